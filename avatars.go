@@ -0,0 +1,119 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols"
+	"github.com/coronanet/go-coronanet/protocols/corona"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// avatarRequest tracks the last avatar retrieval issued to a remote contact.
+type avatarRequest struct {
+	time    time.Time // Time when the last avatar request was sent
+	pending bool      // Whether the last request is still waiting for a reply
+
+	wanted [32]byte    // Avatar hash announced while throttled, to fetch later
+	retry  *time.Timer // Timer to fetch the wanted avatar when the throttle expires
+}
+
+// reserveAvatarRequest checks whether a new avatar request is permitted to be
+// sent to a remote contact, and if so, marks one as in flight. Requests are
+// allowed at most once per throttle period, and never while one is in flight,
+// unless it has seemingly been lost.
+func (b *Backend) reserveAvatarRequest(uid tornet.IdentityFingerprint, now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	req, ok := b.avatars[uid]
+	if ok {
+		if req.pending && now.Sub(req.time) < avatarRequestTimeout {
+			return false
+		}
+		if !req.pending && now.Sub(req.time) < avatarRequestThrottle {
+			return false
+		}
+	} else {
+		req = new(avatarRequest)
+		b.avatars[uid] = req
+	}
+	req.time, req.pending = now, true
+	return true
+}
+
+// completeAvatarRequest marks any in flight avatar request to a remote contact
+// as finished, leaving the throttle in place.
+func (b *Backend) completeAvatarRequest(uid tornet.IdentityFingerprint) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if req, ok := b.avatars[uid]; ok {
+		req.pending = false
+	}
+}
+
+// deferAvatarRequest records an avatar hash announced by a remote contact while
+// requests were throttled, and schedules fetching it once the throttle expires.
+// If the avatar gets updated meanwhile (or the connection is torn down), the
+// deferred request is dropped.
+func (b *Backend) deferAvatarRequest(uid tornet.IdentityFingerprint, hash [32]byte, enc *protocols.Sender, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	req, ok := b.avatars[uid]
+	if !ok {
+		return // Nothing throttling, nothing to defer
+	}
+	req.wanted = hash
+	if req.retry != nil {
+		return // Already scheduled, will pick up the new hash
+	}
+	expiry := req.time.Add(avatarRequestThrottle)
+	if req.pending {
+		expiry = req.time.Add(avatarRequestTimeout)
+	}
+	req.retry = time.AfterFunc(expiry.Sub(now), func() { b.retryAvatarRequest(uid, enc) })
+}
+
+// retryAvatarRequest is invoked when the throttle expires on a contact that has
+// announced an avatar change meanwhile. If the stored avatar is still stale and
+// the contact is still connected, the new avatar is requested.
+func (b *Backend) retryAvatarRequest(uid tornet.IdentityFingerprint, enc *protocols.Sender) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	req, ok := b.avatars[uid]
+	if !ok {
+		return // Contact deleted meanwhile
+	}
+	req.retry = nil
+
+	if b.peerset[uid] != enc {
+		return // Connection torn down, the next profile exchange will retry
+	}
+	info, err := b.Contact(uid)
+	if err != nil || info.Avatar == req.wanted {
+		return // Contact deleted or avatar already up to date
+	}
+	if req.pending && time.Since(req.time) < avatarRequestTimeout {
+		return // A request is still in flight, it will fetch the latest
+	}
+	req.time, req.pending = time.Now(), true
+
+	b.logger.Debug("Retrying throttled avatar request", "contact", uid)
+	go enc.Encode(&corona.Envelope{GetAvatar: &corona.GetAvatar{}})
+}
+
+// dropAvatarRequests removes the avatar request tracking of a remote contact,
+// cancelling any deferred retries.
+//
+// Note, this method assumes the write lock is held.
+func (b *Backend) dropAvatarRequests(uid tornet.IdentityFingerprint) {
+	if req, ok := b.avatars[uid]; ok && req.retry != nil {
+		req.retry.Stop()
+	}
+	delete(b.avatars, uid)
+}
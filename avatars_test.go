@@ -0,0 +1,124 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols"
+	"github.com/coronanet/go-coronanet/protocols/corona"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that rapid avatar hash changes from a remote contact don't result in a
+// request storm, but are throttled, and that in flight requests are not issued
+// again (e.g. on reconnect) until they complete or are deemed lost.
+func TestAvatarRequestThrottling(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	var (
+		uid   = tornet.IdentityFingerprint("alice")
+		start = time.Now()
+	)
+	// Simulate a contact flapping its avatar every second for a while
+	var requests int
+	for i := 0; i < int(avatarRequestThrottle/time.Second)*3; i++ {
+		now := start.Add(time.Duration(i) * time.Second)
+		if backend.reserveAvatarRequest(uid, now) {
+			requests++
+			backend.completeAvatarRequest(uid)
+		}
+	}
+	if requests != 3 {
+		t.Fatalf("avatar request count mismatch: have %d, want %d", requests, 3)
+	}
+	// Issue a request without completing it and ensure it's not repeated, even
+	// after the throttle period expires
+	now := start.Add(time.Hour)
+	if !backend.reserveAvatarRequest(uid, now) {
+		t.Fatalf("avatar request denied after throttle period")
+	}
+	if backend.reserveAvatarRequest(uid, now.Add(avatarRequestThrottle)) {
+		t.Fatalf("in flight avatar request reissued")
+	}
+	// After the request is deemed lost, ensure a new one can be sent
+	if !backend.reserveAvatarRequest(uid, now.Add(avatarRequestTimeout)) {
+		t.Fatalf("lost avatar request not reissued")
+	}
+	// Other contacts must not be affected by the throttle
+	if !backend.reserveAvatarRequest(tornet.IdentityFingerprint("bob"), now) {
+		t.Fatalf("unrelated contact throttled")
+	}
+}
+
+// Tests that an avatar change announced while throttled is not lost, but gets
+// fetched once the throttle expires, unless the avatar got updated meanwhile.
+func TestAvatarRequestDeferral(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	// Create a connected contact with a stale avatar
+	uid := tornet.IdentityFingerprint("alice")
+	blob, _ := json.Marshal(&contact{Name: "Alice"})
+	if err := backend.database.Put(append(dbContactPrefix, uid...), blob, nil); err != nil {
+		t.Fatalf("failed to store contact: %v", err)
+	}
+	reader, writer := io.Pipe()
+	defer reader.Close()
+
+	enc := protocols.NewSender(gob.NewEncoder(writer))
+	defer enc.Close()
+	backend.peerset[uid] = enc
+
+	// Issue an avatar request whose throttle just expired and defer a new one
+	now := time.Now()
+	if !backend.reserveAvatarRequest(uid, now.Add(-avatarRequestThrottle)) {
+		t.Fatalf("initial avatar request denied")
+	}
+	backend.completeAvatarRequest(uid)
+	backend.deferAvatarRequest(uid, [32]byte{1}, enc, now)
+
+	// Ensure the deferred request goes out over the live connection
+	reqs := make(chan *corona.Envelope, 1)
+	go func() {
+		message := new(corona.Envelope)
+		if err := gob.NewDecoder(reader).Decode(message); err == nil {
+			reqs <- message
+		}
+	}()
+	select {
+	case message := <-reqs:
+		if message.GetAvatar == nil {
+			t.Fatalf("deferred request mismatch: have %+v, want avatar request", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("deferred avatar request not sent")
+	}
+	// Defer another request, but update the avatar before it fires
+	backend.completeAvatarRequest(uid)
+
+	backend.lock.Lock()
+	backend.avatars[uid].time = now.Add(-avatarRequestThrottle + 100*time.Millisecond)
+	backend.lock.Unlock()
+
+	backend.deferAvatarRequest(uid, [32]byte{2}, enc, now)
+
+	blob, _ = json.Marshal(&contact{Name: "Alice", Avatar: [32]byte{2}})
+	if err := backend.database.Put(append(dbContactPrefix, uid...), blob, nil); err != nil {
+		t.Fatalf("failed to update contact: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	backend.lock.RLock()
+	pending := backend.avatars[uid].pending
+	backend.lock.RUnlock()
+	if pending {
+		t.Fatalf("avatar requested despite being up to date")
+	}
+}
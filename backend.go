@@ -5,11 +5,16 @@ package coronanet
 
 import (
 	"context"
-	"encoding/gob"
+	"fmt"
+	"net"
+	"net/textproto"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/coronanet/go-coronanet/params"
 	"github.com/coronanet/go-coronanet/protocols"
 	"github.com/coronanet/go-coronanet/protocols/corona"
 	"github.com/coronanet/go-coronanet/protocols/events"
@@ -26,63 +31,261 @@ import (
 // Backend represents the social network node that can connect to other nodes in
 // the network and exchange information.
 type Backend struct {
-	database *leveldb.DB // Database to avoid custom file formats for storage
-	network  *tor.Tor    // Proxy through the Tor network, nil when offline
+	config   BackendConfig // Optional settings, reapplied when switching profiles
+	datadir  string        // Data directory to restart the Tor gateway in
+	database *leveldb.DB   // Database to avoid custom file formats for storage
+	network  *tor.Tor      // Proxy through the Tor network, nil when offline
+	enabled  bool          // Whether networking was enabled by the user
+
+	profileID string // Id of the currently active profile (empty in single-profile mode)
+
+	vault     *vault       // At-rest cipher for secret records (nil = plaintext)
+	vaultLock sync.RWMutex // Lock protecting the vault during passphrase changes
+
+	supervisor   *supervisor         // Health monitor restarting the Tor gateway if stuck
+	liveness     *livenessWatcher    // Monitor for the Tor network going online or offline
+	netCallbacks []func(online bool) // Callbacks to notify of network liveness transitions
 
 	// Social protocol and related fields
-	overlay *tornet.Node     // Overlay network running the Corona protocol
-	dialer  *scheduler       // Dial scheduler to periodically connect to peers
-	pairing *pairing.Pairing // Currently active pairing session (nil if none)
+	overlay *tornet.Node        // Overlay network running the Corona protocol
+	dialer  *scheduler          // Dial scheduler to periodically connect to peers
+	pairing *pairing.Pairing    // Currently active pairing session (nil if none)
+	paired  *pairing.Pairing    // Last successfully completed pairing session (nil if none)
+	joining map[string]struct{} // Remote pairing and checkin sessions currently being joined
+	joins   []time.Time         // Start times of the recent joins for rate limiting
 
-	peerset map[tornet.IdentityFingerprint]*gob.Encoder // Current active connections for updates
+	peerset    map[tornet.IdentityFingerprint]*protocols.Sender // Current active connections for updates
+	broadcasts map[string]*pendingBroadcast                     // Broadcasts waiting to be coalesced, keyed by type
+	avatars    map[tornet.IdentityFingerprint]*avatarRequest    // Avatar requests issued per contact for throttling
+	contacted  map[tornet.IdentityFingerprint]time.Time         // Last time each contact was connected (for diagnostics)
+	synced     map[tornet.IdentityFingerprint]time.Time         // Last time an explicit sync was requested per contact
+	refreshed  time.Time                                        // Last time a refresh of everything was requested
 
 	// Event protocol and related fields
 	hosted  map[tornet.IdentityFingerprint]*events.Server         // Locally hosted and maintained events
 	checkin map[tornet.IdentityFingerprint]*events.CheckinSession // Active checkin session per hosted event
 	joined  map[tornet.IdentityFingerprint]*events.Client         // Remotely joined and watched events
+	planner *planner                                              // Planner creating the scheduled events when due
+	skipped []IntegrityIssue                                      // Corrupt event records skipped on startup
+
+	historyLock sync.Mutex // Lock serializing the sampling of hosted event stats
 
-	logger log.Logger // Contextual logger to embed outside tags
+	bannerFailures map[tornet.IdentityFingerprint]int // Consecutive banner loading failures per hosted event
+	bannerLock     sync.Mutex                         // Lock protecting the banner failure counters
+
+	// Event housekeeping fields
+	reminder    time.Duration                            // Inactivity period after which to remind the organizer
+	termination time.Duration                            // Inactivity period after which to terminate the event (0 = never)
+	reminded    map[tornet.IdentityFingerprint]time.Time // Events already reminded about, at which update timestamp
+	housekeeper chan chan struct{}                       // Quit channel for the event housekeeping loop
+
+	quotaExceeded bool // Whether the storage quota was exceeded at the last check (to avoid repeated warnings)
+
+	feed   *feed        // Notification feed for user interfaces to react to
+	tracer atomic.Value // Optional protocol message tracer for debugging (protocols.Tracer)
+	logger log.Logger   // Contextual logger to embed outside tags
 	lock   sync.RWMutex
 }
 
+// BackendConfig contains optional settings to fine tune the backend with. The
+// zero value is what NewBackend runs with.
+type BackendConfig struct {
+	Integrity    bool   // Whether to check the database on startup, quarantining corrupt records
+	Passphrase   string // Passphrase to encrypt secret records at rest with (empty = plaintext)
+	MultiProfile bool   // Whether to host multiple independent profiles, selectable at runtime
+
+	Clock tornet.Clock // Source of time for dial scheduling (nil = system clock)
+
+	AddressRotation time.Duration // Interval to rotate the onion addresses at (0 = only on untrust)
+	HistoryInterval time.Duration // Minimum time between two hosted event stats snapshots (0 = hourly)
+
+	StorageQuota uint64 // Soft limit on the data directory size, above which old event banners are evicted (0 = unlimited)
+
+	TorControl  string // Control port address of an external Tor to use (empty = start embedded Tor)
+	TorPassword string // Control port password of the external Tor (empty = no auth or cookie auth)
+	TorSocks    string // SOCKS proxy address of the external Tor (empty = query via the control port)
+
+	Gateway tornet.Gateway // Gateway to use instead of Tor, mostly for tests (nil = use Tor)
+}
+
 // NewBackend creates a new social network node.
 func NewBackend(datadir string, logger log.Logger) (*Backend, error) {
+	return NewBackendWithConfig(datadir, BackendConfig{}, logger)
+}
+
+// NewBackendWithGateway creates a new social network node which communicates via
+// the given gateway instead of starting up Tor. Its purpose is to allow running
+// full backends on top of the mock gateway in tests.
+func NewBackendWithGateway(datadir string, gateway tornet.Gateway, logger log.Logger) (*Backend, error) {
+	return NewBackendWithConfig(datadir, BackendConfig{Gateway: gateway}, logger)
+}
+
+// NewBackendWithConfig creates a new social network node with some optional
+// settings fine tuned.
+func NewBackendWithConfig(datadir string, config BackendConfig, logger log.Logger) (*Backend, error) {
 	// Create the database for accessing locally stored data
 	db, err := leveldb.OpenFile(filepath.Join(datadir, "ldb"), &opt.Options{})
 	if err != nil {
 		return nil, err
 	}
-	// Create the Tor background process for accessing remote data
-	net, err := tor.Start(nil, &tor.StartConf{
-		ProcessCreator:         libtor.Creator,
-		UseEmbeddedControlConn: true,
-		DataDir:                filepath.Join(datadir, "tor"),
-		//DebugWriter:            os.Stderr,
-		//NoHush:                 true,
-	})
-	if err != nil {
-		db.Close()
-		return nil, err
+	// Create the Tor background process for accessing remote data, unless a
+	// gateway was explicitly provided
+	var net *tor.Tor
+	if config.Gateway == nil {
+		if net, err = startTor(datadir, config); err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
 	// Create an idle backend; if there's already a user profile, assemble the overlay
 	backend := &Backend{
-		database: db,
-		network:  net,
-		peerset:  make(map[tornet.IdentityFingerprint]*gob.Encoder),
-		logger:   logger,
+		config:         config,
+		datadir:        datadir,
+		database:       db,
+		network:        net,
+		joining:        make(map[string]struct{}),
+		peerset:        make(map[tornet.IdentityFingerprint]*protocols.Sender),
+		broadcasts:     make(map[string]*pendingBroadcast),
+		avatars:        make(map[tornet.IdentityFingerprint]*avatarRequest),
+		contacted:      make(map[tornet.IdentityFingerprint]time.Time),
+		synced:         make(map[tornet.IdentityFingerprint]time.Time),
+		reminder:       params.EventInactivityReminder,
+		termination:    params.EventInactivityTermination,
+		reminded:       make(map[tornet.IdentityFingerprint]time.Time),
+		bannerFailures: make(map[tornet.IdentityFingerprint]int),
+		housekeeper:    make(chan chan struct{}),
+		feed:           newFeed(),
+		logger:         logger,
+	}
+	if config.MultiProfile {
+		backend.profileID = defaultProfileID
 	}
 	backend.dialer = newScheduler(backend)
 
+	// Resume interrupted deletions, upgrade the schema and unlock the encryption
+	vault, err := prepareDatabase(db, config, logger)
+	if err != nil {
+		backend.dialer.close()
+		if net != nil {
+			net.Close()
+		}
+		db.Close()
+		return nil, err
+	}
+	backend.vault = vault
+
 	if prof, err := backend.Profile(); err == nil {
 		if err := backend.initOverlay(*prof.KeyRing); err != nil {
-			net.Close()
+			if net != nil {
+				net.Close()
+			}
 			db.Close()
 			return nil, err
 		}
 	}
+	go backend.housekeep()
+
+	backend.planner = newPlanner(backend, backend.gateway)
+
+	// If running on an injected gateway, there's no Tor process to monitor
+	if net == nil {
+		return backend, nil
+	}
+	backend.supervisor = newSupervisor(backend.checkGateway, backend.restartGateway,
+		supervisorCheckInterval, supervisorFailureThreshold, supervisorRestartBackoff,
+		supervisorRestartBackoffMax, logger.New("supervisor", "tor"))
+
+	backend.liveness = newLivenessWatcher(backend.control, backend.networkChanged,
+		livenessResubscribeDelay, logger.New("liveness", "tor"))
+
 	return backend, nil
 }
 
+// startTor launches an embedded Tor process with networking disabled, storing
+// its state within the given data directory. If an external Tor instance was
+// configured, it is connected to instead.
+func startTor(datadir string, config BackendConfig) (*tor.Tor, error) {
+	if config.TorControl != "" {
+		return connectTor(config.TorControl, config.TorPassword)
+	}
+	return tor.Start(nil, &tor.StartConf{
+		ProcessCreator:         libtor.Creator,
+		UseEmbeddedControlConn: true,
+		DataDir:                filepath.Join(datadir, "tor"),
+		//DebugWriter:            os.Stderr,
+		//NoHush:                 true,
+	})
+}
+
+// connectTor attaches to an already running Tor instance through its control
+// port. The external process is not owned by the backend, closing the returned
+// Tor only drops the control connection, it does not halt the process.
+//
+// The control port may be unauthenticated, or protected by a cookie file (which
+// is picked up automatically from the path Tor reports) or by a password.
+//
+// Note, onion services are forwarded to local listeners, so the external Tor
+// needs to run on the same machine (or network namespace).
+func connectTor(address string, password string) (*tor.Tor, error) {
+	_, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := textproto.Dial("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Tor control port: %v", err)
+	}
+	ctrl := control.NewConn(conn)
+	if err := ctrl.Authenticate(password); err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("failed to authenticate to Tor control port: %v", err)
+	}
+	return &tor.Tor{
+		Control:            ctrl,
+		ControlPort:        port,
+		StopProcessOnClose: false,
+	}, nil
+}
+
+// gateway returns a Tor gateway through the currently running Tor process. The
+// process might be swapped out by the supervisor, so any code not holding the
+// backend lock must retrieve the gateway through this method.
+func (b *Backend) gateway() tornet.Gateway {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.torGateway()
+}
+
+// torGateway returns a Tor gateway through the currently running Tor process,
+// dialing out through the configured SOCKS proxy if any. If a gateway was
+// injected instead of Tor, that is returned.
+//
+// Note, this method assumes the read lock is held.
+func (b *Backend) torGateway() tornet.Gateway {
+	if b.config.Gateway != nil {
+		return b.config.Gateway
+	}
+	if b.config.TorSocks != "" {
+		return tornet.NewTorGatewayWithSocks(b.network, b.config.TorSocks)
+	}
+	return tornet.NewTorGateway(b.network)
+}
+
+// control returns the control connection of the currently running Tor process.
+// The process might be swapped out by the supervisor, so any code not holding
+// the backend lock must retrieve the connection through this method.
+func (b *Backend) control() *control.Conn {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.network.Control
+}
+
 // initOverlay initializes the application layer networking protocols that will
 // the within the backend.
 //
@@ -94,7 +297,7 @@ func (b *Backend) initOverlay(keyring tornet.SecretKeyRing) error {
 		panic("overlay double initialized")
 	}
 	overlay, err := tornet.NewNode(tornet.NodeConfig{
-		Gateway:     tornet.NewTorGateway(b.network),
+		Gateway:     b.torGateway(),
 		KeyRing:     keyring,
 		RingHandler: b.updateKeyring,
 		ConnHandler: protocols.MakeHandler(protocols.HandlerConfig{
@@ -102,9 +305,16 @@ func (b *Backend) initOverlay(keyring tornet.SecretKeyRing) error {
 			Handlers: map[uint]protocols.Handler{
 				1: b.handleContactV1,
 			},
+			Capabilities: []string{protocols.CapabilityKeepalive},
+			Tracer:       b.Tracer,
+			Envelope:     func() interface{} { return new(corona.Envelope) },
+			Keepalive:    connectionKeepalive,
+			Ping:         func(ping *protocols.Ping) interface{} { return &corona.Envelope{Ping: ping} },
 		}),
-		ConnTimeout: connectionIdleTimeout,
-		Logger:      b.logger,
+		ConnTimeout:      connectionIdleTimeout,
+		Clock:            b.config.Clock,
+		RotationInterval: b.config.AddressRotation,
+		Logger:           b.logger,
 	})
 	if err != nil {
 		return err
@@ -142,28 +352,108 @@ func (b *Backend) nukeOverlay() error {
 
 // Close tears down the backend. It's irreversible, it cannot be used afterwards.
 func (b *Backend) Close() error {
+	// Stop the gateway supervisor to avoid it restarting Tor during teardown
+	if b.supervisor != nil {
+		b.supervisor.close()
+	}
+	if b.liveness != nil {
+		b.liveness.close()
+	}
+	// Stop the event housekeeping to avoid it racing with the teardown
+	quit := make(chan struct{})
+	b.housekeeper <- quit
+	<-quit
+
+	// Stop the event planner to avoid it spawning events during teardown
+	b.planner.close()
+
+	// Drop any pending broadcasts, we won't be around to send them
+	b.lock.Lock()
+	for kind, pending := range b.broadcasts {
+		pending.timer.Stop()
+		delete(b.broadcasts, kind)
+	}
+	b.lock.Unlock()
+
 	// Stop initiating and accepting outbound connections, drop everyone
 	b.dialer.close()
 	b.nukeOverlay()
 
 	// Disable and tear down the Tor gateway
-	b.network.Close()
-	b.network = nil
+	if b.network != nil {
+		b.network.Close()
+		b.network = nil
+	}
 
-	// Close the database and return
+	// Close the database and return. Hold the lock to sync with any async keyring
+	// update still in flight.
+	b.lock.Lock()
 	b.database.Close()
 	b.database = nil
+	b.lock.Unlock()
 
 	return nil
 }
 
+// Shutdown gracefully tears down the backend. Unlike Close, it first stops all
+// networking components from accepting new connections and waits (bounded by
+// the context) for active contact and event exchanges to finish processing any
+// in-flight messages. The backend is torn down even if the context expires, in
+// which case the context error is returned.
+func (b *Backend) Shutdown(ctx context.Context) error {
+	err := b.drain(ctx)
+	b.Close()
+	return err
+}
+
+// drain stops the social overlay and all the hosted and joined events from
+// accepting new connections and waits (bounded by the context) for their active
+// handlers to reach a quiescent point.
+func (b *Backend) drain(ctx context.Context) error {
+	var drainers []interface{ Drain(context.Context) error }
+
+	b.lock.RLock()
+	if b.overlay != nil {
+		drainers = append(drainers, b.overlay)
+	}
+	for _, server := range b.hosted {
+		drainers = append(drainers, server)
+	}
+	for _, client := range b.joined {
+		drainers = append(drainers, client)
+	}
+	b.lock.RUnlock()
+
+	errc := make(chan error, len(drainers))
+	for _, drainer := range drainers {
+		go func(drainer interface{ Drain(context.Context) error }) {
+			errc <- drainer.Drain(ctx)
+		}(drainer)
+	}
+	var err error
+	for range drainers {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
 // EnableGateway opens up the network proxy into the Tor network and starts
 // building out the P2P overlay network on top. The method is async.
 func (b *Backend) EnableGateway() error {
 	b.logger.Info("Enabling gateway networking")
-	if err := b.network.EnableNetwork(context.Background(), false); err != nil {
-		return err
+
+	b.lock.Lock()
+	if b.network != nil {
+		if err := b.network.EnableNetwork(context.Background(), false); err != nil {
+			b.lock.Unlock()
+			return err
+		}
 	}
+	b.enabled = true
+	b.lock.Unlock()
+
 	// Networking enabled, resume all scheduled dials
 	prof, err := b.Profile()
 	if err != nil {
@@ -183,9 +473,17 @@ func (b *Backend) EnableGateway() error {
 // all active connections and closes off he network proxy from Tor.
 func (b *Backend) DisableGateway() error {
 	b.logger.Info("Disabling gateway networking")
-	if err := b.network.Control.SetConf(control.KeyVals("DisableNetwork", "1")...); err != nil {
-		return err
+
+	b.lock.Lock()
+	if b.network != nil {
+		if err := b.network.Control.SetConf(control.KeyVals("DisableNetwork", "1")...); err != nil {
+			b.lock.Unlock()
+			return err
+		}
 	}
+	b.enabled = false
+	b.lock.Unlock()
+
 	// Networking disabled, suspend all scheduled dials as pointless
 	b.dialer.suspend()
 
@@ -202,18 +500,28 @@ func (b *Backend) DisableGateway() error {
 // works or not; and the download and upload traffic incurred since starting it.
 func (b *Backend) GatewayStatus() (bool, bool, uint64, uint64, error) {
 	// Retrieve whether the network is enabled or not
-	res, err := b.network.Control.GetConf("DisableNetwork")
+	b.lock.RLock()
+	network, enabled := b.network, b.enabled
+	b.lock.RUnlock()
+
+	// If running on an injected gateway, it's connected whenever enabled
+	if network == nil {
+		return enabled, enabled, 0, 0, nil
+	}
+	res, err := network.Control.GetConf("DisableNetwork")
 	if err != nil {
 		return false, false, 0, 0, err
 	}
-	enabled := res[0].Val == "0"
+	enabled = res[0].Val == "0"
 
 	// Retrieve some status metrics from Tor itself
-	res, err = b.network.Control.GetInfo("status/circuit-established", "traffic/read", "traffic/written", "network-liveness")
+	res, err = network.Control.GetInfo("status/circuit-established", "traffic/read", "traffic/written", "network-liveness")
 	if err != nil {
 		return enabled, false, 0, 0, err
 	}
-	connected := res[0].Val == "1" // TODO(karalabe): this doesn't seem to detect going offline, help?
+	// Circuits established are not torn down when the network is lost, so check
+	// Tor's own liveness estimate too to detect going offline.
+	connected := res[0].Val == "1" && res[3].Val == "up"
 
 	ingress, err := strconv.ParseUint(res[1].Val, 0, 64)
 	if err != nil {
@@ -225,3 +533,10 @@ func (b *Backend) GatewayStatus() (bool, bool, uint64, uint64, error) {
 	}
 	return enabled, connected, ingress, egress, nil
 }
+
+// TrafficByProtocol returns the application level traffic incurred by each of
+// the protocols (contact sync, events and pairing) since the process started,
+// including connections already torn down.
+func (b *Backend) TrafficByProtocol() map[string]protocols.Traffic {
+	return protocols.TrafficByProtocol()
+}
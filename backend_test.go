@@ -0,0 +1,230 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols"
+	"github.com/coronanet/go-coronanet/protocols/corona"
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// newTestBackend creates an offline backend with an in-memory database, without
+// any Tor networking or background processes attached.
+func newTestBackend(t *testing.T) *Backend {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("failed to create in-memory database: %v", err)
+	}
+	return &Backend{
+		database:       db,
+		peerset:        make(map[tornet.IdentityFingerprint]*protocols.Sender),
+		broadcasts:     make(map[string]*pendingBroadcast),
+		avatars:        make(map[tornet.IdentityFingerprint]*avatarRequest),
+		contacted:      make(map[tornet.IdentityFingerprint]time.Time),
+		synced:         make(map[tornet.IdentityFingerprint]time.Time),
+		hosted:         make(map[tornet.IdentityFingerprint]*events.Server),
+		checkin:        make(map[tornet.IdentityFingerprint]*events.CheckinSession),
+		joined:         make(map[tornet.IdentityFingerprint]*events.Client),
+		reminded:       make(map[tornet.IdentityFingerprint]time.Time),
+		bannerFailures: make(map[tornet.IdentityFingerprint]int),
+		housekeeper:    make(chan chan struct{}),
+		feed:           newFeed(),
+		logger:         log.Root(),
+	}
+}
+
+// newTestProfile creates a new local user in a test backend and starts up its
+// social overlay network through the given gateway.
+func newTestProfile(t *testing.T, backend *Backend, gateway tornet.Gateway) {
+	keyring, err := tornet.GenerateKeyRing()
+	if err != nil {
+		t.Fatalf("failed to generate keyring: %v", err)
+	}
+	blob, err := json.Marshal(&profile{KeyRing: &keyring})
+	if err != nil {
+		t.Fatalf("failed to marshal profile: %v", err)
+	}
+	if err := backend.database.Put(dbProfileKey, blob, nil); err != nil {
+		t.Fatalf("failed to store profile: %v", err)
+	}
+	startTestOverlay(t, backend, gateway)
+}
+
+// startTestOverlay starts up the social overlay network of the existing local
+// user in a test backend through the given gateway.
+func startTestOverlay(t *testing.T, backend *Backend, gateway tornet.Gateway) {
+	prof, err := backend.Profile()
+	if err != nil {
+		t.Fatalf("failed to retrieve profile: %v", err)
+	}
+	backend.dialer = newScheduler(backend)
+	backend.overlay, err = tornet.NewNode(tornet.NodeConfig{
+		Gateway:     gateway,
+		KeyRing:     *prof.KeyRing,
+		RingHandler: backend.updateKeyring,
+		ConnHandler: protocols.MakeHandler(protocols.HandlerConfig{
+			Protocol: corona.Protocol,
+			Handlers: map[uint]protocols.Handler{
+				1: backend.handleContactV1,
+			},
+			Tracer:   backend.Tracer,
+			Envelope: func() interface{} { return new(corona.Envelope) },
+		}),
+		Clock:  backend.config.Clock,
+		Logger: backend.logger,
+	})
+	if err != nil {
+		t.Fatalf("failed to create overlay: %v", err)
+	}
+}
+
+// newTestGatewayBackend creates a fully fledged backend in a temporary data
+// directory, communicating through the given gateway instead of Tor.
+func newTestGatewayBackend(t *testing.T, gateway tornet.Gateway) *Backend {
+	datadir, err := ioutil.TempDir("", "coronanet-backend-")
+	if err != nil {
+		t.Fatalf("failed to create temporary datadir: %v", err)
+	}
+	backend, err := NewBackendWithGateway(datadir, gateway, log.Root())
+	if err != nil {
+		os.RemoveAll(datadir)
+		t.Fatalf("failed to create backend: %v", err)
+	}
+	return backend
+}
+
+// Tests that backends running on top of the mock gateway can go through a full
+// pairing flow, without waiting for any Tor circuits to build.
+func TestBackendWithGateway(t *testing.T) {
+	gateway := tornet.NewMockGateway()
+
+	alice := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(alice.datadir)
+	defer alice.Close()
+
+	bob := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(bob.datadir)
+	defer bob.Close()
+
+	for _, backend := range []*Backend{alice, bob} {
+		if err := backend.CreateProfile(); err != nil {
+			t.Fatalf("failed to create profile: %v", err)
+		}
+		if ready, details := backend.Healthy(); !ready {
+			t.Fatalf("backend unhealthy: %v", details)
+		}
+		if _, connected, _, _, _ := backend.GatewayStatus(); connected {
+			t.Fatalf("disabled gateway reported connected")
+		}
+		if err := backend.EnableGateway(); err != nil {
+			t.Fatalf("failed to enable gateway: %v", err)
+		}
+		if enabled, connected, _, _, err := backend.GatewayStatus(); err != nil || !enabled || !connected {
+			t.Fatalf("gateway status mismatch: have %v/%v/%v, want true/true/nil", enabled, connected, err)
+		}
+	}
+	// Pair the two backends and ensure it doesn't wait for circuits
+	start := time.Now()
+
+	secret, address, err := alice.InitPairing()
+	if err != nil {
+		t.Fatalf("failed to initiate pairing: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := bob.JoinPairing(secret, address)
+		errc <- err
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	contact, err := alice.WaitPairing(ctx)
+	if err != nil {
+		t.Fatalf("failed to wait for pairing: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to join pairing: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("pairing too slow: have %v, want < %v", elapsed, 3*time.Second)
+	}
+	prof, err := bob.Profile()
+	if err != nil {
+		t.Fatalf("failed to retrieve profile: %v", err)
+	}
+	if want := prof.KeyRing.Identity.Fingerprint(); contact != want {
+		t.Fatalf("paired contact mismatch: have %v, want %v", contact, want)
+	}
+	if contacts, err := alice.Contacts(); err != nil || len(contacts) != 1 {
+		t.Fatalf("contact list mismatch: have %v (%v), want 1 contact", contacts, err)
+	}
+}
+
+// Tests that an external Tor's control port protected by a password can be
+// authenticated against, and that a wrong password is reported as an error.
+func TestConnectTorPassword(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to open control listener: %v", err)
+	}
+	defer listener.Close()
+
+	// Serve a fake control port accepting only the hex encoded "secret"
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn *textproto.Conn) {
+				defer conn.Close()
+				for {
+					line, err := conn.ReadLine()
+					if err != nil {
+						return
+					}
+					switch {
+					case strings.HasPrefix(line, "PROTOCOLINFO"):
+						conn.PrintfLine("250-PROTOCOLINFO 1")
+						conn.PrintfLine("250-AUTH METHODS=HASHEDPASSWORD")
+						conn.PrintfLine("250-VERSION Tor=\"0.4.2.7\"")
+						conn.PrintfLine("250 OK")
+					case line == "AUTHENTICATE "+hex.EncodeToString([]byte("secret")):
+						conn.PrintfLine("250 OK")
+					default:
+						conn.PrintfLine("515 Authentication failed")
+					}
+				}
+			}(textproto.NewConn(conn))
+		}
+	}()
+	address := listener.Addr().String()
+
+	if _, err := connectTor(address, ""); err == nil {
+		t.Fatalf("missing password accepted")
+	}
+	if _, err := connectTor(address, "wrong"); err == nil {
+		t.Fatalf("wrong password accepted")
+	}
+	net, err := connectTor(address, "secret")
+	if err != nil {
+		t.Fatalf("failed to authenticate with password: %v", err)
+	}
+	net.Close()
+}
@@ -5,6 +5,8 @@
 package bridge
 
 import (
+	"context"
+	"errors"
 	"os"
 
 	"github.com/coronanet/go-coronanet"
@@ -32,7 +34,7 @@ func NewBridge(datadir string) (*Bridge, error) {
 	if err != nil {
 		return nil, err
 	}
-	bridge, err := ghostbridge.New(rest.New(backend, log.Root()))
+	bridge, err := ghostbridge.New(rest.New(backend, rest.Options{}, log.Root()))
 	if err != nil {
 		return nil, err
 	}
@@ -80,3 +82,70 @@ func (b *Bridge) EnableGateway() error {
 func (b *Bridge) DisableGateway() error {
 	return b.backend.DisableGateway()
 }
+
+// Cancellation is a handle to abort a blocking bridge call from a different
+// thread, since gomobile cannot pass Go contexts or channels across.
+type Cancellation struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewCancellation creates a handle to abort a blocking bridge call with.
+func NewCancellation() *Cancellation {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Cancellation{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Cancel aborts the blocking call the handle was passed to. It is safe to call
+// multiple times.
+func (c *Cancellation) Cancel() {
+	c.cancel()
+}
+
+// InitPairing is a pass-through method to allow directly calling Backend.InitPairing
+// via the mobile library, returning the pairing secret to share with the remote
+// user (the same 64 byte blob the REST API returns).
+func (b *Bridge) InitPairing() ([]byte, error) {
+	secret, address, err := b.backend.InitPairing()
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, secret...), address...), nil
+}
+
+// WaitPairing is a pass-through method to allow directly calling Backend.WaitPairing
+// via the mobile library. The call blocks until the pairing session is joined
+// or the cancellation handle (optional) is triggered.
+func (b *Bridge) WaitPairing(cancel *Cancellation) (string, error) {
+	ctx := context.Background()
+	if cancel != nil {
+		ctx = cancel.ctx
+	}
+	uid, err := b.backend.WaitPairing(ctx)
+	if err != nil {
+		return "", err
+	}
+	return string(uid), nil
+}
+
+// JoinPairing is a pass-through method to allow directly calling Backend.JoinPairing
+// via the mobile library, using the pairing secret obtained from the remote user.
+func (b *Bridge) JoinPairing(secret []byte) (string, error) {
+	if len(secret) != 64 {
+		return "", errors.New("invalid pairing secret: not 64 bytes")
+	}
+	uid, err := b.backend.JoinPairing(secret[:32], secret[32:])
+	if err != nil {
+		return "", err
+	}
+	return string(uid), nil
+}
+
+// AbortPairing is a pass-through method to allow directly calling Backend.AbortPairing
+// via the mobile library.
+func (b *Bridge) AbortPairing() error {
+	return b.backend.AbortPairing()
+}
@@ -0,0 +1,75 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package bridge
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that the cancellation handle aborts its context and is safe to trigger
+// multiple times.
+func TestCancellation(t *testing.T) {
+	cancel := NewCancellation()
+	select {
+	case <-cancel.ctx.Done():
+		t.Fatalf("fresh cancellation already aborted")
+	default:
+	}
+	cancel.Cancel()
+	cancel.Cancel()
+
+	select {
+	case <-cancel.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("cancellation not aborted")
+	}
+}
+
+// Tests that malformed pairing secrets are rejected before reaching the backend.
+func TestJoinPairingInvalidSecret(t *testing.T) {
+	bridge := new(Bridge)
+	for _, secret := range [][]byte{nil, make([]byte, 32), make([]byte, 65)} {
+		if _, err := bridge.JoinPairing(secret); err == nil {
+			t.Errorf("secret of %d bytes accepted", len(secret))
+		}
+	}
+}
+
+// Tests that the pairing pass-through methods reach a live backend and surface
+// its errors when there is nothing to pair with.
+func TestPairingPassThrough(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "coronanet-bridge-")
+	if err != nil {
+		t.Fatalf("failed to create temporary datadir: %v", err)
+	}
+	defer os.RemoveAll(datadir)
+
+	bridge, err := NewBridge(datadir)
+	if err != nil {
+		t.Fatalf("failed to create bridge: %v", err)
+	}
+	defer bridge.backend.Close()
+	defer bridge.Close()
+
+	if _, err := bridge.InitPairing(); err != coronanet.ErrProfileNotFound {
+		t.Errorf("init error mismatch: have %v, want %v", err, coronanet.ErrProfileNotFound)
+	}
+	secret, _ := tornet.GenerateIdentity()
+	address, _ := tornet.GenerateAddress()
+	if _, err := bridge.JoinPairing(append(append([]byte{}, secret...), address.Public()...)); err != coronanet.ErrProfileNotFound {
+		t.Errorf("join error mismatch: have %v, want %v", err, coronanet.ErrProfileNotFound)
+	}
+	if _, err := bridge.WaitPairing(NewCancellation()); err != coronanet.ErrNotPairing {
+		t.Errorf("wait error mismatch: have %v, want %v", err, coronanet.ErrNotPairing)
+	}
+	if err := bridge.AbortPairing(); err != coronanet.ErrNotPairing {
+		t.Errorf("abort error mismatch: have %v, want %v", err, coronanet.ErrNotPairing)
+	}
+}
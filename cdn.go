@@ -4,21 +4,99 @@
 package coronanet
 
 import (
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"io/ioutil"
 
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"golang.org/x/crypto/sha3"
 )
 
 var (
-	dbCDNImagePrefix    = []byte("cdn-image-")
-	dbCDNImageRefSuffix = []byte("-refs")
+	dbCDNImagePrefix      = []byte("cdn-image-")
+	dbCDNImageRefSuffix   = []byte("-refs")
+	dbCDNImageThumbSuffix = []byte("-thumb")
 
 	// ErrImageNotFound is returned if an image is attempted to be read from the
 	// CDN but it is not found.
 	ErrImageNotFound = errors.New("image not found")
+
+	// ErrImageTooLarge is returned if an image is attempted to be uploaded into
+	// the CDN but it exceeds the permitted size.
+	ErrImageTooLarge = errors.New("image too large")
 )
 
+// cdnImageMeta retrieves the number of live references to a hash and whether
+// the blob is stored compressed.
+//
+// The metadata is the uvarint encoded ref count, optionally followed by a flag
+// byte marking compression (older entries have no flag, being uncompressed).
+func (b *Backend) cdnImageMeta(hash [32]byte) (uint64, bool) {
+	blob, err := b.database.Get(append(append(dbCDNImagePrefix, hash[:]...), dbCDNImageRefSuffix...), nil)
+	if err != nil {
+		return 0, false
+	}
+	refs, n := binary.Uvarint(blob) // TODO(karalabe): Maybe check for errors?
+	if n <= 0 || n >= len(blob) {
+		return refs, false
+	}
+	return refs, blob[n] == 1
+}
+
+// storeCDNImageMeta updates the number of live references to a hash along with
+// its compression flag.
+func (b *Backend) storeCDNImageMeta(hash [32]byte, refs uint64, compressed bool) error {
+	blob := make([]byte, binary.MaxVarintLen64+1)
+	blob = blob[:binary.PutUvarint(blob, refs)]
+	if compressed {
+		blob = append(blob, 1)
+	}
+	return b.database.Put(append(append(dbCDNImagePrefix, hash[:]...), dbCDNImageRefSuffix...), blob, nil)
+}
+
+// cdnCompressedFormats are the magic byte prefixes of image formats that are
+// already compressed, so attempting to deflate them is just wasted CPU.
+var cdnCompressedFormats = [][]byte{
+	{0xff, 0xd8, 0xff}, // JPEG
+	{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}, // PNG
+	[]byte("GIF8"), // GIF
+	[]byte("RIFF"), // WebP (RIFF container)
+}
+
+// compressCDNImage attempts to compress a blob, returning the compressed version
+// if it's large enough to bother with and the savings are meaningful, or nil if
+// the blob should be stored as is (e.g. already compressed images).
+func compressCDNImage(data []byte) []byte {
+	if len(data) < cdnCompressionThreshold {
+		return nil
+	}
+	for _, magic := range cdnCompressedFormats {
+		if bytes.HasPrefix(data, magic) {
+			return nil
+		}
+	}
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil
+	}
+	if err := w.Close(); err != nil {
+		return nil
+	}
+	if buf.Len() > len(data)-len(data)/cdnCompressionMinSaving {
+		return nil
+	}
+	return buf.Bytes()
+}
+
 // uploadCDNImage inserts a binary image blob by hash into the CND and increments
 // its reference count.
 func (b *Backend) uploadCDNImage(data []byte) ([32]byte, error) {
@@ -26,29 +104,26 @@ func (b *Backend) uploadCDNImage(data []byte) ([32]byte, error) {
 	hash := sha3.Sum256(data)
 
 	// Retrieve the number of live references to this hash
-	var refs uint64
-	if blob, err := b.database.Get(append(append(dbCDNImagePrefix, hash[:]...), dbCDNImageRefSuffix...), nil); err == nil {
-		refs, _ = binary.Uvarint(blob) // TODO(karalabe): Maybe check for errors?
-	}
+	refs, compressed := b.cdnImageMeta(hash)
+
 	// If there are no live references, upload the image; either way, bump the refs
 	if refs == 0 {
-		if err := b.database.Put(append(dbCDNImagePrefix, hash[:]...), data, nil); err != nil {
+		blob, packed := data, compressCDNImage(data)
+		if compressed = packed != nil; compressed {
+			blob = packed
+		}
+		if err := b.database.Put(append(dbCDNImagePrefix, hash[:]...), blob, nil); err != nil {
 			return [32]byte{}, err
 		}
 	}
-	blob := make([]byte, binary.MaxVarintLen64)
-	blob = blob[:binary.PutUvarint(blob, refs+1)]
-	return hash, b.database.Put(append(append(dbCDNImagePrefix, hash[:]...), dbCDNImageRefSuffix...), blob, nil)
+	return hash, b.storeCDNImageMeta(hash, refs+1, compressed)
 }
 
 // deleteCDNImage dereferences an image from the CDN and deletes it if the ref
 // count reaches zero.
 func (b *Backend) deleteCDNImage(hash [32]byte) error {
 	// Retrieve the number of live references to this hash, skip if zero
-	var refs uint64
-	if blob, err := b.database.Get(append(append(dbCDNImagePrefix, hash[:]...), dbCDNImageRefSuffix...), nil); err == nil {
-		refs, _ = binary.Uvarint(blob) // TODO(karalabe): Maybe check for errors?
-	}
+	refs, compressed := b.cdnImageMeta(hash)
 	if refs == 0 {
 		return nil
 	}
@@ -57,10 +132,11 @@ func (b *Backend) deleteCDNImage(hash [32]byte) error {
 		if err := b.database.Delete(append(dbCDNImagePrefix, hash[:]...), nil); err != nil {
 			return err
 		}
+		if err := b.database.Delete(append(append(dbCDNImagePrefix, hash[:]...), dbCDNImageThumbSuffix...), nil); err != nil {
+			return err
+		}
 	}
-	blob := make([]byte, binary.MaxVarintLen64)
-	blob = blob[:binary.PutUvarint(blob, refs-1)]
-	return b.database.Put(append(append(dbCDNImagePrefix, hash[:]...), dbCDNImageRefSuffix...), blob, nil)
+	return b.storeCDNImageMeta(hash, refs-1, compressed)
 }
 
 // CDNImage retrieves an image from the CDN.
@@ -69,5 +145,169 @@ func (b *Backend) CDNImage(hash [32]byte) ([]byte, error) {
 	if err != nil {
 		return nil, ErrImageNotFound
 	}
+	if _, compressed := b.cdnImageMeta(hash); compressed {
+		return ioutil.ReadAll(flate.NewReader(bytes.NewReader(blob)))
+	}
 	return blob, nil
 }
+
+// CDNStats returns the number of images stored in the CDN and the number of
+// bytes they take up (after compression).
+func (b *Backend) CDNStats() (int, uint64, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	var (
+		images int
+		size   uint64
+	)
+	it := b.database.NewIterator(util.BytesPrefix(dbCDNImagePrefix), nil)
+	defer it.Release()
+
+	for it.Next() {
+		if len(it.Key()) == len(dbCDNImagePrefix)+32 {
+			images++
+			size += uint64(len(it.Value()))
+		}
+	}
+	return images, size, it.Error()
+}
+
+// SweepCDN cross references all the images in the CDN with the entities that
+// reference them (profile, contact and participant avatars, event banners and
+// message attachments), deleting images nobody references anymore and repairing any
+// reference counts that drifted. The number of deleted images is returned.
+//
+// The sweep holds the write lock throughout. Since every upload into the CDN is
+// done under the same lock together with persisting its referent, there can't
+// be any upload in progress that the sweep would deem orphaned.
+func (b *Backend) SweepCDN() (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Gather the live references to all the images
+	live := make(map[[32]byte]uint64)
+	if err := b.cdnReferences(func(key []byte, hash [32]byte) { live[hash]++ }); err != nil {
+		return 0, err
+	}
+	// Gather all the images (and dangling metadata) stored in the CDN
+	stored := make(map[[32]byte]bool)
+
+	it := b.database.NewIterator(util.BytesPrefix(dbCDNImagePrefix), nil)
+	for it.Next() {
+		if len(it.Key()) < len(dbCDNImagePrefix)+32 {
+			continue
+		}
+		var hash [32]byte
+		copy(hash[:], it.Key()[len(dbCDNImagePrefix):])
+		stored[hash] = stored[hash] || len(it.Key()) == len(dbCDNImagePrefix)+32
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return 0, err
+	}
+	// Delete all the orphaned images and repair the reference counts of the rest
+	var removed int
+	for hash, exists := range stored {
+		refs, compressed := b.cdnImageMeta(hash)
+		if live[hash] == 0 {
+			if err := b.database.Delete(append(append([]byte{}, dbCDNImagePrefix...), hash[:]...), nil); err != nil {
+				return removed, err
+			}
+			if err := b.database.Delete(append(append(append([]byte{}, dbCDNImagePrefix...), hash[:]...), dbCDNImageRefSuffix...), nil); err != nil {
+				return removed, err
+			}
+			if err := b.database.Delete(append(append(append([]byte{}, dbCDNImagePrefix...), hash[:]...), dbCDNImageThumbSuffix...), nil); err != nil {
+				return removed, err
+			}
+			if exists {
+				b.logger.Warn("Swept orphaned CDN image", "hash", hex.EncodeToString(hash[:]), "refs", refs)
+				removed++
+			}
+			continue
+		}
+		if refs != live[hash] {
+			b.logger.Warn("Repaired CDN image references", "hash", hex.EncodeToString(hash[:]), "have", refs, "want", live[hash])
+			if err := b.storeCDNImageMeta(hash, live[hash], compressed); err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// cdnReferences iterates over all the entities that reference images in the CDN
+// (profile, contact and participant avatars, event banners and message
+// attachments), calling visit with the database key of the referent and the
+// referenced image hash. Referents that fail to decode are skipped.
+//
+// Note, this method assumes the read lock is held.
+func (b *Backend) cdnReferences(visit func(key []byte, hash [32]byte)) error {
+	if prof, err := b.Profile(); err == nil && prof.Avatar != ([32]byte{}) {
+		visit(dbProfileKey, prof.Avatar)
+	}
+	referents := []struct {
+		prefix []byte
+		refs   func(blob []byte) [][32]byte
+	}{
+		{dbContactPrefix, func(blob []byte) [][32]byte {
+			info := new(contact)
+			if err := json.Unmarshal(blob, info); err != nil {
+				return nil
+			}
+			return [][32]byte{info.Avatar}
+		}},
+		{dbHostedEventPrefix, func(blob []byte) [][32]byte {
+			blob, err := b.openSecret(blob)
+			if err != nil {
+				return nil
+			}
+			infos := new(events.ServerInfos)
+			if err := json.Unmarshal(blob, infos); err != nil {
+				return nil
+			}
+			refs := [][32]byte{infos.Banner}
+			for _, avatar := range infos.Avatars {
+				refs = append(refs, avatar)
+			}
+			return refs
+		}},
+		{dbJoinedEventPrefix, func(blob []byte) [][32]byte {
+			blob, err := b.openSecret(blob)
+			if err != nil {
+				return nil
+			}
+			infos := new(events.ClientInfos)
+			if err := json.Unmarshal(blob, infos); err != nil {
+				return nil
+			}
+			return [][32]byte{infos.Banner}
+		}},
+		{dbMessagePrefix, func(blob []byte) [][32]byte {
+			blob, err := b.openSecret(blob)
+			if err != nil {
+				return nil
+			}
+			msg := new(Message)
+			if err := json.Unmarshal(blob, msg); err != nil {
+				return nil
+			}
+			return [][32]byte{msg.Attachment}
+		}},
+	}
+	for _, referent := range referents {
+		it := b.database.NewIterator(util.BytesPrefix(referent.prefix), nil)
+		for it.Next() {
+			for _, hash := range referent.refs(it.Value()) {
+				if hash != ([32]byte{}) {
+					visit(it.Key(), hash)
+				}
+			}
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+)
+
+// Tests that compressible blobs are transparently compressed in the CDN, while
+// incompressible ones (e.g. images) and tiny ones are stored as is.
+func TestCDNCompression(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	random := make([]byte, 4*cdnCompressionThreshold)
+	rand.Read(random)
+
+	tests := []struct {
+		data       []byte
+		compressed bool
+	}{
+		{[]byte(strings.Repeat("Corona Network event description. ", 256)), true},
+		{random, false},
+		{append([]byte{0xff, 0xd8, 0xff, 0xe0}, strings.Repeat("jpeg", 1024)...), false},
+		{[]byte("tiny"), false},
+	}
+	for i, tt := range tests {
+		hash, err := backend.uploadCDNImage(tt.data)
+		if err != nil {
+			t.Fatalf("test %d: failed to upload blob: %v", i, err)
+		}
+		if _, compressed := backend.cdnImageMeta(hash); compressed != tt.compressed {
+			t.Errorf("test %d: compression mismatch: have %v, want %v", i, compressed, tt.compressed)
+		}
+		stored, err := backend.database.Get(append(dbCDNImagePrefix, hash[:]...), nil)
+		if err != nil {
+			t.Fatalf("test %d: failed to retrieve stored blob: %v", i, err)
+		}
+		if tt.compressed && len(stored) >= len(tt.data) {
+			t.Errorf("test %d: stored size not reduced: have %d, original %d", i, len(stored), len(tt.data))
+		}
+		if !tt.compressed && !bytes.Equal(stored, tt.data) {
+			t.Errorf("test %d: uncompressed blob modified", i)
+		}
+		blob, err := backend.CDNImage(hash)
+		if err != nil {
+			t.Fatalf("test %d: failed to retrieve blob: %v", i, err)
+		}
+		if !bytes.Equal(blob, tt.data) {
+			t.Errorf("test %d: blob mismatch after round trip", i)
+		}
+		// Reference the blob a second time and ensure the flag is retained
+		if _, err := backend.uploadCDNImage(tt.data); err != nil {
+			t.Fatalf("test %d: failed to reupload blob: %v", i, err)
+		}
+		if err := backend.deleteCDNImage(hash); err != nil {
+			t.Fatalf("test %d: failed to dereference blob: %v", i, err)
+		}
+		if blob, err := backend.CDNImage(hash); err != nil || !bytes.Equal(blob, tt.data) {
+			t.Errorf("test %d: blob mismatch after dereference: %v", i, err)
+		}
+	}
+}
+
+// Tests that sweeping the CDN deletes images nobody references, repairs drifted
+// reference counts and leaves everything else alone.
+func TestCDNSweep(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+	newTestReporter(t, backend)
+
+	// Upload a profile picture and share it with a contact too
+	avatar := []byte("avatar of bob")
+	if err := backend.UploadProfilePicture(avatar); err != nil {
+		t.Fatalf("failed to upload profile picture: %v", err)
+	}
+	prof, _ := backend.Profile()
+
+	blob, _ := json.Marshal(&contact{Name: "Alice", Avatar: prof.Avatar})
+	if err := backend.database.Put(append(append([]byte{}, dbContactPrefix...), "alice"...), blob, nil); err != nil {
+		t.Fatalf("failed to store contact: %v", err)
+	}
+	// Strand an image without a referent (crash between upload and persist)
+	orphan, err := backend.uploadCDNImage([]byte("stranded image"))
+	if err != nil {
+		t.Fatalf("failed to upload orphan: %v", err)
+	}
+	// Store a message with an attachment to ensure those are kept too
+	storeTestMessage(t, backend, "alice", "look", []byte("picture of a cat"), time.Now())
+
+	if images, size, err := backend.CDNStats(); err != nil || images != 3 || size == 0 {
+		t.Fatalf("pre-sweep stats mismatch: have %d images, %d bytes (err %v), want %d images", images, size, err, 3)
+	}
+	// Sweep the CDN and ensure only the orphan is dropped
+	removed, err := backend.SweepCDN()
+	if err != nil {
+		t.Fatalf("failed to sweep CDN: %v", err)
+	}
+	if removed != 1 {
+		t.Fatalf("removed image count mismatch: have %d, want %d", removed, 1)
+	}
+	if _, err := backend.CDNImage(orphan); err != ErrImageNotFound {
+		t.Fatalf("orphan image error mismatch: have %v, want %v", err, ErrImageNotFound)
+	}
+	if refs, _ := backend.cdnImageMeta(orphan); refs != 0 {
+		t.Fatalf("orphan refs mismatch: have %d, want %d", refs, 0)
+	}
+	if data, err := backend.CDNImage(prof.Avatar); err != nil || !bytes.Equal(data, avatar) {
+		t.Fatalf("avatar mismatch: have %x (err %v), want %x", data, err, avatar)
+	}
+	if refs, _ := backend.cdnImageMeta(prof.Avatar); refs != 2 {
+		t.Fatalf("avatar refs mismatch: have %d, want %d", refs, 2)
+	}
+	if images, _, err := backend.CDNStats(); err != nil || images != 2 {
+		t.Fatalf("post-sweep stats mismatch: have %d images (err %v), want %d", images, err, 2)
+	}
+	// Ensure the repaired refcounts behave correctly on dereference
+	if err := backend.DeleteProfilePicture(); err != nil {
+		t.Fatalf("failed to delete profile picture: %v", err)
+	}
+	if _, err := backend.CDNImage(prof.Avatar); err != nil {
+		t.Fatalf("shared avatar dropped: %v", err)
+	}
+}
+
+// Tests that thumbnails are generated for uploaded pictures, downscaled within
+// the size limits, and dropped together with the original image.
+func TestCDNThumbnail(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	// Create a wide PNG image and upload it as a picture
+	img := image.NewRGBA(image.Rect(0, 0, 4*cdnThumbnailSize, 2*cdnThumbnailSize))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i)
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatalf("failed to encode image: %v", err)
+	}
+	hash, err := backend.uploadCDNPicture(buf.Bytes())
+	if err != nil {
+		t.Fatalf("failed to upload picture: %v", err)
+	}
+	thumb, err := backend.CDNThumbnail(hash)
+	if err != nil {
+		t.Fatalf("failed to retrieve thumbnail: %v", err)
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatalf("failed to decode thumbnail: %v", err)
+	}
+	if config.Width != cdnThumbnailSize || config.Height != cdnThumbnailSize/2 {
+		t.Fatalf("thumbnail size mismatch: have %dx%d, want %dx%d", config.Width, config.Height, cdnThumbnailSize, cdnThumbnailSize/2)
+	}
+	if issues, err := backend.IntegrityCheck(); err != nil || len(issues) != 0 {
+		t.Fatalf("integrity issues with thumbnail: %v (err %v)", issues, err)
+	}
+	// Upload a non-image blob and ensure it's rejected gracefully
+	blob, err := backend.uploadCDNPicture([]byte("not an image"))
+	if err != nil {
+		t.Fatalf("failed to upload blob: %v", err)
+	}
+	if _, err := backend.CDNThumbnail(blob); err != ErrImageNotFound {
+		t.Fatalf("non-image thumbnail error mismatch: have %v, want %v", err, ErrImageNotFound)
+	}
+	// Drop the picture and ensure the thumbnail goes with it
+	if err := backend.deleteCDNImage(hash); err != nil {
+		t.Fatalf("failed to dereference picture: %v", err)
+	}
+	if _, err := backend.CDNThumbnail(hash); err != ErrImageNotFound {
+		t.Fatalf("deleted thumbnail error mismatch: have %v, want %v", err, ErrImageNotFound)
+	}
+	if ok, _ := backend.database.Has(append(append(append([]byte{}, dbCDNImagePrefix...), hash[:]...), dbCDNImageThumbSuffix...), nil); ok {
+		t.Fatalf("thumbnail retained after image deletion")
+	}
+}
+
+// Tests that oversized images are rejected before reaching the CDN.
+func TestImageSizeLimit(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+	newTestReporter(t, backend)
+
+	if err := backend.UploadProfilePicture(make([]byte, params.MaxImageBytes+1)); err != ErrImageTooLarge {
+		t.Fatalf("oversized upload error mismatch: have %v, want %v", err, ErrImageTooLarge)
+	}
+	if images, _, err := backend.CDNStats(); err != nil || images != 0 {
+		t.Fatalf("image count mismatch: have %d (err %v), want %d", images, err, 0)
+	}
+	if err := backend.UploadProfilePicture(make([]byte, params.MaxImageBytes)); err != nil {
+		t.Fatalf("failed to upload maximum size picture: %v", err)
+	}
+}
@@ -7,6 +7,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -16,10 +18,14 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/coronanet/go-coronanet"
+	"github.com/coronanet/go-coronanet/protocols"
 	"github.com/coronanet/go-coronanet/rest"
+	"github.com/coronanet/go-coronanet/tornet"
 	"github.com/ethereum/go-ethereum/log"
 )
 
@@ -28,6 +34,17 @@ var (
 	apiportFlag   = flag.Int("apiport", 0, "API listener port for the backend (default = automatic")
 	hostnameFlag  = flag.String("hostname", "", "Optional hostname for extra logging context")
 	verbosityFlag = flag.Int("verbosity", int(log.LvlInfo), "Log level to run with")
+	traceFlag     = flag.Bool("trace", false, "Log all protocol messages (redacted) for debugging")
+	integrityFlag = flag.Bool("integrity", false, "Check the database on startup, quarantining corrupt records")
+	rotationFlag  = flag.Duration("rotation", 0, "Interval to rotate the onion addresses at (default = only on contact removal)")
+	quotaFlag     = flag.Uint64("quota", 0, "Soft limit on the data directory size in bytes, above which old event banners are evicted (default = unlimited)")
+
+	torcontrolFlag  = flag.String("torcontrol", "", "Control port (host:port) of an external Tor to use instead of the embedded one")
+	torpasswordFlag = flag.String("torpassword", "", "Control port password of the external Tor (default = no auth or cookie auth)")
+	torsocksFlag    = flag.String("torsocks", "", "SOCKS proxy (host:port) of the external Tor (default = query via control port)")
+
+	apitokenFlag   = flag.String("apitoken", "", "Bearer token required to access the API (default = open)")
+	apioriginsFlag = flag.String("apiorigins", "", "Comma separated browser origins permitted to access the API (default = none)")
 )
 
 func main() {
@@ -40,29 +57,58 @@ func main() {
 	if *hostnameFlag != "" {
 		logger = logger.New("host", *hostnameFlag)
 	}
-	// Create a live backend and expose via REST
+	if err := run(logger); err != nil {
+		logger.Crit("Failed to run coronanet", "err", err)
+	}
+}
+
+// run creates a live backend and exposes it via REST until interrupted. Errors
+// are returned instead of aborting, so that deferred cleanups are executed.
+func run(logger log.Logger) error {
+	if (*torsocksFlag != "" || *torpasswordFlag != "") && *torcontrolFlag == "" {
+		return errors.New("external Tor SOCKS proxy and password require its control port too")
+	}
 	if *datadirFlag == "" {
 		datadir, err := ioutil.TempDir("", "")
 		if err != nil {
-			panic(err)
+			return err
 		}
 		defer os.RemoveAll(datadir)
 
 		*datadirFlag = datadir
 	}
-	backend, err := coronanet.NewBackend(*datadirFlag, logger)
+	backend, err := coronanet.NewBackendWithConfig(*datadirFlag, coronanet.BackendConfig{
+		Integrity:       *integrityFlag,
+		TorControl:      *torcontrolFlag,
+		TorPassword:     *torpasswordFlag,
+		TorSocks:        *torsocksFlag,
+		AddressRotation: *rotationFlag,
+		StorageQuota:    *quotaFlag,
+	}, logger)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer backend.Close()
+	defer func() {
+		// Give in-flight network exchanges a few seconds to finish gracefully
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 
+		backend.Shutdown(ctx)
+	}()
+
+	if *traceFlag {
+		backend.SetTracer(func(dir protocols.Direction, proto string, uid tornet.IdentityFingerprint, msg interface{}) {
+			logger.Info("Traced protocol message", "dir", dir, "proto", proto, "peer", uid, "msg", fmt.Sprintf("%+v", msg))
+		})
+	}
 	// Manually create the API listener so we can capture port 0
 	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *apiportFlag))
 	if err != nil {
-		panic(err)
+		return err
 	}
 	if err := ioutil.WriteFile(filepath.Join(*datadirFlag, "apiport"), []byte(strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)), 0600); err != nil {
-		panic(err)
+		listener.Close()
+		return err
 	}
 	defer os.Remove(filepath.Join(*datadirFlag, "apiport"))
 
@@ -74,5 +120,10 @@ func main() {
 		listener.Close()
 	}()
 	// Everything prepared, run the API server
-	http.Serve(listener, rest.New(backend, logger))
+	var origins []string
+	if *apioriginsFlag != "" {
+		origins = strings.Split(*apioriginsFlag, ",")
+	}
+	http.Serve(listener, rest.New(backend, rest.Options{AllowedOrigins: origins, Token: *apitokenFlag}, logger))
+	return nil
 }
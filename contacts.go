@@ -6,7 +6,11 @@ package coronanet
 import (
 	"encoding/json"
 	"errors"
+	"time"
 
+	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/protocols"
+	"github.com/coronanet/go-coronanet/protocols/corona"
 	"github.com/coronanet/go-coronanet/tornet"
 )
 
@@ -29,8 +33,14 @@ var (
 
 // contact represents a remote user's profile information.
 type contact struct {
-	Name   string   `json:"name`    // Originally remote, can override
-	Avatar [32]byte `json:"avatar"` // Always remote, for now
+	Name     string    `json:"name`                // Originally remote, can override
+	Avatar   [32]byte  `json:"avatar"`             // Always remote, for now
+	Mood     string    `json:"mood,omitempty"`     // Always remote, updatable
+	Sequence uint64    `json:"sequence,omitempty"` // Last message sequence number assigned
+	Blocked  bool      `json:"blocked,omitempty"`  // Whether connections are refused
+	Verified bool      `json:"verified,omitempty"` // Whether the identity was verified out-of-band (local only)
+	Note     string    `json:"note,omitempty"`     // Free form verification note (local only)
+	LastSeen time.Time `json:"lastseen"`           // Last completed profile exchange (zero if never)
 }
 
 // AddContact inserts a new remote identity into the local trust ring and adds
@@ -46,6 +56,9 @@ func (b *Backend) AddContact(keyring tornet.RemoteKeyRing) (tornet.IdentityFinge
 	if err != nil {
 		return "", err
 	}
+	if b.overlay == nil {
+		return "", ErrProfileNotFound
+	}
 	uid := keyring.Identity.Fingerprint()
 	if prof.KeyRing.Identity.Fingerprint() == uid {
 		return "", ErrSelfContact
@@ -62,7 +75,24 @@ func (b *Backend) AddContact(keyring tornet.RemoteKeyRing) (tornet.IdentityFinge
 		return "", err
 	}
 	// Inject the security credentials into the overlay (cascading into the profile)
-	return uid, b.overlay.Trust(keyring)
+	if err := b.overlay.Trust(keyring); err != nil {
+		return "", err
+	}
+	b.feed.publish(Event{Kind: EventContactAdded, Contact: uid})
+	return uid, nil
+}
+
+// AddContactByKeyring inserts a new remote identity into the local trust ring
+// from an exported keyring, without going through a pairing session. Since the
+// remote side needs to trust the local user too, no connection will form until
+// the contact is added on both sides, which is reflected by the reachability of
+// the contact, not by an error here.
+func (b *Backend) AddContactByKeyring(keyring tornet.RemoteKeyRing) (tornet.IdentityFingerprint, error) {
+	// Reject malformed keyrings before they get logged or dialed
+	if err := tornet.ValidateRemoteKeyRing(keyring); err != nil {
+		return "", err
+	}
+	return b.AddContact(keyring)
 }
 
 // DeleteContact removes the contact from the trust ring, deletes all associated
@@ -85,11 +115,44 @@ func (b *Backend) DeleteContact(uid tornet.IdentityFingerprint) error {
 	if err := b.deleteContactPicture(uid); err != nil {
 		return err
 	}
-	return b.database.Delete(append(dbContactPrefix, uid...), nil)
+	if err := b.deleteMessages(uid); err != nil {
+		return err
+	}
+	b.dropAvatarRequests(uid)
+	delete(b.contacted, uid)
+	delete(b.synced, uid)
+
+	if err := b.database.Delete(append(dbContactPrefix, uid...), nil); err != nil {
+		return err
+	}
+	b.feed.publish(Event{Kind: EventContactDeleted, Contact: uid})
+	return nil
 }
 
 // Contacts returns the unique ids of all the current contacts.
+//
+// The contacts are taken from the live overlay if it's running, since keyring
+// changes (e.g. new or migrated contacts) are persisted asynchronously.
 func (b *Backend) Contacts() ([]tornet.IdentityFingerprint, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.contacts()
+}
+
+// contacts returns the unique ids of all the current contacts.
+//
+// Note, this method assumes the read lock is held.
+func (b *Backend) contacts() ([]tornet.IdentityFingerprint, error) {
+	if b.overlay != nil {
+		trusted := b.overlay.Trusted()
+
+		uids := make([]tornet.IdentityFingerprint, 0, len(trusted))
+		for uid := range trusted {
+			uids = append(uids, uid)
+		}
+		return uids, nil
+	}
 	prof, err := b.Profile()
 	if err != nil {
 		return nil, ErrProfileNotFound
@@ -101,6 +164,40 @@ func (b *Backend) Contacts() ([]tornet.IdentityFingerprint, error) {
 	return uids, nil
 }
 
+// ExportContact retrieves the security credentials of a contact, allowing them
+// to be shared with a third party (e.g. to introduce two contacts to each other).
+//
+// The address is taken from the live overlay if it's running, since that tracks
+// any rotations announced by the contact before the profile is persisted.
+func (b *Backend) ExportContact(uid tornet.IdentityFingerprint) (tornet.RemoteKeyRing, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if _, err := b.Contact(uid); err != nil {
+		return tornet.RemoteKeyRing{}, err
+	}
+	if b.overlay != nil {
+		keyring, ok := b.overlay.Trusted()[uid]
+		if !ok {
+			return tornet.RemoteKeyRing{}, ErrContactNotFound
+		}
+		return keyring, nil
+	}
+	// Overlay offline, fall back to the last persisted keyring
+	prof, err := b.Profile()
+	if err != nil {
+		return tornet.RemoteKeyRing{}, err
+	}
+	keyring, ok := prof.KeyRing.Trusted[uid]
+	if !ok {
+		return tornet.RemoteKeyRing{}, ErrContactNotFound
+	}
+	return tornet.RemoteKeyRing{
+		Identity: append(tornet.PublicIdentity{}, keyring.Identity...),
+		Address:  append(tornet.PublicAddress{}, keyring.Address...),
+	}, nil
+}
+
 // Contact retrieves a remote user's profile infos.
 func (b *Backend) Contact(uid tornet.IdentityFingerprint) (*contact, error) {
 	blob, err := b.database.Get(append(dbContactPrefix, uid...), nil)
@@ -132,6 +229,62 @@ func (b *Backend) UpdateContact(uid tornet.IdentityFingerprint, name string) err
 	// Name changed, update and serialize back to disk
 	info.Name = name
 
+	blob, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := b.database.Put(append(dbContactPrefix, uid...), blob, nil); err != nil {
+		return err
+	}
+	b.feed.publish(Event{Kind: EventContactUpdated, Contact: uid})
+	return nil
+}
+
+// updateContactMood sets the mood message of a remote contact, as announced by
+// them. Unlike the name, the mood may change any time, so it's not guarded.
+func (b *Backend) updateContactMood(uid tornet.IdentityFingerprint, mood string) error {
+	if len(mood) > profileMoodMaxLength {
+		return ErrMoodTooLong
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	info, err := b.Contact(uid)
+	if err != nil {
+		return err
+	}
+	if info.Mood == mood {
+		return nil
+	}
+	info.Mood = mood
+
+	blob, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := b.database.Put(append(dbContactPrefix, uid...), blob, nil); err != nil {
+		return err
+	}
+	b.feed.publish(Event{Kind: EventContactUpdated, Contact: uid})
+	return nil
+}
+
+// markContactSeen updates the last seen timestamp of a remote contact. Since a
+// flapping connection could keep completing exchanges, the update is debounced
+// and skipped if the stored timestamp is recent enough.
+func (b *Backend) markContactSeen(uid tornet.IdentityFingerprint, now time.Time) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	info, err := b.Contact(uid)
+	if err != nil {
+		return err
+	}
+	if now.Sub(info.LastSeen) < contactSeenDebounce {
+		return nil
+	}
+	info.LastSeen = now
+
 	blob, err := json.Marshal(info)
 	if err != nil {
 		return err
@@ -139,10 +292,71 @@ func (b *Backend) UpdateContact(uid tornet.IdentityFingerprint, name string) err
 	return b.database.Put(append(dbContactPrefix, uid...), blob, nil)
 }
 
+// BlockContact marks a remote contact blocked, dropping any live connection and
+// refusing any new ones until unblocked. Opposed to deleting the contact, the
+// keyring, profile and message history are retained and - most importantly -
+// the onion address is not rotated.
+func (b *Backend) BlockContact(uid tornet.IdentityFingerprint) error {
+	return b.setContactBlocked(uid, true)
+}
+
+// UnblockContact lifts a block from a remote contact, permitting connections to
+// and from it again.
+func (b *Backend) UnblockContact(uid tornet.IdentityFingerprint) error {
+	return b.setContactBlocked(uid, false)
+}
+
+// setContactBlocked updates the blocked status of a remote contact, tearing down
+// or reestablishing the connection with it accordingly.
+func (b *Backend) setContactBlocked(uid tornet.IdentityFingerprint, blocked bool) error {
+	b.logger.Info("Updating contact block", "contact", uid, "blocked", blocked)
+
+	b.lock.Lock()
+
+	// Retrieve the current profile and abort if the update is a noop
+	info, err := b.Contact(uid)
+	if err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	if info.Blocked == blocked {
+		b.lock.Unlock()
+		return nil
+	}
+	// Status changed, update and serialize back to disk
+	info.Blocked = blocked
+
+	blob, err := json.Marshal(info)
+	if err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	if err := b.database.Put(append(dbContactPrefix, uid...), blob, nil); err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	enc := b.peerset[uid]
+	b.lock.Unlock()
+
+	// Drop the contact if it's online, or schedule a reconnect if unblocked
+	if blocked && enc != nil {
+		go enc.Encode(&corona.Envelope{Disconnect: &protocols.Disconnect{}})
+	}
+	if !blocked && b.dialer != nil {
+		b.dialer.prioritize(0, []tornet.IdentityFingerprint{uid})
+	}
+	b.feed.publish(Event{Kind: EventContactUpdated, Contact: uid})
+	return nil
+}
+
 // uploadContactPicture uploads a new local profile picture for the remote user.
 func (b *Backend) uploadContactPicture(uid tornet.IdentityFingerprint, data []byte) error {
 	b.logger.Info("Uploading contact picture", "contact", uid)
 
+	if len(data) > params.MaxImageBytes {
+		return ErrImageTooLarge
+	}
+
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
@@ -152,7 +366,7 @@ func (b *Backend) uploadContactPicture(uid tornet.IdentityFingerprint, data []by
 		return err
 	}
 	// Upload the image into the CDN and delete the old one
-	hash, err := b.uploadCDNImage(data)
+	hash, err := b.uploadCDNPicture(data)
 	if err != nil {
 		return err
 	}
@@ -171,7 +385,11 @@ func (b *Backend) uploadContactPicture(uid tornet.IdentityFingerprint, data []by
 	if err != nil {
 		return err
 	}
-	return b.database.Put(append(dbContactPrefix, uid...), blob, nil)
+	if err := b.database.Put(append(dbContactPrefix, uid...), blob, nil); err != nil {
+		return err
+	}
+	b.feed.publish(Event{Kind: EventContactUpdated, Contact: uid})
+	return nil
 }
 
 // deleteContactPicture deletes the existing local profile picture of the remote user.
@@ -199,5 +417,9 @@ func (b *Backend) deleteContactPicture(uid tornet.IdentityFingerprint) error {
 	if err != nil {
 		return err
 	}
-	return b.database.Put(append(dbContactPrefix, uid...), blob, nil)
+	if err := b.database.Put(append(dbContactPrefix, uid...), blob, nil); err != nil {
+		return err
+	}
+	b.feed.publish(Event{Kind: EventContactUpdated, Contact: uid})
+	return nil
 }
@@ -0,0 +1,346 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that exporting a contact uses the freshest address known by the live
+// overlay, even if it was not yet persisted into the profile.
+func TestExportContactAddress(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	// Create a contact and a rotated address not yet persisted
+	remote, _ := tornet.GenerateKeyRing()
+	rotated, _ := tornet.GenerateAddress()
+
+	uid := remote.Identity.Fingerprint()
+	stale := tornet.RemoteKeyRing{Identity: remote.Identity.Public(), Address: remote.Addresses[0].Public()}
+	fresh := tornet.RemoteKeyRing{Identity: remote.Identity.Public(), Address: rotated.Public()}
+
+	keyring, err := tornet.GenerateKeyRing()
+	if err != nil {
+		t.Fatalf("failed to generate keyring: %v", err)
+	}
+	keyring.Trusted[uid] = stale
+	keyring.Accesses[keyring.Addresses[0].Fingerprint()][uid] = struct{}{}
+
+	blob, err := json.Marshal(&profile{KeyRing: &keyring})
+	if err != nil {
+		t.Fatalf("failed to marshal profile: %v", err)
+	}
+	if err := backend.database.Put(dbProfileKey, blob, nil); err != nil {
+		t.Fatalf("failed to store profile: %v", err)
+	}
+	if blob, err = json.Marshal(&contact{}); err != nil {
+		t.Fatalf("failed to marshal contact: %v", err)
+	}
+	if err := backend.database.Put(append(dbContactPrefix, uid...), blob, nil); err != nil {
+		t.Fatalf("failed to store contact: %v", err)
+	}
+	// While offline, the persisted address should be exported
+	if _, err := backend.ExportContact("unknown"); err != ErrContactNotFound {
+		t.Fatalf("unknown contact error mismatch: have %v, want %v", err, ErrContactNotFound)
+	}
+	exported, err := backend.ExportContact(uid)
+	if err != nil {
+		t.Fatalf("failed to export offline contact: %v", err)
+	}
+	if !bytes.Equal(exported.Address, stale.Address) {
+		t.Fatalf("offline address mismatch: have %x, want %x", exported.Address, stale.Address)
+	}
+	// Start an overlay which already learnt about the address rotation
+	live := keyring
+	live.Trusted = map[tornet.IdentityFingerprint]tornet.RemoteKeyRing{uid: fresh}
+
+	backend.overlay, err = tornet.NewNode(tornet.NodeConfig{
+		Gateway:     tornet.NewMockGateway(),
+		KeyRing:     live,
+		RingHandler: func(keyring tornet.SecretKeyRing) {},
+		Logger:      backend.logger,
+	})
+	if err != nil {
+		t.Fatalf("failed to create overlay: %v", err)
+	}
+	defer backend.overlay.Close()
+
+	if exported, err = backend.ExportContact(uid); err != nil {
+		t.Fatalf("failed to export live contact: %v", err)
+	}
+	if !bytes.Equal(exported.Identity, fresh.Identity) {
+		t.Fatalf("identity mismatch: have %x, want %x", exported.Identity, fresh.Identity)
+	}
+	if !bytes.Equal(exported.Address, fresh.Address) {
+		t.Fatalf("live address mismatch: have %x, want %x", exported.Address, fresh.Address)
+	}
+}
+
+// Tests that blocking a contact drops its connection and refuses new ones, while
+// retaining the contact itself, and that unblocking permits connections again.
+func TestContactBlocking(t *testing.T) {
+	alice, bob, teardown := newTestContacts(t)
+	defer teardown()
+
+	aliceId, bobId := newTestRemote(t, alice), newTestRemote(t, bob)
+	if _, err := alice.AddContact(bobId); err != nil {
+		t.Fatalf("failed to add bob to alice: %v", err)
+	}
+	if _, err := bob.AddContact(aliceId); err != nil {
+		t.Fatalf("failed to add alice to bob: %v", err)
+	}
+	aliceUid, bobUid := aliceId.Identity.Fingerprint(), bobId.Identity.Fingerprint()
+	waitTestConnection(t, alice, bobUid)
+
+	// Block bob and ensure he gets disconnected, but is still a contact
+	if err := alice.BlockContact(bobUid); err != nil {
+		t.Fatalf("failed to block bob: %v", err)
+	}
+	for i := 0; ; i++ {
+		alice.lock.RLock()
+		enc := alice.peerset[bobUid]
+		alice.lock.RUnlock()
+
+		if enc == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("blocked contact not disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info, err := alice.Contact(bobUid); err != nil || !info.Blocked {
+		t.Fatalf("blocked contact mismatch: have %+v (err %v), want blocked", info, err)
+	}
+	if _, ok := alice.overlay.Trusted()[bobUid]; !ok {
+		t.Fatalf("blocked contact untrusted")
+	}
+	// Have bob try to reach alice and ensure the connection is refused
+	if err := bob.SendMessage(aliceUid, "Hello Alice"); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	bob.overlay.Dial(context.Background(), aliceUid)
+	time.Sleep(100 * time.Millisecond)
+
+	if messages, _ := alice.Messages(bobUid, time.Time{}); len(messages) != 0 {
+		t.Fatalf("blocked contact delivered messages: %v", messages)
+	}
+	// Unblock bob and ensure the queued message gets through
+	if err := alice.UnblockContact(bobUid); err != nil {
+		t.Fatalf("failed to unblock bob: %v", err)
+	}
+	bob.overlay.Dial(context.Background(), aliceUid)
+	waitTestMessages(t, alice, bobUid, 1)
+}
+
+// Tests that a contact's last seen timestamp is set when a live connection does
+// its initial profile exchange, and that later updates are debounced.
+func TestContactLastSeen(t *testing.T) {
+	alice, bob, teardown := newTestContacts(t)
+	defer teardown()
+
+	aliceId, bobId := newTestRemote(t, alice), newTestRemote(t, bob)
+	if _, err := alice.AddContact(bobId); err != nil {
+		t.Fatalf("failed to add bob to alice: %v", err)
+	}
+	if _, err := bob.AddContact(aliceId); err != nil {
+		t.Fatalf("failed to add alice to bob: %v", err)
+	}
+	bobUid := bobId.Identity.Fingerprint()
+	if info, err := alice.Contact(bobUid); err != nil || info.LastSeen != (time.Time{}) {
+		t.Fatalf("unconnected contact mismatch: have %+v (err %v), want never seen", info, err)
+	}
+	waitTestConnection(t, alice, bobUid)
+
+	// Wait for the profile exchange to complete and the contact marked seen
+	var seen time.Time
+	for i := 0; ; i++ {
+		info, err := alice.Contact(bobUid)
+		if err != nil {
+			t.Fatalf("failed to retrieve contact: %v", err)
+		}
+		if seen = info.LastSeen; seen != (time.Time{}) {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("connected contact not marked seen")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Ensure updates within the debounce period are skipped, but later ones are not
+	if err := alice.markContactSeen(bobUid, seen.Add(contactSeenDebounce/2)); err != nil {
+		t.Fatalf("failed to mark contact seen: %v", err)
+	}
+	if info, _ := alice.Contact(bobUid); !info.LastSeen.Equal(seen) {
+		t.Fatalf("debounced last seen mismatch: have %v, want %v", info.LastSeen, seen)
+	}
+	later := seen.Add(2 * contactSeenDebounce)
+	if err := alice.markContactSeen(bobUid, later); err != nil {
+		t.Fatalf("failed to mark contact seen: %v", err)
+	}
+	if info, _ := alice.Contact(bobUid); !info.LastSeen.Equal(later) {
+		t.Fatalf("last seen mismatch: have %v, want %v", info.LastSeen, later)
+	}
+}
+
+// Tests that the local verification metadata of a contact can be set and cleared,
+// and that the comparable fingerprint format is stable.
+func TestContactVerification(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	// Create a contact to verify
+	remote, _ := tornet.GenerateKeyRing()
+	uid := remote.Identity.Fingerprint()
+
+	keyring, err := tornet.GenerateKeyRing()
+	if err != nil {
+		t.Fatalf("failed to generate keyring: %v", err)
+	}
+	keyring.Trusted[uid] = tornet.RemoteKeyRing{Identity: remote.Identity.Public(), Address: remote.Addresses[0].Public()}
+
+	blob, _ := json.Marshal(&profile{KeyRing: &keyring})
+	if err := backend.database.Put(dbProfileKey, blob, nil); err != nil {
+		t.Fatalf("failed to store profile: %v", err)
+	}
+	blob, _ = json.Marshal(&contact{Name: "Bob"})
+	if err := backend.database.Put(append(dbContactPrefix, uid...), blob, nil); err != nil {
+		t.Fatalf("failed to store contact: %v", err)
+	}
+	// Ensure the verification can be set, rejecting overly long notes
+	if err := backend.SetContactVerification("unknown", true, ""); err != ErrContactNotFound {
+		t.Fatalf("unknown contact error mismatch: have %v, want %v", err, ErrContactNotFound)
+	}
+	if err := backend.SetContactVerification(uid, true, string(make([]byte, contactNoteMaxLength+1))); err != ErrNoteTooLong {
+		t.Fatalf("long note error mismatch: have %v, want %v", err, ErrNoteTooLong)
+	}
+	if err := backend.SetContactVerification(uid, true, "met in person"); err != nil {
+		t.Fatalf("failed to verify contact: %v", err)
+	}
+	info, err := backend.Contact(uid)
+	if err != nil {
+		t.Fatalf("failed to retrieve contact: %v", err)
+	}
+	if !info.Verified || info.Note != "met in person" || info.Name != "Bob" {
+		t.Fatalf("verified contact mismatch: have %+v", info)
+	}
+	if err := backend.SetContactVerification(uid, false, ""); err != nil {
+		t.Fatalf("failed to unverify contact: %v", err)
+	}
+	if info, _ = backend.Contact(uid); info.Verified || info.Note != "" {
+		t.Fatalf("unverified contact mismatch: have %+v", info)
+	}
+	// Ensure the fingerprint is derived from the contact's identity
+	fingerprint, err := backend.ContactFingerprint(uid)
+	if err != nil {
+		t.Fatalf("failed to retrieve fingerprint: %v", err)
+	}
+	if want := formatFingerprint(remote.Identity.Public()); fingerprint != want {
+		t.Fatalf("fingerprint mismatch: have %s, want %s", fingerprint, want)
+	}
+	if _, err := backend.ContactFingerprint("unknown"); err != ErrContactNotFound {
+		t.Fatalf("unknown fingerprint error mismatch: have %v, want %v", err, ErrContactNotFound)
+	}
+	// Ensure the format doesn't change, users compare them across versions
+	if have, want := formatFingerprint(make(tornet.PublicIdentity, 32)), "9E62 9197 0CB4 4DD9 4008 C79B CAF9 D86F 18B4 B49B"; have != want {
+		t.Fatalf("fingerprint format mismatch: have %s, want %s", have, want)
+	}
+}
+
+// Tests that contacts can be imported from a raw keyring without pairing, and
+// that a one sided import is reported as unreachable rather than failing.
+func TestAddContactByKeyring(t *testing.T) {
+	gateway := tornet.NewMockGateway()
+
+	alice := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(alice.datadir)
+	defer alice.Close()
+
+	bob := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(bob.datadir)
+	defer bob.Close()
+
+	keyrings := make([]tornet.RemoteKeyRing, 2)
+	for i, backend := range []*Backend{alice, bob} {
+		if err := backend.CreateProfile(); err != nil {
+			t.Fatalf("failed to create profile: %v", err)
+		}
+		if err := backend.EnableGateway(); err != nil {
+			t.Fatalf("failed to enable gateway: %v", err)
+		}
+		prof, _ := backend.Profile()
+		keyrings[i] = tornet.RemoteKeyRing{
+			Identity: prof.KeyRing.Identity.Public(),
+			Address:  prof.KeyRing.Addresses[0].Public(),
+		}
+	}
+	// Ensure junk, self and duplicate imports are rejected
+	offcurve := make([]byte, 32)
+	offcurve[0] = 2 // y = 2 is not on the curve
+
+	if _, err := alice.AddContactByKeyring(tornet.RemoteKeyRing{Identity: offcurve, Address: keyrings[1].Address}); err != tornet.ErrMalformedKeyRing {
+		t.Fatalf("malformed import error mismatch: have %v, want %v", err, tornet.ErrMalformedKeyRing)
+	}
+	if _, err := alice.AddContactByKeyring(keyrings[0]); err != ErrSelfContact {
+		t.Fatalf("self import error mismatch: have %v, want %v", err, ErrSelfContact)
+	}
+	uid, err := alice.AddContactByKeyring(keyrings[1])
+	if err != nil {
+		t.Fatalf("failed to import contact: %v", err)
+	}
+	if uid != keyrings[1].Identity.Fingerprint() {
+		t.Fatalf("imported contact mismatch: have %v, want %v", uid, keyrings[1].Identity.Fingerprint())
+	}
+	if _, err := alice.AddContactByKeyring(keyrings[1]); err != ErrContactExists {
+		t.Fatalf("duplicate import error mismatch: have %v, want %v", err, ErrContactExists)
+	}
+	// Bob didn't import alice, so the contact should be reported as unreachable
+	for i := 0; ; i++ {
+		report, err := alice.ReachabilityReport()
+		if err != nil {
+			t.Fatalf("failed to retrieve reachability: %v", err)
+		}
+		if len(report) == 1 { // Keyring is persisted async
+			if report[0].Identity != uid {
+				t.Fatalf("reachability report mismatch: have %v, want %v", report[0].Identity, uid)
+			}
+			if report[0].Connected {
+				t.Fatalf("one sided contact connected")
+			}
+			if report[0].Failure != "" {
+				break
+			}
+		}
+		if i == 100 {
+			t.Fatalf("one sided contact dial failure not reported")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Import alice on bob's side too and ensure they connect
+	if _, err := bob.AddContactByKeyring(keyrings[0]); err != nil {
+		t.Fatalf("failed to import contact: %v", err)
+	}
+	waitTestConnected(t, alice, uid)
+
+	// Wait for the keyrings to be persisted to avoid racing the teardown
+	for _, backend := range []*Backend{alice, bob} {
+		for i := 0; ; i++ {
+			if prof, _ := backend.Profile(); len(prof.KeyRing.Trusted) == 1 {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("contact not persisted into keyring")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
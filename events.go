@@ -5,6 +5,7 @@ package coronanet
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"time"
@@ -12,6 +13,7 @@ import (
 	"github.com/coronanet/go-coronanet/params"
 	"github.com/coronanet/go-coronanet/protocols/events"
 	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
@@ -33,6 +35,10 @@ var (
 	// ErrEventAlreadyJoined is returned if an event is attempted to be joined
 	// that the local user is already a member of.
 	ErrEventAlreadyJoined = errors.New("event already joined")
+
+	// ErrEventReopenExpired is returned if a terminated event is attempted to be
+	// reopened after the grace period allowing it has passed.
+	ErrEventReopenExpired = errors.New("event reopen window expired")
 )
 
 // eventHost is an alias for the backend which implements the events.Host interface.
@@ -42,32 +48,51 @@ type eventHost Backend
 // includes the banner picture), but it is not yet cached in the server.
 //
 // If something unexpected happens, this method returns nil to force the event
-// server to retry for the next invocation.
+// server to retry for the next invocation. If the image keeps failing to load
+// (e.g. it was lost from the CDN), a placeholder is served instead, otherwise
+// guests would never be able to complete retrieving the event metadata.
 func (h *eventHost) Banner(event tornet.IdentityFingerprint, server *events.Server) []byte {
 	infos := server.Infos()
 	if infos.Banner == ([32]byte{}) {
 		return []byte{}
 	}
 	blob, err := (*Backend)(h).CDNImage(infos.Banner)
-	if err != nil {
+
+	h.bannerLock.Lock()
+	defer h.bannerLock.Unlock()
+
+	if err == nil {
+		delete(h.bannerFailures, event)
+		return blob
+	}
+	h.bannerFailures[event]++
+	if h.bannerFailures[event] < eventBannerRetries {
+		h.logger.Warn("Failed to load event banner", "event", event, "failures", h.bannerFailures[event], "err", err)
 		return nil
 	}
-	return blob
+	h.logger.Error("Serving placeholder for unloadable event banner", "event", event, "hash", hex.EncodeToString(infos.Banner[:]), "err", err)
+	return makePlaceholder()
 }
 
 // OnUpdate is invoked when the internal stats of the event changes. All the
 // changes should be persisted to disk to allow recovering. This method does
 // not get passed the updated infos to avoid a data race overwriting something.
 func (h *eventHost) OnUpdate(event tornet.IdentityFingerprint, server *events.Server) {
-	blob, err := json.Marshal(server.Infos())
+	infos := server.Infos()
+
+	blob, err := json.Marshal(infos)
 	if err != nil {
 		h.logger.Error("Failed to marshal event infos", "event", event, "err", err)
 		return
 	}
-	if err := h.database.Put(append(dbHostedEventPrefix, event...), blob, nil); err != nil {
+	if err := (*Backend)(h).putSecret(append(dbHostedEventPrefix, event...), blob); err != nil {
 		h.logger.Error("Failed to store event infos", "event", event, "err", err)
 		return
 	}
+	if err := (*Backend)(h).recordEventStats(event, infos); err != nil {
+		h.logger.Error("Failed to record event stats", "event", event, "err", err)
+	}
+	h.feed.publish(Event{Kind: EventHostedUpdated, Event: event})
 }
 
 // OnReport is invoked when an event participant sends in an infection report
@@ -78,28 +103,114 @@ func (h *eventHost) OnReport(event tornet.IdentityFingerprint, server *events.Se
 	return nil
 }
 
+// OnAvatar is invoked when the profile picture announced by a participant in an
+// infection report was downloaded and verified. The image is uploaded into the
+// CDN, replacing any previous one of the same participant.
+func (h *eventHost) OnAvatar(event tornet.IdentityFingerprint, server *events.Server, pseudonym tornet.IdentityFingerprint, avatar []byte) error {
+	h.logger.Info("Uploading participant picture", "event", event, "pseudonym", pseudonym)
+
+	if len(avatar) > params.MaxImageBytes {
+		return ErrImageTooLarge
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// Upload the image into the CDN and delete the old one
+	hash, err := (*Backend)(h).uploadCDNPicture(avatar)
+	if err != nil {
+		return err
+	}
+	infos := server.Infos()
+	if old := infos.Avatars[pseudonym]; old != ([32]byte{}) {
+		if err := (*Backend)(h).deleteCDNImage(old); err != nil {
+			return err
+		}
+	}
+	// Persist the reference along with the upload, otherwise a concurrent sweep
+	// would deem the image orphaned until the server updates the event
+	infos.Avatars[pseudonym] = hash
+
+	blob, err := json.Marshal(infos)
+	if err != nil {
+		return err
+	}
+	return (*Backend)(h).putSecret(append(dbHostedEventPrefix, event...), blob)
+}
+
 // eventGuest is an alias for the backend which implements the events.Guest interface.
 type eventGuest Backend
 
 // Status retrieves the guests last known infection status within the given
 // time interval. The method should return every data to make a crypto proof.
-func (g *eventGuest) Status(start, end time.Time) (id tornet.SecretIdentity, name string, status string, message string) {
-	return nil, "", "", ""
+//
+// The reported status is the one in effect during the event, i.e. the latest
+// declared at or before its end, even if it was declared before it started. A
+// zero end means the event is still running, so the current status applies.
+// If a status was explicitly reported to the event after that, it takes over
+// along with its message.
+func (g *eventGuest) Status(event tornet.IdentityFingerprint, start, end time.Time) (id tornet.SecretIdentity, name string, status string, message string) {
+	prof, err := (*Backend)(g).Profile()
+	if err != nil {
+		g.logger.Error("Failed to retrieve profile for event report", "err", err)
+		return nil, "", "", ""
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+	infection, err := (*Backend)(g).infectionStatusAt(end)
+	if err != nil {
+		g.logger.Error("Failed to retrieve infection status", "err", err)
+		return nil, "", "", ""
+	}
+	if report, err := (*Backend)(g).eventReport(event); err == nil && report.Time.After(infection.Time) {
+		return prof.KeyRing.Identity, prof.Name, report.Status, report.Message
+	}
+	return prof.KeyRing.Identity, prof.Name, infection.Status, ""
+}
+
+// Avatar retrieves the guest's profile picture to attach to infection reports
+// sent to the event. The method should return nil if there is none.
+func (g *eventGuest) Avatar(event tornet.IdentityFingerprint) []byte {
+	prof, err := (*Backend)(g).Profile()
+	if err != nil || prof.Avatar == ([32]byte{}) {
+		return nil
+	}
+	blob, err := (*Backend)(g).CDNImage(prof.Avatar)
+	if err != nil {
+		g.logger.Error("Failed to retrieve profile picture for event report", "err", err)
+		return nil
+	}
+	return blob
 }
 
 // OnUpdate is invoked when the internal stats of the event changes. All the
 // changes should be persisted to disk to allow recovering. This method does
 // not get passed the updated infos to avoid a data race overwriting something.
 func (g *eventGuest) OnUpdate(event tornet.IdentityFingerprint, client *events.Client) {
+	// If the event was left (or rejoined) meanwhile, don't resurrect the old data.
+	// Clients not yet tracked are still being joined, persist those if stored.
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	if current, ok := g.joined[event]; ok && current != client {
+		g.logger.Debug("Dropping update from stale event client", "event", event)
+		return
+	} else if !ok {
+		if stored, _ := g.database.Has(append(dbJoinedEventPrefix, event...), nil); !stored {
+			g.logger.Debug("Dropping update from untracked event client", "event", event)
+			return
+		}
+	}
 	blob, err := json.Marshal(client.Infos())
 	if err != nil {
 		g.logger.Error("Failed to marshal event infos", "event", event, "err", err)
 		return
 	}
-	if err := g.database.Put(append(dbJoinedEventPrefix, event...), blob, nil); err != nil {
+	if err := (*Backend)(g).putSecret(append(dbJoinedEventPrefix, event...), blob); err != nil {
 		g.logger.Error("Failed to store event infos", "event", event, "err", err)
 		return
 	}
+	g.feed.publish(Event{Kind: EventJoinedUpdated, Event: event})
 }
 
 // OnBanner is invoked when the banner image of the event changes. Opposed to
@@ -122,17 +233,32 @@ func (b *Backend) initEvents() error {
 	if b.hosted != nil {
 		panic("inited events outside of startup")
 	}
+	// Corrupt event records must not brick the entire node, skip them instead.
+	// Any other failure (e.g. I/O error) is not specific to the record though,
+	// so abort the startup.
+	skipped := []IntegrityIssue{}
+	skip := func(prefix []byte, event tornet.IdentityFingerprint, err error) {
+		b.logger.Error("Skipping corrupt event record", "event", event, "err", err)
+		skipped = append(skipped, IntegrityIssue{
+			Key:   append(append([]byte{}, prefix...), event...),
+			Error: err.Error(),
+		})
+	}
 	// Recreate all the known hosted events, but tear down if any fails
 	reinitHosted := func(event tornet.IdentityFingerprint) (*events.Server, error) {
 		infos, err := b.HostedEvent(event)
 		if err != nil {
-			return nil, err
+			if _, ok := err.(*corruptRecordError); !ok {
+				return nil, err
+			}
+			skip(dbHostedEventPrefix, event, err)
+			return nil, nil
 		}
 		if infos.End != (time.Time{}) && time.Since(infos.End) > params.EventMaintenancePeriod {
 			b.logger.Info("Event exceeded maintenance period", "event", event, "ended", time.Since(infos.End))
 			return nil, nil
 		}
-		return events.RecreateServer((*eventHost)(b), tornet.NewTorGateway(b.network), infos, b.logger)
+		return events.RecreateServer((*eventHost)(b), b.torGateway(), infos, b.logger)
 	}
 	hosted := make(map[tornet.IdentityFingerprint]*events.Server)
 	for _, event := range b.HostedEvents() {
@@ -151,13 +277,17 @@ func (b *Backend) initEvents() error {
 	reinitJoined := func(event tornet.IdentityFingerprint) (*events.Client, error) {
 		infos, err := b.JoinedEvent(event)
 		if err != nil {
-			return nil, err
+			if _, ok := err.(*corruptRecordError); !ok {
+				return nil, err
+			}
+			skip(dbJoinedEventPrefix, event, err)
+			return nil, nil
 		}
 		if infos.End != (time.Time{}) && time.Since(infos.End) > params.EventMaintenancePeriod {
 			b.logger.Info("Event exceeded maintenance period", "event", event, "ended", time.Since(infos.End))
 			return nil, nil
 		}
-		return events.RecreateClient((*eventGuest)(b), tornet.NewTorGateway(b.network), infos, b.logger)
+		return events.RecreateClient((*eventGuest)(b), b.torGateway(), infos, b.logger)
 	}
 	joined := make(map[tornet.IdentityFingerprint]*events.Client)
 	for _, event := range b.JoinedEvents() {
@@ -178,7 +308,14 @@ func (b *Backend) initEvents() error {
 	b.hosted = hosted
 	b.checkin = make(map[tornet.IdentityFingerprint]*events.CheckinSession)
 	b.joined = joined
+	b.skipped = skipped
+
+	if len(skipped) > 0 {
+		b.logger.Error("Skipped corrupt event records", "count", len(skipped))
+	}
 
+	// Events are running, let the planner spawn any scheduled ones that are due
+	b.planner.reschedule()
 	return nil
 }
 
@@ -200,14 +337,19 @@ func (b *Backend) nukeEvents() error {
 }
 
 // CreateEvent assembles a new Corona Network event server.
-func (b *Backend) CreateEvent(name string) (tornet.IdentityFingerprint, error) {
-	b.logger.Info("Creating new event", "name", name)
+func (b *Backend) CreateEvent(name string, description string, location string) (tornet.IdentityFingerprint, error) {
+	return b.createEvent(name, description, location, b.gateway())
+}
+
+// createEvent is the gateway agnostic internals of CreateEvent.
+func (b *Backend) createEvent(name string, description string, location string, gateway tornet.Gateway) (tornet.IdentityFingerprint, error) {
+	b.logger.Info("Creating new event", "name", name, "location", location)
 
 	// THe local user is a participant of all events, make sure it exists
 	if _, err := b.Profile(); err != nil {
 		return "", err
 	}
-	server, err := events.CreateServer((*eventHost)(b), tornet.NewTorGateway(b.network), name, [32]byte{}, b.logger)
+	server, err := events.CreateServer((*eventHost)(b), gateway, name, description, location, [32]byte{}, b.logger)
 	if err != nil {
 		return "", err
 	}
@@ -219,10 +361,13 @@ func (b *Backend) CreateEvent(name string) (tornet.IdentityFingerprint, error) {
 	if err != nil {
 		return "", err
 	}
-	if err := b.database.Put(append(dbHostedEventPrefix, event...), blob, nil); err != nil {
+	if err := b.putSecret(append(dbHostedEventPrefix, event...), blob); err != nil {
 		server.Close()
 		return "", err
 	}
+	if err := b.recordEventStats(event, infos); err != nil {
+		b.logger.Error("Failed to record event stats", "event", event, "err", err)
+	}
 	// Event hosted and persisted to disk, add it to the tracked servers
 	b.lock.Lock()
 	defer b.lock.Unlock()
@@ -253,7 +398,52 @@ func (b *Backend) TerminateEvent(event tornet.IdentityFingerprint) error {
 	if err != nil {
 		return err
 	}
-	return b.database.Put(append(dbHostedEventPrefix, event...), blob, nil)
+	return b.putSecret(append(dbHostedEventPrefix, event...), blob)
+}
+
+// ReopenEvent undoes the termination of a hosted event, permitting participants
+// to check in again. It is only allowed within a short grace period after the
+// termination, to avoid resurrecting events the participants consider ended.
+//
+// If the event server was already torn down, it is recreated.
+func (b *Backend) ReopenEvent(event tornet.IdentityFingerprint) error {
+	b.logger.Info("Reopening event", "event", event)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Ensure the event exists and is still within its reopen grace period
+	infos, err := b.HostedEvent(event)
+	if err != nil {
+		return ErrEventNotFound
+	}
+	if infos.End == (time.Time{}) {
+		return events.ErrEventNotConcluded
+	}
+	if time.Since(infos.End) > eventReopenGrace {
+		return ErrEventReopenExpired
+	}
+	// If the server is still running, reopen it, otherwise revive it reopened
+	server, ok := b.hosted[event]
+	if ok {
+		if err := server.Reopen(); err != nil {
+			return err
+		}
+	} else {
+		b.logger.Info("Reviving torn down event", "event", event)
+
+		infos.End, infos.Updated = time.Time{}, time.Now()
+		if server, err = events.RecreateServer((*eventHost)(b), b.torGateway(), infos, b.logger); err != nil {
+			return err
+		}
+		b.hosted[event] = server
+	}
+	// Push the reopening updates into the database too
+	blob, err := json.Marshal(server.Infos())
+	if err != nil {
+		return err
+	}
+	return b.putSecret(append(dbHostedEventPrefix, event...), blob)
 }
 
 // HostedEvents returns the unique ids of all the hosted events.
@@ -271,21 +461,73 @@ func (b *Backend) HostedEvents() []tornet.IdentityFingerprint {
 
 // HostedEvent retrieves all the known information about a hosted event.
 func (b *Backend) HostedEvent(event tornet.IdentityFingerprint) (*events.ServerInfos, error) {
-	blob, err := b.database.Get(append(dbHostedEventPrefix, event...), nil)
-	if err != nil {
+	blob, err := b.getSecret(append(dbHostedEventPrefix, event...))
+	if err == leveldb.ErrNotFound {
 		return nil, ErrEventNotFound
 	}
+	if err != nil {
+		return nil, err
+	}
 	infos := new(events.ServerInfos)
 	if err := json.Unmarshal(blob, infos); err != nil {
-		return nil, err
+		return nil, &corruptRecordError{err}
 	}
 	return infos, nil
 }
 
+// ExportHostedEvents retrieves a consistent snapshot of all the hosted events,
+// ordered by id. Running events are taken from their live servers (which might
+// be ahead of the persisted records), the rest from the database.
+func (b *Backend) ExportHostedEvents() ([]*events.ServerInfos, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.hostedEventsSnapshot()
+}
+
+// hostedEventsSnapshot is the lock free internals of ExportHostedEvents.
+//
+// Note, this method assumes the read lock is held.
+func (b *Backend) hostedEventsSnapshot() ([]*events.ServerInfos, error) {
+	snapshot := []*events.ServerInfos{} // Need explicit init for JSON!
+	for _, event := range b.HostedEvents() {
+		if server, ok := b.hosted[event]; ok {
+			snapshot = append(snapshot, server.Infos())
+			continue
+		}
+		infos, err := b.HostedEvent(event)
+		if err != nil {
+			return nil, err
+		}
+		snapshot = append(snapshot, infos)
+	}
+	return snapshot, nil
+}
+
+// HostedEventParticipants retrieves the roster of a hosted event. If the event
+// is running, the live participant data is used, otherwise the persisted one.
+func (b *Backend) HostedEventParticipants(event tornet.IdentityFingerprint) ([]*events.Participant, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if server, ok := b.hosted[event]; ok {
+		return server.Infos().Roster(), nil
+	}
+	infos, err := b.HostedEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	return infos.Roster(), nil
+}
+
 // UploadHostedEventBanner uploads a new banner picture for the hosted event.
 func (b *Backend) UploadHostedEventBanner(event tornet.IdentityFingerprint, data []byte) error {
 	b.logger.Info("Uploading hosted event banner", "event", event)
 
+	if len(data) > params.MaxImageBytes {
+		return ErrImageTooLarge
+	}
+
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
@@ -298,7 +540,7 @@ func (b *Backend) UploadHostedEventBanner(event tornet.IdentityFingerprint, data
 		return events.ErrEventConcluded
 	}
 	// Upload the image into the CDN and delete the old one
-	hash, err := b.uploadCDNImage(data)
+	hash, err := b.uploadCDNPicture(data)
 	if err != nil {
 		return err
 	}
@@ -317,7 +559,7 @@ func (b *Backend) UploadHostedEventBanner(event tornet.IdentityFingerprint, data
 	if err != nil {
 		return err
 	}
-	if err := b.database.Put(append(dbHostedEventPrefix, event...), blob, nil); err != nil {
+	if err := b.putSecret(append(dbHostedEventPrefix, event...), blob); err != nil {
 		return err
 	}
 	// Banner swapped out, ping the server too
@@ -352,7 +594,7 @@ func (b *Backend) DeleteHostedEventBanner(event tornet.IdentityFingerprint) erro
 	if err != nil {
 		return err
 	}
-	return b.database.Put(append(dbHostedEventPrefix, event...), blob, nil)
+	return b.putSecret(append(dbHostedEventPrefix, event...), blob)
 }
 
 // InitEventCheckin retrieves the current access and checkin credentials of a
@@ -423,14 +665,62 @@ func (b *Backend) WaitEventCheckin(event tornet.IdentityFingerprint) error {
 	return session.Wait(context.TODO())
 }
 
+// EventCheckins retrieves the authentication credential fingerprints of all the
+// live checkin sessions of a hosted event.
+func (b *Backend) EventCheckins(event tornet.IdentityFingerprint) ([]tornet.IdentityFingerprint, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	server, ok := b.hosted[event]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+	return server.CheckinSessions(), nil
+}
+
+// RevokeEventCheckin tears down a single live checkin session of a hosted event,
+// rejecting anyone attempting to check in with its credential afterwards. Other
+// concurrent sessions of the same event are left untouched.
+func (b *Backend) RevokeEventCheckin(event tornet.IdentityFingerprint, auth tornet.IdentityFingerprint) error {
+	b.logger.Info("Revoking checkin session", "event", event, "auth", auth)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	server, ok := b.hosted[event]
+	if !ok {
+		return ErrEventNotFound
+	}
+	if err := server.RevokeCheckin(auth); err != nil {
+		return err
+	}
+	// If the revoked session was the one handed out to the user, forget it so
+	// that a fresh one gets created on the next request
+	if session, ok := b.checkin[event]; ok && session.Auth.Fingerprint() == auth {
+		delete(b.checkin, event)
+	}
+	return nil
+}
+
 // JoinEventCheckin joins a remotely initiated event checkin process.
 func (b *Backend) JoinEventCheckin(id tornet.PublicIdentity, address tornet.PublicAddress, auth tornet.SecretIdentity) error {
+	// Reject malformed secrets before they get logged or dialed
+	if err := tornet.ValidateCheckinSecret(id, address, auth); err != nil {
+		return err
+	}
 	b.logger.Info("Joining for checkin session", "event", id.Fingerprint())
 
 	// Ensure there's a profile to check in with and a network to go through
 	if _, err := b.Profile(); err != nil {
 		return err
 	}
+	// Ensure nobody's joining the same event and we're not hammering Tor
+	release, err := b.startJoin("checkin-" + string(id.Fingerprint()))
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	online, connected, _, _, err := b.GatewayStatus()
 	if err != nil {
 		return err
@@ -462,7 +752,7 @@ func (b *Backend) JoinEventCheckin(id tornet.PublicIdentity, address tornet.Publ
 	if _, err := b.JoinedEvent(id.Fingerprint()); err == nil {
 		return ErrEventAlreadyJoined
 	}
-	client, err := events.CreateClient((*eventGuest)(b), tornet.NewTorGateway(b.network), id, address, auth, b.logger)
+	client, err := events.CreateClient((*eventGuest)(b), b.gateway(), id, address, auth, b.logger)
 	if err != nil {
 		return err
 	}
@@ -474,7 +764,7 @@ func (b *Backend) JoinEventCheckin(id tornet.PublicIdentity, address tornet.Publ
 	if err != nil {
 		return err
 	}
-	if err := b.database.Put(append(dbJoinedEventPrefix, event...), blob, nil); err != nil {
+	if err := b.putSecret(append(dbJoinedEventPrefix, event...), blob); err != nil {
 		client.Close()
 		return err
 	}
@@ -486,6 +776,49 @@ func (b *Backend) JoinEventCheckin(id tornet.PublicIdentity, address tornet.Publ
 	return nil
 }
 
+// LeaveEvent stops following a joined event, tearing down its client and deleting
+// all the data maintained about it. The event may be joined again afterwards via
+// a fresh checkin.
+func (b *Backend) LeaveEvent(event tornet.IdentityFingerprint) error {
+	b.logger.Info("Leaving event", "event", event)
+
+	// Stop tracking the event client, but tear it down outside of the lock since
+	// it might be blocked mid-dial
+	b.lock.Lock()
+	if _, err := b.JoinedEvent(event); err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	client := b.joined[event]
+	delete(b.joined, event)
+	b.lock.Unlock()
+
+	if client != nil {
+		client.Close()
+	}
+	// Client stopped, delete everything associated with the event
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	infos, err := b.JoinedEvent(event)
+	if err != nil {
+		return err // Left concurrently
+	}
+	if err := b.database.Delete(append(dbJoinedEventPrefix, event...), nil); err != nil {
+		return err
+	}
+	if err := b.database.Delete(append(dbEventReportPrefix, event...), nil); err != nil {
+		return err
+	}
+	if infos.Banner != ([32]byte{}) {
+		if err := b.deleteCDNImage(infos.Banner); err != nil {
+			return err
+		}
+	}
+	b.feed.publish(Event{Kind: EventJoinedLeft, Event: event})
+	return nil
+}
+
 // JoinedEvents returns the unique ids of all the joined events.
 func (b *Backend) JoinedEvents() []tornet.IdentityFingerprint {
 	events := []tornet.IdentityFingerprint{} // Need explicit init for JSON!
@@ -501,21 +834,42 @@ func (b *Backend) JoinedEvents() []tornet.IdentityFingerprint {
 
 // JoinedEvent retrieves all the known information about a joined event.
 func (b *Backend) JoinedEvent(event tornet.IdentityFingerprint) (*events.ClientInfos, error) {
-	blob, err := b.database.Get(append(dbJoinedEventPrefix, event...), nil)
-	if err != nil {
+	blob, err := b.getSecret(append(dbJoinedEventPrefix, event...))
+	if err == leveldb.ErrNotFound {
 		return nil, ErrEventNotFound
 	}
+	if err != nil {
+		return nil, err
+	}
 	infos := new(events.ClientInfos)
 	if err := json.Unmarshal(blob, infos); err != nil {
-		return nil, err
+		return nil, &corruptRecordError{err}
 	}
 	return infos, nil
 }
 
+// AttendanceProof retrieves the organizer signed proof that the local user did
+// check in to a joined event, serialized for storage or presentation.
+func (b *Backend) AttendanceProof(event tornet.IdentityFingerprint) ([]byte, error) {
+	infos, err := b.JoinedEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := infos.AttendanceProof()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(proof)
+}
+
 // uploadJoinedEventBanner uploads a new banner picture for the joined event.
 func (b *Backend) uploadJoinedEventBanner(event tornet.IdentityFingerprint, data []byte) error {
 	b.logger.Info("Uploading joined event banner", "event", event)
 
+	if len(data) > params.MaxImageBytes {
+		return ErrImageTooLarge
+	}
+
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
@@ -528,7 +882,7 @@ func (b *Backend) uploadJoinedEventBanner(event tornet.IdentityFingerprint, data
 		return events.ErrEventConcluded
 	}
 	// Upload the image into the CDN and delete the old one
-	hash, err := b.uploadCDNImage(data)
+	hash, err := b.uploadCDNPicture(data)
 	if err != nil {
 		return err
 	}
@@ -547,5 +901,5 @@ func (b *Backend) uploadJoinedEventBanner(event tornet.IdentityFingerprint, data
 	if err != nil {
 		return err
 	}
-	return b.database.Put(append(dbJoinedEventPrefix, event...), blob, nil)
+	return b.putSecret(append(dbJoinedEventPrefix, event...), blob)
 }
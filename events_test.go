@@ -0,0 +1,523 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+	"golang.org/x/crypto/sha3"
+)
+
+// Tests that the participant list of a hosted event reflects the live server
+// state, only revealing real identities once a status is reported.
+func TestHostedEventParticipants(t *testing.T) {
+	gateway := tornet.NewMockGateway()
+
+	organizer := newTestBackend(t)
+	defer organizer.database.Close()
+	newTestReporter(t, organizer)
+
+	if _, err := organizer.HostedEventParticipants("unknown"); err != ErrEventNotFound {
+		t.Fatalf("unknown event error mismatch: have %v, want %v", err, ErrEventNotFound)
+	}
+	banner, err := organizer.uploadCDNImage([]byte("barbecue banner"))
+	if err != nil {
+		t.Fatalf("failed to upload banner: %v", err)
+	}
+	server, err := events.CreateServer((*eventHost)(organizer), gateway, "barbecue", "", "", banner, organizer.logger)
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	event := server.Infos().Identity.Fingerprint()
+	organizer.hosted[event] = server
+
+	// Check a guest into the event and ensure it's listed anonymously
+	guest := newTestBackend(t)
+	defer guest.database.Close()
+	keyring := newTestReporter(t, guest)
+
+	session, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	client, err := events.CreateClient((*eventGuest)(guest), gateway, session.Identity, session.Address, session.Auth, guest.logger)
+	if err != nil {
+		t.Fatalf("failed to create event client: %v", err)
+	}
+	defer client.Close()
+
+	var participants []*events.Participant
+	for i := 0; i < 100; i++ {
+		if participants, err = organizer.HostedEventParticipants(event); err != nil {
+			t.Fatalf("failed to retrieve participants: %v", err)
+		}
+		if len(participants) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(participants) != 1 {
+		t.Fatalf("participant count mismatch: have %d, want %d", len(participants), 1)
+	}
+	if participants[0].Status != params.InfectionStatusUnknown || participants[0].Identity != "" || participants[0].Name != "" {
+		t.Fatalf("anonymous participant mismatch: have %+v", participants[0])
+	}
+	// Report a status from the guest and ensure the identity is revealed
+	for i := 0; i < 500 && client.Infos().Start.IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.Infos().Start.IsZero() {
+		t.Fatalf("event window not synced")
+	}
+	guest.lock.Lock()
+	guest.joined[event] = client
+	guest.lock.Unlock()
+
+	if err := guest.SetInfectionStatus(params.InfectionStatusPositive); err != nil {
+		t.Fatalf("failed to declare infection status: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if participants, err = organizer.HostedEventParticipants(event); err != nil {
+			t.Fatalf("failed to retrieve participants: %v", err)
+		}
+		if participants[0].Status == params.InfectionStatusPositive {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if participants[0].Status != params.InfectionStatusPositive {
+		t.Fatalf("participant status mismatch: have %s, want %s", participants[0].Status, params.InfectionStatusPositive)
+	}
+	if participants[0].Identity != keyring.Identity.Public().Fingerprint() {
+		t.Fatalf("participant identity mismatch: have %s, want %s", participants[0].Identity, keyring.Identity.Public().Fingerprint())
+	}
+	if participants[0].Name != "Bob" {
+		t.Fatalf("participant name mismatch: have %s, want %s", participants[0].Name, "Bob")
+	}
+}
+
+// Tests that the profile picture a participant attaches to an infection report
+// is retrieved by the organizer, stored in its CDN and flagged in the roster.
+func TestHostedEventParticipantAvatar(t *testing.T) {
+	gateway := tornet.NewMockGateway()
+
+	organizer := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(organizer.datadir)
+	defer organizer.Close()
+
+	guest := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(guest.datadir)
+	defer guest.Close()
+
+	for _, backend := range []*Backend{organizer, guest} {
+		if err := backend.CreateProfile(); err != nil {
+			t.Fatalf("failed to create profile: %v", err)
+		}
+		if err := backend.EnableGateway(); err != nil {
+			t.Fatalf("failed to enable gateway: %v", err)
+		}
+	}
+	// Give the guest a profile picture and something to report
+	avatar := []byte("guest avatar")
+	if err := guest.UpdateProfile("Bob"); err != nil {
+		t.Fatalf("failed to set profile name: %v", err)
+	}
+	if err := guest.UploadProfilePicture(avatar); err != nil {
+		t.Fatalf("failed to upload profile picture: %v", err)
+	}
+	if err := guest.SetInfectionStatus(params.InfectionStatusSuspected); err != nil {
+		t.Fatalf("failed to set infection status: %v", err)
+	}
+	// Host an event, join it and wait for the avatar to arrive
+	event, err := organizer.CreateEvent("barbecue", "", "")
+	if err != nil {
+		t.Fatalf("failed to create event: %v", err)
+	}
+	if err := organizer.UploadHostedEventBanner(event, []byte("barbecue banner")); err != nil {
+		t.Fatalf("failed to upload banner: %v", err)
+	}
+	session, err := organizer.InitEventCheckin(event)
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	if err := guest.JoinEventCheckin(session.Identity, session.Address, session.Auth); err != nil {
+		t.Fatalf("failed to join event: %v", err)
+	}
+	var infos *events.ServerInfos
+	for i := 0; i < 500; i++ {
+		if infos, err = organizer.HostedEvent(event); err == nil && len(infos.Avatars) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(infos.Avatars) != 1 {
+		t.Fatalf("participant avatar not retrieved")
+	}
+	for _, hash := range infos.Avatars {
+		blob, err := organizer.CDNImage(hash)
+		if err != nil {
+			t.Fatalf("failed to retrieve participant avatar: %v", err)
+		}
+		if string(blob) != string(avatar) {
+			t.Fatalf("participant avatar mismatch: have %q, want %q", blob, avatar)
+		}
+	}
+	roster, err := organizer.HostedEventParticipants(event)
+	if err != nil {
+		t.Fatalf("failed to retrieve participants: %v", err)
+	}
+	if len(roster) != 1 || !roster[0].Avatar {
+		t.Fatalf("roster avatar mismatch: have %+v", roster)
+	}
+	// Ensure a CDN sweep doesn't deem the participant avatar orphaned
+	if removed, err := organizer.SweepCDN(); err != nil || removed != 0 {
+		t.Fatalf("sweep mismatch: have %d/%v, want %d/%v", removed, err, 0, nil)
+	}
+}
+
+// Tests that if the banner of a hosted event is lost from the CDN, guests still
+// receive the event metadata, with a placeholder banner after a few retries.
+func TestHostedEventMissingBanner(t *testing.T) {
+	gateway := tornet.NewMockGateway()
+
+	// Host an event whose banner is not in the CDN
+	organizer := newTestBackend(t)
+	defer organizer.database.Close()
+	newTestReporter(t, organizer)
+
+	server, err := events.CreateServer((*eventHost)(organizer), gateway, "barbecue", "", "", [32]byte{0x01}, organizer.logger)
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	event := server.Infos().Identity.Fingerprint()
+	organizer.hosted[event] = server
+
+	// Check a guest into the event and keep refreshing until the metadata arrives
+	guest := newTestBackend(t)
+	defer guest.database.Close()
+	newTestReporter(t, guest)
+
+	session, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	client, err := events.CreateClient((*eventGuest)(guest), gateway, session.Identity, session.Address, session.Auth, guest.logger)
+	if err != nil {
+		t.Fatalf("failed to create event client: %v", err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 500 && client.Infos().Banner == ([32]byte{}); i++ {
+		if i%10 == 9 {
+			client.Refresh()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	infos := client.Infos()
+	if infos.Banner == ([32]byte{}) {
+		t.Fatalf("event metadata not retrieved")
+	}
+	if infos.Name != "barbecue" {
+		t.Fatalf("event name mismatch: have %s, want %s", infos.Name, "barbecue")
+	}
+	if want := sha3.Sum256(makePlaceholder()); infos.Banner != want {
+		t.Fatalf("banner mismatch: have %x, want placeholder %x", infos.Banner, want)
+	}
+}
+
+// Tests that draining a backend waits for in-flight event reports to be fully
+// processed and persisted before the networking is torn down.
+func TestHostedEventDrain(t *testing.T) {
+	gateway := tornet.NewMockGateway()
+
+	organizer := newTestBackend(t)
+	defer organizer.database.Close()
+	newTestReporter(t, organizer)
+
+	banner, err := organizer.uploadCDNImage([]byte("barbecue banner"))
+	if err != nil {
+		t.Fatalf("failed to upload banner: %v", err)
+	}
+	server, err := events.CreateServer((*eventHost)(organizer), gateway, "barbecue", "", "", banner, organizer.logger)
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	event := server.Infos().Identity.Fingerprint()
+	organizer.hosted[event] = server
+
+	// Check a guest into the event and wait for the event window to sync
+	guest := newTestBackend(t)
+	defer guest.database.Close()
+	newTestReporter(t, guest)
+
+	session, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	client, err := events.CreateClient((*eventGuest)(guest), gateway, session.Identity, session.Address, session.Auth, guest.logger)
+	if err != nil {
+		t.Fatalf("failed to create event client: %v", err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 500 && client.Infos().Start.IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.Infos().Start.IsZero() {
+		t.Fatalf("event window not synced")
+	}
+	guest.lock.Lock()
+	guest.joined[event] = client
+	guest.lock.Unlock()
+
+	// Report a status and drain the organizer as soon as it's received
+	if err := guest.SetInfectionStatus(params.InfectionStatusPositive); err != nil {
+		t.Fatalf("failed to declare infection status: %v", err)
+	}
+	reported := func() bool {
+		for _, status := range server.Infos().Statuses {
+			if status == params.InfectionStatusPositive {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < 5000 && !reported(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if !reported() {
+		t.Fatalf("status report not received")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if err := organizer.drain(ctx); err != nil {
+		t.Fatalf("failed to drain backend: %v", err)
+	}
+	// Ensure the report was persisted by the time draining finished
+	blob, err := organizer.database.Get(append(dbHostedEventPrefix, event...), nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve event infos: %v", err)
+	}
+	infos := new(events.ServerInfos)
+	if err := json.Unmarshal(blob, infos); err != nil {
+		t.Fatalf("failed to unmarshal event infos: %v", err)
+	}
+	if len(infos.Statuses) != 1 {
+		t.Fatalf("reported status count mismatch: have %d, want %d", len(infos.Statuses), 1)
+	}
+	for _, status := range infos.Statuses {
+		if status != params.InfectionStatusPositive {
+			t.Fatalf("reported status mismatch: have %s, want %s", status, params.InfectionStatusPositive)
+		}
+	}
+}
+
+// Tests that a terminated event can be reopened within the grace period, but
+// not afterwards, and not if it's still running.
+func TestReopenEvent(t *testing.T) {
+	organizer := newTestBackend(t)
+	defer organizer.database.Close()
+	newTestReporter(t, organizer)
+
+	if err := organizer.ReopenEvent("unknown"); err != ErrEventNotFound {
+		t.Fatalf("unknown event error mismatch: have %v, want %v", err, ErrEventNotFound)
+	}
+	// Create an event and persist it as the backend would
+	server, err := events.CreateServer((*eventHost)(organizer), tornet.NewMockGateway(), "barbecue", "", "", [32]byte{}, organizer.logger)
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	event := server.Infos().Identity.Fingerprint()
+	organizer.hosted[event] = server
+
+	blob, _ := json.Marshal(server.Infos())
+	if err := organizer.putSecret(append(dbHostedEventPrefix, event...), blob); err != nil {
+		t.Fatalf("failed to store event: %v", err)
+	}
+	if err := organizer.ReopenEvent(event); err != events.ErrEventNotConcluded {
+		t.Fatalf("running event error mismatch: have %v, want %v", err, events.ErrEventNotConcluded)
+	}
+	// Terminate the event, reopen it and ensure both the server and the database
+	// reflect the change
+	if err := organizer.TerminateEvent(event); err != nil {
+		t.Fatalf("failed to terminate event: %v", err)
+	}
+	if err := organizer.ReopenEvent(event); err != nil {
+		t.Fatalf("failed to reopen event: %v", err)
+	}
+	if end := server.Infos().End; end != (time.Time{}) {
+		t.Fatalf("server end mismatch: have %v, want zero", end)
+	}
+	infos, err := organizer.HostedEvent(event)
+	if err != nil {
+		t.Fatalf("failed to retrieve event: %v", err)
+	}
+	if infos.End != (time.Time{}) {
+		t.Fatalf("persisted end mismatch: have %v, want zero", infos.End)
+	}
+	// Simulate the event being torn down long after termination and ensure it
+	// cannot be reopened any more
+	delete(organizer.hosted, event)
+
+	infos.End = time.Now().Add(-2 * eventReopenGrace)
+	blob, _ = json.Marshal(infos)
+	if err := organizer.putSecret(append(dbHostedEventPrefix, event...), blob); err != nil {
+		t.Fatalf("failed to store event: %v", err)
+	}
+	if err := organizer.ReopenEvent(event); err != ErrEventReopenExpired {
+		t.Fatalf("expired reopen error mismatch: have %v, want %v", err, ErrEventReopenExpired)
+	}
+}
+
+// Tests that exporting the hosted events snapshots the live state of running
+// servers and falls back to the database for the ones torn down.
+func TestExportHostedEvents(t *testing.T) {
+	organizer := newTestBackend(t)
+	defer organizer.database.Close()
+	newTestReporter(t, organizer)
+
+	if snapshot, err := organizer.ExportHostedEvents(); err != nil || len(snapshot) != 0 {
+		t.Fatalf("empty snapshot mismatch: have %v/%v, want %v/%v", snapshot, err, []*events.ServerInfos{}, nil)
+	}
+	// Create a running event whose persisted record lags behind the live one
+	server, err := events.CreateServer((*eventHost)(organizer), tornet.NewMockGateway(), "barbecue", "", "", [32]byte{}, organizer.logger)
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	live := server.Infos().Identity.Fingerprint()
+	organizer.hosted[live] = server
+
+	stale := server.Infos()
+	stale.Name = "stale barbecue"
+	blob, _ := json.Marshal(stale)
+	if err := organizer.putSecret(append(dbHostedEventPrefix, live...), blob); err != nil {
+		t.Fatalf("failed to store event: %v", err)
+	}
+	// Create a concluded event that only lives in the database
+	blob, _ = json.Marshal(&events.ServerInfos{Name: "picnic", End: time.Now().Add(-time.Hour)})
+	if err := organizer.putSecret(append(dbHostedEventPrefix, "archived"...), blob); err != nil {
+		t.Fatalf("failed to store event: %v", err)
+	}
+	// Export the events and ensure both are present with the freshest data
+	snapshot, err := organizer.ExportHostedEvents()
+	if err != nil {
+		t.Fatalf("failed to export hosted events: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, infos := range snapshot {
+		names[infos.Name] = true
+	}
+	if len(snapshot) != 2 || !names["barbecue"] || !names["picnic"] {
+		t.Fatalf("snapshot mismatch: have %v, want %v", names, []string{"barbecue", "picnic"})
+	}
+	// Ensure the snapshot is detached from the live server
+	for _, infos := range snapshot {
+		if infos.Name == "barbecue" {
+			infos.Statuses["intruder"] = params.InfectionStatusPositive
+		}
+	}
+	if _, ok := server.Infos().Statuses["intruder"]; ok {
+		t.Fatalf("snapshot aliases the live server state")
+	}
+}
+
+// Tests that leaving a joined event tears down its client and deletes all data
+// associated with it, after which the event can be joined again.
+func TestLeaveEvent(t *testing.T) {
+	gateway := tornet.NewMockGateway()
+
+	organizer := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(organizer.datadir)
+	defer organizer.Close()
+
+	guest := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(guest.datadir)
+	defer guest.Close()
+
+	for _, backend := range []*Backend{organizer, guest} {
+		if err := backend.CreateProfile(); err != nil {
+			t.Fatalf("failed to create profile: %v", err)
+		}
+		if err := backend.EnableGateway(); err != nil {
+			t.Fatalf("failed to enable gateway: %v", err)
+		}
+	}
+	// Host an event with a banner and join it
+	event, err := organizer.CreateEvent("barbecue", "", "")
+	if err != nil {
+		t.Fatalf("failed to create event: %v", err)
+	}
+	if err := organizer.UploadHostedEventBanner(event, []byte("barbecue banner")); err != nil {
+		t.Fatalf("failed to upload banner: %v", err)
+	}
+	session, err := organizer.InitEventCheckin(event)
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	if err := guest.JoinEventCheckin(session.Identity, session.Address, session.Auth); err != nil {
+		t.Fatalf("failed to join event: %v", err)
+	}
+	var infos *events.ClientInfos
+	for i := 0; i < 500; i++ {
+		if infos, err = guest.JoinedEvent(event); err == nil && infos.Banner != [32]byte{} {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if infos.Banner == [32]byte{} {
+		t.Fatalf("event banner not synced")
+	}
+	// Leave the event and ensure everything is cleaned up
+	if err := guest.LeaveEvent(event); err != nil {
+		t.Fatalf("failed to leave event: %v", err)
+	}
+	if _, err := guest.JoinedEvent(event); err != ErrEventNotFound {
+		t.Fatalf("left event error mismatch: have %v, want %v", err, ErrEventNotFound)
+	}
+	guest.lock.RLock()
+	_, tracked := guest.joined[event]
+	guest.lock.RUnlock()
+	if tracked {
+		t.Fatalf("left event still tracked")
+	}
+	if refs, _ := guest.cdnImageMeta(infos.Banner); refs != 0 {
+		t.Fatalf("banner reference count mismatch: have %d, want %d", refs, 0)
+	}
+	if err := guest.LeaveEvent(event); err != ErrEventNotFound {
+		t.Fatalf("double leave error mismatch: have %v, want %v", err, ErrEventNotFound)
+	}
+	// Ensure the event can be joined again with fresh credentials
+	organizer.lock.RLock()
+	server := organizer.hosted[event]
+	organizer.lock.RUnlock()
+
+	session, err = server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	if err := guest.JoinEventCheckin(session.Identity, session.Address, session.Auth); err != nil {
+		t.Fatalf("failed to rejoin event: %v", err)
+	}
+	if _, err := guest.JoinedEvent(event); err != nil {
+		t.Fatalf("failed to retrieve rejoined event: %v", err)
+	}
+}
@@ -0,0 +1,471 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	// ErrEventAlreadyHosted is returned if an event is attempted to be imported
+	// that the local user is already hosting or participating in.
+	ErrEventAlreadyHosted = errors.New("event already hosted")
+
+	// ErrInvalidExport is returned if an exported blob cannot be decrypted, either
+	// because the passphrase is wrong or because the data was corrupted.
+	ErrInvalidExport = errors.New("invalid passphrase or corrupt export")
+
+	// ErrUnsupportedExport is returned if an exported profile was created by a
+	// newer version using a bundle format not known by this one.
+	ErrUnsupportedExport = errors.New("unsupported export version")
+)
+
+const (
+	// exportSaltLength is the number of random bytes to salt the passphrase
+	// based key derivation with.
+	exportSaltLength = 16
+
+	// exportScryptN, exportScryptR and exportScryptP are the scrypt parameters
+	// for deriving the encryption key from the user's passphrase.
+	exportScryptN = 1 << 15
+	exportScryptR = 8
+	exportScryptP = 1
+
+	// profileExportVersion is the version of the profile bundle format produced
+	// by ExportProfile. Any schema change must bump it and ImportProfile must keep
+	// accepting all older versions.
+	profileExportVersion = 1
+)
+
+// hostedEventExport is the complete state of a hosted event needed to resume
+// running it on a different device.
+type hostedEventExport struct {
+	Infos   *events.ServerInfos `json:"infos"`             // Secret credentials and participant data
+	Banner  []byte              `json:"banner"`            // Banner image, since the CDN is not exported
+	Avatars map[string][]byte   `json:"avatars,omitempty"` // Participant pictures, keyed by hex hash
+}
+
+// ExportHostedEvent serializes the entire state of a hosted event (including
+// its secret identity and address, along with all the participant data) and
+// encrypts it with the given passphrase, allowing another device to take over
+// hosting via ImportHostedEvent.
+//
+// Note, the event is not stopped locally. Since both servers would share the
+// same onion address, the caller should not run both instances concurrently.
+func (b *Backend) ExportHostedEvent(event tornet.IdentityFingerprint, passphrase string) ([]byte, error) {
+	b.logger.Info("Exporting hosted event", "event", event)
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	// Prefer the live infos of running events, but allow exporting old ones too
+	var (
+		infos *events.ServerInfos
+		err   error
+	)
+	if server, ok := b.hosted[event]; ok {
+		infos = server.Infos()
+	} else if infos, err = b.HostedEvent(event); err != nil {
+		return nil, err
+	}
+	export := &hostedEventExport{Infos: infos, Avatars: make(map[string][]byte)}
+	if infos.Banner != ([32]byte{}) {
+		if export.Banner, err = b.CDNImage(infos.Banner); err != nil {
+			return nil, err
+		}
+	}
+	for _, hash := range infos.Avatars {
+		if export.Avatars[hex.EncodeToString(hash[:])], err = b.CDNImage(hash); err != nil {
+			return nil, err
+		}
+	}
+	blob, err := json.Marshal(export)
+	if err != nil {
+		return nil, err
+	}
+	return sealExport(blob, passphrase)
+}
+
+// ImportHostedEvent decrypts an event exported via ExportHostedEvent, persists
+// it into the local database and starts serving it. Importing fails if an event
+// with the same identity is already known locally.
+func (b *Backend) ImportHostedEvent(blob []byte, passphrase string) error {
+	return b.importHostedEvent(blob, passphrase, b.gateway())
+}
+
+// importHostedEvent is the gateway agnostic internals of ImportHostedEvent.
+func (b *Backend) importHostedEvent(blob []byte, passphrase string, gateway tornet.Gateway) error {
+	// The local user is a participant of all events, make sure it exists
+	if _, err := b.Profile(); err != nil {
+		return err
+	}
+	blob, err := openExport(blob, passphrase)
+	if err != nil {
+		return err
+	}
+	export := new(hostedEventExport)
+	if err := json.Unmarshal(blob, export); err != nil {
+		return ErrInvalidExport
+	}
+	if export.Infos == nil || export.Infos.Identity == nil || export.Infos.Address == nil {
+		return ErrInvalidExport
+	}
+	infos := export.Infos
+	event := infos.Identity.Fingerprint()
+
+	b.logger.Info("Importing hosted event", "event", event, "name", infos.Name)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Ensure the event doesn't clash with anything already tracked
+	if _, ok := b.hosted[event]; ok {
+		return ErrEventAlreadyHosted
+	}
+	if _, ok := b.joined[event]; ok {
+		return ErrEventAlreadyHosted
+	}
+	if ok, _ := b.database.Has(append(dbHostedEventPrefix, event...), nil); ok {
+		return ErrEventAlreadyHosted
+	}
+	if ok, _ := b.database.Has(append(dbJoinedEventPrefix, event...), nil); ok {
+		return ErrEventAlreadyHosted
+	}
+	// Restore the banner and participant pictures into the CDN and persist the event
+	if infos.Banner != ([32]byte{}) {
+		hash, err := b.uploadCDNPicture(export.Banner)
+		if err != nil {
+			return err
+		}
+		if hash != infos.Banner {
+			b.deleteCDNImage(hash)
+			return ErrInvalidExport
+		}
+	}
+	for _, avatar := range infos.Avatars {
+		data, ok := export.Avatars[hex.EncodeToString(avatar[:])]
+		if !ok {
+			return ErrInvalidExport
+		}
+		hash, err := b.uploadCDNPicture(data)
+		if err != nil {
+			return err
+		}
+		if hash != avatar {
+			b.deleteCDNImage(hash)
+			return ErrInvalidExport
+		}
+	}
+	blob, err = json.Marshal(infos)
+	if err != nil {
+		return err
+	}
+	if err := b.putSecret(append(dbHostedEventPrefix, event...), blob); err != nil {
+		return err
+	}
+	// If the event is still running (or in maintenance), resume serving it
+	if infos.End != (time.Time{}) && time.Since(infos.End) > params.EventMaintenancePeriod {
+		b.logger.Info("Imported event exceeded maintenance period", "event", event, "ended", time.Since(infos.End))
+		return nil
+	}
+	server, err := events.RecreateServer((*eventHost)(b), gateway, infos, b.logger)
+	if err != nil {
+		b.database.Delete(append(dbHostedEventPrefix, event...), nil)
+		return err
+	}
+	b.hosted[event] = server
+	return nil
+}
+
+// profileExport is the complete state of a local user needed to resume it on a
+// different device, including all the images referenced by any of the records.
+type profileExport struct {
+	Version    uint                                    `json:"version"`    // Bundle format version
+	Profile    *profile                                `json:"profile"`    // Keyring, name and avatar of the user
+	Contacts   map[tornet.IdentityFingerprint]*contact `json:"contacts"`   // Profile infos of all the contacts
+	Hosted     []*events.ServerInfos                   `json:"hosted"`     // Secret credentials and data of hosted events
+	Joined     []*events.ClientInfos                   `json:"joined"`     // Credentials and data of joined events
+	Infections []*InfectionStatus                      `json:"infections"` // Self-declared infection status history
+	Images     map[string][]byte                       `json:"images"`     // Referenced CDN images, keyed by hex hash
+}
+
+// ExportProfile serializes the entire state of the local user (keyring, profile,
+// contacts, hosted and joined events, along with all the images they reference)
+// and encrypts it with the given passphrase, allowing another device to take
+// over via ImportProfile. The export is self-contained, the original device can
+// be wiped afterwards.
+//
+// Note, the profile is not stopped locally. Since both devices would share the
+// same identity and onion addresses, the caller should not run both concurrently.
+func (b *Backend) ExportProfile(passphrase string) ([]byte, error) {
+	b.logger.Info("Exporting profile")
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	prof, err := b.Profile()
+	if err != nil {
+		return nil, err
+	}
+	export := &profileExport{
+		Version:  profileExportVersion,
+		Profile:  prof,
+		Contacts: make(map[tornet.IdentityFingerprint]*contact),
+		Images:   make(map[string][]byte),
+	}
+	// Gather all the records and track the images they reference
+	images := [][32]byte{prof.Avatar}
+
+	for uid := range prof.KeyRing.Trusted {
+		info, err := b.Contact(uid)
+		if err != nil {
+			return nil, err
+		}
+		export.Contacts[uid] = info
+		images = append(images, info.Avatar)
+	}
+	hosted, err := b.hostedEventsSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	for _, infos := range hosted {
+		export.Hosted = append(export.Hosted, infos)
+		images = append(images, infos.Banner)
+		for _, avatar := range infos.Avatars {
+			images = append(images, avatar)
+		}
+	}
+	for _, event := range b.JoinedEvents() {
+		var infos *events.ClientInfos
+		if client, ok := b.joined[event]; ok {
+			infos = client.Infos()
+		} else if infos, err = b.JoinedEvent(event); err != nil {
+			return nil, err
+		}
+		export.Joined = append(export.Joined, infos)
+		images = append(images, infos.Banner)
+	}
+	if export.Infections, err = b.infectionHistory(); err != nil {
+		return nil, err
+	}
+	// Embed the referenced images, since the CDN is not exported wholesale
+	for _, hash := range images {
+		if hash == ([32]byte{}) {
+			continue
+		}
+		id := hex.EncodeToString(hash[:])
+		if _, ok := export.Images[id]; ok {
+			continue
+		}
+		if export.Images[id], err = b.CDNImage(hash); err != nil {
+			return nil, err
+		}
+	}
+	blob, err := json.Marshal(export)
+	if err != nil {
+		return nil, err
+	}
+	return sealExport(blob, passphrase)
+}
+
+// ImportProfile decrypts a profile exported via ExportProfile, persists all its
+// contents into the local database and starts up the overlay network. Importing
+// fails if a local profile already exists.
+func (b *Backend) ImportProfile(blob []byte, passphrase string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	keyring, err := b.importProfile(blob, passphrase)
+	if err != nil {
+		return err
+	}
+	return b.initOverlay(*keyring)
+}
+
+// importProfile is the networking agnostic internals of ImportProfile, restoring
+// all the records into the database without starting anything.
+//
+// Note, this method assumes the write lock is held.
+func (b *Backend) importProfile(blob []byte, passphrase string) (*tornet.SecretKeyRing, error) {
+	// Make sure there's no already existing user
+	if _, err := b.Profile(); err == nil {
+		return nil, ErrProfileExists
+	}
+	blob, err := openExport(blob, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	export := new(profileExport)
+	if err := json.Unmarshal(blob, export); err != nil {
+		return nil, ErrInvalidExport
+	}
+	if export.Version == 0 {
+		return nil, ErrInvalidExport
+	}
+	if export.Version > profileExportVersion {
+		return nil, ErrUnsupportedExport
+	}
+	if export.Profile == nil || export.Profile.KeyRing == nil {
+		return nil, ErrInvalidExport
+	}
+	b.logger.Info("Importing profile", "version", export.Version, "contacts", len(export.Contacts),
+		"hosted", len(export.Hosted), "joined", len(export.Joined))
+
+	// Restore an image into the CDN for a record referencing it
+	restore := func(hash [32]byte) error {
+		if hash == ([32]byte{}) {
+			return nil
+		}
+		data, ok := export.Images[hex.EncodeToString(hash[:])]
+		if !ok {
+			return ErrInvalidExport
+		}
+		uploaded, err := b.uploadCDNPicture(data)
+		if err != nil {
+			return err
+		}
+		if uploaded != hash {
+			b.deleteCDNImage(uploaded)
+			return ErrInvalidExport
+		}
+		return nil
+	}
+	// Persist all the records, leaving the profile to last so that an interrupted
+	// import does not surface a half restored user
+	for uid, info := range export.Contacts {
+		if _, ok := export.Profile.KeyRing.Trusted[uid]; !ok || info == nil {
+			return nil, ErrInvalidExport
+		}
+		if err := restore(info.Avatar); err != nil {
+			return nil, err
+		}
+		blob, err := json.Marshal(info)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.database.Put(append(dbContactPrefix, uid...), blob, nil); err != nil {
+			return nil, err
+		}
+	}
+	for _, infos := range export.Hosted {
+		if infos == nil || infos.Identity == nil || infos.Address == nil {
+			return nil, ErrInvalidExport
+		}
+		if err := restore(infos.Banner); err != nil {
+			return nil, err
+		}
+		for _, avatar := range infos.Avatars {
+			if err := restore(avatar); err != nil {
+				return nil, err
+			}
+		}
+		blob, err := json.Marshal(infos)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.putSecret(append(dbHostedEventPrefix, infos.Identity.Fingerprint()...), blob); err != nil {
+			return nil, err
+		}
+	}
+	for _, infos := range export.Joined {
+		if infos == nil || infos.Identity == nil {
+			return nil, ErrInvalidExport
+		}
+		if err := restore(infos.Banner); err != nil {
+			return nil, err
+		}
+		blob, err := json.Marshal(infos)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.putSecret(append(dbJoinedEventPrefix, infos.Identity.Fingerprint()...), blob); err != nil {
+			return nil, err
+		}
+	}
+	if len(export.Infections) > 0 {
+		blob, err := json.Marshal(export.Infections)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.putSecret(dbInfectionKey, blob); err != nil {
+			return nil, err
+		}
+	}
+	if err := restore(export.Profile.Avatar); err != nil {
+		return nil, err
+	}
+	blob, err = json.Marshal(export.Profile)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.putSecret(dbProfileKey, blob); err != nil {
+		return nil, err
+	}
+	return export.Profile.KeyRing, nil
+}
+
+// sealExport encrypts a blob with AES-GCM, using a key derived from the given
+// passphrase via scrypt. The output is the salt, followed by the nonce and the
+// sealed data.
+func sealExport(blob []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, exportSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := exportCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(salt, nonce...)
+	return aead.Seal(sealed, nonce, blob, nil), nil
+}
+
+// openExport decrypts a blob sealed by sealExport with the given passphrase.
+func openExport(blob []byte, passphrase string) ([]byte, error) {
+	if len(blob) < exportSaltLength {
+		return nil, ErrInvalidExport
+	}
+	aead, err := exportCipher(passphrase, blob[:exportSaltLength])
+	if err != nil {
+		return nil, err
+	}
+	blob = blob[exportSaltLength:]
+	if len(blob) < aead.NonceSize() {
+		return nil, ErrInvalidExport
+	}
+	plain, err := aead.Open(nil, blob[:aead.NonceSize()], blob[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrInvalidExport
+	}
+	return plain, nil
+}
+
+// exportCipher derives the symmetric key for an export from the passphrase and
+// salt, and creates an authenticated cipher from it.
+func exportCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, exportScryptN, exportScryptR, exportScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,222 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that a hosted event can be exported from one backend and imported into
+// another, which resumes serving the existing participants.
+func TestHostedEventHandoff(t *testing.T) {
+	// Create an organizer hosting an event and a guest checked into it
+	gateway := tornet.NewMockGateway()
+
+	organizer := newTestBackend(t)
+	defer organizer.database.Close()
+	newTestReporter(t, organizer)
+
+	banner, err := organizer.uploadCDNImage([]byte("barbecue banner"))
+	if err != nil {
+		t.Fatalf("failed to upload banner: %v", err)
+	}
+	server, err := events.CreateServer((*eventHost)(organizer), gateway, "barbecue", "", "", banner, organizer.logger)
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	event := server.Infos().Identity.Fingerprint()
+	(*eventHost)(organizer).OnUpdate(event, server)
+	organizer.hosted[event] = server
+
+	guest := newTestBackend(t)
+	defer guest.database.Close()
+	newTestReporter(t, guest)
+
+	session, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	client, err := events.CreateClient((*eventGuest)(guest), gateway, session.Identity, session.Address, session.Auth, guest.logger)
+	if err != nil {
+		t.Fatalf("failed to create event client: %v", err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 500 && client.Infos().Start.IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.Infos().Start.IsZero() {
+		t.Fatalf("event window not synced")
+	}
+	guest.lock.Lock()
+	guest.joined[event] = client
+	guest.lock.Unlock()
+
+	// Export the event and stop hosting it on the original organizer
+	blob, err := organizer.ExportHostedEvent(event, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("failed to export event: %v", err)
+	}
+	exported := server.Infos()
+	server.Close()
+
+	// Import the event into a new organizer, rejecting bad passphrases and dupes
+	successor := newTestBackend(t)
+	defer successor.database.Close()
+	newTestReporter(t, successor)
+
+	if err := successor.importHostedEvent(blob, "wrong passphrase", gateway); err != ErrInvalidExport {
+		t.Fatalf("bad passphrase error mismatch: have %v, want %v", err, ErrInvalidExport)
+	}
+	if err := successor.importHostedEvent(blob, "correct horse battery staple", gateway); err != nil {
+		t.Fatalf("failed to import event: %v", err)
+	}
+	defer successor.hosted[event].Close()
+
+	if err := successor.importHostedEvent(blob, "correct horse battery staple", gateway); err != ErrEventAlreadyHosted {
+		t.Fatalf("duplicate import error mismatch: have %v, want %v", err, ErrEventAlreadyHosted)
+	}
+	imported, err := successor.HostedEvent(event)
+	if err != nil {
+		t.Fatalf("failed to retrieve imported event: %v", err)
+	}
+	if imported.Address.Fingerprint() != exported.Address.Fingerprint() {
+		t.Errorf("address mismatch: have %s, want %s", imported.Address.Fingerprint(), exported.Address.Fingerprint())
+	}
+	if len(imported.Participants) != 1 || len(imported.Participants) != len(exported.Participants) {
+		t.Errorf("participant count mismatch: have %d, want %d", len(imported.Participants), len(exported.Participants))
+	}
+	// Ensure the existing participant can report to the new organizer
+	if err := guest.SetInfectionStatus(params.InfectionStatusPositive); err != nil {
+		t.Fatalf("failed to declare infection status: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if stats := successor.hosted[event].Infos().Stats(); stats.Positives == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("infection report not delivered to the new organizer")
+}
+
+// Tests that a full profile can be exported from one backend and imported into
+// another, restoring the keyring, contacts, events and all referenced images.
+func TestProfileHandoff(t *testing.T) {
+	gateway := tornet.NewMockGateway()
+
+	// Create a user with an avatar, a contact and a hosted event
+	original := newTestBackend(t)
+	defer original.database.Close()
+	newTestReporter(t, original)
+
+	prof, err := original.Profile()
+	if err != nil {
+		t.Fatalf("failed to retrieve profile: %v", err)
+	}
+	if prof.Avatar, err = original.uploadCDNPicture([]byte("selfie")); err != nil {
+		t.Fatalf("failed to upload avatar: %v", err)
+	}
+	remote, err := tornet.GenerateKeyRing()
+	if err != nil {
+		t.Fatalf("failed to generate contact keyring: %v", err)
+	}
+	uid := remote.Identity.Public().Fingerprint()
+	prof.KeyRing.Trusted[uid] = tornet.RemoteKeyRing{Identity: remote.Identity.Public(), Address: remote.Addresses[0].Public()}
+
+	blob, _ := json.Marshal(prof)
+	if err := original.putSecret(dbProfileKey, blob); err != nil {
+		t.Fatalf("failed to store profile: %v", err)
+	}
+	avatar, err := original.uploadCDNPicture([]byte("contact selfie"))
+	if err != nil {
+		t.Fatalf("failed to upload contact avatar: %v", err)
+	}
+	blob, _ = json.Marshal(&contact{Name: "Alice", Avatar: avatar})
+	if err := original.database.Put(append(dbContactPrefix, uid...), blob, nil); err != nil {
+		t.Fatalf("failed to store contact: %v", err)
+	}
+	banner, err := original.uploadCDNImage([]byte("barbecue banner"))
+	if err != nil {
+		t.Fatalf("failed to upload banner: %v", err)
+	}
+	server, err := events.CreateServer((*eventHost)(original), gateway, "barbecue", "", "", banner, original.logger)
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	event := server.Infos().Identity.Fingerprint()
+	(*eventHost)(original).OnUpdate(event, server)
+	server.Close()
+
+	if err := original.SetInfectionStatus(params.InfectionStatusPositive); err != nil {
+		t.Fatalf("failed to declare infection status: %v", err)
+	}
+	// Export the profile and import it into a fresh backend
+	blob, err = original.ExportProfile("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("failed to export profile: %v", err)
+	}
+	successor := newTestBackend(t)
+	defer successor.database.Close()
+
+	if _, err := successor.importProfile(blob, "wrong passphrase"); err != ErrInvalidExport {
+		t.Fatalf("bad passphrase error mismatch: have %v, want %v", err, ErrInvalidExport)
+	}
+	keyring, err := successor.importProfile(blob, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("failed to import profile: %v", err)
+	}
+	if _, err := successor.importProfile(blob, "correct horse battery staple"); err != ErrProfileExists {
+		t.Fatalf("duplicate import error mismatch: have %v, want %v", err, ErrProfileExists)
+	}
+	// Ensure everything was restored
+	if keyring.Identity.Public().Fingerprint() != prof.KeyRing.Identity.Public().Fingerprint() {
+		t.Fatalf("identity mismatch: have %s, want %s", keyring.Identity.Public().Fingerprint(), prof.KeyRing.Identity.Public().Fingerprint())
+	}
+	imported, err := successor.Profile()
+	if err != nil {
+		t.Fatalf("failed to retrieve imported profile: %v", err)
+	}
+	if imported.Name != "Bob" || imported.Avatar != prof.Avatar {
+		t.Fatalf("profile mismatch: have %s/%x, want %s/%x", imported.Name, imported.Avatar, "Bob", prof.Avatar)
+	}
+	info, err := successor.Contact(uid)
+	if err != nil {
+		t.Fatalf("failed to retrieve imported contact: %v", err)
+	}
+	if info.Name != "Alice" || info.Avatar != avatar {
+		t.Fatalf("contact mismatch: have %s/%x, want %s/%x", info.Name, info.Avatar, "Alice", avatar)
+	}
+	infos, err := successor.HostedEvent(event)
+	if err != nil {
+		t.Fatalf("failed to retrieve imported event: %v", err)
+	}
+	if infos.Name != "barbecue" || infos.Banner != banner {
+		t.Fatalf("event mismatch: have %s/%x, want %s/%x", infos.Name, infos.Banner, "barbecue", banner)
+	}
+	for _, hash := range [][32]byte{prof.Avatar, avatar, banner} {
+		if _, err := successor.CDNImage(hash); err != nil {
+			t.Fatalf("image %x not restored: %v", hash, err)
+		}
+	}
+	if status, err := successor.InfectionStatus(); err != nil || status.Status != params.InfectionStatusPositive {
+		t.Fatalf("infection status mismatch: have %v/%v, want %s", status, err, params.InfectionStatusPositive)
+	}
+	// Ensure bundles from newer versions are rejected
+	blob, _ = json.Marshal(&profileExport{Version: profileExportVersion + 1, Profile: prof})
+	if blob, err = sealExport(blob, "passphrase"); err != nil {
+		t.Fatalf("failed to seal export: %v", err)
+	}
+	future := newTestBackend(t)
+	defer future.database.Close()
+
+	if _, err := future.importProfile(blob, "passphrase"); err != ErrUnsupportedExport {
+		t.Fatalf("future version error mismatch: have %v, want %v", err, ErrUnsupportedExport)
+	}
+}
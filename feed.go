@@ -0,0 +1,142 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"sync"
+
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+const (
+	// EventHostedInactive is emitted when a hosted event had no activity for a
+	// long time and the organizer should be reminded to terminate it.
+	EventHostedInactive = "hosted-inactive"
+
+	// EventHostedTerminated is emitted when a hosted event was terminated by the
+	// backend itself, not by the organizer.
+	EventHostedTerminated = "hosted-terminated"
+
+	// EventHostedStarted is emitted when a scheduled (or recurring) hosted event
+	// was created by the backend as its start time arrived.
+	EventHostedStarted = "hosted-started"
+
+	// EventPairingCompleted is emitted when a pairing session (either initiated
+	// or joined) completes and the remote user is added as a contact.
+	EventPairingCompleted = "pairing-completed"
+
+	// EventMessageReceived is emitted when a new text message arrives from a
+	// remote contact.
+	EventMessageReceived = "message-received"
+
+	// EventMessageDelivered is emitted when a remote contact acknowledges having
+	// received a message sent by the local user.
+	EventMessageDelivered = "message-delivered"
+
+	// EventContactAdded is emitted when a new remote contact is trusted.
+	EventContactAdded = "contact-added"
+
+	// EventContactDeleted is emitted when a remote contact is removed along with
+	// all associated data.
+	EventContactDeleted = "contact-deleted"
+
+	// EventContactUpdated is emitted when the profile infos (name or picture) of
+	// a remote contact change.
+	EventContactUpdated = "contact-updated"
+
+	// EventContactMigrated is emitted when a remote contact rotated its permanent
+	// identity and was moved over to the new one. The old id is in the message.
+	EventContactMigrated = "contact-migrated"
+
+	// EventHostedUpdated is emitted when the statistics of a hosted event change
+	// (e.g. a participant checked in or reported an infection).
+	EventHostedUpdated = "hosted-updated"
+
+	// EventJoinedUpdated is emitted when the statistics of a joined event change.
+	EventJoinedUpdated = "joined-updated"
+
+	// EventJoinedLeft is emitted when a joined event was left by the local user
+	// and all data associated with it was deleted.
+	EventJoinedLeft = "joined-left"
+
+	// EventGatewayRestarted is emitted when the Tor gateway was found dead or
+	// stuck and was restarted, along with the overlay and events on top.
+	EventGatewayRestarted = "gateway-restarted"
+
+	// EventStorageQuota is emitted when the data directory exceeds its configured
+	// soft quota and old event banners were evicted (or none could be).
+	EventStorageQuota = "storage-quota"
+)
+
+// Event is a notification about something happening within the backend that
+// a user interface might want to react to.
+type Event struct {
+	Kind    string                     `json:"kind"`              // Type of the notification
+	Contact tornet.IdentityFingerprint `json:"contact,omitempty"` // Contact the notification is about (if any)
+	Event   tornet.IdentityFingerprint `json:"event,omitempty"`   // Event the notification is about (if any)
+	Message string                     `json:"message,omitempty"` // Human readable description of the notification
+}
+
+// feed is a tiny publish/subscribe mechanism to distribute backend events to
+// any number of listeners. Slow listeners never block the publisher, rather
+// their oldest undelivered events get dropped.
+type feed struct {
+	subs map[chan Event]struct{} // Currently active subscriptions
+	lock sync.Mutex              // Lock protecting the subscription set
+}
+
+// newFeed creates an event feed without any subscribers.
+func newFeed() *feed {
+	return &feed{
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+// subscribe creates a new buffered subscription to the feed.
+func (f *feed) subscribe() (<-chan Event, func()) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	sub := make(chan Event, feedSubscriptionBuffer)
+	f.subs[sub] = struct{}{}
+
+	var once sync.Once
+	return sub, func() {
+		once.Do(func() {
+			f.lock.Lock()
+			defer f.lock.Unlock()
+
+			delete(f.subs, sub)
+		})
+	}
+}
+
+// publish delivers an event to all active subscribers. If the buffer of any
+// subscriber is full, its oldest queued event is discarded to make room.
+func (f *feed) publish(event Event) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for sub := range f.subs {
+		for delivered := false; !delivered; {
+			select {
+			case sub <- event:
+				delivered = true
+			default:
+				select {
+				case <-sub:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Subscribe creates a new subscription to the backend's event feed. The caller
+// must invoke the returned function to release the subscription when done.
+//
+// Listeners that don't keep up with the events will lose the oldest ones.
+func (b *Backend) Subscribe() (<-chan Event, func()) {
+	return b.feed.subscribe()
+}
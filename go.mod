@@ -3,6 +3,7 @@ module github.com/coronanet/go-coronanet
 go 1.14
 
 require (
+	filippo.io/edwards25519 v1.0.0
 	github.com/cretz/bine v0.1.0
 	github.com/ethereum/go-ethereum v1.9.12
 	github.com/ipsn/go-ghostbridge v0.0.0-20190304084428-78924eea6711
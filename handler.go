@@ -18,37 +18,76 @@ import (
 
 // handleContactV1 is ran when a remote contact connects to us via the `tornet`
 // and negotiates a common `corona` protocol version of 1.
-func (b *Backend) handleContactV1(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, logger log.Logger) {
-	err := b.handleContactV1Internal(uid, enc, dec, logger)
+func (b *Backend) handleContactV1(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps protocols.Capabilities, logger log.Logger) {
+	// Route all outbound messages through a priority queue to avoid avatars
+	// delaying more important data
+	sender := protocols.NewSender(enc)
+	defer sender.Close()
+
+	err := b.handleContactV1Internal(uid, sender, dec, logger)
 	if err != nil {
 		// Something failed horribly, try to send over an error
 		conn.SetWriteDeadline(time.Now().Add(3 * time.Second))
-		enc.Encode(&corona.Envelope{Disconnect: &protocols.Disconnect{Reason: err.Error()}})
+		sender.Encode(&corona.Envelope{Disconnect: &protocols.Disconnect{Reason: err.Error()}})
 	}
 	logger.Warn("Connection torn down", "err", err)
 }
 
 // handleContactV1Internal is ran when a remote contact connects to us via the tornet
 // and negotiates a common `corona` protocol version of 1.
-func (b *Backend) handleContactV1Internal(uid tornet.IdentityFingerprint, enc *gob.Encoder, dec *gob.Decoder, logger log.Logger) error {
+func (b *Backend) handleContactV1Internal(uid tornet.IdentityFingerprint, enc *protocols.Sender, dec *gob.Decoder, logger log.Logger) error {
+	// Refuse talking to blocked contacts without giving away why
+	if info, err := b.Contact(uid); err == nil && info.Blocked {
+		logger.Info("Rejecting blocked contact")
+		return nil
+	}
+	// If the contact doesn't know about our rotated identity yet, announce it
+	// before anything else, since any signed data is made with the new one
+	migration, err := b.identityMigration(uid)
+	if err != nil {
+		return err
+	}
+	if migration != nil {
+		logger.Info("Announcing identity migration")
+		if err := enc.Encode(&corona.Envelope{Migrate: migration}); err != nil {
+			return err
+		}
+	}
 	// Track the peer while connected to allow sending direct updates too
 	b.lock.Lock()
 	if _, ok := b.peerset[uid]; ok {
 		panic("peer already registered")
 	}
 	b.peerset[uid] = enc
+	b.contacted[uid] = time.Now()
+	queued, err := b.queuedMessages(uid)
+	if err != nil {
+		logger.Error("Failed to retrieve queued messages", "err", err)
+	}
 	b.lock.Unlock()
 
 	defer func() {
 		b.lock.Lock()
 		delete(b.peerset, uid)
+		if _, ok := b.contacted[uid]; ok { // Contact might have been deleted
+			b.contacted[uid] = time.Now()
+		}
 		b.lock.Unlock()
 	}()
 
-	// Version one will do a profile exchange on connect
-	go enc.Encode(&corona.Envelope{GetProfile: &corona.GetProfile{}})
+	// Version one will do a profile exchange on connect. If a migration is in
+	// progress, postpone everything until the next connection.
+	if migration == nil {
+		go enc.Encode(&corona.Envelope{GetProfile: &corona.GetProfile{}})
+
+		// Deliver any messages queued up while the contact was offline
+		if len(queued) > 0 {
+			go b.deliverMessages(uid, enc, queued)
+		}
+	}
 
 	// Start processing messages until torn down
+	exchanged := false
 	for {
 		// Read the next message off the network
 		message := new(corona.Envelope)
@@ -63,6 +102,12 @@ func (b *Backend) handleContactV1Internal(uid tornet.IdentityFingerprint, enc *g
 			}
 			return nil
 
+		case message.Ping != nil:
+			go enc.Encode(&corona.Envelope{Pong: &protocols.Pong{Nonce: message.Ping.Nonce}})
+
+		case message.Pong != nil:
+			// Liveness is tracked by the keepalive on any inbound data, nothing to do
+
 		case message.GetProfile != nil:
 			logger.Info("Contact requested profile")
 			prof, err := b.Profile()
@@ -72,6 +117,7 @@ func (b *Backend) handleContactV1Internal(uid tornet.IdentityFingerprint, enc *g
 			if err := enc.Encode(&corona.Envelope{Profile: &corona.Profile{
 				Name:   prof.Name,
 				Avatar: prof.Avatar,
+				Mood:   prof.Mood,
 			}}); err != nil {
 				return err
 			}
@@ -93,8 +139,26 @@ func (b *Backend) handleContactV1Internal(uid tornet.IdentityFingerprint, enc *g
 			} else if info.Name != message.Profile.Name {
 				logger.Warn("Rejecting remote name change", "have", info.Name)
 			}
-			// If the avatar was changed, request te new one
+			// Mood messages are meant to change, accept any update (or clearing)
+			if info.Mood != message.Profile.Mood {
+				if err := b.updateContactMood(uid, message.Profile.Mood); err != nil {
+					logger.Warn("Failed to update mood", "err", err)
+				}
+			}
+			// If this completed the initial profile exchange, mark the contact seen
+			if !exchanged {
+				exchanged = true
+				if err := b.markContactSeen(uid, time.Now()); err != nil {
+					logger.Warn("Failed to mark contact seen", "err", err)
+				}
+			}
+			// If the avatar was changed, request te new one (unless throttled)
 			if info.Avatar != message.Profile.Avatar {
+				if !b.reserveAvatarRequest(uid, time.Now()) {
+					logger.Debug("Throttling avatar request")
+					b.deferAvatarRequest(uid, message.Profile.Avatar, enc, time.Now())
+					continue
+				}
 				go enc.Encode(&corona.Envelope{GetAvatar: &corona.GetAvatar{}})
 			}
 
@@ -107,21 +171,23 @@ func (b *Backend) handleContactV1Internal(uid tornet.IdentityFingerprint, enc *g
 			if prof.Avatar == ([32]byte{}) {
 				// No avatar set, sorry
 				logger.Info("No avatar to send over", "err", err)
-				go enc.Encode(&corona.Envelope{Avatar: &corona.Avatar{Image: []byte{}}})
+				go enc.EncodeBulk(&corona.Envelope{Avatar: &corona.Avatar{Image: []byte{}}})
 				continue
 			}
 			img, err := b.CDNImage(prof.Avatar)
 			if err != nil {
 				// Something funky happened, warn and nuke the remote image
 				logger.Warn("Local avatar unavailable", "err", err)
-				go enc.Encode(&corona.Envelope{Avatar: &corona.Avatar{Image: []byte{}}})
+				go enc.EncodeBulk(&corona.Envelope{Avatar: &corona.Avatar{Image: []byte{}}})
 				continue
 			}
-			if err := enc.Encode(&corona.Envelope{Avatar: &corona.Avatar{Image: img}}); err != nil {
-				return err
-			}
+			// Send the avatar asynchronously, allowing priority replies to overtake
+			// it while queued; if it fails, the connection is broken anyway
+			go enc.EncodeBulk(&corona.Envelope{Avatar: &corona.Avatar{Image: img}})
 
 		case message.Avatar != nil:
+			b.completeAvatarRequest(uid)
+
 			// If the remote user deleted their avatar, delete locally too
 			if len(message.Avatar.Image) == 0 {
 				logger.Info("Contact deleted their avatar")
@@ -137,6 +203,50 @@ func (b *Backend) handleContactV1Internal(uid tornet.IdentityFingerprint, enc *g
 			if err := b.uploadContactPicture(uid, message.Avatar.Image); err != nil {
 				logger.Warn("Failed to set avatar", "err", err)
 			}
+
+		case message.Message != nil:
+			logger.Info("Contact sent message", "bytes", len(message.Message.Text))
+			if err := b.receiveMessage(uid, message.Message); err != nil {
+				logger.Warn("Rejecting contact message", "err", err)
+				return err
+			}
+			if message.Message.Sequence != 0 {
+				go enc.Encode(&corona.Envelope{Ack: &corona.Ack{Ref: message.Message.Sequence}})
+			}
+
+		case message.Ack != nil:
+			logger.Debug("Contact acknowledged message", "seq", message.Ack.Ref)
+			if err := b.acknowledgeMessage(uid, message.Ack.Ref); err != nil {
+				logger.Error("Failed to acknowledge delivered message", "err", err)
+			}
+
+		case message.Migrate != nil:
+			// If the contact is already known by the new identity (i.e. previous
+			// ack lost), acknowledge it without doing anything
+			if message.Migrate.Identity.Fingerprint() == uid {
+				logger.Debug("Contact repeated identity migration")
+				go enc.Encode(&corona.Envelope{MigrateAck: &corona.MigrateAck{}})
+				continue
+			}
+			next, err := b.migrateContact(uid, message.Migrate)
+			if err != nil {
+				logger.Warn("Rejecting identity migration", "err", err)
+				return err
+			}
+			logger.Info("Contact migrated identity", "identity", next)
+
+			// Acknowledge the migration and drop the old identity. This tears
+			// down the connection, the contact is redialed with the new one.
+			enc.Encode(&corona.Envelope{MigrateAck: &corona.MigrateAck{}})
+			if err := b.overlay.Forget(uid); err != nil {
+				logger.Warn("Failed to forget old identity", "err", err)
+			}
+			return nil
+
+		case message.MigrateAck != nil:
+			logger.Info("Contact acknowledged identity migration")
+			b.overlay.Migrated(uid)
+			return nil
 		}
 	}
 	return nil
@@ -0,0 +1,72 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"time"
+
+	"github.com/cretz/bine/control"
+)
+
+// Healthy reports whether the backend is ready to serve: the database is open,
+// the Tor process is running and responds on its control port and - if the user
+// enabled networking - circuits are established. The details contain a short
+// status of each component checked.
+//
+// The method never blocks on a dead Tor control connection, the probe is bounded
+// by a short timeout.
+func (b *Backend) Healthy() (bool, map[string]string) {
+	b.lock.RLock()
+	database, network, enabled := b.database, b.network, b.enabled
+	b.lock.RUnlock()
+
+	ready := true
+	details := make(map[string]string)
+
+	// Ensure the database was not yet torn down
+	if database == nil {
+		ready, details["database"] = false, "closed"
+	} else {
+		details["database"] = "ok"
+	}
+	// If running on an injected gateway, there's no Tor process to probe
+	if network == nil && b.config.Gateway != nil {
+		details["tor"], details["circuits"] = "injected", "established"
+		if !enabled {
+			details["circuits"] = "disabled"
+		}
+		return ready, details
+	}
+	// Ensure the Tor process is alive and responsive
+	if network == nil {
+		ready, details["tor"] = false, "stopped"
+		return ready, details
+	}
+	type result struct {
+		vals []*control.KeyVal
+		err  error
+	}
+	done := make(chan result, 1) // Buffered to let a late probe exit
+	go func() {
+		vals, err := network.Control.GetInfo("status/circuit-established")
+		done <- result{vals, err}
+	}()
+	select {
+	case res := <-done:
+		switch {
+		case res.err != nil:
+			ready, details["tor"] = false, "unresponsive: "+res.err.Error()
+		case !enabled:
+			details["tor"], details["circuits"] = "ok", "disabled"
+		case len(res.vals) == 0 || res.vals[0].Val != "1":
+			details["tor"] = "ok"
+			ready, details["circuits"] = false, "none"
+		default:
+			details["tor"], details["circuits"] = "ok", "established"
+		}
+	case <-time.After(healthProbeTimeout):
+		ready, details["tor"] = false, "unresponsive: probe timed out"
+	}
+	return ready, details
+}
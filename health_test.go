@@ -0,0 +1,28 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import "testing"
+
+// Tests that the health probe reports the backend unready if any of its core
+// components is missing, detailing which one.
+func TestHealthProbe(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	// Test backends have an open database but no Tor process
+	ready, details := backend.Healthy()
+	if ready {
+		t.Fatalf("backend without Tor reported ready")
+	}
+	if details["database"] != "ok" || details["tor"] != "stopped" {
+		t.Fatalf("details mismatch: have %v, want database ok, tor stopped", details)
+	}
+	// Tear down the database and ensure it's reported too
+	backend.database = nil
+
+	if ready, details = backend.Healthy(); ready || details["database"] != "closed" {
+		t.Fatalf("closed database mismatch: have %v/%v, want unready with database closed", ready, details)
+	}
+}
@@ -0,0 +1,131 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// dbHostedHistoryPrefix is the database key for storing the time series of a
+// hosted event's stats. The event id is followed by the start of the sampling
+// window, so snapshots iterate chronologically.
+var dbHostedHistoryPrefix = []byte("history-")
+
+// StatSnapshot is a point-in-time sample of a hosted event's statistics.
+type StatSnapshot struct {
+	Time      time.Time `json:"time"`      // Time when the stats were sampled
+	Attendees uint      `json:"attendees"` // Number of participants in the event
+	Negatives uint      `json:"negatives"` // Participants who reported negative test results
+	Suspected uint      `json:"suspected"` // Participants who might have been infected
+	Positives uint      `json:"positives"` // Participants who reported positive infection
+	Recovered uint      `json:"recovered"` // Participants who recovered from a positive infection
+}
+
+// sameStats returns whether two snapshots contain the exact same counters,
+// disregarding their sampling time.
+func (s *StatSnapshot) sameStats(other *StatSnapshot) bool {
+	return s.Attendees == other.Attendees && s.Negatives == other.Negatives &&
+		s.Suspected == other.Suspected && s.Positives == other.Positives &&
+		s.Recovered == other.Recovered
+}
+
+// historyKey assembles the database key of a hosted event's stats snapshot for
+// the sampling window starting at the given time.
+func historyKey(event tornet.IdentityFingerprint, window time.Time) []byte {
+	key := make([]byte, 0, len(dbHostedHistoryPrefix)+len(event)+1+8)
+	key = append(key, dbHostedHistoryPrefix...)
+	key = append(key, event...)
+	key = append(key, '-')
+	key = append(key, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(key[len(key)-8:], uint64(window.UnixNano()))
+	return key
+}
+
+// historyPrefix assembles the database key prefix of all the stats snapshots of
+// a hosted event.
+func historyPrefix(event tornet.IdentityFingerprint) []byte {
+	return append(append(append([]byte{}, dbHostedHistoryPrefix...), event...), '-')
+}
+
+// recordEventStats samples the current stats of a hosted event into its history.
+// At most one snapshot is stored per sampling interval: until the interval since
+// the last one elapses, updates overwrite it in place, so a burst of changes can
+// not bloat the database, yet the last state is never lost.
+func (b *Backend) recordEventStats(event tornet.IdentityFingerprint, infos *events.ServerInfos) error {
+	b.historyLock.Lock()
+	defer b.historyLock.Unlock()
+
+	clock, interval := b.config.Clock, b.config.HistoryInterval
+	if clock == nil {
+		clock = tornet.SystemClock
+	}
+	if interval == 0 {
+		interval = eventHistoryInterval
+	}
+	stats := infos.Stats()
+	snapshot := &StatSnapshot{
+		Time:      clock.Now(),
+		Attendees: stats.Attendees,
+		Negatives: stats.Negatives,
+		Suspected: stats.Suspected,
+		Positives: stats.Positives,
+		Recovered: stats.Recovered,
+	}
+	// Find the latest snapshot and either update it or start a new window
+	window := snapshot.Time
+
+	it := b.database.NewIterator(util.BytesPrefix(historyPrefix(event)), nil)
+	if it.Last() {
+		start := time.Unix(0, int64(binary.BigEndian.Uint64(it.Key()[len(it.Key())-8:])))
+
+		last := new(StatSnapshot)
+		if blob, err := b.openSecret(it.Value()); err == nil && json.Unmarshal(blob, last) == nil {
+			if last.sameStats(snapshot) {
+				it.Release()
+				return nil
+			}
+		}
+		if snapshot.Time.Sub(start) < interval {
+			window = start
+		}
+	}
+	it.Release()
+
+	blob, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return b.putSecret(historyKey(event, window), blob)
+}
+
+// HostedEventHistory retrieves the time series of stats snapshots of a hosted
+// event, in chronological order.
+func (b *Backend) HostedEventHistory(event tornet.IdentityFingerprint) ([]StatSnapshot, error) {
+	if _, err := b.HostedEvent(event); err != nil {
+		return nil, err
+	}
+	history := []StatSnapshot{} // Need explicit init for JSON!
+
+	it := b.database.NewIterator(util.BytesPrefix(historyPrefix(event)), nil)
+	defer it.Release()
+
+	for it.Next() {
+		blob, err := b.openSecret(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		var snapshot StatSnapshot
+		if err := json.Unmarshal(blob, &snapshot); err != nil {
+			return nil, err
+		}
+		history = append(history, snapshot)
+	}
+	return history, nil
+}
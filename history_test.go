@@ -0,0 +1,79 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that the stats history of a hosted event is sampled at most once per
+// interval, with the latest snapshot tracking the changes within it.
+func TestHostedEventHistory(t *testing.T) {
+	clock := tornet.NewSimulatedClock(time.Unix(1600000000, 0))
+
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+	backend.config.Clock = clock
+	backend.config.HistoryInterval = time.Hour
+
+	if _, err := backend.HostedEventHistory("unknown"); err != ErrEventNotFound {
+		t.Fatalf("unknown event error mismatch: have %v, want %v", err, ErrEventNotFound)
+	}
+	// Store a hosted event and feed a burst of updates to it
+	infos := &events.ServerInfos{
+		Name:         "barbecue",
+		Participants: make(map[tornet.IdentityFingerprint]tornet.PublicIdentity),
+		Statuses:     make(map[tornet.IdentityFingerprint]string),
+	}
+	blob, _ := json.Marshal(infos)
+	if err := backend.putSecret(append(dbHostedEventPrefix, "event"...), blob); err != nil {
+		t.Fatalf("failed to store event: %v", err)
+	}
+	update := func(participant string, status string) {
+		infos.Participants[tornet.IdentityFingerprint(participant)] = nil
+		infos.Statuses[tornet.IdentityFingerprint(participant)] = status
+		if err := backend.recordEventStats("event", infos); err != nil {
+			t.Fatalf("failed to record stats: %v", err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		update(string(rune('a'+i%26))+string(rune('a'+i/26)), params.InfectionStatusUnknown)
+		clock.Run(time.Second)
+	}
+	history, err := backend.HostedEventHistory("event")
+	if err != nil {
+		t.Fatalf("failed to retrieve history: %v", err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("burst snapshot count mismatch: have %d, want %d", len(history), 1)
+	}
+	if history[0].Attendees != 101 { // Organizer included
+		t.Fatalf("burst attendees mismatch: have %d, want %d", history[0].Attendees, 101)
+	}
+	// Unchanged stats should not be recorded, changed ones after the interval should
+	clock.Run(time.Hour)
+	if err := backend.recordEventStats("event", infos); err != nil {
+		t.Fatalf("failed to record stats: %v", err)
+	}
+	if history, _ = backend.HostedEventHistory("event"); len(history) != 1 {
+		t.Fatalf("noop snapshot count mismatch: have %d, want %d", len(history), 1)
+	}
+	update("aa", params.InfectionStatusPositive)
+
+	if history, _ = backend.HostedEventHistory("event"); len(history) != 2 {
+		t.Fatalf("sampled snapshot count mismatch: have %d, want %d", len(history), 2)
+	}
+	if history[1].Attendees != 101 || history[1].Positives != 1 {
+		t.Fatalf("sampled snapshot mismatch: have %+v", history[1])
+	}
+	if !history[0].Time.Before(history[1].Time) {
+		t.Fatalf("snapshot order mismatch: have %v, then %v", history[0].Time, history[1].Time)
+	}
+}
@@ -0,0 +1,106 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// SetEventHousekeeping configures the inactivity periods after which the user
+// is reminded to terminate a hosted event, and after which the event is ended
+// automatically. A zero period disables the specific action.
+func (b *Backend) SetEventHousekeeping(reminder time.Duration, termination time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.reminder = reminder
+	b.termination = termination
+}
+
+// housekeep is a background loop that periodically checks all the hosted events
+// and reminds the organizer about ones that seem to be over, or terminates them
+// if the organizer forgot about them for too long. It also keeps the storage in
+// check, evicting old event banners if the data directory grows over its quota.
+func (b *Backend) housekeep() {
+	ticker := time.NewTicker(eventSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.sweepHostedEvents(time.Now())
+			if _, err := b.enforceStorageQuota(); err != nil {
+				b.logger.Error("Failed to enforce storage quota", "err", err)
+			}
+
+		case quit := <-b.housekeeper:
+			close(quit)
+			return
+		}
+	}
+}
+
+// sweepHostedEvents iterates over all the running hosted events and checks how
+// long ago they've seen any activity, taking action if they've been idle for
+// too long.
+func (b *Backend) sweepHostedEvents(now time.Time) {
+	// Copy the tracked events to avoid holding the lock while terminating
+	b.lock.RLock()
+	reminder, termination := b.reminder, b.termination
+
+	hosted := make(map[tornet.IdentityFingerprint]*events.Server, len(b.hosted))
+	for event, server := range b.hosted {
+		hosted[event] = server
+	}
+	b.lock.RUnlock()
+
+	for event, server := range hosted {
+		// Skip any events that were already concluded
+		infos := server.Infos()
+		if infos.End != (time.Time{}) {
+			continue
+		}
+		idle := now.Sub(infos.Updated)
+
+		// If the event was abandoned for long enough, terminate it
+		if termination > 0 && idle > termination {
+			b.logger.Info("Terminating inactive event", "event", event, "idle", idle)
+			if err := b.TerminateEvent(event); err != nil {
+				b.logger.Warn("Failed to terminate inactive event", "event", event, "err", err)
+				continue
+			}
+			b.lock.Lock()
+			delete(b.reminded, event)
+			b.lock.Unlock()
+
+			b.feed.publish(Event{
+				Kind:    EventHostedTerminated,
+				Event:   event,
+				Message: fmt.Sprintf("%s was inactive for too long, terminated", infos.Name),
+			})
+			continue
+		}
+		// If the event is idle, remind the organizer, but only once per activity
+		if reminder > 0 && idle > reminder {
+			b.lock.Lock()
+			if last, ok := b.reminded[event]; ok && last.Equal(infos.Updated) {
+				b.lock.Unlock()
+				continue
+			}
+			b.reminded[event] = infos.Updated
+			b.lock.Unlock()
+
+			b.logger.Info("Reminding about inactive event", "event", event, "idle", idle)
+			b.feed.publish(Event{
+				Kind:    EventHostedInactive,
+				Event:   event,
+				Message: fmt.Sprintf("%s seems over, terminate it?", infos.Name),
+			})
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// newTestHostedEvent creates a new event server on a mock gateway and injects
+// it into the backend's tracked events.
+func newTestHostedEvent(t *testing.T, backend *Backend, name string) (tornet.IdentityFingerprint, *events.Server) {
+	server, err := events.CreateServer((*eventHost)(backend), tornet.NewMockGateway(), name, "", "", [32]byte{}, backend.logger)
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	event := server.Infos().Identity.Fingerprint()
+	(*eventHost)(backend).OnUpdate(event, server)
+
+	backend.hosted[event] = server
+	return event, server
+}
+
+// Tests that inactive hosted events first trigger a single reminder, and then
+// get automatically terminated after the grace period.
+func TestHousekeepingInactiveEvents(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	backend.SetEventHousekeeping(time.Hour, 3*time.Hour)
+
+	event, server := newTestHostedEvent(t, backend, "Barbecue")
+	defer server.Close()
+
+	sub, unsub := backend.Subscribe()
+	defer unsub()
+
+	updated := server.Infos().Updated
+
+	// Sweep before the reminder threshold, nothing should happen
+	backend.sweepHostedEvents(updated.Add(30 * time.Minute))
+	select {
+	case ev := <-sub:
+		t.Fatalf("unexpected notification: %+v", ev)
+	default:
+	}
+	// Sweep after the reminder threshold, a notification should arrive
+	backend.sweepHostedEvents(updated.Add(90 * time.Minute))
+	select {
+	case ev := <-sub:
+		if ev.Kind != EventHostedInactive {
+			t.Fatalf("notification kind mismatch: have %v, want %v", ev.Kind, EventHostedInactive)
+		}
+		if ev.Event != event {
+			t.Fatalf("notification event mismatch: have %v, want %v", ev.Event, event)
+		}
+	default:
+		t.Fatalf("missing inactivity reminder")
+	}
+	// Sweep again without any activity, the reminder should not be repeated
+	backend.sweepHostedEvents(updated.Add(2 * time.Hour))
+	select {
+	case ev := <-sub:
+		t.Fatalf("unexpected notification: %+v", ev)
+	default:
+	}
+	// Sweep after the termination threshold, the event should be ended
+	backend.sweepHostedEvents(updated.Add(4 * time.Hour))
+	select {
+	case ev := <-sub:
+		if ev.Kind != EventHostedTerminated {
+			t.Fatalf("notification kind mismatch: have %v, want %v", ev.Kind, EventHostedTerminated)
+		}
+		if ev.Event != event {
+			t.Fatalf("notification event mismatch: have %v, want %v", ev.Event, event)
+		}
+	default:
+		t.Fatalf("missing termination notification")
+	}
+	infos, err := backend.HostedEvent(event)
+	if err != nil {
+		t.Fatalf("failed to retrieve hosted event: %v", err)
+	}
+	if infos.End == (time.Time{}) {
+		t.Fatalf("inactive event not terminated")
+	}
+	// Sweep once more, terminated events should be left alone
+	backend.sweepHostedEvents(updated.Add(8 * time.Hour))
+	select {
+	case ev := <-sub:
+		t.Fatalf("unexpected notification: %+v", ev)
+	default:
+	}
+}
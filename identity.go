@@ -0,0 +1,252 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols/corona"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ErrInvalidMigration is returned if a remote contact announces an identity
+// migration which is expired, replayed or not signed correctly.
+var ErrInvalidMigration = errors.New("invalid identity migration")
+
+// RotateIdentity replaces the permanent identity of the local user with a fresh
+// one, retaining all the contacts. The new identity is distributed to the trusted
+// contacts via signed migration messages on their next connections. Until all of
+// them acknowledge it, the old identity is kept around to remain reachable.
+func (b *Backend) RotateIdentity() (tornet.SecretKeyRing, error) {
+	b.logger.Info("Rotating permanent identity")
+
+	keyring, err := b.rotateIdentity()
+	if err != nil {
+		return tornet.SecretKeyRing{}, err
+	}
+	// Identity rotated, announce it to all connected contacts and try to reach
+	// all the others to spread the news
+	var offline []tornet.IdentityFingerprint
+	for uid := range keyring.Migrating {
+		b.lock.RLock()
+		enc := b.peerset[uid]
+		b.lock.RUnlock()
+
+		if enc == nil {
+			offline = append(offline, uid)
+			continue
+		}
+		migration, err := b.identityMigration(uid)
+		if err != nil || migration == nil {
+			continue // Contact deleted or migrated meanwhile
+		}
+		go enc.Encode(&corona.Envelope{Migrate: migration})
+	}
+	if b.dialer != nil && len(offline) > 0 {
+		b.dialer.prioritize(0, offline)
+	}
+	return keyring, nil
+}
+
+// rotateIdentity generates a new permanent identity and swaps it into the overlay
+// and the persisted profile.
+func (b *Backend) rotateIdentity() (tornet.SecretKeyRing, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	prof, err := b.Profile()
+	if err != nil {
+		return tornet.SecretKeyRing{}, err
+	}
+	if b.overlay == nil {
+		return tornet.SecretKeyRing{}, ErrProfileNotFound
+	}
+	identity, err := tornet.GenerateIdentity()
+	if err != nil {
+		return tornet.SecretKeyRing{}, err
+	}
+	address, err := tornet.GenerateAddress()
+	if err != nil {
+		return tornet.SecretKeyRing{}, err
+	}
+	if err := b.overlay.RotateIdentity(identity, address); err != nil {
+		return tornet.SecretKeyRing{}, err
+	}
+	// Queued messages will only be delivered after the contacts migrated, so
+	// they need to be signed with the new identity
+	if err := b.resignQueuedMessages(identity); err != nil {
+		return tornet.SecretKeyRing{}, err
+	}
+	// Persist the new keyring straight away instead of waiting for the async
+	// update, the old identity must not be lost on a crash
+	keyring := b.overlay.KeyRing()
+	prof.KeyRing = &keyring
+
+	blob, err := json.Marshal(prof)
+	if err != nil {
+		return tornet.SecretKeyRing{}, err
+	}
+	if err := b.putSecret(dbProfileKey, blob); err != nil {
+		return tornet.SecretKeyRing{}, err
+	}
+	return keyring, nil
+}
+
+// resignQueuedMessages updates the signatures of all the messages queued up for
+// delivery to use a new permanent identity.
+//
+// Note, this method assumes the write lock is held.
+func (b *Backend) resignQueuedMessages(identity tornet.SecretIdentity) error {
+	batch := new(leveldb.Batch)
+
+	it := b.database.NewIterator(util.BytesPrefix(dbOutboxPrefix), nil)
+	for it.Next() {
+		blob, err := b.openSecret(it.Value())
+		if err != nil {
+			it.Release()
+			return err
+		}
+		msg := new(corona.Message)
+		if err := json.Unmarshal(blob, msg); err != nil {
+			it.Release()
+			return err
+		}
+		msg.Signature = identity.Sign(messageBlob(msg))
+
+		if blob, err = json.Marshal(msg); err != nil {
+			it.Release()
+			return err
+		}
+		if blob, err = b.sealSecret(blob); err != nil {
+			it.Release()
+			return err
+		}
+		batch.Put(append([]byte{}, it.Key()...), blob)
+	}
+	it.Release()
+
+	return b.database.Write(batch, nil)
+}
+
+// migrationBlob assembles the binary blob that the old identity's signature in
+// a migration announcement covers. The recipient is included so announcements
+// cannot be replayed to other contacts, and the timestamp so they cannot be
+// replayed later on.
+func migrationBlob(recipient tornet.PublicIdentity, msg *corona.Migrate) []byte {
+	blob := make([]byte, 0, len(recipient)+len(msg.Identity)+len(msg.Address)+8)
+	blob = append(blob, recipient...)
+	blob = append(blob, msg.Identity...)
+	blob = append(blob, msg.Address...)
+	blob = append(blob, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(blob[len(blob)-8:], uint64(msg.Timestamp.UnixNano()))
+	return blob
+}
+
+// identityMigration creates a freshly signed identity migration announcement
+// for a remote contact not yet aware of a rotation, or nil if it doesn't need
+// one.
+func (b *Backend) identityMigration(uid tornet.IdentityFingerprint) (*corona.Migrate, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.overlay == nil {
+		return nil, ErrProfileNotFound
+	}
+	retired, ok := b.overlay.Migrating(uid)
+	if !ok {
+		return nil, nil
+	}
+	keyring := b.overlay.KeyRing()
+	remote, ok := keyring.Trusted[uid]
+	if !ok {
+		return nil, ErrContactNotFound
+	}
+	msg := &corona.Migrate{
+		Identity:  keyring.Identity.Public(),
+		Address:   keyring.Addresses[len(keyring.Addresses)-1].Public(),
+		Timestamp: time.Now(),
+	}
+	msg.Signature = retired.Sign(migrationBlob(remote.Identity, msg))
+	msg.Proof = keyring.Identity.Sign(retired.Public())
+	return msg, nil
+}
+
+// migrateContact validates an identity migration announced by a remote contact
+// and moves the contact, along with all associated data, over to the new one.
+func (b *Backend) migrateContact(uid tornet.IdentityFingerprint, msg *corona.Migrate) (tornet.IdentityFingerprint, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	prof, err := b.Profile()
+	if err != nil {
+		return "", err
+	}
+	if b.overlay == nil {
+		return "", ErrProfileNotFound
+	}
+	keyring, ok := b.overlay.Trusted()[uid]
+	if !ok {
+		return "", ErrContactNotFound
+	}
+	// Reject expired (or future) announcements to limit any replays
+	if now := time.Now(); msg.Timestamp.Before(now.Add(-identityMigrationWindow)) || msg.Timestamp.After(now.Add(identityMigrationWindow)) {
+		return "", ErrInvalidMigration
+	}
+	// Ensure the announcement is meant for us, signed by the old identity and
+	// that the contact actually possesses the new identity
+	recipient := prof.KeyRing.Identity.Public()
+	if retired, ok := b.overlay.Migrating(uid); ok {
+		recipient = retired.Public() // Contact doesn't know about our rotation yet
+	}
+	if !keyring.Identity.Verify(migrationBlob(recipient, msg), msg.Signature) {
+		return "", ErrInvalidMigration
+	}
+	if !msg.Identity.Verify(keyring.Identity, msg.Proof) {
+		return "", ErrInvalidMigration
+	}
+	next := msg.Identity.Fingerprint()
+	if next == prof.KeyRing.Identity.Fingerprint() {
+		return "", ErrSelfContact
+	}
+	if _, err := b.Contact(next); err == nil {
+		return "", ErrContactExists
+	}
+	// Announcement valid, move all the contact data over to the new identity
+	batch := new(leveldb.Batch)
+	for _, prefix := range [][]byte{dbContactPrefix, dbMessagePrefix, dbOutboxPrefix} {
+		oldPrefix := append(append([]byte{}, prefix...), uid...)
+		newPrefix := append(append([]byte{}, prefix...), next...)
+
+		it := b.database.NewIterator(util.BytesPrefix(oldPrefix), nil)
+		for it.Next() {
+			key := it.Key()
+			batch.Put(append(append([]byte{}, newPrefix...), key[len(oldPrefix):]...), append([]byte{}, it.Value()...))
+			batch.Delete(append([]byte{}, key...))
+		}
+		it.Release()
+	}
+	if err := b.database.Write(batch, nil); err != nil {
+		return "", err
+	}
+	if err := b.overlay.Migrate(uid, tornet.RemoteKeyRing{Identity: msg.Identity, Address: msg.Address}); err != nil {
+		return "", err
+	}
+	if contacted, ok := b.contacted[uid]; ok {
+		b.contacted[next] = contacted
+		delete(b.contacted, uid)
+	}
+	if synced, ok := b.synced[uid]; ok {
+		b.synced[next] = synced
+		delete(b.synced, uid)
+	}
+	b.dropAvatarRequests(uid)
+
+	b.feed.publish(Event{Kind: EventContactMigrated, Contact: next, Message: string(uid)})
+	return next, nil
+}
@@ -0,0 +1,156 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols/corona"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that rotating the permanent identity migrates the contacts over to the
+// new one, after which the old identity and its announcements are rejected.
+func TestIdentityRotation(t *testing.T) {
+	gateway := tornet.NewMockGateway()
+
+	alice := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(alice.datadir)
+	defer alice.Close()
+
+	bob := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(bob.datadir)
+	defer bob.Close()
+
+	// Create the two profiles and cross trust them
+	keyrings := make([]tornet.SecretKeyRing, 2)
+	for i, backend := range []*Backend{alice, bob} {
+		if err := backend.CreateProfile(); err != nil {
+			t.Fatalf("failed to create profile: %v", err)
+		}
+		if err := backend.EnableGateway(); err != nil {
+			t.Fatalf("failed to enable gateway: %v", err)
+		}
+		prof, err := backend.Profile()
+		if err != nil {
+			t.Fatalf("failed to retrieve profile: %v", err)
+		}
+		keyrings[i] = *prof.KeyRing
+	}
+	if _, err := alice.AddContact(tornet.RemoteKeyRing{Identity: keyrings[1].Identity.Public(), Address: keyrings[1].Addresses[0].Public()}); err != nil {
+		t.Fatalf("failed to add bob as contact: %v", err)
+	}
+	if _, err := bob.AddContact(tornet.RemoteKeyRing{Identity: keyrings[0].Identity.Public(), Address: keyrings[0].Addresses[0].Public()}); err != nil {
+		t.Fatalf("failed to add alice as contact: %v", err)
+	}
+	old := keyrings[0].Identity.Fingerprint()
+	waitTestConnected(t, alice, keyrings[1].Identity.Fingerprint())
+
+	// Rotate alice's identity and wait for bob to migrate
+	feed, unsub := bob.Subscribe()
+	defer unsub()
+
+	keyring, err := alice.RotateIdentity()
+	if err != nil {
+		t.Fatalf("failed to rotate identity: %v", err)
+	}
+	if keyring.Retired.Fingerprint() != old {
+		t.Fatalf("retired identity mismatch: have %v, want %v", keyring.Retired.Fingerprint(), old)
+	}
+	if _, err := alice.RotateIdentity(); err != tornet.ErrIdentityMigrating {
+		t.Fatalf("double rotation error mismatch: have %v, want %v", err, tornet.ErrIdentityMigrating)
+	}
+	next := keyring.Identity.Fingerprint()
+
+	timeout := time.After(5 * time.Second)
+	for migrated := false; !migrated; {
+		select {
+		case ev := <-feed:
+			if ev.Kind == EventContactMigrated {
+				if ev.Contact != next {
+					t.Fatalf("migrated contact mismatch: have %v, want %v", ev.Contact, next)
+				}
+				migrated = true
+			}
+		case <-timeout:
+			t.Fatalf("contact not migrated")
+		}
+	}
+	if _, err := bob.Contact(old); err != ErrContactNotFound {
+		t.Fatalf("old contact error mismatch: have %v, want %v", err, ErrContactNotFound)
+	}
+	if _, err := bob.Contact(next); err != nil {
+		t.Fatalf("failed to retrieve migrated contact: %v", err)
+	}
+	// Wait for alice to process the acknowledgement and drop the old identity
+	for i := 0; ; i++ {
+		if keyring := alice.overlay.KeyRing(); keyring.Retired == nil && len(keyring.Addresses) == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("retired identity not dropped")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Ensure messages signed by the new identity are accepted
+	waitTestConnected(t, alice, keyrings[1].Identity.Fingerprint())
+	if err := alice.SendMessage(keyrings[1].Identity.Fingerprint(), "hello"); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	timeout = time.After(5 * time.Second)
+	for received := false; !received; {
+		select {
+		case ev := <-feed:
+			if ev.Kind == EventMessageReceived && ev.Contact == next {
+				received = true
+			}
+		case <-timeout:
+			t.Fatalf("message not received")
+		}
+	}
+	// Ensure expired announcements are rejected, even if correctly signed
+	secret, _ := tornet.GenerateIdentity()
+	msg := &corona.Migrate{
+		Identity:  secret.Public(),
+		Address:   keyring.Addresses[len(keyring.Addresses)-1].Public(),
+		Timestamp: time.Now().Add(-2 * identityMigrationWindow),
+	}
+	msg.Signature = keyring.Identity.Sign(migrationBlob(keyrings[1].Identity.Public(), msg))
+	msg.Proof = secret.Sign(keyring.Identity.Public())
+
+	if _, err := bob.migrateContact(next, msg); err != ErrInvalidMigration {
+		t.Fatalf("expired migration error mismatch: have %v, want %v", err, ErrInvalidMigration)
+	}
+	// Ensure announcements meant for someone else are rejected
+	msg.Timestamp = time.Now()
+	msg.Signature = keyring.Identity.Sign(migrationBlob(secret.Public(), msg))
+
+	if _, err := bob.migrateContact(next, msg); err != ErrInvalidMigration {
+		t.Fatalf("misdirected migration error mismatch: have %v, want %v", err, ErrInvalidMigration)
+	}
+	// Ensure announcements from the retired identity are rejected
+	msg.Signature = keyring.Retired.Sign(migrationBlob(keyrings[1].Identity.Public(), msg))
+
+	if _, err := bob.migrateContact(old, msg); err != ErrContactNotFound {
+		t.Fatalf("retired migration error mismatch: have %v, want %v", err, ErrContactNotFound)
+	}
+}
+
+// waitTestConnected waits until a backend has a live connection with a contact,
+// redialing if simultaneous dials from both sides tore each other down.
+func waitTestConnected(t *testing.T, backend *Backend, uid tornet.IdentityFingerprint) {
+	for i := 0; i < 50; i++ {
+		if connected, _, _ := backend.overlay.PeerStatus(uid); connected {
+			return
+		}
+		if i%10 == 9 {
+			backend.overlay.Dial(context.Background(), uid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("contact not connected")
+}
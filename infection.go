@@ -0,0 +1,254 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var (
+	// dbInfectionKey is the database key for storing the history of the local
+	// user's self-declared infection statuses.
+	dbInfectionKey = []byte("infection")
+
+	// dbEventReportPrefix is the database key for storing the infection status
+	// explicitly reported to a single joined event.
+	dbEventReportPrefix = []byte("report-")
+
+	// ErrInvalidInfectionStatus is returned if the local user attempts to declare
+	// an infection status that is not recognized.
+	ErrInvalidInfectionStatus = errors.New("invalid infection status")
+
+	// ErrInvalidInfectionTransition is returned if the local user attempts to
+	// declare an infection status not reachable from the current one.
+	ErrInvalidInfectionTransition = errors.New("invalid infection status transition")
+)
+
+// InfectionStatus is a single self-declared infection status of the local user.
+type InfectionStatus struct {
+	Status string    `json:"status"` // Declared infection status (negative, suspected, positive, recovered)
+	Time   time.Time `json:"time"`   // Time when the status was declared
+}
+
+// eventReport is an infection status explicitly reported to a single joined
+// event, overriding the globally declared one.
+type eventReport struct {
+	Status  string    `json:"status"`  // Reported infection status
+	Message string    `json:"message"` // Optional message to the organizer
+	Time    time.Time `json:"time"`    // Time when the status was reported
+}
+
+// SetInfectionStatus records a new self-declared infection status of the local
+// user and pushes it out to all the joined events the user might have been
+// exposed at (or might have exposed others at).
+func (b *Backend) SetInfectionStatus(status string) error {
+	b.logger.Info("Setting infection status", "status", status)
+
+	switch status {
+	case params.InfectionStatusNegative, params.InfectionStatusSuspected, params.InfectionStatusPositive, params.InfectionStatusRecovered:
+	default:
+		return ErrInvalidInfectionStatus
+	}
+	b.lock.Lock()
+	clients, err := b.setInfectionStatus(status)
+	b.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	// Status persisted, push it out to all the relevant joined events. Reporting
+	// may block on the event's dialer, so don't hold the backend lock meanwhile.
+	for _, client := range clients {
+		client.Report()
+	}
+	return nil
+}
+
+// ReportInfectionStatus records an infection status (and an optional message to
+// the organizer) to report to a single joined event, and requests an immediate
+// dial to push it out. If the event's window is not yet known, the report will
+// be sent after it's synced.
+func (b *Backend) ReportInfectionStatus(event tornet.IdentityFingerprint, status string, message string) error {
+	b.logger.Info("Reporting infection status", "event", event, "status", status)
+
+	switch status {
+	case params.InfectionStatusNegative, params.InfectionStatusSuspected, params.InfectionStatusPositive, params.InfectionStatusRecovered:
+	default:
+		return ErrInvalidInfectionStatus
+	}
+	b.lock.Lock()
+	client, err := b.reportInfectionStatus(event, status, message)
+	b.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	// Report persisted, push it out without holding the backend lock
+	client.Report()
+	return nil
+}
+
+// reportInfectionStatus persists an infection status to report to a joined
+// event and returns the event client to push it out through.
+//
+// Note, this method assumes the write lock is held.
+func (b *Backend) reportInfectionStatus(event tornet.IdentityFingerprint, status string, message string) (*events.Client, error) {
+	if _, err := b.Profile(); err != nil {
+		return nil, err
+	}
+	client, ok := b.joined[event]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+	// Validate the transition from the last status reported to the event
+	current := client.Infos().Status
+	if report, err := b.eventReport(event); err == nil {
+		current = report.Status
+	}
+	if current == "" {
+		current = params.InfectionStatusUnknown
+	}
+	if !events.ValidInfectionTransition(current, status) {
+		return nil, ErrInvalidInfectionTransition
+	}
+	blob, err := json.Marshal(&eventReport{
+		Status:  status,
+		Message: message,
+		Time:    time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if blob, err = b.sealSecret(blob); err != nil {
+		return nil, err
+	}
+	if err := b.database.Put(append(dbEventReportPrefix, event...), blob, &opt.WriteOptions{Sync: true}); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// eventReport retrieves the infection status explicitly reported to a joined
+// event, if any.
+func (b *Backend) eventReport(event tornet.IdentityFingerprint) (*eventReport, error) {
+	blob, err := b.getSecret(append(dbEventReportPrefix, event...))
+	if err != nil {
+		return nil, err
+	}
+	report := new(eventReport)
+	if err := json.Unmarshal(blob, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// setInfectionStatus persists a new self-declared infection status of the local
+// user and returns the joined events it needs to be reported to.
+//
+// Note, this method assumes the write lock is held.
+func (b *Backend) setInfectionStatus(status string) ([]*events.Client, error) {
+	if _, err := b.Profile(); err != nil {
+		return nil, err
+	}
+	history, err := b.infectionHistory()
+	if err != nil {
+		return nil, err
+	}
+	current := params.InfectionStatusUnknown
+	if len(history) > 0 {
+		current = history[len(history)-1].Status
+	}
+	if !events.ValidInfectionTransition(current, status) {
+		return nil, ErrInvalidInfectionTransition
+	}
+	history = append(history, &InfectionStatus{
+		Status: status,
+		Time:   time.Now(),
+	})
+	blob, err := json.Marshal(history)
+	if err != nil {
+		return nil, err
+	}
+	if blob, err = b.sealSecret(blob); err != nil {
+		return nil, err
+	}
+	if err := b.database.Put(dbInfectionKey, blob, &opt.WriteOptions{Sync: true}); err != nil {
+		return nil, err
+	}
+	// Status persisted, gather all the relevant joined events
+	var (
+		now     = time.Now()
+		clients []*events.Client
+	)
+	for event, client := range b.joined {
+		if infos := client.Infos(); reportableEvent(infos.Start, infos.End, now) {
+			b.logger.Debug("Reporting infection status to event", "event", event)
+			clients = append(clients, client)
+		}
+	}
+	return clients, nil
+}
+
+// reportableEvent returns whether an infection status declared at `now` is
+// relevant to an event within the given window: the event must have already
+// started and either still be running, or have ended within the maintenance
+// period (the window during which exposures are still tracked).
+func reportableEvent(start, end time.Time, now time.Time) bool {
+	if start.IsZero() || start.After(now) {
+		return false // Event window unknown yet, or not started
+	}
+	return end.IsZero() || now.Sub(end) <= params.EventMaintenancePeriod
+}
+
+// InfectionStatus retrieves the latest self-declared infection status of the
+// local user. If nothing was declared yet, the status is unknown.
+func (b *Backend) InfectionStatus() (*InfectionStatus, error) {
+	if _, err := b.Profile(); err != nil {
+		return nil, err
+	}
+	history, err := b.infectionHistory()
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return &InfectionStatus{Status: params.InfectionStatusUnknown}, nil
+	}
+	return history[len(history)-1], nil
+}
+
+// infectionStatusAt retrieves the self-declared infection status of the local
+// user in effect at the given time, i.e. the latest one declared at or before.
+func (b *Backend) infectionStatusAt(at time.Time) (*InfectionStatus, error) {
+	history, err := b.infectionHistory()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if !history[i].Time.After(at) {
+			return history[i], nil
+		}
+	}
+	return &InfectionStatus{Status: params.InfectionStatusUnknown}, nil
+}
+
+// infectionHistory retrieves all the self-declared infection statuses of the
+// local user, in the order they were declared.
+func (b *Backend) infectionHistory() ([]*InfectionStatus, error) {
+	blob, err := b.getSecret(dbInfectionKey)
+	if err != nil {
+		return nil, nil // No declarations yet
+	}
+	var history []*InfectionStatus
+	if err := json.Unmarshal(blob, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
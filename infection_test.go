@@ -0,0 +1,369 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// testEventHost is a mock organizer collecting the infection reports received.
+type testEventHost struct {
+	reports chan tornet.IdentityFingerprint
+}
+
+func (h *testEventHost) Banner(event tornet.IdentityFingerprint, server *events.Server) []byte {
+	return []byte("steak.jpg")
+}
+
+func (h *testEventHost) OnUpdate(event tornet.IdentityFingerprint, server *events.Server) {}
+
+func (h *testEventHost) OnReport(event tornet.IdentityFingerprint, server *events.Server, pseudonym tornet.IdentityFingerprint, message string) error {
+	h.reports <- pseudonym
+	return nil
+}
+
+func (h *testEventHost) OnAvatar(event tornet.IdentityFingerprint, server *events.Server, pseudonym tornet.IdentityFingerprint, avatar []byte) error {
+	return nil
+}
+
+// newTestReporter injects a local user with a name into a test backend, without
+// any networking attached, returning its keyring.
+func newTestReporter(t *testing.T, backend *Backend) tornet.SecretKeyRing {
+	keyring, err := tornet.GenerateKeyRing()
+	if err != nil {
+		t.Fatalf("failed to generate keyring: %v", err)
+	}
+	blob, err := json.Marshal(&profile{KeyRing: &keyring, Name: "Bob"})
+	if err != nil {
+		t.Fatalf("failed to marshal profile: %v", err)
+	}
+	if err := backend.database.Put(dbProfileKey, blob, nil); err != nil {
+		t.Fatalf("failed to store profile: %v", err)
+	}
+	return keyring
+}
+
+// Tests that a guest with a declared positive status files a signed report to a
+// joined event, which the organizer verifies and reflects in its stats.
+func TestInfectionStatusReport(t *testing.T) {
+	// Create a local user with a name to report with
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	keyring := newTestReporter(t, backend)
+
+	// Create an event and declare the infection after it started
+	var (
+		gateway = tornet.NewMockGateway()
+		host    = &testEventHost{reports: make(chan tornet.IdentityFingerprint, 1)}
+	)
+	server, err := events.CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	if err := backend.SetInfectionStatus("dead"); err != ErrInvalidInfectionStatus {
+		t.Fatalf("invalid status error mismatch: have %v, want %v", err, ErrInvalidInfectionStatus)
+	}
+	if err := backend.SetInfectionStatus(params.InfectionStatusPositive); err != nil {
+		t.Fatalf("failed to declare infection status: %v", err)
+	}
+	if err := backend.SetInfectionStatus(params.InfectionStatusSuspected); err != ErrInvalidInfectionTransition {
+		t.Fatalf("invalid transition error mismatch: have %v, want %v", err, ErrInvalidInfectionTransition)
+	}
+	if status, err := backend.InfectionStatus(); err != nil || status.Status != params.InfectionStatusPositive {
+		t.Fatalf("infection status mismatch: have %v/%v, want %s", status, err, params.InfectionStatusPositive)
+	}
+	// Join the event as a guest and wait for the report to arrive
+	session, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	client, err := events.CreateClient((*eventGuest)(backend), gateway, session.Identity, session.Address, session.Auth, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event client: %v", err)
+	}
+	defer client.Close()
+
+	var pseudonym tornet.IdentityFingerprint
+	select {
+	case pseudonym = <-host.reports:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("infection report timed out")
+	}
+	infos := server.Infos()
+	if status := infos.Statuses[pseudonym]; status != params.InfectionStatusPositive {
+		t.Errorf("reported status mismatch: have %s, want %s", status, params.InfectionStatusPositive)
+	}
+	if id := infos.Identities[pseudonym]; id.Fingerprint() != keyring.Identity.Fingerprint() {
+		t.Errorf("reported identity mismatch: have %s, want %s", id.Fingerprint(), keyring.Identity.Fingerprint())
+	}
+	if stats := infos.Stats(); stats.Positives != 1 {
+		t.Errorf("positive count mismatch: have %d, want %d", stats.Positives, 1)
+	}
+}
+
+// Tests that setting an infection status after joining events cascades reports
+// out to all the joined events.
+func TestInfectionStatusCascade(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	newTestReporter(t, backend)
+
+	// Create a few events and join all of them
+	gateway := tornet.NewMockGateway()
+
+	var hosts []*testEventHost
+	for i := 0; i < 3; i++ {
+		host := &testEventHost{reports: make(chan tornet.IdentityFingerprint, 1)}
+		server, err := events.CreateServer(host, gateway, fmt.Sprintf("event #%d", i), "", "", [32]byte{byte(i + 1)}, log.Root())
+		if err != nil {
+			t.Fatalf("event %d: failed to create server: %v", i, err)
+		}
+		defer server.Close()
+
+		session, err := server.Checkin()
+		if err != nil {
+			t.Fatalf("event %d: failed to create checkin session: %v", i, err)
+		}
+		client, err := events.CreateClient((*eventGuest)(backend), gateway, session.Identity, session.Address, session.Auth, log.Root())
+		if err != nil {
+			t.Fatalf("event %d: failed to create client: %v", i, err)
+		}
+		defer client.Close()
+
+		// Wait until the event window is known to the guest
+		for j := 0; j < 100 && client.Infos().Start.IsZero(); j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if client.Infos().Start.IsZero() {
+			t.Fatalf("event %d: window not synced", i)
+		}
+		backend.lock.Lock()
+		backend.joined[session.Identity.Fingerprint()] = client
+		backend.lock.Unlock()
+
+		hosts = append(hosts, host)
+	}
+	// Declare a positive status and ensure all events get notified
+	if err := backend.SetInfectionStatus(params.InfectionStatusPositive); err != nil {
+		t.Fatalf("failed to declare infection status: %v", err)
+	}
+	for i, host := range hosts {
+		select {
+		case <-host.reports:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d: infection report timed out", i)
+		}
+	}
+}
+
+// Tests that recovering from a positive infection propagates to the joined events,
+// moving the participant from the positive tally over to the recovered one.
+func TestInfectionStatusRecovery(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	newTestReporter(t, backend)
+
+	// Declare a positive status and join an event to report it to
+	if err := backend.SetInfectionStatus(params.InfectionStatusPositive); err != nil {
+		t.Fatalf("failed to declare infection status: %v", err)
+	}
+	var (
+		gateway = tornet.NewMockGateway()
+		host    = &testEventHost{reports: make(chan tornet.IdentityFingerprint, 1)}
+	)
+	server, err := events.CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	session, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	client, err := events.CreateClient((*eventGuest)(backend), gateway, session.Identity, session.Address, session.Auth, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event client: %v", err)
+	}
+	defer client.Close()
+
+	select {
+	case <-host.reports:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("infection report timed out")
+	}
+	// Wait until the report is acknowledged, otherwise the recovery would be
+	// attempted from an unknown status
+	for i := 0; i < 100 && client.Infos().Status != params.InfectionStatusPositive; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := client.Infos().Status; status != params.InfectionStatusPositive {
+		t.Fatalf("acknowledged status mismatch: have %s, want %s", status, params.InfectionStatusPositive)
+	}
+	backend.lock.Lock()
+	backend.joined[session.Identity.Fingerprint()] = client
+	backend.lock.Unlock()
+
+	// Recover from the infection and ensure the event stats reflect it
+	if err := backend.SetInfectionStatus(params.InfectionStatusRecovered); err != nil {
+		t.Fatalf("failed to declare recovery: %v", err)
+	}
+	select {
+	case <-host.reports:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("recovery report timed out")
+	}
+	stats := server.Infos().Stats()
+	if stats.Positives != 0 {
+		t.Errorf("positive count mismatch: have %d, want %d", stats.Positives, 0)
+	}
+	if stats.Recovered != 1 {
+		t.Errorf("recovered count mismatch: have %d, want %d", stats.Recovered, 1)
+	}
+	// Recovery is final, ensure it cannot be reverted
+	if err := backend.SetInfectionStatus(params.InfectionStatusPositive); err != ErrInvalidInfectionTransition {
+		t.Fatalf("invalid transition error mismatch: have %v, want %v", err, ErrInvalidInfectionTransition)
+	}
+}
+
+// Tests that an infection status can be reported to a single joined event, along
+// with a message, without declaring it globally.
+func TestEventInfectionReport(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	newTestReporter(t, backend)
+
+	// Join an event without any declared status
+	var (
+		gateway = tornet.NewMockGateway()
+		host    = &testEventHost{reports: make(chan tornet.IdentityFingerprint, 1)}
+	)
+	server, err := events.CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	session, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	client, err := events.CreateClient((*eventGuest)(backend), gateway, session.Identity, session.Address, session.Auth, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event client: %v", err)
+	}
+	defer client.Close()
+
+	event := session.Identity.Fingerprint()
+	if err := backend.ReportInfectionStatus(event, params.InfectionStatusSuspected, "fever"); err != ErrEventNotFound {
+		t.Fatalf("unknown event error mismatch: have %v, want %v", err, ErrEventNotFound)
+	}
+	backend.lock.Lock()
+	backend.joined[event] = client
+	backend.lock.Unlock()
+
+	// Report a suspected infection and ensure it reaches the organizer
+	if err := backend.ReportInfectionStatus(event, "dead", ""); err != ErrInvalidInfectionStatus {
+		t.Fatalf("invalid status error mismatch: have %v, want %v", err, ErrInvalidInfectionStatus)
+	}
+	if err := backend.ReportInfectionStatus(event, params.InfectionStatusSuspected, "fever"); err != nil {
+		t.Fatalf("failed to report infection status: %v", err)
+	}
+	var pseudonym tornet.IdentityFingerprint
+	select {
+	case pseudonym = <-host.reports:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("infection report timed out")
+	}
+	if status := server.Infos().Statuses[pseudonym]; status != params.InfectionStatusSuspected {
+		t.Errorf("reported status mismatch: have %s, want %s", status, params.InfectionStatusSuspected)
+	}
+	if _, _, _, message := (*eventGuest)(backend).Status(event, time.Time{}, time.Time{}); message != "fever" {
+		t.Errorf("reported message mismatch: have %s, want %s", message, "fever")
+	}
+	if status, err := backend.InfectionStatus(); err != nil || status.Status != params.InfectionStatusUnknown {
+		t.Errorf("global status mismatch: have %v/%v, want %s", status, err, params.InfectionStatusUnknown)
+	}
+	// Ensure repeated and disallowed transitions are rejected
+	if err := backend.ReportInfectionStatus(event, params.InfectionStatusSuspected, "still fever"); err != ErrInvalidInfectionTransition {
+		t.Fatalf("repeated status error mismatch: have %v, want %v", err, ErrInvalidInfectionTransition)
+	}
+	if err := backend.ReportInfectionStatus(event, params.InfectionStatusRecovered, ""); err != ErrInvalidInfectionTransition {
+		t.Fatalf("invalid transition error mismatch: have %v, want %v", err, ErrInvalidInfectionTransition)
+	}
+}
+
+// Tests that only events the user could have been exposed at are reported to.
+func TestReportableEvent(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		start time.Time
+		end   time.Time
+		want  bool
+	}{
+		{time.Time{}, time.Time{}, false},                    // Window unknown
+		{now.Add(time.Hour), time.Time{}, false},             // Not yet started
+		{now.Add(-time.Hour), time.Time{}, true},             // Running
+		{now.Add(-2 * time.Hour), now.Add(-time.Hour), true}, // Recently ended
+		{now.Add(-params.EventMaintenancePeriod * 2), now.Add(-params.EventMaintenancePeriod - time.Hour), false}, // Long ended
+	}
+	for i, tt := range tests {
+		if have := reportableEvent(tt.start, tt.end, now); have != tt.want {
+			t.Errorf("test %d: reportability mismatch: have %v, want %v", i, have, tt.want)
+		}
+	}
+}
+
+// Tests that the status reported to an event is the one in effect during it,
+// even if it was declared before the event started.
+func TestInfectionStatusWindow(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	newTestReporter(t, backend)
+
+	// Inject a history of declarations at known times
+	now := time.Now()
+	history := []*InfectionStatus{
+		{Status: params.InfectionStatusSuspected, Time: now.Add(-3 * time.Hour)},
+		{Status: params.InfectionStatusPositive, Time: now.Add(-time.Hour)},
+	}
+	blob, err := json.Marshal(history)
+	if err != nil {
+		t.Fatalf("failed to marshal infection history: %v", err)
+	}
+	if err := backend.database.Put(dbInfectionKey, blob, nil); err != nil {
+		t.Fatalf("failed to store infection history: %v", err)
+	}
+	tests := []struct {
+		start time.Time
+		end   time.Time
+		want  string
+	}{
+		{now.Add(-5 * time.Hour), now.Add(-4 * time.Hour), params.InfectionStatusUnknown},      // Before any declaration
+		{now.Add(-2 * time.Hour), now.Add(-90 * time.Minute), params.InfectionStatusSuspected}, // Declared before start
+		{now.Add(-4 * time.Hour), now.Add(-2 * time.Hour), params.InfectionStatusSuspected},    // Declared within window
+		{now.Add(-30 * time.Minute), time.Time{}, params.InfectionStatusPositive},              // Still running
+	}
+	for i, tt := range tests {
+		if _, _, status, _ := (*eventGuest)(backend).Status("", tt.start, tt.end); status != tt.want {
+			t.Errorf("test %d: status mismatch: have %s, want %s", i, status, tt.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io/ioutil"
+
+	"github.com/coronanet/go-coronanet/protocols/corona"
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/crypto/sha3"
+)
+
+// dbQuarantinePrefix is the database key prefix under which corrupt records are
+// moved, retaining them for manual recovery without tripping up the backend.
+var dbQuarantinePrefix = []byte("quarantine-")
+
+// IntegrityIssue is a single unreadable record found in the database, or a
+// readable one referencing a CDN image that does not exist.
+type IntegrityIssue struct {
+	Key         []byte `json:"key"`               // Database key of the corrupt record
+	Error       string `json:"error"`             // Reason why the record is unreadable
+	Missing     string `json:"missing,omitempty"` // Hash of the missing CDN image, if dangling reference
+	Quarantined bool   `json:"quarantined"`       // Whether the record was moved into quarantine
+}
+
+// corruptRecordError wraps the failure to decode a database record, to tell a
+// malformed record apart from an inaccessible database (e.g. an I/O error or a
+// wrong passphrase).
+type corruptRecordError struct {
+	err error // Decoding error of the record
+}
+
+// Error implements the error interface.
+func (e *corruptRecordError) Error() string {
+	return e.err.Error()
+}
+
+// integrityRule is a validator for a class of records in the database.
+type integrityRule struct {
+	prefix []byte                        // Key (or key prefix) of the records
+	exact  bool                          // Whether the prefix is the full key
+	check  func(key, value []byte) error // Validator for a single record
+}
+
+// integrityRules assembles the validators for all the records the backend
+// stores. Records not covered by any rule are ignored, as they might have been
+// created by a newer version.
+func (b *Backend) integrityRules() []integrityRule {
+	decoder := func(alloc func() interface{}) func(key, value []byte) error {
+		return func(key, value []byte) error {
+			return json.Unmarshal(value, alloc())
+		}
+	}
+	secret := func(alloc func() interface{}) func(key, value []byte) error {
+		return func(key, value []byte) error {
+			blob, err := b.openSecret(value)
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(blob, alloc())
+		}
+	}
+	return []integrityRule{
+		{prefix: dbProfileKey, exact: true, check: secret(func() interface{} { return new(profile) })},
+		{prefix: dbInfectionKey, exact: true, check: secret(func() interface{} { return new([]*InfectionStatus) })},
+		{prefix: dbRetentionKey, exact: true, check: decoder(func() interface{} { return new(MessageRetention) })},
+		{prefix: dbSchemaKey, exact: true, check: func(key, value []byte) error {
+			if len(value) != 8 {
+				return fmt.Errorf("invalid schema version length %d", len(value))
+			}
+			return nil
+		}},
+		{prefix: dbContactPrefix, check: decoder(func() interface{} { return new(contact) })},
+		{prefix: dbMessagePrefix, check: secret(func() interface{} { return new(Message) })},
+		{prefix: dbOutboxPrefix, check: secret(func() interface{} { return new(corona.Message) })},
+		{prefix: dbHostedEventPrefix, check: secret(func() interface{} { return new(events.ServerInfos) })},
+		{prefix: dbHostedHistoryPrefix, check: secret(func() interface{} { return new(StatSnapshot) })},
+		{prefix: dbJoinedEventPrefix, check: secret(func() interface{} { return new(events.ClientInfos) })},
+		{prefix: dbScheduledEventPrefix, check: decoder(func() interface{} { return new(ScheduledEvent) })},
+		{prefix: dbEventReportPrefix, check: secret(func() interface{} { return new(eventReport) })},
+		{prefix: dbCDNImagePrefix, check: b.checkCDNRecord},
+	}
+}
+
+// checkCDNRecord validates a CDN entry, which is either an image (checked for
+// matching its content hash), the metadata of one or its generated thumbnail.
+func (b *Backend) checkCDNRecord(key, value []byte) error {
+	if len(key) < len(dbCDNImagePrefix)+32 {
+		return errors.New("truncated image hash")
+	}
+	var hash [32]byte
+	copy(hash[:], key[len(dbCDNImagePrefix):])
+
+	switch suffix := key[len(dbCDNImagePrefix)+32:]; {
+	case bytes.Equal(suffix, dbCDNImageRefSuffix):
+		if _, n := binary.Uvarint(value); n <= 0 {
+			return errors.New("invalid reference count")
+		}
+		return nil
+
+	case bytes.Equal(suffix, dbCDNImageThumbSuffix):
+		_, err := jpeg.DecodeConfig(bytes.NewReader(value))
+		return err
+
+	case len(suffix) == 0:
+		if _, compressed := b.cdnImageMeta(hash); compressed {
+			data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(value)))
+			if err != nil {
+				return err
+			}
+			value = data
+		}
+		if sha3.Sum256(value) != hash {
+			return errors.New("image hash mismatch")
+		}
+		return nil
+
+	default:
+		return errors.New("unknown image record")
+	}
+}
+
+// IntegrityCheck scans all the records stored by the backend and reports any
+// that cannot be decoded, or that reference CDN images which do not exist. The
+// database is not modified.
+func (b *Backend) IntegrityCheck() ([]IntegrityIssue, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.integrityCheck(false)
+}
+
+// SkippedRecords returns the corrupt records that were skipped while starting up
+// the tracked events, instead of aborting the entire startup. They are left in
+// place for IntegrityCheck or QuarantineCorruption to deal with.
+func (b *Backend) SkippedRecords() []IntegrityIssue {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return append([]IntegrityIssue{}, b.skipped...)
+}
+
+// QuarantineCorruption scans all the records stored by the backend and moves
+// any that cannot be decoded into quarantine, so the rest of the data can still
+// be used. The quarantined records are reported back, along with any dangling
+// image references, which are left in place as the referents are still usable.
+func (b *Backend) QuarantineCorruption() ([]IntegrityIssue, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.integrityCheck(true)
+}
+
+// integrityCheck scans all the records stored by the backend and reports any
+// that cannot be decoded or reference missing images, optionally moving the
+// undecodable ones into quarantine.
+//
+// Note, this method assumes the read lock is held, or the write lock if the
+// corrupt records are to be quarantined.
+func (b *Backend) integrityCheck(quarantine bool) ([]IntegrityIssue, error) {
+	issues := []IntegrityIssue{} // Need explicit init for JSON!
+
+	for _, rule := range b.integrityRules() {
+		rng := util.BytesPrefix(rule.prefix)
+		if rule.exact {
+			rng = &util.Range{Start: rule.prefix, Limit: append(append([]byte{}, rule.prefix...), 0)}
+		}
+		it := b.database.NewIterator(rng, nil)
+		for it.Next() {
+			if err := rule.check(it.Key(), it.Value()); err != nil {
+				b.logger.Warn("Corrupt database record", "key", fmt.Sprintf("%q", it.Key()), "err", err)
+				issues = append(issues, IntegrityIssue{
+					Key:   append([]byte{}, it.Key()...),
+					Error: err.Error(),
+				})
+			}
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return nil, err
+		}
+	}
+	// Cross reference the CDN images with their referents to find dangling ones
+	err := b.cdnReferences(func(key []byte, hash [32]byte) {
+		if ok, _ := b.database.Has(append(append([]byte{}, dbCDNImagePrefix...), hash[:]...), nil); ok {
+			return
+		}
+		b.logger.Warn("Dangling image reference", "key", fmt.Sprintf("%q", key), "hash", hex.EncodeToString(hash[:]))
+		issues = append(issues, IntegrityIssue{
+			Key:     append([]byte{}, key...),
+			Error:   "dangling image reference",
+			Missing: hex.EncodeToString(hash[:]),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !quarantine {
+		return issues, nil
+	}
+	for i, issue := range issues {
+		if issue.Missing != "" {
+			continue // Referent is healthy, only its image is gone
+		}
+		blob, err := b.database.Get(issue.Key, nil)
+		if err != nil {
+			return issues, err
+		}
+		if err := b.database.Put(append(append([]byte{}, dbQuarantinePrefix...), issue.Key...), blob, nil); err != nil {
+			return issues, err
+		}
+		if err := b.database.Delete(issue.Key, nil); err != nil {
+			return issues, err
+		}
+		issues[i].Quarantined = true
+	}
+	return issues, nil
+}
@@ -0,0 +1,212 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that corrupt records are detected by the integrity check, and that they
+// can be quarantined, leaving the healthy records intact.
+func TestIntegrityCheck(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	// Populate the database with some valid data
+	newTestReporter(t, backend)
+	storeTestMessage(t, backend, "bob", "Hello", nil, time.Now())
+
+	image := make([]byte, 2000)
+	rand.Read(image)
+	hash, err := backend.uploadCDNImage(image)
+	if err != nil {
+		t.Fatalf("failed to upload image: %v", err)
+	}
+	if issues, err := backend.IntegrityCheck(); err != nil || len(issues) != 0 {
+		t.Fatalf("healthy database issues: have %v (err %v), want none", issues, err)
+	}
+	// Corrupt a few records in various ways
+	corrupt := map[string][]byte{
+		string(dbProfileKey):                          []byte("{\"keyring\":"),
+		string(append(dbContactPrefix, "alice"...)):   []byte("not json"),
+		string(append(dbHostedEventPrefix, "bbq"...)): []byte("[1, 2, 3]"),
+		string(append(dbCDNImagePrefix, hash[:]...)):  append([]byte{}, image[:1000]...),
+	}
+	for key, blob := range corrupt {
+		if err := backend.database.Put([]byte(key), blob, nil); err != nil {
+			t.Fatalf("failed to inject corrupt record: %v", err)
+		}
+	}
+	// Ensure all the corrupt records are detected, but left in place
+	issues, err := backend.IntegrityCheck()
+	if err != nil {
+		t.Fatalf("failed to check integrity: %v", err)
+	}
+	if len(issues) != len(corrupt) {
+		t.Fatalf("issue count mismatch: have %d, want %d", len(issues), len(corrupt))
+	}
+	for _, issue := range issues {
+		if _, ok := corrupt[string(issue.Key)]; !ok {
+			t.Errorf("unexpected issue: %q: %s", issue.Key, issue.Error)
+		}
+		if issue.Quarantined {
+			t.Errorf("issue quarantined by check: %q", issue.Key)
+		}
+		if ok, _ := backend.database.Has(issue.Key, nil); !ok {
+			t.Errorf("corrupt record removed by check: %q", issue.Key)
+		}
+	}
+	// Quarantine the corrupt records and ensure they're moved out of the way
+	issues, err = backend.QuarantineCorruption()
+	if err != nil {
+		t.Fatalf("failed to quarantine corruption: %v", err)
+	}
+	if len(issues) != len(corrupt) {
+		t.Fatalf("quarantined count mismatch: have %d, want %d", len(issues), len(corrupt))
+	}
+	for _, issue := range issues {
+		if !issue.Quarantined {
+			t.Errorf("issue not quarantined: %q", issue.Key)
+		}
+		if ok, _ := backend.database.Has(issue.Key, nil); ok {
+			t.Errorf("corrupt record not removed: %q", issue.Key)
+		}
+		blob, err := backend.database.Get(append(append([]byte{}, dbQuarantinePrefix...), issue.Key...), nil)
+		if err != nil {
+			t.Errorf("corrupt record not quarantined: %q: %v", issue.Key, err)
+		} else if !bytes.Equal(blob, corrupt[string(issue.Key)]) {
+			t.Errorf("quarantined record mismatch: %q: have %x, want %x", issue.Key, blob, corrupt[string(issue.Key)])
+		}
+	}
+	// Ensure the database is clean afterwards and the healthy data survived
+	if issues, err := backend.IntegrityCheck(); err != nil || len(issues) != 0 {
+		t.Fatalf("quarantined database issues: have %v (err %v), want none", issues, err)
+	}
+	if _, err := backend.Profile(); err != ErrProfileNotFound {
+		t.Fatalf("quarantined profile error mismatch: have %v, want %v", err, ErrProfileNotFound)
+	}
+	if texts := testConversation(t, backend, "bob"); len(texts) != 1 {
+		t.Fatalf("healthy message count mismatch: have %d, want %d", len(texts), 1)
+	}
+}
+
+// Tests that references to images missing from the CDN are reported, but the
+// referents are not quarantined since they are still usable.
+func TestIntegrityDanglingReference(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	// Store a contact referencing an avatar that's not in the CDN
+	missing := [32]byte{0xde, 0xad}
+	blob, _ := json.Marshal(&contact{Name: "Bob", Avatar: missing})
+
+	key := append(append([]byte{}, dbContactPrefix...), "bob"...)
+	if err := backend.database.Put(key, blob, nil); err != nil {
+		t.Fatalf("failed to store contact: %v", err)
+	}
+	// Ensure the dangling reference is reported by both the check and quarantine
+	for _, scan := range []func() ([]IntegrityIssue, error){backend.IntegrityCheck, backend.QuarantineCorruption} {
+		issues, err := scan()
+		if err != nil {
+			t.Fatalf("failed to scan database: %v", err)
+		}
+		if len(issues) != 1 {
+			t.Fatalf("issue count mismatch: have %d, want %d", len(issues), 1)
+		}
+		if !bytes.Equal(issues[0].Key, key) || issues[0].Missing != hex.EncodeToString(missing[:]) || issues[0].Quarantined {
+			t.Fatalf("dangling issue mismatch: have %+v", issues[0])
+		}
+	}
+	if _, err := backend.Contact("bob"); err != nil {
+		t.Fatalf("referent removed by quarantine: %v", err)
+	}
+}
+
+// Tests that corrupt event records are skipped on startup instead of aborting
+// it, with the healthy events still being recreated.
+func TestInitEventsSkipsCorruption(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+	backend.config.Gateway = tornet.NewMockGateway()
+
+	// Store a healthy hosted event and a few corrupt ones
+	identity, _ := tornet.GenerateIdentity()
+	address, _ := tornet.GenerateAddress()
+
+	infos := &events.ServerInfos{
+		Identity:     identity,
+		Address:      address,
+		Participants: make(map[tornet.IdentityFingerprint]tornet.PublicIdentity),
+		Identities:   make(map[tornet.IdentityFingerprint]tornet.PublicIdentity),
+		Statuses:     make(map[tornet.IdentityFingerprint]string),
+		Names:        make(map[tornet.IdentityFingerprint]string),
+		Name:         "barbecue",
+		Start:        time.Now(),
+	}
+	healthy := identity.Fingerprint()
+
+	blob, _ := json.Marshal(infos)
+	if err := backend.putSecret(append(dbHostedEventPrefix, healthy...), blob); err != nil {
+		t.Fatalf("failed to store healthy event: %v", err)
+	}
+	if err := backend.database.Put(append(dbHostedEventPrefix, "broken"...), []byte("not json"), nil); err != nil {
+		t.Fatalf("failed to store corrupt hosted event: %v", err)
+	}
+	if err := backend.database.Put(append(dbJoinedEventPrefix, "broken"...), []byte("[1, 2, 3]"), nil); err != nil {
+		t.Fatalf("failed to store corrupt joined event: %v", err)
+	}
+	// Start up the events and ensure only the corrupt ones are skipped
+	backend.hosted, backend.checkin, backend.joined = nil, nil, nil
+	if err := backend.initEvents(); err != nil {
+		t.Fatalf("failed to init events: %v", err)
+	}
+	defer backend.nukeEvents()
+
+	if _, ok := backend.hosted[healthy]; !ok || len(backend.hosted) != 1 {
+		t.Fatalf("hosted events mismatch: have %d, want healthy only", len(backend.hosted))
+	}
+	skipped := backend.SkippedRecords()
+	if len(skipped) != 2 {
+		t.Fatalf("skipped record count mismatch: have %d, want %d", len(skipped), 2)
+	}
+	for _, issue := range skipped {
+		if ok, _ := backend.database.Has(issue.Key, nil); !ok {
+			t.Errorf("skipped record removed: %q", issue.Key)
+		}
+	}
+}
+
+// Tests that event records failing to load for reasons other than corruption
+// (e.g. a wrong passphrase) abort the startup instead of being skipped.
+func TestInitEventsFailsOnInaccessible(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+	backend.config.Gateway = tornet.NewMockGateway()
+
+	// Store an event sealed with a passphrase, then forget the vault
+	if err := backend.openVault("secret"); err != nil {
+		t.Fatalf("failed to enable encryption: %v", err)
+	}
+	if err := backend.putSecret(append(dbJoinedEventPrefix, "sealed"...), []byte("{}")); err != nil {
+		t.Fatalf("failed to store sealed event: %v", err)
+	}
+	backend.vault = nil
+
+	// Start up the events and ensure the failure is reported, not skipped
+	backend.hosted, backend.checkin, backend.joined = nil, nil, nil
+	if err := backend.initEvents(); err != ErrBadPassphrase {
+		t.Fatalf("init error mismatch: have %v, want %v", err, ErrBadPassphrase)
+	}
+	if skipped := backend.SkippedRecords(); len(skipped) != 0 {
+		t.Fatalf("inaccessible records skipped: %v", skipped)
+	}
+}
@@ -0,0 +1,49 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrJoinInProgress is returned if a remote pairing or checkin session is
+	// attempted to be joined, but a join of the same session is already running.
+	ErrJoinInProgress = errors.New("join already in progress")
+
+	// ErrJoinThrottled is returned if a remote pairing or checkin session is
+	// attempted to be joined, but too many joins were started recently.
+	ErrJoinThrottled = errors.New("join throttled")
+)
+
+// startJoin marks a remote session as being joined, ensuring that the same one
+// isn't joined concurrently and that joins in general don't storm the Tor network
+// (e.g. a frontend stuck in a retry loop). The returned method must be called to
+// release the session after the join finishes.
+func (b *Backend) startJoin(target string) (func(), error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.joining[target]; ok {
+		return nil, ErrJoinInProgress
+	}
+	// Drop all the joins that fell out of the rate window and check the limit
+	now := time.Now()
+	for len(b.joins) > 0 && now.Sub(b.joins[0]) >= joinRateWindow {
+		b.joins = b.joins[1:]
+	}
+	if len(b.joins) >= joinRateLimit {
+		return nil, ErrJoinThrottled
+	}
+	b.joins = append(b.joins, now)
+	b.joining[target] = struct{}{}
+
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		delete(b.joining, target)
+	}, nil
+}
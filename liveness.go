@@ -0,0 +1,201 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/control"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// livenessEvents are the Tor control port events that signal the network going
+// online or offline.
+var livenessEvents = []control.EventCode{control.EventCodeNetworkLiveness, control.EventCodeStatusClient}
+
+// livenessWatcher is a background monitor that subscribes to the network liveness
+// and circuit status events of Tor, reporting any online/offline transitions. If
+// the event stream breaks (e.g. control connection hiccup or Tor restart), the
+// watcher resubscribes after a short delay.
+type livenessWatcher struct {
+	control func() *control.Conn // Retriever for the current Tor control connection
+	notify  func(online bool)    // Callback to invoke on liveness transitions
+	retry   time.Duration        // Time to wait between resubscription attempts
+
+	quit   chan chan struct{} // Quit channel to tear down the watcher
+	logger log.Logger         // Contextual logger to embed outside tags
+}
+
+// newLivenessWatcher creates a Tor network liveness monitor and starts it.
+func newLivenessWatcher(conn func() *control.Conn, notify func(online bool), retry time.Duration, logger log.Logger) *livenessWatcher {
+	w := &livenessWatcher{
+		control: conn,
+		notify:  notify,
+		retry:   retry,
+		quit:    make(chan chan struct{}),
+		logger:  logger,
+	}
+	go w.loop()
+	return w
+}
+
+// close terminates the liveness monitor, unsubscribing from Tor.
+func (w *livenessWatcher) close() {
+	quit := make(chan struct{})
+	w.quit <- quit
+	<-quit
+}
+
+// loop keeps a subscription to Tor's liveness events alive, resubscribing if it
+// breaks, and reports any state transitions.
+func (w *livenessWatcher) loop() {
+	var known, online bool // Last reported liveness state, only valid if known
+
+	for {
+		// Subscribe to the liveness events and start dispatching them. The channel
+		// is buffered as Tor relays events blocking, so a few may arrive while the
+		// subscription is being torn down.
+		conn := w.control()
+		events := make(chan control.Event, 16)
+
+		if err := conn.AddEventListener(events, livenessEvents...); err != nil {
+			w.logger.Warn("Failed to subscribe to liveness events", "err", err)
+			select {
+			case quit := <-w.quit:
+				close(quit)
+				return
+			case <-time.After(w.retry):
+				continue
+			}
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		failed := make(chan error, 1)
+		go func() { failed <- conn.HandleEvents(ctx) }()
+
+		// Seed the current state, since it might have changed while unsubscribed
+		if res, err := conn.GetInfo("status/circuit-established"); err == nil && len(res) > 0 {
+			if state := res[0].Val == "1"; !known || state != online {
+				known, online = true, state
+				w.notify(online)
+			}
+		}
+		// Process the liveness events until the subscription breaks or we quit
+		var quit chan struct{}
+	process:
+		for {
+			select {
+			case quit = <-w.quit:
+				break process
+
+			case err := <-failed:
+				w.logger.Warn("Liveness event stream failed", "err", err)
+				break process
+
+			case event := <-events:
+				state, ok := livenessUpdate(event)
+				if !ok || (known && state == online) {
+					continue
+				}
+				known, online = true, state
+				w.notify(online)
+			}
+		}
+		// Unsubscribe from the events, draining anything still in flight
+		done := make(chan struct{})
+		go func() {
+			conn.RemoveEventListener(events, livenessEvents...)
+			close(done)
+		}()
+	drain:
+		for {
+			select {
+			case <-events:
+			case <-done:
+				break drain
+			}
+		}
+		cancel()
+
+		if quit != nil {
+			close(quit)
+			return
+		}
+		select {
+		case quit := <-w.quit:
+			close(quit)
+			return
+		case <-time.After(w.retry):
+		}
+	}
+}
+
+// livenessUpdate interprets a Tor control port event, returning whether it signals
+// the network going online or offline. If the event is unrelated to liveness, the
+// ok flag is false.
+func livenessUpdate(event control.Event) (online bool, ok bool) {
+	switch event := event.(type) {
+	case *control.NetworkLivenessEvent:
+		switch strings.TrimSpace(event.Raw) {
+		case "UP":
+			return true, true
+		case "DOWN":
+			return false, true
+		}
+	case *control.StatusEvent:
+		switch event.Action {
+		case "CIRCUIT_ESTABLISHED":
+			return true, true
+		case "CIRCUIT_NOT_ESTABLISHED":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// OnNetworkChange registers a callback to be invoked whenever the Tor network
+// goes online or offline. Callbacks are invoked synchronously from the liveness
+// monitor, so they should not block.
+func (b *Backend) OnNetworkChange(callback func(online bool)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.netCallbacks = append(b.netCallbacks, callback)
+}
+
+// networkChanged is invoked by the liveness monitor when the Tor network goes
+// online or offline. If networking is enabled by the user, the dial scheduler
+// and joined event clients are suspended while offline to avoid pointless dial
+// failures, and resumed when back online.
+func (b *Backend) networkChanged(online bool) {
+	b.logger.Info("Tor network liveness changed", "online", online)
+
+	b.lock.RLock()
+	enabled := b.enabled
+	callbacks := append([]func(bool){}, b.netCallbacks...)
+	b.lock.RUnlock()
+
+	if enabled {
+		if online {
+			if prof, err := b.Profile(); err == nil {
+				b.dialer.reinit(*prof.KeyRing)
+			}
+		} else {
+			b.dialer.suspend()
+		}
+		b.lock.RLock()
+		for _, client := range b.joined {
+			if online {
+				client.Resume()
+			} else {
+				client.Suspend()
+			}
+		}
+		b.lock.RUnlock()
+	}
+	for _, callback := range callbacks {
+		callback(online)
+	}
+}
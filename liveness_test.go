@@ -0,0 +1,82 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/cretz/bine/control"
+)
+
+// Tests that Tor control port events are correctly interpreted as network going
+// online or offline.
+func TestLivenessUpdate(t *testing.T) {
+	tests := []struct {
+		event  control.Event
+		online bool
+		ok     bool
+	}{
+		{&control.NetworkLivenessEvent{Raw: "UP"}, true, true},
+		{&control.NetworkLivenessEvent{Raw: "DOWN"}, false, true},
+		{&control.NetworkLivenessEvent{Raw: "SIDEWAYS"}, false, false},
+		{&control.StatusEvent{Type: control.EventCodeStatusClient, Action: "CIRCUIT_ESTABLISHED"}, true, true},
+		{&control.StatusEvent{Type: control.EventCodeStatusClient, Action: "CIRCUIT_NOT_ESTABLISHED"}, false, true},
+		{&control.StatusEvent{Type: control.EventCodeStatusClient, Action: "BOOTSTRAP"}, false, false},
+	}
+	for i, tt := range tests {
+		online, ok := livenessUpdate(tt.event)
+		if online != tt.online || ok != tt.ok {
+			t.Errorf("test %d: liveness mismatch: have %v/%v, want %v/%v", i, online, ok, tt.online, tt.ok)
+		}
+	}
+}
+
+// Tests that network liveness transitions suspend and resume the dial scheduler
+// and notify any registered callbacks.
+func TestNetworkChanged(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	// Create a local user with a single contact and schedule dialing it
+	keyring := newTestReporter(t, backend)
+
+	remote, err := tornet.GenerateKeyRing()
+	if err != nil {
+		t.Fatalf("failed to generate remote keyring: %v", err)
+	}
+	keyring.Trusted[remote.Identity.Fingerprint()] = tornet.RemoteKeyRing{
+		Identity: remote.Identity.Public(),
+		Address:  remote.Addresses[0].Public(),
+	}
+	blob, err := json.Marshal(&profile{KeyRing: &keyring})
+	if err != nil {
+		t.Fatalf("failed to marshal profile: %v", err)
+	}
+	if err := backend.database.Put(dbProfileKey, blob, nil); err != nil {
+		t.Fatalf("failed to store profile: %v", err)
+	}
+	backend.dialer = newScheduler(backend)
+	defer backend.dialer.close()
+
+	backend.enabled = true
+
+	var notified []bool
+	backend.OnNetworkChange(func(online bool) { notified = append(notified, online) })
+
+	// Bring the network online and ensure dials are scheduled
+	backend.networkChanged(true)
+	if statuses := backend.dialer.statuses(); len(statuses) != 1 {
+		t.Fatalf("online schedule mismatch: have %d contacts, want %d", len(statuses), 1)
+	}
+	// Take the network offline and ensure dials are suspended
+	backend.networkChanged(false)
+	if statuses := backend.dialer.statuses(); len(statuses) != 0 {
+		t.Fatalf("offline schedule mismatch: have %d contacts, want %d", len(statuses), 0)
+	}
+	if len(notified) != 2 || !notified[0] || notified[1] {
+		t.Fatalf("notifications mismatch: have %v, want %v", notified, []bool{true, false})
+	}
+}
@@ -0,0 +1,392 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols"
+	"github.com/coronanet/go-coronanet/protocols/corona"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/crypto/sha3"
+)
+
+var (
+	// dbMessagePrefix is the database key for storing messages exchanged with a
+	// remote contact.
+	dbMessagePrefix = []byte("message-")
+
+	// dbOutboxPrefix is the database key for storing signed messages queued up
+	// for delivery to a remote contact.
+	dbOutboxPrefix = []byte("outbox-")
+
+	// ErrMessageEmpty is returned if a message is attempted to be sent without
+	// any content.
+	ErrMessageEmpty = errors.New("message empty")
+
+	// ErrMessageTooLong is returned if a message is attempted to be sent or is
+	// received that exceeds the permitted length.
+	ErrMessageTooLong = errors.New("message too long")
+
+	// ErrAttachmentTooLarge is returned if a message is attempted to be sent or
+	// is received with an attachment exceeding the permitted size.
+	ErrAttachmentTooLarge = errors.New("attachment too large")
+)
+
+// Message represents a single text message exchanged with a remote contact.
+type Message struct {
+	Nonce      [16]byte  `json:"nonce"`      // Unique nonce of the message for deduplication
+	Text       string    `json:"text"`       // Free form text content of the message
+	Attachment [32]byte  `json:"attachment"` // CDN hash of the attached blob, if any
+	Size       int       `json:"size"`       // Number of bytes in the attachment, if any
+	Time       time.Time `json:"time"`       // Time when the message was composed by the sender
+	Outgoing   bool      `json:"outgoing"`   // Whether the message was sent or received
+	Delivered  bool      `json:"delivered"`  // Whether the contact acknowledged an outgoing message
+}
+
+// messageKey assembles the database key for a message exchanged with a contact.
+func messageKey(uid tornet.IdentityFingerprint, nonce [16]byte) []byte {
+	key := append(append(append([]byte{}, dbMessagePrefix...), uid...), '-')
+	return append(key, nonce[:]...)
+}
+
+// outboxKey assembles the database key for a message queued up for delivery to
+// a contact.
+func outboxKey(uid tornet.IdentityFingerprint, nonce [16]byte) []byte {
+	key := append(append(append([]byte{}, dbOutboxPrefix...), uid...), '-')
+	return append(key, nonce[:]...)
+}
+
+// messageBlob assembles the binary blob that a message's signature covers. The
+// attachment is only covered by hash, and only if present, so that plain text
+// messages are signed the same way as before attachments existed.
+func messageBlob(msg *corona.Message) []byte {
+	blob := make([]byte, 0, len(msg.Nonce)+8+len(msg.Text)+32)
+	blob = append(blob, msg.Nonce[:]...)
+	blob = append(blob, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(blob[len(msg.Nonce):], uint64(msg.Timestamp.UnixNano()))
+	blob = append(blob, msg.Text...)
+	if len(msg.Attachment) > 0 {
+		hash := sha3.Sum256(msg.Attachment)
+		blob = append(blob, hash[:]...)
+	}
+	return blob
+}
+
+// validateMessage checks that the content of a message is within the allowed
+// limits, both for sending and for receiving.
+func validateMessage(text string, attachment []byte) error {
+	switch {
+	case len(text) == 0 && len(attachment) == 0:
+		return ErrMessageEmpty
+	case len(text) > messageMaxLength:
+		return ErrMessageTooLong
+	case len(attachment) > messageMaxAttachment:
+		return ErrAttachmentTooLarge
+	}
+	return nil
+}
+
+// storeMessage serializes a message into the database, uploading any attachment
+// into the CDN. Afterwards the conversation is pruned according to the message
+// retention policy.
+//
+// Note, this method assumes the write lock is held.
+func (b *Backend) storeMessage(uid tornet.IdentityFingerprint, msg *Message, attachment []byte) error {
+	if len(attachment) > 0 {
+		hash, err := b.uploadCDNImage(attachment)
+		if err != nil {
+			return err
+		}
+		msg.Attachment, msg.Size = hash, len(attachment)
+	}
+	blob, err := json.Marshal(msg)
+	if err != nil {
+		if msg.Attachment != ([32]byte{}) {
+			b.deleteCDNImage(msg.Attachment)
+		}
+		return err
+	}
+	if err := b.putSecret(messageKey(uid, msg.Nonce), blob); err != nil {
+		if msg.Attachment != ([32]byte{}) {
+			b.deleteCDNImage(msg.Attachment)
+		}
+		return err
+	}
+	return b.pruneMessages(uid)
+}
+
+// SendMessage sends a text message to a remote contact. If the contact is not
+// online, the message is queued up and delivered on the next connection.
+func (b *Backend) SendMessage(uid tornet.IdentityFingerprint, text string) error {
+	return b.SendAttachment(uid, text, nil)
+}
+
+// SendAttachment sends a binary attachment to a remote contact, optionally with
+// a text caption. Identical attachments are deduplicated locally in the CDN.
+func (b *Backend) SendAttachment(uid tornet.IdentityFingerprint, text string, attachment []byte) error {
+	b.logger.Info("Sending message", "contact", uid, "bytes", len(text), "attachment", len(attachment))
+
+	if err := validateMessage(text, attachment); err != nil {
+		return err
+	}
+	b.lock.Lock()
+
+	// Ensure the local user and the remote contact both exist
+	prof, err := b.Profile()
+	if err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	info, err := b.Contact(uid)
+	if err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	// Assign the next sequence number to the message for acknowledgements
+	info.Sequence++
+
+	blob, err := json.Marshal(info)
+	if err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	if err := b.database.Put(append(dbContactPrefix, uid...), blob, nil); err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	// Assemble the message, sign it and store it locally
+	msg := &corona.Message{
+		Text:       text,
+		Attachment: attachment,
+		Timestamp:  time.Now(),
+		Sequence:   info.Sequence,
+	}
+	if _, err := rand.Read(msg.Nonce[:]); err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	msg.Signature = prof.KeyRing.Identity.Sign(messageBlob(msg))
+
+	if err := b.storeMessage(uid, &Message{Nonce: msg.Nonce, Text: msg.Text, Time: msg.Timestamp, Outgoing: true}, attachment); err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	// Queue the message up until it's delivered, and if the contact is online,
+	// send it over straight away
+	if err := b.queueMessage(uid, msg); err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	if enc := b.peerset[uid]; enc != nil {
+		b.lock.Unlock()
+
+		go b.deliverMessages(uid, enc, []*corona.Message{msg})
+		return nil
+	}
+	b.lock.Unlock()
+
+	b.dialer.prioritize(schedulerMessageDelivery, []tornet.IdentityFingerprint{uid})
+	return nil
+}
+
+// Messages retrieves all the messages exchanged with a remote contact after the
+// given time, ordered chronologically.
+func (b *Backend) Messages(uid tornet.IdentityFingerprint, since time.Time) ([]*Message, error) {
+	if _, err := b.Contact(uid); err != nil {
+		return nil, err
+	}
+	messages := []*Message{} // Need explicit init for JSON!
+
+	it := b.database.NewIterator(util.BytesPrefix(append(append(append([]byte{}, dbMessagePrefix...), uid...), '-')), nil)
+	defer it.Release()
+
+	for it.Next() {
+		blob, err := b.openSecret(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		msg := new(Message)
+		if err := json.Unmarshal(blob, msg); err != nil {
+			return nil, err
+		}
+		if msg.Time.After(since) {
+			messages = append(messages, msg)
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Time.Before(messages[j].Time)
+	})
+	return messages, nil
+}
+
+// deleteMessages deletes all the messages exchanged with a remote contact and
+// drops any queued up ones, dereferencing their attachments from the CDN.
+//
+// Note, this method assumes the write lock is held.
+func (b *Backend) deleteMessages(uid tornet.IdentityFingerprint) error {
+	for _, prefix := range [][]byte{dbMessagePrefix, dbOutboxPrefix} {
+		it := b.database.NewIterator(util.BytesPrefix(append(append(append([]byte{}, prefix...), uid...), '-')), nil)
+		for it.Next() {
+			if bytes.HasPrefix(it.Key(), dbMessagePrefix) {
+				msg := new(Message)
+				if blob, err := b.openSecret(it.Value()); err == nil && json.Unmarshal(blob, msg) == nil && msg.Attachment != ([32]byte{}) {
+					if err := b.deleteCDNImage(msg.Attachment); err != nil {
+						it.Release()
+						return err
+					}
+				}
+			}
+			if err := b.database.Delete(it.Key(), nil); err != nil {
+				it.Release()
+				return err
+			}
+		}
+		it.Release()
+	}
+	return nil
+}
+
+// queueMessage persists a signed message for delivery to a remote contact, so
+// it survives until the contact comes online, even across restarts.
+//
+// Note, this method assumes the write lock is held.
+func (b *Backend) queueMessage(uid tornet.IdentityFingerprint, msg *corona.Message) error {
+	blob, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return b.putSecret(outboxKey(uid, msg.Nonce), blob)
+}
+
+// queuedMessages retrieves all the messages queued up for delivery to a remote
+// contact, ordered chronologically.
+//
+// Note, this method assumes the read lock is held.
+func (b *Backend) queuedMessages(uid tornet.IdentityFingerprint) ([]*corona.Message, error) {
+	var queued []*corona.Message
+
+	it := b.database.NewIterator(util.BytesPrefix(append(append(append([]byte{}, dbOutboxPrefix...), uid...), '-')), nil)
+	defer it.Release()
+
+	for it.Next() {
+		blob, err := b.openSecret(it.Value())
+		if err != nil {
+			return nil, err
+		}
+		msg := new(corona.Message)
+		if err := json.Unmarshal(blob, msg); err != nil {
+			return nil, err
+		}
+		queued = append(queued, msg)
+	}
+	sort.SliceStable(queued, func(i, j int) bool {
+		return queued[i].Timestamp.Before(queued[j].Timestamp)
+	})
+	return queued, nil
+}
+
+// receiveMessage validates a message received from a remote contact and stores
+// it into the database. Messages already seen are silently discarded.
+func (b *Backend) receiveMessage(uid tornet.IdentityFingerprint, msg *corona.Message) error {
+	if err := validateMessage(msg.Text, msg.Attachment); err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Ensure the message was signed by the contact we're talking to
+	if b.overlay == nil {
+		return ErrProfileNotFound
+	}
+	keyring, ok := b.overlay.Trusted()[uid]
+	if !ok {
+		return ErrContactNotFound
+	}
+	if !keyring.Identity.Verify(messageBlob(msg), msg.Signature) {
+		return errors.New("invalid message signature")
+	}
+	// Discard any redelivered messages, store and announce new ones
+	if known, _ := b.database.Has(messageKey(uid, msg.Nonce), nil); known {
+		b.logger.Debug("Discarding duplicate message", "contact", uid)
+		return nil
+	}
+	if err := b.storeMessage(uid, &Message{Nonce: msg.Nonce, Text: msg.Text, Time: msg.Timestamp}, msg.Attachment); err != nil {
+		return err
+	}
+	b.feed.publish(Event{Kind: EventMessageReceived, Contact: uid})
+	return nil
+}
+
+// deliverMessages sends over a batch of queued up messages to a remote contact.
+// Messages are not dropped from the outbox here, only when the remote contact
+// acknowledges them; anything unacknowledged is redelivered on the next
+// connection.
+func (b *Backend) deliverMessages(uid tornet.IdentityFingerprint, enc *protocols.Sender, queued []*corona.Message) {
+	for i, msg := range queued {
+		if err := enc.Encode(&corona.Envelope{Message: msg}); err != nil {
+			b.logger.Warn("Failed to deliver queued messages", "contact", uid, "pending", len(queued)-i, "err", err)
+			return
+		}
+	}
+	b.logger.Debug("Delivered queued messages", "contact", uid, "count", len(queued))
+}
+
+// acknowledgeMessage drops a message from the outbox after the remote contact
+// has acknowledged receiving it, and marks the stored copy delivered. Unknown
+// (already acknowledged) sequence numbers are ignored.
+func (b *Backend) acknowledgeMessage(uid tornet.IdentityFingerprint, seq uint64) error {
+	b.lock.Lock()
+
+	// Find the queued message the acknowledgement refers to
+	queued, err := b.queuedMessages(uid)
+	if err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	var nonce *[16]byte
+	for _, msg := range queued {
+		if msg.Sequence == seq {
+			nonce = &msg.Nonce
+			break
+		}
+	}
+	if nonce == nil {
+		b.lock.Unlock()
+		return nil
+	}
+	// Message found, drop it from the outbox and mark it delivered
+	if err := b.database.Delete(outboxKey(uid, *nonce), nil); err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	if blob, err := b.getSecret(messageKey(uid, *nonce)); err == nil { // Might have been pruned
+		msg := new(Message)
+		if err := json.Unmarshal(blob, msg); err != nil {
+			b.lock.Unlock()
+			return err
+		}
+		msg.Delivered = true
+
+		if blob, err = json.Marshal(msg); err != nil {
+			b.lock.Unlock()
+			return err
+		}
+		if err := b.putSecret(messageKey(uid, *nonce), blob); err != nil {
+			b.lock.Unlock()
+			return err
+		}
+	}
+	b.lock.Unlock()
+
+	b.feed.publish(Event{Kind: EventMessageDelivered, Contact: uid})
+	return nil
+}
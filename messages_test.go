@@ -0,0 +1,442 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols"
+	"github.com/coronanet/go-coronanet/protocols/corona"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// newTestContacts creates two test users with live overlays on a shared gateway.
+//
+// Only bob's dialer is left running, otherwise simultaneous dials from the two
+// sides would deduplicate (tear down) each other's connections.
+func newTestContacts(t *testing.T) (*Backend, *Backend, func()) {
+	gateway := tornet.NewMockGateway()
+
+	alice := newTestBackend(t)
+	newTestProfile(t, alice, gateway)
+	alice.dialer.close()
+
+	bob := newTestBackend(t)
+	newTestProfile(t, bob, gateway)
+
+	return alice, bob, func() {
+		bob.dialer.close()
+		for _, backend := range []*Backend{alice, bob} {
+			backend.overlay.Close()
+			backend.database.Close()
+		}
+	}
+}
+
+// newTestRemote retrieves the remote keyring of a test user to trust.
+func newTestRemote(t *testing.T, backend *Backend) tornet.RemoteKeyRing {
+	prof, err := backend.Profile()
+	if err != nil {
+		t.Fatalf("failed to retrieve profile: %v", err)
+	}
+	return tornet.RemoteKeyRing{
+		Identity: prof.KeyRing.Identity.Public(),
+		Address:  prof.KeyRing.Addresses[0].Public(),
+	}
+}
+
+// waitTestMessages waits until a given number of messages were exchanged with
+// a remote contact.
+func waitTestMessages(t *testing.T, backend *Backend, uid tornet.IdentityFingerprint, count int) []*Message {
+	for i := 0; i < 100; i++ {
+		messages, err := backend.Messages(uid, time.Time{})
+		if err != nil {
+			t.Fatalf("failed to retrieve messages: %v", err)
+		}
+		if len(messages) >= count {
+			return messages
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("messages timed out")
+	return nil
+}
+
+// waitTestConnection waits until a remote contact is connected.
+func waitTestConnection(t *testing.T, backend *Backend, uid tornet.IdentityFingerprint) {
+	for i := 0; i < 100; i++ {
+		backend.lock.RLock()
+		enc := backend.peerset[uid]
+		backend.lock.RUnlock()
+
+		if enc != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("connection timed out")
+}
+
+// Tests that messages sent to online contacts get delivered directly.
+func TestMessageOnlineDelivery(t *testing.T) {
+	alice, bob, teardown := newTestContacts(t)
+	defer teardown()
+
+	aliceId, bobId := newTestRemote(t, alice), newTestRemote(t, bob)
+	if _, err := alice.AddContact(bobId); err != nil {
+		t.Fatalf("failed to add bob to alice: %v", err)
+	}
+	if _, err := bob.AddContact(aliceId); err != nil {
+		t.Fatalf("failed to add alice to bob: %v", err)
+	}
+	waitTestConnection(t, alice, bobId.Identity.Fingerprint())
+
+	// Send a message from alice to bob and ensure it arrives
+	sub, unsub := bob.Subscribe()
+	defer unsub()
+
+	if err := alice.SendMessage(bobId.Identity.Fingerprint(), "Hello Bob"); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	messages := waitTestMessages(t, bob, aliceId.Identity.Fingerprint(), 1)
+	if messages[0].Text != "Hello Bob" || messages[0].Outgoing {
+		t.Fatalf("received message mismatch: have %+v", messages[0])
+	}
+	sent := waitTestMessages(t, alice, bobId.Identity.Fingerprint(), 1)
+	if sent[0].Text != "Hello Bob" || !sent[0].Outgoing {
+		t.Fatalf("sent message mismatch: have %+v", sent[0])
+	}
+	for {
+		select {
+		case event := <-sub:
+			if event.Kind != EventMessageReceived {
+				continue
+			}
+			if event.Contact != aliceId.Identity.Fingerprint() {
+				t.Fatalf("notification contact mismatch: have %v, want %v", event.Contact, aliceId.Identity.Fingerprint())
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatalf("message notification timed out")
+		}
+	}
+}
+
+// Tests that messages sent to offline contacts get queued up and delivered when
+// the connection is established.
+func TestMessageOfflineDelivery(t *testing.T) {
+	alice, bob, teardown := newTestContacts(t)
+	defer teardown()
+
+	// Only have alice trust bob, so connections can't be established yet
+	aliceId, bobId := newTestRemote(t, alice), newTestRemote(t, bob)
+	if _, err := alice.AddContact(bobId); err != nil {
+		t.Fatalf("failed to add bob to alice: %v", err)
+	}
+	if err := alice.SendMessage(bobId.Identity.Fingerprint(), "Hello Bob"); err != nil {
+		t.Fatalf("failed to send first message: %v", err)
+	}
+	if err := alice.SendMessage(bobId.Identity.Fingerprint(), "Are you there?"); err != nil {
+		t.Fatalf("failed to send second message: %v", err)
+	}
+	alice.lock.RLock()
+	pending, _ := alice.queuedMessages(bobId.Identity.Fingerprint())
+	alice.lock.RUnlock()
+
+	queued := len(pending)
+
+	if queued != 2 {
+		t.Fatalf("queued message count mismatch: have %d, want %d", queued, 2)
+	}
+	// Have bob trust alice too, which will trigger a connection and delivery
+	if _, err := bob.AddContact(aliceId); err != nil {
+		t.Fatalf("failed to add alice to bob: %v", err)
+	}
+	messages := waitTestMessages(t, bob, aliceId.Identity.Fingerprint(), 2)
+	if messages[0].Text != "Hello Bob" {
+		t.Errorf("first message mismatch: have %s, want %s", messages[0].Text, "Hello Bob")
+	}
+	if messages[1].Text != "Are you there?" {
+		t.Errorf("second message mismatch: have %s, want %s", messages[1].Text, "Are you there?")
+	}
+	for i := 0; ; i++ {
+		alice.lock.RLock()
+		pending, _ = alice.queuedMessages(bobId.Identity.Fingerprint())
+		alice.lock.RUnlock()
+
+		if len(pending) == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("queued message count mismatch: have %d, want %d", len(pending), 0)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests that redelivered messages are deduplicated and that messages with bad
+// signatures or lengths are rejected.
+func TestMessageValidation(t *testing.T) {
+	alice, bob, teardown := newTestContacts(t)
+	defer teardown()
+
+	// Have alice trust bob (alice never dials, so no connection is made)
+	aliceId, bobId := newTestRemote(t, alice), newTestRemote(t, bob)
+	if _, err := alice.AddContact(bobId); err != nil {
+		t.Fatalf("failed to add bob to alice: %v", err)
+	}
+	prof, _ := bob.Profile()
+	msg := &corona.Message{
+		Text:      "Hello Alice",
+		Timestamp: time.Now(),
+		Nonce:     [16]byte{1, 2, 3},
+	}
+	msg.Signature = prof.KeyRing.Identity.Sign(messageBlob(msg))
+
+	// Deliver the same message twice and ensure only one is stored
+	uid := bobId.Identity.Fingerprint()
+	for i := 0; i < 2; i++ {
+		if err := alice.receiveMessage(uid, msg); err != nil {
+			t.Fatalf("delivery %d: failed to receive message: %v", i, err)
+		}
+	}
+	if messages, _ := alice.Messages(uid, time.Time{}); len(messages) != 1 {
+		t.Fatalf("stored message count mismatch: have %d, want %d", len(messages), 1)
+	}
+	// Tamper with the message and ensure it's rejected
+	forged := *msg
+	forged.Nonce = [16]byte{4, 5, 6}
+	forged.Text = "Hello Eve"
+	if err := alice.receiveMessage(uid, &forged); err == nil {
+		t.Fatalf("forged message accepted")
+	}
+	// Ensure oversized messages are rejected on both ends
+	long := make([]byte, messageMaxLength+1)
+	for i := range long {
+		long[i] = 'x'
+	}
+	if err := bob.SendMessage(aliceId.Identity.Fingerprint(), string(long)); err != ErrMessageTooLong {
+		t.Fatalf("oversized send error mismatch: have %v, want %v", err, ErrMessageTooLong)
+	}
+	oversized := &corona.Message{
+		Text:      string(long),
+		Timestamp: time.Now(),
+		Nonce:     [16]byte{7, 8, 9},
+	}
+	oversized.Signature = prof.KeyRing.Identity.Sign(messageBlob(oversized))
+	if err := alice.receiveMessage(uid, oversized); err != ErrMessageTooLong {
+		t.Fatalf("oversized receive error mismatch: have %v, want %v", err, ErrMessageTooLong)
+	}
+	// Ensure oversized attachments are rejected on both ends
+	huge := make([]byte, messageMaxAttachment+1)
+	if err := bob.SendAttachment(aliceId.Identity.Fingerprint(), "", huge); err != ErrAttachmentTooLarge {
+		t.Fatalf("oversized attachment send error mismatch: have %v, want %v", err, ErrAttachmentTooLarge)
+	}
+	bloated := &corona.Message{
+		Attachment: huge,
+		Timestamp:  time.Now(),
+		Nonce:      [16]byte{10, 11, 12},
+	}
+	bloated.Signature = prof.KeyRing.Identity.Sign(messageBlob(bloated))
+	if err := alice.receiveMessage(uid, bloated); err != ErrAttachmentTooLarge {
+		t.Fatalf("oversized attachment receive error mismatch: have %v, want %v", err, ErrAttachmentTooLarge)
+	}
+}
+
+// Tests that queued messages are only dropped from the outbox once the remote
+// contact acknowledges them, and are kept for the next connection until then.
+func TestMessageDeliveryFailure(t *testing.T) {
+	alice, bob, teardown := newTestContacts(t)
+	defer teardown()
+
+	// Queue up a message to an offline bob
+	bobId := newTestRemote(t, bob)
+	if _, err := alice.AddContact(bobId); err != nil {
+		t.Fatalf("failed to add bob to alice: %v", err)
+	}
+	uid := bobId.Identity.Fingerprint()
+	if err := alice.SendMessage(uid, "Hello Bob"); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	alice.lock.RLock()
+	queued, err := alice.queuedMessages(uid)
+	alice.lock.RUnlock()
+	if err != nil {
+		t.Fatalf("failed to retrieve queued messages: %v", err)
+	}
+	if len(queued) != 1 {
+		t.Fatalf("queued message count mismatch: have %d, want %d", len(queued), 1)
+	}
+	// Attempt to deliver it over a dead connection and ensure it stays queued
+	reader, writer := io.Pipe()
+	reader.Close()
+
+	dead := protocols.NewSender(gob.NewEncoder(writer))
+	defer dead.Close()
+	alice.deliverMessages(uid, dead, queued)
+
+	alice.lock.RLock()
+	pending, _ := alice.queuedMessages(uid)
+	alice.lock.RUnlock()
+	if len(pending) != 1 {
+		t.Fatalf("failed delivery queue mismatch: have %d, want %d", len(pending), 1)
+	}
+	// Deliver it over a live connection and ensure it stays queued until acked
+	live := protocols.NewSender(gob.NewEncoder(ioutil.Discard))
+	defer live.Close()
+	alice.deliverMessages(uid, live, queued)
+
+	alice.lock.RLock()
+	pending, _ = alice.queuedMessages(uid)
+	alice.lock.RUnlock()
+	if len(pending) != 1 {
+		t.Fatalf("unacknowledged delivery queue mismatch: have %d, want %d", len(pending), 1)
+	}
+	if err := alice.acknowledgeMessage(uid, queued[0].Sequence); err != nil {
+		t.Fatalf("failed to acknowledge message: %v", err)
+	}
+	alice.lock.RLock()
+	pending, _ = alice.queuedMessages(uid)
+	alice.lock.RUnlock()
+	if len(pending) != 0 {
+		t.Fatalf("acknowledged delivery queue mismatch: have %d, want %d", len(pending), 0)
+	}
+}
+
+// Tests that messages queued up for an offline contact survive a restart of the
+// sender, and are delivered and dequeued once the contact comes online.
+func TestMessageRedeliveryAfterRestart(t *testing.T) {
+	gateway := tornet.NewMockGateway()
+
+	alice := newTestBackend(t)
+	newTestProfile(t, alice, gateway)
+	alice.dialer.close()
+
+	bob := newTestBackend(t)
+	newTestProfile(t, bob, gateway)
+	defer bob.database.Close()
+	defer bob.overlay.Close()
+	defer bob.dialer.close()
+
+	// Only have alice trust bob and queue up a message for him
+	aliceId, bobId := newTestRemote(t, alice), newTestRemote(t, bob)
+	if _, err := alice.AddContact(bobId); err != nil {
+		t.Fatalf("failed to add bob to alice: %v", err)
+	}
+	if err := alice.SendMessage(bobId.Identity.Fingerprint(), "Hello Bob"); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	// Wait for the trust to be persisted, then restart alice on the same database
+	for i := 0; ; i++ {
+		prof, err := alice.Profile()
+		if err != nil {
+			t.Fatalf("failed to retrieve profile: %v", err)
+		}
+		if _, ok := prof.KeyRing.Trusted[bobId.Identity.Fingerprint()]; ok {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("keyring persistence timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	alice.overlay.Close()
+
+	restarted := newTestBackend(t)
+	restarted.database.Close()
+	restarted.database = alice.database
+	defer restarted.database.Close()
+
+	startTestOverlay(t, restarted, gateway)
+	restarted.dialer.close()
+	defer restarted.overlay.Close()
+
+	// Have bob trust alice too, which will trigger a connection and delivery
+	if _, err := bob.AddContact(aliceId); err != nil {
+		t.Fatalf("failed to add alice to bob: %v", err)
+	}
+	messages := waitTestMessages(t, bob, aliceId.Identity.Fingerprint(), 1)
+	if messages[0].Text != "Hello Bob" {
+		t.Fatalf("message mismatch: have %s, want %s", messages[0].Text, "Hello Bob")
+	}
+	for i := 0; ; i++ {
+		restarted.lock.RLock()
+		pending, _ := restarted.queuedMessages(bobId.Identity.Fingerprint())
+		restarted.lock.RUnlock()
+
+		if len(pending) == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("queued message count mismatch: have %d, want %d", len(pending), 0)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests that messages get assigned increasing sequence numbers and are marked
+// delivered once the remote contact acknowledges them.
+func TestMessageAcknowledgement(t *testing.T) {
+	alice, bob, teardown := newTestContacts(t)
+	defer teardown()
+
+	aliceId, bobId := newTestRemote(t, alice), newTestRemote(t, bob)
+	if _, err := alice.AddContact(bobId); err != nil {
+		t.Fatalf("failed to add bob to alice: %v", err)
+	}
+	uid := bobId.Identity.Fingerprint()
+
+	// Queue up a few messages while bob is offline and check their sequencing
+	for _, text := range []string{"Hello Bob", "Are you there?"} {
+		if err := alice.SendMessage(uid, text); err != nil {
+			t.Fatalf("failed to send message: %v", err)
+		}
+	}
+	alice.lock.RLock()
+	queued, _ := alice.queuedMessages(uid)
+	alice.lock.RUnlock()
+
+	for i, msg := range queued {
+		if msg.Sequence != uint64(i+1) {
+			t.Fatalf("message %d: sequence mismatch: have %d, want %d", i, msg.Sequence, i+1)
+		}
+	}
+	for _, msg := range waitTestMessages(t, alice, uid, 2) {
+		if msg.Delivered {
+			t.Fatalf("undelivered message marked delivered: %+v", msg)
+		}
+	}
+	// Bring bob online and wait for the acknowledgements to arrive
+	sub, unsub := alice.Subscribe()
+	defer unsub()
+
+	if _, err := bob.AddContact(aliceId); err != nil {
+		t.Fatalf("failed to add alice to bob: %v", err)
+	}
+	for acked := 0; acked < len(queued); {
+		select {
+		case event := <-sub:
+			if event.Kind == EventMessageDelivered && event.Contact == uid {
+				acked++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("delivery notification timed out")
+		}
+	}
+	for _, msg := range waitTestMessages(t, alice, uid, 2) {
+		if !msg.Delivered {
+			t.Fatalf("acknowledged message not marked delivered: %+v", msg)
+		}
+	}
+	alice.lock.RLock()
+	pending, _ := alice.queuedMessages(uid)
+	alice.lock.RUnlock()
+	if len(pending) != 0 {
+		t.Fatalf("queued message count mismatch: have %d, want %d", len(pending), 0)
+	}
+}
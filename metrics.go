@@ -0,0 +1,111 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"sync/atomic"
+
+	"github.com/coronanet/go-coronanet/protocols/events"
+)
+
+// Metric is a single named measurement of the backend, along with one or more
+// labeled samples of it. The layout mirrors the Prometheus data model so it can
+// be exported without any further processing.
+type Metric struct {
+	Name    string         // Name of the metric, unique across all of them
+	Help    string         // Short human readable description of the metric
+	Kind    string         // Type of the metric (counter or gauge)
+	Samples []MetricSample // Individual values of the metric, one per label set
+}
+
+// MetricSample is a single value of a metric, optionally labeled.
+type MetricSample struct {
+	Labels map[string]string // Labels distinguishing the sample (nil = none)
+	Value  float64           // Current value of the sample
+}
+
+// Metrics gathers a snapshot of the backend's operational metrics. The backend
+// lock is only held while collecting the live components, all the counters are
+// read afterwards, so scraping does not stall the node.
+func (b *Backend) Metrics() []Metric {
+	b.lock.RLock()
+	overlay, dialer := b.overlay, b.dialer
+
+	hosted := make([]*events.Server, 0, len(b.hosted))
+	for _, server := range b.hosted {
+		hosted = append(hosted, server)
+	}
+	joined := make([]*events.Client, 0, len(b.joined))
+	for _, client := range b.joined {
+		joined = append(joined, client)
+	}
+	b.lock.RUnlock()
+
+	// Count the contacts and live connections
+	var contacts, peers, attendees int
+	if overlay != nil {
+		contacts, peers = len(overlay.Trusted()), overlay.Connections()
+	} else if uids, err := b.Contacts(); err == nil {
+		contacts = len(uids)
+	}
+	for _, server := range hosted {
+		attendees += server.Connections()
+	}
+	for _, client := range joined {
+		attendees += client.Connections()
+	}
+	metrics := []Metric{
+		gauge("coronanet_contacts", "Number of trusted contacts", float64(contacts)),
+		gauge("coronanet_events_hosted", "Number of locally hosted events", float64(len(hosted))),
+		gauge("coronanet_events_joined", "Number of remotely hosted events joined", float64(len(joined))),
+		{
+			Name: "coronanet_connections",
+			Help: "Number of active peer connections",
+			Kind: "gauge",
+			Samples: []MetricSample{
+				{Labels: map[string]string{"kind": "contacts"}, Value: float64(peers)},
+				{Labels: map[string]string{"kind": "events"}, Value: float64(attendees)},
+			},
+		},
+	}
+	// Export the dial scheduler's stats if it's running
+	if dialer != nil {
+		metrics = append(metrics,
+			gauge("coronanet_dials_queued", "Number of contacts queued for dialing", float64(atomic.LoadInt64(&dialer.queued))),
+			counter("coronanet_dials_total", "Number of dial attempts to contacts", float64(atomic.LoadUint64(&dialer.dials))),
+			counter("coronanet_dial_failures_total", "Number of failed dial attempts to contacts", float64(atomic.LoadUint64(&dialer.failures))),
+		)
+	}
+	// Export the network traffic, both raw Tor and per protocol
+	if _, _, ingress, egress, err := b.GatewayStatus(); err == nil {
+		metrics = append(metrics,
+			counter("coronanet_tor_read_bytes_total", "Number of bytes read by the Tor gateway", float64(ingress)),
+			counter("coronanet_tor_written_bytes_total", "Number of bytes written by the Tor gateway", float64(egress)),
+		)
+	}
+	var (
+		in  = Metric{Name: "coronanet_protocol_read_bytes_total", Help: "Number of bytes read by each protocol", Kind: "counter"}
+		out = Metric{Name: "coronanet_protocol_written_bytes_total", Help: "Number of bytes written by each protocol", Kind: "counter"}
+	)
+	for proto, traffic := range b.TrafficByProtocol() {
+		labels := map[string]string{"protocol": proto}
+
+		in.Samples = append(in.Samples, MetricSample{Labels: labels, Value: float64(traffic.In)})
+		out.Samples = append(out.Samples, MetricSample{Labels: labels, Value: float64(traffic.Out)})
+	}
+	if len(in.Samples) > 0 {
+		metrics = append(metrics, in, out)
+	}
+	return metrics
+}
+
+// gauge creates an unlabeled metric of a value that can go up and down.
+func gauge(name string, help string, value float64) Metric {
+	return Metric{Name: name, Help: help, Kind: "gauge", Samples: []MetricSample{{Value: value}}}
+}
+
+// counter creates an unlabeled metric of a monotonically increasing value.
+func counter(name string, help string, value float64) Metric {
+	return Metric{Name: name, Help: help, Kind: "counter", Samples: []MetricSample{{Value: value}}}
+}
@@ -0,0 +1,76 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"os"
+	"testing"
+
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that the backend metrics track the contacts, events and connections of
+// the local node.
+func TestMetrics(t *testing.T) {
+	gateway := tornet.NewMockGateway()
+
+	alice := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(alice.datadir)
+	defer alice.Close()
+
+	bob := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(bob.datadir)
+	defer bob.Close()
+
+	// Create the two profiles and cross trust them
+	keyrings := make([]tornet.SecretKeyRing, 2)
+	for i, backend := range []*Backend{alice, bob} {
+		if err := backend.CreateProfile(); err != nil {
+			t.Fatalf("failed to create profile: %v", err)
+		}
+		if err := backend.EnableGateway(); err != nil {
+			t.Fatalf("failed to enable gateway: %v", err)
+		}
+		prof, err := backend.Profile()
+		if err != nil {
+			t.Fatalf("failed to retrieve profile: %v", err)
+		}
+		keyrings[i] = *prof.KeyRing
+	}
+	if _, err := alice.AddContact(tornet.RemoteKeyRing{Identity: keyrings[1].Identity.Public(), Address: keyrings[1].Addresses[0].Public()}); err != nil {
+		t.Fatalf("failed to add bob as contact: %v", err)
+	}
+	if _, err := bob.AddContact(tornet.RemoteKeyRing{Identity: keyrings[0].Identity.Public(), Address: keyrings[0].Addresses[0].Public()}); err != nil {
+		t.Fatalf("failed to add alice as contact: %v", err)
+	}
+	if _, err := alice.CreateEvent("barbecue", "", ""); err != nil {
+		t.Fatalf("failed to create event: %v", err)
+	}
+	waitTestConnected(t, alice, keyrings[1].Identity.Fingerprint())
+
+	// Gather the metrics and ensure they reflect the node's state
+	metrics := make(map[string]Metric)
+	for _, metric := range alice.Metrics() {
+		metrics[metric.Name] = metric
+	}
+	for name, want := range map[string]float64{
+		"coronanet_contacts":      1,
+		"coronanet_events_hosted": 1,
+		"coronanet_events_joined": 0,
+	} {
+		metric, ok := metrics[name]
+		if !ok {
+			t.Fatalf("metric %s missing", name)
+		}
+		if have := metric.Samples[0].Value; have != want {
+			t.Errorf("metric %s mismatch: have %v, want %v", name, have, want)
+		}
+	}
+	if metric := metrics["coronanet_connections"]; len(metric.Samples) != 2 || metric.Samples[0].Value != 1 {
+		t.Errorf("connection metric mismatch: have %+v", metric.Samples)
+	}
+	if _, ok := metrics["coronanet_dial_failures_total"]; !ok {
+		t.Errorf("dial failure metric missing")
+	}
+}
@@ -0,0 +1,94 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	// dbSchemaKey is the database key holding the version of the data schema
+	// the database was last migrated to.
+	dbSchemaKey = []byte("schema")
+
+	// ErrSchemaUnsupported is returned if the database was created by a newer
+	// version of the library than the current one, with an unknown schema.
+	ErrSchemaUnsupported = errors.New("unsupported database schema")
+)
+
+// migration is a single step upgrading the persisted data from one schema
+// version to the next. Migrations must be idempotent, as an interrupted run
+// will be restarted from scratch on the next boot.
+//
+// Migrations should operate on the raw JSON records instead of the current Go
+// types, since the latter will keep evolving after the migration is written.
+type migration struct {
+	name string                     // Descriptive name of the migration for logging
+	run  func(db *leveldb.DB) error // Upgrade function from the previous version
+}
+
+// migrations is the ordered list of schema upgrades. The schema version of the
+// database is the number of migrations already applied on it. Never reorder or
+// remove entries, only ever append new ones.
+var migrations = []migration{}
+
+// migrateDatabase detects the schema version of the database and runs all the
+// needed migrations from the given list to bring it up to the current schema.
+func (b *Backend) migrateDatabase(migrations []migration) error {
+	// Detect the current version of the database. If no version is stored, the
+	// database is either brand new (nothing to migrate), or it's a legacy one from
+	// before schema tracking (everything needs migration).
+	var version uint64
+
+	blob, err := b.database.Get(dbSchemaKey, nil)
+	switch err {
+	case nil:
+		if len(blob) != 8 {
+			return fmt.Errorf("corrupt schema version: %x", blob)
+		}
+		version = binary.BigEndian.Uint64(blob)
+
+	case leveldb.ErrNotFound:
+		it := b.database.NewIterator(&util.Range{}, nil)
+		empty := !it.Next()
+		it.Release()
+
+		if empty {
+			version = uint64(len(migrations))
+			return storeSchemaVersion(b.database, version)
+		}
+	default:
+		return err
+	}
+	if version > uint64(len(migrations)) {
+		b.logger.Error("Database schema too new", "have", version, "want", len(migrations))
+		return ErrSchemaUnsupported
+	}
+	// Run all the missing migrations, bumping the version after each
+	for ; version < uint64(len(migrations)); version++ {
+		b.logger.Info("Migrating database schema", "version", version+1, "migration", migrations[version].name)
+		if err := migrations[version].run(b.database); err != nil {
+			b.logger.Error("Database migration failed", "version", version+1, "err", err)
+			return err
+		}
+		if err := storeSchemaVersion(b.database, version+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeSchemaVersion persists the schema version of the database.
+func storeSchemaVersion(db *leveldb.DB, version uint64) error {
+	blob := make([]byte, 8)
+	binary.BigEndian.PutUint64(blob, version)
+
+	return db.Put(dbSchemaKey, blob, &opt.WriteOptions{Sync: true})
+}
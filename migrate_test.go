@@ -0,0 +1,99 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// newTestMigrations creates a list of migrations that count how many times
+// each was run.
+func newTestMigrations(n int) ([]migration, []int) {
+	var (
+		migs = make([]migration, n)
+		runs = make([]int, n)
+	)
+	for i := 0; i < n; i++ {
+		i := i
+		migs[i] = migration{name: "test", run: func(db *leveldb.DB) error {
+			runs[i]++
+			return nil
+		}}
+	}
+	return migs, runs
+}
+
+// testSchemaVersion retrieves the schema version stored in the database.
+func testSchemaVersion(t *testing.T, backend *Backend) uint64 {
+	blob, err := backend.database.Get(dbSchemaKey, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve schema version: %v", err)
+	}
+	return binary.BigEndian.Uint64(blob)
+}
+
+// Tests that a brand new database is tagged with the latest schema without
+// running any migrations.
+func TestMigrateFreshDatabase(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	migs, runs := newTestMigrations(3)
+	if err := backend.migrateDatabase(migs); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	if version := testSchemaVersion(t, backend); version != 3 {
+		t.Fatalf("schema version mismatch: have %d, want %d", version, 3)
+	}
+	for i, n := range runs {
+		if n != 0 {
+			t.Errorf("migration %d: run count mismatch: have %d, want %d", i, n, 0)
+		}
+	}
+}
+
+// Tests that a database from before schema tracking gets all migrations applied
+// exactly once, and that newly added migrations are picked up incrementally.
+func TestMigrateLegacyDatabase(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	if err := backend.database.Put(dbProfileKey, []byte("{}"), nil); err != nil {
+		t.Fatalf("failed to store legacy profile: %v", err)
+	}
+	migs, runs := newTestMigrations(3)
+	for i := 0; i < 2; i++ {
+		if err := backend.migrateDatabase(migs[:2]); err != nil {
+			t.Fatalf("failed to migrate database: %v", err)
+		}
+	}
+	if err := backend.migrateDatabase(migs); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	if version := testSchemaVersion(t, backend); version != 3 {
+		t.Fatalf("schema version mismatch: have %d, want %d", version, 3)
+	}
+	for i, n := range runs {
+		if n != 1 {
+			t.Errorf("migration %d: run count mismatch: have %d, want %d", i, n, 1)
+		}
+	}
+}
+
+// Tests that a database created by a newer version is rejected.
+func TestMigrateNewerDatabase(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	migs, _ := newTestMigrations(3)
+	if err := backend.migrateDatabase(migs); err != nil {
+		t.Fatalf("failed to migrate database: %v", err)
+	}
+	if err := backend.migrateDatabase(migs[:2]); err != ErrSchemaUnsupported {
+		t.Fatalf("newer schema error mismatch: have %v, want %v", err, ErrSchemaUnsupported)
+	}
+}
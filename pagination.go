@@ -0,0 +1,65 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"errors"
+
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ErrInvalidPageLimit is returned if a listing page is requested with a size
+// that is not positive or exceeds the maximum permitted.
+var ErrInvalidPageLimit = errors.New("invalid page limit")
+
+// ContactsPage retrieves a page of the contacts of the local user, ordered by
+// their unique id. The listing starts after the given cursor (empty for the
+// first page) and the cursor of the next page is returned (empty if there are
+// no more contacts).
+func (b *Backend) ContactsPage(cursor string, limit int) ([]tornet.IdentityFingerprint, string, error) {
+	if _, err := b.Profile(); err != nil {
+		return nil, "", ErrProfileNotFound
+	}
+	return b.listPage(dbContactPrefix, cursor, limit)
+}
+
+// HostedEventsPage retrieves a page of the locally hosted events, ordered by
+// their unique id. The cursor semantics are the same as for ContactsPage.
+func (b *Backend) HostedEventsPage(cursor string, limit int) ([]tornet.IdentityFingerprint, string, error) {
+	return b.listPage(dbHostedEventPrefix, cursor, limit)
+}
+
+// JoinedEventsPage retrieves a page of the remotely joined events, ordered by
+// their unique id. The cursor semantics are the same as for ContactsPage.
+func (b *Backend) JoinedEventsPage(cursor string, limit int) ([]tornet.IdentityFingerprint, string, error) {
+	return b.listPage(dbJoinedEventPrefix, cursor, limit)
+}
+
+// listPage iterates over the entities stored under a database prefix in key
+// order, returning the ids of at most limit of them, starting after the cursor.
+//
+// The cursor is the last id of the previous page, so deleting entities between
+// two page requests (even the one the cursor points to) can neither skip nor
+// duplicate any of the remaining ones.
+func (b *Backend) listPage(prefix []byte, cursor string, limit int) ([]tornet.IdentityFingerprint, string, error) {
+	if limit <= 0 || limit > pageMaxLimit {
+		return nil, "", ErrInvalidPageLimit
+	}
+	span := util.BytesPrefix(prefix)
+	if cursor != "" {
+		span.Start = append(append(append([]byte{}, prefix...), cursor...), 0x00)
+	}
+	it := b.database.NewIterator(span, nil)
+	defer it.Release()
+
+	ids := []tornet.IdentityFingerprint{} // Need explicit init for JSON!
+	for it.Next() {
+		if len(ids) == limit {
+			return ids, string(ids[len(ids)-1]), nil
+		}
+		ids = append(ids, tornet.IdentityFingerprint(it.Key()[len(prefix):]))
+	}
+	return ids, "", it.Error()
+}
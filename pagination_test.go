@@ -0,0 +1,58 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that listings can be paginated in key order, and that deletions between
+// two page requests neither skip nor duplicate any of the remaining entries.
+func TestListPagination(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	for _, id := range []string{"e", "a", "c", "b", "d"} {
+		if err := backend.database.Put(append(dbHostedEventPrefix, id...), []byte("{}"), nil); err != nil {
+			t.Fatalf("failed to store event %s: %v", id, err)
+		}
+	}
+	// Ensure invalid page sizes are rejected
+	for _, limit := range []int{-1, 0, pageMaxLimit + 1} {
+		if _, _, err := backend.HostedEventsPage("", limit); err != ErrInvalidPageLimit {
+			t.Fatalf("limit %d error mismatch: have %v, want %v", limit, err, ErrInvalidPageLimit)
+		}
+	}
+	// Retrieve the first page and delete the cursor entry and one ahead of it
+	page, next, err := backend.HostedEventsPage("", 2)
+	if err != nil {
+		t.Fatalf("failed to retrieve first page: %v", err)
+	}
+	if want := []tornet.IdentityFingerprint{"a", "b"}; !reflect.DeepEqual(page, want) || next != "b" {
+		t.Fatalf("first page mismatch: have %v/%q, want %v/%q", page, next, want, "b")
+	}
+	for _, id := range []string{"b", "d"} {
+		if err := backend.database.Delete(append(dbHostedEventPrefix, id...), nil); err != nil {
+			t.Fatalf("failed to delete event %s: %v", id, err)
+		}
+	}
+	// Retrieve the remainder and ensure nothing is skipped or duplicated
+	page, next, err = backend.HostedEventsPage(next, 2)
+	if err != nil {
+		t.Fatalf("failed to retrieve second page: %v", err)
+	}
+	if want := []tornet.IdentityFingerprint{"c", "e"}; !reflect.DeepEqual(page, want) || next != "" {
+		t.Fatalf("second page mismatch: have %v/%q, want %v/%q", page, next, want, "")
+	}
+	// Ensure other listings are unaffected and contacts need a local user
+	if page, next, err = backend.JoinedEventsPage("", 2); err != nil || len(page) != 0 || next != "" {
+		t.Fatalf("joined page mismatch: have %v/%q (err %v), want empty", page, next, err)
+	}
+	if _, _, err := backend.ContactsPage("", 2); err != ErrProfileNotFound {
+		t.Fatalf("contacts error mismatch: have %v, want %v", err, ErrProfileNotFound)
+	}
+}
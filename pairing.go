@@ -24,6 +24,10 @@ var (
 	// ErrNotPairing is returned if a pairing session is attempted to be joined,
 	// but none is in progress.
 	ErrNotPairing = errors.New("not pairing")
+
+	// ErrPairingExpired is returned if an initiated pairing session was waited
+	// on, but nobody joined it within the allowed time.
+	ErrPairingExpired = errors.New("pairing expired")
 )
 
 // InitPairing initiates a new pairing session over Tor.
@@ -75,7 +79,7 @@ func (b *Backend) InitPairing() (tornet.SecretIdentity, tornet.PublicAddress, er
 		Identity: profile.KeyRing.Identity.Public(),
 		Address:  profile.KeyRing.Addresses[len(profile.KeyRing.Addresses)-1].Public(),
 	}
-	pairer, secret, address, err := pairing.NewServer(tornet.NewTorGateway(b.network), keyring, b.logger)
+	pairer, secret, address, err := pairing.NewServer(b.torGateway(), keyring, pairingSessionTimeout, b.logger)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -83,14 +87,15 @@ func (b *Backend) InitPairing() (tornet.SecretIdentity, tornet.PublicAddress, er
 	return secret, address, nil
 }
 
-// WaitPairing blocks until an already initiated pairing session is joined.
-func (b *Backend) WaitPairing() (tornet.IdentityFingerprint, error) {
+// WaitPairing blocks until an already initiated pairing session is joined. If
+// the context is cancelled, the pairing session is aborted.
+func (b *Backend) WaitPairing(ctx context.Context) (tornet.IdentityFingerprint, error) {
 	b.logger.Info("Waiting for pairing session")
 
 	// Ensure there is a pairing session ongoing
 	b.lock.Lock()
-	pairing := b.pairing
-	if pairing == nil {
+	pairer := b.pairing
+	if pairer == nil {
 		b.lock.Unlock()
 		return "", ErrNotPairing
 	} else {
@@ -99,15 +104,22 @@ func (b *Backend) WaitPairing() (tornet.IdentityFingerprint, error) {
 	b.lock.Unlock()
 
 	// Pairing session in progress, wait for it and tear it down
-	contact, err := pairing.Wait(context.TODO())
+	contact, err := pairer.Wait(ctx)
+	if err == pairing.ErrExpired {
+		return "", ErrPairingExpired
+	}
 	if err != nil {
-		return "", nil
+		return "", err
 	}
-	return b.AddContact(contact)
+	return b.addPairedContact(pairer, contact)
 }
 
 // JoinPairing joins a remotely initiated pairing session.
 func (b *Backend) JoinPairing(secret tornet.SecretIdentity, address tornet.PublicAddress) (tornet.IdentityFingerprint, error) {
+	// Reject malformed secrets before they get logged or dialed
+	if err := tornet.ValidatePairingSecret(secret, address); err != nil {
+		return "", err
+	}
 	b.logger.Info("Joining pairing session", "address", address.Fingerprint(), "identity", secret.Fingerprint())
 
 	// Ensure there's a profile to pair and a network to go through
@@ -115,6 +127,13 @@ func (b *Backend) JoinPairing(secret tornet.SecretIdentity, address tornet.Publi
 	if err != nil {
 		return "", err
 	}
+	// Ensure nobody's joining the same session and we're not hammering Tor
+	release, err := b.startJoin("pairing-" + string(address.Fingerprint()))
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
 	online, connected, _, _, err := b.GatewayStatus()
 	if err != nil {
 		return "", err
@@ -148,7 +167,7 @@ func (b *Backend) JoinPairing(secret tornet.SecretIdentity, address tornet.Publi
 		Identity: profile.KeyRing.Identity.Public(),
 		Address:  profile.KeyRing.Addresses[len(profile.KeyRing.Addresses)-1].Public(),
 	}
-	pairer, err := pairing.NewClient(tornet.NewTorGateway(b.network), keyring, secret, address, b.logger)
+	pairer, err := pairing.NewClient(b.gateway(), keyring, secret, address, b.logger)
 	if err != nil {
 		return "", err
 	}
@@ -157,7 +176,50 @@ func (b *Backend) JoinPairing(secret tornet.SecretIdentity, address tornet.Publi
 		return "", err
 	}
 	// Pairing succeeded, start tracking the contact
-	return b.AddContact(contact)
+	return b.addPairedContact(pairer, contact)
 }
 
-// TODO(karalabe): AbortPairing, otherwise we end up in a weird place
+// addPairedContact is invoked after a pairing session (either initiated or
+// joined) completes successfully. It injects the remote keyring as a contact
+// and notifies any listeners of the new pairing.
+func (b *Backend) addPairedContact(session *pairing.Pairing, keyring tornet.RemoteKeyRing) (tornet.IdentityFingerprint, error) {
+	b.lock.Lock()
+	b.paired = session
+	b.lock.Unlock()
+
+	uid, err := b.AddContact(keyring)
+	if err != nil {
+		return uid, err
+	}
+	b.feed.publish(Event{Kind: EventPairingCompleted, Contact: uid})
+	return uid, nil
+}
+
+// PairingSAS returns the short authentication string of the last completed
+// pairing session, which the users should compare out of band to verify that
+// nobody intercepted the identity exchange.
+func (b *Backend) PairingSAS() (string, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	if b.paired == nil {
+		return "", ErrNotPairing
+	}
+	return b.paired.SAS()
+}
+
+// AbortPairing tears down an initiated pairing session that nobody is waiting
+// on yet. Without it, an abandoned session would block initiating any new ones.
+func (b *Backend) AbortPairing() error {
+	b.logger.Info("Aborting pairing session")
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.pairing == nil {
+		return ErrNotPairing
+	}
+	b.pairing.Close()
+	b.pairing = nil
+	return nil
+}
@@ -0,0 +1,303 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols/pairing"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that completing a pairing session notifies both the initiating and the
+// joining side about the new contact.
+func TestPairingCompletedEvent(t *testing.T) {
+	// Create two independent users to pair with each other
+	initer := newTestBackend(t)
+	defer initer.database.Close()
+	newTestProfile(t, initer, tornet.NewMockGateway())
+	defer initer.dialer.close()
+	defer initer.overlay.Close()
+
+	joiner := newTestBackend(t)
+	defer joiner.database.Close()
+	newTestProfile(t, joiner, tornet.NewMockGateway())
+	defer joiner.dialer.close()
+	defer joiner.overlay.Close()
+
+	initSub, initUnsub := initer.Subscribe()
+	defer initUnsub()
+	joinSub, joinUnsub := joiner.Subscribe()
+	defer joinUnsub()
+
+	// Run a pairing session between the two users
+	initProf, _ := initer.Profile()
+	joinProf, _ := joiner.Profile()
+
+	initRemote := tornet.RemoteKeyRing{
+		Identity: initProf.KeyRing.Identity.Public(),
+		Address:  initProf.KeyRing.Addresses[0].Public(),
+	}
+	joinRemote := tornet.RemoteKeyRing{
+		Identity: joinProf.KeyRing.Identity.Public(),
+		Address:  joinProf.KeyRing.Addresses[0].Public(),
+	}
+	gateway := tornet.NewMockGateway()
+
+	initPairing, secret, address, err := pairing.NewServer(gateway, initRemote, 0, initer.logger)
+	if err != nil {
+		t.Fatalf("failed to initiate pairing: %v", err)
+	}
+	joinPairing, err := pairing.NewClient(gateway, joinRemote, secret, address, joiner.logger)
+	if err != nil {
+		t.Fatalf("failed to join pairing: %v", err)
+	}
+	initContact, err := initPairing.Wait(context.TODO())
+	if err != nil {
+		t.Fatalf("initer side pairing failed: %v", err)
+	}
+	joinContact, err := joinPairing.Wait(context.TODO())
+	if err != nil {
+		t.Fatalf("joiner side pairing failed: %v", err)
+	}
+	// Add the paired contacts and ensure both sides get notified
+	if _, err := initer.addPairedContact(initPairing, initContact); err != nil {
+		t.Fatalf("failed to add contact on initer side: %v", err)
+	}
+	if _, err := joiner.addPairedContact(joinPairing, joinContact); err != nil {
+		t.Fatalf("failed to add contact on joiner side: %v", err)
+	}
+	for _, test := range []struct {
+		side    string
+		sub     <-chan Event
+		contact tornet.IdentityFingerprint
+	}{
+		{"initer", initSub, joinRemote.Identity.Fingerprint()},
+		{"joiner", joinSub, initRemote.Identity.Fingerprint()},
+	} {
+	wait:
+		for {
+			select {
+			case event := <-test.sub:
+				if event.Kind == EventContactAdded {
+					continue // Trusting the contact is announced separately
+				}
+				if event.Kind != EventPairingCompleted {
+					t.Errorf("%s: event kind mismatch: have %v, want %v", test.side, event.Kind, EventPairingCompleted)
+				}
+				if event.Contact != test.contact {
+					t.Errorf("%s: event contact mismatch: have %v, want %v", test.side, event.Contact, test.contact)
+				}
+				break wait
+			case <-time.After(time.Second):
+				t.Errorf("%s: pairing completion event timed out", test.side)
+				break wait
+			}
+		}
+	}
+	// Wait for the keyrings to be persisted to avoid racing the teardown
+	for _, backend := range []*Backend{initer, joiner} {
+		for i := 0; ; i++ {
+			if contacts, _ := backend.Contacts(); len(contacts) == 1 {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("contact not persisted into keyring")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// Tests that waiting for a pairing session can be aborted via the context, and
+// that the aborted session is torn down.
+func TestWaitPairingCancellation(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+	newTestProfile(t, backend, tornet.NewMockGateway())
+	defer backend.dialer.close()
+	defer backend.overlay.Close()
+
+	// Inject a pairing session that nobody will ever join
+	prof, _ := backend.Profile()
+	self := tornet.RemoteKeyRing{
+		Identity: prof.KeyRing.Identity.Public(),
+		Address:  prof.KeyRing.Addresses[0].Public(),
+	}
+	session, _, _, err := pairing.NewServer(tornet.NewMockGateway(), self, 0, backend.logger)
+	if err != nil {
+		t.Fatalf("failed to initiate pairing: %v", err)
+	}
+	backend.pairing = session
+
+	// Wait for the pairing in the background and abort it
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := backend.WaitPairing(ctx)
+		errc <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatalf("cancelled pairing succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("pairing wait not aborted")
+	}
+	if _, err := backend.WaitPairing(context.Background()); err != ErrNotPairing {
+		t.Fatalf("post-cancel wait error mismatch: have %v, want %v", err, ErrNotPairing)
+	}
+}
+
+// Tests that an initiated pairing session can be aborted, after which there is
+// nothing left to wait on or abort.
+func TestAbortPairing(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+	newTestProfile(t, backend, tornet.NewMockGateway())
+	defer backend.dialer.close()
+	defer backend.overlay.Close()
+
+	if err := backend.AbortPairing(); err != ErrNotPairing {
+		t.Fatalf("idle abort error mismatch: have %v, want %v", err, ErrNotPairing)
+	}
+	// Inject a pairing session that nobody will ever join and abort it
+	prof, _ := backend.Profile()
+	self := tornet.RemoteKeyRing{
+		Identity: prof.KeyRing.Identity.Public(),
+		Address:  prof.KeyRing.Addresses[0].Public(),
+	}
+	session, _, _, err := pairing.NewServer(tornet.NewMockGateway(), self, 0, backend.logger)
+	if err != nil {
+		t.Fatalf("failed to initiate pairing: %v", err)
+	}
+	backend.pairing = session
+
+	if err := backend.AbortPairing(); err != nil {
+		t.Fatalf("failed to abort pairing: %v", err)
+	}
+	if err := backend.AbortPairing(); err != ErrNotPairing {
+		t.Fatalf("repeated abort error mismatch: have %v, want %v", err, ErrNotPairing)
+	}
+	if _, err := backend.WaitPairing(context.Background()); err != ErrNotPairing {
+		t.Fatalf("post-abort wait error mismatch: have %v, want %v", err, ErrNotPairing)
+	}
+}
+
+// Tests that an initiated pairing session nobody joins expires on its own, and
+// that waiting on it afterwards reports the expiry.
+func TestWaitPairingExpiry(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+	newTestProfile(t, backend, tornet.NewMockGateway())
+	defer backend.dialer.close()
+	defer backend.overlay.Close()
+
+	// Inject a short lived pairing session that nobody will ever join
+	prof, _ := backend.Profile()
+	self := tornet.RemoteKeyRing{
+		Identity: prof.KeyRing.Identity.Public(),
+		Address:  prof.KeyRing.Addresses[0].Public(),
+	}
+	session, _, _, err := pairing.NewServer(tornet.NewMockGateway(), self, 50*time.Millisecond, backend.logger)
+	if err != nil {
+		t.Fatalf("failed to initiate pairing: %v", err)
+	}
+	backend.pairing = session
+
+	// Wait only after the session expired, ensure the expiry is reported
+	time.Sleep(100 * time.Millisecond)
+	if _, err := backend.WaitPairing(context.Background()); err != ErrPairingExpired {
+		t.Fatalf("expired wait error mismatch: have %v, want %v", err, ErrPairingExpired)
+	}
+	if _, err := backend.WaitPairing(context.Background()); err != ErrNotPairing {
+		t.Fatalf("post-expiry wait error mismatch: have %v, want %v", err, ErrNotPairing)
+	}
+}
+
+// Tests that concurrent joins of the same pairing session are rejected while one
+// is in progress, and that joins in general are rate limited.
+func TestJoinPairingConcurrent(t *testing.T) {
+	// Slow down the network so that the pairing takes a while to complete
+	gateway := tornet.NewMockGatewayWithConditions(tornet.MockConditions{Latency: 50 * time.Millisecond})
+
+	initer := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(initer.datadir)
+	defer initer.Close()
+
+	joiner := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(joiner.datadir)
+	defer joiner.Close()
+
+	for _, backend := range []*Backend{initer, joiner} {
+		if err := backend.CreateProfile(); err != nil {
+			t.Fatalf("failed to create profile: %v", err)
+		}
+		if err := backend.EnableGateway(); err != nil {
+			t.Fatalf("failed to enable gateway: %v", err)
+		}
+	}
+	secret, address, err := initer.InitPairing()
+	if err != nil {
+		t.Fatalf("failed to initiate pairing: %v", err)
+	}
+	go initer.WaitPairing(context.Background())
+
+	// Fire a batch of concurrent joins and ensure only one proceeds
+	errc := make(chan error, 10)
+	for i := 0; i < cap(errc); i++ {
+		go func() {
+			_, err := joiner.JoinPairing(secret, address)
+			errc <- err
+		}()
+	}
+	var joined, rejected int
+	for i := 0; i < cap(errc); i++ {
+		switch err := <-errc; err {
+		case nil:
+			joined++
+		case ErrJoinInProgress:
+			rejected++
+		default:
+			t.Errorf("unexpected join error: %v", err)
+		}
+	}
+	if joined != 1 || rejected != cap(errc)-1 {
+		t.Fatalf("join outcome mismatch: have %d joined, %d rejected, want %d joined, %d rejected", joined, rejected, 1, cap(errc)-1)
+	}
+	// Wait for the keyrings to be persisted to avoid racing the teardown
+	for _, backend := range []*Backend{initer, joiner} {
+		for i := 0; ; i++ {
+			if prof, _ := backend.Profile(); len(prof.KeyRing.Trusted) == 1 {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("contact not persisted into keyring")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// Ensure too many joins get throttled
+	for i := 1; i < joinRateLimit; i++ {
+		release, err := joiner.startJoin(fmt.Sprintf("test-%d", i))
+		if err != nil {
+			t.Fatalf("join %d: failed to start: %v", i, err)
+		}
+		release()
+	}
+	if _, err := joiner.startJoin("test-throttled"); err != ErrJoinThrottled {
+		t.Fatalf("throttled join error mismatch: have %v, want %v", err, ErrJoinThrottled)
+	}
+	if _, err := joiner.JoinPairing(secret, address); err != ErrJoinThrottled {
+		t.Fatalf("throttled pairing error mismatch: have %v, want %v", err, ErrJoinThrottled)
+	}
+}
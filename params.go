@@ -7,18 +7,176 @@ import "time"
 
 const (
 	// connectionIdleTimeout is the maximum amount of time for a connection to
-	// remain idle before it is torn down (to save bandwidth and battery).
+	// remain idle before it is torn down (to save bandwidth and battery). Any
+	// exchanged data resets it, so active conversations are never cut.
 	connectionIdleTimeout = 5 * time.Minute
 
+	// connectionKeepalive is the interval between liveness pings sent to contacts
+	// to detect silently dead Tor circuits. A contact not answering anything for
+	// two intervals is dropped.
+	connectionKeepalive = time.Minute
+
+	// contactSeenDebounce is the minimum time between two persisted updates of a
+	// contact's last seen timestamp, to avoid a flapping connection thrashing the
+	// database.
+	contactSeenDebounce = 5 * time.Minute
+
 	// schedulerSanityRedial is the time to wait before redialing a peer if no
 	// event happens in between.
 	schedulerSanityRedial = 24 * time.Hour
 
 	// schedulerFailureRedial is the time to wait before redialing a peer which
-	// was unreachable the last time we dialed.
+	// was unreachable the last time we dialed. It is scaled by the reliability
+	// of the peer, reliable ones being retried sooner, flaky ones later.
 	schedulerFailureRedial = time.Hour
 
+	// schedulerFailureBackoff is the maximum factor by which the failure redial
+	// time is shortened for fully reliable peers or lengthened for fully broken
+	// ones.
+	schedulerFailureBackoff = 4.0
+
+	// schedulerReliabilityInitial is the reliability score assumed for peers not
+	// yet dialed (neither reliable, nor unreliable).
+	schedulerReliabilityInitial = 0.5
+
+	// schedulerReliabilityWeight is the weight of the latest dial outcome in the
+	// exponential moving average tracking the reliability of a peer.
+	schedulerReliabilityWeight = 0.25
+
 	// schedulerProfileUpdate is the time to wait before dialing someone to push
 	// over a profile update.
 	schedulerProfileUpdate = 6 * time.Hour
+
+	// schedulerMessageDelivery is the time to wait before dialing someone to push
+	// over a queued up text message.
+	schedulerMessageDelivery = time.Minute
+
+	// refreshCooldown is the minimum time to wait between two explicit refreshes
+	// of all contacts and events, to avoid callers storming the Tor network.
+	refreshCooldown = 30 * time.Second
+
+	// contactSyncCoalesce is the time window within which repeated explicit sync
+	// requests to the same contact are merged into the already scheduled dial.
+	contactSyncCoalesce = 10 * time.Second
+
+	// avatarRequestThrottle is the minimum time to wait between two consecutive
+	// avatar requests to the same contact, to avoid flapping peers causing large
+	// transfer storms.
+	avatarRequestThrottle = time.Minute
+
+	// avatarRequestTimeout is the time after which an unanswered avatar request
+	// is considered lost and may be reissued.
+	avatarRequestTimeout = 5 * time.Minute
+
+	// identityMigrationWindow is the maximum clock difference tolerated on the
+	// timestamp of an identity migration announcement. Announcements are signed
+	// anew on every connection, so anything older is treated as a replay.
+	identityMigrationWindow = time.Hour
+
+	// profileMoodMaxLength is the maximum number of bytes permitted in the free
+	// form mood message of a user profile.
+	profileMoodMaxLength = 140
+
+	// contactNoteMaxLength is the maximum number of bytes permitted in the local
+	// verification note attached to a contact.
+	contactNoteMaxLength = 1024
+
+	// messageMaxLength is the maximum number of bytes permitted in a single text
+	// message exchanged between contacts.
+	messageMaxLength = 1024
+
+	// messageMaxAttachment is the maximum number of bytes permitted in a single
+	// attachment of a message exchanged between contacts.
+	messageMaxAttachment = 512 * 1024
+
+	// broadcastCoalesceWindow is the time to wait before broadcasting a message
+	// to allow subsequent updates of the same type to be merged into one.
+	broadcastCoalesceWindow = 500 * time.Millisecond
+
+	// cdnCompressionThreshold is the minimum size of a CDN blob before attempting
+	// to compress it. Tiny blobs aren't worth the hassle.
+	cdnCompressionThreshold = 1024
+
+	// cdnCompressionMinSaving is the fraction (1/N) of the original size that the
+	// compression needs to save for the compressed version to be stored.
+	cdnCompressionMinSaving = 8
+
+	// cdnThumbnailSize is the maximum width and height of the thumbnails generated
+	// for avatars and banners.
+	cdnThumbnailSize = 128
+
+	// cdnThumbnailQuality is the JPEG quality used to encode generated thumbnails.
+	cdnThumbnailQuality = 80
+
+	// cdnThumbnailMaxPixels is the maximum number of pixels an image may have for
+	// a thumbnail to be generated, to avoid decompression bombs eating up memory.
+	cdnThumbnailMaxPixels = 4096 * 4096
+
+	// feedSubscriptionBuffer is the number of events to queue up for a slow
+	// subscriber before starting to drop the oldest ones.
+	feedSubscriptionBuffer = 64
+
+	// eventSweepInterval is the time period to check hosted events for signs of
+	// abandonment.
+	eventSweepInterval = 10 * time.Minute
+
+	// eventReopenGrace is the time period after terminating an event, within
+	// which it can still be reopened (e.g. if it was terminated by accident).
+	eventReopenGrace = 24 * time.Hour
+
+	// eventHistoryInterval is the default minimum time between two persisted
+	// snapshots of a hosted event's stats, bounding the size of its history.
+	eventHistoryInterval = time.Hour
+
+	// eventBannerRetries is the number of consecutive times loading the banner of
+	// a hosted event may fail before a placeholder is served in its stead, so a
+	// lost image doesn't prevent guests from ever receiving the event metadata.
+	eventBannerRetries = 3
+
+	// eventRecurrenceMin is the shortest recurrence period allowed for scheduled
+	// events, to avoid spinning up a new event server every few seconds.
+	eventRecurrenceMin = time.Hour
+
+	// joinRateLimit is the maximum number of remote pairing and checkin sessions
+	// that may be joined within a rate window, to avoid a misbehaving frontend
+	// spawning dials that fight over Tor circuits.
+	joinRateLimit = 10
+
+	// joinRateWindow is the time period within which the number of joins of
+	// remote pairing and checkin sessions is limited.
+	joinRateWindow = time.Minute
+
+	// pairingSessionTimeout is the time after which an initiated pairing session
+	// expires if nobody joins it, so that abandoned QR codes can't be scanned
+	// long after they were displayed.
+	pairingSessionTimeout = 5 * time.Minute
+
+	// supervisorCheckInterval is the time between two consecutive health checks
+	// of the Tor gateway.
+	supervisorCheckInterval = 30 * time.Second
+
+	// supervisorFailureThreshold is the number of consecutive failed health checks
+	// after which the Tor gateway is considered dead or stuck and is restarted.
+	supervisorFailureThreshold = 3
+
+	// supervisorRestartBackoff is the minimum time to wait between two restarts
+	// of the Tor gateway. It is doubled after each restart, so a gateway that
+	// can't recover (e.g. no internet at all) doesn't end up in a restart loop.
+	supervisorRestartBackoff = time.Minute
+
+	// supervisorRestartBackoffMax is the maximum time to wait between two restarts
+	// of the Tor gateway.
+	supervisorRestartBackoffMax = 30 * time.Minute
+
+	// livenessResubscribeDelay is the time to wait before resubscribing to the
+	// network liveness events of Tor if the subscription fails or breaks.
+	livenessResubscribeDelay = 5 * time.Second
+
+	// pageMaxLimit is the maximum number of entries a single page of a listing
+	// may contain.
+	pageMaxLimit = 1000
+
+	// healthProbeTimeout is the maximum time to wait for the Tor control port to
+	// answer a health probe before deeming it unresponsive.
+	healthProbeTimeout = 2 * time.Second
 )
@@ -23,6 +23,10 @@ const (
 	// InfectionStatusPositive is the constant representing a successful test
 	// resulting in positive outcome.
 	InfectionStatusPositive = "positive"
+
+	// InfectionStatusRecovered is the constant representing a confirmed infection
+	// that the user has since recovered from.
+	InfectionStatusRecovered = "recovered"
 )
 
 const (
@@ -43,4 +47,19 @@ const (
 	// maintenance period expires. After this time expires, all data associated
 	// with the event is deleted.
 	EventArchivePeriod = 30 * 24 * time.Hour
+
+	// EventInactivityReminder is the time after which the organizer is reminded
+	// to terminate a hosted event that has not seen any checkins or reports.
+	EventInactivityReminder = 12 * time.Hour
+
+	// EventInactivityTermination is the time after which a hosted event that has
+	// not seen any checkins or reports is automatically terminated.
+	EventInactivityTermination = 3 * 24 * time.Hour
+)
+
+const (
+	// MaxImageBytes is the maximum size of an image (avatar or event banner) that
+	// is accepted for storage, either uploaded locally or received from remote
+	// peers.
+	MaxImageBytes = 4 * 1024 * 1024
 )
@@ -0,0 +1,305 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	// dbScheduledEventPrefix is the database key for storing the template of a
+	// scheduled (potentially recurring) hosted event.
+	dbScheduledEventPrefix = []byte("scheduled-")
+
+	// ErrScheduleNotFound is returned if a scheduled event is attempted to be
+	// accessed but it is not found.
+	ErrScheduleNotFound = errors.New("scheduled event not found")
+
+	// ErrInvalidSchedule is returned if an event is attempted to be scheduled
+	// without a start time or with a too frequent recurrence.
+	ErrInvalidSchedule = errors.New("invalid event schedule")
+)
+
+// ScheduledEvent is the template of a hosted event which is to be created at a
+// future time, and optionally re-created periodically.
+type ScheduledEvent struct {
+	Name        string                     `json:"name"`
+	Description string                     `json:"description,omitempty"`
+	Location    string                     `json:"location,omitempty"`
+	Start       time.Time                  `json:"start"`              // Next time an instance is to be created
+	Every       time.Duration              `json:"every,omitempty"`    // Recurrence period (0 = one-off)
+	Instance    tornet.IdentityFingerprint `json:"instance,omitempty"` // Last created instance of the event
+}
+
+// ScheduleEvent stores a template for a hosted event to be created when its
+// start time arrives. If a recurrence period is given, the previous instance is
+// terminated and a fresh one is created every time the period elapses.
+func (b *Backend) ScheduleEvent(name string, description string, location string, start time.Time, every time.Duration) (string, error) {
+	b.logger.Info("Scheduling new event", "name", name, "location", location, "start", start, "every", every)
+
+	// The local user is a participant of all events, make sure it exists
+	if _, err := b.Profile(); err != nil {
+		return "", err
+	}
+	if start.IsZero() || every < 0 || (every > 0 && every < eventRecurrenceMin) {
+		return "", ErrInvalidSchedule
+	}
+	// Template seems valid, generate a random identifier and store it
+	var seed [16]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(seed[:])
+
+	blob, err := json.Marshal(&ScheduledEvent{
+		Name:        name,
+		Description: description,
+		Location:    location,
+		Start:       start,
+		Every:       every,
+	})
+	if err != nil {
+		return "", err
+	}
+	b.planner.lock.Lock()
+	err = b.database.Put(append(dbScheduledEventPrefix, id...), blob, nil)
+	b.planner.lock.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+	// Event template stored, make sure the planner picks it up
+	b.planner.reschedule()
+	return id, nil
+}
+
+// ScheduledEvents returns the unique ids of all the scheduled events templates.
+func (b *Backend) ScheduledEvents() []string {
+	ids := []string{} // Need explicit init for JSON!
+
+	it := b.database.NewIterator(util.BytesPrefix(dbScheduledEventPrefix), nil)
+	defer it.Release()
+
+	for it.Next() {
+		ids = append(ids, string(it.Key()[len(dbScheduledEventPrefix):]))
+	}
+	return ids
+}
+
+// ScheduledEvent retrieves the template of a scheduled event.
+func (b *Backend) ScheduledEvent(id string) (*ScheduledEvent, error) {
+	blob, err := b.database.Get(append(dbScheduledEventPrefix, id...), nil)
+	if err != nil {
+		return nil, ErrScheduleNotFound
+	}
+	template := new(ScheduledEvent)
+	if err := json.Unmarshal(blob, template); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// CancelScheduledEvent deletes the template of a scheduled event, preventing any
+// further instances from being created. An already running instance is left
+// untouched, it can be terminated separately.
+func (b *Backend) CancelScheduledEvent(id string) error {
+	b.logger.Info("Cancelling scheduled event", "id", id)
+
+	b.planner.lock.Lock()
+	defer b.planner.lock.Unlock()
+
+	key := append(dbScheduledEventPrefix, id...)
+	if ok, _ := b.database.Has(key, nil); !ok {
+		return ErrScheduleNotFound
+	}
+	return b.database.Delete(key, nil)
+}
+
+// spawnScheduledEvents creates an event instance for every scheduled template
+// that is due at the given time, returning the time when the next one is due,
+// or zero if none is pending.
+//
+// Templates are advanced (or deleted if one-off) and persisted before creating
+// the instances, so that a crash can never result in the same occurrence being
+// created twice. Missed occurrences are collapsed into a single instance.
+func (b *Backend) spawnScheduledEvents(now time.Time, gateway tornet.Gateway) time.Time {
+	// If the events are not running (no profile), don't spawn anything. Starting
+	// them up will reschedule the planner.
+	b.lock.RLock()
+	running := b.hosted != nil
+	b.lock.RUnlock()
+
+	if !running {
+		return time.Time{}
+	}
+	b.planner.lock.Lock()
+	defer b.planner.lock.Unlock()
+
+	var next time.Time
+	for _, id := range b.ScheduledEvents() {
+		template, err := b.ScheduledEvent(id)
+		if err != nil {
+			b.logger.Error("Failed to retrieve scheduled event", "id", id, "err", err)
+			continue
+		}
+		if template.Start.After(now) {
+			if next.IsZero() || template.Start.Before(next) {
+				next = template.Start
+			}
+			continue
+		}
+		// Event template is due, advance or delete it before spawning anything
+		key := append(dbScheduledEventPrefix, id...)
+		if template.Every > 0 {
+			for !template.Start.After(now) {
+				template.Start = template.Start.Add(template.Every)
+			}
+			if next.IsZero() || template.Start.Before(next) {
+				next = template.Start
+			}
+			if err := b.putScheduledEvent(key, template); err != nil {
+				b.logger.Error("Failed to advance scheduled event", "id", id, "err", err)
+				continue
+			}
+		} else {
+			if err := b.database.Delete(key, nil); err != nil {
+				b.logger.Error("Failed to delete scheduled event", "id", id, "err", err)
+				continue
+			}
+		}
+		// Terminate the previous instance of a recurring event and start a new one
+		if template.Instance != "" {
+			switch err := b.TerminateEvent(template.Instance); err {
+			case nil, ErrEventNotFound, events.ErrEventConcluded:
+			default:
+				b.logger.Warn("Failed to terminate previous event instance", "id", id, "event", template.Instance, "err", err)
+			}
+		}
+		event, err := b.createEvent(template.Name, template.Description, template.Location, gateway)
+		if err != nil {
+			b.logger.Error("Failed to create scheduled event", "id", id, "err", err)
+			continue
+		}
+		if template.Every > 0 {
+			template.Instance = event
+			if err := b.putScheduledEvent(key, template); err != nil {
+				b.logger.Error("Failed to update scheduled event", "id", id, "err", err)
+			}
+		}
+		b.feed.publish(Event{
+			Kind:    EventHostedStarted,
+			Event:   event,
+			Message: fmt.Sprintf("%s started", template.Name),
+		})
+	}
+	return next
+}
+
+// putScheduledEvent stores a scheduled event template into the database.
+//
+// Note, this method assumes the planner lock is held.
+func (b *Backend) putScheduledEvent(key []byte, template *ScheduledEvent) error {
+	blob, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	return b.database.Put(key, blob, nil)
+}
+
+// planner is a background loop that waits for the start times of the scheduled
+// event templates and creates the hosted event instances when they are due.
+type planner struct {
+	backend *Backend              // Backend to spawn the events through
+	gateway func() tornet.Gateway // Gateway retriever to run the event servers through
+	clock   tornet.Clock          // Source of time to schedule the events by
+	lock    sync.Mutex            // Lock serializing template modifications
+
+	update     chan struct{}      // Planner channel when the templates change
+	teardown   chan chan struct{} // Planner channel when the system is terminating
+	terminated chan struct{}      // Termination channel to unblock any updates
+}
+
+// newPlanner creates a new event planner, spawning event servers through the
+// gateway returned by the given method.
+func newPlanner(backend *Backend, gateway func() tornet.Gateway) *planner {
+	clock := backend.config.Clock
+	if clock == nil {
+		clock = tornet.SystemClock
+	}
+	planner := &planner{
+		backend:    backend,
+		gateway:    gateway,
+		clock:      clock,
+		update:     make(chan struct{}, 1),
+		teardown:   make(chan chan struct{}),
+		terminated: make(chan struct{}),
+	}
+	go planner.loop()
+	return planner
+}
+
+// close terminates the event planner.
+func (p *planner) close() error {
+	closer := make(chan struct{})
+	p.teardown <- closer
+	<-closer
+
+	return nil
+}
+
+// reschedule notifies the planner that the templates or the backend state has
+// changed and it should recheck when the next event is due. The method never
+// blocks, so it's safe to call while holding the backend lock.
+func (p *planner) reschedule() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.update <- struct{}{}:
+	default:
+	}
+}
+
+// loop waits until the earliest scheduled event is due, spawns it and moves on
+// to the next one.
+func (p *planner) loop() {
+	// If termination is requested, notify anyone listening
+	defer close(p.terminated)
+
+	timer := p.clock.NewTimer(0)
+	for {
+		select {
+		case <-timer.C():
+			now := p.clock.Now()
+			if next := p.backend.spawnScheduledEvents(now, p.gateway()); !next.IsZero() {
+				p.backend.logger.Debug("Next event creation scheduled", "time", next.Sub(now))
+				timer.Reset(next.Sub(now))
+			}
+
+		case <-p.update:
+			if !timer.Stop() {
+				select {
+				case <-timer.C():
+				default:
+				}
+			}
+			timer.Reset(0)
+
+		case closer := <-p.teardown:
+			timer.Stop()
+			close(closer)
+			return
+		}
+	}
+}
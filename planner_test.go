@@ -0,0 +1,162 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that scheduled events are only created when their start time arrives,
+// that recurring ones terminate their previous instance and that rerunning the
+// planner (e.g. after a restart) doesn't duplicate already created instances.
+func TestScheduledEvents(t *testing.T) {
+	start := time.Date(2020, time.April, 1, 12, 0, 0, 0, time.UTC)
+	clock := tornet.NewSimulatedClock(start)
+	gateway := tornet.NewMockGateway()
+
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+	newTestReporter(t, backend)
+
+	backend.config.Clock = clock
+	backend.planner = newPlanner(backend, func() tornet.Gateway { return gateway })
+	defer backend.planner.close()
+
+	defer func() {
+		for _, server := range backend.hosted {
+			server.Close()
+		}
+	}()
+	feed, unsub := backend.Subscribe()
+	defer unsub()
+
+	// Ensure invalid schedules are rejected
+	if _, err := backend.ScheduleEvent("barbecue", "", "", time.Time{}, 0); err != ErrInvalidSchedule {
+		t.Fatalf("missing start error mismatch: have %v, want %v", err, ErrInvalidSchedule)
+	}
+	if _, err := backend.ScheduleEvent("barbecue", "", "", start, time.Minute); err != ErrInvalidSchedule {
+		t.Fatalf("frequent recurrence error mismatch: have %v, want %v", err, ErrInvalidSchedule)
+	}
+	// Schedule a recurring event and ensure nothing is created until it's due
+	id, err := backend.ScheduleEvent("barbecue", "", "", start.Add(time.Hour), 2*time.Hour)
+	if err != nil {
+		t.Fatalf("failed to schedule event: %v", err)
+	}
+	waitTestPlanner(t, clock)
+	if events := backend.HostedEvents(); len(events) != 0 {
+		t.Fatalf("premature events: have %v, want none", events)
+	}
+	// Advance to the start time and ensure an instance is created
+	clock.Run(time.Hour)
+	first := waitTestEventStarted(t, feed)
+
+	template, err := backend.ScheduledEvent(id)
+	if err != nil {
+		t.Fatalf("failed to retrieve scheduled event: %v", err)
+	}
+	if template.Instance != first {
+		t.Fatalf("instance mismatch: have %v, want %v", template.Instance, first)
+	}
+	if want := start.Add(3 * time.Hour); !template.Start.Equal(want) {
+		t.Fatalf("next start mismatch: have %v, want %v", template.Start, want)
+	}
+	// Rerun the planner at the same time and ensure nothing is duplicated
+	backend.spawnScheduledEvents(clock.Now(), gateway)
+	if events := backend.HostedEvents(); len(events) != 1 {
+		t.Fatalf("hosted events mismatch: have %d, want %d", len(events), 1)
+	}
+	// Advance to the next occurrence and ensure the previous one is terminated
+	waitTestPlanner(t, clock)
+	clock.Run(2 * time.Hour)
+	second := waitTestEventStarted(t, feed)
+
+	if second == first {
+		t.Fatalf("recurring instance not recreated")
+	}
+	infos, err := backend.HostedEvent(first)
+	if err != nil {
+		t.Fatalf("failed to retrieve previous instance: %v", err)
+	}
+	if infos.End == (time.Time{}) {
+		t.Fatalf("previous instance not terminated")
+	}
+	// Cancel the schedule and ensure the running instance is left alone
+	if err := backend.CancelScheduledEvent(id); err != nil {
+		t.Fatalf("failed to cancel scheduled event: %v", err)
+	}
+	if ids := backend.ScheduledEvents(); len(ids) != 0 {
+		t.Fatalf("scheduled events mismatch: have %v, want none", ids)
+	}
+	if err := backend.CancelScheduledEvent(id); err != ErrScheduleNotFound {
+		t.Fatalf("double cancel error mismatch: have %v, want %v", err, ErrScheduleNotFound)
+	}
+	if infos := backend.hosted[second].Infos(); infos.End != (time.Time{}) {
+		t.Fatalf("running instance terminated by cancellation")
+	}
+}
+
+// Tests that one-off scheduled events are deleted once their instance is created.
+func TestScheduledEventOneOff(t *testing.T) {
+	start := time.Date(2020, time.April, 1, 12, 0, 0, 0, time.UTC)
+	gateway := tornet.NewMockGateway()
+
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+	newTestReporter(t, backend)
+
+	backend.config.Clock = tornet.NewSimulatedClock(start)
+	backend.planner = newPlanner(backend, func() tornet.Gateway { return gateway })
+	defer backend.planner.close()
+
+	defer func() {
+		for _, server := range backend.hosted {
+			server.Close()
+		}
+	}()
+	if _, err := backend.ScheduleEvent("barbecue", "", "", start.Add(time.Hour), 0); err != nil {
+		t.Fatalf("failed to schedule event: %v", err)
+	}
+	if next := backend.spawnScheduledEvents(start, gateway); !next.Equal(start.Add(time.Hour)) {
+		t.Fatalf("next start mismatch: have %v, want %v", next, start.Add(time.Hour))
+	}
+	if next := backend.spawnScheduledEvents(start.Add(time.Hour), gateway); !next.IsZero() {
+		t.Fatalf("next start mismatch: have %v, want zero", next)
+	}
+	if events := backend.HostedEvents(); len(events) != 1 {
+		t.Fatalf("hosted events mismatch: have %d, want %d", len(events), 1)
+	}
+	if ids := backend.ScheduledEvents(); len(ids) != 0 {
+		t.Fatalf("scheduled events mismatch: have %v, want none", ids)
+	}
+}
+
+// waitTestPlanner waits until the planner arms its timer for the next event.
+func waitTestPlanner(t *testing.T, clock *tornet.SimulatedClock) {
+	for i := 0; i < 100; i++ {
+		if clock.Pending() > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("planner didn't schedule the next event")
+}
+
+// waitTestEventStarted waits for a scheduled event to be started, returning the
+// id of the created event.
+func waitTestEventStarted(t *testing.T, feed <-chan Event) tornet.IdentityFingerprint {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-feed:
+			if ev.Kind == EventHostedStarted {
+				return ev.Event
+			}
+		case <-timeout:
+			t.Fatalf("scheduled event not started")
+		}
+	}
+}
@@ -4,11 +4,14 @@
 package coronanet
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 
+	"github.com/coronanet/go-coronanet/params"
 	"github.com/coronanet/go-coronanet/protocols/corona"
 	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
@@ -16,6 +19,10 @@ var (
 	// dbProfileKey is the database key for storing the local user's profile.
 	dbProfileKey = []byte("profile")
 
+	// dbDeletingKey is the database marker signalling that a profile deletion is
+	// in progress. If found on startup, the deletion is resumed.
+	dbDeletingKey = []byte("deleting")
+
 	// ErrProfileNotFound is returned if the profile is attempted to be read from
 	// the database but it does not exist.
 	ErrProfileNotFound = errors.New("profile not found")
@@ -23,6 +30,10 @@ var (
 	// ErrProfileExists is returned if a new profile is attempted to be created
 	// but an old one already exists.
 	ErrProfileExists = errors.New("profile already exists")
+
+	// ErrMoodTooLong is returned if a profile mood message is attempted to be set
+	// that exceeds the permitted length.
+	ErrMoodTooLong = errors.New("mood too long")
 )
 
 // profile represents a local user's profile information, both public and private.
@@ -30,6 +41,7 @@ type profile struct {
 	KeyRing *tornet.SecretKeyRing `json:"keyring"`
 	Name    string                `json:"name`
 	Avatar  [32]byte              `json:"avatar"`
+	Mood    string                `json:"mood,omitempty"`
 }
 
 // CreateProfile generates a new cryptographic identity for the local user and
@@ -40,6 +52,14 @@ func (b *Backend) CreateProfile() error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
+	return b.createProfile()
+}
+
+// createProfile generates a new cryptographic identity for the local user within
+// the currently active profile namespace and starts up its overlay.
+//
+// Note, this method assumes the write lock is held.
+func (b *Backend) createProfile() error {
 	// Make sure there's no already existing user
 	if _, err := b.Profile(); err == nil {
 		return ErrProfileExists
@@ -55,7 +75,7 @@ func (b *Backend) CreateProfile() error {
 	if err != nil {
 		return err
 	}
-	if err := b.database.Put(dbProfileKey, blob, nil); err != nil {
+	if err := b.putSecret(dbProfileKey, blob); err != nil {
 		return err
 	}
 	return b.initOverlay(keyring)
@@ -73,19 +93,47 @@ func (b *Backend) DeleteProfile() error {
 	if err := b.nukeOverlay(); err != nil {
 		return err
 	}
+	// Mark the deletion as in progress so a crash can be recovered from
+	if err := b.database.Put(dbDeletingKey, []byte{}, &opt.WriteOptions{Sync: true}); err != nil {
+		return err
+	}
+	return b.wipeDatabase()
+}
+
+// wipeDatabase deletes everything from the database, leaving the deletion marker
+// to last, so that if interrupted, the next startup can resume the wipe. The
+// schema version is retained, since an empty database is on the latest schema,
+// as is the at-rest encryption setup, since the passphrase stays the same.
+func (b *Backend) wipeDatabase() error {
 	// Independent of what's in the database, nuke everything
 	it := b.database.NewIterator(&util.Range{nil, nil}, nil)
 	for it.Next() {
+		if bytes.Equal(it.Key(), dbDeletingKey) || bytes.Equal(it.Key(), dbSchemaKey) || bytes.Equal(it.Key(), dbVaultKey) {
+			continue
+		}
 		b.database.Delete(it.Key(), nil)
 	}
 	it.Release()
 
+	if err := b.database.Delete(dbDeletingKey, &opt.WriteOptions{Sync: true}); err != nil {
+		return err
+	}
 	return b.database.CompactRange(util.Range{nil, nil})
 }
 
+// recoverDeletion checks whether a previous profile deletion was interrupted
+// and if so, completes it.
+func (b *Backend) recoverDeletion() error {
+	if deleting, _ := b.database.Has(dbDeletingKey, nil); !deleting {
+		return nil
+	}
+	b.logger.Warn("Resuming interrupted profile deletion")
+	return b.wipeDatabase()
+}
+
 // Profile retrieves the current user's profile infos.
 func (b *Backend) Profile() (*profile, error) {
-	blob, err := b.database.Get(dbProfileKey, nil)
+	blob, err := b.getSecret(dbProfileKey)
 	if err != nil {
 		return nil, ErrProfileNotFound
 	}
@@ -96,6 +144,29 @@ func (b *Backend) Profile() (*profile, error) {
 	return prof, nil
 }
 
+// MyKeyring retrieves the public identity and the currently preferred address
+// of the local user, which others need to add them as a contact.
+//
+// The address is taken from the live overlay if it's running, since that tracks
+// any rotations before the profile is persisted.
+func (b *Backend) MyKeyring() (tornet.RemoteKeyRing, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	prof, err := b.Profile()
+	if err != nil {
+		return tornet.RemoteKeyRing{}, err
+	}
+	keyring := *prof.KeyRing
+	if b.overlay != nil {
+		keyring = b.overlay.KeyRing()
+	}
+	return tornet.RemoteKeyRing{
+		Identity: keyring.Identity.Public(),
+		Address:  keyring.Addresses[len(keyring.Addresses)-1].Public(),
+	}, nil
+}
+
 // updateKeyring is a callback method for the tornet Node to notify us whenever
 // the cryptographic keyring was modified to serialize it to disk.
 //
@@ -110,22 +181,41 @@ func (b *Backend) updateKeyring(keyring tornet.SecretKeyRing) {
 		b.logger.Info("Updating tornet keyring", "addresses", len(keyring.Addresses), "contacts", len(keyring.Trusted))
 
 		b.lock.Lock()
-		defer b.lock.Unlock()
 
+		// If the backend was torn down or the profile deleted meanwhile, there's
+		// nothing to update
+		if b.database == nil {
+			b.lock.Unlock()
+			return
+		}
 		prof, err := b.Profile()
 		if err != nil {
-			panic("keyring update without profile")
+			b.logger.Warn("Dropping keyring update without profile", "err", err)
+			b.lock.Unlock()
+			return
+		}
+		// Updates may be reordered, so persist the live keyring of the overlay
+		// if available to avoid overwriting a newer one (e.g. a rotated identity)
+		if b.overlay != nil {
+			keyring = b.overlay.KeyRing()
 		}
 		prof.KeyRing = &keyring
 
 		blob, err := json.Marshal(prof)
 		if err != nil {
-			panic(err)
+			b.logger.Error("Failed to encode updated keyring", "err", err)
+			b.lock.Unlock()
+			return
 		}
-		if err := b.database.Put(dbProfileKey, blob, nil); err != nil {
-			panic(err)
+		if err := b.putSecret(dbProfileKey, blob); err != nil {
+			b.logger.Error("Failed to persist updated keyring", "err", err)
+			b.lock.Unlock()
+			return
 		}
-		// The keyring was updated, ping the scheduler to dial accordingly
+		b.lock.Unlock()
+
+		// The keyring was updated, ping the scheduler to dial accordingly. Don't
+		// hold the lock as the scheduler might be waiting for it to dial.
 		b.dialer.reinit(keyring)
 	}()
 }
@@ -154,7 +244,7 @@ func (b *Backend) UpdateProfile(name string) error {
 	if err != nil {
 		return err
 	}
-	if err := b.database.Put(dbProfileKey, blob, nil); err != nil {
+	if err := b.putSecret(dbProfileKey, blob); err != nil {
 		return err
 	}
 	// Propagate the update to all our contacts
@@ -162,6 +252,51 @@ func (b *Backend) UpdateProfile(name string) error {
 		Profile: &corona.Profile{
 			Name:   prof.Name,
 			Avatar: prof.Avatar,
+			Mood:   prof.Mood,
+		},
+	}, schedulerProfileUpdate)
+	return nil
+}
+
+// UpdateProfileMood changes the free form mood message of an existing local user
+// (e.g. an away message). An empty mood clears it.
+//
+// Note, the mood is unrelated to the user's self-declared infection status.
+func (b *Backend) UpdateProfileMood(mood string) error {
+	b.logger.Debug("Profile mood update requested", "mood", mood)
+
+	if len(mood) > profileMoodMaxLength {
+		return ErrMoodTooLong
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Retrieve the current profile and abort if the update is a noop
+	prof, err := b.Profile()
+	if err != nil {
+		return err
+	}
+	if prof.Mood == mood {
+		b.logger.Debug("Skipping noop profile mood update")
+		return nil
+	}
+	// Mood changed, update and serialize back to disk
+	b.logger.Info("Updating local profile mood", "old", prof.Mood, "new", mood)
+	prof.Mood = mood
+
+	blob, err := json.Marshal(prof)
+	if err != nil {
+		return err
+	}
+	if err := b.putSecret(dbProfileKey, blob); err != nil {
+		return err
+	}
+	// Propagate the update to all our contacts
+	b.broadcast(&corona.Envelope{
+		Profile: &corona.Profile{
+			Name:   prof.Name,
+			Avatar: prof.Avatar,
+			Mood:   prof.Mood,
 		},
 	}, schedulerProfileUpdate)
 	return nil
@@ -171,6 +306,10 @@ func (b *Backend) UpdateProfile(name string) error {
 func (b *Backend) UploadProfilePicture(data []byte) error {
 	b.logger.Info("Uploading profile picture")
 
+	if len(data) > params.MaxImageBytes {
+		return ErrImageTooLarge
+	}
+
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
@@ -180,7 +319,7 @@ func (b *Backend) UploadProfilePicture(data []byte) error {
 		return err
 	}
 	// Upload the image into the CDN and delete the old one
-	hash, err := b.uploadCDNImage(data)
+	hash, err := b.uploadCDNPicture(data)
 	if err != nil {
 		return err
 	}
@@ -199,7 +338,7 @@ func (b *Backend) UploadProfilePicture(data []byte) error {
 	if err != nil {
 		return err
 	}
-	if err := b.database.Put(dbProfileKey, blob, nil); err != nil {
+	if err := b.putSecret(dbProfileKey, blob); err != nil {
 		return err
 	}
 	// Propagate the update to all our contacts
@@ -207,6 +346,7 @@ func (b *Backend) UploadProfilePicture(data []byte) error {
 		Profile: &corona.Profile{
 			Name:   prof.Name,
 			Avatar: prof.Avatar,
+			Mood:   prof.Mood,
 		},
 	}, schedulerProfileUpdate)
 	return nil
@@ -237,7 +377,7 @@ func (b *Backend) DeleteProfilePicture() error {
 	if err != nil {
 		return err
 	}
-	if err := b.database.Put(dbProfileKey, blob, nil); err != nil {
+	if err := b.putSecret(dbProfileKey, blob); err != nil {
 		return err
 	}
 	// Propagate the update to all our contacts
@@ -245,6 +385,7 @@ func (b *Backend) DeleteProfilePicture() error {
 		Profile: &corona.Profile{
 			Name:   prof.Name,
 			Avatar: prof.Avatar,
+			Mood:   prof.Mood,
 		},
 	}, schedulerProfileUpdate)
 	return nil
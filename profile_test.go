@@ -0,0 +1,199 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Tests that an interrupted profile deletion is detected on startup and the wipe
+// is completed, whereas a clean database is left alone.
+func TestProfileDeletionRecovery(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	// Populate the database with a profile and some auxiliary data
+	if err := backend.database.Put(dbProfileKey, []byte(`{"name":"Alice"}`), nil); err != nil {
+		t.Fatalf("failed to store profile: %v", err)
+	}
+	for _, key := range []string{"contact-bob", "contact-carol", "message-bob-1"} {
+		if err := backend.database.Put([]byte(key), []byte{0x01}, nil); err != nil {
+			t.Fatalf("failed to store %s: %v", key, err)
+		}
+	}
+	// Ensure startup recovery doesn't touch a clean database
+	if err := backend.recoverDeletion(); err != nil {
+		t.Fatalf("failed to run recovery: %v", err)
+	}
+	if _, err := backend.Profile(); err != nil {
+		t.Fatalf("profile lost without deletion: %v", err)
+	}
+	// Simulate a crash midway through a deletion: marker set, some keys deleted
+	if err := backend.database.Put(dbDeletingKey, []byte{}, nil); err != nil {
+		t.Fatalf("failed to set deletion marker: %v", err)
+	}
+	if err := backend.database.Delete([]byte("contact-bob"), nil); err != nil {
+		t.Fatalf("failed to delete contact: %v", err)
+	}
+	// Run the startup recovery and ensure everything is gone
+	if err := backend.recoverDeletion(); err != nil {
+		t.Fatalf("failed to recover deletion: %v", err)
+	}
+	if _, err := backend.Profile(); err != ErrProfileNotFound {
+		t.Fatalf("profile error mismatch: have %v, want %v", err, ErrProfileNotFound)
+	}
+	it := backend.database.NewIterator(&util.Range{}, nil)
+	defer it.Release()
+
+	for it.Next() {
+		t.Errorf("leftover database entry: %s", it.Key())
+	}
+}
+
+// Tests that a keyring update racing with a profile deletion is dropped instead
+// of crashing the backend or resurrecting the deleted profile.
+func TestKeyringUpdateAfterDeletion(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	keyring := newTestReporter(t, backend)
+
+	// Queue up a keyring update while the profile is being deleted
+	backend.lock.Lock()
+	backend.updateKeyring(keyring)
+	if err := backend.database.Delete(dbProfileKey, nil); err != nil {
+		t.Fatalf("failed to delete profile: %v", err)
+	}
+	backend.lock.Unlock()
+
+	// Give the update a chance to run and ensure the profile stays deleted
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		backend.lock.Lock()
+		backend.lock.Unlock()
+	}
+	if _, err := backend.Profile(); err != ErrProfileNotFound {
+		t.Fatalf("profile error mismatch: have %v, want %v", err, ErrProfileNotFound)
+	}
+}
+
+// Tests that the profile mood message is propagated to contacts on change, and
+// that clearing it propagates too.
+func TestProfileMoodPropagation(t *testing.T) {
+	gateway := tornet.NewMockGateway()
+
+	alice := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(alice.datadir)
+	defer alice.Close()
+
+	bob := newTestGatewayBackend(t, gateway)
+	defer os.RemoveAll(bob.datadir)
+	defer bob.Close()
+
+	// Create the two profiles and cross trust them
+	keyrings := make([]tornet.SecretKeyRing, 2)
+	for i, backend := range []*Backend{alice, bob} {
+		if err := backend.CreateProfile(); err != nil {
+			t.Fatalf("failed to create profile: %v", err)
+		}
+		if err := backend.EnableGateway(); err != nil {
+			t.Fatalf("failed to enable gateway: %v", err)
+		}
+		prof, err := backend.Profile()
+		if err != nil {
+			t.Fatalf("failed to retrieve profile: %v", err)
+		}
+		keyrings[i] = *prof.KeyRing
+	}
+	if _, err := alice.AddContact(tornet.RemoteKeyRing{Identity: keyrings[1].Identity.Public(), Address: keyrings[1].Addresses[0].Public()}); err != nil {
+		t.Fatalf("failed to add bob as contact: %v", err)
+	}
+	if _, err := bob.AddContact(tornet.RemoteKeyRing{Identity: keyrings[0].Identity.Public(), Address: keyrings[0].Addresses[0].Public()}); err != nil {
+		t.Fatalf("failed to add alice as contact: %v", err)
+	}
+	waitTestConnected(t, alice, keyrings[1].Identity.Fingerprint())
+
+	// Ensure overly long moods are rejected
+	if err := alice.UpdateProfileMood(strings.Repeat("x", profileMoodMaxLength+1)); err != ErrMoodTooLong {
+		t.Fatalf("long mood error mismatch: have %v, want %v", err, ErrMoodTooLong)
+	}
+	// Set and then clear a mood, ensuring bob sees both
+	for _, mood := range []string{"recovering, isolating", ""} {
+		if err := alice.UpdateProfileMood(mood); err != nil {
+			t.Fatalf("failed to update mood: %v", err)
+		}
+		if prof, _ := alice.Profile(); prof.Mood != mood {
+			t.Fatalf("local mood mismatch: have %q, want %q", prof.Mood, mood)
+		}
+		var have string
+		for i := 0; i < 100; i++ {
+			info, err := bob.Contact(keyrings[0].Identity.Fingerprint())
+			if err != nil {
+				t.Fatalf("failed to retrieve contact: %v", err)
+			}
+			if have = info.Mood; have == mood {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if have != mood {
+			t.Fatalf("remote mood mismatch: have %q, want %q", have, mood)
+		}
+	}
+}
+
+// Tests that the shareable keyring of the local user always contains the live
+// identity and the most recent address, even across rotations.
+func TestMyKeyring(t *testing.T) {
+	backend := newTestGatewayBackend(t, tornet.NewMockGateway())
+	defer os.RemoveAll(backend.datadir)
+	defer backend.Close()
+
+	if _, err := backend.MyKeyring(); err != ErrProfileNotFound {
+		t.Fatalf("missing profile error mismatch: have %v, want %v", err, ErrProfileNotFound)
+	}
+	if err := backend.CreateProfile(); err != nil {
+		t.Fatalf("failed to create profile: %v", err)
+	}
+	if err := backend.EnableGateway(); err != nil {
+		t.Fatalf("failed to enable gateway: %v", err)
+	}
+	prof, _ := backend.Profile()
+
+	keyring, err := backend.MyKeyring()
+	if err != nil {
+		t.Fatalf("failed to retrieve keyring: %v", err)
+	}
+	if keyring.Identity.Fingerprint() != prof.KeyRing.Identity.Fingerprint() {
+		t.Fatalf("identity mismatch: have %v, want %v", keyring.Identity.Fingerprint(), prof.KeyRing.Identity.Fingerprint())
+	}
+	if keyring.Address.Fingerprint() != prof.KeyRing.Addresses[0].Fingerprint() {
+		t.Fatalf("address mismatch: have %v, want %v", keyring.Address.Fingerprint(), prof.KeyRing.Addresses[0].Fingerprint())
+	}
+	if parsed, err := tornet.ParseRemoteKeyRing(keyring.Bytes()); err != nil {
+		t.Fatalf("failed to parse exported keyring: %v", err)
+	} else if parsed.Identity.Fingerprint() != keyring.Identity.Fingerprint() || parsed.Address.Fingerprint() != keyring.Address.Fingerprint() {
+		t.Fatalf("exported keyring mismatch: have %v/%v, want %v/%v", parsed.Identity.Fingerprint(), parsed.Address.Fingerprint(), keyring.Identity.Fingerprint(), keyring.Address.Fingerprint())
+	}
+	// Rotate the identity and ensure the new one is exported right away
+	rotated, err := backend.RotateIdentity()
+	if err != nil {
+		t.Fatalf("failed to rotate identity: %v", err)
+	}
+	if keyring, err = backend.MyKeyring(); err != nil {
+		t.Fatalf("failed to retrieve rotated keyring: %v", err)
+	}
+	if keyring.Identity.Fingerprint() != rotated.Identity.Fingerprint() {
+		t.Fatalf("rotated identity mismatch: have %v, want %v", keyring.Identity.Fingerprint(), rotated.Identity.Fingerprint())
+	}
+	if want := rotated.Addresses[len(rotated.Addresses)-1].Fingerprint(); keyring.Address.Fingerprint() != want {
+		t.Fatalf("rotated address mismatch: have %v, want %v", keyring.Address.Fingerprint(), want)
+	}
+}
@@ -0,0 +1,245 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var (
+	// ErrMultiProfileDisabled is returned if a named profile is attempted to be
+	// created or switched to on a backend running in single-profile mode.
+	ErrMultiProfileDisabled = errors.New("multi-profile mode disabled")
+
+	// ErrInvalidProfileID is returned if a named profile is attempted to be created
+	// or switched to with an id that is not safe to use as a directory name.
+	ErrInvalidProfileID = errors.New("invalid profile id")
+)
+
+// defaultProfileID is the id of the profile living in the legacy single-profile
+// database location. It always exists in multi-profile mode, and is the one the
+// backend starts out on.
+const defaultProfileID = "default"
+
+// profileIDRegexp is the pattern all named profile ids must match.
+var profileIDRegexp = regexp.MustCompile("^[a-zA-Z0-9_-]{1,64}$")
+
+// profileDatabase returns the path of the database holding a profile's data.
+// Every named profile lives in a completely separate database, so contacts,
+// events and everything else are namespaced without any key juggling.
+func profileDatabase(datadir string, id string) string {
+	if id == defaultProfileID {
+		return filepath.Join(datadir, "ldb")
+	}
+	return filepath.Join(datadir, "profiles", id, "ldb")
+}
+
+// Profiles returns the ids of all the profiles hosted by the backend, sorted
+// alphabetically. In single-profile mode, nil is returned.
+func (b *Backend) Profiles() []string {
+	if !b.config.MultiProfile {
+		return nil
+	}
+	ids := []string{defaultProfileID}
+
+	infos, _ := ioutil.ReadDir(filepath.Join(b.datadir, "profiles"))
+	for _, info := range infos {
+		if info.IsDir() && info.Name() != defaultProfileID && profileIDRegexp.MatchString(info.Name()) {
+			ids = append(ids, info.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ActiveProfile returns the id of the profile the backend is currently running.
+// In single-profile mode, an empty string is returned.
+func (b *Backend) ActiveProfile() string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.profileID
+}
+
+// CreateProfileNamed creates a new profile namespace with the given id, switches
+// over to it and generates a new cryptographic identity for the local user in
+// it. The default profile namespace always exists, so it can only be created
+// into if its user was deleted.
+func (b *Backend) CreateProfileNamed(id string) error {
+	b.logger.Debug("Named profile creation requested", "id", id)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := b.switchProfile(id, true); err != nil {
+		return err
+	}
+	return b.createProfile()
+}
+
+// SwitchProfile tears down everything running for the currently active profile
+// and starts it all up for the one with the given id.
+func (b *Backend) SwitchProfile(id string) error {
+	b.logger.Info("Switching profile", "id", id)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := b.switchProfile(id, false); err != nil {
+		return err
+	}
+	prof, err := b.Profile()
+	if err != nil {
+		return nil // No user in the profile is fine
+	}
+	if err := b.initOverlay(*prof.KeyRing); err != nil {
+		return err
+	}
+	if b.enabled {
+		b.dialer.reinit(*prof.KeyRing)
+	}
+	return nil
+}
+
+// switchProfile swaps the database of the backend to the one of a different
+// profile, tearing down everything running on top of the old one. The overlay
+// of the new profile is not started.
+//
+// If create is set, a missing profile namespace is created, and an existing one
+// with a local user in it is rejected. Otherwise the namespace must exist.
+//
+// Note, this method assumes the write lock is held.
+func (b *Backend) switchProfile(id string, create bool) error {
+	if !b.config.MultiProfile {
+		return ErrMultiProfileDisabled
+	}
+	if !profileIDRegexp.MatchString(id) {
+		return ErrInvalidProfileID
+	}
+	// Open and prepare the new profile's database, but don't touch the old one
+	// until it's certain the switch will succeed
+	path := profileDatabase(b.datadir, id)
+	if !create && id != defaultProfileID {
+		if _, err := os.Stat(path); err != nil {
+			return ErrProfileNotFound
+		}
+	}
+	if id == b.profileID {
+		if create {
+			if _, err := b.Profile(); err == nil {
+				return ErrProfileExists
+			}
+		}
+		return nil
+	}
+	db, err := leveldb.OpenFile(path, &opt.Options{})
+	if err != nil {
+		return err
+	}
+	vault, err := prepareDatabase(db, b.config, b.logger)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	if create {
+		if exists, _ := db.Has(dbProfileKey, nil); exists {
+			db.Close()
+			return ErrProfileExists
+		}
+	}
+	// New database ready, tear down everything running on the old one
+	if err := b.nukeOverlay(); err != nil {
+		db.Close()
+		return err
+	}
+	for kind, pending := range b.broadcasts {
+		pending.timer.Stop()
+		delete(b.broadcasts, kind)
+	}
+	if b.pairing != nil {
+		b.pairing.Close()
+		b.pairing = nil
+	}
+	b.paired = nil
+
+	b.avatars = make(map[tornet.IdentityFingerprint]*avatarRequest)
+	b.contacted = make(map[tornet.IdentityFingerprint]time.Time)
+	b.synced = make(map[tornet.IdentityFingerprint]time.Time)
+	b.checkin = make(map[tornet.IdentityFingerprint]*events.CheckinSession)
+	b.reminded = make(map[tornet.IdentityFingerprint]time.Time)
+	b.refreshed = time.Time{}
+	b.skipped = nil
+	b.quotaExceeded = false
+
+	b.bannerLock.Lock()
+	b.bannerFailures = make(map[tornet.IdentityFingerprint]int)
+	b.bannerLock.Unlock()
+
+	// Swap out the database, blocking any secret record access meanwhile
+	b.vaultLock.Lock()
+	old := b.database
+	b.database, b.vault = db, vault
+	b.vaultLock.Unlock()
+
+	b.profileID = id
+	return old.Close()
+}
+
+// prepareDatabase readies a freshly opened database for use: it resumes any
+// interrupted profile deletion, upgrades the schema, unlocks the at-rest
+// encryption and optionally quarantines corrupt records. The unlocked vault is
+// returned.
+//
+// The work is done through a scratch backend wrapping only the database, so an
+// already running backend is left untouched if anything fails.
+func prepareDatabase(db *leveldb.DB, config BackendConfig, logger log.Logger) (*vault, error) {
+	scratch := &Backend{
+		database: db,
+		logger:   logger,
+	}
+	// If a previous profile deletion was interrupted, finish it before anything
+	if err := scratch.recoverDeletion(); err != nil {
+		return nil, err
+	}
+	// Upgrade any data persisted by older versions to the current schema
+	if err := scratch.migrateDatabase(migrations); err != nil {
+		return nil, err
+	}
+	// Unlock (or enable) the at-rest encryption of the secret records
+	if err := scratch.openVault(config.Passphrase); err != nil {
+		return nil, err
+	}
+	// If requested, move any corrupt records out of the way before using them
+	if config.Integrity {
+		issues, err := scratch.integrityCheck(true)
+		if err != nil {
+			return nil, err
+		}
+		var quarantined int
+		for _, issue := range issues {
+			if issue.Quarantined {
+				quarantined++
+			}
+		}
+		if quarantined > 0 {
+			logger.Error("Quarantined corrupt database records", "count", quarantined)
+		}
+		if dangling := len(issues) - quarantined; dangling > 0 {
+			logger.Warn("Found dangling image references", "count", dangling)
+		}
+	}
+	return scratch.vault, nil
+}
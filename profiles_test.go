@@ -0,0 +1,147 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Tests that in multi-profile mode, independent profiles can be created and
+// switched between, each seeing only its own data.
+func TestProfileSwitching(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "coronanet-profiles-")
+	if err != nil {
+		t.Fatalf("failed to create temporary datadir: %v", err)
+	}
+	defer os.RemoveAll(datadir)
+
+	// Create a multi-profile backend with a user in the default profile
+	backend := newTestBackend(t)
+	backend.database.Close()
+
+	backend.datadir = datadir
+	backend.config = BackendConfig{MultiProfile: true}
+	backend.profileID = defaultProfileID
+	if backend.database, err = leveldb.OpenFile(profileDatabase(datadir, defaultProfileID), nil); err != nil {
+		t.Fatalf("failed to open default profile database: %v", err)
+	}
+	defer func() { backend.database.Close() }()
+
+	keyring := newTestReporter(t, backend)
+
+	// Create a new named profile and ensure it's empty
+	if err := backend.switchProfile(defaultProfileID, true); err != ErrProfileExists {
+		t.Fatalf("default recreation error mismatch: have %v, want %v", err, ErrProfileExists)
+	}
+	if err := backend.switchProfile("kiosk", true); err != nil {
+		t.Fatalf("failed to create named profile: %v", err)
+	}
+	if _, err := backend.Profile(); err != ErrProfileNotFound {
+		t.Fatalf("named profile error mismatch: have %v, want %v", err, ErrProfileNotFound)
+	}
+	if id := backend.ActiveProfile(); id != "kiosk" {
+		t.Fatalf("active profile mismatch: have %s, want %s", id, "kiosk")
+	}
+	if ids := backend.Profiles(); !reflect.DeepEqual(ids, []string{defaultProfileID, "kiosk"}) {
+		t.Fatalf("profile list mismatch: have %v, want %v", ids, []string{defaultProfileID, "kiosk"})
+	}
+	// Switch back and forth, ensuring the users are kept separate
+	if err := backend.switchProfile(defaultProfileID, false); err != nil {
+		t.Fatalf("failed to switch to default profile: %v", err)
+	}
+	prof, err := backend.Profile()
+	if err != nil {
+		t.Fatalf("failed to retrieve default profile: %v", err)
+	}
+	if !bytes.Equal(prof.KeyRing.Identity, keyring.Identity) {
+		t.Fatalf("default identity mismatch: have %x, want %x", prof.KeyRing.Identity, keyring.Identity)
+	}
+	if err := backend.switchProfile("kiosk", false); err != nil {
+		t.Fatalf("failed to switch to named profile: %v", err)
+	}
+	if _, err := backend.Profile(); err != ErrProfileNotFound {
+		t.Fatalf("named profile error mismatch: have %v, want %v", err, ErrProfileNotFound)
+	}
+	// Ensure invalid and missing profiles are rejected without switching
+	if err := backend.switchProfile("../kiosk", false); err != ErrInvalidProfileID {
+		t.Fatalf("invalid id error mismatch: have %v, want %v", err, ErrInvalidProfileID)
+	}
+	if err := backend.switchProfile("missing", false); err != ErrProfileNotFound {
+		t.Fatalf("missing profile error mismatch: have %v, want %v", err, ErrProfileNotFound)
+	}
+	if id := backend.ActiveProfile(); id != "kiosk" {
+		t.Fatalf("active profile mismatch: have %s, want %s", id, "kiosk")
+	}
+}
+
+// Tests that named profiles are rejected in the default single-profile mode.
+func TestProfileSwitchingDisabled(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	if err := backend.switchProfile("kiosk", true); err != ErrMultiProfileDisabled {
+		t.Fatalf("creation error mismatch: have %v, want %v", err, ErrMultiProfileDisabled)
+	}
+	if ids := backend.Profiles(); ids != nil {
+		t.Fatalf("profile list mismatch: have %v, want nil", ids)
+	}
+}
+
+// Tests that changing the passphrase in multi-profile mode re-encrypts all the
+// profiles, not just the active one, so they can still be switched between.
+func TestProfileSwitchingPassphraseChange(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "coronanet-profiles-")
+	if err != nil {
+		t.Fatalf("failed to create temporary datadir: %v", err)
+	}
+	defer os.RemoveAll(datadir)
+
+	// Create an encrypted multi-profile backend with a user in the default profile
+	backend := newTestBackend(t)
+	backend.database.Close()
+
+	backend.datadir = datadir
+	backend.config = BackendConfig{MultiProfile: true, Passphrase: "secret"}
+	backend.profileID = defaultProfileID
+	if backend.database, err = leveldb.OpenFile(profileDatabase(datadir, defaultProfileID), nil); err != nil {
+		t.Fatalf("failed to open default profile database: %v", err)
+	}
+	defer func() { backend.database.Close() }()
+
+	if err := backend.openVault("secret"); err != nil {
+		t.Fatalf("failed to enable encryption: %v", err)
+	}
+	keyring := newTestReporter(t, backend)
+
+	// Create a second profile, switch back and change the passphrase
+	if err := backend.switchProfile("kiosk", true); err != nil {
+		t.Fatalf("failed to create named profile: %v", err)
+	}
+	if err := backend.switchProfile(defaultProfileID, false); err != nil {
+		t.Fatalf("failed to switch to default profile: %v", err)
+	}
+	if err := backend.ChangePassphrase("secret", "changed"); err != nil {
+		t.Fatalf("failed to change passphrase: %v", err)
+	}
+	// Ensure both profiles unlock with the new passphrase
+	if err := backend.switchProfile("kiosk", false); err != nil {
+		t.Fatalf("failed to switch to named profile: %v", err)
+	}
+	if err := backend.switchProfile(defaultProfileID, false); err != nil {
+		t.Fatalf("failed to switch back to default profile: %v", err)
+	}
+	prof, err := backend.Profile()
+	if err != nil {
+		t.Fatalf("failed to retrieve default profile: %v", err)
+	}
+	if !bytes.Equal(prof.KeyRing.Identity, keyring.Identity) {
+		t.Fatalf("default identity mismatch: have %x, want %x", prof.KeyRing.Identity, keyring.Identity)
+	}
+}
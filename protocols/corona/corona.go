@@ -5,7 +5,10 @@
 package corona
 
 import (
+	"time"
+
 	"github.com/coronanet/go-coronanet/protocols"
+	"github.com/coronanet/go-coronanet/tornet"
 )
 
 // Protocol is the unique identifier of the corona protocol.
@@ -15,10 +18,16 @@ const Protocol = "corona"
 // the Corona Network wire protocol.
 type Envelope struct {
 	Disconnect *protocols.Disconnect
+	Ping       *protocols.Ping
+	Pong       *protocols.Pong
 	GetProfile *GetProfile
 	Profile    *Profile
 	GetAvatar  *GetAvatar
 	Avatar     *Avatar
+	Message    *Message
+	Ack        *Ack
+	Migrate    *Migrate
+	MigrateAck *MigrateAck
 }
 
 // GetProfile requests the remote user's profile summary.
@@ -28,6 +37,7 @@ type GetProfile struct{}
 type Profile struct {
 	Name   string   // Free form name the user is advertising (might be fake)
 	Avatar [32]byte // SHA3 hash of the user's avatar (avoid download if known)
+	Mood   string   // Free form mood message of the user (empty if cleared)
 }
 
 // GetAvatar requests the remote user's profile picture.
@@ -37,3 +47,33 @@ type GetAvatar struct{}
 type Avatar struct {
 	Image []byte // Binary image content, mime not restricted for now
 }
+
+// Message sends a direct text message to the remote user.
+type Message struct {
+	Text       string           // Free form text content of the message
+	Attachment []byte           // Optional binary attachment, mime not restricted for now
+	Timestamp  time.Time        // Time when the message was composed by the sender
+	Nonce      [16]byte         // Random nonce to deduplicate redeliveries
+	Sequence   uint64           // Per-contact sequence number for acknowledgements (0 = none)
+	Signature  tornet.Signature // Sender signature over the nonce, timestamp, text and attachment
+}
+
+// Ack acknowledges the receipt of a direct message, allowing the sender to drop
+// it from its outbox and mark it delivered.
+type Ack struct {
+	Ref uint64 // Sequence number of the message being acknowledged
+}
+
+// Migrate announces that the sender rotated its permanent identity, requesting
+// the recipient to replace the old identity in its keyring with the new one.
+type Migrate struct {
+	Identity  tornet.PublicIdentity // New permanent identity of the sender
+	Address   tornet.PublicAddress  // Address the new identity is reachable on
+	Timestamp time.Time             // Time of signing, limiting the validity of the announcement
+	Signature tornet.Signature      // Old identity signature over the recipient, new identity, address and timestamp
+	Proof     tornet.Signature      // New identity signature over the old identity, proving possession
+}
+
+// MigrateAck acknowledges that the recipient switched over to the sender's new
+// permanent identity.
+type MigrateAck struct{}
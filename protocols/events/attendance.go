@@ -0,0 +1,52 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package events
+
+import (
+	"errors"
+
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+var (
+	// ErrAttendanceUnavailable is returned if an attendance proof is requested
+	// for an event which did not sign the checkin (e.g. joined before proofs).
+	ErrAttendanceUnavailable = errors.New("attendance proof unavailable")
+
+	// ErrAttendanceInvalid is returned if an attendance proof does not belong to
+	// the expected event or its signature does not check out.
+	ErrAttendanceInvalid = errors.New("attendance proof invalid")
+)
+
+// attendancePrefix is the domain separator for attendance signatures to avoid
+// them being mistaken for any other signature made by the event identity.
+var attendancePrefix = []byte("coronanet-attendance-")
+
+// AttendanceProof is a record signed by an event organizer at checkin time that
+// a pseudonym attended the event. It does not reveal anything about the guest,
+// but the guest can later prove ownership of the pseudonym.
+type AttendanceProof struct {
+	Event     tornet.PublicIdentity `json:"event"`     // Permanent identity of the event
+	Pseudonym tornet.PublicIdentity `json:"pseudonym"` // Ephemeral identity the guest checked in with
+	Signature tornet.Signature      `json:"signature"` // Organizer signature over the event and pseudonym
+}
+
+// attendanceBlob assembles the binary blob that an attendance signature covers.
+func attendanceBlob(event tornet.PublicIdentity, pseudonym tornet.PublicIdentity) []byte {
+	blob := append([]byte{}, attendancePrefix...)
+	blob = append(blob, event...)
+	return append(blob, pseudonym...)
+}
+
+// Verify checks that the attendance proof belongs to the given event and that
+// it was signed by the event's organizer.
+func (p *AttendanceProof) Verify(event tornet.IdentityFingerprint) error {
+	if len(p.Event) == 0 || p.Event.Fingerprint() != event {
+		return ErrAttendanceInvalid
+	}
+	if !p.Event.Verify(attendanceBlob(p.Event, p.Pseudonym), p.Signature) {
+		return ErrAttendanceInvalid
+	}
+	return nil
+}
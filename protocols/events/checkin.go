@@ -9,6 +9,7 @@ import (
 	"encoding/gob"
 	"errors"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/coronanet/go-coronanet/tornet"
@@ -22,8 +23,32 @@ type CheckinSession struct {
 	Address  tornet.PublicAddress  // Public address of the server to check in to
 	Auth     tornet.SecretIdentity // Ephemeral authentication credential
 
-	server *Server    // Event server to check into
-	result chan error // Checkin result for user feedback
+	server *Server     // Event server to check into
+	expiry *time.Timer // Expiration timer for multi-use windows (nil if single use)
+	closer sync.Once   // Guard to only ever clean the session up once
+
+	result   error              // Checkin result for user feedback
+	resolver sync.Once          // Guard to only ever deliver the first result
+	resolved context.Context    // Context cancelled when the result is available
+	resolve  context.CancelFunc // Cancels the result context to release waiters
+}
+
+// errSessionClosed is returned if a checkin session is torn down before a guest
+// checked in (or the window expired).
+var errSessionClosed = errors.New("session closed")
+
+// newCheckinSession creates a checkin session for an event server, pending any
+// result.
+func newCheckinSession(s *Server, auth tornet.SecretIdentity) *CheckinSession {
+	resolved, resolve := context.WithCancel(context.Background())
+	return &CheckinSession{
+		Identity: s.infos.Identity.Public(),
+		Address:  s.infos.Address.Public(),
+		Auth:     auth,
+		server:   s,
+		resolved: resolved,
+		resolve:  resolve,
+	}
 }
 
 // Checkin starts a new checkin session. Normally you don't want to support more
@@ -39,25 +64,95 @@ func (s *Server) Checkin() (*CheckinSession, error) {
 	if err != nil {
 		return nil, err
 	}
-	session := &CheckinSession{
-		Identity: s.infos.Identity.Public(),
-		Address:  s.infos.Address.Public(),
-		Auth:     auth,
-		server:   s,
-		result:   make(chan error, 3), // Checkin && end event && wait defer
+	session := newCheckinSession(s, auth)
+	s.checkins[auth.Fingerprint()] = session
+	s.peerset.Trust(auth.Public())
+	return session, nil
+}
+
+// OpenCheckinWindow starts a new multi-use checkin session. Opposed to a single
+// use one, the same authentication credential can be used by any number of
+// participants, one after the other, until the window expires.
+//
+// Each participant still checks in with their own pseudonym, so every one will
+// get distinct access to the event. A pseudonym can only be used once.
+func (s *Server) OpenCheckinWindow(duration time.Duration) (*CheckinSession, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.infos.End != (time.Time{}) {
+		return nil, ErrEventConcluded
 	}
+	auth, err := tornet.GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	session := newCheckinSession(s, auth)
+	session.expiry = time.AfterFunc(duration, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		if s.checkins[auth.Fingerprint()] != session {
+			return // Session closed meanwhile
+		}
+		session.finish(nil)
+		session.close()
+	})
 	s.checkins[auth.Fingerprint()] = session
 	s.peerset.Trust(auth.Public())
 	return session, nil
 }
 
-// close cleans up the checkin session from the event server.
+// CheckinSessions returns the authentication credential fingerprints of all the
+// currently live checkin sessions, in no particular order.
+func (s *Server) CheckinSessions() []tornet.IdentityFingerprint {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	auths := make([]tornet.IdentityFingerprint, 0, len(s.checkins))
+	for auth := range s.checkins {
+		auths = append(auths, auth)
+	}
+	return auths
+}
+
+// RevokeCheckin tears down a single live checkin session, untrusting its auth
+// credential (e.g. if the QR code leaked). Any other sessions are unaffected.
+func (s *Server) RevokeCheckin(auth tornet.IdentityFingerprint) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.checkins[auth]
+	if !ok {
+		return ErrCheckinNotFound
+	}
+	session.close()
+	return nil
+}
+
+// close cleans up the checkin session from the event server. It is safe to call
+// multiple times, only the first invocation will have any effect.
 //
 // Note, this method assumes the server lock is held.
 func (cs *CheckinSession) close() {
-	cs.server.peerset.Untrust(cs.Auth.Fingerprint())
-	delete(cs.server.checkins, cs.Auth.Fingerprint())
-	cs.result <- errors.New("session closed")
+	cs.closer.Do(func() {
+		if cs.expiry != nil {
+			cs.expiry.Stop()
+		}
+		cs.server.peerset.Untrust(cs.Auth.Fingerprint())
+		delete(cs.server.checkins, cs.Auth.Fingerprint())
+		cs.finish(errSessionClosed)
+	})
+}
+
+// finish delivers the result of the checkin session. Only the first result is
+// retained, any subsequent ones (e.g. teardowns after success) are discarded,
+// so any number of paths may call it without blocking.
+func (cs *CheckinSession) finish(err error) {
+	cs.resolver.Do(func() {
+		cs.result = err
+		cs.resolve()
+	})
 }
 
 // Wait blocks until the checkin session concludes or the context is cancelled.
@@ -75,14 +170,45 @@ func (cs *CheckinSession) Wait(ctx context.Context) error {
 	select {
 	case <-ctx.Done():
 		return errors.New("context cancelled")
-	case err := <-cs.result:
-		return err
+	case <-cs.resolved.Done():
+		return cs.result
+	}
+}
+
+// checkinBindingPrefix is the domain separator for checkin binding signatures
+// to avoid them being mistaken for any other signature made by the event.
+var checkinBindingPrefix = []byte("coronanet-checkin-")
+
+// checkinBindingBlob assembles the binary blob that a checkin binding signature
+// covers, tying the issued checkin credential to the event and the pseudonym.
+func checkinBindingBlob(event tornet.PublicIdentity, auth tornet.PublicIdentity, pseudonym tornet.PublicIdentity) []byte {
+	blob := append([]byte{}, checkinBindingPrefix...)
+	blob = append(blob, event...)
+	blob = append(blob, auth...)
+	return append(blob, pseudonym...)
+}
+
+// verifyCheckinAck checks that a checkin acknowledgement was signed by the given
+// event, both as an attendance proof for the pseudonym and as a binding of the
+// checkin credential to the event.
+//
+// Organizers predating attendance proofs or checkin bindings send acks without
+// them. These are accepted in a degraded mode (no attendance proof is retained),
+// only signatures that are present but invalid are rejected. The returned flag
+// reports whether the ack carries a valid attendance proof.
+func verifyCheckinAck(ack *CheckinAck, event tornet.PublicIdentity, auth tornet.PublicIdentity, pseudonym tornet.PublicIdentity) (bool, error) {
+	if len(ack.Signature) > 0 && !event.Verify(attendanceBlob(event, pseudonym), ack.Signature) {
+		return false, errors.New("invalid checkin ack signature")
+	}
+	if len(ack.Binding) > 0 && !event.Verify(checkinBindingBlob(event, auth, pseudonym), ack.Binding) {
+		return false, ErrCheckinMismatch
 	}
+	return len(ack.Signature) > 0, nil
 }
 
 // handleV1CheckIn is the network handler for the v1 `event` protocol's checkin
 // phase.
-func (s *Server) handleV1CheckIn(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, logger log.Logger) error {
+func (s *Server) handleV1CheckIn(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, session *CheckinSession, logger log.Logger) error {
 	logger.Info("Participant checking in")
 
 	// The entire exchange is time limited, ensure failure if it's exceeded
@@ -113,6 +239,17 @@ func (s *Server) handleV1CheckIn(uid tornet.IdentityFingerprint, conn net.Conn,
 	// Checkin completed, authorize the identity to connect for data exchange
 	uid = message.Checkin.Pseudonym.Fingerprint()
 
+	s.lock.RLock()
+	_, replay := s.infos.Participants[uid]
+	s.lock.RUnlock()
+
+	if replay {
+		// Multi-use checkin windows allow the same auth credential to be reused,
+		// but a pseudonym must never be. Reject any replayed checkins.
+		logger.Warn("Replayed checkin rejected", "pseudonym", uid)
+		return errors.New("replayed checkin")
+	}
+
 	if err := s.peerset.Trust(message.Checkin.Pseudonym); err != nil {
 		// The only realistic error is a duplicate checkin, which is a massive
 		// protocol violation (participants use ephemeral IDs), so make things
@@ -126,12 +263,16 @@ func (s *Server) handleV1CheckIn(uid tornet.IdentityFingerprint, conn net.Conn,
 
 	s.lock.Lock()
 	s.infos.Participants[uid] = message.Checkin.Pseudonym
+	s.infos.Checkins[uid] = time.Now()
 	s.infos.Updated = time.Now()
 	s.lock.Unlock()
 
 	s.host.OnUpdate(s.infos.Identity.Fingerprint(), s)
 
-	if err := enc.Encode(&Envelope{CheckinAck: &CheckinAck{}}); err != nil {
+	if err := enc.Encode(&Envelope{CheckinAck: &CheckinAck{
+		Signature: s.infos.Identity.Sign(attendanceBlob(s.infos.Identity.Public(), message.Checkin.Pseudonym)),
+		Binding:   s.infos.Identity.Sign(checkinBindingBlob(s.infos.Identity.Public(), session.Auth.Public(), message.Checkin.Pseudonym)),
+	}}); err != nil {
 		logger.Warn("Failed to send checkin ack", "err", err)
 		return err
 	}
@@ -140,7 +281,7 @@ func (s *Server) handleV1CheckIn(uid tornet.IdentityFingerprint, conn net.Conn,
 
 // handleV1CheckIn is the network handler for the v1 `event` protocol's checkin
 // phase.
-func (c *Client) handleV1CheckIn(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, logger log.Logger) {
+func (c *Client) handleV1CheckIn(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, auth tornet.SecretIdentity, logger log.Logger) {
 	logger.Info("Checking in to event", "pseudonym", c.infos.Pseudonym.Fingerprint())
 
 	// The entire exchange is time limited, ensure failure if it's exceeded
@@ -167,6 +308,22 @@ func (c *Client) handleV1CheckIn(uid tornet.IdentityFingerprint, conn net.Conn,
 		c.checkin <- errors.New("unknown checkin ack")
 		return
 	}
+	// Ensure the ack is a valid attendance proof and that it binds the checkin
+	// credential to the dialed event (i.e. the credential was not lifted from
+	// a different event).
+	attested, err := verifyCheckinAck(message.CheckinAck, c.infos.Identity, auth.Public(), c.infos.Pseudonym.Public())
+	if err != nil {
+		logger.Warn("Invalid checkin ack", "err", err)
+		c.checkin <- err
+		return
+	}
+	if attested {
+		c.lock.Lock()
+		c.infos.Attendance = message.CheckinAck.Signature
+		c.lock.Unlock()
+	} else {
+		logger.Warn("Organizer did not sign attendance proof")
+	}
 	// Checkin successful, notify the blocked constructor
 	logger.Info("Checked in to event", "pseudonym", c.infos.Pseudonym.Fingerprint())
 	c.checkin <- nil
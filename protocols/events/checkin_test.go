@@ -4,19 +4,26 @@
 package events
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"testing"
 	"time"
 
 	"github.com/coronanet/go-coronanet/tornet"
 	"github.com/ethereum/go-ethereum/log"
+	"golang.org/x/crypto/sha3"
 )
 
 // testHost is a mock host to test interacting with a single hosted event.
 type testHost struct {
 	event  *Server
+	banner []byte // Banner to serve (defaults to a tiny one if nil)
 	update chan *ServerInfos
 
+	reports chan tornet.IdentityFingerprint // Notification channel for accepted reports (nil = unexpected)
+	avatars chan []byte                     // Notification channel for downloaded avatars (nil = unexpected)
+
 	inited chan struct{} // Barrier to wait until the server is assigned
 }
 
@@ -28,6 +35,9 @@ func newTestHost() *testHost {
 }
 
 func (h *testHost) Banner(event tornet.IdentityFingerprint, server *Server) []byte {
+	if h.banner != nil {
+		return h.banner
+	}
 	return []byte("steak.jpg")
 }
 
@@ -37,7 +47,19 @@ func (h *testHost) OnUpdate(event tornet.IdentityFingerprint, server *Server) {
 }
 
 func (h *testHost) OnReport(event tornet.IdentityFingerprint, server *Server, pseudonym tornet.IdentityFingerprint, message string) error {
-	panic("not implemented)")
+	if h.reports == nil {
+		panic("not implemented)")
+	}
+	h.reports <- pseudonym
+	return nil
+}
+
+func (h *testHost) OnAvatar(event tornet.IdentityFingerprint, server *Server, pseudonym tornet.IdentityFingerprint, avatar []byte) error {
+	if h.avatars == nil {
+		panic("not implemented")
+	}
+	h.avatars <- avatar
+	return nil
 }
 
 // testGuest is a mock guest to test interacting with a single joined event.
@@ -57,10 +79,14 @@ func newTestGuest() *testGuest {
 	}
 }
 
-func (g *testGuest) Status(start, end time.Time) (id tornet.SecretIdentity, name string, status string, message string) {
+func (g *testGuest) Status(event tornet.IdentityFingerprint, start, end time.Time) (id tornet.SecretIdentity, name string, status string, message string) {
 	return nil, "", "", ""
 }
 
+func (g *testGuest) Avatar(event tornet.IdentityFingerprint) []byte {
+	return nil
+}
+
 func (g *testGuest) OnUpdate(event tornet.IdentityFingerprint, client *Client) {
 	<-g.inited
 	g.update <- g.event.Infos()
@@ -82,7 +108,7 @@ func TestCheckin(t *testing.T) {
 		guest   = newTestGuest()
 	)
 	// Create an event server to check into
-	server, err := CreateServer(host, gateway, "barbecue", [32]byte{3, 1, 4}, log.Root())
+	server, err := CreateServer(host, gateway, "barbecue", "bring your own beer", "the park", [32]byte{3, 1, 4}, log.Root())
 	if err != nil {
 		t.Fatalf("failed to create event server: %v", err)
 	}
@@ -117,6 +143,12 @@ func TestCheckin(t *testing.T) {
 	if clientInfos.Name != "barbecue" {
 		t.Errorf("event name mismatch: have %s, want %s", clientInfos.Name, "barbecue")
 	}
+	if clientInfos.Description != "bring your own beer" {
+		t.Errorf("event description mismatch: have %s, want %s", clientInfos.Description, "bring your own beer")
+	}
+	if clientInfos.Location != "the park" {
+		t.Errorf("event location mismatch: have %s, want %s", clientInfos.Location, "the park")
+	}
 	if clientInfos.Attendees != 2 { // self + organizer
 		t.Errorf("event attendees count mismatch: have %d, want %d", clientInfos.Attendees, 2)
 	}
@@ -142,7 +174,7 @@ func TestDuplicateCheckin(t *testing.T) {
 		guest   = newTestGuest()
 	)
 	// Create an event server to check into
-	server, err := CreateServer(host, gateway, "barbecue", [32]byte{3, 1, 4}, log.Root())
+	server, err := CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
 	if err != nil {
 		t.Fatalf("failed to create event server: %v", err)
 	}
@@ -187,7 +219,7 @@ func TestSubsequentCheckin(t *testing.T) {
 		host    = newTestHost()
 	)
 	// Create an event server to check into
-	server, err := CreateServer(host, gateway, "barbecue", [32]byte{3, 1, 4}, log.Root())
+	server, err := CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
 	if err != nil {
 		t.Fatalf("failed to create event server: %v", err)
 	}
@@ -248,7 +280,7 @@ func TestConcurrentCheckin(t *testing.T) {
 		host    = newTestHost()
 	)
 	// Create an event server to check into
-	server, err := CreateServer(host, gateway, "barbecue", [32]byte{3, 1, 4}, log.Root())
+	server, err := CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
 	if err != nil {
 		t.Fatalf("failed to create event server: %v", err)
 	}
@@ -294,6 +326,68 @@ func TestConcurrentCheckin(t *testing.T) {
 	}
 }
 
+// Tests that revoking a checkin session disables its credential without affecting
+// other concurrent sessions of the same event.
+func TestRevokeCheckin(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gateway = tornet.NewMockGateway()
+		host    = newTestHost()
+	)
+	// Create an event server with two concurrent checkin sessions
+	server, err := CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	host.event = server
+	close(host.inited)
+
+	revoked, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create first checkin session: %v", err)
+	}
+	retained, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create second checkin session: %v", err)
+	}
+	if sessions := server.CheckinSessions(); len(sessions) != 2 {
+		t.Fatalf("live session count mismatch: have %d, want %d", len(sessions), 2)
+	}
+	// Revoke the first session and ensure it's gone, but the second is not
+	if err := server.RevokeCheckin(revoked.Auth.Fingerprint()); err != nil {
+		t.Fatalf("failed to revoke checkin session: %v", err)
+	}
+	if err := server.RevokeCheckin(revoked.Auth.Fingerprint()); err != ErrCheckinNotFound {
+		t.Fatalf("double revocation error mismatch: have %v, want %v", err, ErrCheckinNotFound)
+	}
+	if sessions := server.CheckinSessions(); len(sessions) != 1 || sessions[0] != retained.Auth.Fingerprint() {
+		t.Fatalf("live sessions mismatch: have %v, want [%v]", sessions, retained.Auth.Fingerprint())
+	}
+	if err := revoked.Wait(context.Background()); err != errSessionClosed {
+		t.Fatalf("revoked session result mismatch: have %v, want %v", err, errSessionClosed)
+	}
+	// Ensure the revoked credential is rejected, but the retained one works
+	if _, err := CreateClient(newTestGuest(), gateway, revoked.Identity, revoked.Address, revoked.Auth, log.Root()); err == nil {
+		t.Fatalf("revoked checkin permitted")
+	}
+	guest := newTestGuest()
+	client, err := CreateClient(guest, gateway, retained.Identity, retained.Address, retained.Auth, log.Root())
+	if err != nil {
+		t.Fatalf("failed to check in with retained session: %v", err)
+	}
+	defer client.Close()
+
+	guest.event = client
+	close(guest.inited)
+
+	if err := retained.Wait(context.Background()); err != nil {
+		t.Fatalf("retained session result mismatch: have %v, want %v", err, nil)
+	}
+}
+
 // Tests that once an event is concluded, the checkin mechanism gets disabled.
 func TestPostTerminationCheckin(t *testing.T) {
 	t.Parallel()
@@ -302,7 +396,7 @@ func TestPostTerminationCheckin(t *testing.T) {
 
 	// Create an event server to check into, retrieve it's checkin credentials and
 	// terminate it.
-	server, err := CreateServer(newTestHost(), gateway, "barbecue", [32]byte{3, 1, 4}, log.Root())
+	server, err := CreateServer(newTestHost(), gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
 	if err != nil {
 		t.Fatalf("failed to create event server: %v", err)
 	}
@@ -330,3 +424,487 @@ func TestPostTerminationCheckin(t *testing.T) {
 		t.Fatalf("recreated server reopened checkin")
 	}
 }
+
+// Tests that reopening a concluded event re-enables the checkin mechanism.
+func TestReopenCheckin(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gateway = tornet.NewMockGateway()
+		host    = newTestHost()
+		guest   = newTestGuest()
+	)
+	// Create an event server, terminate it and ensure running events can't be
+	// reopened, only concluded ones
+	server, err := CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	host.event = server
+	close(host.inited)
+
+	if err := server.Reopen(); err != ErrEventNotConcluded {
+		t.Fatalf("running reopen error mismatch: have %v, want %v", err, ErrEventNotConcluded)
+	}
+	server.Terminate()
+	if _, err := server.Checkin(); err != ErrEventConcluded {
+		t.Fatalf("concluded checkin error mismatch: have %v, want %v", err, ErrEventConcluded)
+	}
+	// Reopen the event and ensure guests can check in again
+	if err := server.Reopen(); err != nil {
+		t.Fatalf("failed to reopen event: %v", err)
+	}
+	if end := server.Infos().End; end != (time.Time{}) {
+		t.Fatalf("reopened event end mismatch: have %v, want zero", end)
+	}
+	session, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	client, err := CreateClient(guest, gateway, session.Identity, session.Address, session.Auth, log.Root())
+	if err != nil {
+		t.Fatalf("failed to check into reopened event: %v", err)
+	}
+	defer client.Close()
+
+	guest.event = client
+	close(guest.inited)
+
+	if infos := <-host.update; len(infos.Participants) == 0 {
+		t.Errorf("client missing from participant list")
+	}
+}
+
+// Tests that a multi-use checkin window can be used by multiple guests in
+// sequence, and that it gets disabled after it expires.
+func TestCheckinWindow(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gateway = tornet.NewMockGateway()
+		host    = newTestHost()
+	)
+	// Create an event server to check into
+	server, err := CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	host.event = server
+	close(host.inited)
+
+	// Open a checkin window and check in multiple guests with the same credentials
+	session, err := server.OpenCheckinWindow(500 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to open checkin window: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		guest := newTestGuest()
+		client, err := CreateClient(guest, gateway, session.Identity, session.Address, session.Auth, log.Root())
+		if err != nil {
+			t.Fatalf("guest %d: failed to create event client: %v", i, err)
+		}
+		defer client.Close()
+
+		guest.event = client
+		close(guest.inited)
+
+		serverInfos := <-host.update
+		if _, ok := serverInfos.Participants[client.infos.Pseudonym.Fingerprint()]; !ok {
+			t.Errorf("guest %d: client missing from participant list", i)
+		}
+		if len(serverInfos.Participants) != i+1 {
+			t.Errorf("guest %d: participant count mismatch: have %d, want %d", i, len(serverInfos.Participants), i+1)
+		}
+		<-guest.update
+		<-guest.update
+		<-guest.banner
+	}
+	// Wait for the window to expire and ensure no more guests can check in
+	if err := session.Wait(context.Background()); err != nil {
+		t.Fatalf("checkin window failed: %v", err)
+	}
+	if _, err := CreateClient(newTestGuest(), gateway, session.Identity, session.Address, session.Auth, log.Root()); err == nil {
+		t.Fatalf("post-expiry checkin permitted")
+	}
+}
+
+// Tests that a checkin session can be closed through multiple paths concurrently
+// without deadlocking or double-cleaning it.
+func TestCheckinConcurrentClose(t *testing.T) {
+	t.Parallel()
+
+	// Create an event server and a checkin session to tear down
+	server, err := CreateServer(newTestHost(), tornet.NewMockGateway(), "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	session, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	// Close the session through all available paths concurrently
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{}, 4)
+	go func() {
+		session.Wait(ctx)
+		done <- struct{}{}
+	}()
+	go func() {
+		cancel()
+		done <- struct{}{}
+	}()
+	go func() {
+		server.Terminate()
+		done <- struct{}{}
+	}()
+	go func() {
+		server.Close()
+		done <- struct{}{}
+	}()
+	for i := 0; i < 4; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("session teardown deadlocked")
+		}
+	}
+	// Ensure the session was fully removed and a repeat close is a noop
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if len(server.checkins) != 0 {
+		t.Fatalf("checkin sessions remaining: have %d, want %d", len(server.checkins), 0)
+	}
+	session.close()
+}
+
+// Tests that any number of checkin session teardown paths (success, event end,
+// expiry, explicit close) racing each other converge on a single result without
+// blocking any of them.
+func TestCheckinResultConvergence(t *testing.T) {
+	t.Parallel()
+
+	for i := 0; i < 25; i++ {
+		server, err := CreateServer(newTestHost(), tornet.NewMockGateway(), "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+		if err != nil {
+			t.Fatalf("run %d: failed to create event server: %v", i, err)
+		}
+		single, err := server.Checkin()
+		if err != nil {
+			t.Fatalf("run %d: failed to create checkin session: %v", i, err)
+		}
+		window, err := server.OpenCheckinWindow(time.Duration(i%3) * time.Millisecond)
+		if err != nil {
+			t.Fatalf("run %d: failed to open checkin window: %v", i, err)
+		}
+		// Start multiple waiters on both sessions, one of them abortable
+		ctx, cancel := context.WithCancel(context.Background())
+
+		results := make(chan error, 4)
+		for _, session := range []*CheckinSession{single, window} {
+			go func(session *CheckinSession) { results <- session.Wait(context.Background()) }(session)
+		}
+		go func() { results <- single.Wait(ctx) }()
+		go func() { results <- window.Wait(ctx) }()
+
+		// Tear the sessions down through all the paths concurrently
+		done := make(chan struct{}, 4)
+		for _, session := range []*CheckinSession{single, window} {
+			go func(session *CheckinSession) {
+				session.finish(nil) // Same as a successful checkin
+
+				server.lock.Lock()
+				session.close()
+				server.lock.Unlock()
+
+				done <- struct{}{}
+			}(session)
+		}
+		go func() {
+			server.Terminate()
+			done <- struct{}{}
+		}()
+		go func() {
+			cancel()
+			server.Close()
+			done <- struct{}{}
+		}()
+		for j := 0; j < 4; j++ {
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatalf("run %d: session teardown blocked", i)
+			}
+		}
+		for j := 0; j < 4; j++ {
+			select {
+			case err := <-results:
+				if err != nil && err != errSessionClosed && err.Error() != "context cancelled" {
+					t.Errorf("run %d: unexpected session result: %v", i, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("run %d: session wait blocked", i)
+			}
+		}
+		// Ensure all late waiters get the same, single result
+		for _, session := range []*CheckinSession{single, window} {
+			have, want := session.Wait(context.Background()), session.result
+			if have != want {
+				t.Errorf("run %d: late result mismatch: have %v, want %v", i, have, want)
+			}
+		}
+	}
+}
+
+// Tests that a successful checkin yields an organizer signed attendance proof
+// which verifies against the event, and that tampering invalidates it.
+func TestCheckinAttendanceProof(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gateway = tornet.NewMockGateway()
+		host    = newTestHost()
+		guest   = newTestGuest()
+	)
+	// Create an event server and check into it
+	server, err := CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	host.event = server
+	close(host.inited)
+
+	session, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	client, err := CreateClient(guest, gateway, session.Identity, session.Address, session.Auth, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event client: %v", err)
+	}
+	defer client.Close()
+
+	guest.event = client
+	close(guest.inited)
+
+	// Consume the server and client events to ensure nothing's left in the system
+	<-host.update
+	<-guest.update
+	<-guest.update
+
+	// Ensure the attendance proof is valid for the event
+	event := session.Identity.Fingerprint()
+
+	proof, err := client.Infos().AttendanceProof()
+	if err != nil {
+		t.Fatalf("failed to retrieve attendance proof: %v", err)
+	}
+	if err := proof.Verify(event); err != nil {
+		t.Fatalf("failed to verify attendance proof: %v", err)
+	}
+	if proof.Pseudonym.Fingerprint() != client.Infos().Pseudonym.Fingerprint() {
+		t.Errorf("proof pseudonym mismatch: have %v, want %v", proof.Pseudonym.Fingerprint(), client.Infos().Pseudonym.Fingerprint())
+	}
+	// Ensure the proof cannot be used for a different event
+	other, _ := tornet.GenerateIdentity()
+	if err := proof.Verify(other.Public().Fingerprint()); err != ErrAttendanceInvalid {
+		t.Errorf("foreign event verification mismatch: have %v, want %v", err, ErrAttendanceInvalid)
+	}
+	// Ensure the proof cannot be transferred to a different pseudonym
+	forged := *proof
+	forged.Pseudonym = other.Public()
+	if err := forged.Verify(event); err != ErrAttendanceInvalid {
+		t.Errorf("forged pseudonym verification mismatch: have %v, want %v", err, ErrAttendanceInvalid)
+	}
+	// Ensure a mangled signature is rejected
+	forged = *proof
+	forged.Signature = append(tornet.Signature{}, proof.Signature...)
+	forged.Signature[0] ^= 0xff
+	if err := forged.Verify(event); err != ErrAttendanceInvalid {
+		t.Errorf("forged signature verification mismatch: have %v, want %v", err, ErrAttendanceInvalid)
+	}
+}
+
+// Tests that a checkin credential paired with the identity of a different event
+// than the one that issued it is rejected, both by the transport and by the
+// checkin acknowledgement binding.
+func TestCheckinCredentialMismatch(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gateway = tornet.NewMockGateway()
+		hostA   = newTestHost()
+		hostB   = newTestHost()
+	)
+	// Create two event servers, issue a checkin credential for the first
+	serverA, err := CreateServer(hostA, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server A: %v", err)
+	}
+	defer serverA.Close()
+
+	hostA.event = serverA
+	close(hostA.inited)
+
+	serverB, err := CreateServer(hostB, gateway, "picnic", "", "", [32]byte{2, 7, 1}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server B: %v", err)
+	}
+	defer serverB.Close()
+
+	hostB.event = serverB
+	close(hostB.inited)
+
+	session, err := serverA.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	// Try to join event B with A's credential, both via B's and A's address
+	identityB := serverB.infos.Identity.Public()
+	addressB := serverB.infos.Address.Public()
+
+	if _, err := CreateClient(newTestGuest(), gateway, identityB, addressB, session.Auth, log.Root()); err == nil {
+		t.Fatalf("mismatched checkin accepted via event address")
+	}
+	if _, err := CreateClient(newTestGuest(), gateway, identityB, session.Address, session.Auth, log.Root()); err == nil {
+		t.Fatalf("mismatched checkin accepted via credential address")
+	}
+	if n := len(serverB.Infos().Participants); n != 0 {
+		t.Fatalf("participant count mismatch: have %d, want %d", n, 0)
+	}
+	// Ensure an acknowledgement binding a different credential is rejected
+	pseudonym, _ := tornet.GenerateIdentity()
+	forged, _ := tornet.GenerateIdentity()
+
+	event := serverA.infos.Identity
+	ack := &CheckinAck{
+		Signature: event.Sign(attendanceBlob(event.Public(), pseudonym.Public())),
+		Binding:   event.Sign(checkinBindingBlob(event.Public(), forged.Public(), pseudonym.Public())),
+	}
+	if _, err := verifyCheckinAck(ack, event.Public(), session.Auth.Public(), pseudonym.Public()); err != ErrCheckinMismatch {
+		t.Fatalf("mismatched binding error mismatch: have %v, want %v", err, ErrCheckinMismatch)
+	}
+	if attested, err := verifyCheckinAck(ack, event.Public(), forged.Public(), pseudonym.Public()); err != nil || !attested {
+		t.Fatalf("matching binding rejected: attested %v, err %v", attested, err)
+	}
+	if _, err := verifyCheckinAck(ack, identityB, forged.Public(), pseudonym.Public()); err == nil {
+		t.Fatalf("acknowledgement from a different event accepted")
+	}
+}
+
+// Tests that checkin acks from organizers predating attendance proofs and checkin
+// bindings are accepted in a degraded mode, without an attendance proof.
+func TestCheckinAckLegacy(t *testing.T) {
+	var (
+		event, _     = tornet.GenerateIdentity()
+		auth, _      = tornet.GenerateIdentity()
+		pseudonym, _ = tornet.GenerateIdentity()
+	)
+	tests := []struct {
+		ack      *CheckinAck
+		attested bool
+		failure  bool
+	}{
+		// Legacy organizer without signatures, accept without proof
+		{&CheckinAck{}, false, false},
+		// Organizer with attendance proofs but no bindings, accept with proof
+		{&CheckinAck{Signature: event.Sign(attendanceBlob(event.Public(), pseudonym.Public()))}, true, false},
+		// Organizer with bindings only (weird), accept without proof
+		{&CheckinAck{Binding: event.Sign(checkinBindingBlob(event.Public(), auth.Public(), pseudonym.Public()))}, false, false},
+		// Present but invalid signatures, reject
+		{&CheckinAck{Signature: make(tornet.Signature, 64)}, false, true},
+		{&CheckinAck{Binding: make(tornet.Signature, 64)}, false, true},
+	}
+	for i, tt := range tests {
+		attested, err := verifyCheckinAck(tt.ack, event.Public(), auth.Public(), pseudonym.Public())
+		if (err != nil) != tt.failure {
+			t.Errorf("test %d: failure mismatch: have %v, want %v", i, err, tt.failure)
+		}
+		if attested != tt.attested {
+			t.Errorf("test %d: attestation mismatch: have %v, want %v", i, attested, tt.attested)
+		}
+	}
+	// Ensure a client checked in without a proof reports it as unavailable
+	infos := &ClientInfos{Identity: event.Public(), Pseudonym: pseudonym}
+	if _, err := infos.AttendanceProof(); err != ErrAttendanceUnavailable {
+		t.Fatalf("proof error mismatch: have %v, want %v", err, ErrAttendanceUnavailable)
+	}
+}
+
+// Tests that banners too large to be sent inline are transferred in chunks
+// separately, with the rest of the metadata arriving promptly.
+func TestLargeBannerTransfer(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gateway = tornet.NewMockGateway()
+		host    = newTestHost()
+		guest   = newTestGuest()
+	)
+	host.banner = make([]byte, 3*bannerChunkSize+bannerInlineLimit+1)
+	for i := range host.banner {
+		host.banner[i] = byte(i)
+	}
+	// Create an event server and check into it
+	server, err := CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	host.event = server
+	close(host.inited)
+
+	session, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	client, err := CreateClient(guest, gateway, session.Identity, session.Address, session.Auth, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event client: %v", err)
+	}
+	defer client.Close()
+
+	guest.event = client
+	close(guest.inited)
+	<-host.update
+
+	// Wait until the banner arrives, ensuring the name arrived before it
+	var named bool
+	for {
+		select {
+		case infos := <-guest.update:
+			if infos.Banner == ([32]byte{}) {
+				if infos.Name == "barbecue" {
+					named = true
+				}
+				continue
+			}
+			if !named {
+				t.Fatalf("event name didn't arrive before the banner")
+			}
+			if infos.Banner != sha3.Sum256(host.banner) {
+				t.Fatalf("banner hash mismatch: have %x, want %x", infos.Banner, sha3.Sum256(host.banner))
+			}
+			select {
+			case banner := <-guest.banner:
+				if !bytes.Equal(banner, host.banner) {
+					t.Fatalf("banner content mismatch")
+				}
+			default:
+				t.Fatalf("banner not delivered")
+			}
+			return
+
+		case <-time.After(3 * time.Second):
+			t.Fatalf("banner transfer timed out")
+		}
+	}
+}
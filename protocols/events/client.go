@@ -6,6 +6,7 @@ package events
 import (
 	"context"
 	"encoding/gob"
+	"errors"
 	"io"
 	"net"
 	"sync"
@@ -29,8 +30,13 @@ type clientDialRequest struct {
 // persisting updates into the database.
 type Guest interface {
 	// Status retrieves the guests last known infection status within the given
-	// time interval. The method should return every data to make a crypto proof.
-	Status(start, end time.Time) (id tornet.SecretIdentity, name string, status string, message string)
+	// time interval of an event. The method should return every data to make a
+	// crypto proof.
+	Status(event tornet.IdentityFingerprint, start, end time.Time) (id tornet.SecretIdentity, name string, status string, message string)
+
+	// Avatar retrieves the guest's profile picture to attach to infection reports
+	// sent to the event. The method should return nil if there is none.
+	Avatar(event tornet.IdentityFingerprint) []byte
 
 	// OnUpdate is invoked when the internal stats of the event changes. All the
 	// changes should be persisted to disk to allow recovering. This method does
@@ -53,20 +59,39 @@ type ClientInfos struct {
 	Checkin   tornet.SecretIdentity `json:"checkin"`   // Identity to use for checkin
 	Pseudonym tornet.SecretIdentity `json:"pseudonym"` // Identity to use for reading stats
 
-	Name   string    `json:"name"`   // Name of the event
-	Banner [32]byte  `json:"banner"` // Banner image hash of the event
-	Start  time.Time `json:"start"`  // Start time of the event
-	End    time.Time `json:"end"`    // Conclusion time of the event
+	Attendance tornet.Signature `json:"attendance"` // Organizer signature proving the checkin
+
+	Name        string    `json:"name"`                  // Name of the event
+	Description string    `json:"description,omitempty"` // Description of the event
+	Location    string    `json:"location,omitempty"`    // Location of the event
+	Banner      [32]byte  `json:"banner"`                // Banner image hash of the event
+	Start       time.Time `json:"start"`                 // Start time of the event
+	End         time.Time `json:"end"`                   // Conclusion time of the event
 
-	Status string `json:"status"` // Current status reporting to the event (avoid update cycles)
+	Status   string        `json:"status"`             // Current status reporting to the event (avoid update cycles)
+	Pending  string        `json:"pending,omitempty"`  // Status reported but not yet acknowledged (retried until acked)
+	Refused  string        `json:"refused,omitempty"`  // Status the organizer rejected (not retried until changed)
+	Rejected string        `json:"rejected,omitempty"` // Reason the organizer rejected the last report (empty if accepted)
+	Skew     time.Duration `json:"skew"`               // Estimated clock skew of the organizer (positive if ahead)
 
 	Attendees uint `json:"attendees"` // Number of participants in the event
 	Negatives uint `json:"negatives"` // Participants who reported negative test results
 	Suspected uint `json:"suspected"` // Participants who might have been infected
 	Positives uint `json:"positives"` // Participants who reported positive infection
+	Recovered uint `json:"recovered"` // Participants who recovered from a positive infection
 
 	Updated time.Time `json:"updated"` // Time when the event was last modified
 	Synced  time.Time `json:"synced"`  // Time when the event was last synced
+
+	Clock tornet.Clock `json:"-"` // Source of time for dial scheduling (nil = system clock)
+}
+
+// Connectivity is a snapshot of the network reachability of a remote event.
+type Connectivity struct {
+	Connected bool      // Whether there's a live connection to the event server
+	Dialed    time.Time // Time when the event server was last dialed successfully
+	Next      time.Time // Time when the event server will be dialed next
+	Failure   error     // Error of the last dial if it failed, nil otherwise
 }
 
 // Client is a remotely hosted event, running a `tornet` client which periodically
@@ -77,7 +102,17 @@ type Client struct {
 	infos   *ClientInfos   // Complete event metadata and statistics
 	banner  []byte         // Banner image cached for quick serving
 
-	peerset *tornet.PeerSet // Peer set handling remote connectivity
+	bannerHash [32]byte // Hash of the banner being downloaded in chunks (zero if none)
+	bannerData []byte   // Partial banner downloaded so far
+
+	features featureSet // Optional features last advertised by the organizer
+
+	clock    tornet.Clock    // Source of time for dial scheduling
+	peerset  *tornet.PeerSet // Peer set handling remote connectivity
+	live     *gob.Encoder    // Encoder of the live data exchange connection (nil if none)
+	dialed   time.Time       // Time of the last successful dial to the server
+	nextDial time.Time       // Time of the next scheduled dial (zero if suspended)
+	failure  error           // Error of the last dial if it failed
 
 	checkin chan error              // Notification channel when checkin finishes
 	update  chan *clientDialRequest // Update channel to change the dial priority
@@ -112,12 +147,16 @@ func RecreateClient(guest Guest, gateway tornet.Gateway, infos *ClientInfos, log
 		guest:      guest,
 		gateway:    gateway,
 		infos:      infos,
+		clock:      infos.Clock,
 		update:     make(chan *clientDialRequest),
 		suspend:    make(chan bool),
 		teardown:   make(chan chan struct{}),
 		terminated: make(chan struct{}),
 		logger:     logger,
 	}
+	if client.clock == nil {
+		client.clock = tornet.SystemClock
+	}
 	client.peerset = tornet.NewPeerSet(tornet.PeerSetConfig{
 		Trusted: []tornet.PublicIdentity{infos.Identity},
 		Handler: protocols.MakeHandler(protocols.HandlerConfig{
@@ -125,6 +164,8 @@ func RecreateClient(guest Guest, gateway tornet.Gateway, infos *ClientInfos, log
 			Handlers: map[uint]protocols.Handler{
 				1: client.handleV1,
 			},
+			Tracer:   protocols.TracerOf(guest),
+			Envelope: func() interface{} { return new(Envelope) },
 		}),
 		Timeout: connectionIdleTimeout,
 		Logger:  logger,
@@ -171,6 +212,18 @@ func (c *Client) Close() error {
 	return c.peerset.Close()
 }
 
+// Connections returns the number of live connections with the event server.
+func (c *Client) Connections() int {
+	return c.peerset.Count()
+}
+
+// Drain stops accepting new connections and waits (bounded by the context) for
+// all active data exchanges to finish their in-flight messages. The event client
+// should be torn down afterwards via Close.
+func (c *Client) Drain(ctx context.Context) error {
+	return c.peerset.Drain(ctx)
+}
+
 // Infos retrieves a copy of the event client's internal state for persistence.
 // The copy is not safe for modification, only from data races.
 func (c *Client) Infos() *ClientInfos {
@@ -181,11 +234,72 @@ func (c *Client) Infos() *ClientInfos {
 	return &infos
 }
 
-// Report requests the client to schedule an dial due to an infection update. The
-// method will change the dial priority to high and request an immediate dial too.
+// ReportError returns the reason the organizer rejected the last infection status
+// report, or nil if it was accepted (or none was sent yet).
+func (infos *ClientInfos) ReportError() error {
+	switch infos.Rejected {
+	case "":
+		return nil
+	case ErrInvalidTransition.Error():
+		return ErrInvalidTransition
+	default:
+		return errors.New(infos.Rejected)
+	}
+}
+
+// AttendanceProof assembles the organizer signed proof that the local guest's
+// pseudonym checked in to the event.
+func (infos *ClientInfos) AttendanceProof() (*AttendanceProof, error) {
+	if len(infos.Attendance) == 0 {
+		return nil, ErrAttendanceUnavailable
+	}
+	return &AttendanceProof{
+		Event:     infos.Identity,
+		Pseudonym: infos.Pseudonym.Public(),
+		Signature: infos.Attendance,
+	}, nil
+}
+
+// Connectivity retrieves a snapshot of the event server's network reachability.
+func (c *Client) Connectivity() *Connectivity {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return &Connectivity{
+		Connected: c.peerset.Connected(c.infos.Identity.Fingerprint()),
+		Dialed:    c.dialed,
+		Next:      c.nextDial,
+		Failure:   c.failure,
+	}
+}
+
+// Report requests the client to push out an infection update. If the event is
+// currently connected, the report is sent straight away, otherwise the method
+// queues it up for delivery and will change the dial priority to high and
+// request an immediate dial too.
 func (c *Client) Report() {
+	c.lock.RLock()
+	live := c.live
+	c.lock.RUnlock()
+
+	logger := c.logger.New("event", c.infos.Identity.Fingerprint())
+	if live != nil {
+		go c.sendStatusReport(logger, live)
+		return
+	}
+	c.queueStatusReport(logger)
+
 	select {
-	case c.update <- &clientDialRequest{time: time.Now(), prio: params.EventInfectionUpdateRetry}:
+	case c.update <- &clientDialRequest{time: c.clock.Now(), prio: params.EventInfectionUpdateRetry}:
+	case <-c.terminated:
+	}
+}
+
+// Refresh requests the client to schedule an immediate dial to sync the latest
+// event statistics, without changing the dial priority.
+func (c *Client) Refresh() {
+	select {
+	case c.update <- &clientDialRequest{time: c.clock.Now(), prio: params.EventStatsRecheck}:
 	case <-c.terminated:
 	}
 }
@@ -216,10 +330,15 @@ func (c *Client) loop() {
 
 	// Initiate a dial straight away, schedule afterward
 	var (
-		nextTime = time.Now()
-		nextDial = time.NewTimer(0)
+		nextTime = c.clock.Now()
+		nextDial = c.clock.NewTimer(0)
 		nextPrio = params.EventStatsRecheck
 	)
+	if c.pending() {
+		nextPrio = params.EventInfectionUpdateRetry
+	}
+	c.scheduled(nextTime)
+
 	logger := c.logger.New("event", c.infos.Identity.Fingerprint())
 	for {
 		select {
@@ -232,17 +351,19 @@ func (c *Client) loop() {
 			// instantly.
 			if !nextDial.Stop() { // Both paths touch the dialer
 				select {
-				case <-nextDial.C:
+				case <-nextDial.C():
 				default:
 				}
 			}
-			nextTime = time.Now() // Ensures updates don't resume accidentally
+			nextTime = c.clock.Now() // Ensures updates don't resume accidentally
 
 			if suspend {
 				logger.Debug("Suspending event dialing")
+				c.scheduled(time.Time{})
 			} else {
 				logger.Debug("Resuming event dialing")
-				nextDial.Reset(time.Until(nextTime))
+				nextDial.Reset(nextTime.Sub(c.clock.Now()))
+				c.scheduled(nextTime)
 			}
 
 		case sched := <-c.update:
@@ -253,9 +374,10 @@ func (c *Client) loop() {
 				logger.Debug("Updated dial schedule", "old", nextTime, "new", sched.time)
 				nextTime = sched.time
 				if !nextDial.Stop() {
-					<-nextDial.C
+					<-nextDial.C()
 				}
-				nextDial.Reset(time.Until(nextTime))
+				nextDial.Reset(nextTime.Sub(c.clock.Now()))
+				c.scheduled(nextTime)
 			}
 			if nextPrio < sched.prio {
 				logger.Debug("Keeping earlier priority", "old", nextPrio, "new", sched.prio)
@@ -264,9 +386,9 @@ func (c *Client) loop() {
 				nextPrio = sched.prio
 			}
 
-		case <-nextDial.C:
+		case <-nextDial.C():
 			logger.Debug("Dialing event server")
-			if _, err := tornet.DialServer(context.TODO(), tornet.DialConfig{
+			if done, err := tornet.DialServer(context.TODO(), tornet.DialConfig{
 				Gateway:  c.gateway,
 				Address:  c.infos.Address,
 				Server:   c.infos.Identity,
@@ -274,33 +396,60 @@ func (c *Client) loop() {
 				PeerSet:  c.peerset,
 			}); err != nil {
 				// If dialing failed, reschedule with the same priority as before
-				logger.Error("Dialing event failed", "retry", nextPrio, "err", err)
-				nextTime = time.Now().Add(nextPrio)
+				if errors.Is(err, tornet.ErrUnreachable) {
+					logger.Info("Event offline, retrying", "retry", nextPrio, "err", err)
+				} else {
+					logger.Error("Dialing event failed", "retry", nextPrio, "err", err)
+				}
+				nextTime = c.clock.Now().Add(nextPrio)
 				nextDial.Reset(nextPrio)
+
+				c.lock.Lock()
+				c.nextDial, c.failure = nextTime, err
+				c.lock.Unlock()
 			} else {
-				// Dialing succeeded, reschedule with the default priority
-				logger.Debug("Dialing event succeeded", "schedule", params.EventStatsRecheck)
+				// Dialing succeeded, reschedule with the default priority, unless
+				// a report is still waiting for an ack. The authentication might
+				// still fail, track that too.
+				go c.watchRejection(done, logger)
+
 				nextPrio = params.EventStatsRecheck
-				nextTime = time.Now().Add(nextPrio)
+				if c.pending() {
+					nextPrio = params.EventInfectionUpdateRetry
+				}
+				logger.Debug("Dialing event succeeded", "schedule", nextPrio)
+				nextTime = c.clock.Now().Add(nextPrio)
 				nextDial.Reset(nextPrio)
+
+				c.lock.Lock()
+				c.dialed, c.nextDial, c.failure = c.clock.Now(), nextTime, nil
+				c.lock.Unlock()
 			}
 		}
 	}
 }
 
+// scheduled updates the time of the next dial to report in the connectivity.
+func (c *Client) scheduled(next time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.nextDial = next
+}
+
 // handleV1 is the network handler for the v1 `event` protocol. This method only
 // demultiplexes the checkin and the data exchange phases.
-func (c *Client) handleV1(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, logger log.Logger) {
+func (c *Client) handleV1(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps protocols.Capabilities, logger log.Logger) {
 	logger = logger.New("event", c.infos.Identity.Fingerprint())
 
 	c.lock.Lock()
-	checkin := c.infos.Checkin != nil
+	checkin := c.infos.Checkin
 	c.infos.Checkin = nil
 	c.lock.Unlock()
 
 	// Depending on the protocol phase, descend into checkin or data exchange
-	if checkin {
-		c.handleV1CheckIn(uid, conn, enc, dec, logger)
+	if checkin != nil {
+		c.handleV1CheckIn(uid, conn, enc, dec, checkin, logger)
 		return
 	}
 	c.handleV1DataExchange(uid, conn, enc, dec, logger)
@@ -311,28 +460,55 @@ func (c *Client) handleV1(uid tornet.IdentityFingerprint, conn net.Conn, enc *go
 func (c *Client) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, logger log.Logger) {
 	logger.Info("Running event data exchange")
 
-	// If the event metadata is missing, request it
+	// Track the live connection to push infection updates through directly
+	c.lock.Lock()
+	c.live = enc
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		if c.live == enc {
+			c.live = nil
+		}
+	}()
+
+	// If the event metadata is missing (or the banner never arrived), request it
 	c.lock.RLock()
-	nometa := c.infos.Name == ""
+	nometa := c.infos.Name == "" || c.infos.Banner == [32]byte{}
 	c.lock.RUnlock()
 
+	// Advertise the supported optional features piggybacked onto the requests,
+	// so the organizer knows what it may use when answering them. Legacy ones
+	// ignore the unknown field, but would drop a standalone advertisement.
+	features := &Capabilities{Features: supportedFeatures}
 	if nometa {
-		go enc.Encode(&Envelope{GetMetadata: &GetMetadata{}})
+		go enc.Encode(&Envelope{Capabilities: features, GetMetadata: &GetMetadata{}})
 	}
 	// Attempt to send over the current status and request new stats
 	go c.sendStatusReport(logger, enc)
-	go enc.Encode(&Envelope{GetStatus: &GetStatus{}})
+	go enc.Encode(&Envelope{Capabilities: features, GetStatus: &GetStatus{}})
 
 	// Start processing messages until torn down
 	for {
 		// Read the next message off the network
 		message := new(Envelope)
 		if err := dec.Decode(message); err != nil {
-			if err != io.EOF {
+			if err != io.EOF && err != tornet.ErrDraining {
 				log.Warn("Failed to decode message", "err", err)
 			}
 			return
 		}
+		// Track the capabilities piggybacked onto the organizer's replies, to know
+		// whether it's willing to retrieve avatars attached to infection reports
+		if message.Capabilities != nil {
+			logger.Debug("Organizer advertised capabilities", "features", message.Capabilities.Features)
+
+			c.lock.Lock()
+			c.features = newFeatureSet(message.Capabilities.Features)
+			c.lock.Unlock()
+		}
 		// Depending on what we've got, do something meaningful
 		switch {
 		case message.Metadata != nil:
@@ -343,19 +519,39 @@ func (c *Client) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.C
 				logger.Warn("Rejecting event without name")
 				return
 			}
-			if len(message.Metadata.Banner) == 0 {
+			if len(message.Metadata.Banner) == 0 && message.Metadata.BannerHash == ([32]byte{}) {
 				logger.Warn("Rejecting event without banner")
 				return
 			}
-			// Set the event metadata, unless it was already transmitted
+			if len(message.Metadata.Banner) > bannerMaxSize {
+				logger.Warn("Rejecting oversized banner", "bytes", len(message.Metadata.Banner))
+				return
+			}
+			// Set the event metadata, unless it was already transmitted. If only
+			// the banner is missing, accept the same metadata again.
 			c.lock.Lock()
-			if c.infos.Name != "" {
+			if c.infos.Name != "" && (c.infos.Name != message.Metadata.Name ||
+				c.infos.Description != message.Metadata.Description ||
+				c.infos.Location != message.Metadata.Location ||
+				c.infos.Banner != [32]byte{}) {
 				logger.Warn("Rejecting event metadata swap")
 				c.lock.Unlock()
 				return
 			}
-			c.banner = message.Metadata.Banner
 			c.infos.Name = message.Metadata.Name
+			c.infos.Description = message.Metadata.Description
+			c.infos.Location = message.Metadata.Location
+
+			// If the banner is too large to be inlined, start downloading it
+			if len(message.Metadata.Banner) == 0 {
+				c.bannerHash, c.bannerData = message.Metadata.BannerHash, nil
+				c.lock.Unlock()
+
+				c.guest.OnUpdate(c.infos.Identity.Fingerprint(), c)
+				go enc.Encode(&Envelope{GetBanner: &GetBanner{}})
+				continue
+			}
+			c.banner = message.Metadata.Banner
 			c.infos.Banner = sha3.Sum256(c.banner)
 			c.lock.Unlock()
 
@@ -363,20 +559,71 @@ func (c *Client) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.C
 			c.guest.OnBanner(c.infos.Identity.Fingerprint(), c.banner)
 			c.guest.OnUpdate(c.infos.Identity.Fingerprint(), c)
 
+		case message.Banner != nil:
+			logger.Debug("Organizer sent banner chunk", "offset", message.Banner.Offset, "bytes", len(message.Banner.Data), "total", message.Banner.Total)
+
+			// Make sure the chunk was requested and is the next expected one
+			c.lock.Lock()
+			if c.bannerHash == ([32]byte{}) {
+				logger.Warn("Rejecting unrequested banner chunk")
+				c.lock.Unlock()
+				return
+			}
+			if message.Banner.Offset != uint64(len(c.bannerData)) || len(message.Banner.Data) == 0 {
+				logger.Warn("Rejecting out of order banner chunk", "have", message.Banner.Offset, "want", len(c.bannerData))
+				c.lock.Unlock()
+				return
+			}
+			if message.Banner.Total > bannerMaxSize || uint64(len(c.bannerData)+len(message.Banner.Data)) > message.Banner.Total {
+				logger.Warn("Rejecting oversized banner", "total", message.Banner.Total)
+				c.lock.Unlock()
+				return
+			}
+			c.bannerData = append(c.bannerData, message.Banner.Data...)
+
+			// If more chunks are needed, request the next one
+			if uint64(len(c.bannerData)) < message.Banner.Total {
+				offset := uint64(len(c.bannerData))
+				c.lock.Unlock()
+
+				go enc.Encode(&Envelope{GetBanner: &GetBanner{Offset: offset}})
+				continue
+			}
+			// Banner fully downloaded, make sure it's the announced one
+			if sha3.Sum256(c.bannerData) != c.bannerHash {
+				logger.Warn("Rejecting banner with hash mismatch")
+				c.bannerHash, c.bannerData = [32]byte{}, nil
+				c.lock.Unlock()
+				return
+			}
+			c.banner, c.infos.Banner = c.bannerData, c.bannerHash
+			c.bannerHash, c.bannerData = [32]byte{}, nil
+			c.lock.Unlock()
+
+			// Event updated, persist it to disk (banner first, otherwise the above hash will break)
+			c.guest.OnBanner(c.infos.Identity.Fingerprint(), c.banner)
+			c.guest.OnUpdate(c.infos.Identity.Fingerprint(), c)
+
 		case message.Status != nil:
 			logger.Info("Organizer sent event status", "status", message.Status)
 
+			// Translate the event window into the local clock to counter any skew
+			now := time.Now()
+			skew := clockSkew(message.Status.Now, now)
+			start, end := localizeWindow(message.Status.Start, message.Status.End, skew, now)
+
 			// Update the event statistics, no way to verify these
 			c.lock.Lock()
+			c.infos.Skew = skew
 			if c.infos.Start == (time.Time{}) {
-				c.infos.Start = message.Status.Start
+				c.infos.Start = start
 				c.infos.Updated = time.Now()
 
 				// Event was completed just now, maybe send infection status
 				go c.sendStatusReport(logger, enc)
 			}
 			if c.infos.End == (time.Time{}) {
-				c.infos.End = message.Status.End
+				c.infos.End = end
 				c.infos.Updated = time.Now()
 			}
 			if c.infos.Attendees != message.Status.Attendees {
@@ -395,6 +642,10 @@ func (c *Client) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.C
 				c.infos.Positives = message.Status.Positives
 				c.infos.Updated = time.Now()
 			}
+			if c.infos.Recovered != message.Status.Recovered {
+				c.infos.Recovered = message.Status.Recovered
+				c.infos.Updated = time.Now()
+			}
 			c.infos.Synced = time.Now()
 			c.lock.Unlock()
 
@@ -402,38 +653,115 @@ func (c *Client) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.C
 			c.guest.OnUpdate(c.infos.Identity.Fingerprint(), c)
 
 		case message.ReportAck != nil:
-			logger.Info("Organizer sent report ack", "status", message.ReportAck.Status)
+			logger.Info("Organizer sent report ack", "status", message.ReportAck.Status, "rejected", message.ReportAck.Rejected)
+
+			// If the report was rejected, track the reason but leave the status alone.
+			// Stop retrying the pending report, the organizer will not change its mind.
+			if message.ReportAck.Rejected != "" {
+				c.lock.Lock()
+				if c.infos.Rejected == message.ReportAck.Rejected && c.infos.Pending == "" {
+					c.lock.Unlock()
+					continue
+				}
+				c.infos.Rejected = message.ReportAck.Rejected
+				if c.infos.Pending != "" {
+					c.infos.Refused, c.infos.Pending = c.infos.Pending, ""
+				}
+				c.lock.Unlock()
 
+				c.guest.OnUpdate(c.infos.Identity.Fingerprint(), c)
+				continue
+			}
 			// Update the maintained infection status, if possible
 			if !validInfectionStatus(message.ReportAck.Status) {
 				logger.Warn("Rejecting invalid status")
 				return
 			}
 			c.lock.Lock()
-			if !validInfectionTransition(c.infos.Status, message.ReportAck.Status) {
+			delivered := c.infos.Pending == message.ReportAck.Status
+			if delivered {
+				// Pending report acknowledged, stop retrying it
+				c.infos.Pending, c.infos.Refused = "", ""
+			}
+			if c.infos.Status == message.ReportAck.Status && c.infos.Rejected == "" {
+				// Duplicate ack of a re-delivered report, nothing else changed
+				c.lock.Unlock()
+
+				if delivered {
+					c.guest.OnUpdate(c.infos.Identity.Fingerprint(), c)
+				}
+				continue
+			}
+			if c.infos.Status == message.ReportAck.Status {
+				// Duplicate ack of an accepted report after a rejection, clear it
+				c.infos.Rejected = ""
+				c.lock.Unlock()
+
+				c.guest.OnUpdate(c.infos.Identity.Fingerprint(), c)
+				continue
+			}
+			if !ValidInfectionTransition(c.infos.Status, message.ReportAck.Status) {
 				logger.Warn("Rejecting malicious status ack", "old", c.infos.Status, "new", message.ReportAck.Status)
 				c.lock.Unlock()
 				return
 			}
 			c.infos.Status = message.ReportAck.Status
+			c.infos.Rejected = ""
 			c.lock.Unlock()
 
 			// Event updated, persist it to disk
 			c.guest.OnUpdate(c.infos.Identity.Fingerprint(), c)
 
+		case message.GetAvatar != nil:
+			logger.Debug("Organizer requested avatar chunk", "offset", message.GetAvatar.Offset)
+
+			// Only serve the avatar if it's still the one announced in the report
+			avatar := c.guest.Avatar(c.infos.Identity.Fingerprint())
+			if len(avatar) == 0 || sha3.Sum256(avatar) != message.GetAvatar.Hash {
+				logger.Debug("Requested avatar not available")
+				go enc.Encode(&Envelope{Avatar: &Avatar{}})
+				continue
+			}
+			if message.GetAvatar.Offset >= uint64(len(avatar)) {
+				logger.Warn("Avatar chunk out of bounds", "offset", message.GetAvatar.Offset, "size", len(avatar))
+				return
+			}
+			end := message.GetAvatar.Offset + avatarChunkSize
+			if end > uint64(len(avatar)) {
+				end = uint64(len(avatar))
+			}
+			go enc.Encode(&Envelope{Avatar: &Avatar{
+				Offset: message.GetAvatar.Offset,
+				Total:  uint64(len(avatar)),
+				Data:   avatar[message.GetAvatar.Offset:end],
+			}})
+
+		case message.Capabilities != nil:
+			// Standalone capabilities, already processed above
+
 		default:
-			logger.Warn("Organizer sent unknown message")
-			return
+			// Organizer might be running a newer version, skip the message
+			logger.Debug("Ignoring unknown message")
 		}
 	}
 }
 
-// sendStatusReport retrieves the guests latest status update for the event's
-// runtime and sends it over to the event server.
-func (c *Client) sendStatusReport(logger log.Logger, enc *gob.Encoder) error {
+// pending returns whether there is an infection status report waiting for the
+// organizer's acknowledgement.
+func (c *Client) pending() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.infos.Pending != ""
+}
+
+// queueStatusReport retrieves the guests latest status update for the event's
+// runtime and if it needs reporting, marks it pending until the organizer acks
+// it. The signed report is returned, or nil if there's nothing to send.
+func (c *Client) queueStatusReport(logger log.Logger) *Report {
 	// If we haven't yet retrieved event infos, try again later
 	c.lock.RLock()
-	start, end, old := c.infos.Start, c.infos.End, c.infos.Status
+	start, end, old, refused := c.infos.Start, c.infos.End, c.infos.Status, c.infos.Refused
 	c.lock.RUnlock()
 
 	if start == (time.Time{}) {
@@ -445,24 +773,69 @@ func (c *Client) sendStatusReport(logger log.Logger, enc *gob.Encoder) error {
 		end = time.Now() // TODO(karalabe): Maybe enforce a maximum duration
 	}
 	// Retrieve the current status from the guest and report if transition allowed
-	id, name, status, message := c.guest.Status(start, end)
-	if validInfectionTransition(old, status) {
-		logger.Info("Sending over infection status", "name", name, "status", status)
-
-		blob := c.infos.Identity
-		blob = append(blob, name...)
-		blob = append(blob, status...)
-		blob = append(blob, message...)
-
-		return enc.Encode(&Envelope{Report: &Report{
-			Name:      name,
-			Status:    status,
-			Message:   message,
-			Identity:  id.Public(),
-			Signature: id.Sign(blob),
-		}})
+	id, name, status, message := c.guest.Status(c.infos.Identity.Fingerprint(), start, end)
+	if !ValidInfectionTransition(old, status) {
+		logger.Debug("Status update noop, skipping", "old", old, "new", status)
+		return nil
+	}
+	if status == refused {
+		logger.Debug("Status update refused by organizer, skipping", "old", old, "new", status)
+		return nil
+	}
+	// Status needs reporting, make sure it's retried until acknowledged
+	c.lock.Lock()
+	queued := c.infos.Pending != status
+	c.infos.Pending = status
+	c.lock.Unlock()
+
+	if queued {
+		c.guest.OnUpdate(c.infos.Identity.Fingerprint(), c)
+	}
+	// Attach the profile picture if the organizer is known to retrieve them
+	c.lock.RLock()
+	avatars := c.features[featureAvatars]
+	c.lock.RUnlock()
+
+	var avatar [32]byte
+	if avatars {
+		if data := c.guest.Avatar(c.infos.Identity.Fingerprint()); len(data) > 0 {
+			avatar = sha3.Sum256(data)
+		}
+	}
+	report := &Report{
+		Name:     name,
+		Status:   status,
+		Message:  message,
+		Avatar:   avatar,
+		Identity: id.Public(),
 	}
-	// Status update was rejected, skip transmitting it
-	logger.Debug("Status update noop, skipping", "old", old, "new", status)
-	return nil
+	report.Signature = id.Sign(reportBlob(c.infos.Identity, report))
+	return report
+}
+
+// sendStatusReport retrieves the guests latest status update for the event's
+// runtime and sends it over to the event server.
+func (c *Client) sendStatusReport(logger log.Logger, enc *gob.Encoder) error {
+	report := c.queueStatusReport(logger)
+	if report == nil {
+		return nil
+	}
+	logger.Info("Sending over infection status", "name", report.Name, "status", report.Status)
+	return enc.Encode(&Envelope{Capabilities: &Capabilities{Features: supportedFeatures}, Report: report})
+}
+
+// watchRejection waits for a dialed connection to the event server to finish,
+// and if it was torn down because either side refused to authenticate the other,
+// records the failure.
+func (c *Client) watchRejection(done chan error, logger log.Logger) {
+	err := <-done
+	if !errors.Is(err, tornet.ErrRejected) && !errors.Is(err, tornet.ErrUnexpectedServer) &&
+		!errors.Is(err, tornet.ErrUnauthorizedKey) && !errors.Is(err, tornet.ErrInvalidKeyType) {
+		return
+	}
+	logger.Error("Event rejected us", "err", err)
+
+	c.lock.Lock()
+	c.failure = err
+	c.lock.Unlock()
 }
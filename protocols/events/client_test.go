@@ -0,0 +1,116 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Tests that the event client schedules its dials off of the injected clock,
+// periodically rechecking the stats and retrying sooner for infection reports.
+func TestClientDialScheduling(t *testing.T) {
+	start := time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC)
+	clock := tornet.NewSimulatedClock(start)
+
+	// Create an already checked in client for an event that's unreachable
+	identity, err := tornet.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("failed to generate event identity: %v", err)
+	}
+	address, err := tornet.GenerateAddress()
+	if err != nil {
+		t.Fatalf("failed to generate event address: %v", err)
+	}
+	pseudonym, err := tornet.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("failed to generate pseudonym: %v", err)
+	}
+	client, err := RecreateClient(newTestGuest(), tornet.NewMockGateway(), &ClientInfos{
+		Identity:  identity.Public(),
+		Address:   address.Public(),
+		Pseudonym: pseudonym,
+		Clock:     clock,
+	}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event client: %v", err)
+	}
+	defer client.Close()
+
+	// Waits until a failed dial is rescheduled for the given time
+	wait := func(want time.Time) {
+		var conn *Connectivity
+		for i := 0; i < 1000; i++ {
+			if conn = client.Connectivity(); conn.Failure != nil && conn.Next.Equal(want) {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("schedule mismatch: have %v, want %v", conn.Next, want)
+	}
+	// The initial dial fails, ensure it's retried at the stats recheck interval
+	wait(start.Add(params.EventStatsRecheck))
+
+	clock.Run(params.EventStatsRecheck)
+	wait(start.Add(2 * params.EventStatsRecheck))
+
+	// Request an infection report and ensure it's retried much sooner
+	client.Report()
+	now := start.Add(params.EventStatsRecheck)
+	wait(now.Add(params.EventInfectionUpdateRetry))
+
+	clock.Run(params.EventInfectionUpdateRetry)
+	wait(now.Add(2 * params.EventInfectionUpdateRetry))
+}
+
+// Tests that a client recreated with an infection report still pending delivery
+// keeps retrying it at the infection update interval, not the stats recheck one.
+func TestClientPendingReportRetry(t *testing.T) {
+	start := time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC)
+	clock := tornet.NewSimulatedClock(start)
+
+	// Create an already checked in client for an unreachable event with a report
+	// queued up from a previous run
+	identity, err := tornet.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("failed to generate event identity: %v", err)
+	}
+	address, err := tornet.GenerateAddress()
+	if err != nil {
+		t.Fatalf("failed to generate event address: %v", err)
+	}
+	pseudonym, err := tornet.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("failed to generate pseudonym: %v", err)
+	}
+	client, err := RecreateClient(newTestGuest(), tornet.NewMockGateway(), &ClientInfos{
+		Identity:  identity.Public(),
+		Address:   address.Public(),
+		Pseudonym: pseudonym,
+		Pending:   params.InfectionStatusPositive,
+		Clock:     clock,
+	}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event client: %v", err)
+	}
+	defer client.Close()
+
+	var conn *Connectivity
+	for i := 0; i < 1000; i++ {
+		if conn = client.Connectivity(); conn.Failure != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if want := start.Add(params.EventInfectionUpdateRetry); !conn.Next.Equal(want) {
+		t.Fatalf("schedule mismatch: have %v, want %v", conn.Next, want)
+	}
+	if pending := client.Infos().Pending; pending != params.InfectionStatusPositive {
+		t.Fatalf("pending report mismatch: have %s, want %s", pending, params.InfectionStatusPositive)
+	}
+}
@@ -0,0 +1,34 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package events
+
+const (
+	// featureBannerChunks is the capability to transfer banners too large to be
+	// inlined into the event metadata in separate chunks.
+	featureBannerChunks = "banner-chunks"
+
+	// featureAvatars is the capability to attach the hash of a profile picture
+	// to infection reports, which the organizer retrieves in separate chunks.
+	featureAvatars = "avatars"
+)
+
+// supportedFeatures is the list of optional protocol features supported by the
+// local implementation, advertised to the remote side on connection.
+var supportedFeatures = []string{
+	featureBannerChunks,
+	featureAvatars,
+}
+
+// featureSet is a lookup table of the optional features a remote peer supports.
+// A nil set is valid and means that the peer supports nothing optional.
+type featureSet map[string]bool
+
+// newFeatureSet creates a feature lookup table from an advertised list.
+func newFeatureSet(features []string) featureSet {
+	set := make(featureSet, len(features))
+	for _, feature := range features {
+		set[feature] = true
+	}
+	return set
+}
@@ -0,0 +1,252 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Tests that a feature-rich event server talking to a minimal participant that
+// does not support any optional features degrades gracefully: it does not use
+// any unsupported features and it tolerates unknown messages.
+func TestCapabilitiesDegradation(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gateway = tornet.NewMockGateway()
+		host    = newTestHost()
+	)
+	// Create an event server with a banner that would normally be chunked
+	host.banner = bytes.Repeat([]byte{0x01}, bannerInlineLimit+1)
+
+	server, err := CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	host.event = server
+	close(host.inited)
+
+	// Check a pseudonym in directly, without running a checkin round
+	pseudonym, err := tornet.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("failed to generate pseudonym: %v", err)
+	}
+	server.lock.Lock()
+	server.infos.Participants[pseudonym.Fingerprint()] = pseudonym.Public()
+	server.lock.Unlock()
+	server.peerset.Trust(pseudonym.Public())
+
+	// Connect to the server with a minimal client not supporting anything
+	type result struct {
+		features []string
+		metadata *Metadata
+		err      error
+	}
+	results := make(chan result, 1)
+
+	peerset := tornet.NewPeerSet(tornet.PeerSetConfig{
+		Trusted: []tornet.PublicIdentity{server.infos.Identity.Public()},
+		Handler: protocols.MakeHandler(protocols.HandlerConfig{
+			Protocol: Protocol,
+			Handlers: map[uint]protocols.Handler{
+				1: func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps protocols.Capabilities, logger log.Logger) {
+					// Send a message from the future and request the metadata without
+					// advertising any features, like a legacy participant would
+					for _, message := range []*Envelope{{}, {GetMetadata: &GetMetadata{}}} {
+						if err := enc.Encode(message); err != nil {
+							results <- result{err: err}
+							return
+						}
+					}
+					// Collect the server's capabilities and the metadata
+					var res result
+					for res.metadata == nil {
+						message := new(Envelope)
+						if err := dec.Decode(message); err != nil {
+							res.err = err
+							break
+						}
+						if message.Capabilities != nil {
+							res.features = message.Capabilities.Features
+						}
+						switch {
+						case message.Metadata != nil:
+							res.metadata = message.Metadata
+						default:
+							res.err = errors.New("unexpected message")
+						}
+						if res.err != nil {
+							break
+						}
+					}
+					results <- res
+				},
+			},
+		}),
+		Timeout: connectionIdleTimeout,
+		Logger:  log.Root(),
+	})
+	defer peerset.Close()
+
+	if _, err := tornet.DialServer(context.Background(), tornet.DialConfig{
+		Gateway:  gateway,
+		Address:  server.infos.Address.Public(),
+		Server:   server.infos.Identity.Public(),
+		Identity: pseudonym,
+		PeerSet:  peerset,
+	}); err != nil {
+		t.Fatalf("failed to dial event server: %v", err)
+	}
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("data exchange timed out")
+	}
+	if res.err != nil {
+		t.Fatalf("data exchange failed: %v", res.err)
+	}
+	// Ensure the server did not advertise nor use any of its features
+	if res.features != nil {
+		t.Errorf("server features advertised to legacy client: %v", res.features)
+	}
+	if res.metadata.BannerHash != ([32]byte{}) {
+		t.Errorf("chunked banner announced to unsupporting client")
+	}
+	if !bytes.Equal(res.metadata.Banner, host.banner) {
+		t.Errorf("inline banner mismatch: have %d bytes, want %d bytes", len(res.metadata.Banner), len(host.banner))
+	}
+}
+
+// legacyEnvelope is the wire envelope of organizers predating the optional
+// protocol features, which drop the connection on any message they do not know.
+type legacyEnvelope struct {
+	Disconnect  *protocols.Disconnect
+	Checkin     *Checkin
+	CheckinAck  *CheckinAck
+	GetMetadata *GetMetadata
+	Metadata    *legacyMetadata
+	GetStatus   *GetStatus
+	Status      *Status
+	Report      *Report
+	ReportAck   *ReportAck
+}
+
+// legacyMetadata is the event metadata of organizers predating chunked banners.
+type legacyMetadata struct {
+	Name   string
+	Banner []byte
+}
+
+// Tests that a feature-rich participant talking to a legacy organizer, which
+// drops the connection on unknown messages, still completes the data exchange.
+func TestCapabilitiesLegacyServer(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gateway = tornet.NewMockGateway()
+		guest   = newTestGuest()
+	)
+	// Create all the identities needed for an already checked in client
+	identity, err := tornet.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("failed to generate event identity: %v", err)
+	}
+	address, err := tornet.GenerateAddress()
+	if err != nil {
+		t.Fatalf("failed to generate event address: %v", err)
+	}
+	pseudonym, err := tornet.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("failed to generate pseudonym: %v", err)
+	}
+	// Start a legacy event server, dropping the connection on unknown messages
+	failures := make(chan error, 1)
+
+	peerset := tornet.NewPeerSet(tornet.PeerSetConfig{
+		Trusted: []tornet.PublicIdentity{pseudonym.Public()},
+		Handler: protocols.MakeHandler(protocols.HandlerConfig{
+			Protocol: Protocol,
+			Handlers: map[uint]protocols.Handler{
+				1: func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps protocols.Capabilities, logger log.Logger) {
+					for {
+						message := new(legacyEnvelope)
+						if err := dec.Decode(message); err != nil {
+							return
+						}
+						switch {
+						case message.GetMetadata != nil:
+							enc.Encode(&legacyEnvelope{Metadata: &legacyMetadata{Name: "barbecue", Banner: []byte{3, 1, 4}}})
+						case message.GetStatus != nil:
+							now := time.Now()
+							enc.Encode(&legacyEnvelope{Status: &Status{Start: now, Now: now, Attendees: 1}})
+						default:
+							select {
+							case failures <- errors.New("unknown message"):
+							default:
+							}
+							return
+						}
+					}
+				},
+			},
+		}),
+		Timeout: connectionIdleTimeout,
+		Logger:  log.Root(),
+	})
+	defer peerset.Close()
+
+	server, err := tornet.NewServer(tornet.ServerConfig{
+		Gateway:  gateway,
+		Address:  address,
+		Identity: identity,
+		PeerSet:  peerset,
+	})
+	if err != nil {
+		t.Fatalf("failed to create legacy event server: %v", err)
+	}
+	defer server.Close()
+
+	// Connect to the legacy server with an up-to-date client
+	client, err := RecreateClient(guest, gateway, &ClientInfos{
+		Identity:  identity.Public(),
+		Address:   address.Public(),
+		Pseudonym: pseudonym,
+	}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event client: %v", err)
+	}
+	defer client.Close()
+
+	guest.event = client
+	close(guest.inited)
+
+	// Wait until both the metadata and the status arrives
+	var infos *ClientInfos
+	for infos == nil || infos.Name == "" || infos.Start == (time.Time{}) {
+		select {
+		case infos = <-guest.update:
+		case <-guest.banner:
+		case err := <-failures:
+			t.Fatalf("legacy server dropped connection: %v", err)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("data exchange timed out")
+		}
+	}
+	if infos.Name != "barbecue" {
+		t.Errorf("event name mismatch: have %s, want %s", infos.Name, "barbecue")
+	}
+}
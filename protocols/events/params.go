@@ -11,37 +11,140 @@ import (
 
 const (
 	// connectionIdleTimeout is the maximum amount of time for a connection to
-	// remain idle before it is torn down (to save bandwidth and battery).
+	// remain idle before it is torn down (to save bandwidth and battery). The
+	// countdown restarts on traffic in either direction.
 	connectionIdleTimeout = time.Minute
 
+	// serverMaxPeers is the maximum number of distinct participants that may be
+	// connected to an event server at once, to avoid a flood of connections
+	// pinning down the organizer's resources.
+	//
+	// Note, reconnections are deliberately not rate limited, since the guests of
+	// a multi-use checkin window all share the same credential, connecting in
+	// quick succession. Deduplication already limits them to one at a time.
+	serverMaxPeers = 256
+
 	// checkinTimeout is the maximum amount of time for a checkin to complete
 	// before the connection is torn down.
 	checkinTimeout = 3 * time.Second
+
+	// bannerInlineLimit is the maximum size of a banner image that is sent along
+	// with the event metadata. Anything larger is transferred in chunks.
+	bannerInlineLimit = 64 * 1024
+
+	// bannerChunkSize is the size of the chunks to transfer large banners in.
+	bannerChunkSize = 16 * 1024
+
+	// bannerMaxSize is the maximum size of a banner image a participant accepts
+	// to download from an event.
+	bannerMaxSize = params.MaxImageBytes
+
+	// avatarChunkSize is the size of the chunks to transfer participant profile
+	// pictures in.
+	avatarChunkSize = 16 * 1024
+
+	// avatarMaxSize is the maximum size of a participant's profile picture that
+	// an organizer accepts to download.
+	avatarMaxSize = params.MaxImageBytes
+
+	// maxClockSkew is the maximum clock difference tolerated between a guest and
+	// an organizer. Anything above is deemed a broken clock and ignored.
+	maxClockSkew = 24 * time.Hour
 )
 
+// clockSkew estimates how far ahead the remote clock is compared to the local
+// one, based on a remote timestamp taken when the local clock read `local`. If
+// the remote time is missing or the skew is absurd, zero is returned.
+func clockSkew(remote time.Time, local time.Time) time.Duration {
+	if remote.IsZero() {
+		return 0
+	}
+	skew := remote.Sub(local)
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return 0
+	}
+	return skew
+}
+
+// localizeWindow translates an event time window from the remote clock into the
+// local one, clamping any obviously wrong timestamps: nothing can happen in the
+// future and nothing can end before it started. Zero times are left untouched.
+func localizeWindow(start, end time.Time, skew time.Duration, now time.Time) (time.Time, time.Time) {
+	if !start.IsZero() {
+		if start = start.Add(-skew); start.After(now) {
+			start = now
+		}
+	}
+	if !end.IsZero() {
+		if end = end.Add(-skew); end.After(now) {
+			end = now
+		}
+		if !start.IsZero() && end.Before(start) {
+			end = start
+		}
+	}
+	return start, end
+}
+
 // validInfectionStatus returns if the `status` string is valid according to the
 // `events` protocol.
 func validInfectionStatus(status string) bool {
 	return status == params.InfectionStatusUnknown || status == params.InfectionStatusNegative ||
-		status == params.InfectionStatusSuspected || status == params.InfectionStatusPositive
+		status == params.InfectionStatusSuspected || status == params.InfectionStatusPositive ||
+		status == params.InfectionStatusRecovered
 }
 
-// validInfectionTransition returns whether the `events` protocol permits going
-// form the `old` infection status to the `new` one. The purpose of the enforced
-// limitation is ensure the system reached a stable point eventually/
-func validInfectionTransition(old string, new string) bool {
-	// If nothing changed, reject the transition (avoids data mining)
-	if old == new {
-		return false
+// infectionTransitions is the state machine of infection statuses permitted by
+// the `events` protocol. The purpose of the enforced limitation is to ensure the
+// system reaches a stable point eventually:
+//
+//   - Nothing may transition into `unknown` or into the same status (avoids data
+//     mining through repeated reports).
+//   - `unknown` and `suspected` may go anywhere but `recovered`, since there was
+//     no confirmed infection to recover from.
+//   - A confirmed `positive` can only be exited by recovering from it, or by a
+//     negative test correcting a false positive.
+//   - `negative` and `recovered` are final.
+var infectionTransitions = map[string][]string{
+	params.InfectionStatusUnknown: {
+		params.InfectionStatusNegative,
+		params.InfectionStatusSuspected,
+		params.InfectionStatusPositive,
+	},
+	params.InfectionStatusSuspected: {
+		params.InfectionStatusNegative,
+		params.InfectionStatusPositive,
+	},
+	params.InfectionStatusPositive: {
+		params.InfectionStatusNegative,
+		params.InfectionStatusRecovered,
+	},
+	params.InfectionStatusNegative:  {},
+	params.InfectionStatusRecovered: {},
+}
+
+// InfectionStatusGraph returns the infection status transitions permitted by the
+// `events` protocol, mapping every status to the ones reachable from it. The
+// returned map is a copy, it's safe to modify.
+func InfectionStatusGraph() map[string][]string {
+	graph := make(map[string][]string, len(infectionTransitions))
+	for from, tos := range infectionTransitions {
+		graph[from] = append([]string{}, tos...)
 	}
-	// If the new status is unknown, reject the transition (avoids data mining)
-	if new == "" || new == params.InfectionStatusUnknown {
-		return false
+	return graph
+}
+
+// ValidInfectionTransition returns whether the `events` protocol permits going
+// from the `old` infection status to the `new` one. An empty `old` status is
+// treated as `unknown`.
+func ValidInfectionTransition(old string, new string) bool {
+	if old == "" {
+		old = params.InfectionStatusUnknown
 	}
-	// If the status is already confirmed positive or negative, there's nowhere to go
-	if old == params.InfectionStatusNegative || old == params.InfectionStatusPositive {
-		return false
+	for _, next := range infectionTransitions[old] {
+		if next == new {
+			return true
+		}
 	}
-	// At this point `old` is either `unknown` or `suspect` and `new` is higher, accept
-	return true
+	return false
 }
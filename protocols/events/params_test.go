@@ -0,0 +1,144 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+)
+
+// Tests that event windows received from organizers with skewed clocks are
+// correctly translated into the local clock, and broken times are clamped.
+func TestClockSkewWindow(t *testing.T) {
+	now := time.Date(2020, time.April, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		remote time.Time     // Organizer's clock when sending the status
+		start  time.Time     // Event start in the organizer's clock
+		end    time.Time     // Event end in the organizer's clock
+		skew   time.Duration // Expected skew estimate
+		wstart time.Time     // Expected start in the local clock
+		wend   time.Time     // Expected end in the local clock
+	}{
+		// Organizer clock in sync, nothing to adjust
+		{now, now.Add(-2 * time.Hour), now.Add(-time.Hour), 0, now.Add(-2 * time.Hour), now.Add(-time.Hour)},
+		// Organizer clock ahead, event just ended (would look like it's in the future)
+		{now.Add(time.Hour), now.Add(-time.Hour), now.Add(time.Hour), time.Hour, now.Add(-2 * time.Hour), now},
+		// Organizer clock behind, still running event
+		{now.Add(-30 * time.Minute), now.Add(-time.Hour), time.Time{}, -30 * time.Minute, now.Add(-30 * time.Minute), time.Time{}},
+		// Old organizer without clock, nothing to adjust
+		{time.Time{}, now.Add(-time.Hour), time.Time{}, 0, now.Add(-time.Hour), time.Time{}},
+		// Organizer clock is absurd, ignore the skew but clamp the future
+		{now.Add(30 * 24 * time.Hour), now.Add(29 * 24 * time.Hour), time.Time{}, 0, now, time.Time{}},
+		// Event ending before starting, clamp to the start
+		{now, now.Add(-time.Hour), now.Add(-2 * time.Hour), 0, now.Add(-time.Hour), now.Add(-time.Hour)},
+	}
+	for i, tt := range tests {
+		skew := clockSkew(tt.remote, now)
+		if skew != tt.skew {
+			t.Errorf("test %d: skew mismatch: have %v, want %v", i, skew, tt.skew)
+			continue
+		}
+		start, end := localizeWindow(tt.start, tt.end, skew, now)
+		if !start.Equal(tt.wstart) {
+			t.Errorf("test %d: start mismatch: have %v, want %v", i, start, tt.wstart)
+		}
+		if !end.Equal(tt.wend) {
+			t.Errorf("test %d: end mismatch: have %v, want %v", i, end, tt.wend)
+		}
+	}
+}
+
+// Tests that infection statuses only move towards confirmed states, but that
+// confirmed infections can be recovered from or corrected.
+func TestInfectionTransitions(t *testing.T) {
+	var (
+		unknown   = params.InfectionStatusUnknown
+		negative  = params.InfectionStatusNegative
+		suspected = params.InfectionStatusSuspected
+		positive  = params.InfectionStatusPositive
+		recovered = params.InfectionStatusRecovered
+	)
+	tests := []struct {
+		old  string
+		new  string
+		want bool
+	}{
+		{"", negative, true}, // Missing status treated as unknown
+		{"", recovered, false},
+		{unknown, unknown, false}, // No change
+		{unknown, negative, true},
+		{unknown, suspected, true},
+		{unknown, positive, true},
+		{unknown, recovered, false}, // Nothing to recover from
+		{negative, unknown, false},
+		{negative, negative, false},
+		{negative, suspected, false}, // Negative is final
+		{negative, positive, false},
+		{negative, recovered, false},
+		{suspected, unknown, false},
+		{suspected, negative, true},
+		{suspected, suspected, false}, // No change
+		{suspected, positive, true},
+		{suspected, recovered, false},
+		{positive, unknown, false},
+		{positive, negative, true}, // False positive correction
+		{positive, suspected, false},
+		{positive, positive, false},
+		{positive, recovered, true}, // Recovery
+		{recovered, unknown, false},
+		{recovered, negative, false},
+		{recovered, suspected, false}, // Recovered is final
+		{recovered, positive, false},
+		{recovered, recovered, false},
+		{"bogus", negative, false}, // Unknown statuses go nowhere
+		{unknown, "bogus", false},
+	}
+	for i, tt := range tests {
+		if have := ValidInfectionTransition(tt.old, tt.new); have != tt.want {
+			t.Errorf("test %d: transition %s -> %s mismatch: have %v, want %v", i, tt.old, tt.new, have, tt.want)
+		}
+	}
+}
+
+// Tests that the exported infection status graph matches the enforced rules and
+// that modifying it doesn't leak into the protocol.
+func TestInfectionStatusGraph(t *testing.T) {
+	statuses := []string{
+		params.InfectionStatusUnknown,
+		params.InfectionStatusNegative,
+		params.InfectionStatusSuspected,
+		params.InfectionStatusPositive,
+		params.InfectionStatusRecovered,
+	}
+	graph := InfectionStatusGraph()
+	if len(graph) != len(statuses) {
+		t.Fatalf("graph size mismatch: have %d, want %d", len(graph), len(statuses))
+	}
+	for _, from := range statuses {
+		tos, ok := graph[from]
+		if !ok {
+			t.Errorf("status %s missing from graph", from)
+			continue
+		}
+		for _, to := range statuses {
+			var listed bool
+			for _, next := range tos {
+				if next == to {
+					listed = true
+				}
+			}
+			if valid := ValidInfectionTransition(from, to); valid != listed {
+				t.Errorf("transition %s -> %s mismatch: graph %v, rules %v", from, to, listed, valid)
+			}
+		}
+	}
+	// Mess with the returned graph and ensure the rules are unaffected
+	graph[params.InfectionStatusNegative] = append(graph[params.InfectionStatusNegative], params.InfectionStatusPositive)
+	if ValidInfectionTransition(params.InfectionStatusNegative, params.InfectionStatusPositive) {
+		t.Errorf("graph modification leaked into the rules")
+	}
+}
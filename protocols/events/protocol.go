@@ -17,15 +17,20 @@ const Protocol = "events"
 // Envelope is an envelope containing all possible messages received through
 // the `events` wire protocol.
 type Envelope struct {
-	Disconnect  *protocols.Disconnect
-	Checkin     *Checkin
-	CheckinAck  *CheckinAck
-	GetMetadata *GetMetadata
-	Metadata    *Metadata
-	GetStatus   *GetStatus
-	Status      *Status
-	Report      *Report
-	ReportAck   *ReportAck
+	Disconnect   *protocols.Disconnect
+	Checkin      *Checkin
+	CheckinAck   *CheckinAck
+	Capabilities *Capabilities
+	GetMetadata  *GetMetadata
+	Metadata     *Metadata
+	GetBanner    *GetBanner
+	Banner       *Banner
+	GetStatus    *GetStatus
+	Status       *Status
+	Report       *Report
+	ReportAck    *ReportAck
+	GetAvatar    *GetAvatar
+	Avatar       *Avatar
 }
 
 // Checkin represents a request to attend an event.
@@ -35,15 +40,45 @@ type Checkin struct {
 }
 
 // CheckinAck represents the organizer's response to a checkin request.
-type CheckinAck struct{}
+type CheckinAck struct {
+	Signature tornet.Signature // Digital signature over the event identity and pseudonym
+	Binding   tornet.Signature // Digital signature over the event identity, checkin credential and pseudonym
+}
+
+// Capabilities advertises the optional protocol features supported by a peer. It
+// is never sent standalone, rather piggybacked onto a participant's requests in
+// the data exchange phase (and the organizer's replies to them), so that legacy
+// peers not knowing about it simply ignore the unknown field.
+type Capabilities struct {
+	Features []string // Optional protocol features supported by the sender
+}
 
 // GetMetadata requests the events permanent metadata.
 type GetMetadata struct{}
 
 // Metadata sends the events permanent metadata.
+//
+// Note, gob decoding ignores unknown fields and leaves missing ones zero, so new
+// fields can be added without breaking older guests or organizers.
 type Metadata struct {
-	Name   string // Free form name the event is advertising
-	Banner []byte // Binary image of banner, mime not restricted for now
+	Name        string   // Free form name the event is advertising
+	Description string   // Free form description of the event (optional)
+	Location    string   // Free form location of the event (optional)
+	Banner      []byte   // Binary image of banner, mime not restricted for now (nil if too large)
+	BannerHash  [32]byte // SHA3 hash of the banner if it's too large to send inline
+}
+
+// GetBanner requests a chunk of the event's banner image, if it was too large
+// to be sent inline with the metadata.
+type GetBanner struct {
+	Offset uint64 // Byte offset of the chunk to retrieve
+}
+
+// Banner sends a chunk of the event's banner image.
+type Banner struct {
+	Offset uint64 // Byte offset of the chunk within the banner
+	Total  uint64 // Total size of the banner in bytes
+	Data   []byte // Binary content of the chunk
 }
 
 // GetStatus requests the public statistics and infos of an event.
@@ -53,24 +88,45 @@ type GetStatus struct{}
 type Status struct {
 	Start time.Time // Timestamp when the event started
 	End   time.Time // Timestamp when the event ended (0 if not ended)
+	Now   time.Time // Organizer's wall clock time when sending the status
 
 	Attendees uint // Number of participants in the event
 	Negatives uint // Participants who reported negative test results
 	Suspected uint // Participants who might have been infected
 	Positives uint // Participants who reported positive infection
+	Recovered uint // Participants who recovered from a positive infection
 }
 
 // Report is an infection status update from a participant.
 type Report struct {
 	Name    string // Free form name the user is advertising (might be fake)
-	Status  string // Infection status (unknown, negative, suspect, positive)
+	Status  string // Infection status (unknown, negative, suspect, positive, recovered)
 	Message string // Any personal message for the status update
 
+	Avatar [32]byte // SHA3 hash of the reporter's profile picture (zero if none)
+
 	Identity  tornet.PublicIdentity // Permanent identity to reporting with
 	Signature tornet.Signature      // Signature over the event identity and above fields
 }
 
 // ReportAck is a receipt confirmation from the organizer.
 type ReportAck struct {
-	Status string // Currently maintained infection status
+	Status   string // Currently maintained infection status
+	Rejected string // Reason if the report was rejected (empty if accepted)
+}
+
+// GetAvatar requests a chunk of a participant's profile picture, announced by
+// its hash in an infection report. Opposed to the other requests, this one is
+// sent by the organizer to the participant.
+type GetAvatar struct {
+	Hash   [32]byte // SHA3 hash of the profile picture to retrieve
+	Offset uint64   // Byte offset of the chunk to retrieve
+}
+
+// Avatar sends a chunk of a participant's profile picture. An empty chunk with
+// a zero total signals that the requested picture is not available any more.
+type Avatar struct {
+	Offset uint64 // Byte offset of the chunk within the profile picture
+	Total  uint64 // Total size of the profile picture in bytes
+	Data   []byte // Binary content of the chunk
 }
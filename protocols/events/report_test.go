@@ -0,0 +1,484 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/protocols"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/ethereum/go-ethereum/log"
+	"golang.org/x/crypto/sha3"
+)
+
+// Tests that re-delivering an already processed infection report (e.g. after a
+// lost ack) is acknowledged, but not integrated into the event a second time.
+func TestReportDeduplication(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gateway = tornet.NewMockGateway()
+		host    = newTestHost()
+	)
+	host.reports = make(chan tornet.IdentityFingerprint, 2)
+
+	server, err := CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	host.event = server
+	close(host.inited)
+
+	// Check a pseudonym in directly, without running a checkin round
+	pseudonym, err := tornet.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("failed to generate pseudonym: %v", err)
+	}
+	server.lock.Lock()
+	server.infos.Participants[pseudonym.Fingerprint()] = pseudonym.Public()
+	server.lock.Unlock()
+	server.peerset.Trust(pseudonym.Public())
+
+	// Sign a positive report with a real identity
+	identity, err := tornet.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("failed to generate identity: %v", err)
+	}
+	blob := server.infos.Identity.Public()
+	blob = append(blob, "Bob"...)
+	blob = append(blob, params.InfectionStatusPositive...)
+
+	report := &Report{
+		Name:      "Bob",
+		Status:    params.InfectionStatusPositive,
+		Identity:  identity.Public(),
+		Signature: identity.Sign(blob),
+	}
+	// Connect to the server and deliver the same report twice
+	acks := make(chan string, 2)
+	errc := make(chan error, 1)
+
+	peerset := tornet.NewPeerSet(tornet.PeerSetConfig{
+		Trusted: []tornet.PublicIdentity{server.infos.Identity.Public()},
+		Handler: protocols.MakeHandler(protocols.HandlerConfig{
+			Protocol: Protocol,
+			Handlers: map[uint]protocols.Handler{
+				1: func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps protocols.Capabilities, logger log.Logger) {
+					for i := 0; i < 2; i++ {
+						if err := enc.Encode(&Envelope{Report: report}); err != nil {
+							errc <- err
+							return
+						}
+						message := new(Envelope)
+						if err := dec.Decode(message); err != nil {
+							errc <- err
+							return
+						}
+						if message.ReportAck != nil {
+							acks <- message.ReportAck.Status
+						}
+					}
+				},
+			},
+		}),
+		Timeout: connectionIdleTimeout,
+		Logger:  log.Root(),
+	})
+	defer peerset.Close()
+
+	if _, err := tornet.DialServer(context.Background(), tornet.DialConfig{
+		Gateway:  gateway,
+		Address:  server.infos.Address.Public(),
+		Server:   server.infos.Identity.Public(),
+		Identity: pseudonym,
+		PeerSet:  peerset,
+	}); err != nil {
+		t.Fatalf("failed to dial event server: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case status := <-acks:
+			if status != params.InfectionStatusPositive {
+				t.Errorf("ack %d: status mismatch: have %s, want %s", i, status, params.InfectionStatusPositive)
+			}
+		case <-host.update:
+			i-- // Drain persistence notifications, not an ack
+		case err := <-errc:
+			t.Fatalf("report delivery failed: %v", err)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("report ack %d timed out", i)
+		}
+	}
+	// Ensure the report was only integrated once
+	if n := len(host.reports); n != 1 {
+		t.Errorf("report notification count mismatch: have %d, want %d", n, 1)
+	}
+	infos := server.Infos()
+	if n := len(infos.Statuses); n != 1 {
+		t.Errorf("stored status count mismatch: have %d, want %d", n, 1)
+	}
+	if n := len(infos.Reports); n != 1 {
+		t.Errorf("stored report count mismatch: have %d, want %d", n, 1)
+	}
+}
+
+// Tests that an infection report not reachable from the status maintained by the
+// organizer is acknowledged as rejected, leaving the maintained status intact.
+func TestReportRejection(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gateway = tornet.NewMockGateway()
+		host    = newTestHost()
+	)
+	host.reports = make(chan tornet.IdentityFingerprint, 2)
+
+	server, err := CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	host.event = server
+	close(host.inited)
+
+	// Check a pseudonym in directly, without running a checkin round
+	pseudonym, err := tornet.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("failed to generate pseudonym: %v", err)
+	}
+	server.lock.Lock()
+	server.infos.Participants[pseudonym.Fingerprint()] = pseudonym.Public()
+	server.lock.Unlock()
+	server.peerset.Trust(pseudonym.Public())
+
+	// Sign a positive report followed by an invalid suspected one
+	identity, err := tornet.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("failed to generate identity: %v", err)
+	}
+	var reports []*Report
+	for _, status := range []string{params.InfectionStatusPositive, params.InfectionStatusSuspected} {
+		blob := server.infos.Identity.Public()
+		blob = append(blob, "Bob"...)
+		blob = append(blob, status...)
+
+		reports = append(reports, &Report{
+			Name:      "Bob",
+			Status:    status,
+			Identity:  identity.Public(),
+			Signature: identity.Sign(blob),
+		})
+	}
+	// Connect to the server and deliver both reports
+	acks := make(chan *ReportAck, 2)
+	errc := make(chan error, 1)
+
+	peerset := tornet.NewPeerSet(tornet.PeerSetConfig{
+		Trusted: []tornet.PublicIdentity{server.infos.Identity.Public()},
+		Handler: protocols.MakeHandler(protocols.HandlerConfig{
+			Protocol: Protocol,
+			Handlers: map[uint]protocols.Handler{
+				1: func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps protocols.Capabilities, logger log.Logger) {
+					for _, report := range reports {
+						if err := enc.Encode(&Envelope{Report: report}); err != nil {
+							errc <- err
+							return
+						}
+						message := new(Envelope)
+						if err := dec.Decode(message); err != nil {
+							errc <- err
+							return
+						}
+						if message.ReportAck != nil {
+							acks <- message.ReportAck
+						}
+					}
+				},
+			},
+		}),
+		Timeout: connectionIdleTimeout,
+		Logger:  log.Root(),
+	})
+	defer peerset.Close()
+
+	if _, err := tornet.DialServer(context.Background(), tornet.DialConfig{
+		Gateway:  gateway,
+		Address:  server.infos.Address.Public(),
+		Server:   server.infos.Identity.Public(),
+		Identity: pseudonym,
+		PeerSet:  peerset,
+	}); err != nil {
+		t.Fatalf("failed to dial event server: %v", err)
+	}
+	wants := []*ReportAck{
+		{Status: params.InfectionStatusPositive},
+		{Status: params.InfectionStatusPositive, Rejected: ErrInvalidTransition.Error()},
+	}
+	for i := 0; i < len(wants); i++ {
+		select {
+		case ack := <-acks:
+			if *ack != *wants[i] {
+				t.Errorf("ack %d: mismatch: have %+v, want %+v", i, ack, wants[i])
+			}
+		case <-host.update:
+			i-- // Drain persistence notifications, not an ack
+		case err := <-errc:
+			t.Fatalf("report delivery failed: %v", err)
+		case <-time.After(3 * time.Second):
+			t.Fatalf("report ack %d timed out", i)
+		}
+	}
+	// Ensure the rejected report didn't change the maintained status
+	if status := server.Infos().Statuses[pseudonym.Fingerprint()]; status != params.InfectionStatusPositive {
+		t.Errorf("maintained status mismatch: have %s, want %s", status, params.InfectionStatusPositive)
+	}
+	// Ensure a guest can map the rejection back into a typed error
+	infos := &ClientInfos{Rejected: wants[1].Rejected}
+	if err := infos.ReportError(); err != ErrInvalidTransition {
+		t.Errorf("report error mismatch: have %v, want %v", err, ErrInvalidTransition)
+	}
+}
+
+// testReporter is a mock guest reporting a configurable infection status.
+type testReporter struct {
+	identity tornet.SecretIdentity
+	status   string
+	avatar   []byte
+	lock     sync.Mutex
+}
+
+func (r *testReporter) Status(event tornet.IdentityFingerprint, start, end time.Time) (id tornet.SecretIdentity, name string, status string, message string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.identity, "Bob", r.status, ""
+}
+
+func (r *testReporter) setStatus(status string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.status = status
+}
+
+func (r *testReporter) Avatar(event tornet.IdentityFingerprint) []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.avatar
+}
+
+func (r *testReporter) OnUpdate(event tornet.IdentityFingerprint, client *Client) {}
+func (r *testReporter) OnBanner(event tornet.IdentityFingerprint, banner []byte)  {}
+
+// Tests that an infection report is kept pending until the organizer acks it,
+// after which it's not resent; and that a rejected one is not retried.
+func TestReportRetryUntilAcked(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gateway = tornet.NewMockGateway()
+		host    = newTestHost()
+	)
+	host.reports = make(chan tornet.IdentityFingerprint, 4)
+
+	server, err := CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	host.event = server
+	close(host.inited)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-host.update:
+			case <-done:
+				return
+			}
+		}
+	}()
+	// Join the event with a suspected status and wait for the report to be acked
+	identity, err := tornet.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("failed to generate identity: %v", err)
+	}
+	guest := &testReporter{identity: identity, status: params.InfectionStatusSuspected}
+
+	session, err := server.Checkin()
+	if err != nil {
+		t.Fatalf("failed to create checkin session: %v", err)
+	}
+	client, err := CreateClient(guest, gateway, session.Identity, session.Address, session.Auth, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event client: %v", err)
+	}
+	defer client.Close()
+
+	select {
+	case <-host.reports:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("infection report timed out")
+	}
+	waitInfos := func(check func(infos *ClientInfos) bool) *ClientInfos {
+		var infos *ClientInfos
+		for i := 0; i < 500; i++ {
+			if infos = client.Infos(); check(infos) {
+				return infos
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("client infos mismatch: have %+v", infos)
+		return nil
+	}
+	waitInfos(func(infos *ClientInfos) bool {
+		return infos.Status == params.InfectionStatusSuspected && infos.Pending == ""
+	})
+	// Request a new report and ensure the acked status is not resent
+	client.Report()
+	time.Sleep(100 * time.Millisecond)
+
+	if n := len(host.reports); n != 0 {
+		t.Fatalf("duplicate report count mismatch: have %d, want %d", n, 0)
+	}
+	if pending := client.Infos().Pending; pending != "" {
+		t.Fatalf("acked report pending: %s", pending)
+	}
+	// Make the organizer disagree with the next report and ensure it's dropped
+	server.lock.Lock()
+	server.infos.Statuses[client.infos.Pseudonym.Fingerprint()] = params.InfectionStatusNegative
+	server.lock.Unlock()
+
+	guest.setStatus(params.InfectionStatusPositive)
+	client.Report()
+
+	waitInfos(func(infos *ClientInfos) bool {
+		return infos.Refused == params.InfectionStatusPositive && infos.Pending == "" && infos.Rejected != ""
+	})
+	client.Report()
+	time.Sleep(100 * time.Millisecond)
+
+	if pending := client.Infos().Pending; pending != "" {
+		t.Fatalf("refused report requeued: %s", pending)
+	}
+}
+
+// Tests that an avatar attached to an infection report is retrieved by the
+// organizer in chunks, and that an oversized one is refused without affecting
+// the report itself.
+func TestReportAvatar(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gateway = tornet.NewMockGateway()
+		host    = newTestHost()
+	)
+	host.reports = make(chan tornet.IdentityFingerprint, 2)
+	host.avatars = make(chan []byte, 2)
+
+	server, err := CreateServer(host, gateway, "barbecue", "", "", [32]byte{3, 1, 4}, log.Root())
+	if err != nil {
+		t.Fatalf("failed to create event server: %v", err)
+	}
+	defer server.Close()
+
+	host.event = server
+	close(host.inited)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-host.update:
+			case <-done:
+				return
+			}
+		}
+	}()
+	// join checks a new reporter with the given avatar into the event, waiting
+	// for its infection report to arrive
+	join := func(avatar []byte) *Client {
+		identity, err := tornet.GenerateIdentity()
+		if err != nil {
+			t.Fatalf("failed to generate identity: %v", err)
+		}
+		guest := &testReporter{identity: identity, status: params.InfectionStatusSuspected, avatar: avatar}
+
+		session, err := server.Checkin()
+		if err != nil {
+			t.Fatalf("failed to create checkin session: %v", err)
+		}
+		client, err := CreateClient(guest, gateway, session.Identity, session.Address, session.Auth, log.Root())
+		if err != nil {
+			t.Fatalf("failed to create event client: %v", err)
+		}
+		select {
+		case <-host.reports:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("infection report timed out")
+		}
+		return client
+	}
+	// Report with an avatar spanning multiple chunks and ensure it's retrieved
+	avatar := make([]byte, 2*avatarChunkSize+1)
+	for i := range avatar {
+		avatar[i] = byte(i)
+	}
+	client := join(avatar)
+	defer client.Close()
+
+	select {
+	case have := <-host.avatars:
+		if !bytes.Equal(have, avatar) {
+			t.Fatalf("avatar mismatch: have %d bytes, want %d bytes", len(have), len(avatar))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("avatar retrieval timed out")
+	}
+	pseudonym := client.Infos().Pseudonym.Fingerprint()
+	for i := 0; ; i++ {
+		if server.Infos().Avatars[pseudonym] == sha3.Sum256(avatar) {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("avatar hash not tracked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, participant := range server.Infos().Roster() {
+		if want := participant.Pseudonym == pseudonym; participant.Avatar != want {
+			t.Errorf("participant %s avatar mismatch: have %v, want %v", participant.Pseudonym, participant.Avatar, want)
+		}
+	}
+	// Report with an oversized avatar and ensure it's refused
+	oversized := join(make([]byte, avatarMaxSize+1))
+	defer oversized.Close()
+
+	select {
+	case have := <-host.avatars:
+		t.Fatalf("oversized avatar accepted: %d bytes", len(have))
+	case <-time.After(500 * time.Millisecond):
+	}
+	if hash, ok := server.Infos().Avatars[oversized.Infos().Pseudonym.Fingerprint()]; ok {
+		t.Fatalf("oversized avatar tracked: %x", hash)
+	}
+	if status := server.Infos().Statuses[oversized.Infos().Pseudonym.Fingerprint()]; status != params.InfectionStatusSuspected {
+		t.Fatalf("report status mismatch: have %s, want %s", status, params.InfectionStatusSuspected)
+	}
+}
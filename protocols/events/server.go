@@ -4,6 +4,7 @@
 package events
 
 import (
+	"context"
 	"crypto/ed25519"
 	"encoding/gob"
 	"errors"
@@ -17,12 +18,30 @@ import (
 	"github.com/coronanet/go-coronanet/protocols"
 	"github.com/coronanet/go-coronanet/tornet"
 	"github.com/ethereum/go-ethereum/log"
+	"golang.org/x/crypto/sha3"
 )
 
 var (
 	// ErrEventConcluded is returned if an operation is attempted on an event that
 	// is forbidden after it's closing date.
 	ErrEventConcluded = errors.New("event concluded")
+
+	// ErrEventNotConcluded is returned if an event is attempted to be reopened
+	// while it is still running.
+	ErrEventNotConcluded = errors.New("event not concluded")
+
+	// ErrCheckinMismatch is returned if the checkin acknowledgement of an event
+	// does not bind the used checkin credential to the event's identity, meaning
+	// the credential was not issued by the event that was dialed.
+	ErrCheckinMismatch = errors.New("checkin credential mismatch")
+
+	// ErrCheckinNotFound is returned if a checkin session is attempted to be
+	// revoked, but no live session exists with the given credential.
+	ErrCheckinNotFound = errors.New("checkin session not found")
+
+	// ErrInvalidTransition is returned if a participant reports an infection
+	// status not reachable from the one the organizer maintains for them.
+	ErrInvalidTransition = errors.New("invalid infection status transition")
 )
 
 // Host defines the methods needed to run a live event. They revolve around
@@ -41,6 +60,11 @@ type Host interface {
 	// that changes the status of the event. The organizer may store the message
 	// for later verification.
 	OnReport(event tornet.IdentityFingerprint, server *Server, pseudonym tornet.IdentityFingerprint, message string) error
+
+	// OnAvatar is invoked when the profile picture announced by a participant in
+	// an infection report was downloaded and verified. The server only starts
+	// tracking the avatar's hash if the host successfully stored the image.
+	OnAvatar(event tornet.IdentityFingerprint, server *Server, pseudonym tornet.IdentityFingerprint, avatar []byte) error
 }
 
 // ServerInfos is all the data maintained about a local event. It is pre-tagged
@@ -54,11 +78,16 @@ type ServerInfos struct {
 	Identities   map[tornet.IdentityFingerprint]tornet.PublicIdentity `json:"identities"`   // Real participant credentials
 	Statuses     map[tornet.IdentityFingerprint]string                `json:"statuses"`     // Participant infection statuses
 	Names        map[tornet.IdentityFingerprint]string                `json:"names"`        // Real participant names
+	Checkins     map[tornet.IdentityFingerprint]time.Time             `json:"checkins"`     // Participant checkin timestamps
+	Reports      map[tornet.IdentityFingerprint][32]byte              `json:"reports"`      // Last processed report ids
+	Avatars      map[tornet.IdentityFingerprint][32]byte              `json:"avatars"`      // Participant profile picture hashes
 
-	Name   string    `json:"name"`   // Name of the event
-	Banner [32]byte  `json:"banner"` // Banner image hash of the event
-	Start  time.Time `json:"start"`  // Start time of the event
-	End    time.Time `json:"end"`    // Conclusion time of the event
+	Name        string    `json:"name"`                  // Name of the event
+	Description string    `json:"description,omitempty"` // Description of the event
+	Location    string    `json:"location,omitempty"`    // Location of the event
+	Banner      [32]byte  `json:"banner"`                // Banner image hash of the event
+	Start       time.Time `json:"start"`                 // Start time of the event
+	End         time.Time `json:"end"`                   // Conclusion time of the event
 
 	Updated time.Time `json:"updated"` // Time when the event was last modified
 }
@@ -80,8 +109,8 @@ type Server struct {
 }
 
 // CreateServer creates a brand new event server with the given matadata and a
-// new random identity and address.
-func CreateServer(host Host, gateway tornet.Gateway, name string, banner [32]byte, logger log.Logger) (*Server, error) {
+// new random identity and address. The metadata cannot be changed afterwards.
+func CreateServer(host Host, gateway tornet.Gateway, name string, description string, location string, banner [32]byte, logger log.Logger) (*Server, error) {
 	// Generate the permanent identities of the event
 	identity, err := tornet.GenerateIdentity()
 	if err != nil {
@@ -99,7 +128,12 @@ func CreateServer(host Host, gateway tornet.Gateway, name string, banner [32]byt
 		Identities:   make(map[tornet.IdentityFingerprint]tornet.PublicIdentity),
 		Statuses:     make(map[tornet.IdentityFingerprint]string),
 		Names:        make(map[tornet.IdentityFingerprint]string),
+		Checkins:     make(map[tornet.IdentityFingerprint]time.Time),
+		Reports:      make(map[tornet.IdentityFingerprint][32]byte),
+		Avatars:      make(map[tornet.IdentityFingerprint][32]byte),
 		Name:         name,
+		Description:  description,
+		Location:     location,
 		Banner:       banner,
 		Start:        time.Now(),
 		Updated:      time.Now(),
@@ -109,6 +143,18 @@ func CreateServer(host Host, gateway tornet.Gateway, name string, banner [32]byt
 // RecreateServer reloads a previously existent event server from a persisted
 // configuration dump.
 func RecreateServer(host Host, gateway tornet.Gateway, infos *ServerInfos, logger log.Logger) (*Server, error) {
+	// Events persisted before checkin times were tracked lack the map, create it
+	if infos.Checkins == nil {
+		infos.Checkins = make(map[tornet.IdentityFingerprint]time.Time)
+	}
+	// Events persisted before reports were deduplicated lack the map, create it
+	if infos.Reports == nil {
+		infos.Reports = make(map[tornet.IdentityFingerprint][32]byte)
+	}
+	// Events persisted before avatars were supported lack the map, create it
+	if infos.Avatars == nil {
+		infos.Avatars = make(map[tornet.IdentityFingerprint][32]byte)
+	}
 	// Assemble the server, ready to be published
 	trusted := make([]tornet.PublicIdentity, 0, len(infos.Participants)+1)
 	for _, id := range infos.Participants {
@@ -128,9 +174,12 @@ func RecreateServer(host Host, gateway tornet.Gateway, infos *ServerInfos, logge
 			Handlers: map[uint]protocols.Handler{
 				1: server.handleV1,
 			},
+			Tracer:   protocols.TracerOf(host),
+			Envelope: func() interface{} { return new(Envelope) },
 		}),
-		Timeout: connectionIdleTimeout,
-		Logger:  logger,
+		Timeout:  connectionIdleTimeout,
+		MaxConns: serverMaxPeers,
+		Logger:   logger,
 	})
 	var err error
 	server.server, err = tornet.NewServer(tornet.ServerConfig{
@@ -164,6 +213,18 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// Connections returns the number of live connections with participants.
+func (s *Server) Connections() int {
+	return s.peerset.Count()
+}
+
+// Drain stops accepting new connections and waits (bounded by the context) for
+// all active data exchanges to finish their in-flight messages. The event server
+// should be torn down afterwards via Close.
+func (s *Server) Drain(ctx context.Context) error {
+	return s.peerset.Drain(ctx)
+}
+
 // Infos retrieves a copy of the event server's internal state for persistence.
 // The copy is not safe for modification, only from data races.
 func (s *Server) Infos() *ServerInfos {
@@ -184,6 +245,22 @@ func (s *Server) Infos() *ServerInfos {
 	for uid, status := range s.infos.Statuses {
 		infos.Statuses[uid] = status
 	}
+	infos.Names = make(map[tornet.IdentityFingerprint]string)
+	for uid, name := range s.infos.Names {
+		infos.Names[uid] = name
+	}
+	infos.Checkins = make(map[tornet.IdentityFingerprint]time.Time)
+	for uid, time := range s.infos.Checkins {
+		infos.Checkins[uid] = time
+	}
+	infos.Reports = make(map[tornet.IdentityFingerprint][32]byte)
+	for uid, id := range s.infos.Reports {
+		infos.Reports[uid] = id
+	}
+	infos.Avatars = make(map[tornet.IdentityFingerprint][32]byte)
+	for uid, hash := range s.infos.Avatars {
+		infos.Avatars[uid] = hash
+	}
 	return &infos
 }
 
@@ -218,23 +295,49 @@ func (s *Server) Terminate() error {
 	return nil
 }
 
+// Reopen undoes the termination of an event, clearing its end time and thus also
+// allowing participants to check in again.
+//
+// Note, participants that already synced the end time will not pick up on the
+// change, so an event should only be reopened shortly after terminating it.
+func (s *Server) Reopen() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.infos.End == (time.Time{}) {
+		return ErrEventNotConcluded
+	}
+	s.infos.End = time.Time{}
+	s.infos.Updated = time.Now()
+
+	return nil
+}
+
 // handleV1 is the network handler for the v1 `event` protocol. This method only
 // demultiplexes the checkin and the data exchange phases.
-func (s *Server) handleV1(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, logger log.Logger) {
+func (s *Server) handleV1(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps protocols.Capabilities, logger log.Logger) {
 	// Add the event id to the logger in case of concurrent events
 	logger = logger.New("event", s.infos.Identity.Fingerprint())
 
-	// If the connection is a checkin, discard the session upon completion
+	// If the connection is a single use checkin, discard the session upon completion
 	s.lock.Lock()
 	session := s.checkins[uid]
-	if session != nil {
-		defer session.close()
+	if session != nil && session.expiry == nil {
+		defer func() {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+
+			session.close()
+		}()
 	}
 	s.lock.Unlock()
 
 	// Depending on the protocol phase, descend into checkin or data exchange
 	if session != nil {
-		session.result <- s.handleV1CheckIn(uid, conn, enc, dec, logger)
+		err := s.handleV1CheckIn(uid, conn, enc, dec, session, logger)
+		if session.expiry == nil {
+			session.finish(err)
+		}
 		return
 	}
 	s.handleV1DataExchange(uid, conn, enc, dec, logger)
@@ -245,16 +348,54 @@ func (s *Server) handleV1(uid tornet.IdentityFingerprint, conn net.Conn, enc *go
 func (s *Server) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, logger log.Logger) {
 	logger.Info("Running event data exchange")
 
+	// Route all replies through a priority queue, so that banner chunks don't
+	// delay status updates on slow circuits
+	sender := protocols.NewSender(enc)
+	defer sender.Close()
+
+	// Until the participant advertises its capabilities, assume it has none
+	var peer featureSet
+
+	// Track the participant's avatar being downloaded in chunks (zero if none)
+	var (
+		avatarHash [32]byte
+		avatarData []byte
+	)
+	// requestAvatar starts downloading the avatar announced in a report, unless
+	// it's already known or being downloaded
+	requestAvatar := func(hash [32]byte) error {
+		if hash == ([32]byte{}) || !peer[featureAvatars] || avatarHash != ([32]byte{}) {
+			return nil
+		}
+		s.lock.RLock()
+		known := s.infos.Avatars[uid] == hash
+		s.lock.RUnlock()
+
+		if known {
+			return nil
+		}
+		avatarHash, avatarData = hash, nil
+		return sender.Encode(&Envelope{GetAvatar: &GetAvatar{Hash: hash}})
+	}
+
 	// Start processing messages until torn down
 	for {
 		// Read the next message off the network
 		message := new(Envelope)
 		if err := dec.Decode(message); err != nil {
-			if err != io.EOF {
+			if err != io.EOF && err != tornet.ErrDraining {
 				log.Warn("Failed to decode message", "err", err)
 			}
 			return
 		}
+		// Capabilities are piggybacked onto requests (legacy participants don't
+		// send any), so process them before the request and answer in kind
+		var local *Capabilities
+		if message.Capabilities != nil {
+			logger.Debug("Participant advertised capabilities", "features", message.Capabilities.Features)
+			peer = newFeatureSet(message.Capabilities.Features)
+			local = &Capabilities{Features: supportedFeatures}
+		}
 		// Depending on what we've got, do something meaningful
 		switch {
 		case message.GetMetadata != nil:
@@ -270,14 +411,48 @@ func (s *Server) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.C
 				s.banner = banner
 				s.lock.Unlock()
 			}
-			if err := enc.Encode(&Envelope{Metadata: &Metadata{
-				Name:   s.infos.Name,
-				Banner: banner,
-			}}); err != nil {
+			// If the banner is too large, only announce it to transfer separately
+			metadata := &Metadata{
+				Name:        s.infos.Name,
+				Description: s.infos.Description,
+				Location:    s.infos.Location,
+				Banner:      banner,
+			}
+			if len(banner) > bannerInlineLimit && peer[featureBannerChunks] {
+				metadata.Banner, metadata.BannerHash = nil, sha3.Sum256(banner)
+			}
+			if err := sender.Encode(&Envelope{Capabilities: local, Metadata: metadata}); err != nil {
 				logger.Warn("Failed to send event metadata", "err", err)
 				return
 			}
 
+		case message.GetBanner != nil:
+			logger.Debug("Participant requested banner chunk", "offset", message.GetBanner.Offset)
+
+			s.lock.RLock()
+			banner := s.banner
+			s.lock.RUnlock()
+
+			if message.GetBanner.Offset >= uint64(len(banner)) {
+				logger.Warn("Banner chunk out of bounds", "offset", message.GetBanner.Offset, "size", len(banner))
+				return
+			}
+			end := message.GetBanner.Offset + bannerChunkSize
+			if end > uint64(len(banner)) {
+				end = uint64(len(banner))
+			}
+			chunk := &Envelope{Banner: &Banner{
+				Offset: message.GetBanner.Offset,
+				Total:  uint64(len(banner)),
+				Data:   banner[message.GetBanner.Offset:end],
+			}}
+			go func() {
+				if err := sender.EncodeBulk(chunk); err != nil {
+					logger.Warn("Failed to send banner chunk", "err", err)
+					conn.Close()
+				}
+			}()
+
 		case message.GetStatus != nil:
 			logger.Info("Participant requested event status")
 
@@ -286,6 +461,7 @@ func (s *Server) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.C
 			reply := &Status{
 				Start:     s.infos.Start,
 				End:       s.infos.End,
+				Now:       time.Now(),
 				Attendees: uint(len(s.infos.Participants)),
 			}
 			for _, status := range s.infos.Statuses {
@@ -296,6 +472,8 @@ func (s *Server) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.C
 					reply.Suspected++
 				case params.InfectionStatusPositive:
 					reply.Positives++
+				case params.InfectionStatusRecovered:
+					reply.Recovered++
 				case params.InfectionStatusUnknown:
 				// Do nothing
 				default:
@@ -308,7 +486,7 @@ func (s *Server) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.C
 			s.lock.RUnlock()
 
 			// Package up and send over the statistics
-			if err := enc.Encode(&Envelope{Status: reply}); err != nil {
+			if err := sender.Encode(&Envelope{Capabilities: local, Status: reply}); err != nil {
 				logger.Warn("Failed to send event status", "err", err)
 				return
 			}
@@ -326,12 +504,7 @@ func (s *Server) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.C
 				return
 			}
 			// Validate all the data and drop the connection if it fails
-			blob := s.infos.Identity.Public()
-			blob = append(blob, message.Report.Name...)
-			blob = append(blob, message.Report.Status...)
-			blob = append(blob, message.Report.Message...)
-
-			if !message.Report.Identity.Verify(blob, message.Report.Signature) {
+			if !message.Report.Identity.Verify(reportBlob(s.infos.Identity.Public(), message.Report), message.Report.Signature) {
 				logger.Warn("Invalid report signature")
 				return
 			}
@@ -343,8 +516,29 @@ func (s *Server) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.C
 				logger.Warn("Report contains invalid status", "status", message.Report.Status)
 				return
 			}
-			// If content seems valid, integrate the report into the event stats
+			// If the report was already processed (re-delivery after a lost ack),
+			// acknowledge it again without touching anything
+			id := reportID(s.infos.Identity.Public(), message.Report)
+
 			s.lock.Lock()
+			if s.infos.Reports[uid] == id {
+				status := s.infos.Statuses[uid]
+				s.lock.Unlock()
+
+				logger.Debug("Acknowledging duplicate report", "status", status)
+				if err := sender.Encode(&Envelope{Capabilities: local, ReportAck: &ReportAck{Status: status}}); err != nil {
+					logger.Warn("Failed to send report ack", "err", err)
+					return
+				}
+				// The avatar download might have been interrupted, or the avatar
+				// was only attached to the re-delivery, retrieve it if missing
+				if err := requestAvatar(message.Report.Avatar); err != nil {
+					logger.Warn("Failed to request avatar", "err", err)
+					return
+				}
+				continue
+			}
+			// If content seems valid, integrate the report into the event stats
 			cid := message.Report.Identity
 			if old, ok := s.infos.Identities[uid]; ok && old.Fingerprint() != cid.Fingerprint() {
 				// Changing a user identity is a serious protocol violation and
@@ -356,17 +550,18 @@ func (s *Server) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.C
 			s.infos.Identities[uid] = cid
 
 			status := message.Report.Status
-			if old, ok := s.infos.Statuses[uid]; ok && !validInfectionTransition(old, status) {
-				logger.Warn("Ignoring invalid status update", "status", status)
+			if old := s.infos.Statuses[uid]; !ValidInfectionTransition(old, status) {
+				logger.Warn("Rejecting invalid status update", "old", old, "status", status)
 				s.lock.Unlock()
 
-				if err := enc.Encode(&Envelope{ReportAck: &ReportAck{Status: old}}); err != nil {
+				if err := sender.Encode(&Envelope{Capabilities: local, ReportAck: &ReportAck{Status: old, Rejected: ErrInvalidTransition.Error()}}); err != nil {
 					logger.Warn("Failed to send report ack", "err", err)
 					return
 				}
 				continue
 			}
 			s.infos.Statuses[uid] = status
+			s.infos.Reports[uid] = id
 
 			if _, ok := s.infos.Names[uid]; !ok {
 				// Users can for valid reasons change names, but let's not care about them
@@ -379,14 +574,101 @@ func (s *Server) handleV1DataExchange(uid tornet.IdentityFingerprint, conn net.C
 			s.host.OnUpdate(s.infos.Identity.Fingerprint(), s)
 			s.host.OnReport(s.infos.Identity.Fingerprint(), s, uid, message.Report.Message)
 
-			if err := enc.Encode(&Envelope{ReportAck: &ReportAck{Status: status}}); err != nil {
+			if err := sender.Encode(&Envelope{Capabilities: local, ReportAck: &ReportAck{Status: status}}); err != nil {
 				logger.Warn("Failed to send report ack", "err", err)
 				return
 			}
+			// If the participant attached a new avatar, start retrieving it
+			if err := requestAvatar(message.Report.Avatar); err != nil {
+				logger.Warn("Failed to request avatar", "err", err)
+				return
+			}
+
+		case message.Avatar != nil:
+			logger.Debug("Participant sent avatar chunk", "offset", message.Avatar.Offset, "bytes", len(message.Avatar.Data), "total", message.Avatar.Total)
+
+			// Make sure the chunk was requested and is the next expected one
+			if avatarHash == ([32]byte{}) {
+				logger.Warn("Rejecting unrequested avatar chunk")
+				return
+			}
+			if message.Avatar.Total == 0 && len(message.Avatar.Data) == 0 {
+				logger.Debug("Participant avatar no longer available")
+				avatarHash, avatarData = [32]byte{}, nil
+				continue
+			}
+			if message.Avatar.Offset != uint64(len(avatarData)) || len(message.Avatar.Data) == 0 {
+				logger.Warn("Rejecting out of order avatar chunk", "have", message.Avatar.Offset, "want", len(avatarData))
+				return
+			}
+			if message.Avatar.Total > avatarMaxSize || uint64(len(avatarData)+len(message.Avatar.Data)) > message.Avatar.Total {
+				logger.Warn("Rejecting oversized avatar", "total", message.Avatar.Total)
+				return
+			}
+			avatarData = append(avatarData, message.Avatar.Data...)
+
+			// If more chunks are needed, request the next one
+			if uint64(len(avatarData)) < message.Avatar.Total {
+				if err := sender.Encode(&Envelope{GetAvatar: &GetAvatar{Hash: avatarHash, Offset: uint64(len(avatarData))}}); err != nil {
+					logger.Warn("Failed to request avatar chunk", "err", err)
+					return
+				}
+				continue
+			}
+			// Avatar fully downloaded, make sure it's the announced one
+			hash, avatar := avatarHash, avatarData
+			avatarHash, avatarData = [32]byte{}, nil
+
+			if sha3.Sum256(avatar) != hash {
+				logger.Warn("Rejecting avatar with hash mismatch")
+				return
+			}
+			if err := s.host.OnAvatar(s.infos.Identity.Fingerprint(), s, uid, avatar); err != nil {
+				logger.Warn("Failed to store participant avatar", "err", err)
+				continue
+			}
+			s.lock.Lock()
+			s.infos.Avatars[uid] = hash
+			s.infos.Updated = time.Now()
+			s.lock.Unlock()
+
+			// Avatar accepted, ensure it's persisted to disk
+			s.host.OnUpdate(s.infos.Identity.Fingerprint(), s)
+
+		case message.Capabilities != nil:
+			// Standalone capabilities, nothing to answer them with
 
 		default:
-			logger.Warn("Participant sent unknown message")
-			return
+			// Participant might be running a newer version, skip the message
+			logger.Debug("Ignoring unknown message")
 		}
 	}
 }
+
+// reportBlob assembles the content of an infection report that is signed by the
+// reporter: the event identity followed by the name, status and message. The hash
+// of the avatar is only appended if one is attached, so that reports without it
+// remain verifiable by organizers predating avatars.
+func reportBlob(event tornet.PublicIdentity, report *Report) []byte {
+	blob := append([]byte{}, event...)
+	blob = append(blob, report.Name...)
+	blob = append(blob, report.Status...)
+	blob = append(blob, report.Message...)
+
+	if report.Avatar != ([32]byte{}) {
+		blob = append(blob, report.Avatar[:]...)
+	}
+	return blob
+}
+
+// reportID calculates the unique identifier of an infection report, used to
+// recognize re-deliveries of an already processed one.
+//
+// The attached avatar is disregarded, so a report re-delivered with an avatar
+// attached (or swapped) is still recognized as the same.
+func reportID(event tornet.PublicIdentity, report *Report) [32]byte {
+	content := *report
+	content.Avatar = [32]byte{}
+
+	return sha3.Sum256(append(append([]byte{}, report.Identity...), reportBlob(event, &content)...))
+}
@@ -5,21 +5,26 @@ package events
 
 import (
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/tornet"
 )
 
 // Stats is a collection of public statistics about an event.
 type Stats struct {
-	Name  string    `json:"name"`  // Name of the event
-	Start time.Time `json:"start"` // Start time of the event
-	End   time.Time `json:"end"`   // Conclusion time of the event
+	Name        string    `json:"name"`                  // Name of the event
+	Description string    `json:"description,omitempty"` // Description of the event
+	Location    string    `json:"location,omitempty"`    // Location of the event
+	Start       time.Time `json:"start"`                 // Start time of the event
+	End         time.Time `json:"end"`                   // Conclusion time of the event
 
 	Attendees uint `json:"attendees"` // Number of participants in the event
 	Negatives uint `json:"negatives"` // Participants who reported negative test results
 	Suspected uint `json:"suspected"` // Participants who might have been infected
 	Positives uint `json:"positives"` // Participants who reported positive infection
+	Recovered uint `json:"recovered"` // Participants who recovered from a positive infection
 
 	Updated time.Time `json:"updated"` // Time when the event was last modified
 	Synced  time.Time `json:"synced"`  // Time when the event was last synced
@@ -28,12 +33,14 @@ type Stats struct {
 // Stats converts an internal event configuration into an external stats dump.
 func (s *ServerInfos) Stats() *Stats {
 	stats := &Stats{
-		Name:      s.Name,
-		Start:     s.Start,
-		End:       s.End,
-		Attendees: uint(len(s.Participants)),
-		Updated:   s.Updated,
-		Synced:    time.Now(),
+		Name:        s.Name,
+		Description: s.Description,
+		Location:    s.Location,
+		Start:       s.Start,
+		End:         s.End,
+		Attendees:   uint(len(s.Participants)),
+		Updated:     s.Updated,
+		Synced:      time.Now(),
 	}
 	for _, status := range s.Statuses {
 		switch status {
@@ -43,6 +50,8 @@ func (s *ServerInfos) Stats() *Stats {
 			stats.Suspected++
 		case params.InfectionStatusPositive:
 			stats.Positives++
+		case params.InfectionStatusRecovered:
+			stats.Recovered++
 		case params.InfectionStatusUnknown:
 		// Do nothing
 		default:
@@ -58,14 +67,63 @@ func (s *ServerInfos) Stats() *Stats {
 // Stats converts an internal event configuration into an external stats dump.
 func (c *ClientInfos) Stats() *Stats {
 	return &Stats{
-		Name:      c.Name,
-		Start:     c.Start,
-		End:       c.End,
-		Attendees: c.Attendees,
-		Negatives: c.Negatives,
-		Suspected: c.Suspected,
-		Positives: c.Positives,
-		Updated:   c.Updated,
-		Synced:    c.Synced,
+		Name:        c.Name,
+		Description: c.Description,
+		Location:    c.Location,
+		Start:       c.Start,
+		End:         c.End,
+		Attendees:   c.Attendees,
+		Negatives:   c.Negatives,
+		Suspected:   c.Suspected,
+		Positives:   c.Positives,
+		Recovered:   c.Recovered,
+		Updated:     c.Updated,
+		Synced:      c.Synced,
 	}
 }
+
+// Participant is a single attendee entry in a hosted event's roster.
+type Participant struct {
+	Pseudonym tornet.IdentityFingerprint `json:"pseudonym"`          // Anonymous identity used for checking in
+	Checkin   time.Time                  `json:"checkin"`            // Time when the participant checked in
+	Status    string                     `json:"status"`             // Last reported infection status
+	Name      string                     `json:"name,omitempty"`     // Real name, if ever reported
+	Identity  tornet.IdentityFingerprint `json:"identity,omitempty"` // Real identity, if a status was ever reported
+	Avatar    bool                       `json:"avatar,omitempty"`   // Whether a profile picture was shared along with a report
+}
+
+// Roster assembles the list of participants of a hosted event, ordered by their
+// checkin time. Participants without a known checkin time (events persisted by
+// older versions) are listed first, and ties are broken by the pseudonym to keep
+// the ordering deterministic across calls.
+//
+// The real identity of a participant is only included if they reported a status,
+// since that's the point where they voluntarily revealed themselves.
+func (s *ServerInfos) Roster() []*Participant {
+	roster := make([]*Participant, 0, len(s.Participants))
+	for uid := range s.Participants {
+		participant := &Participant{
+			Pseudonym: uid,
+			Checkin:   s.Checkins[uid],
+			Status:    params.InfectionStatusUnknown,
+			Name:      s.Names[uid],
+		}
+		if hash, ok := s.Avatars[uid]; ok && hash != ([32]byte{}) {
+			participant.Avatar = true
+		}
+		if status, ok := s.Statuses[uid]; ok {
+			participant.Status = status
+			if id, ok := s.Identities[uid]; ok && id != nil {
+				participant.Identity = id.Fingerprint()
+			}
+		}
+		roster = append(roster, participant)
+	}
+	sort.Slice(roster, func(i, j int) bool {
+		if !roster[i].Checkin.Equal(roster[j].Checkin) {
+			return roster[i].Checkin.Before(roster[j].Checkin)
+		}
+		return roster[i].Pseudonym < roster[j].Pseudonym
+	})
+	return roster
+}
@@ -0,0 +1,59 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package events
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that the roster of a hosted event is ordered by checkin time, falling
+// back to the pseudonyms, that the ordering is stable across queries and that
+// real identities are only included for participants who reported a status.
+func TestRosterOrdering(t *testing.T) {
+	now := time.Date(2020, time.April, 1, 12, 0, 0, 0, time.UTC)
+
+	bob, _ := tornet.GenerateIdentity()
+	carol, _ := tornet.GenerateIdentity()
+
+	infos := &ServerInfos{
+		Participants: make(map[tornet.IdentityFingerprint]tornet.PublicIdentity),
+		Identities: map[tornet.IdentityFingerprint]tornet.PublicIdentity{
+			"bob":   bob.Public(),
+			"carol": carol.Public(), // Not reported, must not leak
+		},
+		Statuses: map[tornet.IdentityFingerprint]string{
+			"bob": params.InfectionStatusPositive,
+		},
+		Names: map[tornet.IdentityFingerprint]string{
+			"bob": "Bob",
+		},
+		Checkins: map[tornet.IdentityFingerprint]time.Time{
+			"alice": now.Add(time.Minute),
+			"bob":   now,
+			"carol": now.Add(time.Minute),
+			"dave":  now.Add(-time.Minute),
+		},
+	}
+	for _, uid := range []tornet.IdentityFingerprint{"alice", "bob", "carol", "dave", "erin", "frank"} {
+		infos.Participants[uid] = tornet.PublicIdentity{}
+	}
+	want := []*Participant{
+		{Pseudonym: "erin", Status: params.InfectionStatusUnknown},
+		{Pseudonym: "frank", Status: params.InfectionStatusUnknown},
+		{Pseudonym: "dave", Checkin: now.Add(-time.Minute), Status: params.InfectionStatusUnknown},
+		{Pseudonym: "bob", Checkin: now, Status: params.InfectionStatusPositive, Name: "Bob", Identity: bob.Fingerprint()},
+		{Pseudonym: "alice", Checkin: now.Add(time.Minute), Status: params.InfectionStatusUnknown},
+		{Pseudonym: "carol", Checkin: now.Add(time.Minute), Status: params.InfectionStatusUnknown},
+	}
+	for i := 0; i < 32; i++ {
+		if have := infos.Roster(); !reflect.DeepEqual(have, want) {
+			t.Fatalf("query %d: roster mismatch: have %v, want %v", i, have, want)
+		}
+	}
+}
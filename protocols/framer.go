@@ -0,0 +1,95 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package protocols
+
+import (
+	"io"
+
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// framedReader is an io.Reader feeding the gob decoder, which follows the message
+// boundaries of the gob stream (every message is prefixed by its byte count) and
+// reports them to the connection, so draining it never cuts a message in half.
+//
+// Reads are capped at message boundaries, so that the decoder's internal buffer
+// never pulls in the start of the next message while finishing the current one.
+type framedReader struct {
+	conn    io.Reader             // Connection to read the gob stream from
+	tracker tornet.MessageTracker // Tracker to report message boundaries to
+
+	head   []byte // Byte count prefix of the message being read, if incomplete
+	remain uint64 // Number of body bytes remaining of the message being read
+}
+
+// newFramedReader wraps a connection to report its message boundaries. If the
+// connection doesn't track them, it is returned as is.
+func newFramedReader(conn io.Reader, tracker tornet.MessageTracker) io.Reader {
+	if tracker == nil {
+		return conn
+	}
+	return &framedReader{conn: conn, tracker: tracker}
+}
+
+// Read implements io.Reader, reading at most until the end of the current frame
+// (the byte count prefix or the message body).
+func (r *framedReader) Read(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	// If we're inside a message body, read at most until its end
+	if r.remain > 0 {
+		if uint64(len(buf)) > r.remain {
+			buf = buf[:r.remain]
+		}
+		n, err := r.conn.Read(buf)
+		if r.remain -= uint64(n); r.remain == 0 {
+			r.tracker.MessageFinished()
+		}
+		return n, err
+	}
+	// Otherwise we're reading the byte count: a single byte if small, or a byte
+	// holding the negated length of the big endian count following it
+	want := 1
+	if len(r.head) > 0 {
+		want += countBytes(r.head[0])
+	}
+	if len(buf) > want-len(r.head) {
+		buf = buf[:want-len(r.head)]
+	}
+	n, err := r.conn.Read(buf)
+	if n == 0 {
+		return n, err
+	}
+	if len(r.head) == 0 {
+		r.tracker.MessageStarted()
+	}
+	r.head = append(r.head, buf[:n]...)
+
+	if len(r.head) < 1+countBytes(r.head[0]) {
+		return n, err // Byte count still incomplete
+	}
+	if r.head[0] <= 0x7f {
+		r.remain = uint64(r.head[0])
+	} else {
+		for _, b := range r.head[1:] {
+			r.remain = r.remain<<8 | uint64(b)
+		}
+	}
+	r.head = r.head[:0]
+	if r.remain == 0 {
+		r.tracker.MessageFinished()
+	}
+	return n, err
+}
+
+// countBytes returns the number of bytes following the first byte of a gob byte
+// count prefix: none if the count fits into the first byte, otherwise the first
+// byte is the negated length of the rest.
+func countBytes(first byte) int {
+	if first <= 0x7f {
+		return 0
+	}
+	return 256 - int(first)
+}
@@ -0,0 +1,68 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package protocols
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+// testMessageTracker records the message boundaries reported by a framed reader.
+type testMessageTracker struct {
+	partial  bool // Whether a message is halfway read
+	messages int  // Number of messages fully read
+}
+
+func (t *testMessageTracker) MessageStarted() { t.partial = true }
+
+func (t *testMessageTracker) MessageFinished() {
+	t.partial = false
+	t.messages++
+}
+
+// Tests that the framed reader follows the message boundaries of a gob stream,
+// for messages with both short and long byte count prefixes, and that it never
+// reads ahead into the next message.
+func TestFramedReader(t *testing.T) {
+	type message struct {
+		Data []byte
+	}
+	sizes := []int{0, 1, 100, 200, 70000, 3}
+
+	var (
+		stream = new(bytes.Buffer)
+		enc    = gob.NewEncoder(stream)
+		ends   []int
+	)
+	for _, size := range sizes {
+		if err := enc.Encode(&message{Data: bytes.Repeat([]byte{0x80}, size)}); err != nil {
+			t.Fatalf("failed to encode message: %v", err)
+		}
+		ends = append(ends, stream.Len())
+	}
+	total := stream.Len()
+
+	tracker := new(testMessageTracker)
+	dec := gob.NewDecoder(newFramedReader(stream, tracker))
+	for i, size := range sizes {
+		msg := new(message)
+		if err := dec.Decode(msg); err != nil {
+			t.Fatalf("message %d: failed to decode: %v", i, err)
+		}
+		if len(msg.Data) != size {
+			t.Fatalf("message %d: size mismatch: have %d, want %d", i, len(msg.Data), size)
+		}
+		if tracker.partial {
+			t.Fatalf("message %d: reader stuck mid-message after decoding", i)
+		}
+		if read := total - stream.Len(); read != ends[i] {
+			t.Fatalf("message %d: read position mismatch: have %d, want %d", i, read, ends[i])
+		}
+		// The first message is preceded by the type definition, also a message
+		if tracker.messages != i+2 {
+			t.Fatalf("message %d: boundary count mismatch: have %d, want %d", i, tracker.messages, i+2)
+		}
+	}
+}
@@ -14,15 +14,36 @@ import (
 	"github.com/ethereum/go-ethereum/log"
 )
 
+// CapabilityKeepalive is the optional feature of answering liveness pings. Pings
+// are only sent to peers that advertised it, so that a peer unaware of them is
+// neither sent junk envelopes, nor dropped for not answering.
+const CapabilityKeepalive = "keepalive"
+
 // HandlerConfig specifies how a generic handshake should run and what methods
 // should be given control when it succeeds.
 type HandlerConfig struct {
-	Protocol string           // Protocol to negotiate through the handshake
-	Handlers map[uint]Handler // Handlers to run for different versions
+	Protocol     string           // Protocol to negotiate through the handshake
+	Handlers     map[uint]Handler // Handlers to run for different versions
+	Capabilities []string         // Optional features to negotiate alongside the version
+
+	Tracer   func() Tracer      // Optional debug tracer getter, checked on every connection (nil = off)
+	Envelope func() interface{} // Constructor for the protocol's message envelope (needed for tracing)
+
+	Keepalive time.Duration                // Interval between liveness pings (0 = off, needs CapabilityKeepalive)
+	Ping      func(ping *Ping) interface{} // Constructor wrapping a ping into the protocol's envelope (needed for keepalive)
 }
 
 // Handler is a callback to give control after a successful handshake.
-type Handler func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, logger log.Logger)
+type Handler func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps Capabilities, logger log.Logger)
+
+// Capabilities is the set of optional features both sides of a connection agreed
+// to support during the handshake.
+type Capabilities map[string]bool
+
+// Has returns whether the given optional feature was negotiated.
+func (c Capabilities) Has(capability string) bool {
+	return c[capability]
+}
 
 // MakeHandler creates a protocol handler based on the specified handshake and
 // callback configurations. It's mostly sugar coating to avoid having to redo
@@ -33,9 +54,33 @@ func MakeHandler(config HandlerConfig) tornet.ConnHandler {
 		logger = logger.New("proto", config.Protocol, "peer", uid)
 		logger.Info("Remote peer connected")
 
-		// Create the gob encoder and decoder
+		// If the connection can record the negotiated protocol or track the message
+		// boundaries, grab the hooks before wrapping
+		recorder, _ := conn.(tornet.NegotiationRecorder)
+		tracker, _ := conn.(tornet.MessageTracker)
+
+		// Tally all the traffic into the protocol's counters, handshake included
+		conn = newMeteredConn(conn, config.Protocol)
+
+		// If keepalive was requested, wrap the connection to track inbound activity
+		var alive *keepaliveConn
+		if config.Keepalive > 0 && config.Ping != nil {
+			alive = newKeepaliveConn(conn)
+			conn = alive
+		}
+		// If tracing was requested, wrap the connection to duplicate all traffic
+		if config.Tracer != nil && config.Envelope != nil {
+			if tracer := config.Tracer(); tracer != nil {
+				traced := newTracedConn(conn, tracer, config, uid)
+				defer traced.release()
+
+				conn = traced
+			}
+		}
+		// Create the gob encoder and decoder, the latter reporting message boundaries
+		// to the connection so draining doesn't interrupt a message halfway through
 		enc := gob.NewEncoder(conn)
-		dec := gob.NewDecoder(conn)
+		dec := gob.NewDecoder(newFramedReader(conn, tracker))
 
 		// Run the protocol handshake and catch any errors. Since we're not yet in
 		// the separate reader/writer phase, we can't send over errors. Just nuke
@@ -44,24 +89,33 @@ func MakeHandler(config HandlerConfig) tornet.ConnHandler {
 		for v := range config.Handlers {
 			versions = append(versions, v)
 		}
-		ver, err := handleHandshake(config.Protocol, versions, enc, dec)
+		ver, caps, err := handleHandshake(config.Protocol, versions, config.Capabilities, enc, dec)
 		if err != nil {
 			logger.Warn("Protocol handshake failed", "err", err)
 			return
 		}
 		// Common protocol version negotiated, start up the actual message handler
-		logger.Debug("Negotiated protocol version", "version", ver)
-		config.Handlers[ver](uid, conn, enc, dec, logger)
+		logger.Debug("Negotiated protocol version", "version", ver, "caps", len(caps))
+		if recorder != nil {
+			recorder.RecordNegotiation(config.Protocol, ver)
+		}
+		if alive != nil && caps.Has(CapabilityKeepalive) {
+			done := make(chan struct{})
+			defer close(done)
+
+			go keepalive(alive, enc, config, done, logger)
+		}
+		config.Handlers[ver](uid, conn, enc, dec, caps, logger)
 	}
 }
 
 // handleHandshake runs a generic protocol negotiation and returns the common version
-// number agreed upon.
-func handleHandshake(protocol string, versions []uint, enc *gob.Encoder, dec *gob.Decoder) (uint, error) {
+// number and optional capabilities agreed upon.
+func handleHandshake(protocol string, versions []uint, capabilities []string, enc *gob.Encoder, dec *gob.Decoder) (uint, Capabilities, error) {
 	// All protocols start with a system handshake, send ours, read theirs
 	errc := make(chan error, 2)
 	go func() {
-		errc <- enc.Encode(&Handshake{Protocol: protocol, Versions: versions})
+		errc <- enc.Encode(&Handshake{Protocol: protocol, Versions: versions, Capabilities: capabilities})
 	}()
 	handshake := new(Handshake)
 	go func() {
@@ -73,15 +127,15 @@ func handleHandshake(protocol string, versions []uint, enc *gob.Encoder, dec *go
 		select {
 		case err := <-errc:
 			if err != nil {
-				return 0, err
+				return 0, nil, err
 			}
 		case <-timeout.C:
-			return 0, errors.New("handshake timed out")
+			return 0, nil, errors.New("handshake timed out")
 		}
 	}
 	// Find the common protocol, abort otherwise
 	if handshake.Protocol != protocol {
-		return 0, fmt.Errorf("unexpected protocol: %s", handshake.Protocol)
+		return 0, nil, fmt.Errorf("unexpected protocol: %s", handshake.Protocol)
 	}
 	have := make(map[uint]struct{})
 	for _, v := range versions {
@@ -94,7 +148,24 @@ func handleHandshake(protocol string, versions []uint, enc *gob.Encoder, dec *go
 		}
 	}
 	if version == 0 {
-		return 0, fmt.Errorf("no common protocol version: remote %v vs local %v", handshake.Versions, versions)
+		return 0, nil, fmt.Errorf("no common protocol version: remote %v vs local %v", handshake.Versions, versions)
+	}
+	return version, negotiateCapabilities(capabilities, handshake.Capabilities), nil
+}
+
+// negotiateCapabilities calculates the intersection of the locally and remotely
+// supported optional features. Anything unknown locally is ignored, since those
+// are features added by newer versions of the protocol.
+func negotiateCapabilities(local []string, remote []string) Capabilities {
+	have := make(map[string]bool, len(local))
+	for _, capability := range local {
+		have[capability] = true
+	}
+	caps := make(Capabilities)
+	for _, capability := range remote {
+		if have[capability] {
+			caps[capability] = true
+		}
 	}
-	return version, nil
+	return caps
 }
@@ -0,0 +1,217 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package protocols
+
+import (
+	"context"
+	"encoding/gob"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Tests that the protocol version negotiated by the handshake is recorded into
+// the peer set and is queryable while the connection is live.
+func TestNegotiatedVersion(t *testing.T) {
+	// Set up the crypto identities
+	var (
+		gateway       = tornet.NewMockGateway()
+		serverId, _   = tornet.GenerateIdentity()
+		serverAddr, _ = tornet.GenerateAddress()
+		clientId, _   = tornet.GenerateIdentity()
+	)
+	// Create two peers with partially overlapping protocol versions, keeping the
+	// connections alive until released
+	var (
+		notify  = make(chan struct{}, 2)
+		release = make(chan struct{})
+	)
+	handler := func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps Capabilities, logger log.Logger) {
+		notify <- struct{}{}
+		<-release
+	}
+	serverPeers := tornet.NewPeerSet(tornet.PeerSetConfig{
+		Trusted: []tornet.PublicIdentity{clientId.Public()},
+		Handler: MakeHandler(HandlerConfig{
+			Protocol: "test",
+			Handlers: map[uint]Handler{1: handler, 2: handler},
+		}),
+	})
+	defer serverPeers.Close()
+
+	clientPeers := tornet.NewPeerSet(tornet.PeerSetConfig{
+		Trusted: []tornet.PublicIdentity{serverId.Public()},
+		Handler: MakeHandler(HandlerConfig{
+			Protocol: "test",
+			Handlers: map[uint]Handler{1: handler, 2: handler, 3: handler},
+		}),
+	})
+	defer clientPeers.Close()
+
+	server, err := tornet.NewServer(tornet.ServerConfig{
+		Gateway:  gateway,
+		Address:  serverAddr,
+		Identity: serverId,
+		PeerSet:  serverPeers,
+	})
+	if err != nil {
+		t.Fatalf("failed to launch server: %v", err)
+	}
+	defer server.Close()
+
+	// Nothing should be recorded before connecting
+	if _, _, ok := clientPeers.NegotiatedVersion(serverId.Fingerprint()); ok {
+		t.Fatalf("negotiated version reported without connection")
+	}
+	if _, err := tornet.DialServer(context.Background(), tornet.DialConfig{
+		Gateway:  gateway,
+		Address:  serverAddr.Public(),
+		Server:   serverId.Public(),
+		Identity: clientId,
+		PeerSet:  clientPeers,
+	}); err != nil {
+		t.Fatalf("failed to dial server: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-notify:
+		case <-time.After(time.Second):
+			t.Fatalf("connection timed out")
+		}
+	}
+	// Both sides should report the highest common version
+	for _, check := range []struct {
+		peers *tornet.PeerSet
+		uid   tornet.IdentityFingerprint
+	}{
+		{serverPeers, clientId.Fingerprint()},
+		{clientPeers, serverId.Fingerprint()},
+	} {
+		proto, version, ok := check.peers.NegotiatedVersion(check.uid)
+		if !ok {
+			t.Fatalf("negotiated version missing for %s", check.uid)
+		}
+		if proto != "test" || version != 2 {
+			t.Fatalf("negotiated version mismatch: have %s/%d, want %s/%d", proto, version, "test", 2)
+		}
+	}
+	close(release)
+}
+
+// Tests that the negotiated capabilities are the intersection of both sides,
+// ignoring anything unknown locally.
+func TestNegotiateCapabilities(t *testing.T) {
+	tests := []struct {
+		local  []string
+		remote []string
+		want   []string
+	}{
+		{nil, nil, nil},
+		{[]string{"keepalive"}, nil, nil},
+		{nil, []string{"keepalive"}, nil},
+		{[]string{"keepalive"}, []string{"avatars"}, nil},
+		{[]string{"keepalive", "avatars"}, []string{"avatars"}, []string{"avatars"}},
+		{[]string{"keepalive", "avatars"}, []string{"avatars", "keepalive", "messaging"}, []string{"avatars", "keepalive"}},
+		{[]string{"avatars"}, []string{"avatars", "avatars"}, []string{"avatars"}},
+	}
+	for i, tt := range tests {
+		caps := negotiateCapabilities(tt.local, tt.remote)
+		if len(caps) != len(tt.want) {
+			t.Errorf("test %d: capability count mismatch: have %v, want %v", i, caps, tt.want)
+			continue
+		}
+		for _, capability := range tt.want {
+			if !caps.Has(capability) {
+				t.Errorf("test %d: capability %s missing: have %v, want %v", i, capability, caps, tt.want)
+			}
+		}
+	}
+}
+
+// Tests that peers negotiate the common optional capabilities over a live
+// connection, and that disjoint ones still establish the base protocol.
+func TestNegotiatedCapabilities(t *testing.T) {
+	tests := []struct {
+		server []string
+		client []string
+		want   []string
+	}{
+		{[]string{"keepalive"}, []string{"avatars"}, nil},
+		{[]string{"keepalive", "avatars"}, []string{"avatars", "messaging"}, []string{"avatars"}},
+	}
+	for i, tt := range tests {
+		// Set up the crypto identities
+		var (
+			gateway       = tornet.NewMockGateway()
+			serverId, _   = tornet.GenerateIdentity()
+			serverAddr, _ = tornet.GenerateAddress()
+			clientId, _   = tornet.GenerateIdentity()
+		)
+		// Create two peers with the requested capabilities, reporting whatever
+		// got negotiated
+		negotiated := make(chan Capabilities, 2)
+		handler := func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps Capabilities, logger log.Logger) {
+			negotiated <- caps
+		}
+		serverPeers := tornet.NewPeerSet(tornet.PeerSetConfig{
+			Trusted: []tornet.PublicIdentity{clientId.Public()},
+			Handler: MakeHandler(HandlerConfig{
+				Protocol:     "test",
+				Handlers:     map[uint]Handler{1: handler},
+				Capabilities: tt.server,
+			}),
+		})
+		defer serverPeers.Close()
+
+		clientPeers := tornet.NewPeerSet(tornet.PeerSetConfig{
+			Trusted: []tornet.PublicIdentity{serverId.Public()},
+			Handler: MakeHandler(HandlerConfig{
+				Protocol:     "test",
+				Handlers:     map[uint]Handler{1: handler},
+				Capabilities: tt.client,
+			}),
+		})
+		defer clientPeers.Close()
+
+		server, err := tornet.NewServer(tornet.ServerConfig{
+			Gateway:  gateway,
+			Address:  serverAddr,
+			Identity: serverId,
+			PeerSet:  serverPeers,
+		})
+		if err != nil {
+			t.Fatalf("test %d: failed to launch server: %v", i, err)
+		}
+		defer server.Close()
+
+		if _, err := tornet.DialServer(context.Background(), tornet.DialConfig{
+			Gateway:  gateway,
+			Address:  serverAddr.Public(),
+			Server:   serverId.Public(),
+			Identity: clientId,
+			PeerSet:  clientPeers,
+		}); err != nil {
+			t.Fatalf("test %d: failed to dial server: %v", i, err)
+		}
+		// Both sides should reach their handlers with the same capabilities
+		for j := 0; j < 2; j++ {
+			select {
+			case caps := <-negotiated:
+				if len(caps) != len(tt.want) {
+					t.Fatalf("test %d: capability count mismatch: have %v, want %v", i, caps, tt.want)
+				}
+				for _, capability := range tt.want {
+					if !caps.Has(capability) {
+						t.Fatalf("test %d: capability %s missing: have %v, want %v", i, capability, caps, tt.want)
+					}
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("test %d: connection timed out", i)
+			}
+		}
+	}
+}
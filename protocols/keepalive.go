@@ -0,0 +1,73 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package protocols
+
+import (
+	"encoding/gob"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// keepaliveConn is a net.Conn wrapper that tracks the last time any data was
+// received from the remote peer.
+type keepaliveConn struct {
+	net.Conn // Pass everything non-interesting through
+
+	heard int64 // Unix nanoseconds of the last inbound data (atomic)
+}
+
+// newKeepaliveConn wraps a connection to track its inbound activity.
+func newKeepaliveConn(conn net.Conn) *keepaliveConn {
+	return &keepaliveConn{
+		Conn:  conn,
+		heard: time.Now().UnixNano(),
+	}
+}
+
+// Read implements net.Conn, marking the remote peer alive if data arrives.
+func (c *keepaliveConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	if n > 0 {
+		atomic.StoreInt64(&c.heard, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// silence returns the amount of time passed since any data was received.
+func (c *keepaliveConn) silence() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.heard)))
+}
+
+// keepalive periodically sends a ping to the remote peer until the done channel
+// is closed. If nothing (neither a pong, nor any other message) is received for
+// two ping intervals, the connection is deemed dead and torn down.
+//
+// Pings are encoded as whole protocol envelopes through the connection's shared
+// gob encoder, which serializes concurrent messages, so they can never corrupt
+// the framing of real messages.
+func keepalive(conn *keepaliveConn, enc *gob.Encoder, config HandlerConfig, done chan struct{}, logger log.Logger) {
+	ticker := time.NewTicker(config.Keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if silence := conn.silence(); silence > 2*config.Keepalive {
+				logger.Warn("Remote peer unresponsive, dropping", "silence", silence)
+				conn.Close()
+				return
+			}
+			if err := enc.Encode(config.Ping(&Ping{Nonce: rand.Uint64()})); err != nil {
+				logger.Debug("Failed to send keepalive ping", "err", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package protocols
+
+import (
+	"context"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Tests that a peer answering liveness pings is kept connected, whereas a peer
+// going silent is dropped after two ping intervals.
+func TestKeepalive(t *testing.T) {
+	config := HandlerConfig{
+		Keepalive: 20 * time.Millisecond,
+		Ping:      func(ping *Ping) interface{} { return ping },
+	}
+	// Create a connection with a remote side answering all pings
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn := newKeepaliveConn(local)
+	defer conn.Close()
+
+	go func() {
+		enc, dec := gob.NewEncoder(remote), gob.NewDecoder(remote)
+		for {
+			ping := new(Ping)
+			if err := dec.Decode(ping); err != nil {
+				return
+			}
+			if err := enc.Encode(&Pong{Nonce: ping.Nonce}); err != nil {
+				return
+			}
+		}
+	}()
+	pongs := make(chan *Pong, 1024)
+	go func() {
+		dec := gob.NewDecoder(conn)
+		for {
+			pong := new(Pong)
+			if err := dec.Decode(pong); err != nil {
+				close(pongs)
+				return
+			}
+			pongs <- pong
+		}
+	}()
+	done := make(chan struct{})
+	go keepalive(conn, gob.NewEncoder(conn), config, done, log.Root())
+
+	// Wait for a number of ping intervals and ensure the connection survived
+	time.Sleep(10 * config.Keepalive)
+	close(done)
+
+	count := 0
+	for drained := false; !drained; {
+		select {
+		case _, ok := <-pongs:
+			if !ok {
+				t.Fatalf("responsive peer dropped")
+			}
+			count++
+		default:
+			drained = true
+		}
+	}
+	if count == 0 {
+		t.Fatalf("no pongs received")
+	}
+	// Create a connection with a remote side swallowing everything silently
+	local, remote = net.Pipe()
+	defer remote.Close()
+
+	conn = newKeepaliveConn(local)
+	defer conn.Close()
+
+	go io.Copy(ioutil.Discard, remote)
+
+	start := time.Now()
+	go keepalive(conn, gob.NewEncoder(conn), config, make(chan struct{}), log.Root())
+
+	// Ensure the connection is torn down after two intervals of silence
+	failed := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		failed <- err
+	}()
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Fatalf("read from dropped connection succeeded")
+		}
+		if elapsed := time.Since(start); elapsed < 2*config.Keepalive {
+			t.Fatalf("silent peer dropped too early: have %v, want >= %v", elapsed, 2*config.Keepalive)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("silent peer not dropped")
+	}
+}
+
+// Tests that liveness pings are only sent to peers that negotiated the keepalive
+// capability, others being left alone.
+func TestKeepaliveNegotiation(t *testing.T) {
+	tests := []struct {
+		client []string
+		pinged bool
+	}{
+		{nil, false},
+		{[]string{"avatars"}, false},
+		{[]string{CapabilityKeepalive}, true},
+	}
+	for i, tt := range tests {
+		// Set up the crypto identities
+		var (
+			gateway       = tornet.NewMockGateway()
+			serverId, _   = tornet.GenerateIdentity()
+			serverAddr, _ = tornet.GenerateAddress()
+			clientId, _   = tornet.GenerateIdentity()
+		)
+		// Create a server pinging frequently and a client reporting whether it got
+		// pinged within a few intervals
+		serverPeers := tornet.NewPeerSet(tornet.PeerSetConfig{
+			Trusted: []tornet.PublicIdentity{clientId.Public()},
+			Handler: MakeHandler(HandlerConfig{
+				Protocol: "test",
+				Handlers: map[uint]Handler{1: func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps Capabilities, logger log.Logger) {
+					io.Copy(ioutil.Discard, conn)
+				}},
+				Capabilities: []string{CapabilityKeepalive},
+				Keepalive:    20 * time.Millisecond,
+				Ping:         func(ping *Ping) interface{} { return ping },
+			}),
+		})
+		defer serverPeers.Close()
+
+		pinged := make(chan bool, 1)
+		clientPeers := tornet.NewPeerSet(tornet.PeerSetConfig{
+			Trusted: []tornet.PublicIdentity{serverId.Public()},
+			Handler: MakeHandler(HandlerConfig{
+				Protocol: "test",
+				Handlers: map[uint]Handler{1: func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps Capabilities, logger log.Logger) {
+					conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+					pinged <- dec.Decode(new(Ping)) == nil
+				}},
+				Capabilities: tt.client,
+			}),
+		})
+		defer clientPeers.Close()
+
+		server, err := tornet.NewServer(tornet.ServerConfig{
+			Gateway:  gateway,
+			Address:  serverAddr,
+			Identity: serverId,
+			PeerSet:  serverPeers,
+		})
+		if err != nil {
+			t.Fatalf("test %d: failed to launch server: %v", i, err)
+		}
+		defer server.Close()
+
+		if _, err := tornet.DialServer(context.Background(), tornet.DialConfig{
+			Gateway:  gateway,
+			Address:  serverAddr.Public(),
+			Server:   serverId.Public(),
+			Identity: clientId,
+			PeerSet:  clientPeers,
+		}); err != nil {
+			t.Fatalf("test %d: failed to dial server: %v", i, err)
+		}
+		select {
+		case have := <-pinged:
+			if have != tt.pinged {
+				t.Fatalf("test %d: ping mismatch: have %v, want %v", i, have, tt.pinged)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("test %d: connection timed out", i)
+		}
+	}
+}
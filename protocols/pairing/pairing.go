@@ -5,23 +5,47 @@
 package pairing
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/coronanet/go-coronanet/protocols"
 	"github.com/coronanet/go-coronanet/tornet"
 	"github.com/ethereum/go-ethereum/log"
+	"golang.org/x/crypto/sha3"
+)
+
+var (
+	// ErrNotPaired is returned if the short authentication string is requested
+	// for a pairing session that did not (yet) successfully complete.
+	ErrNotPaired = errors.New("not paired")
+
+	// ErrAborted is returned from Wait if the pairing session was torn down via
+	// Close before any remote peer joined.
+	ErrAborted = errors.New("pairing aborted")
+
+	// ErrExpired is returned from Wait if nobody joined the pairing session
+	// within the timeout it was created with.
+	ErrExpired = errors.New("pairing expired")
 )
 
 // Pairing runs the pairing algorithm with a remote peer, hopefully at the end
 // of it resulting in a remote identity.
 type Pairing struct {
-	self tornet.RemoteKeyRing // Real identity to send to the remote peer
-	peer tornet.RemoteKeyRing // Real identity to receive from the remote peer
+	self    tornet.RemoteKeyRing  // Real identity to send to the remote peer
+	peer    tornet.RemoteKeyRing  // Real identity to receive from the remote peer
+	session tornet.PublicIdentity // Ephemeral identity of the pairing session
+
+	selfNonce [32]byte // Random nonce committed to and revealed by the local peer
+	peerNonce [32]byte // Random nonce committed to and revealed by the remote peer
 
 	peerset *tornet.PeerSet // Peer set handling remote connections
 	server  *tornet.Server  // Ephemeral pairing server through the Tor network
@@ -29,6 +53,8 @@ type Pairing struct {
 	singleton chan struct{} // Guard channel to only ever allow one run
 	finished  chan struct{} // Notification channel when pairing finishes
 	failure   error         // Failure that occurred during the pairing exchange
+	closer    sync.Once     // Guard to only ever tear down the networking once
+	expirer   *time.Timer   // Timer to abort the session if nobody joins in time
 }
 
 // NewServer creates a temporary tornet server running a pairing protocol and
@@ -39,7 +65,10 @@ type Pairing struct {
 // and a public address to connect to. It is super unorthodox to reuse the same
 // encryption key in both directions, but it avoids having to send 2 identities
 // to the joiner (which would make QR codes quite unwieldy).
-func NewServer(gateway tornet.Gateway, self tornet.RemoteKeyRing, logger log.Logger) (*Pairing, tornet.SecretIdentity, tornet.PublicAddress, error) {
+//
+// If nobody joins the session within the given timeout (0 = never), it expires
+// and is torn down, even if nobody is waiting on it.
+func NewServer(gateway tornet.Gateway, self tornet.RemoteKeyRing, timeout time.Duration, logger log.Logger) (*Pairing, tornet.SecretIdentity, tornet.PublicAddress, error) {
 	// Pairing will be done on an ephemeral channel, create a temporary identity
 	// for it, reusing the same for both directions.
 	identity, err := tornet.GenerateIdentity()
@@ -53,6 +82,7 @@ func NewServer(gateway tornet.Gateway, self tornet.RemoteKeyRing, logger log.Log
 	// Create a temporary tornet server to accept the pairing connection on
 	p := &Pairing{
 		self:      self,
+		session:   identity.Public(),
 		singleton: make(chan struct{}, 1),
 		finished:  make(chan struct{}),
 	}
@@ -63,6 +93,7 @@ func NewServer(gateway tornet.Gateway, self tornet.RemoteKeyRing, logger log.Log
 			Handlers: map[uint]protocols.Handler{
 				1: p.handleV1,
 			},
+			Envelope: func() interface{} { return new(Envelope) },
 		}),
 		Logger: logger,
 	})
@@ -77,6 +108,12 @@ func NewServer(gateway tornet.Gateway, self tornet.RemoteKeyRing, logger log.Log
 		p.peerset.Close()
 		return nil, nil, nil, err
 	}
+	if timeout > 0 {
+		p.expirer = time.AfterFunc(timeout, func() {
+			logger.Warn("Pairing session expired", "timeout", timeout)
+			p.abort(ErrExpired)
+		})
+	}
 	return p, identity, address.Public(), nil
 }
 
@@ -86,6 +123,7 @@ func NewServer(gateway tornet.Gateway, self tornet.RemoteKeyRing, logger log.Log
 func NewClient(gateway tornet.Gateway, self tornet.RemoteKeyRing, identity tornet.SecretIdentity, address tornet.PublicAddress, logger log.Logger) (*Pairing, error) {
 	p := &Pairing{
 		self:      self,
+		session:   identity.Public(),
 		singleton: make(chan struct{}, 1),
 		finished:  make(chan struct{}),
 	}
@@ -96,6 +134,7 @@ func NewClient(gateway tornet.Gateway, self tornet.RemoteKeyRing, identity torne
 			Handlers: map[uint]protocols.Handler{
 				1: p.handleV1,
 			},
+			Envelope: func() interface{} { return new(Envelope) },
 		}),
 		Logger: logger,
 	})
@@ -115,10 +154,11 @@ func NewClient(gateway tornet.Gateway, self tornet.RemoteKeyRing, identity torne
 
 // Wait blocks until the pairing is done or the context is cancelled.
 func (p *Pairing) Wait(ctx context.Context) (tornet.RemoteKeyRing, error) {
-	defer p.peerset.Close()
-	if p.server != nil {
-		defer p.server.Close()
+	if p.expirer != nil {
+		defer p.expirer.Stop()
 	}
+	defer p.teardown()
+
 	select {
 	case <-ctx.Done():
 		return tornet.RemoteKeyRing{}, errors.New("context cancelled")
@@ -130,31 +170,103 @@ func (p *Pairing) Wait(ctx context.Context) (tornet.RemoteKeyRing, error) {
 	}
 }
 
-// handleV1 is the handler for the v1 pairing protocol.
-func (p *Pairing) handleV1(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, logger log.Logger) {
-	// If the pairing already in progress, reject additional peers
+// Close tears down a pairing session, releasing the ephemeral server and any
+// connection already established through it. If nobody joined yet, the session
+// is marked aborted; if an exchange is in progress, dropping the connection will
+// fail it. Either way, any pending Wait is unblocked.
+func (p *Pairing) Close() error {
+	if p.expirer != nil {
+		p.expirer.Stop()
+	}
+	return p.abort(ErrAborted)
+}
+
+// abort tears down the pairing session, marking it failed with the given error
+// if nobody joined it yet.
+func (p *Pairing) abort(failure error) error {
 	select {
 	case p.singleton <- struct{}{}:
-		// Singleton lock received, everyone's happy
+		// Nobody joined yet, block anyone from doing so and mark the failure
+		p.failure = failure
+		close(p.finished)
+	default:
+		// Exchange already in progress or done, the handler will finish it
+	}
+	return p.teardown()
+}
+
+// teardown closes the ephemeral server and the connections of the session. It
+// is safe to call multiple times, only the first invocation does anything.
+func (p *Pairing) teardown() error {
+	var err error
+	p.closer.Do(func() {
+		if p.server != nil {
+			p.server.Close()
+		}
+		err = p.peerset.Close()
+	})
+	return err
+}
+
+// SAS returns the short authentication string of a successfully completed pairing
+// session. The users should compare it out of band to ensure there was no man-
+// in-the-middle swapping out the exchanged identities.
+func (p *Pairing) SAS() (string, error) {
+	select {
 	case <-p.finished:
-		logger.Error("Pairing session already finished")
-		return
+		if p.failure != nil {
+			return "", p.failure
+		}
+		if p.peer.Identity == nil {
+			return "", ErrNotPaired
+		}
+		self := &Identity{Identity: p.self.Identity, Address: p.self.Address, Nonce: p.selfNonce}
+		peer := &Identity{Identity: p.peer.Identity, Address: p.peer.Address, Nonce: p.peerNonce}
+		return SAS(p.session, self, peer), nil
 	default:
-		logger.Error("Pairing session already in progress")
-		return
+		return "", ErrNotPaired
 	}
-	// No matter what happens, mark the pairer finished after this point
-	defer close(p.finished)
+}
+
+// SAS derives a short authentication string from the ephemeral identity of the
+// pairing session and the two revealed identities exchanged through it. The
+// order of the two peers does not matter, the code will match on both sides.
+//
+// The code is short enough to compare by eye, so it is only secure because both
+// sides commit to their identities and nonces before seeing the other's: a man-
+// in-the-middle cannot grind keys for a collision, it gets a single guess.
+func SAS(session tornet.PublicIdentity, a *Identity, b *Identity) string {
+	if bytes.Compare(a.Identity, b.Identity) > 0 {
+		a, b = b, a
+	}
+	hasher := sha3.New256()
+	hasher.Write(session)
+	for _, id := range []*Identity{a, b} {
+		hasher.Write(id.Identity)
+		hasher.Write(id.Address)
+		hasher.Write(id.Nonce[:])
+	}
+	hash := hasher.Sum(nil)
+
+	code := binary.BigEndian.Uint32(hash) % 1000000
+	return fmt.Sprintf("%03d %03d", code/1000, code%1000)
+}
+
+// commitment calculates the hash a peer commits to before revealing its identity.
+func commitment(id *Identity) [32]byte {
+	blob := make([]byte, 0, len(id.Identity)+len(id.Address)+len(id.Nonce))
+	blob = append(blob, id.Identity...)
+	blob = append(blob, id.Address...)
+	blob = append(blob, id.Nonce[:]...)
+	return sha3.Sum256(blob)
+}
 
-	// Send out identity, read theirs
+// exchange concurrently sends a message to the remote peer and reads one from
+// it, failing if either errors or they don't both complete in a timely manner.
+func exchange(enc *gob.Encoder, dec *gob.Decoder, send *Envelope) (*Envelope, error) {
 	errc := make(chan error, 2)
 	go func() {
-		errc <- enc.Encode(&Envelope{
-			Identity: &Identity{
-				Identity: p.self.Identity,
-				Address:  p.self.Address,
-			},
-		})
+		errc <- enc.Encode(send)
 	}()
 	message := new(Envelope)
 	go func() {
@@ -167,16 +279,61 @@ func (p *Pairing) handleV1(uid tornet.IdentityFingerprint, conn net.Conn, enc *g
 		select {
 		case err := <-errc:
 			if err != nil {
-				logger.Warn("Identity exchange failed", "err", err)
-				p.failure = err
-				return
+				return nil, err
 			}
 		case <-timeout.C:
-			logger.Warn("Identity exchange timed out")
-			p.failure = errors.New("exchange timed out")
-			return
+			return nil, errors.New("exchange timed out")
 		}
 	}
+	return message, nil
+}
+
+// handleV1 is the handler for the v1 pairing protocol.
+func (p *Pairing) handleV1(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps protocols.Capabilities, logger log.Logger) {
+	// If the pairing already in progress, reject additional peers
+	select {
+	case p.singleton <- struct{}{}:
+		// Singleton lock received, everyone's happy
+	case <-p.finished:
+		logger.Error("Pairing session already finished")
+		return
+	default:
+		logger.Error("Pairing session already in progress")
+		return
+	}
+	// No matter what happens, mark the pairer finished after this point
+	defer close(p.finished)
+
+	// Commit to our identity before revealing it, so the remote side cannot pick
+	// its own after seeing ours in an attempt to collide the SAS codes
+	if _, err := rand.Read(p.selfNonce[:]); err != nil {
+		logger.Error("Failed to generate pairing nonce", "err", err)
+		p.failure = err
+		return
+	}
+	self := &Identity{
+		Identity: p.self.Identity,
+		Address:  p.self.Address,
+		Nonce:    p.selfNonce,
+	}
+	commit, err := exchange(enc, dec, &Envelope{Commit: &Commit{Hash: commitment(self)}})
+	if err != nil {
+		logger.Warn("Commitment exchange failed", "err", err)
+		p.failure = err
+		return
+	}
+	if commit.Commit == nil {
+		logger.Warn("Missing commitment exchange")
+		p.failure = errors.New("missing commitment exchange")
+		return
+	}
+	// Both sides are committed, send out identity, read theirs
+	message, err := exchange(enc, dec, &Envelope{Identity: self})
+	if err != nil {
+		logger.Warn("Identity exchange failed", "err", err)
+		p.failure = err
+		return
+	}
 	// Decode the received identity and return
 	if message.Identity == nil {
 		logger.Warn("Missing identity exchange")
@@ -193,6 +350,12 @@ func (p *Pairing) handleV1(uid tornet.IdentityFingerprint, conn net.Conn, enc *g
 		p.failure = errors.New("invalid remote address")
 		return
 	}
+	if commitment(message.Identity) != commit.Commit.Hash {
+		logger.Warn("Remote identity doesn't match commitment")
+		p.failure = errors.New("commitment mismatch")
+		return
+	}
+	p.peerNonce = message.Identity.Nonce
 	p.peer = tornet.RemoteKeyRing{
 		Identity: message.Identity.Identity,
 		Address:  message.Identity.Address,
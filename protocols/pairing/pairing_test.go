@@ -6,8 +6,14 @@ package pairing
 import (
 	"bytes"
 	"context"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/coronanet/go-coronanet/protocols"
 	"github.com/coronanet/go-coronanet/tornet"
 	"github.com/ethereum/go-ethereum/log"
 )
@@ -31,7 +37,7 @@ func TestPairing(t *testing.T) {
 	// Initiate a pairing session and join it with the other identity
 	gateway := tornet.NewMockGateway()
 
-	initPairing, secret, address, err := NewServer(gateway, initRemote, log.Root())
+	initPairing, secret, address, err := NewServer(gateway, initRemote, 0, log.Root())
 	if err != nil {
 		t.Fatalf("failed to initiate pairing: %v", err)
 	}
@@ -62,3 +68,258 @@ func TestPairing(t *testing.T) {
 		t.Errorf("joiner address mismatch: have %x, want %x", joinPub.Address, joinRemote.Address)
 	}
 }
+
+// Tests that both sides of a pairing derive the same short authentication string
+// and that substituting either identity results in a different one.
+func TestPairingSAS(t *testing.T) {
+	t.Parallel()
+
+	// Create two identities, one for initiating pairing and one for joining
+	initKeyRing, _ := tornet.GenerateKeyRing()
+	joinKeyRing, _ := tornet.GenerateKeyRing()
+
+	initRemote := tornet.RemoteKeyRing{
+		Identity: initKeyRing.Identity.Public(),
+		Address:  initKeyRing.Addresses[0].Public(),
+	}
+	joinRemote := tornet.RemoteKeyRing{
+		Identity: joinKeyRing.Identity.Public(),
+		Address:  joinKeyRing.Addresses[0].Public(),
+	}
+	// Initiate a pairing session and join it with the other identity
+	gateway := tornet.NewMockGateway()
+
+	initPairing, secret, address, err := NewServer(gateway, initRemote, 0, log.Root())
+	if err != nil {
+		t.Fatalf("failed to initiate pairing: %v", err)
+	}
+	if _, err := initPairing.SAS(); err != ErrNotPaired {
+		t.Fatalf("unfinished pairing error mismatch: have %v, want %v", err, ErrNotPaired)
+	}
+	joinPairing, err := NewClient(gateway, joinRemote, secret, address, log.Root())
+	if err != nil {
+		t.Fatalf("failed to join pairing: %v", err)
+	}
+	if _, err := initPairing.Wait(context.TODO()); err != nil {
+		t.Fatalf("server side pairing failed: %v", err)
+	}
+	if _, err := joinPairing.Wait(context.TODO()); err != nil {
+		t.Fatalf("client side pairing failed: %v", err)
+	}
+	// Ensure the authentication strings match on both sides
+	initSAS, err := initPairing.SAS()
+	if err != nil {
+		t.Fatalf("failed to derive server side SAS: %v", err)
+	}
+	joinSAS, err := joinPairing.SAS()
+	if err != nil {
+		t.Fatalf("failed to derive client side SAS: %v", err)
+	}
+	if initSAS != joinSAS {
+		t.Fatalf("SAS mismatch: initer %v, joiner %v", initSAS, joinSAS)
+	}
+	// Ensure that an attacker substituting either identity gets caught
+	evilKeyRing, _ := tornet.GenerateKeyRing()
+	evil := &Identity{
+		Identity: evilKeyRing.Identity.Public(),
+		Address:  evilKeyRing.Addresses[0].Public(),
+	}
+	initId := &Identity{Identity: initRemote.Identity, Address: initRemote.Address, Nonce: initPairing.selfNonce}
+	joinId := &Identity{Identity: joinRemote.Identity, Address: joinRemote.Address, Nonce: joinPairing.selfNonce}
+
+	if sas := SAS(secret.Public(), initId, joinId); sas != initSAS {
+		t.Fatalf("recomputed SAS mismatch: have %v, want %v", sas, initSAS)
+	}
+	if sas := SAS(secret.Public(), initId, evil); sas == initSAS {
+		t.Errorf("substituted joiner SAS collision: %v", sas)
+	}
+	if sas := SAS(secret.Public(), evil, joinId); sas == initSAS {
+		t.Errorf("substituted initer SAS collision: %v", sas)
+	}
+	// Ensure the revealed identities match the commitments and the nonces differ
+	if initPairing.peerNonce != joinPairing.selfNonce || joinPairing.peerNonce != initPairing.selfNonce {
+		t.Errorf("revealed nonce mismatch")
+	}
+	if initPairing.selfNonce == joinPairing.selfNonce {
+		t.Errorf("pairing nonces not random: %x", initPairing.selfNonce)
+	}
+}
+
+// Tests that a pairing peer revealing an identity other than the one it committed
+// to gets rejected, preventing it from choosing its identity after seeing ours.
+func TestPairingCommitmentMismatch(t *testing.T) {
+	t.Parallel()
+
+	initKeyRing, _ := tornet.GenerateKeyRing()
+	initRemote := tornet.RemoteKeyRing{
+		Identity: initKeyRing.Identity.Public(),
+		Address:  initKeyRing.Addresses[0].Public(),
+	}
+	gateway := tornet.NewMockGateway()
+
+	initPairing, secret, address, err := NewServer(gateway, initRemote, 0, log.Root())
+	if err != nil {
+		t.Fatalf("failed to initiate pairing: %v", err)
+	}
+	// Connect a malicious joiner that commits to one identity and reveals another
+	honestKeyRing, _ := tornet.GenerateKeyRing()
+	evilKeyRing, _ := tornet.GenerateKeyRing()
+
+	honest := &Identity{Identity: honestKeyRing.Identity.Public(), Address: honestKeyRing.Addresses[0].Public()}
+	evil := &Identity{Identity: evilKeyRing.Identity.Public(), Address: evilKeyRing.Addresses[0].Public()}
+
+	peerset := tornet.NewPeerSet(tornet.PeerSetConfig{
+		Trusted: []tornet.PublicIdentity{secret.Public()},
+		Handler: protocols.MakeHandler(protocols.HandlerConfig{
+			Protocol: Protocol,
+			Handlers: map[uint]protocols.Handler{
+				1: func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps protocols.Capabilities, logger log.Logger) {
+					if _, err := exchange(enc, dec, &Envelope{Commit: &Commit{Hash: commitment(honest)}}); err != nil {
+						return
+					}
+					exchange(enc, dec, &Envelope{Identity: evil})
+				},
+			},
+			Envelope: func() interface{} { return new(Envelope) },
+		}),
+		Logger: log.Root(),
+	})
+	defer peerset.Close()
+
+	if _, err := tornet.DialServer(context.TODO(), tornet.DialConfig{
+		Gateway:  gateway,
+		Address:  address,
+		Server:   secret.Public(),
+		Identity: secret,
+		PeerSet:  peerset,
+	}); err != nil {
+		t.Fatalf("failed to join pairing: %v", err)
+	}
+	if _, err := initPairing.Wait(context.TODO()); err == nil {
+		t.Fatalf("mismatching reveal accepted")
+	}
+}
+
+// Tests that closing a pairing session unblocks anyone waiting on it, both if
+// nobody joined yet and if a joiner is stuck mid-exchange.
+func TestPairingAbort(t *testing.T) {
+	t.Parallel()
+
+	keyring, _ := tornet.GenerateKeyRing()
+	self := tornet.RemoteKeyRing{
+		Identity: keyring.Identity.Public(),
+		Address:  keyring.Addresses[0].Public(),
+	}
+	gateway := tornet.NewMockGateway()
+
+	// Abort a pairing session nobody joined and ensure waiting fails
+	idle, _, _, err := NewServer(gateway, self, 0, log.Root())
+	if err != nil {
+		t.Fatalf("failed to initiate pairing: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := idle.Wait(context.TODO())
+		errc <- err
+	}()
+	if err := idle.Close(); err != nil {
+		t.Fatalf("failed to abort idle pairing: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err != ErrAborted {
+			t.Fatalf("idle abort error mismatch: have %v, want %v", err, ErrAborted)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("idle pairing wait not unblocked")
+	}
+	if err := idle.Close(); err != nil {
+		t.Fatalf("failed to re-abort idle pairing: %v", err)
+	}
+	// Join a pairing session with a peer that never sends its identity, abort
+	// the session mid-exchange and ensure waiting fails
+	stuck, secret, address, err := NewServer(gateway, self, 0, log.Root())
+	if err != nil {
+		t.Fatalf("failed to initiate pairing: %v", err)
+	}
+	joined := make(chan struct{})
+	peerset := tornet.NewPeerSet(tornet.PeerSetConfig{
+		Trusted: []tornet.PublicIdentity{secret.Public()},
+		Handler: protocols.MakeHandler(protocols.HandlerConfig{
+			Protocol: Protocol,
+			Handlers: map[uint]protocols.Handler{
+				1: func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps protocols.Capabilities, logger log.Logger) {
+					close(joined)
+					io.Copy(ioutil.Discard, conn)
+				},
+			},
+			Envelope: func() interface{} { return new(Envelope) },
+		}),
+		Logger: log.Root(),
+	})
+	defer peerset.Close()
+
+	if _, err := tornet.DialServer(context.TODO(), tornet.DialConfig{
+		Gateway:  gateway,
+		Address:  address,
+		Server:   secret.Public(),
+		Identity: secret,
+		PeerSet:  peerset,
+	}); err != nil {
+		t.Fatalf("failed to join pairing: %v", err)
+	}
+	select {
+	case <-joined:
+	case <-time.After(time.Second):
+		t.Fatalf("pairing session not joined")
+	}
+	go func() {
+		_, err := stuck.Wait(context.TODO())
+		errc <- err
+	}()
+	if err := stuck.Close(); err != nil {
+		t.Fatalf("failed to abort stuck pairing: %v", err)
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatalf("aborted pairing succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("stuck pairing wait not unblocked")
+	}
+}
+
+// Tests that a pairing session nobody joins expires after its timeout, even if
+// nobody is waiting on it yet.
+func TestPairingExpiry(t *testing.T) {
+	t.Parallel()
+
+	initKeyRing, _ := tornet.GenerateKeyRing()
+	joinKeyRing, _ := tornet.GenerateKeyRing()
+
+	initRemote := tornet.RemoteKeyRing{
+		Identity: initKeyRing.Identity.Public(),
+		Address:  initKeyRing.Addresses[0].Public(),
+	}
+	joinRemote := tornet.RemoteKeyRing{
+		Identity: joinKeyRing.Identity.Public(),
+		Address:  joinKeyRing.Addresses[0].Public(),
+	}
+	gateway := tornet.NewMockGateway()
+
+	initPairing, secret, address, err := NewServer(gateway, initRemote, 50*time.Millisecond, log.Root())
+	if err != nil {
+		t.Fatalf("failed to initiate pairing: %v", err)
+	}
+	// Let the session expire without waiting, ensure it can't be joined any more
+	time.Sleep(250 * time.Millisecond)
+
+	if _, err := NewClient(gateway, joinRemote, secret, address, log.Root()); err == nil {
+		t.Fatalf("joined expired pairing session")
+	}
+	// Ensure the expiry is reported when waiting after the fact
+	if _, err := initPairing.Wait(context.TODO()); err != ErrExpired {
+		t.Fatalf("expired pairing error mismatch: have %v, want %v", err, ErrExpired)
+	}
+}
@@ -17,11 +17,19 @@ const (
 // the `pairing` wire protocol.
 type Envelope struct {
 	Disconnect *protocols.Disconnect
+	Commit     *Commit
 	Identity   *Identity
 }
 
+// Commit sends a hash commitment to the user's identity before revealing it, so
+// that neither side can pick its identity after seeing the other one's.
+type Commit struct {
+	Hash [32]byte // SHA3-256 of the identity, address and nonce to be revealed
+}
+
 // Identity sends the user's `social` protocol P2P identity.
 type Identity struct {
 	Identity tornet.PublicIdentity // Identity to authenticate with
 	Address  tornet.PublicAddress  // Address to contact through
+	Nonce    [32]byte              // Random nonce mixed into the commitment and SAS
 }
@@ -6,11 +6,23 @@ package protocols
 
 // Handshake represents the initial protocol version negotiation.
 type Handshake struct {
-	Protocol string // Protocol expected on this connection
-	Versions []uint // Protocol version numbers supported
+	Protocol     string   // Protocol expected on this connection
+	Versions     []uint   // Protocol version numbers supported
+	Capabilities []string // Optional protocol features supported
 }
 
 // Disconnect represents a notification that the connection is torn down.
 type Disconnect struct {
 	Reason string // Textual disconnect reason, meant for developers
 }
+
+// Ping represents a liveness probe, which the remote side should answer with a
+// Pong carrying the same nonce.
+type Ping struct {
+	Nonce uint64 // Random number to pair up the probe and its answer
+}
+
+// Pong represents the answer to a liveness probe.
+type Pong struct {
+	Nonce uint64 // Nonce of the probe being answered
+}
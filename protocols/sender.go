@@ -0,0 +1,147 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package protocols
+
+import (
+	"encoding/gob"
+	"errors"
+	"sync"
+)
+
+// ErrSenderClosed is returned if a message is attempted to be sent through an
+// outbound queue that was already torn down.
+var ErrSenderClosed = errors.New("sender closed")
+
+// Sender is a per-connection outbound queue with two priority classes. Bulk
+// messages (images, banner chunks) are only written to the wire if there are
+// no priority messages (status, profile, text) waiting, so that essential data
+// is not stuck behind a slow image transfer on a congested Tor circuit.
+//
+// Note, messages are never interrupted once written, so bulk payloads should be
+// split into multiple messages to allow priority ones to jump ahead.
+type Sender struct {
+	enc *gob.Encoder // Encoder to serialize the messages with
+
+	queues [2][]*outbound // Messages waiting to be sent (priority, bulk)
+	wake   chan struct{}  // Notification channel for newly queued messages
+	quit   chan struct{}  // Termination channel to tear down the sender
+	err    error          // Sticky failure after a write error or closure
+
+	once sync.Once
+	lock sync.Mutex
+}
+
+// outbound is a single message waiting to be sent.
+type outbound struct {
+	message interface{} // Message to encode onto the wire
+	result  chan error  // Channel to report the write result on
+}
+
+// NewSender creates an outbound queue on top of a protocol encoder and starts
+// the writer goroutine.
+func NewSender(enc *gob.Encoder) *Sender {
+	sender := &Sender{
+		enc:  enc,
+		wake: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+	}
+	go sender.loop()
+	return sender
+}
+
+// Close tears down the sender, failing all queued messages. A write in progress
+// is not interrupted, it's up to the caller to close the underlying connection.
+func (s *Sender) Close() error {
+	s.once.Do(func() {
+		s.fail(ErrSenderClosed)
+		close(s.quit)
+	})
+	return nil
+}
+
+// Encode queues a priority message and waits until it's written to the wire.
+func (s *Sender) Encode(message interface{}) error {
+	return <-s.queue(message, false)
+}
+
+// EncodeBulk queues a bulk message and waits until it's written to the wire.
+func (s *Sender) EncodeBulk(message interface{}) error {
+	return <-s.queue(message, true)
+}
+
+// queue inserts a message into one of the outbound queues, returning a channel
+// through which the result of the write is reported.
+func (s *Sender) queue(message interface{}, bulk bool) <-chan error {
+	result := make(chan error, 1)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err != nil {
+		result <- s.err
+		return result
+	}
+	class := 0
+	if bulk {
+		class = 1
+	}
+	s.queues[class] = append(s.queues[class], &outbound{message: message, result: result})
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return result
+}
+
+// fail marks the sender failed and aborts all queued messages with the error.
+func (s *Sender) fail(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+	for i, queue := range s.queues {
+		for _, msg := range queue {
+			msg.result <- s.err
+		}
+		s.queues[i] = nil
+	}
+}
+
+// loop is the writer goroutine, always sending the oldest message of the highest
+// priority class available.
+func (s *Sender) loop() {
+	for {
+		// Pick the next message to send, or wait until one arrives
+		var next *outbound
+
+		s.lock.Lock()
+		for i, queue := range s.queues {
+			if len(queue) > 0 {
+				next, s.queues[i] = queue[0], queue[1:]
+				break
+			}
+		}
+		s.lock.Unlock()
+
+		if next == nil {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.quit:
+				return
+			}
+		}
+		// Message available, send it and abort everything on failure
+		err := s.enc.Encode(next.message)
+		next.result <- err
+
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+}
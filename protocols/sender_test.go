@@ -0,0 +1,91 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package protocols
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"net"
+	"testing"
+)
+
+// testMessage is a minimal envelope to push through a sender.
+type testMessage struct {
+	Status string // Small priority payload
+	Chunk  []byte // Large bulk payload
+}
+
+// Tests that a priority message queued during an in-progress bulk transfer is
+// sent ahead of the remaining bulk messages.
+func TestSenderPriority(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	sender := NewSender(gob.NewEncoder(local))
+	defer sender.Close()
+
+	dec := gob.NewDecoder(remote)
+
+	// Queue up a bulk transfer and wait for the first chunk to be in flight
+	var results []<-chan error
+	for i := 0; i < 4; i++ {
+		results = append(results, sender.queue(&testMessage{Chunk: bytes.Repeat([]byte{byte(i)}, 1024)}, true))
+	}
+	message := new(testMessage)
+	if err := dec.Decode(message); err != nil {
+		t.Fatalf("failed to decode first chunk: %v", err)
+	}
+	if len(message.Chunk) == 0 || message.Chunk[0] != 0 {
+		t.Fatalf("first message mismatch: have %v, want chunk #0", message)
+	}
+	// Queue a status update while the bulk transfer is in progress
+	status := sender.queue(&testMessage{Status: "positive"}, false)
+
+	// The writer might have already picked up the next chunk, but the status
+	// update must overtake all the others
+	var chunks []byte
+	for i := 0; i < 4; i++ {
+		message := new(testMessage)
+		if err := dec.Decode(message); err != nil {
+			t.Fatalf("failed to decode message %d: %v", i, err)
+		}
+		if message.Status != "" {
+			if len(chunks) > 1 {
+				t.Fatalf("status update delivered after chunks %v", chunks)
+			}
+			continue
+		}
+		chunks = append(chunks, message.Chunk[0])
+	}
+	if !bytes.Equal(chunks, []byte{1, 2, 3}) {
+		t.Fatalf("chunk order mismatch: have %v, want %v", chunks, []byte{1, 2, 3})
+	}
+	for i, result := range append(results, status) {
+		if err := <-result; err != nil {
+			t.Errorf("message %d: send failed: %v", i, err)
+		}
+	}
+}
+
+// Tests that a failed write aborts all queued messages and rejects new ones.
+func TestSenderFailure(t *testing.T) {
+	reader, writer := io.Pipe()
+	reader.Close()
+
+	sender := NewSender(gob.NewEncoder(writer))
+	defer sender.Close()
+
+	if err := sender.Encode(&testMessage{Status: "positive"}); err != io.ErrClosedPipe {
+		t.Fatalf("failed send error mismatch: have %v, want %v", err, io.ErrClosedPipe)
+	}
+	if err := sender.EncodeBulk(&testMessage{Chunk: []byte{1}}); err != io.ErrClosedPipe {
+		t.Fatalf("post-failure send error mismatch: have %v, want %v", err, io.ErrClosedPipe)
+	}
+	sender.Close()
+	if err := sender.Encode(&testMessage{Status: "negative"}); err != io.ErrClosedPipe {
+		t.Fatalf("post-close send error mismatch: have %v, want %v", err, io.ErrClosedPipe)
+	}
+}
@@ -0,0 +1,253 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package protocols
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Direction is the flow direction of a traced protocol message.
+type Direction int
+
+const (
+	// Inbound marks a message received from the remote peer.
+	Inbound Direction = iota
+
+	// Outbound marks a message sent to the remote peer.
+	Outbound
+)
+
+// String implements fmt.Stringer.
+func (dir Direction) String() string {
+	if dir == Inbound {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+// Tracer is a debug callback to observe every protocol message that crosses the
+// wire, after sensitive payloads have been redacted.
+type Tracer func(dir Direction, proto string, uid tornet.IdentityFingerprint, msg interface{})
+
+// TracerSource is an optional interface that the owner of a protocol instance
+// (e.g. the host or guest of an event) may implement to have its connections
+// traced without the protocol needing to know about tracing.
+type TracerSource interface {
+	// Tracer returns the tracer to observe a new connection with (nil = off).
+	Tracer() Tracer
+}
+
+// TracerOf returns a tracer getter for the given protocol owner if it supports
+// tracing, or nil otherwise. The result can be used as HandlerConfig.Tracer.
+func TracerOf(owner interface{}) func() Tracer {
+	if source, ok := owner.(TracerSource); ok {
+		return source.Tracer
+	}
+	return nil
+}
+
+// tracerBlobLimit is the maximum length of a binary blob that is left intact in
+// traced messages. This retains keys and signatures, but drops images and such.
+const tracerBlobLimit = 64
+
+// tracerQueueLimit is the maximum number of network reads or writes buffered up
+// for a tracer. If the tracer falls behind, tracing the stream is abandoned as
+// opposed to stalling the real protocol connection.
+const tracerQueueLimit = 1024
+
+// traceStream is a bounded, non-blocking duplicate of one direction of a network
+// stream. It is fed by the connection and drained by a gob decoder.
+type traceStream struct {
+	chunks  chan []byte // Duplicated network chunks waiting to be decoded
+	pending []byte      // Remainder of the chunk being decoded
+	dropped bool        // Whether the stream was abandoned due to overflow
+	closed  bool        // Whether the stream was already closed
+	lock    sync.Mutex  // Protects the feeding side against concurrent closes
+}
+
+// newTraceStream creates a bounded trace stream.
+func newTraceStream() *traceStream {
+	return &traceStream{chunks: make(chan []byte, tracerQueueLimit)}
+}
+
+// feed duplicates a chunk of network data into the trace stream. If the tracer
+// cannot keep up, the stream is abandoned since any gap would corrupt the gob
+// decoding anyway. This method never blocks.
+func (s *traceStream) feed(b []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.chunks <- append([]byte{}, b...):
+	default:
+		s.dropped, s.closed = true, true
+		close(s.chunks)
+	}
+}
+
+// close terminates the trace stream, letting the decoder run dry.
+func (s *traceStream) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.chunks)
+	}
+}
+
+// overflowed returns whether the stream was abandoned due to the tracer being
+// too slow.
+func (s *traceStream) overflowed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.dropped
+}
+
+// Read implements io.Reader, retrieving the duplicated network data.
+func (s *traceStream) Read(b []byte) (int, error) {
+	for len(s.pending) == 0 {
+		chunk, ok := <-s.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		s.pending = chunk
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// tracedConn is a network connection that duplicates all the inbound and the
+// outbound traffic into separate gob decoders to reconstruct the exchanged
+// messages for tracing, without touching the real data flow.
+type tracedConn struct {
+	net.Conn
+
+	inbound  *traceStream // Duplicate of the read stream for the tracer
+	outbound *traceStream // Duplicate of the written stream for the tracer
+}
+
+// newTracedConn wraps a network connection and starts the tracers for both the
+// inbound and outbound traffic.
+func newTracedConn(conn net.Conn, tracer Tracer, config HandlerConfig, uid tornet.IdentityFingerprint) *tracedConn {
+	in, out := newTraceStream(), newTraceStream()
+
+	go runTracer(in, Inbound, tracer, config, uid)
+	go runTracer(out, Outbound, tracer, config, uid)
+
+	return &tracedConn{
+		Conn:     conn,
+		inbound:  in,
+		outbound: out,
+	}
+}
+
+// Read implements io.Reader, duplicating any read data into the tracer.
+func (c *tracedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.inbound.feed(b[:n])
+	}
+	return n, err
+}
+
+// Write implements io.Writer, duplicating any written data into the tracer.
+func (c *tracedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.outbound.feed(b[:n])
+	}
+	return n, err
+}
+
+// Close implements io.Closer, tearing down the tracers too.
+func (c *tracedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+// release terminates the tracers of the connection.
+func (c *tracedConn) release() {
+	c.inbound.close()
+	c.outbound.close()
+}
+
+// runTracer decodes a duplicated gob stream (handshake first, envelopes after)
+// and feeds the redacted messages to the tracer.
+func runTracer(stream *traceStream, dir Direction, tracer Tracer, config HandlerConfig, uid tornet.IdentityFingerprint) {
+	dec := gob.NewDecoder(stream)
+
+	handshake := new(Handshake)
+	if err := dec.Decode(handshake); err != nil {
+		if stream.overflowed() {
+			tracer(dir, config.Protocol, uid, errors.New("trace abandoned: tracer too slow"))
+		}
+		return
+	}
+	tracer(dir, config.Protocol, uid, handshake)
+
+	for {
+		msg := config.Envelope()
+		if err := dec.Decode(msg); err != nil {
+			switch {
+			case stream.overflowed():
+				tracer(dir, config.Protocol, uid, errors.New("trace abandoned: tracer too slow"))
+			case err != io.EOF:
+				tracer(dir, config.Protocol, uid, fmt.Errorf("trace failed: %v", err))
+			}
+			return
+		}
+		redact(reflect.ValueOf(msg))
+		tracer(dir, config.Protocol, uid, msg)
+	}
+}
+
+// redact walks a decoded message and strips out any potentially sensitive or
+// huge payloads: long binary blobs (images) and free form texts.
+func redact(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			redact(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			if !field.CanSet() {
+				continue
+			}
+			switch name := v.Type().Field(i).Name; {
+			case field.Kind() == reflect.String && (name == "Text" || name == "Message") && field.Len() > 0:
+				field.SetString(fmt.Sprintf("<redacted %d bytes>", field.Len()))
+			default:
+				redact(field)
+			}
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Len() > tracerBlobLimit && v.CanSet() {
+				v.Set(reflect.Zero(v.Type()))
+			}
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			redact(v.Index(i))
+		}
+	case reflect.Map:
+		// Maps are not used in any protocol, ignore
+	}
+}
@@ -0,0 +1,193 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package protocols
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// testEnvelope is a tiny protocol message for testing the tracer.
+type testEnvelope struct {
+	Text  string // Should be redacted
+	Image []byte // Should be dropped if large
+	Sig   []byte // Should be retained if small
+}
+
+// testTrace is a single message observed by the tracer.
+type testTrace struct {
+	dir Direction
+	msg interface{}
+}
+
+// Tests that the tracer observes the handshake and all the exchanged messages,
+// with sensitive payloads redacted.
+func TestTracer(t *testing.T) {
+	// Create a tracer that collects all observed messages
+	var (
+		lock   sync.Mutex
+		traces = make(map[tornet.IdentityFingerprint][]testTrace)
+	)
+	tracer := func(dir Direction, proto string, uid tornet.IdentityFingerprint, msg interface{}) {
+		if proto != "test" {
+			t.Errorf("protocol mismatch: have %s, want %s", proto, "test")
+		}
+		lock.Lock()
+		defer lock.Unlock()
+
+		traces[uid] = append(traces[uid], testTrace{dir, msg})
+	}
+	envelope := func() interface{} { return new(testEnvelope) }
+
+	// Create a ping-pong protocol on both sides of a pipe
+	var (
+		image = bytes.Repeat([]byte{0x01}, 1024)
+		sig   = []byte{0x02, 0x03}
+	)
+	client := MakeHandler(HandlerConfig{
+		Protocol: "test",
+		Handlers: map[uint]Handler{
+			1: func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps Capabilities, logger log.Logger) {
+				enc.Encode(&testEnvelope{Text: "ping", Image: image, Sig: sig})
+				dec.Decode(new(testEnvelope))
+			},
+		},
+		Tracer:   func() Tracer { return tracer },
+		Envelope: envelope,
+	})
+	server := MakeHandler(HandlerConfig{
+		Protocol: "test",
+		Handlers: map[uint]Handler{
+			1: func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps Capabilities, logger log.Logger) {
+				dec.Decode(new(testEnvelope))
+				enc.Encode(&testEnvelope{Text: "pong"})
+			},
+		},
+	})
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	done := make(chan struct{})
+	go func() {
+		server("server", s, log.Root())
+		close(done)
+	}()
+	client("client", c, log.Root())
+	<-done
+
+	// Wait until the asynchronous tracers catch up and verify the messages
+	want := []testTrace{
+		{Outbound, &Handshake{Protocol: "test", Versions: []uint{1}}},
+		{Inbound, &Handshake{Protocol: "test", Versions: []uint{1}}},
+		{Outbound, &testEnvelope{Text: "<redacted 4 bytes>", Sig: sig}},
+		{Inbound, &testEnvelope{Text: "<redacted 4 bytes>"}},
+	}
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		n := len(traces["client"])
+		lock.Unlock()
+		if n >= len(want) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, ok := traces["server"]; ok {
+		t.Fatalf("untraced handler observed: %v", traces["server"])
+	}
+	// Inbound and outbound messages are traced independently, compare per direction
+	for _, dir := range []Direction{Outbound, Inbound} {
+		var have, exp []testTrace
+		for _, trace := range traces["client"] {
+			if trace.dir == dir {
+				have = append(have, trace)
+			}
+		}
+		for _, trace := range want {
+			if trace.dir == dir {
+				exp = append(exp, trace)
+			}
+		}
+		if !reflect.DeepEqual(have, exp) {
+			t.Fatalf("%v trace mismatch: have %+v, want %+v", dir, have, exp)
+		}
+	}
+}
+
+// Tests that a stuck tracer does not stall the real protocol connection, rather
+// the trace is abandoned once its buffer overflows.
+func TestTracerOverflow(t *testing.T) {
+	// Create a tracer that blocks until released, collecting any errors
+	var (
+		release = make(chan struct{})
+		errs    = make(chan error, 2)
+	)
+	tracer := func(dir Direction, proto string, uid tornet.IdentityFingerprint, msg interface{}) {
+		<-release
+		if err, ok := msg.(error); ok {
+			errs <- err
+		}
+	}
+	// Create a protocol which sends a lot more messages than the trace buffer
+	count := 2 * tracerQueueLimit
+
+	client := MakeHandler(HandlerConfig{
+		Protocol: "test",
+		Handlers: map[uint]Handler{
+			1: func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps Capabilities, logger log.Logger) {
+				for i := 0; i < count; i++ {
+					enc.Encode(&testEnvelope{Sig: []byte{byte(i)}})
+				}
+			},
+		},
+		Tracer:   func() Tracer { return tracer },
+		Envelope: func() interface{} { return new(testEnvelope) },
+	})
+	server := MakeHandler(HandlerConfig{
+		Protocol: "test",
+		Handlers: map[uint]Handler{
+			1: func(uid tornet.IdentityFingerprint, conn net.Conn, enc *gob.Encoder, dec *gob.Decoder, caps Capabilities, logger log.Logger) {
+				for i := 0; i < count; i++ {
+					dec.Decode(new(testEnvelope))
+				}
+			},
+		},
+	})
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+
+	done := make(chan struct{})
+	go server("server", s, log.Root())
+	go func() {
+		client("client", c, log.Root())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stuck tracer stalled the connection")
+	}
+	close(release)
+
+	select {
+	case err := <-errs:
+		if err.Error() != "trace abandoned: tracer too slow" {
+			t.Fatalf("trace error mismatch: have %v, want abandoned trace", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("abandoned trace not reported")
+	}
+}
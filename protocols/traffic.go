@@ -0,0 +1,97 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package protocols
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Traffic is the number of bytes exchanged over all the connections of a single
+// protocol.
+type Traffic struct {
+	In  uint64 // Number of bytes read from remote peers
+	Out uint64 // Number of bytes written to remote peers
+}
+
+// trafficCounter is the live tally of a single protocol's traffic.
+//
+// Note, the fields are accessed atomically, keep them 64 bit aligned.
+type trafficCounter struct {
+	in  uint64 // Number of bytes read from remote peers
+	out uint64 // Number of bytes written to remote peers
+}
+
+var (
+	trafficCounters = make(map[string]*trafficCounter) // Live traffic tallies per protocol
+	trafficLock     sync.RWMutex                       // Lock protecting the counter set
+)
+
+// trafficOf retrieves the traffic counter of a protocol, creating it if this is
+// the first connection running it.
+func trafficOf(protocol string) *trafficCounter {
+	trafficLock.RLock()
+	counter, ok := trafficCounters[protocol]
+	trafficLock.RUnlock()
+
+	if ok {
+		return counter
+	}
+	trafficLock.Lock()
+	defer trafficLock.Unlock()
+
+	if counter, ok = trafficCounters[protocol]; !ok {
+		counter = new(trafficCounter)
+		trafficCounters[protocol] = counter
+	}
+	return counter
+}
+
+// TrafficByProtocol returns the number of bytes exchanged so far by each protocol
+// that was run within the process, including connections already torn down.
+func TrafficByProtocol() map[string]Traffic {
+	trafficLock.RLock()
+	defer trafficLock.RUnlock()
+
+	traffic := make(map[string]Traffic, len(trafficCounters))
+	for protocol, counter := range trafficCounters {
+		traffic[protocol] = Traffic{
+			In:  atomic.LoadUint64(&counter.in),
+			Out: atomic.LoadUint64(&counter.out),
+		}
+	}
+	return traffic
+}
+
+// meteredConn is a net.Conn wrapper that tallies all the traffic passing through
+// into a protocol's counters.
+type meteredConn struct {
+	net.Conn // Pass everything non-interesting through
+
+	counter *trafficCounter // Protocol counter to tally the traffic into
+}
+
+// newMeteredConn wraps a connection to tally its traffic into the counters of
+// the given protocol.
+func newMeteredConn(conn net.Conn, protocol string) net.Conn {
+	return &meteredConn{
+		Conn:    conn,
+		counter: trafficOf(protocol),
+	}
+}
+
+// Read implements net.Conn, tallying the bytes read, even if the read failed.
+func (c *meteredConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	atomic.AddUint64(&c.counter.in, uint64(n))
+	return n, err
+}
+
+// Write implements net.Conn, tallying the bytes written, even if the write failed.
+func (c *meteredConn) Write(buf []byte) (int, error) {
+	n, err := c.Conn.Write(buf)
+	atomic.AddUint64(&c.counter.out, uint64(n))
+	return n, err
+}
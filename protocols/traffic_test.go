@@ -0,0 +1,41 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package protocols
+
+import (
+	"net"
+	"testing"
+)
+
+// Tests that metered connections tally their traffic into their protocol's
+// counters, which persist across connection churn.
+func TestTrafficAccounting(t *testing.T) {
+	for i := 1; i <= 2; i++ {
+		local, remote := net.Pipe()
+
+		conn := newMeteredConn(local, "traffic-test")
+		go remote.Write(make([]byte, 3))
+		if _, err := conn.Read(make([]byte, 3)); err != nil {
+			t.Fatalf("failed to read from metered conn: %v", err)
+		}
+		go remote.Read(make([]byte, 5))
+		if _, err := conn.Write(make([]byte, 5)); err != nil {
+			t.Fatalf("failed to write to metered conn: %v", err)
+		}
+		// Tear down the connection and ensure the counters survive it
+		remote.Close()
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("read from closed connection succeeded")
+		}
+		conn.Close()
+
+		traffic, ok := TrafficByProtocol()["traffic-test"]
+		if !ok {
+			t.Fatalf("run %d: protocol traffic not reported", i)
+		}
+		if traffic.In != uint64(3*i) || traffic.Out != uint64(5*i) {
+			t.Fatalf("run %d: traffic mismatch: have %d/%d, want %d/%d", i, traffic.In, traffic.Out, 3*i, 5*i)
+		}
+	}
+}
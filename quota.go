@@ -0,0 +1,146 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// StorageUsage estimates the number of bytes the backend's data directory takes
+// up. It's the database's own estimate of its on disk size, with the images in
+// the CDN swapped out for their exact stored sizes (the estimate lags behind
+// until the database compacts, which would hide any freshly freed images).
+func (b *Backend) StorageUsage() (uint64, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return b.storageUsageEstimate()
+}
+
+// storageUsageEstimate is the lock free internals of StorageUsage.
+//
+// Note, this method assumes the read lock is held.
+func (b *Backend) storageUsageEstimate() (uint64, error) {
+	cdn := util.BytesPrefix(dbCDNImagePrefix)
+
+	sizes, err := b.database.SizeOf([]util.Range{
+		{Start: nil, Limit: cdn.Start},
+		{Start: cdn.Limit, Limit: nil},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return uint64(sizes.Sum()) + b.storageUsage(dbCDNImagePrefix), nil
+}
+
+// enforceStorageQuota checks whether the data directory exceeds the configured
+// soft quota, and if so, evicts the banners of joined events, the least recently
+// synced ones first, until the usage drops below it. The number of dereferenced
+// banners is returned.
+//
+// Only events that concluded and exceeded their maintenance period are touched,
+// since nothing will sync them any more. Banners of running joined events would
+// just be downloaded again (racing with the eviction), whereas hosted events and
+// the profile are never evicted. An image shared with any of those survives the
+// eviction, since only the joined event's reference to it is dropped.
+func (b *Backend) enforceStorageQuota() (int, error) {
+	if b.config.StorageQuota == 0 {
+		return 0, nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// If the backend was torn down meanwhile, there's nothing to enforce
+	if b.database == nil {
+		return 0, nil
+	}
+	usage, err := b.storageUsageEstimate()
+	if err != nil {
+		return 0, err
+	}
+	if usage <= b.config.StorageQuota {
+		b.quotaExceeded = false
+		return 0, nil
+	}
+	b.logger.Warn("Storage quota exceeded", "usage", usage, "quota", b.config.StorageQuota)
+
+	// Gather all the joined events whose banners can be safely evicted
+	type candidate struct {
+		event tornet.IdentityFingerprint
+		infos *events.ClientInfos
+	}
+	var candidates []candidate
+	for _, event := range b.JoinedEvents() {
+		if _, ok := b.joined[event]; ok {
+			continue
+		}
+		infos, err := b.JoinedEvent(event)
+		if err != nil || infos.Banner == ([32]byte{}) {
+			continue
+		}
+		if infos.End == (time.Time{}) || time.Since(infos.End) <= params.EventMaintenancePeriod {
+			continue
+		}
+		candidates = append(candidates, candidate{event: event, infos: infos})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if !candidates[i].infos.Synced.Equal(candidates[j].infos.Synced) {
+			return candidates[i].infos.Synced.Before(candidates[j].infos.Synced)
+		}
+		return candidates[i].event < candidates[j].event
+	})
+	// Evict the banners until the usage drops below the quota. Deletions are only
+	// reflected in the database estimate after compaction, so track the freed CDN
+	// bytes manually.
+	var evicted int
+	for _, candidate := range candidates {
+		if usage <= b.config.StorageQuota {
+			break
+		}
+		hash := candidate.infos.Banner
+
+		freed := uint64(0)
+		if refs, _ := b.cdnImageMeta(hash); refs == 1 {
+			freed = b.cdnImageUsage(hash)
+		}
+		candidate.infos.Banner = [32]byte{}
+
+		blob, err := json.Marshal(candidate.infos)
+		if err != nil {
+			return evicted, err
+		}
+		if err := b.putSecret(append(dbJoinedEventPrefix, candidate.event...), blob); err != nil {
+			return evicted, err
+		}
+		if err := b.deleteCDNImage(hash); err != nil {
+			return evicted, err
+		}
+		b.logger.Info("Evicted joined event banner", "event", candidate.event, "freed", freed)
+
+		usage -= freed
+		evicted++
+	}
+	if evicted > 0 {
+		b.database.CompactRange(*util.BytesPrefix(dbCDNImagePrefix))
+	}
+	// Warn the user if something was evicted, or if the quota was just exceeded
+	// and nothing could be done about it
+	if evicted > 0 || !b.quotaExceeded {
+		message := fmt.Sprintf("Storage quota exceeded, evicted %d event banners", evicted)
+		if usage > b.config.StorageQuota {
+			message = fmt.Sprintf("%s, still using %d bytes out of %d", message, usage, b.config.StorageQuota)
+		}
+		b.feed.publish(Event{Kind: EventStorageQuota, Message: message})
+	}
+	b.quotaExceeded = usage > b.config.StorageQuota
+	return evicted, nil
+}
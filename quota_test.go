@@ -0,0 +1,120 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that exceeding the storage quota evicts the banners of old joined events,
+// least recently synced first, without touching running or hosted events.
+func TestStorageQuotaEviction(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	feed, unsub := backend.Subscribe()
+	defer unsub()
+
+	// Create a few joined events with banners, some of them still relevant
+	var (
+		now      = time.Now()
+		expired  = now.Add(-params.EventMaintenancePeriod - time.Hour)
+		banners  = make(map[tornet.IdentityFingerprint][32]byte)
+		makeBlob = func(seed byte) []byte { return bytes.Repeat([]byte{seed, seed + 1, seed + 2}, 4096) }
+	)
+	join := func(event tornet.IdentityFingerprint, end time.Time, synced time.Time, banner []byte) {
+		hash, err := backend.uploadCDNImage(banner)
+		if err != nil {
+			t.Fatalf("failed to upload banner: %v", err)
+		}
+		blob, _ := json.Marshal(&events.ClientInfos{Name: string(event), Banner: hash, End: end, Synced: synced})
+		if err := backend.putSecret(append(dbJoinedEventPrefix, event...), blob); err != nil {
+			t.Fatalf("failed to store event: %v", err)
+		}
+		banners[event] = hash
+	}
+	join("oldest", expired, expired, makeBlob(1))
+	join("older", expired, expired.Add(time.Minute), makeBlob(2))
+	join("running", time.Time{}, now, makeBlob(3))
+	join("tracked", expired, expired.Add(-time.Minute), makeBlob(4))
+	backend.joined["tracked"] = nil
+
+	// Host an event sharing its banner with an old joined one
+	hash, err := backend.uploadCDNImage(makeBlob(2))
+	if err != nil {
+		t.Fatalf("failed to upload banner: %v", err)
+	}
+	blob, _ := json.Marshal(&events.ServerInfos{Name: "hosted", Banner: hash})
+	if err := backend.putSecret(append(dbHostedEventPrefix, "hosted"...), blob); err != nil {
+		t.Fatalf("failed to store event: %v", err)
+	}
+	// Without a quota, nothing should be evicted
+	usage, err := backend.StorageUsage()
+	if err != nil {
+		t.Fatalf("failed to retrieve storage usage: %v", err)
+	}
+	if evicted, err := backend.enforceStorageQuota(); err != nil || evicted != 0 {
+		t.Fatalf("unlimited eviction mismatch: have %d/%v, want %d/%v", evicted, err, 0, nil)
+	}
+	// Go slightly over quota and ensure only the least recently synced is evicted
+	backend.config.StorageQuota = usage - 1
+
+	if evicted, err := backend.enforceStorageQuota(); err != nil || evicted != 1 {
+		t.Fatalf("eviction mismatch: have %d/%v, want %d/%v", evicted, err, 1, nil)
+	}
+	if infos, _ := backend.JoinedEvent("oldest"); infos.Banner != ([32]byte{}) {
+		t.Fatalf("oldest banner not dereferenced")
+	}
+	if _, err := backend.CDNImage(banners["oldest"]); err != ErrImageNotFound {
+		t.Fatalf("evicted banner error mismatch: have %v, want %v", err, ErrImageNotFound)
+	}
+	if infos, _ := backend.JoinedEvent("older"); infos.Banner != banners["older"] {
+		t.Fatalf("older banner evicted prematurely")
+	}
+	select {
+	case ev := <-feed:
+		if ev.Kind != EventStorageQuota {
+			t.Fatalf("notification kind mismatch: have %s, want %s", ev.Kind, EventStorageQuota)
+		}
+	default:
+		t.Fatalf("eviction not notified")
+	}
+	// Go way over quota and ensure only the safe banners are evicted
+	backend.config.StorageQuota = 1
+
+	if evicted, err := backend.enforceStorageQuota(); err != nil || evicted != 1 {
+		t.Fatalf("eviction mismatch: have %d/%v, want %d/%v", evicted, err, 1, nil)
+	}
+	if infos, _ := backend.JoinedEvent("older"); infos.Banner != ([32]byte{}) {
+		t.Fatalf("older banner not dereferenced")
+	}
+	for _, event := range []tornet.IdentityFingerprint{"running", "tracked"} {
+		if infos, _ := backend.JoinedEvent(event); infos.Banner != banners[event] {
+			t.Fatalf("%s banner evicted", event)
+		}
+		if _, err := backend.CDNImage(banners[event]); err != nil {
+			t.Fatalf("%s banner image missing: %v", event, err)
+		}
+	}
+	if _, err := backend.CDNImage(hash); err != nil {
+		t.Fatalf("hosted banner image missing: %v", err)
+	}
+	// Ensure that repeated checks don't spam the user if nothing more can be done
+	<-feed
+	if evicted, err := backend.enforceStorageQuota(); err != nil || evicted != 0 {
+		t.Fatalf("noop eviction mismatch: have %d/%v, want %d/%v", evicted, err, 0, nil)
+	}
+	select {
+	case ev := <-feed:
+		t.Fatalf("repeated notification: %+v", ev)
+	default:
+	}
+}
@@ -0,0 +1,200 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// ErrRefreshThrottled is returned if a refresh of all contacts and events is
+// requested too soon after the previous one.
+var ErrRefreshThrottled = errors.New("refresh throttled")
+
+const (
+	// ReachabilityContact marks a reachability entry about a remote contact.
+	ReachabilityContact = "contact"
+
+	// ReachabilityEvent marks a reachability entry about a joined event.
+	ReachabilityEvent = "event"
+)
+
+// Reachability is a diagnostic snapshot of the network connectivity towards a
+// single trusted entity (remote contact or joined event).
+type Reachability struct {
+	Kind      string                     `json:"kind"`            // Type of the entity (contact or event)
+	Identity  tornet.IdentityFingerprint `json:"identity"`        // Unique identifier of the entity
+	Connected bool                       `json:"connected"`       // Whether there's a live connection to the entity
+	Contacted time.Time                  `json:"contacted"`       // Time of the last successful contact (zero if never)
+	Scheduled time.Time                  `json:"scheduled"`       // Time of the next scheduled dial (zero if none)
+	Failure   string                     `json:"error,omitempty"` // Error of the last dial if it failed
+}
+
+// ContactConnectivity is a snapshot of the dial state of a single remote contact,
+// allowing the UI to flag contacts that have been persistently unreachable.
+type ContactConnectivity struct {
+	Failures int       `json:"failures"`          // Number of consecutive failed dials (reset on success)
+	LastErr  string    `json:"lasterr,omitempty"` // Error of the last dial if it failed
+	NextDial time.Time `json:"nextdial"`          // Time of the next scheduled dial
+}
+
+// ContactConnectivity retrieves the dial state of all the remote contacts that
+// are scheduled for dialing. The snapshot is assembled by the dial scheduler in
+// one go, so it is consistent across contacts. If the scheduler is not running,
+// nil is returned.
+func (b *Backend) ContactConnectivity() map[tornet.IdentityFingerprint]ContactConnectivity {
+	statuses := b.dialer.statuses()
+	if statuses == nil {
+		return nil
+	}
+	conns := make(map[tornet.IdentityFingerprint]ContactConnectivity, len(statuses))
+	for uid, status := range statuses {
+		conn := ContactConnectivity{
+			Failures: status.failures,
+			NextDial: status.next,
+		}
+		if status.failure != nil {
+			conn.LastErr = status.failure.Error()
+		}
+		conns[uid] = conn
+	}
+	return conns
+}
+
+// ReachabilityReport collects the connectivity status of all the trusted remote
+// contacts and joined events, aggregated from the overlay, the dial scheduler
+// and the event clients into one view.
+func (b *Backend) ReachabilityReport() ([]Reachability, error) {
+	prof, err := b.Profile()
+	if err != nil {
+		return nil, ErrProfileNotFound
+	}
+	// Retrieve the dial schedule first, as the scheduler needs the lock too
+	statuses := b.dialer.statuses()
+
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	report := make([]Reachability, 0, len(prof.KeyRing.Trusted)+len(b.joined))
+	for uid := range prof.KeyRing.Trusted {
+		entry := Reachability{
+			Kind:      ReachabilityContact,
+			Identity:  uid,
+			Connected: b.peerset[uid] != nil,
+			Contacted: b.contacted[uid],
+		}
+		if entry.Connected {
+			entry.Contacted = time.Now()
+		}
+		if status, ok := statuses[uid]; ok {
+			entry.Scheduled = status.next
+			if status.failure != nil {
+				entry.Failure = status.failure.Error()
+			}
+		}
+		report = append(report, entry)
+	}
+	for uid, client := range b.joined {
+		conn := client.Connectivity()
+
+		entry := Reachability{
+			Kind:      ReachabilityEvent,
+			Identity:  uid,
+			Connected: conn.Connected,
+			Contacted: conn.Dialed,
+			Scheduled: conn.Next,
+		}
+		if conn.Failure != nil {
+			entry.Failure = conn.Failure.Error()
+		}
+		report = append(report, entry)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Kind != report[j].Kind {
+			return report[i].Kind < report[j].Kind
+		}
+		return report[i].Identity < report[j].Identity
+	})
+	return report, nil
+}
+
+// SyncContact requests an immediate data exchange with a single remote contact,
+// e.g. to pull its latest profile on demand. The dial is handed to the dial
+// scheduler and the method returns without waiting for it.
+//
+// If the contact is already connected, there's nothing to do. Repeated requests
+// in quick succession are coalesced into the one already scheduled, to avoid
+// stacking multiple dials to the same contact.
+func (b *Backend) SyncContact(uid tornet.IdentityFingerprint) error {
+	b.logger.Info("Syncing contact", "contact", uid)
+
+	if _, err := b.Contact(uid); err != nil {
+		return ErrContactNotFound
+	}
+	b.lock.Lock()
+	if !b.enabled {
+		b.lock.Unlock()
+		return ErrNetworkDisabled
+	}
+	if b.peerset[uid] != nil {
+		b.lock.Unlock()
+		return nil
+	}
+	if time.Since(b.synced[uid]) < contactSyncCoalesce {
+		b.lock.Unlock()
+		b.logger.Debug("Coalescing contact sync", "contact", uid)
+		return nil
+	}
+	b.synced[uid] = time.Now()
+	b.lock.Unlock()
+
+	// Trigger the dial outside of the lock, the scheduler might need it
+	b.dialer.prioritize(0, []tornet.IdentityFingerprint{uid})
+	return nil
+}
+
+// RefreshAll requests an immediate data exchange with every trusted contact not
+// currently connected and with every joined event. It's meant to be called when
+// the user explicitly wants fresh data (i.e. pull to refresh).
+//
+// The contacts are handed to the dial scheduler, which connects to them one by
+// one, so that refreshing many contacts does not storm the Tor network. Repeated
+// refreshes within a cooldown period are rejected for the same reason.
+func (b *Backend) RefreshAll() error {
+	prof, err := b.Profile()
+	if err != nil {
+		return ErrProfileNotFound
+	}
+	b.lock.Lock()
+	if time.Since(b.refreshed) < refreshCooldown {
+		b.lock.Unlock()
+		return ErrRefreshThrottled
+	}
+	b.refreshed = time.Now()
+
+	offline := make([]tornet.IdentityFingerprint, 0, len(prof.KeyRing.Trusted))
+	for uid := range prof.KeyRing.Trusted {
+		if b.peerset[uid] == nil {
+			offline = append(offline, uid)
+		}
+	}
+	clients := make([]*events.Client, 0, len(b.joined))
+	for _, client := range b.joined {
+		clients = append(clients, client)
+	}
+	b.lock.Unlock()
+
+	// Trigger the refreshes outside of the lock, the event clients might block
+	for _, client := range clients {
+		client.Refresh()
+	}
+	if len(offline) > 0 {
+		b.dialer.prioritize(0, offline)
+	}
+	return nil
+}
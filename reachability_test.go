@@ -0,0 +1,318 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that the reachability report correctly aggregates the connectivity of
+// connected, failing and disconnected contacts.
+func TestReachabilityReport(t *testing.T) {
+	alice, bob, teardown := newTestContacts(t)
+	defer teardown()
+
+	// Connect alice and bob to each other
+	aliceId, bobId := newTestRemote(t, alice), newTestRemote(t, bob)
+	if _, err := alice.AddContact(bobId); err != nil {
+		t.Fatalf("failed to add bob to alice: %v", err)
+	}
+	if _, err := bob.AddContact(aliceId); err != nil {
+		t.Fatalf("failed to add alice to bob: %v", err)
+	}
+	waitTestConnection(t, bob, aliceId.Identity.Fingerprint())
+
+	// Add a contact to bob that is not reachable at all
+	carolId, _ := tornet.GenerateIdentity()
+	carolAddr, _ := tornet.GenerateAddress()
+	carol := tornet.RemoteKeyRing{Identity: carolId.Public(), Address: carolAddr.Public()}
+	if _, err := bob.AddContact(carol); err != nil {
+		t.Fatalf("failed to add carol to bob: %v", err)
+	}
+	// Wait for the dial to carol to fail and check the report
+	var report []Reachability
+	for i := 0; i < 100; i++ {
+		var err error
+		if report, err = bob.ReachabilityReport(); err != nil {
+			t.Fatalf("failed to retrieve reachability report: %v", err)
+		}
+		if len(report) == 2 && (report[0].Failure != "" || report[1].Failure != "") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(report) != 2 {
+		t.Fatalf("report size mismatch: have %d, want %d", len(report), 2)
+	}
+	entries := make(map[tornet.IdentityFingerprint]Reachability)
+	for _, entry := range report {
+		if entry.Kind != ReachabilityContact {
+			t.Errorf("entry %s: kind mismatch: have %s, want %s", entry.Identity, entry.Kind, ReachabilityContact)
+		}
+		entries[entry.Identity] = entry
+	}
+	connected := entries[aliceId.Identity.Fingerprint()]
+	if !connected.Connected {
+		t.Errorf("connected contact reported offline")
+	}
+	if connected.Failure != "" {
+		t.Errorf("connected contact reported failure: %s", connected.Failure)
+	}
+	if connected.Scheduled.Before(time.Now().Add(schedulerSanityRedial - time.Minute)) {
+		t.Errorf("connected contact scheduled too early: %v", connected.Scheduled)
+	}
+	failing := entries[carolId.Fingerprint()]
+	if failing.Connected {
+		t.Errorf("unreachable contact reported online")
+	}
+	if failing.Failure == "" {
+		t.Errorf("unreachable contact missing failure")
+	}
+	if !failing.Contacted.IsZero() {
+		t.Errorf("unreachable contact reported contacted: %v", failing.Contacted)
+	}
+	// Disconnect alice and ensure the last contact time is retained
+	alice.overlay.Close()
+	for i := 0; i < 100; i++ {
+		bob.lock.RLock()
+		enc := bob.peerset[aliceId.Identity.Fingerprint()]
+		bob.lock.RUnlock()
+
+		if enc == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	report, err := bob.ReachabilityReport()
+	if err != nil {
+		t.Fatalf("failed to retrieve reachability report: %v", err)
+	}
+	for _, entry := range report {
+		if entry.Identity != aliceId.Identity.Fingerprint() {
+			continue
+		}
+		if entry.Connected {
+			t.Errorf("disconnected contact reported online")
+		}
+		if entry.Contacted.IsZero() {
+			t.Errorf("disconnected contact missing last contact time")
+		}
+	}
+}
+
+// Tests that refreshing all contacts schedules an immediate dial to everyone,
+// even if their previous dial failed and was postponed.
+func TestRefreshAll(t *testing.T) {
+	_, bob, teardown := newTestContacts(t)
+	defer teardown()
+
+	// Add a few contacts to bob that are not reachable at all
+	var contacts []tornet.IdentityFingerprint
+	for i := 0; i < 3; i++ {
+		id, _ := tornet.GenerateIdentity()
+		addr, _ := tornet.GenerateAddress()
+		if _, err := bob.AddContact(tornet.RemoteKeyRing{Identity: id.Public(), Address: addr.Public()}); err != nil {
+			t.Fatalf("failed to add contact %d: %v", i, err)
+		}
+		contacts = append(contacts, id.Fingerprint())
+
+		// Wait for the keyring update to land before adding the next contact
+		for j := 0; j < 100; j++ {
+			if _, ok := bob.dialer.statuses()[id.Fingerprint()]; ok {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// Wait until all the dials fail and get postponed
+	var statuses map[tornet.IdentityFingerprint]*schedulerStatus
+	for i := 0; i < 100; i++ {
+		statuses = bob.dialer.statuses()
+
+		failed := 0
+		for _, uid := range contacts {
+			if status, ok := statuses[uid]; ok && status.failure != nil {
+				failed++
+			}
+		}
+		if failed == len(contacts) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	postponed := make(map[tornet.IdentityFingerprint]time.Time)
+	for _, uid := range contacts {
+		status, ok := statuses[uid]
+		if !ok || status.failure == nil {
+			t.Fatalf("contact %s: dial not failed", uid)
+		}
+		if time.Until(status.next) < schedulerFailureRedial-time.Minute {
+			t.Fatalf("contact %s: redial not postponed: %v", uid, status.next)
+		}
+		postponed[uid] = status.next
+	}
+	// Refresh everything and ensure all contacts get redialed right away, but
+	// also that repeated refreshes are throttled
+	if err := bob.RefreshAll(); err != nil {
+		t.Fatalf("failed to refresh contacts: %v", err)
+	}
+	if err := bob.RefreshAll(); err != ErrRefreshThrottled {
+		t.Fatalf("repeated refresh error mismatch: have %v, want %v", err, ErrRefreshThrottled)
+	}
+	for i := 0; i < 100; i++ {
+		statuses = bob.dialer.statuses()
+
+		redialed := 0
+		for _, uid := range contacts {
+			if statuses[uid].next.After(postponed[uid]) {
+				redialed++
+			}
+		}
+		if redialed == len(contacts) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, uid := range contacts {
+		if !statuses[uid].next.After(postponed[uid]) {
+			t.Errorf("contact %s: not redialed: have %v, postponed %v", uid, statuses[uid].next, postponed[uid])
+		}
+	}
+}
+
+// Tests that the contact connectivity snapshot counts consecutive dial failures
+// and that a single successful dial resets the counter.
+func TestContactConnectivity(t *testing.T) {
+	start := time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC)
+	clock := tornet.NewSimulatedClock(start)
+	gateway := tornet.NewMockGateway()
+
+	// Create bob with an offline contact alice, who already trusts him
+	bob := newTestBackend(t)
+	defer bob.database.Close()
+
+	bob.config.Clock = clock
+	newTestProfile(t, bob, gateway)
+	defer bob.overlay.Close()
+	defer bob.dialer.close()
+
+	alice := newTestBackend(t)
+	defer alice.database.Close()
+
+	keyring := newTestReporter(t, alice)
+	bobId := newTestRemote(t, bob)
+	keyring.Trusted[bobId.Identity.Fingerprint()] = bobId
+
+	blob, err := json.Marshal(&profile{KeyRing: &keyring})
+	if err != nil {
+		t.Fatalf("failed to marshal profile: %v", err)
+	}
+	if err := alice.database.Put(dbProfileKey, blob, nil); err != nil {
+		t.Fatalf("failed to store profile: %v", err)
+	}
+	if err := alice.database.Put(append(dbContactPrefix, bobId.Identity.Fingerprint()...), []byte("{}"), nil); err != nil {
+		t.Fatalf("failed to store contact: %v", err)
+	}
+	aliceId := newTestRemote(t, alice)
+
+	// Waits until alice's connectivity from bob's perspective matches
+	uid := aliceId.Identity.Fingerprint()
+	wait := func(failures int, next time.Time) ContactConnectivity {
+		var conn ContactConnectivity
+		for i := 0; i < 1000; i++ {
+			if conn = bob.ContactConnectivity()[uid]; conn.Failures == failures && conn.NextDial.Equal(next) {
+				return conn
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("connectivity mismatch: have %+v, want %d failures, next %v", conn, failures, next)
+		return conn
+	}
+	// Add alice to bob and ensure the failures accumulate
+	if _, err := bob.AddContact(aliceId); err != nil {
+		t.Fatalf("failed to add alice to bob: %v", err)
+	}
+	score := updateReliability(schedulerReliabilityInitial, false)
+	next := start.Add(failureRedial(score))
+	if conn := wait(1, next); conn.LastErr == "" {
+		t.Fatalf("failed dial missing error")
+	}
+	clock.Run(next.Sub(clock.Now()))
+
+	score = updateReliability(score, false)
+	next = next.Add(failureRedial(score))
+	wait(2, next)
+
+	// Bring alice online and ensure a single success resets the counter
+	startTestOverlay(t, alice, gateway)
+	defer alice.overlay.Close()
+	alice.dialer.close()
+
+	clock.Run(next.Sub(clock.Now()))
+	if conn := wait(0, next.Add(schedulerSanityRedial)); conn.LastErr != "" {
+		t.Fatalf("successful dial retained error: %s", conn.LastErr)
+	}
+	waitTestConnection(t, bob, uid)
+}
+
+// Tests that syncing a contact schedules an immediate dial, rejecting unknown
+// contacts and offline mode, and coalescing repeated requests.
+func TestSyncContact(t *testing.T) {
+	start := time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC)
+	clock := tornet.NewSimulatedClock(start)
+
+	bob := newTestBackend(t)
+	defer bob.database.Close()
+
+	bob.config.Clock = clock
+	newTestProfile(t, bob, tornet.NewMockGateway())
+	defer bob.overlay.Close()
+	defer bob.dialer.close()
+
+	// Add a contact to bob that is not reachable at all
+	carolId, _ := tornet.GenerateIdentity()
+	carolAddr, _ := tornet.GenerateAddress()
+	uid, err := bob.AddContact(tornet.RemoteKeyRing{Identity: carolId.Public(), Address: carolAddr.Public()})
+	if err != nil {
+		t.Fatalf("failed to add carol to bob: %v", err)
+	}
+	// Waits until carol has failed to be dialed a number of times
+	wait := func(failures int) {
+		var conn ContactConnectivity
+		for i := 0; i < 1000; i++ {
+			if conn = bob.ContactConnectivity()[uid]; conn.Failures == failures {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("failures mismatch: have %d, want %d", conn.Failures, failures)
+	}
+	wait(1)
+
+	// Ensure syncs are rejected for unknown contacts and while offline
+	if err := bob.SyncContact("unknown"); err != ErrContactNotFound {
+		t.Fatalf("unknown contact error mismatch: have %v, want %v", err, ErrContactNotFound)
+	}
+	if err := bob.SyncContact(uid); err != ErrNetworkDisabled {
+		t.Fatalf("offline error mismatch: have %v, want %v", err, ErrNetworkDisabled)
+	}
+	// Enable networking and ensure a sync dials right away, but only once
+	bob.enabled = true
+
+	if err := bob.SyncContact(uid); err != nil {
+		t.Fatalf("failed to sync contact: %v", err)
+	}
+	wait(2)
+	if err := bob.SyncContact(uid); err != nil {
+		t.Fatalf("failed to sync contact again: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if conn := bob.ContactConnectivity()[uid]; conn.Failures != 2 {
+		t.Fatalf("coalesced sync dialed: have %d failures, want %d", conn.Failures, 2)
+	}
+}
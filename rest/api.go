@@ -9,7 +9,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"time"
 
+	"github.com/coronanet/go-coronanet"
 	"github.com/coronanet/go-coronanet/protocols/events"
 )
 
@@ -17,6 +20,7 @@ import (
 // allow writing integration tests and scenarios in Go.
 type API struct {
 	endpoint string
+	token    string
 }
 
 // NewAPI creates a simplistic REST API around a Corona Network endpoint.
@@ -26,6 +30,15 @@ func NewAPI(endpoint string) *API {
 	}
 }
 
+// NewAPIWithToken creates a simplistic REST API around a Corona Network endpoint
+// that requires bearer token authorization.
+func NewAPIWithToken(endpoint string, token string) *API {
+	return &API{
+		endpoint: endpoint,
+		token:    token,
+	}
+}
+
 func (api *API) GatewayStatus() (*GatewayStatus, error) {
 	status := new(GatewayStatus)
 	if err := api.run("GET", "/gateway", nil, status); err != nil {
@@ -40,6 +53,22 @@ func (api *API) DisableGateway() error {
 	return api.run("DELETE", "/gateway", nil, nil)
 }
 
+func (api *API) Reachability() ([]coronanet.Reachability, error) {
+	var report []coronanet.Reachability
+	if err := api.run("GET", "/reachability", nil, &report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (api *API) StorageBreakdown() (*coronanet.StorageBreakdown, error) {
+	breakdown := new(coronanet.StorageBreakdown)
+	if err := api.run("GET", "/storage", nil, breakdown); err != nil {
+		return nil, err
+	}
+	return breakdown, nil
+}
+
 func (api *API) CreateProfile() error {
 	return api.run("POST", "/profile", nil, nil)
 }
@@ -54,6 +83,23 @@ func (api *API) UpdateProfile(profile *ProfileInfos) error {
 	return api.run("PUT", "/profile", profile, nil)
 }
 func (api *API) DeleteProfile() error { return api.run("DELETE", "/profile", nil, nil) }
+func (api *API) ProfileIdentity() (*ProfileIdentity, error) {
+	identity := new(ProfileIdentity)
+	if err := api.run("GET", "/profile/identity", nil, identity); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+func (api *API) InfectionStatus() (*coronanet.InfectionStatus, error) {
+	status := new(coronanet.InfectionStatus)
+	if err := api.run("GET", "/profile/status", nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+func (api *API) SetInfectionStatus(status string) error {
+	return api.run("PUT", "/profile/status", &coronanet.InfectionStatus{Status: status}, nil)
+}
 
 func (api *API) InitPairing() (string, error) {
 	var secret string
@@ -76,6 +122,57 @@ func (api *API) WaitPairing() (string, error) {
 	}
 	return contact, nil
 }
+func (api *API) AbortPairing() error {
+	return api.run("DELETE", "/pairing", nil, nil)
+}
+func (api *API) WaitPairingCompleted() (string, error) {
+	var contact string
+	if err := api.run("GET", "/pairing/completed", nil, &contact); err != nil {
+		return "", err
+	}
+	return contact, nil
+}
+
+func (api *API) AddContact(keyring string) (string, error) {
+	var contact string
+	if err := api.run("POST", "/contacts", keyring, &contact); err != nil {
+		return "", err
+	}
+	return contact, nil
+}
+func (api *API) BlockContact(id string) error {
+	return api.run("PUT", "/contacts/"+id+"/block", nil, nil)
+}
+func (api *API) UnblockContact(id string) error {
+	return api.run("DELETE", "/contacts/"+id+"/block", nil, nil)
+}
+func (api *API) ContactVerification(id string) (*Verification, error) {
+	verification := new(Verification)
+	if err := api.run("GET", "/contacts/"+id+"/verification", nil, verification); err != nil {
+		return nil, err
+	}
+	return verification, nil
+}
+func (api *API) SetContactVerification(id string, verified bool, note string) error {
+	return api.run("PUT", "/contacts/"+id+"/verification", &Verification{Verified: verified, Note: note}, nil)
+}
+func (api *API) SyncContact(id string) error {
+	return api.run("POST", "/contacts/"+id+"/sync", nil, nil)
+}
+func (api *API) SendMessage(id string, text string) error {
+	return api.run("POST", "/contacts/"+id+"/messages", text, nil)
+}
+func (api *API) Messages(id string, since time.Time) ([]*Message, error) {
+	path := "/contacts/" + id + "/messages"
+	if since != (time.Time{}) {
+		path += "?since=" + url.QueryEscape(since.Format(time.RFC3339Nano))
+	}
+	var messages []*Message
+	if err := api.run("GET", path, nil, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
 
 func (api *API) HostedEvents() ([]string, error) {
 	var events []string
@@ -98,6 +195,37 @@ func (api *API) HostedEvent(id string) (*events.Stats, error) {
 	}
 	return stats, nil
 }
+func (api *API) HostedEventRoster(id string) ([]*events.Participant, error) {
+	var roster []*events.Participant
+	if err := api.run("GET", "/events/hosted/"+id+"/roster", nil, &roster); err != nil {
+		return nil, err
+	}
+	return roster, nil
+}
+func (api *API) HostedEventParticipants(id string) ([]*events.Participant, error) {
+	var participants []*events.Participant
+	if err := api.run("GET", "/events/hosted/"+id+"/participants", nil, &participants); err != nil {
+		return nil, err
+	}
+	return participants, nil
+}
+func (api *API) HostedEventHistory(id string) ([]coronanet.StatSnapshot, error) {
+	var history []coronanet.StatSnapshot
+	if err := api.run("GET", "/events/hosted/"+id+"/history", nil, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+func (api *API) HostedEventCheckins(id string) ([]string, error) {
+	var auths []string
+	if err := api.run("GET", "/events/hosted/"+id+"/checkins", nil, &auths); err != nil {
+		return nil, err
+	}
+	return auths, nil
+}
+func (api *API) RevokeEventCheckin(id string, auth string) error {
+	return api.run("DELETE", "/events/hosted/"+id+"/checkins/"+auth, nil, nil)
+}
 func (api *API) TerminateEvent(id string) error {
 	return api.run("DELETE", "/events/hosted/"+id, nil, nil)
 }
@@ -128,6 +256,43 @@ func (api *API) JoinedEvent(id string) (*events.Stats, error) {
 	}
 	return stats, nil
 }
+func (api *API) WaitJoinedEvent(id string, updated time.Time, wait time.Duration) (*events.Stats, error) {
+	path := fmt.Sprintf("/events/joined/%s?wait=%s&version=%s", id, wait, url.QueryEscape(updated.Format(time.RFC3339Nano)))
+
+	stats := new(events.Stats)
+	if err := api.run("GET", path, nil, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+func (api *API) LeaveEvent(id string) error {
+	return api.run("DELETE", "/events/joined/"+id, nil, nil)
+}
+
+func (api *API) ScheduledEvents() ([]string, error) {
+	var ids []string
+	if err := api.run("GET", "/events/scheduled", nil, &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+func (api *API) ScheduleEvent(config *ScheduleConfig) (string, error) {
+	var id string
+	if err := api.run("POST", "/events/scheduled", config, &id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+func (api *API) ScheduledEvent(id string) (*ScheduleConfig, error) {
+	config := new(ScheduleConfig)
+	if err := api.run("GET", "/events/scheduled/"+id, nil, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+func (api *API) CancelScheduledEvent(id string) error {
+	return api.run("DELETE", "/events/scheduled/"+id, nil, nil)
+}
 
 // run creates an API requests of the given type and sends over a JSON encoded
 // request, potentially expecting a reply, and converting any failures into a
@@ -148,6 +313,9 @@ func (api *API) run(method string, path string, request interface{}, reply inter
 		return err
 	}
 	req.Header.Add("Content-Type", "application/json")
+	if api.token != "" {
+		req.Header.Add("Authorization", "Bearer "+api.token)
+	}
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
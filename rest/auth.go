@@ -0,0 +1,81 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package rest
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// serveCORS enforces the cross origin restrictions of the API. If no origins are
+// configured, nothing is done and the API stays open to everyone. Otherwise any
+// request carrying a non-permitted origin is rejected and preflight requests are
+// answered directly.
+//
+// The method returns whether the request should be processed further.
+func (api *api) serveCORS(w http.ResponseWriter, r *http.Request, logger log.Logger) bool {
+	if len(api.options.AllowedOrigins) == 0 {
+		return true
+	}
+	// Requests without an origin are not from browsers, let them through
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	w.Header().Add("Vary", "Origin")
+	if !api.allowedOrigin(origin) {
+		logger.Warn("Rejecting cross origin request", "origin", origin)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+
+	// If the request is a preflight, answer it without authorization since
+	// browsers never attach credentials to them
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	return true
+}
+
+// allowedOrigin returns whether a browser origin is permitted to access the API.
+func (api *api) allowedOrigin(origin string) bool {
+	for _, allowed := range api.options.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize enforces the bearer token authorization of the API, if configured.
+// Unauthorized requests are rejected with a 401.
+//
+// The method returns whether the request should be processed further.
+func (api *api) authorize(w http.ResponseWriter, r *http.Request, logger log.Logger) bool {
+	if api.options.Token == "" {
+		return true
+	}
+	// Compare the hashes of the tokens to avoid leaking anything via timing,
+	// not even the length of the expected token
+	var (
+		have = sha256.Sum256([]byte(r.Header.Get("Authorization")))
+		want = sha256.Sum256([]byte("Bearer " + api.options.Token))
+	)
+	if subtle.ConstantTimeCompare(have[:], want[:]) != 1 {
+		logger.Warn("Rejecting unauthorized request")
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Tests that the access restrictions of the API are enforced on every route if
+// configured, and that the API stays fully open otherwise.
+func TestAccessRestrictions(t *testing.T) {
+	tests := []struct {
+		options Options
+		method  string
+		path    string
+		headers map[string]string
+		status  int
+		origin  string
+	}{
+		// Unrestricted API should serve everything
+		{Options{}, "GET", "/unknown", nil, http.StatusNotFound, ""},
+		{Options{}, "GET", "/unknown", map[string]string{"Origin": "https://evil.com"}, http.StatusNotFound, ""},
+
+		// Token protected API should reject anything without the correct token
+		{Options{Token: "secret"}, "GET", "/unknown", nil, http.StatusUnauthorized, ""},
+		{Options{Token: "secret"}, "GET", "/cdn/images/00", nil, http.StatusUnauthorized, ""},
+		{Options{Token: "secret"}, "GET", "/unknown", map[string]string{"Authorization": "Bearer wrong"}, http.StatusUnauthorized, ""},
+		{Options{Token: "secret"}, "GET", "/unknown", map[string]string{"Authorization": "secret"}, http.StatusUnauthorized, ""},
+		{Options{Token: "secret"}, "GET", "/unknown", map[string]string{"Authorization": "Bearer secret"}, http.StatusNotFound, ""},
+		{Options{Token: "secret"}, "GET", "/cdn/images/00", map[string]string{"Authorization": "Bearer secret"}, http.StatusBadRequest, ""},
+
+		// Origin restricted API should reject foreign browsers and answer preflights
+		{Options{AllowedOrigins: []string{"https://app.com"}}, "GET", "/unknown", nil, http.StatusNotFound, ""},
+		{Options{AllowedOrigins: []string{"https://app.com"}}, "GET", "/unknown", map[string]string{"Origin": "https://evil.com"}, http.StatusForbidden, ""},
+		{Options{AllowedOrigins: []string{"https://app.com"}}, "GET", "/unknown", map[string]string{"Origin": "https://app.com"}, http.StatusNotFound, "https://app.com"},
+		{Options{AllowedOrigins: []string{"*"}}, "GET", "/unknown", map[string]string{"Origin": "https://app.com"}, http.StatusNotFound, "https://app.com"},
+		{Options{AllowedOrigins: []string{"https://app.com"}}, "OPTIONS", "/profile", map[string]string{"Origin": "https://app.com", "Access-Control-Request-Method": "PUT"}, http.StatusNoContent, "https://app.com"},
+		{Options{AllowedOrigins: []string{"https://app.com"}}, "OPTIONS", "/profile", map[string]string{"Origin": "https://evil.com", "Access-Control-Request-Method": "PUT"}, http.StatusForbidden, ""},
+
+		// Preflights are not authorized, but the actual requests are
+		{Options{AllowedOrigins: []string{"https://app.com"}, Token: "secret"}, "OPTIONS", "/profile", map[string]string{"Origin": "https://app.com", "Access-Control-Request-Method": "PUT"}, http.StatusNoContent, "https://app.com"},
+		{Options{AllowedOrigins: []string{"https://app.com"}, Token: "secret"}, "GET", "/unknown", map[string]string{"Origin": "https://app.com"}, http.StatusUnauthorized, "https://app.com"},
+		{Options{AllowedOrigins: []string{"https://app.com"}, Token: "secret"}, "GET", "/unknown", map[string]string{"Origin": "https://app.com", "Authorization": "Bearer secret"}, http.StatusNotFound, "https://app.com"},
+	}
+	for i, tt := range tests {
+		handler := New(nil, tt.options, log.Root())
+
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		for key, val := range tt.headers {
+			req.Header.Set(key, val)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		if res.Code != tt.status {
+			t.Errorf("test %d: status mismatch: have %d, want %d", i, res.Code, tt.status)
+		}
+		if origin := res.Header().Get("Access-Control-Allow-Origin"); origin != tt.origin {
+			t.Errorf("test %d: allowed origin mismatch: have %q, want %q", i, origin, tt.origin)
+		}
+	}
+}
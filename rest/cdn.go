@@ -25,20 +25,30 @@ func (api *api) serveCDN(w http.ResponseWriter, r *http.Request, path string) {
 // serveCDNImages serves API calls concerning immutable image distribution.
 func (api *api) serveCDNImages(w http.ResponseWriter, r *http.Request, path string) {
 	// If the image sha3 is of wrong length, reject the request
-	if len(path) != 65 {
+	if len(path) < 65 {
 		http.Error(w, "Image hash invalid", http.StatusBadRequest)
 		return
 	}
 	var hash [32]byte
-	if _, err := hex.Decode(hash[:], []byte(path[1:])); err != nil {
+	if _, err := hex.Decode(hash[:], []byte(path[1:65])); err != nil {
 		http.Error(w, fmt.Sprintf("Image hash invalid: %s", err), http.StatusBadRequest)
 		return
 	}
-	// Hash valid, try to return it to the user
+	// Hash valid, try to return it (or its thumbnail) to the user
+	var retrieve func(hash [32]byte) ([]byte, error)
+	switch path[65:] {
+	case "":
+		retrieve = api.backend.CDNImage
+	case "/thumb":
+		retrieve = api.backend.CDNThumbnail
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
 	switch r.Method {
 	case "GET":
-		// Retrieves the local user's profile
-		switch data, err := api.backend.CDNImage(hash); err {
+		// Retrieves the requested image
+		switch data, err := retrieve(hash); err {
 		case coronanet.ErrImageNotFound:
 			http.Error(w, "Image unknown or unavailable", http.StatusNotFound)
 		case nil:
@@ -4,15 +4,36 @@
 package rest
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/coronanet/go-coronanet"
 	"github.com/coronanet/go-coronanet/tornet"
+	"golang.org/x/crypto/sha3"
 )
 
+// Message is the response struct sent back to the client when requesting the
+// messages exchanged with a remote contact.
+type Message struct {
+	Text       string    `json:"text"`
+	Attachment string    `json:"attachment,omitempty"`
+	Time       time.Time `json:"time"`
+	Outgoing   bool      `json:"outgoing"`
+	Delivered  bool      `json:"delivered"`
+}
+
+// Verification is the request and response struct for the local out-of-band
+// verification metadata of a remote contact.
+type Verification struct {
+	Verified    bool   `json:"verified"`
+	Note        string `json:"note,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
 // serveContacts serves API calls concerning all contacts.
 func (api *api) serveContacts(w http.ResponseWriter, r *http.Request, path string) {
 	// If we're not serving the contacts root, descend into a single contact
@@ -23,17 +44,60 @@ func (api *api) serveContacts(w http.ResponseWriter, r *http.Request, path strin
 	// Handle serving the contacts root
 	switch r.Method {
 	case "GET":
-		// List all contacts of the local user
-		switch contacts, err := api.backend.Contacts(); err {
+		// List all contacts of the local user, optionally paginated
+		cursor, limit, paged, err := parsePage(r)
+		if err != nil {
+			http.Error(w, "Provided pagination is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var (
+			contacts []tornet.IdentityFingerprint
+			next     string
+		)
+		if paged {
+			contacts, next, err = api.backend.ContactsPage(cursor, limit)
+		} else {
+			contacts, err = api.backend.Contacts()
+		}
+		switch err {
 		case coronanet.ErrProfileNotFound:
 			http.Error(w, "Local user doesn't exist", http.StatusForbidden)
+		case coronanet.ErrInvalidPageLimit:
+			http.Error(w, "Provided pagination is invalid: "+err.Error(), http.StatusBadRequest)
 		case nil:
+			setNextPage(w, r, next, limit)
 			w.Header().Add("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(contacts)
 		default:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 
+	case "POST":
+		// Imports a new contact from an exported keyring, without pairing
+		var blob []byte
+		if err := json.NewDecoder(r.Body).Decode(&blob); err != nil { // Bit unorthodox, but we don't want callers to interpret the data
+			http.Error(w, "Provided keyring is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		keyring, err := tornet.ParseRemoteKeyRing(blob)
+		if err != nil {
+			http.Error(w, "Provided keyring is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch uid, err := api.backend.AddContactByKeyring(keyring); err {
+		case coronanet.ErrProfileNotFound:
+			http.Error(w, "Local user doesn't exist", http.StatusForbidden)
+		case coronanet.ErrSelfContact:
+			http.Error(w, "Cannot add self as contact", http.StatusBadRequest)
+		case coronanet.ErrContactExists:
+			http.Error(w, "Remote contact already exists", http.StatusConflict)
+		case nil:
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(uid)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
 	default:
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
@@ -48,8 +112,21 @@ func (api *api) serveContact(w http.ResponseWriter, r *http.Request, path string
 	if len(parts) > 1 {
 		path = "/" + parts[1]
 	}
-	// If we're not serving the contact root, descend into the profile
-	if path != "" {
+	// If we're not serving the contact root, descend into the messages or profile
+	switch {
+	case path == "/messages":
+		api.serveContactMessages(w, r, uid)
+		return
+	case path == "/block":
+		api.serveContactBlock(w, r, uid)
+		return
+	case path == "/sync":
+		api.serveContactSync(w, r, uid)
+		return
+	case path == "/verification":
+		api.serveContactVerification(w, r, uid)
+		return
+	case path != "":
 		api.serveContactProfile(w, r, uid, path)
 		return
 	}
@@ -87,13 +164,41 @@ func (api *api) serveContactProfile(w http.ResponseWriter, r *http.Request, uid
 func (api *api) serveContactProfileInfo(w http.ResponseWriter, r *http.Request, uid tornet.IdentityFingerprint) {
 	switch r.Method {
 	case "GET":
-		// Retrieves a remote contact's profile
+		// Retrieves a remote contact's profile, optionally waiting for changes
+		wait, err := parseWait(r)
+		if err != nil {
+			http.Error(w, "Provided wait duration is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if wait > 0 {
+			relevant := func(event coronanet.Event) bool {
+				return event.Kind == coronanet.EventContactUpdated && event.Contact == uid
+			}
+			version := func() (string, error) {
+				contact, err := api.backend.Contact(uid)
+				if err != nil {
+					return "", err
+				}
+				return contactVersion(contact.Name, contact.Avatar, contact.Mood, contact.Blocked), nil
+			}
+			if err := api.waitUpdate(r, wait, relevant, version); err != nil {
+				return // Client disconnected
+			}
+		}
 		switch contact, err := api.backend.Contact(uid); err {
 		case coronanet.ErrContactNotFound:
 			http.Error(w, "Remote contact doesn't exist", http.StatusNotFound)
 		case nil:
+			setVersion(w, contactVersion(contact.Name, contact.Avatar, contact.Mood, contact.Blocked))
 			w.Header().Add("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(&ProfileInfos{Name: contact.Name})
+			infos := &ProfileInfos{Name: contact.Name, Blocked: contact.Blocked}
+			if contact.Mood != "" {
+				infos.Mood = &contact.Mood
+			}
+			if contact.LastSeen != (time.Time{}) {
+				infos.LastSeen = &contact.LastSeen
+			}
+			json.NewEncoder(w).Encode(infos)
 		default:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -139,3 +244,161 @@ func (api *api) serveContactProfileAvatar(w http.ResponseWriter, r *http.Request
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
+
+// serveContactBlock serves API calls concerning blocking a remote contact.
+func (api *api) serveContactBlock(w http.ResponseWriter, r *http.Request, uid tornet.IdentityFingerprint) {
+	var update func(uid tornet.IdentityFingerprint) error
+	switch r.Method {
+	case "PUT":
+		// Blocks a remote contact without deleting it
+		update = api.backend.BlockContact
+	case "DELETE":
+		// Lifts the block from a remote contact
+		update = api.backend.UnblockContact
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	switch err := update(uid); err {
+	case coronanet.ErrContactNotFound:
+		http.Error(w, "Remote contact doesn't exist", http.StatusForbidden)
+	case nil:
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveContactVerification serves API calls concerning the local verification
+// metadata of a remote contact.
+func (api *api) serveContactVerification(w http.ResponseWriter, r *http.Request, uid tornet.IdentityFingerprint) {
+	switch r.Method {
+	case "GET":
+		// Retrieves the verification status along with the fingerprint to compare
+		contact, err := api.backend.Contact(uid)
+		if err != nil {
+			http.Error(w, "Remote contact doesn't exist", http.StatusNotFound)
+			return
+		}
+		switch fingerprint, err := api.backend.ContactFingerprint(uid); err {
+		case coronanet.ErrContactNotFound:
+			http.Error(w, "Remote contact doesn't exist", http.StatusNotFound)
+		case nil:
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&Verification{Verified: contact.Verified, Note: contact.Note, Fingerprint: fingerprint})
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case "PUT":
+		// Updates the verification status of the contact
+		verification := new(Verification)
+		if err := json.NewDecoder(r.Body).Decode(verification); err != nil {
+			http.Error(w, "Provided verification is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err := api.backend.SetContactVerification(uid, verification.Verified, verification.Note); err {
+		case coronanet.ErrContactNotFound:
+			http.Error(w, "Remote contact doesn't exist", http.StatusForbidden)
+		case coronanet.ErrNoteTooLong:
+			http.Error(w, "Provided note is too long", http.StatusBadRequest)
+		case nil:
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveContactSync serves API calls concerning on demand syncing with a remote
+// contact.
+func (api *api) serveContactSync(w http.ResponseWriter, r *http.Request, uid tornet.IdentityFingerprint) {
+	switch r.Method {
+	case "POST":
+		// Requests an immediate data exchange with a remote contact
+		switch err := api.backend.SyncContact(uid); err {
+		case coronanet.ErrContactNotFound:
+			http.Error(w, "Remote contact doesn't exist", http.StatusForbidden)
+		case coronanet.ErrNetworkDisabled:
+			http.Error(w, "Cannot sync while offline", http.StatusForbidden)
+		case nil:
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveContactMessages serves API calls concerning the messages exchanged with a
+// remote contact.
+func (api *api) serveContactMessages(w http.ResponseWriter, r *http.Request, uid tornet.IdentityFingerprint) {
+	switch r.Method {
+	case "GET":
+		// Retrieves the messages exchanged with a remote contact
+		var since time.Time
+		if param := r.URL.Query().Get("since"); param != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339Nano, param); err != nil {
+				http.Error(w, "Provided timestamp is invalid: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		switch messages, err := api.backend.Messages(uid, since); err {
+		case coronanet.ErrContactNotFound:
+			http.Error(w, "Remote contact doesn't exist", http.StatusNotFound)
+		case nil:
+			replies := make([]*Message, 0, len(messages))
+			for _, message := range messages {
+				reply := &Message{Text: message.Text, Time: message.Time, Outgoing: message.Outgoing, Delivered: message.Delivered}
+				if message.Attachment != ([32]byte{}) {
+					reply.Attachment = hex.EncodeToString(message.Attachment[:])
+				}
+				replies = append(replies, reply)
+			}
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(replies)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case "POST":
+		// Sends a text message to a remote contact
+		var text string
+		if err := json.NewDecoder(r.Body).Decode(&text); err != nil {
+			http.Error(w, "Provided message is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err := api.backend.SendMessage(uid, text); err {
+		case coronanet.ErrProfileNotFound:
+			http.Error(w, "Local user doesn't exist", http.StatusForbidden)
+		case coronanet.ErrContactNotFound:
+			http.Error(w, "Remote contact doesn't exist", http.StatusForbidden)
+		case coronanet.ErrMessageEmpty, coronanet.ErrMessageTooLong:
+			http.Error(w, "Provided message is invalid: "+err.Error(), http.StatusBadRequest)
+		case nil:
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// contactVersion calculates the long-poll version of a remote contact's profile,
+// which is a hash of all its fields.
+func contactVersion(name string, avatar [32]byte, mood string, blocked bool) string {
+	blob := append([]byte(name), avatar[:]...)
+	blob = append(blob, mood...)
+	if blocked {
+		blob = append(blob, 1)
+	}
+	return fmt.Sprintf("%x", sha3.Sum256(blob))
+}
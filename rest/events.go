@@ -10,6 +10,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/coronanet/go-coronanet"
 	"github.com/coronanet/go-coronanet/protocols/events"
@@ -19,7 +20,20 @@ import (
 
 // EventConfig is the initial configurations of an event when creating it.
 type EventConfig struct {
-	Name string `json:"name"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Location    string `json:"location,omitempty"`
+}
+
+// ScheduleConfig is the template of an event to be created at a future time and
+// optionally recreated periodically.
+type ScheduleConfig struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Location    string    `json:"location,omitempty"`
+	Start       time.Time `json:"start"`              // Next time an instance is to be created
+	Every       int64     `json:"every,omitempty"`    // Recurrence period in seconds (0 = one-off)
+	Instance    string    `json:"instance,omitempty"` // Last created instance of the event (read only)
 }
 
 // serveEvents serves API calls concerning all events.
@@ -29,6 +43,8 @@ func (api *api) serveEvents(w http.ResponseWriter, r *http.Request, path string,
 		api.serveHostedEvents(w, r, strings.TrimPrefix(path, "/hosted"), logger)
 	case strings.HasPrefix(path, "/joined"):
 		api.serveJoinedEvents(w, r, strings.TrimPrefix(path, "/joined"), logger)
+	case strings.HasPrefix(path, "/scheduled"):
+		api.serveScheduledEvents(w, r, strings.TrimPrefix(path, "/scheduled"), logger)
 	default:
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 	}
@@ -46,8 +62,26 @@ func (api *api) serveHostedEvents(w http.ResponseWriter, r *http.Request, path s
 	case "GET":
 		// List all the hosted events
 		logger.Debug("Requesting hosted event listing")
-		w.Header().Add("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(api.backend.HostedEvents())
+		cursor, limit, paged, err := parsePage(r)
+		if err != nil {
+			http.Error(w, "Provided pagination is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !paged {
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(api.backend.HostedEvents())
+			return
+		}
+		switch page, next, err := api.backend.HostedEventsPage(cursor, limit); err {
+		case coronanet.ErrInvalidPageLimit:
+			http.Error(w, "Provided pagination is invalid: "+err.Error(), http.StatusBadRequest)
+		case nil:
+			setNextPage(w, r, next, limit)
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(page)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 
 	case "POST":
 		// Hosts a new event
@@ -58,7 +92,7 @@ func (api *api) serveHostedEvents(w http.ResponseWriter, r *http.Request, path s
 			http.Error(w, "Provided event config is invalid: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		switch uid, err := api.backend.CreateEvent(config.Name); err {
+		switch uid, err := api.backend.CreateEvent(config.Name, config.Description, config.Location); err {
 		case coronanet.ErrProfileNotFound:
 			logger.Warn("Local user doesn't exist")
 			http.Error(w, "Local user doesn't exist", http.StatusForbidden)
@@ -91,8 +125,16 @@ func (api *api) serveHostedEvent(w http.ResponseWriter, r *http.Request, path st
 		switch {
 		case strings.HasPrefix(path, "/banner"):
 			api.serveHostedEventBanner(w, r, uid)
+		case strings.HasPrefix(path, "/checkins"):
+			api.serveHostedEventCheckins(w, r, uid, strings.TrimPrefix(path, "/checkins"), logger)
 		case strings.HasPrefix(path, "/checkin"):
 			api.serveHostedEventCheckin(w, r, uid, logger)
+		case strings.HasPrefix(path, "/roster"):
+			api.serveHostedEventRoster(w, r, uid, logger)
+		case strings.HasPrefix(path, "/participants"):
+			api.serveHostedEventParticipants(w, r, uid, strings.TrimPrefix(path, "/participants"), logger)
+		case strings.HasPrefix(path, "/history"):
+			api.serveHostedEventHistory(w, r, uid, logger)
 		default:
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		}
@@ -172,6 +214,8 @@ func (api *api) serveHostedEventBanner(w http.ResponseWriter, r *http.Request, u
 
 		// Attempt to push the image into the database
 		switch err := api.backend.UploadHostedEventBanner(uid, buffer.Bytes()); err {
+		case coronanet.ErrImageTooLarge:
+			http.Error(w, "Banner image too large", http.StatusRequestEntityTooLarge)
 		case coronanet.ErrEventNotFound:
 			http.Error(w, "Hosted event doesn't exist", http.StatusForbidden)
 		case events.ErrEventConcluded:
@@ -198,6 +242,115 @@ func (api *api) serveHostedEventBanner(w http.ResponseWriter, r *http.Request, u
 	}
 }
 
+// serveHostedEventRoster serves API calls concerning a hosted event's participants.
+func (api *api) serveHostedEventRoster(w http.ResponseWriter, r *http.Request, uid tornet.IdentityFingerprint, logger log.Logger) {
+	switch r.Method {
+	case "GET":
+		// Retrieves a hosted event's participant roster
+		logger.Debug("Requesting hosted event roster")
+		switch infos, err := api.backend.HostedEvent(uid); err {
+		case coronanet.ErrEventNotFound:
+			logger.Warn("Hosted event doesn't exist")
+			http.Error(w, "Hosted event doesn't exist", http.StatusNotFound)
+		case nil:
+			roster := infos.Roster()
+			logger.Debug("Hosted event roster successfully retrieved", "participants", len(roster))
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(roster)
+		default:
+			logger.Error("Hosted event roster retrieval failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveHostedEventHistory serves API calls concerning a hosted event's stats
+// history.
+func (api *api) serveHostedEventHistory(w http.ResponseWriter, r *http.Request, uid tornet.IdentityFingerprint, logger log.Logger) {
+	switch r.Method {
+	case "GET":
+		// Retrieves a hosted event's stats time series
+		logger.Debug("Requesting hosted event history")
+		switch history, err := api.backend.HostedEventHistory(uid); err {
+		case coronanet.ErrEventNotFound:
+			logger.Warn("Hosted event doesn't exist")
+			http.Error(w, "Hosted event doesn't exist", http.StatusNotFound)
+		case nil:
+			logger.Debug("Hosted event history successfully retrieved", "snapshots", len(history))
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(history)
+		default:
+			logger.Error("Hosted event history retrieval failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveHostedEventParticipants serves API calls concerning a hosted event's live
+// participant list.
+func (api *api) serveHostedEventParticipants(w http.ResponseWriter, r *http.Request, uid tornet.IdentityFingerprint, path string, logger log.Logger) {
+	// If we're not serving the participants root, descend into a single participant
+	if path != "" {
+		parts := strings.SplitN(path[1:], "/", 2)
+		if len(parts) != 2 || parts[1] != "avatar" {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		api.serveHostedEventParticipantAvatar(w, r, uid, tornet.IdentityFingerprint(parts[0]))
+		return
+	}
+	switch r.Method {
+	case "GET":
+		// Retrieves a hosted event's live participant list
+		logger.Debug("Requesting hosted event participants")
+		switch participants, err := api.backend.HostedEventParticipants(uid); err {
+		case coronanet.ErrEventNotFound:
+			logger.Warn("Hosted event doesn't exist")
+			http.Error(w, "Hosted event doesn't exist", http.StatusNotFound)
+		case nil:
+			logger.Debug("Hosted event participants successfully retrieved", "participants", len(participants))
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(participants)
+		default:
+			logger.Error("Hosted event participants retrieval failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveHostedEventParticipantAvatar serves API calls concerning the profile picture
+// a participant shared with a hosted event.
+func (api *api) serveHostedEventParticipantAvatar(w http.ResponseWriter, r *http.Request, uid tornet.IdentityFingerprint, pseudonym tornet.IdentityFingerprint) {
+	switch r.Method {
+	case "GET":
+		// Retrieves a participant's profile picture
+		switch infos, err := api.backend.HostedEvent(uid); {
+		case err == coronanet.ErrEventNotFound:
+			http.Error(w, "Hosted event doesn't exist", http.StatusForbidden)
+		case err == nil && infos.Participants[pseudonym] == nil:
+			http.Error(w, "Participant doesn't exist", http.StatusForbidden)
+		case err == nil && infos.Avatars[pseudonym] == [32]byte{}:
+			http.Error(w, "Participant doesn't have a profile picture", http.StatusNotFound)
+		case err == nil:
+			http.Redirect(w, r, fmt.Sprintf("/cdn/images/%x", infos.Avatars[pseudonym]), http.StatusFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
 // serveHostedEventCheckin serves API calls concerning a hosted event's checkin procedure.
 func (api *api) serveHostedEventCheckin(w http.ResponseWriter, r *http.Request, uid tornet.IdentityFingerprint, logger log.Logger) {
 	switch r.Method {
@@ -240,6 +393,150 @@ func (api *api) serveHostedEventCheckin(w http.ResponseWriter, r *http.Request,
 	}
 }
 
+// serveHostedEventCheckins serves API calls concerning the live checkin sessions
+// of a hosted event.
+func (api *api) serveHostedEventCheckins(w http.ResponseWriter, r *http.Request, uid tornet.IdentityFingerprint, path string, logger log.Logger) {
+	// If we're not serving the sessions root, descend into a single session
+	if path != "" {
+		auth := tornet.IdentityFingerprint(path[1:])
+
+		switch r.Method {
+		case "DELETE":
+			// Revokes a single checkin session
+			logger.Debug("Requesting checkin session revocation", "auth", auth)
+			switch err := api.backend.RevokeEventCheckin(uid, auth); err {
+			case coronanet.ErrEventNotFound:
+				logger.Warn("Hosted event doesn't exist")
+				http.Error(w, "Hosted event doesn't exist", http.StatusNotFound)
+			case events.ErrCheckinNotFound:
+				logger.Warn("Checkin session doesn't exist")
+				http.Error(w, "Checkin session doesn't exist", http.StatusNotFound)
+			case nil:
+				logger.Debug("Checkin session successfully revoked")
+				w.WriteHeader(http.StatusOK)
+			default:
+				logger.Error("Checkin session revocation failed", "err", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	// Handle serving the sessions root
+	switch r.Method {
+	case "GET":
+		// Lists the live checkin sessions
+		logger.Debug("Requesting checkin session listing")
+		switch auths, err := api.backend.EventCheckins(uid); err {
+		case coronanet.ErrEventNotFound:
+			logger.Warn("Hosted event doesn't exist")
+			http.Error(w, "Hosted event doesn't exist", http.StatusNotFound)
+		case nil:
+			logger.Debug("Checkin sessions successfully listed", "sessions", len(auths))
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(auths)
+		default:
+			logger.Error("Checkin session listing failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveScheduledEvents serves API calls concerning scheduled event templates.
+func (api *api) serveScheduledEvents(w http.ResponseWriter, r *http.Request, path string, logger log.Logger) {
+	// If we're not serving the templates root, descend into a single template
+	if path != "" {
+		api.serveScheduledEvent(w, r, path[1:], logger)
+		return
+	}
+	// Handle serving the templates root
+	switch r.Method {
+	case "GET":
+		// List all the scheduled event templates
+		logger.Debug("Requesting scheduled event listing")
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(api.backend.ScheduledEvents())
+
+	case "POST":
+		// Schedules a new event template
+		logger.Debug("Requesting event scheduling")
+		config := new(ScheduleConfig)
+		if err := json.NewDecoder(r.Body).Decode(config); err != nil {
+			logger.Warn("Provided schedule config is invalid", "err", err)
+			http.Error(w, "Provided schedule config is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch id, err := api.backend.ScheduleEvent(config.Name, config.Description, config.Location, config.Start, time.Duration(config.Every)*time.Second); err {
+		case coronanet.ErrProfileNotFound:
+			logger.Warn("Local user doesn't exist")
+			http.Error(w, "Local user doesn't exist", http.StatusForbidden)
+		case coronanet.ErrInvalidSchedule:
+			logger.Warn("Provided schedule is invalid")
+			http.Error(w, "Provided schedule is invalid", http.StatusBadRequest)
+		case nil:
+			logger.Debug("Event successfully scheduled", "id", id)
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(id)
+		default:
+			logger.Error("Event scheduling failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveScheduledEvent serves API calls concerning a single scheduled event template.
+func (api *api) serveScheduledEvent(w http.ResponseWriter, r *http.Request, id string, logger log.Logger) {
+	switch r.Method {
+	case "GET":
+		// Retrieves a scheduled event template
+		logger.Debug("Requesting scheduled event")
+		switch template, err := api.backend.ScheduledEvent(id); err {
+		case coronanet.ErrScheduleNotFound:
+			logger.Warn("Scheduled event doesn't exist")
+			http.Error(w, "Scheduled event doesn't exist", http.StatusNotFound)
+		case nil:
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&ScheduleConfig{
+				Name:        template.Name,
+				Description: template.Description,
+				Location:    template.Location,
+				Start:       template.Start,
+				Every:       int64(template.Every / time.Second),
+				Instance:    string(template.Instance),
+			})
+		default:
+			logger.Error("Scheduled event retrieval failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case "DELETE":
+		// Cancels any future instances of the scheduled event
+		logger.Debug("Requesting scheduled event cancellation")
+		switch err := api.backend.CancelScheduledEvent(id); err {
+		case coronanet.ErrScheduleNotFound:
+			logger.Warn("Scheduled event doesn't exist")
+			http.Error(w, "Scheduled event doesn't exist", http.StatusNotFound)
+		case nil:
+			logger.Debug("Scheduled event successfully cancelled")
+			w.WriteHeader(http.StatusOK)
+		default:
+			logger.Error("Scheduled event cancellation failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
 // serveJoinedEvents serves API calls concerning joined events.
 func (api *api) serveJoinedEvents(w http.ResponseWriter, r *http.Request, path string, logger log.Logger) {
 	// If we're not serving the events root, descend into a single event
@@ -252,8 +549,26 @@ func (api *api) serveJoinedEvents(w http.ResponseWriter, r *http.Request, path s
 	case "GET":
 		// List all events joined by the local user
 		logger.Debug("Requesting joined event listing")
-		w.Header().Add("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(api.backend.JoinedEvents())
+		cursor, limit, paged, err := parsePage(r)
+		if err != nil {
+			http.Error(w, "Provided pagination is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !paged {
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(api.backend.JoinedEvents())
+			return
+		}
+		switch page, next, err := api.backend.JoinedEventsPage(cursor, limit); err {
+		case coronanet.ErrInvalidPageLimit:
+			http.Error(w, "Provided pagination is invalid: "+err.Error(), http.StatusBadRequest)
+		case nil:
+			setNextPage(w, r, next, limit)
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(page)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 
 	case "POST":
 		// Checks into an existing event
@@ -266,12 +581,13 @@ func (api *api) serveJoinedEvents(w http.ResponseWriter, r *http.Request, path s
 			http.Error(w, "Provided checkin secret is invalid: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		if len(blob) != 96 {
-			logger.Warn("Provided checkin secret is invalid: not 96 bytes")
-			http.Error(w, "Provided checkin secret is invalid: not 96 bytes", http.StatusBadRequest)
+		id, address, auth, err := tornet.ParseCheckinSecret(blob)
+		if err != nil {
+			logger.Warn("Provided checkin secret is invalid", "err", err)
+			http.Error(w, "Provided checkin secret is invalid: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		switch err := api.backend.JoinEventCheckin(blob[:32], blob[32:64], blob[64:]); err {
+		switch err := api.backend.JoinEventCheckin(id, address, auth); err {
 		case coronanet.ErrProfileNotFound:
 			logger.Warn("Cannot checkin without profile")
 			http.Error(w, "Cannot checkin without profile", http.StatusForbidden)
@@ -281,6 +597,15 @@ func (api *api) serveJoinedEvents(w http.ResponseWriter, r *http.Request, path s
 		case coronanet.ErrEventAlreadyJoined:
 			logger.Warn("Remote event already joined")
 			http.Error(w, "Remote event already joined", http.StatusConflict)
+		case coronanet.ErrJoinInProgress:
+			logger.Warn("Remote event already being joined")
+			http.Error(w, "Remote event already being joined", http.StatusConflict)
+		case coronanet.ErrJoinThrottled:
+			logger.Warn("Event joins requested too frequently")
+			http.Error(w, "Event joins requested too frequently", http.StatusTooManyRequests)
+		case events.ErrCheckinMismatch:
+			logger.Warn("Checkin credential not issued by event")
+			http.Error(w, "Checkin credential not issued by event", http.StatusBadRequest)
 		case nil:
 			logger.Debug("Remote event joined successfully")
 			w.WriteHeader(http.StatusOK)
@@ -317,20 +642,59 @@ func (api *api) serveJoinedEvent(w http.ResponseWriter, r *http.Request, path st
 	// Handle serving the event root
 	switch r.Method {
 	case "GET":
-		// Retrieves a hosted event's statistics
+		// Retrieves a joined event's statistics, optionally waiting for changes
 		logger.Debug("Requesting joined event")
+		wait, err := parseWait(r)
+		if err != nil {
+			logger.Warn("Provided wait duration is invalid", "err", err)
+			http.Error(w, "Provided wait duration is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if wait > 0 {
+			relevant := func(event coronanet.Event) bool {
+				return event.Kind == coronanet.EventJoinedUpdated && event.Event == uid
+			}
+			version := func() (string, error) {
+				infos, err := api.backend.JoinedEvent(uid)
+				if err != nil {
+					return "", err
+				}
+				return joinedEventVersion(infos), nil
+			}
+			if err := api.waitUpdate(r, wait, relevant, version); err != nil {
+				logger.Debug("Joined event wait aborted", "err", err)
+				return
+			}
+		}
 		switch infos, err := api.backend.JoinedEvent(uid); err {
 		case coronanet.ErrEventNotFound:
 			logger.Warn("Joined event doesn't exist")
 			http.Error(w, "Joined event doesn't exist", http.StatusNotFound)
 		case nil:
 			logger.Debug("Joined event successfully retrieved")
+			setVersion(w, joinedEventVersion(infos))
 			w.Header().Add("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(infos.Stats())
 		default:
 			logger.Error("Joined event retrieval failed", "err", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
+
+	case "DELETE":
+		// Leaves the event, deleting everything known about it
+		logger.Debug("Requesting joined event leave")
+		switch err := api.backend.LeaveEvent(uid); err {
+		case coronanet.ErrEventNotFound:
+			logger.Warn("Joined event doesn't exist")
+			http.Error(w, "Joined event doesn't exist", http.StatusNotFound)
+		case nil:
+			logger.Debug("Joined event successfully left")
+			w.WriteHeader(http.StatusOK)
+		default:
+			logger.Error("Joined event leave failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
 	default:
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
@@ -355,3 +719,9 @@ func (api *api) serveJoinedEventBanner(w http.ResponseWriter, r *http.Request, u
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
+
+// joinedEventVersion calculates the long-poll version of a joined event, which
+// is the time its statistics were last modified.
+func joinedEventVersion(infos *events.ClientInfos) string {
+	return infos.Updated.Format(time.RFC3339Nano)
+}
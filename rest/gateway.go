@@ -16,11 +16,19 @@ type GatewayStatus struct {
 	Enabled   bool `json:"enabled"`
 	Connected bool `json:"connected"`
 	Bandwidth struct {
-		Ingress uint64 `json:"ingress"`
-		Egress  uint64 `json:"egress"`
+		Ingress   uint64                       `json:"ingress"`
+		Egress    uint64                       `json:"egress"`
+		Protocols map[string]ProtocolBandwidth `json:"protocols"`
 	} `json:"bandwidth"`
 }
 
+// ProtocolBandwidth is the application level traffic incurred by a single P2P
+// protocol running on top of the gateway.
+type ProtocolBandwidth struct {
+	Ingress uint64 `json:"ingress"`
+	Egress  uint64 `json:"egress"`
+}
+
 // serveGateway serves API calls concerning the P2P gateway.
 func (api *api) serveGateway(w http.ResponseWriter, r *http.Request, logger log.Logger) {
 	switch r.Method {
@@ -36,6 +44,10 @@ func (api *api) serveGateway(w http.ResponseWriter, r *http.Request, logger log.
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		status.Bandwidth.Protocols = make(map[string]ProtocolBandwidth)
+		for protocol, traffic := range api.backend.TrafficByProtocol() {
+			status.Bandwidth.Protocols[protocol] = ProtocolBandwidth{Ingress: traffic.In, Egress: traffic.Out}
+		}
 		// All ok, stream the status and stats over to the client
 		w.Header().Add("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(status)
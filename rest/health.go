@@ -0,0 +1,31 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// serveHealth serves API calls concerning the readiness of the backend.
+func (api *api) serveHealth(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	switch r.Method {
+	case "GET":
+		// Probes the backend components, failing if any is not ready
+		logger.Trace("Checking backend health")
+		ready, details := api.backend.Healthy()
+
+		w.Header().Add("Content-Type", "application/json")
+		if !ready {
+			logger.Warn("Backend not healthy", "details", details)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(details)
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,88 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coronanet/go-coronanet"
+)
+
+// longPollMaxWait is the maximum time a long-poll request may block waiting for
+// an update, to avoid idle connections lingering forever.
+const longPollMaxWait = 5 * time.Minute
+
+// errInvalidWait is returned if the long-poll timeout of a request is malformed.
+var errInvalidWait = errors.New("invalid wait duration")
+
+// parseWait extracts the optional long-poll timeout (`wait` query parameter) of
+// a request, capped to the maximum permitted. Zero means no waiting.
+func parseWait(r *http.Request) (time.Duration, error) {
+	param := r.URL.Query().Get("wait")
+	if param == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(param)
+	if err != nil || wait < 0 {
+		return 0, errInvalidWait
+	}
+	if wait > longPollMaxWait {
+		wait = longPollMaxWait
+	}
+	return wait, nil
+}
+
+// waitUpdate blocks until the version of a resource differs from the one the
+// client already knows (`version` query parameter, as returned in the `ETag`
+// header), the timeout expires, or the client disconnects. The latter is
+// reported via the request context's error, in which case the caller should
+// not bother responding.
+//
+// The relevant callback filters the backend events that might have changed the
+// resource, and the version callback retrieves its current version.
+func (api *api) waitUpdate(r *http.Request, wait time.Duration, relevant func(coronanet.Event) bool, version func() (string, error)) error {
+	// Subscribe before checking the version to avoid missing updates
+	events, unsub := api.backend.Subscribe()
+	defer unsub()
+
+	known := strings.Trim(r.URL.Query().Get("version"), `"`)
+	return waitVersion(r.Context(), events, wait, known, relevant, version)
+}
+
+// waitVersion is the feed agnostic internals of waitUpdate.
+func waitVersion(ctx context.Context, events <-chan coronanet.Event, wait time.Duration, known string, relevant func(coronanet.Event) bool, version func() (string, error)) error {
+	if current, err := version(); err != nil || current != known {
+		return nil // Changed or errored, the caller will handle it
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-timeout.C:
+			return nil
+
+		case event := <-events:
+			if !relevant(event) {
+				continue
+			}
+			if current, err := version(); err != nil || current != known {
+				return nil
+			}
+		}
+	}
+}
+
+// setVersion attaches the version of a served resource to the response, which
+// the client may use in subsequent long-poll requests.
+func setVersion(w http.ResponseWriter, version string) {
+	w.Header().Set("ETag", `"`+version+`"`)
+}
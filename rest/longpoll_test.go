@@ -0,0 +1,128 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package rest
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// testVersioned is a mock resource with an atomically bumpable version.
+type testVersioned struct {
+	version int32
+}
+
+func (v *testVersioned) current() (string, error) {
+	return strconv.Itoa(int(atomic.LoadInt32(&v.version))), nil
+}
+
+func (v *testVersioned) bump() {
+	atomic.AddInt32(&v.version, 1)
+}
+
+// relevantContact creates an event filter for updates of a single contact.
+func relevantContact(uid tornet.IdentityFingerprint) func(coronanet.Event) bool {
+	return func(event coronanet.Event) bool {
+		return event.Kind == coronanet.EventContactUpdated && event.Contact == uid
+	}
+}
+
+// Tests that a long-poll returns as soon as the resource changes, but ignores
+// irrelevant notifications meanwhile.
+func TestLongPollUpdate(t *testing.T) {
+	var (
+		resource = new(testVersioned)
+		events   = make(chan coronanet.Event, 4)
+		done     = make(chan error, 1)
+	)
+	go func() {
+		done <- waitVersion(context.Background(), events, time.Minute, "0", relevantContact("alice"), resource.current)
+	}()
+	// Send an unrelated notification and a related one without a change
+	events <- coronanet.Event{Kind: coronanet.EventContactUpdated, Contact: "bob"}
+	events <- coronanet.Event{Kind: coronanet.EventContactUpdated, Contact: "alice"}
+
+	select {
+	case err := <-done:
+		t.Fatalf("long-poll returned without change: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Change the resource and ensure the wait returns
+	resource.bump()
+	events <- coronanet.Event{Kind: coronanet.EventContactUpdated, Contact: "alice"}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("long-poll failed: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("long-poll not woken up by change")
+	}
+	// Ensure a stale version returns immediately
+	if err := waitVersion(context.Background(), events, time.Minute, "0", relevantContact("alice"), resource.current); err != nil {
+		t.Fatalf("stale long-poll failed: %v", err)
+	}
+}
+
+// Tests that a long-poll without any changes returns when the timeout expires,
+// and that disconnecting aborts the wait.
+func TestLongPollTimeout(t *testing.T) {
+	resource := new(testVersioned)
+
+	start := time.Now()
+	if err := waitVersion(context.Background(), nil, 250*time.Millisecond, "0", relevantContact("alice"), resource.current); err != nil {
+		t.Fatalf("long-poll failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("long-poll returned early after %v", elapsed)
+	}
+	// Abort a long wait from the client side
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- waitVersion(ctx, nil, time.Minute, "0", relevantContact("alice"), resource.current)
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("aborted long-poll error mismatch: have %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("long-poll not aborted by disconnect")
+	}
+}
+
+// Tests that long-poll timeouts are parsed, capped and validated.
+func TestLongPollWait(t *testing.T) {
+	tests := []struct {
+		query string
+		wait  time.Duration
+		fail  bool
+	}{
+		{"", 0, false},
+		{"?wait=30s", 30 * time.Second, false},
+		{"?wait=1h", longPollMaxWait, false},
+		{"?wait=soon", 0, true},
+		{"?wait=-1s", 0, true},
+	}
+	for i, tt := range tests {
+		wait, err := parseWait(httptest.NewRequest("GET", "/events/joined/x"+tt.query, nil))
+		if (err != nil) != tt.fail {
+			t.Errorf("test %d: failure mismatch: have %v, want %v", i, err, tt.fail)
+		}
+		if wait != tt.wait {
+			t.Errorf("test %d: wait mismatch: have %v, want %v", i, wait, tt.wait)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package rest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coronanet/go-coronanet"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// serveMetrics serves API calls concerning the operational metrics of the node.
+func (api *api) serveMetrics(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	switch r.Method {
+	case "GET":
+		// Gathers the current metrics and exports them for Prometheus
+		logger.Trace("Exporting backend metrics")
+
+		w.Header().Add("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, api.backend.Metrics())
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// labelEscaper escapes the special characters of a Prometheus label value.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// helpEscaper escapes the special characters of a Prometheus help string.
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// writeMetrics serializes a batch of metrics into the Prometheus text exposition
+// format. Labels are sorted by name to keep the output stable across scrapes.
+func writeMetrics(w io.Writer, metrics []coronanet.Metric) error {
+	buf := bufio.NewWriter(w)
+	for _, metric := range metrics {
+		fmt.Fprintf(buf, "# HELP %s %s\n", metric.Name, helpEscaper.Replace(metric.Help))
+		fmt.Fprintf(buf, "# TYPE %s %s\n", metric.Name, metric.Kind)
+
+		for _, sample := range metric.Samples {
+			buf.WriteString(metric.Name)
+			if len(sample.Labels) > 0 {
+				names := make([]string, 0, len(sample.Labels))
+				for name := range sample.Labels {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+
+				buf.WriteByte('{')
+				for i, name := range names {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					fmt.Fprintf(buf, `%s="%s"`, name, labelEscaper.Replace(sample.Labels[name]))
+				}
+				buf.WriteByte('}')
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(strconv.FormatFloat(sample.Value, 'g', -1, 64))
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Flush()
+}
@@ -0,0 +1,48 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package rest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/coronanet/go-coronanet"
+)
+
+// Tests that metrics are serialized into the Prometheus text format, with the
+// labels sorted and escaped.
+func TestWriteMetrics(t *testing.T) {
+	metrics := []coronanet.Metric{
+		{
+			Name:    "coronanet_contacts",
+			Help:    "Number of trusted contacts",
+			Kind:    "gauge",
+			Samples: []coronanet.MetricSample{{Value: 3}},
+		},
+		{
+			Name: "coronanet_traffic_bytes_total",
+			Help: "Traffic\nby protocol",
+			Kind: "counter",
+			Samples: []coronanet.MetricSample{
+				{Labels: map[string]string{"protocol": "corona", "dir": "in"}, Value: 1.5e9},
+				{Labels: map[string]string{"protocol": `we"ird\`}, Value: 0},
+			},
+		},
+	}
+	want := `# HELP coronanet_contacts Number of trusted contacts
+# TYPE coronanet_contacts gauge
+coronanet_contacts 3
+# HELP coronanet_traffic_bytes_total Traffic\nby protocol
+# TYPE coronanet_traffic_bytes_total counter
+coronanet_traffic_bytes_total{dir="in",protocol="corona"} 1.5e+09
+coronanet_traffic_bytes_total{protocol="we\"ird\\"} 0
+`
+	buf := new(bytes.Buffer)
+	if err := writeMetrics(buf, metrics); err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	if have := buf.String(); have != want {
+		t.Fatalf("metrics mismatch: have\n%s\nwant\n%s", have, want)
+	}
+}
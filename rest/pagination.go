@@ -0,0 +1,53 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// pageDefaultLimit is the number of entries returned in a page of a listing if
+// the client requested pagination without specifying the page size.
+const pageDefaultLimit = 100
+
+// errInvalidLimit is returned if the page size of a listing request is malformed.
+var errInvalidLimit = errors.New("invalid page limit")
+
+// parsePage extracts the optional pagination parameters (`cursor` and `limit`
+// query parameters) of a listing request. If neither is present, the request
+// is not paginated and the entire listing should be returned.
+func parsePage(r *http.Request) (string, int, bool, error) {
+	query := r.URL.Query()
+
+	_, cursored := query["cursor"]
+	_, limited := query["limit"]
+	if !cursored && !limited {
+		return "", 0, false, nil
+	}
+	limit := pageDefaultLimit
+	if param := query.Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit <= 0 {
+			return "", 0, false, errInvalidLimit
+		}
+	}
+	return query.Get("cursor"), limit, true, nil
+}
+
+// setNextPage sets the `Link` header of a listing response to point to the next
+// page, if there is one.
+func setNextPage(w http.ResponseWriter, r *http.Request, cursor string, limit int) {
+	if cursor == "" {
+		return
+	}
+	query := url.Values{}
+	query.Set("cursor", cursor)
+	query.Set("limit", strconv.Itoa(limit))
+
+	next := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	w.Header().Set("Link", "<"+next.String()+`>; rel="next"`)
+}
@@ -8,11 +8,20 @@ import (
 	"net/http"
 
 	"github.com/coronanet/go-coronanet"
+	"github.com/coronanet/go-coronanet/tornet"
 	"github.com/ethereum/go-ethereum/log"
 )
 
 // servePairing serves API calls concerning the contact pairing.
-func (api *api) servePairing(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+func (api *api) servePairing(w http.ResponseWriter, r *http.Request, path string, logger log.Logger) {
+	switch {
+	case path == "/completed":
+		api.servePairingCompleted(w, r, logger)
+		return
+	case path != "":
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
 	switch r.Method {
 	case "POST":
 		// Creates a pairing session for contact establishment
@@ -39,10 +48,13 @@ func (api *api) servePairing(w http.ResponseWriter, r *http.Request, logger log.
 	case "GET":
 		// Waits for a pairing session to complete
 		logger.Debug("Requesting waiting for pairing session")
-		switch uid, err := api.backend.WaitPairing(); err {
+		switch uid, err := api.backend.WaitPairing(r.Context()); err {
 		case coronanet.ErrNotPairing:
 			logger.Warn("No pairing session in progress")
 			http.Error(w, "No pairing session in progress", http.StatusForbidden)
+		case coronanet.ErrPairingExpired:
+			logger.Warn("Pairing session expired")
+			http.Error(w, "Pairing session expired", http.StatusRequestTimeout)
 		case coronanet.ErrContactExists:
 			logger.Warn("Remote contact already paired")
 			http.Error(w, "Remote contact already paired", http.StatusConflict)
@@ -67,12 +79,13 @@ func (api *api) servePairing(w http.ResponseWriter, r *http.Request, logger log.
 			http.Error(w, "Provided pairing secret is invalid: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		if len(blob) != 64 {
-			logger.Error("Provided pairing secret is invalid: not 64 bytes")
-			http.Error(w, "Provided pairing secret is invalid: not 64 bytes", http.StatusBadRequest)
+		secret, address, err := tornet.ParsePairingSecret(blob)
+		if err != nil {
+			logger.Warn("Provided pairing secret is invalid", "err", err)
+			http.Error(w, "Provided pairing secret is invalid: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		switch uid, err := api.backend.JoinPairing(blob[:32], blob[32:]); err {
+		switch uid, err := api.backend.JoinPairing(secret, address); err {
 		case coronanet.ErrProfileNotFound:
 			logger.Warn("Cannot pair without profile")
 			http.Error(w, "Cannot pair without profile", http.StatusForbidden)
@@ -82,6 +95,12 @@ func (api *api) servePairing(w http.ResponseWriter, r *http.Request, logger log.
 		case coronanet.ErrContactExists:
 			logger.Warn("Remote contact already paired")
 			http.Error(w, "Remote contact already paired", http.StatusConflict)
+		case coronanet.ErrJoinInProgress:
+			logger.Warn("Pairing session already being joined")
+			http.Error(w, "Pairing session already being joined", http.StatusConflict)
+		case coronanet.ErrJoinThrottled:
+			logger.Warn("Pairing joins requested too frequently")
+			http.Error(w, "Pairing joins requested too frequently", http.StatusTooManyRequests)
 		case nil:
 			logger.Debug("Pairing join completed successfully", "contact", uid)
 			w.Header().Add("Content-Type", "application/json")
@@ -91,6 +110,52 @@ func (api *api) servePairing(w http.ResponseWriter, r *http.Request, logger log.
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 
+	case "DELETE":
+		// Aborts a pairing session nobody is waiting on
+		logger.Debug("Requesting pairing session abortion")
+		switch err := api.backend.AbortPairing(); err {
+		case coronanet.ErrNotPairing:
+			logger.Warn("No pairing session in progress")
+			http.Error(w, "No pairing session in progress", http.StatusForbidden)
+		case nil:
+			logger.Debug("Pairing session aborted")
+			w.WriteHeader(http.StatusOK)
+		default:
+			logger.Error("Pairing session abortion failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// servePairingCompleted serves API calls concerning pairing completion notifications.
+func (api *api) servePairingCompleted(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	switch r.Method {
+	case "GET":
+		// Waits for any pairing session to complete, independent of who initiated it
+		logger.Debug("Requesting waiting for pairing completion")
+
+		events, unsub := api.backend.Subscribe()
+		defer unsub()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				logger.Debug("Pairing completion wait aborted")
+				return
+			case event := <-events:
+				if event.Kind != coronanet.EventPairingCompleted {
+					continue
+				}
+				logger.Debug("Pairing completion wait finished", "contact", event.Contact)
+				w.Header().Add("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(event.Contact)
+				return
+			}
+		}
+
 	default:
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
@@ -10,15 +10,27 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/coronanet/go-coronanet"
+	"github.com/coronanet/go-coronanet/tornet"
 	"github.com/ethereum/go-ethereum/log"
 )
 
 // ProfileInfos is the response struct sent back to the client when requesting
 // a user profile from the Corona Network.
 type ProfileInfos struct {
-	Name string `json:"name"`
+	Name     string     `json:"name"`
+	Mood     *string    `json:"mood,omitempty"`
+	Blocked  bool       `json:"blocked,omitempty"`
+	LastSeen *time.Time `json:"lastseen,omitempty"`
+}
+
+// ProfileIdentity is the response struct sent back to the client when requesting
+// the local user's shareable identity.
+type ProfileIdentity struct {
+	Keyring     []byte                     `json:"keyring"`
+	Fingerprint tornet.IdentityFingerprint `json:"fingerprint"`
 }
 
 // serveProfile serves API calls concerning the local user profile.
@@ -28,6 +40,10 @@ func (api *api) serveProfile(w http.ResponseWriter, r *http.Request, path string
 		api.serveProfileInfo(w, r, logger)
 	case strings.HasPrefix(path, "/avatar"):
 		api.serveProfileAvatar(w, r, logger)
+	case strings.HasPrefix(path, "/status"):
+		api.serveProfileStatus(w, r, logger)
+	case path == "/identity":
+		api.serveProfileIdentity(w, r, logger)
 	default:
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 	}
@@ -61,7 +77,11 @@ func (api *api) serveProfileInfo(w http.ResponseWriter, r *http.Request, logger
 		case nil:
 			logger.Debug("Profile successfully retrieved", "name", profile.Name)
 			w.Header().Add("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(&ProfileInfos{Name: profile.Name})
+			infos := &ProfileInfos{Name: profile.Name}
+			if profile.Mood != "" {
+				infos.Mood = &profile.Mood
+			}
+			json.NewEncoder(w).Encode(infos)
 		default:
 			logger.Error("Profile retrieval failed", "err", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -76,10 +96,22 @@ func (api *api) serveProfileInfo(w http.ResponseWriter, r *http.Request, logger
 			http.Error(w, "Provided profile is invalid: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		switch err := api.backend.UpdateProfile(profile.Name); err {
+		// Update the mood first (if given, older clients don't know about it), so
+		// an invalid one doesn't leave a partial update
+		var err error
+		if profile.Mood != nil {
+			err = api.backend.UpdateProfileMood(*profile.Mood)
+		}
+		if err == nil {
+			err = api.backend.UpdateProfile(profile.Name)
+		}
+		switch err {
 		case coronanet.ErrProfileNotFound:
 			logger.Warn("Local user doesn't exist")
 			http.Error(w, "Local user doesn't exist", http.StatusForbidden)
+		case coronanet.ErrMoodTooLong:
+			logger.Warn("Provided mood is too long")
+			http.Error(w, "Provided mood is too long", http.StatusBadRequest)
 		case nil:
 			logger.Debug("Profile successfully updated")
 			w.WriteHeader(http.StatusOK)
@@ -137,6 +169,8 @@ func (api *api) serveProfileAvatar(w http.ResponseWriter, r *http.Request, logge
 
 		// Attempt to push the image into the database
 		switch err := api.backend.UploadProfilePicture(buffer.Bytes()); err {
+		case coronanet.ErrImageTooLarge:
+			http.Error(w, "Profile picture too large", http.StatusRequestEntityTooLarge)
 		case coronanet.ErrProfileNotFound:
 			http.Error(w, "Local user doesn't exist", http.StatusForbidden)
 		case nil:
@@ -160,3 +194,82 @@ func (api *api) serveProfileAvatar(w http.ResponseWriter, r *http.Request, logge
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
+
+// serveProfileStatus serves API calls concerning local user's infection status.
+func (api *api) serveProfileStatus(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	switch r.Method {
+	case "GET":
+		// Retrieves the local user's latest self-declared infection status
+		logger.Debug("Requesting infection status")
+		switch status, err := api.backend.InfectionStatus(); err {
+		case coronanet.ErrProfileNotFound:
+			logger.Warn("Local user doesn't exist")
+			http.Error(w, "Local user doesn't exist", http.StatusForbidden)
+		case nil:
+			logger.Debug("Infection status successfully retrieved", "status", status.Status)
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(status)
+		default:
+			logger.Error("Infection status retrieval failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case "PUT":
+		// Declares a new infection status for the local user
+		logger.Debug("Requesting infection status update")
+		status := new(coronanet.InfectionStatus)
+		if err := json.NewDecoder(r.Body).Decode(status); err != nil {
+			logger.Error("Provided infection status is invalid", "err", err)
+			http.Error(w, "Provided infection status is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err := api.backend.SetInfectionStatus(status.Status); err {
+		case coronanet.ErrProfileNotFound:
+			logger.Warn("Local user doesn't exist")
+			http.Error(w, "Local user doesn't exist", http.StatusForbidden)
+		case coronanet.ErrInvalidInfectionStatus:
+			logger.Warn("Provided infection status is invalid", "status", status.Status)
+			http.Error(w, "Provided infection status is invalid", http.StatusBadRequest)
+		case coronanet.ErrInvalidInfectionTransition:
+			logger.Warn("Infection status transition forbidden", "status", status.Status)
+			http.Error(w, "Infection status transition forbidden", http.StatusConflict)
+		case nil:
+			logger.Debug("Infection status successfully updated")
+			w.WriteHeader(http.StatusOK)
+		default:
+			logger.Error("Infection status update failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveProfileIdentity serves API calls concerning the local user's shareable
+// identity.
+func (api *api) serveProfileIdentity(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	switch r.Method {
+	case "GET":
+		// Retrieves the local user's identity for others to add as a contact
+		logger.Debug("Requesting profile identity")
+		switch keyring, err := api.backend.MyKeyring(); err {
+		case coronanet.ErrProfileNotFound:
+			logger.Warn("Local user doesn't exist")
+			http.Error(w, "Local user doesn't exist", http.StatusForbidden)
+		case nil:
+			logger.Debug("Profile identity successfully retrieved")
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&ProfileIdentity{
+				Keyring:     keyring.Bytes(),
+				Fingerprint: keyring.Identity.Fingerprint(),
+			})
+		default:
+			logger.Error("Profile identity retrieval failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,68 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package rest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/coronanet/go-coronanet"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Tests that profile updates only touch the mood message if it's explicitly set,
+// so clients unaware of it don't wipe it when renaming the user.
+func TestProfileUpdateMood(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "coronanet-rest-")
+	if err != nil {
+		t.Fatalf("failed to create temporary datadir: %v", err)
+	}
+	defer os.RemoveAll(datadir)
+
+	backend, err := coronanet.NewBackendWithGateway(datadir, tornet.NewMockGateway(), log.Root())
+	if err != nil {
+		t.Fatalf("failed to create backend: %v", err)
+	}
+	defer backend.Close()
+
+	if err := backend.CreateProfile(); err != nil {
+		t.Fatalf("failed to create profile: %v", err)
+	}
+	handler := New(backend, Options{}, log.Root())
+
+	update := func(body string) {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("PUT", "/profile", strings.NewReader(body)))
+		if res.Code != http.StatusOK {
+			t.Fatalf("update %s: status mismatch: have %d, want %d", body, res.Code, http.StatusOK)
+		}
+	}
+	mood := func() *string {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", "/profile", nil))
+
+		infos := new(ProfileInfos)
+		if err := json.NewDecoder(res.Body).Decode(infos); err != nil {
+			t.Fatalf("failed to decode profile: %v", err)
+		}
+		return infos.Mood
+	}
+	// Set a mood, rename without one and ensure it's retained
+	update(`{"name": "Alice", "mood": "on holiday"}`)
+	update(`{"name": "Alicia"}`)
+	if have := mood(); have == nil || *have != "on holiday" {
+		t.Fatalf("mood mismatch: have %v, want %q", have, "on holiday")
+	}
+	// Explicitly clear the mood and ensure it's gone
+	update(`{"name": "Alicia", "mood": ""}`)
+	if have := mood(); have != nil {
+		t.Fatalf("mood not cleared: have %q", *have)
+	}
+}
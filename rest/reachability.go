@@ -0,0 +1,33 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/coronanet/go-coronanet"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// serveReachability serves API calls concerning the connectivity diagnostics.
+func (api *api) serveReachability(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	switch r.Method {
+	case "GET":
+		// Retrieves the connectivity status of all trusted contacts and events
+		logger.Trace("Retrieving reachability report")
+		switch report, err := api.backend.ReachabilityReport(); err {
+		case coronanet.ErrProfileNotFound:
+			http.Error(w, "Local user doesn't exist", http.StatusForbidden)
+		case nil:
+			w.Header().Add("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(report)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
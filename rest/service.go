@@ -19,13 +19,23 @@ import (
 type api struct {
 	nextreq uint64
 	backend *coronanet.Backend
+	options Options
 	logger  log.Logger
 }
 
+// Options contains the access restrictions to enforce on the REST API. The zero
+// value keeps the API fully open, which is fine as long as it's only reachable
+// from the local device.
+type Options struct {
+	AllowedOrigins []string // Browser origins permitted to access the API ("*" for any)
+	Token          string   // Bearer token required on every request (empty = none)
+}
+
 // New creates an REST API interface in front of a Corona Network backend.
-func New(backend *coronanet.Backend, logger log.Logger) http.Handler {
+func New(backend *coronanet.Backend, options Options, logger log.Logger) http.Handler {
 	return &api{
 		backend: backend,
+		options: options,
 		logger:  logger.New("api", "rest"),
 	}
 }
@@ -41,17 +51,31 @@ func (api *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		logger.Trace("API request finished", "elapsed", time.Since(start))
 	}(time.Now())
 
+	// Enforce the access restrictions before touching any route
+	if !api.serveCORS(w, r, logger) || !api.authorize(w, r, logger) {
+		return
+	}
 	switch {
+	case r.URL.Path == "/health":
+		api.serveHealth(w, r, logger)
+	case r.URL.Path == "/metrics":
+		api.serveMetrics(w, r, logger)
 	case strings.HasPrefix(r.URL.Path, "/gateway"):
 		api.serveGateway(w, r, logger)
 	case strings.HasPrefix(r.URL.Path, "/profile"):
 		api.serveProfile(w, r, strings.TrimPrefix(r.URL.Path, "/profile"), logger)
 	case strings.HasPrefix(r.URL.Path, "/pairing"):
-		api.servePairing(w, r, logger)
+		api.servePairing(w, r, strings.TrimPrefix(r.URL.Path, "/pairing"), logger)
 	case strings.HasPrefix(r.URL.Path, "/contacts"):
 		api.serveContacts(w, r, strings.TrimPrefix(r.URL.Path, "/contacts"))
 	case strings.HasPrefix(r.URL.Path, "/events"):
 		api.serveEvents(w, r, strings.TrimPrefix(r.URL.Path, "/events"), logger)
+	case r.URL.Path == "/reachability":
+		api.serveReachability(w, r, logger)
+	case r.URL.Path == "/storage":
+		api.serveStorage(w, r, logger)
+	case r.URL.Path == "/stream":
+		api.serveStream(w, r, logger)
 	case strings.HasPrefix(r.URL.Path, "/cdn"):
 		api.serveCDN(w, r, strings.TrimPrefix(r.URL.Path, "/cdn"))
 	default:
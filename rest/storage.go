@@ -0,0 +1,25 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// serveStorage serves API calls concerning the local storage usage.
+func (api *api) serveStorage(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	switch r.Method {
+	case "GET":
+		// Retrieves the storage usage broken down per entity type
+		logger.Trace("Retrieving storage breakdown")
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(api.backend.StorageBreakdown())
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
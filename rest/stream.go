@@ -0,0 +1,81 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/coronanet/go-coronanet"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// streamKeepAlive is the time period after which to send a comment down an idle
+// event stream to avoid intermediate proxies timing it out.
+const streamKeepAlive = 30 * time.Second
+
+// serveStream serves API calls concerning the live stream of backend updates.
+func (api *api) serveStream(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	switch r.Method {
+	case "GET":
+		// Streams backend events as Server-Sent Events until the client leaves
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		events, unsub := api.backend.Subscribe()
+		defer unsub()
+
+		w.Header().Add("Content-Type", "text/event-stream")
+		w.Header().Add("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		logger.Debug("Event stream opened")
+		err := streamEvents(r.Context(), w, flusher, events, streamKeepAlive)
+		logger.Debug("Event stream closed", "err", err)
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// streamEvents writes each backend event into an SSE stream, named after the
+// event kind and carrying the JSON encoded event as data. It returns when the
+// client disconnects or a write fails.
+//
+// The backend feed drops the oldest events of slow subscribers, so a client not
+// keeping up with the stream never blocks the protocol handlers.
+func streamEvents(ctx context.Context, w io.Writer, flusher http.Flusher, events <-chan coronanet.Event, keepalive time.Duration) error {
+	ticker := time.NewTicker(keepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return err
+			}
+			flusher.Flush()
+
+		case event := <-events:
+			blob, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Kind, blob); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+	}
+}
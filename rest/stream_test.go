@@ -0,0 +1,55 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package rest
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet"
+)
+
+// Tests that backend events are written into the stream in SSE format, with an
+// occasional keepalive comment, until the client disconnects.
+func TestStreamEvents(t *testing.T) {
+	var (
+		recorder    = httptest.NewRecorder()
+		events      = make(chan coronanet.Event, 4)
+		ctx, cancel = context.WithCancel(context.Background())
+		done        = make(chan error, 1)
+	)
+	events <- coronanet.Event{Kind: coronanet.EventContactAdded, Contact: "alice"}
+	events <- coronanet.Event{Kind: coronanet.EventHostedUpdated, Event: "party"}
+
+	go func() {
+		done <- streamEvents(ctx, recorder, recorder, events, 50*time.Millisecond)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("stream termination error mismatch: have %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("stream didn't terminate on disconnect")
+	}
+	body := recorder.Body.String()
+	for _, want := range []string{
+		"event: contact-added\ndata: {\"kind\":\"contact-added\",\"contact\":\"alice\"}\n\n",
+		"event: hosted-updated\ndata: {\"kind\":\"hosted-updated\",\"event\":\"party\"}\n\n",
+		": keepalive\n\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("stream missing %q, have %q", want, body)
+		}
+	}
+	if !recorder.Flushed {
+		t.Errorf("stream never flushed")
+	}
+}
@@ -0,0 +1,143 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	// dbRetentionKey is the database key for storing the message retention policy.
+	dbRetentionKey = []byte("retention")
+
+	// ErrInvalidRetention is returned if a message retention policy is attempted
+	// to be set with negative limits.
+	ErrInvalidRetention = errors.New("invalid retention policy")
+)
+
+// MessageRetention is the policy by which old messages exchanged with contacts
+// are pruned to keep the database from growing unbounded. The limits apply per
+// conversation and any zero field means that limit is disabled.
+type MessageRetention struct {
+	MaxMessages int           `json:"maxMessages"` // Maximum number of messages to keep
+	MaxAge      time.Duration `json:"maxAge"`      // Maximum age of the messages to keep
+	MaxBytes    int           `json:"maxBytes"`    // Maximum text and attachment bytes to keep
+}
+
+// SetMessageRetention sets the policy by which to prune old messages, and prunes
+// all existing conversations accordingly. By default, messages are kept forever.
+func (b *Backend) SetMessageRetention(policy MessageRetention) error {
+	b.logger.Info("Setting message retention", "messages", policy.MaxMessages, "age", policy.MaxAge, "bytes", policy.MaxBytes)
+
+	if policy.MaxMessages < 0 || policy.MaxAge < 0 || policy.MaxBytes < 0 {
+		return ErrInvalidRetention
+	}
+	blob, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := b.database.Put(dbRetentionKey, blob, nil); err != nil {
+		return err
+	}
+	// Prune all existing conversations (no profile means nothing to prune)
+	contacts, err := b.contacts()
+	if err != nil {
+		return nil
+	}
+	for _, uid := range contacts {
+		if err := b.pruneMessages(uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MessageRetention retrieves the policy by which old messages are pruned.
+func (b *Backend) MessageRetention() (*MessageRetention, error) {
+	policy := new(MessageRetention)
+
+	blob, err := b.database.Get(dbRetentionKey, nil)
+	if err != nil {
+		return policy, nil // No policy set, keep everything
+	}
+	if err := json.Unmarshal(blob, policy); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// pruneMessages deletes the oldest messages exchanged with a remote contact
+// until the conversation fits within the message retention policy, and drops
+// the attachments of the pruned messages from the CDN. Queued up messages are
+// not affected, they will be delivered regardless.
+//
+// Note, this method assumes the write lock is held.
+func (b *Backend) pruneMessages(uid tornet.IdentityFingerprint) error {
+	policy, err := b.MessageRetention()
+	if err != nil {
+		return err
+	}
+	if *policy == (MessageRetention{}) {
+		return nil
+	}
+	// Retrieve the entire conversation, oldest first
+	var (
+		messages []*Message
+		size     int
+	)
+	it := b.database.NewIterator(util.BytesPrefix(append(append(append([]byte{}, dbMessagePrefix...), uid...), '-')), nil)
+	for it.Next() {
+		blob, err := b.openSecret(it.Value())
+		if err != nil {
+			it.Release()
+			return err
+		}
+		msg := new(Message)
+		if err := json.Unmarshal(blob, msg); err != nil {
+			it.Release()
+			return err
+		}
+		messages = append(messages, msg)
+		size += len(msg.Text) + msg.Size
+	}
+	it.Release()
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Time.Before(messages[j].Time)
+	})
+	// Drop the oldest messages until all the limits are satisfied
+	for len(messages) > 0 {
+		var (
+			count   = policy.MaxMessages > 0 && len(messages) > policy.MaxMessages
+			expired = policy.MaxAge > 0 && time.Since(messages[0].Time) > policy.MaxAge
+			bloated = policy.MaxBytes > 0 && size > policy.MaxBytes
+		)
+		if !count && !expired && !bloated {
+			break
+		}
+		msg := messages[0]
+		if err := b.database.Delete(messageKey(uid, msg.Nonce), nil); err != nil {
+			return err
+		}
+		if msg.Attachment != ([32]byte{}) {
+			if err := b.deleteCDNImage(msg.Attachment); err != nil {
+				return err
+			}
+		}
+		b.logger.Debug("Pruned old message", "contact", uid, "time", msg.Time, "expired", expired)
+
+		messages = messages[1:]
+		size -= len(msg.Text) + msg.Size
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/crypto/sha3"
+)
+
+// storeTestMessage inserts a message with the given content into a conversation.
+func storeTestMessage(t *testing.T, backend *Backend, uid tornet.IdentityFingerprint, text string, attachment []byte, time time.Time) {
+	msg := &Message{Text: text, Time: time}
+	rand.Read(msg.Nonce[:])
+
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if err := backend.storeMessage(uid, msg, attachment); err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+}
+
+// testConversation retrieves the texts of all the messages stored for a remote
+// contact, without requiring the contact to exist.
+func testConversation(t *testing.T, backend *Backend, uid tornet.IdentityFingerprint) map[string]bool {
+	texts := make(map[string]bool)
+
+	it := backend.database.NewIterator(util.BytesPrefix(append(append(append([]byte{}, dbMessagePrefix...), uid...), '-')), nil)
+	defer it.Release()
+
+	for it.Next() {
+		msg := new(Message)
+		if err := json.Unmarshal(it.Value(), msg); err != nil {
+			t.Fatalf("failed to decode message: %v", err)
+		}
+		texts[msg.Text] = true
+	}
+	return texts
+}
+
+// Tests that messages are kept forever by default and that invalid retention
+// policies are rejected.
+func TestMessageRetentionDefault(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	for i := 0; i < 10; i++ {
+		storeTestMessage(t, backend, "bob", string(rune('a'+i)), nil, time.Now().Add(-365*24*time.Hour))
+	}
+	if texts := testConversation(t, backend, "bob"); len(texts) != 10 {
+		t.Fatalf("message count mismatch: have %d, want %d", len(texts), 10)
+	}
+	if err := backend.SetMessageRetention(MessageRetention{MaxMessages: -1}); err != ErrInvalidRetention {
+		t.Fatalf("invalid policy error mismatch: have %v, want %v", err, ErrInvalidRetention)
+	}
+}
+
+// Tests that exceeding the message count limit prunes the oldest messages and
+// dereferences their attachments from the CDN.
+func TestMessageRetentionCount(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	if err := backend.SetMessageRetention(MessageRetention{MaxMessages: 2}); err != nil {
+		t.Fatalf("failed to set retention: %v", err)
+	}
+	attachment := []byte("picture of a cat")
+
+	start := time.Now()
+	storeTestMessage(t, backend, "bob", "first", attachment, start)
+	storeTestMessage(t, backend, "bob", "second", nil, start.Add(time.Second))
+
+	if _, err := backend.CDNImage(sha3.Sum256(attachment)); err != nil {
+		t.Fatalf("attachment not stored: %v", err)
+	}
+	storeTestMessage(t, backend, "bob", "third", nil, start.Add(2*time.Second))
+
+	texts := testConversation(t, backend, "bob")
+	if len(texts) != 2 || !texts["second"] || !texts["third"] {
+		t.Fatalf("retained messages mismatch: have %v, want [second third]", texts)
+	}
+	if _, err := backend.CDNImage(sha3.Sum256(attachment)); err != ErrImageNotFound {
+		t.Fatalf("pruned attachment error mismatch: have %v, want %v", err, ErrImageNotFound)
+	}
+}
+
+// Tests that messages exceeding the age limit are pruned, along with their
+// attachments.
+func TestMessageRetentionAge(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	// Insert some old messages without retention, then enable it
+	attachment := []byte("picture of a dog")
+
+	storeTestMessage(t, backend, "bob", "ancient", attachment, time.Now().Add(-48*time.Hour))
+	storeTestMessage(t, backend, "bob", "recent", nil, time.Now().Add(-time.Hour))
+
+	if err := backend.SetMessageRetention(MessageRetention{MaxAge: 24 * time.Hour}); err != nil {
+		t.Fatalf("failed to set retention: %v", err)
+	}
+	// Contacts are only pruned on policy change if there's a profile, so insert
+	// a new message to trigger it
+	storeTestMessage(t, backend, "bob", "current", nil, time.Now())
+
+	texts := testConversation(t, backend, "bob")
+	if len(texts) != 2 || !texts["recent"] || !texts["current"] {
+		t.Fatalf("retained messages mismatch: have %v, want [recent current]", texts)
+	}
+	if _, err := backend.CDNImage(sha3.Sum256(attachment)); err != ErrImageNotFound {
+		t.Fatalf("pruned attachment error mismatch: have %v, want %v", err, ErrImageNotFound)
+	}
+}
+
+// Tests that exceeding the byte limit prunes the oldest messages, and that shared
+// attachments are deduplicated and only dropped from the CDN with the last user.
+func TestMessageRetentionBytes(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	if err := backend.SetMessageRetention(MessageRetention{MaxBytes: 2500}); err != nil {
+		t.Fatalf("failed to set retention: %v", err)
+	}
+	attachment := make([]byte, 1000)
+	rand.Read(attachment)
+	hash := sha3.Sum256(attachment)
+
+	// Send the same attachment twice and ensure it's deduplicated
+	start := time.Now()
+	storeTestMessage(t, backend, "bob", "", attachment, start)
+	storeTestMessage(t, backend, "bob", "again", attachment, start.Add(time.Second))
+
+	if refs, _ := backend.cdnImageMeta(hash); refs != 2 {
+		t.Fatalf("attachment refs mismatch: have %d, want %d", refs, 2)
+	}
+	// Push the conversation over the limit, ensure only the oldest is dropped
+	text := string(make([]byte, 600))
+	storeTestMessage(t, backend, "bob", text, nil, start.Add(2*time.Second))
+
+	if texts := testConversation(t, backend, "bob"); len(texts) != 2 || texts[""] {
+		t.Fatalf("retained message count mismatch: have %d, want %d", len(texts), 2)
+	}
+	if refs, _ := backend.cdnImageMeta(hash); refs != 1 {
+		t.Fatalf("attachment refs mismatch: have %d, want %d", refs, 1)
+	}
+	if _, err := backend.CDNImage(hash); err != nil {
+		t.Fatalf("shared attachment dropped: %v", err)
+	}
+	// Push the conversation over the limit again, ensure the attachment is gone
+	storeTestMessage(t, backend, "bob", string(make([]byte, 1000)), nil, start.Add(3*time.Second))
+
+	if texts := testConversation(t, backend, "bob"); len(texts) != 2 || texts["again"] {
+		t.Fatalf("retained message count mismatch: have %d, want %d", len(texts), 2)
+	}
+	if _, err := backend.CDNImage(hash); err != ErrImageNotFound {
+		t.Fatalf("pruned attachment error mismatch: have %v, want %v", err, ErrImageNotFound)
+	}
+}
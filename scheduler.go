@@ -5,6 +5,10 @@ package coronanet
 
 import (
 	"context"
+	"errors"
+	"math"
+	"reflect"
+	"sync/atomic"
 	"time"
 
 	"github.com/coronanet/go-coronanet/protocols/corona"
@@ -18,23 +22,52 @@ type schedulerRequest struct {
 	contacts []tornet.IdentityFingerprint
 }
 
+// schedulerRejection is a notification towards the scheduler that a contact was
+// successfully dialed, but it refused the handshake (e.g. doesn't trust us yet).
+type schedulerRejection struct {
+	contact tornet.IdentityFingerprint
+	err     error
+}
+
+// schedulerStatus is a snapshot of the dial state of a single contact.
+type schedulerStatus struct {
+	next        time.Time // Time when the contact will be dialed next
+	failure     error     // Error of the last dial if it failed, nil otherwise
+	failures    int       // Number of consecutive failed dials (reset on success)
+	reliability float64   // Moving average of dial successes (1) and failures (0)
+}
+
 // scheduler is a remote connection dialer that aggregates various system and
 // user events and schedules the dialing of remote peers based on them.
 type scheduler struct {
-	backend *Backend // Backend to retrieve the overlay node from
+	dials    uint64 // Number of dials attempted (atomic, for metrics)
+	failures uint64 // Number of dials failed (atomic, for metrics)
+	queued   int64  // Number of contacts currently scheduled (atomic, for metrics)
 
-	update     chan *schedulerRequest    // Scheduler channel for app update requests
-	keyring    chan tornet.SecretKeyRing // Scheduler channel when the keyring is updated
-	teardown   chan chan struct{}        // Scheduler channel when the system is terminating
-	terminated chan struct{}             // Termination channel to unblock any schedules
+	backend *Backend     // Backend to retrieve the overlay node from
+	clock   tornet.Clock // Source of time to schedule the dials by
+
+	update     chan *schedulerRequest                                    // Scheduler channel for app update requests
+	keyring    chan tornet.SecretKeyRing                                 // Scheduler channel when the keyring is updated
+	status     chan chan map[tornet.IdentityFingerprint]*schedulerStatus // Scheduler channel for introspection requests
+	rejected   chan *schedulerRejection                                  // Scheduler channel when a dialed contact refused us
+	teardown   chan chan struct{}                                        // Scheduler channel when the system is terminating
+	terminated chan struct{}                                             // Termination channel to unblock any schedules
 }
 
 // newScheduler creates a new dial scheduler.
 func newScheduler(backend *Backend) *scheduler {
+	clock := backend.config.Clock
+	if clock == nil {
+		clock = tornet.SystemClock
+	}
 	dialer := &scheduler{
 		backend:    backend,
+		clock:      clock,
 		update:     make(chan *schedulerRequest),
 		keyring:    make(chan tornet.SecretKeyRing),
+		status:     make(chan chan map[tornet.IdentityFingerprint]*schedulerStatus),
+		rejected:   make(chan *schedulerRejection),
 		teardown:   make(chan chan struct{}),
 		terminated: make(chan struct{}),
 	}
@@ -78,6 +111,32 @@ func (s *scheduler) prioritize(dial time.Duration, contacts []tornet.IdentityFin
 	}
 }
 
+// statuses retrieves a snapshot of the dial state of all scheduled contacts. If
+// the scheduler is already terminated, nil is returned.
+func (s *scheduler) statuses() map[tornet.IdentityFingerprint]*schedulerStatus {
+	reply := make(chan map[tornet.IdentityFingerprint]*schedulerStatus, 1)
+	select {
+	case s.status <- reply:
+		return <-reply
+	case <-s.terminated:
+		return nil
+	}
+}
+
+// watchHandshake waits for the handshake of a successfully dialed contact to
+// finish and notifies the scheduler if the remote side refused it.
+func (s *scheduler) watchHandshake(uid tornet.IdentityFingerprint, done chan error) {
+	err := <-done
+	if !errors.Is(err, tornet.ErrRejected) && !errors.Is(err, tornet.ErrUnexpectedServer) &&
+		!errors.Is(err, tornet.ErrUnauthorizedKey) && !errors.Is(err, tornet.ErrInvalidKeyType) {
+		return
+	}
+	select {
+	case s.rejected <- &schedulerRejection{contact: uid, err: err}:
+	case <-s.terminated:
+	}
+}
+
 // loop is responsible for scheduling networking data exchanges based on the various
 // priorities that events towards contacts might have.
 func (s *scheduler) loop() {
@@ -85,30 +144,32 @@ func (s *scheduler) loop() {
 	defer close(s.terminated)
 
 	schedule := make(map[tornet.IdentityFingerprint]time.Time)
+	failures := make(map[tornet.IdentityFingerprint]error)
+	streaks := make(map[tornet.IdentityFingerprint]int)
+	reliability := make(map[tornet.IdentityFingerprint]float64)
 
 	var (
-		nextTime = time.NewTimer(0)
-		nextChan = nextTime.C
+		nextTime = s.clock.NewTimer(0)
+		nextChan = nextTime.C()
 		nextDial tornet.IdentityFingerprint
 	)
 	for {
 		// Something happened, find the next dial target
 		if nextChan != nil {
 			if !nextTime.Stop() {
-				<-nextTime.C
+				<-nextTime.C()
 			}
 			nextChan = nil
 		}
+		atomic.StoreInt64(&s.queued, int64(len(schedule)))
+
 		var earliest time.Time
-		for uid, time := range schedule {
-			if earliest.IsZero() || earliest.After(time) {
-				earliest, nextDial = time, uid
-			}
-		}
+		now := s.clock.Now()
+		nextDial, earliest = nextDialTarget(schedule, reliability, now)
 		if !earliest.IsZero() {
-			s.backend.logger.Debug("Next dialing scheduled", "time", time.Until(earliest))
-			nextTime.Reset(time.Until(earliest))
-			nextChan = nextTime.C
+			s.backend.logger.Debug("Next dialing scheduled", "time", earliest.Sub(now))
+			nextTime.Reset(earliest.Sub(now))
+			nextChan = nextTime.C()
 		}
 		// Listen for scheduling requests or keyring updates
 		select {
@@ -122,28 +183,54 @@ func (s *scheduler) loop() {
 			for uid := range keyring.Trusted {
 				if _, ok := schedule[uid]; !ok {
 					s.backend.logger.Debug("Scheduling dial for new contact", "contact", uid)
-					schedule[uid] = time.Now()
+					schedule[uid] = s.clock.Now()
 				}
 			}
 			for uid := range schedule {
 				if _, ok := keyring.Trusted[uid]; !ok {
 					s.backend.logger.Debug("Unscheduling dial for dropped contact", "contact", uid)
 					delete(schedule, uid)
+					delete(failures, uid)
+					delete(streaks, uid)
+					delete(reliability, uid)
 				}
 			}
 
+		case reply := <-s.status:
+			// Someone requested the current dial state, assemble a snapshot
+			statuses := make(map[tornet.IdentityFingerprint]*schedulerStatus, len(schedule))
+			for uid, next := range schedule {
+				statuses[uid] = &schedulerStatus{next: next, failure: failures[uid], failures: streaks[uid], reliability: contactReliability(reliability, uid)}
+			}
+			reply <- statuses
+
+		case rej := <-s.rejected:
+			// A dialed contact refused the handshake, most probably because it did
+			// not add us (yet). Back off the same way as for an unreachable one.
+			if _, ok := schedule[rej.contact]; !ok {
+				continue // Contact dropped meanwhile
+			}
+			atomic.AddUint64(&s.failures, 1)
+			reliability[rej.contact] = updateReliability(contactReliability(reliability, rej.contact), false)
+			redial := failureRedial(reliability[rej.contact])
+
+			s.backend.logger.Warn("Contact rejected handshake", "contact", rej.contact, "schedule", redial, "reliability", reliability[rej.contact], "err", rej.err)
+			schedule[rej.contact] = s.clock.Now().Add(redial)
+			failures[rej.contact] = rej.err
+			streaks[rej.contact]++
+
 		case req := <-s.update:
 			// Application layer requested an update to be pushed out to one or
 			// more contacts. Merge the request with the current schedule.
 			for _, uid := range req.contacts {
 				had, ok := schedule[uid]
-				old := time.Until(had)
+				old := had.Sub(s.clock.Now())
 				switch {
 				case !ok:
 					s.backend.logger.Error("Reschedule requested for unknown contact", "contact", uid, "schedule", req.request)
 				case old > req.request:
 					s.backend.logger.Debug("Rescheduling dial or earlier time", "contact", uid, "old", old, "new", req.request)
-					schedule[nextDial] = time.Now().Add(req.request)
+					schedule[uid] = s.clock.Now().Add(req.request)
 				default:
 					s.backend.logger.Trace("Reschedule to later time ignored", "contact", uid, "old", old, "new", req.request)
 				}
@@ -163,25 +250,141 @@ func (s *scheduler) loop() {
 				s.backend.logger.Warn("Scheduler triggered without overlay")
 				continue
 			}
+			if info, err := s.backend.Contact(nextDial); err == nil && info.Blocked {
+				s.backend.logger.Debug("Skipping dial for blocked contact", "contact", nextDial)
+				schedule[nextDial] = s.clock.Now().Add(schedulerSanityRedial)
+				continue
+			}
 			s.backend.logger.Debug("Scheduling dial for contact", "contact", nextDial)
-			if _, err := overlay.Dial(context.TODO(), nextDial); err != nil {
-				s.backend.logger.Error("Dial request failed", "contact", nextDial, "schedule", schedulerFailureRedial, "err", err)
-				schedule[nextDial] = time.Now().Add(schedulerFailureRedial)
+			atomic.AddUint64(&s.dials, 1)
+
+			done, err := overlay.Dial(context.TODO(), nextDial)
+			if err != nil {
+				// Dialing failed, back off depending on how flaky the contact is
+				atomic.AddUint64(&s.failures, 1)
+				reliability[nextDial] = updateReliability(contactReliability(reliability, nextDial), false)
+				redial := failureRedial(reliability[nextDial])
+
+				s.backend.logger.Error("Dial request failed", "contact", nextDial, "schedule", redial, "reliability", reliability[nextDial], "err", err)
+				schedule[nextDial] = s.clock.Now().Add(redial)
+				failures[nextDial] = err
+				streaks[nextDial]++
 			} else {
 				// Dialing succeeded, unless someone has anything important, check back tomorrow
-				s.backend.logger.Debug("Dialing succeeded, rescheduling", "contact", nextDial, "schedule", schedulerSanityRedial)
-				schedule[nextDial] = time.Now().Add(schedulerSanityRedial)
+				reliability[nextDial] = updateReliability(contactReliability(reliability, nextDial), true)
+
+				s.backend.logger.Debug("Dialing succeeded, rescheduling", "contact", nextDial, "schedule", schedulerSanityRedial, "reliability", reliability[nextDial])
+				schedule[nextDial] = s.clock.Now().Add(schedulerSanityRedial)
+				delete(failures, nextDial)
+				delete(streaks, nextDial)
+
+				go s.watchHandshake(nextDial, done)
 			}
 		}
 	}
 }
 
-// broadcast tries to broadcast a message to all active peers, and for everyone
-// else it schedules a prioritized dial.
+// nextDialTarget picks the contact to dial next. If multiple contacts are already
+// overdue, the most reliable one is preferred to make the best use of the single
+// dial slot; otherwise the one scheduled the earliest is picked. If nothing is
+// scheduled, a zero time is returned.
+func nextDialTarget(schedule map[tornet.IdentityFingerprint]time.Time, reliability map[tornet.IdentityFingerprint]float64, now time.Time) (tornet.IdentityFingerprint, time.Time) {
+	var (
+		target   tornet.IdentityFingerprint
+		earliest time.Time
+	)
+	for uid, next := range schedule {
+		switch {
+		case earliest.IsZero():
+			target, earliest = uid, next
+
+		case !next.After(now) && !earliest.After(now):
+			// Both contacts overdue, prefer the more reliable, then the older
+			have, want := contactReliability(reliability, target), contactReliability(reliability, uid)
+			if want > have || (want == have && (next.Before(earliest) || (next.Equal(earliest) && uid < target))) {
+				target, earliest = uid, next
+			}
+		case next.Before(earliest) || (next.Equal(earliest) && uid < target):
+			target, earliest = uid, next
+		}
+	}
+	return target, earliest
+}
+
+// contactReliability returns the reliability score of a contact, defaulting to
+// a neutral one if the contact was never dialed.
+func contactReliability(reliability map[tornet.IdentityFingerprint]float64, uid tornet.IdentityFingerprint) float64 {
+	if score, ok := reliability[uid]; ok {
+		return score
+	}
+	return schedulerReliabilityInitial
+}
+
+// updateReliability folds the outcome of a dial into a contact's reliability
+// score, tracked as an exponential moving average.
+func updateReliability(score float64, success bool) float64 {
+	outcome := 0.0
+	if success {
+		outcome = 1.0
+	}
+	return (1-schedulerReliabilityWeight)*score + schedulerReliabilityWeight*outcome
+}
+
+// failureRedial calculates the time to wait before redialing a contact after a
+// failed dial, scaled by its reliability: a neutral contact is retried after the
+// default failure redial, while reliable and flaky ones sooner or later.
+func failureRedial(score float64) time.Duration {
+	return time.Duration(float64(schedulerFailureRedial) * math.Pow(schedulerFailureBackoff, 1-2*score))
+}
+
+// pendingBroadcast is a message waiting for the coalescing window to expire
+// before being broadcast to all contacts.
+type pendingBroadcast struct {
+	message  *corona.Envelope // Latest message of this type to broadcast
+	priority time.Duration    // Tightest dial priority requested for the message
+	timer    *time.Timer      // Timer to flush the message when the window expires
+}
+
+// broadcast schedules a message to be sent to all active peers, and for everyone
+// else it schedules a prioritized dial. Messages of the same type requested in
+// quick succession are coalesced, only the latest being sent out.
+//
+// Note, this method assumes the write lock is held.
 func (b *Backend) broadcast(message *corona.Envelope, priority time.Duration) {
+	kind := broadcastKind(message)
+
+	if pending, ok := b.broadcasts[kind]; ok {
+		b.logger.Debug("Coalescing broadcast", "kind", kind)
+		pending.message = message
+		if pending.priority > priority {
+			pending.priority = priority
+		}
+		return
+	}
+	b.broadcasts[kind] = &pendingBroadcast{
+		message:  message,
+		priority: priority,
+		timer: time.AfterFunc(broadcastCoalesceWindow, func() {
+			b.flushBroadcast(kind)
+		}),
+	}
+}
+
+// flushBroadcast sends out a pending message to all active peers, and for
+// everyone else it schedules a prioritized dial.
+func (b *Backend) flushBroadcast(kind string) {
+	b.lock.Lock()
+	pending, ok := b.broadcasts[kind]
+	if !ok {
+		b.lock.Unlock()
+		return // Backend torn down meanwhile
+	}
+	delete(b.broadcasts, kind)
+
 	// Retrieve the list of contacts to broadcast to
 	prof, err := b.Profile()
 	if err != nil {
+		b.lock.Unlock()
 		b.logger.Error("Broadcasting without profile", "err", err)
 		return
 	}
@@ -190,13 +393,27 @@ func (b *Backend) broadcast(message *corona.Envelope, priority time.Duration) {
 
 	for uid := range prof.KeyRing.Trusted {
 		if enc := b.peerset[uid]; enc != nil {
-			go enc.Encode(message)
+			go enc.Encode(pending.message)
 		} else {
 			offline = append(offline, uid)
 		}
 	}
+	b.lock.Unlock()
+
 	// If anyone was offline, schedule it to them later
 	if len(offline) > 0 {
-		b.dialer.prioritize(priority, offline)
+		b.dialer.prioritize(pending.priority, offline)
+	}
+}
+
+// broadcastKind returns the name of the message type contained within a wire
+// envelope, used to coalesce subsequent broadcasts of the same type.
+func broadcastKind(message *corona.Envelope) string {
+	envelope := reflect.ValueOf(message).Elem()
+	for i := 0; i < envelope.NumField(); i++ {
+		if !envelope.Field(i).IsNil() {
+			return envelope.Type().Field(i).Name
+		}
 	}
+	return ""
 }
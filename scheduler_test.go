@@ -0,0 +1,309 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols"
+	"github.com/coronanet/go-coronanet/protocols/corona"
+	"github.com/coronanet/go-coronanet/tornet"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Tests that multiple profile changes in quick succession are coalesced into a
+// single broadcast containing the final state.
+func TestBroadcastCoalescing(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	// Create a local profile with a single trusted contact
+	keyring, _ := tornet.GenerateKeyRing()
+	contact, _ := tornet.GenerateKeyRing()
+
+	uid := contact.Identity.Fingerprint()
+	keyring.Trusted[uid] = tornet.RemoteKeyRing{
+		Identity: contact.Identity.Public(),
+		Address:  contact.Addresses[0].Public(),
+	}
+	blob, _ := json.Marshal(&profile{KeyRing: &keyring})
+	if err := backend.database.Put(dbProfileKey, blob, nil); err != nil {
+		t.Fatalf("failed to inject profile: %v", err)
+	}
+	// Connect the contact through an in-memory pipe and collect its messages
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	sender := protocols.NewSender(gob.NewEncoder(local))
+	defer sender.Close()
+	backend.peerset[uid] = sender
+
+	messages := make(chan *corona.Envelope, 16)
+	go func() {
+		dec := gob.NewDecoder(remote)
+		for {
+			message := new(corona.Envelope)
+			if err := dec.Decode(message); err != nil {
+				return
+			}
+			messages <- message
+		}
+	}()
+	// Change multiple profile fields in rapid succession
+	if err := backend.UpdateProfile("Alice"); err != nil {
+		t.Fatalf("failed to update profile name: %v", err)
+	}
+	if err := backend.UploadProfilePicture([]byte{0xde, 0xad, 0xbe, 0xef}); err != nil {
+		t.Fatalf("failed to upload profile picture: %v", err)
+	}
+	prof, err := backend.Profile()
+	if err != nil {
+		t.Fatalf("failed to retrieve profile: %v", err)
+	}
+	// Ensure a single broadcast arrives with the final state
+	select {
+	case message := <-messages:
+		if message.Profile == nil {
+			t.Fatalf("unexpected message: %+v", message)
+		}
+		if message.Profile.Name != prof.Name {
+			t.Errorf("broadcast name mismatch: have %v, want %v", message.Profile.Name, prof.Name)
+		}
+		if message.Profile.Avatar != prof.Avatar {
+			t.Errorf("broadcast avatar mismatch: have %x, want %x", message.Profile.Avatar, prof.Avatar)
+		}
+	case <-time.After(4 * broadcastCoalesceWindow):
+		t.Fatalf("broadcast timed out")
+	}
+	select {
+	case message := <-messages:
+		t.Fatalf("unexpected second broadcast: %+v", message)
+	case <-time.After(4 * broadcastCoalesceWindow):
+	}
+}
+
+// Tests that a consistently failing contact gets progressively deprioritized
+// relative to a reliable one, both in backoff and in dial ordering.
+func TestSchedulerReliability(t *testing.T) {
+	var (
+		reliable tornet.IdentityFingerprint = "reliable"
+		failing  tornet.IdentityFingerprint = "failing"
+
+		reliability = make(map[tornet.IdentityFingerprint]float64)
+		backoff     = schedulerFailureRedial
+	)
+	for i := 0; i < 10; i++ {
+		reliability[reliable] = updateReliability(contactReliability(reliability, reliable), true)
+		reliability[failing] = updateReliability(contactReliability(reliability, failing), false)
+
+		redial := failureRedial(reliability[failing])
+		if redial <= backoff {
+			t.Fatalf("round %d: failing backoff not increased: have %v, previous %v", i, redial, backoff)
+		}
+		backoff = redial
+
+		if prompt := failureRedial(reliability[reliable]); prompt >= schedulerFailureRedial {
+			t.Fatalf("round %d: reliable backoff not decreased: have %v, want < %v", i, prompt, schedulerFailureRedial)
+		}
+	}
+	if limit := time.Duration(float64(schedulerFailureRedial) * schedulerFailureBackoff); backoff > limit {
+		t.Fatalf("failing backoff exceeded limit: have %v, want <= %v", backoff, limit)
+	}
+	// If both contacts are overdue, the reliable one should be dialed first, even
+	// if the failing one was scheduled earlier
+	now := time.Now()
+	schedule := map[tornet.IdentityFingerprint]time.Time{
+		reliable: now.Add(-time.Minute),
+		failing:  now.Add(-time.Hour),
+	}
+	if uid, _ := nextDialTarget(schedule, reliability, now); uid != reliable {
+		t.Fatalf("overdue dial target mismatch: have %s, want %s", uid, reliable)
+	}
+	// If neither is overdue, the earliest schedule should be respected
+	schedule = map[tornet.IdentityFingerprint]time.Time{
+		reliable: now.Add(time.Hour),
+		failing:  now.Add(time.Minute),
+	}
+	if uid, _ := nextDialTarget(schedule, reliability, now); uid != failing {
+		t.Fatalf("future dial target mismatch: have %s, want %s", uid, failing)
+	}
+}
+
+// Tests that the scheduler runs off of the injected clock, rescheduling dials on
+// prioritization requests and backing off on failures in simulated time.
+func TestSchedulerSimulatedClock(t *testing.T) {
+	start := time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC)
+	clock := tornet.NewSimulatedClock(start)
+
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	backend.config.Clock = clock
+
+	// Create a local user with a single unreachable contact
+	keyring := newTestReporter(t, backend)
+
+	remote, err := tornet.GenerateKeyRing()
+	if err != nil {
+		t.Fatalf("failed to generate remote keyring: %v", err)
+	}
+	uid := remote.Identity.Fingerprint()
+	keyring.Trusted[uid] = tornet.RemoteKeyRing{
+		Identity: remote.Identity.Public(),
+		Address:  remote.Addresses[0].Public(),
+	}
+	blob, err := json.Marshal(&profile{KeyRing: &keyring})
+	if err != nil {
+		t.Fatalf("failed to marshal profile: %v", err)
+	}
+	if err := backend.database.Put(dbProfileKey, blob, nil); err != nil {
+		t.Fatalf("failed to store profile: %v", err)
+	}
+	startTestOverlay(t, backend, tornet.NewMockGateway())
+	defer backend.overlay.Close()
+	defer backend.dialer.close()
+
+	// Waits until the contact is scheduled for the given time
+	wait := func(want time.Time) {
+		var status *schedulerStatus
+		for i := 0; i < 1000; i++ {
+			if status = backend.dialer.statuses()[uid]; status != nil && status.next.Equal(want) {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("schedule mismatch: have %+v, want %v", status, want)
+	}
+	// Schedule the contact, which should fail immediately and back off
+	backend.dialer.reinit(keyring)
+
+	score := updateReliability(schedulerReliabilityInitial, false)
+	wait(start.Add(failureRedial(score)))
+
+	// Prioritize the contact and ensure the schedule is shortened, but not extended
+	backend.dialer.prioritize(time.Minute, []tornet.IdentityFingerprint{uid})
+	wait(start.Add(time.Minute))
+
+	backend.dialer.prioritize(schedulerSanityRedial, []tornet.IdentityFingerprint{uid})
+	wait(start.Add(time.Minute))
+
+	// Advance time until the prioritized dial and ensure it backs off further
+	clock.Run(time.Minute)
+
+	score = updateReliability(score, false)
+	wait(start.Add(time.Minute).Add(failureRedial(score)))
+}
+
+// Tests that a freshly added contact is dialed right away, even if the scheduler
+// timer is parked far in the future for an unreachable contact.
+func TestSchedulerNewContactFastPath(t *testing.T) {
+	start := time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC)
+	clock := tornet.NewSimulatedClock(start)
+
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	backend.config.Clock = clock
+
+	// Create a local user with a single unreachable contact
+	keyring := newTestReporter(t, backend)
+
+	parked, err := tornet.GenerateKeyRing()
+	if err != nil {
+		t.Fatalf("failed to generate parked keyring: %v", err)
+	}
+	keyring.Trusted[parked.Identity.Fingerprint()] = tornet.RemoteKeyRing{
+		Identity: parked.Identity.Public(),
+		Address:  parked.Addresses[0].Public(),
+	}
+	blob, err := json.Marshal(&profile{KeyRing: &keyring})
+	if err != nil {
+		t.Fatalf("failed to marshal profile: %v", err)
+	}
+	if err := backend.database.Put(dbProfileKey, blob, nil); err != nil {
+		t.Fatalf("failed to store profile: %v", err)
+	}
+	gateway := tornet.NewMockGateway()
+
+	startTestOverlay(t, backend, gateway)
+	defer backend.overlay.Close()
+	defer backend.dialer.close()
+
+	// Let the unreachable contact fail and park the dial timer in the future
+	backend.dialer.reinit(keyring)
+
+	parkedAt := start.Add(failureRedial(updateReliability(schedulerReliabilityInitial, false)))
+	for i := 0; ; i++ {
+		if status := backend.dialer.statuses()[parked.Identity.Fingerprint()]; status != nil && status.next.Equal(parkedAt) {
+			break
+		}
+		if i == 1000 {
+			t.Fatalf("unreachable contact not parked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Start up a reachable remote peer and add it as a new contact without ever
+	// advancing the clock
+	remote, err := tornet.GenerateKeyRing()
+	if err != nil {
+		t.Fatalf("failed to generate remote keyring: %v", err)
+	}
+	connected := make(chan tornet.IdentityFingerprint, 1)
+	peers := tornet.NewPeerSet(tornet.PeerSetConfig{
+		Trusted: []tornet.PublicIdentity{keyring.Identity.Public()},
+		Handler: func(uid tornet.IdentityFingerprint, conn net.Conn, logger log.Logger) {
+			select {
+			case connected <- uid:
+			default:
+			}
+		},
+	})
+	defer peers.Close()
+
+	server, err := tornet.NewServer(tornet.ServerConfig{
+		Gateway:  gateway,
+		Address:  remote.Addresses[0],
+		Identity: remote.Identity,
+		PeerSet:  peers,
+	})
+	if err != nil {
+		t.Fatalf("failed to launch remote server: %v", err)
+	}
+	defer server.Close()
+
+	if _, err := backend.AddContact(tornet.RemoteKeyRing{
+		Identity: remote.Identity.Public(),
+		Address:  remote.Addresses[0].Public(),
+	}); err != nil {
+		t.Fatalf("failed to add contact: %v", err)
+	}
+	select {
+	case uid := <-connected:
+		if uid != keyring.Identity.Fingerprint() {
+			t.Fatalf("connected peer mismatch: have %s, want %s", uid, keyring.Identity.Fingerprint())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("new contact not dialed")
+	}
+	// The unreachable contact should remain parked
+	if status := backend.dialer.statuses()[parked.Identity.Fingerprint()]; status == nil || !status.next.Equal(parkedAt) {
+		t.Fatalf("parked schedule mismatch: have %+v, want %v", status, parkedAt)
+	}
+	// Prioritize both contacts in a single batch and ensure each gets rescheduled
+	// on its own, not whichever was picked for the next dial
+	contacts := []tornet.IdentityFingerprint{parked.Identity.Fingerprint(), remote.Identity.Fingerprint()}
+	backend.dialer.prioritize(time.Minute, contacts)
+
+	statuses := backend.dialer.statuses()
+	for _, uid := range contacts {
+		if status := statuses[uid]; status == nil || !status.next.Equal(start.Add(time.Minute)) {
+			t.Fatalf("prioritized schedule mismatch for %s: have %+v, want %v", uid, status, start.Add(time.Minute))
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/json"
+
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// StorageBreakdown is the number of bytes used up in the database by the various
+// entities maintained by the backend. Images are content addressed in the CDN,
+// so the avatar and banner fields are the attributed subsets of the CDN total.
+type StorageBreakdown struct {
+	Profile  uint64 `json:"profile"`  // Local user's profile and keyring
+	Contacts uint64 `json:"contacts"` // Remote contacts' metadata
+	Avatars  uint64 `json:"avatars"`  // Remote contacts' profile pictures
+	Messages uint64 `json:"messages"` // Text messages exchanged with contacts (and queued ones)
+	Hosted   uint64 `json:"hosted"`   // Locally hosted events' metadata and stats history
+	Joined   uint64 `json:"joined"`   // Remotely joined events' metadata
+	Banners  uint64 `json:"banners"`  // Hosted and joined events' banner pictures
+	CDN      uint64 `json:"cdn"`      // All images in the CDN (including the above)
+	Total    uint64 `json:"total"`    // Entire database usage
+}
+
+// StorageBreakdown calculates the number of bytes used up by the various data
+// entities in the database. The sizes are exact key and value sums, not the on
+// disk footprint which depends on compression and compaction.
+func (b *Backend) StorageBreakdown() StorageBreakdown {
+	var breakdown StorageBreakdown
+
+	// Sum up the plain metadata entities
+	if blob, err := b.database.Get(dbProfileKey, nil); err == nil {
+		breakdown.Profile = uint64(len(dbProfileKey) + len(blob))
+	}
+	breakdown.Messages = b.storageUsage(dbMessagePrefix) + b.storageUsage(dbOutboxPrefix)
+	breakdown.CDN = b.storageUsage(dbCDNImagePrefix)
+	breakdown.Hosted = b.storageUsage(dbHostedHistoryPrefix)
+	breakdown.Total = b.storageUsage(nil)
+
+	// Sum up the contacts and attribute their avatars from the CDN
+	avatars := make(map[[32]byte]struct{})
+
+	it := b.database.NewIterator(util.BytesPrefix(dbContactPrefix), nil)
+	for it.Next() {
+		breakdown.Contacts += uint64(len(it.Key()) + len(it.Value()))
+
+		info := new(contact)
+		if err := json.Unmarshal(it.Value(), info); err == nil && info.Avatar != [32]byte{} {
+			avatars[info.Avatar] = struct{}{}
+		}
+	}
+	it.Release()
+
+	for hash := range avatars {
+		breakdown.Avatars += b.cdnImageUsage(hash)
+	}
+	// Sum up the events and attribute their banners from the CDN
+	banners := make(map[[32]byte]struct{})
+
+	it = b.database.NewIterator(util.BytesPrefix(dbHostedEventPrefix), nil)
+	for it.Next() {
+		breakdown.Hosted += uint64(len(it.Key()) + len(it.Value()))
+
+		infos := new(events.ServerInfos)
+		if blob, err := b.openSecret(it.Value()); err == nil {
+			if err := json.Unmarshal(blob, infos); err == nil && infos.Banner != [32]byte{} {
+				banners[infos.Banner] = struct{}{}
+			}
+		}
+	}
+	it.Release()
+
+	it = b.database.NewIterator(util.BytesPrefix(dbJoinedEventPrefix), nil)
+	for it.Next() {
+		breakdown.Joined += uint64(len(it.Key()) + len(it.Value()))
+
+		infos := new(events.ClientInfos)
+		if blob, err := b.openSecret(it.Value()); err == nil {
+			if err := json.Unmarshal(blob, infos); err == nil && infos.Banner != [32]byte{} {
+				banners[infos.Banner] = struct{}{}
+			}
+		}
+	}
+	it.Release()
+
+	for hash := range banners {
+		breakdown.Banners += b.cdnImageUsage(hash)
+	}
+	return breakdown
+}
+
+// storageUsage sums up the key and value sizes of all database entries with the
+// given prefix (nil for the entire database).
+func (b *Backend) storageUsage(prefix []byte) uint64 {
+	var size uint64
+
+	it := b.database.NewIterator(util.BytesPrefix(prefix), nil)
+	defer it.Release()
+
+	for it.Next() {
+		size += uint64(len(it.Key()) + len(it.Value()))
+	}
+	return size
+}
+
+// cdnImageUsage sums up the storage size of a single image in the CDN, including
+// its reference count metadata.
+func (b *Backend) cdnImageUsage(hash [32]byte) uint64 {
+	key := append(append([]byte{}, dbCDNImagePrefix...), hash[:]...)
+	return b.storageUsage(key)
+}
@@ -0,0 +1,81 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/coronanet/go-coronanet/protocols/events"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that the storage breakdown attributes the database contents to the
+// correct entity types.
+func TestStorageBreakdown(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	// Insert a profile and a contact with an avatar
+	if err := backend.database.Put(dbProfileKey, make([]byte, 100), nil); err != nil {
+		t.Fatalf("failed to store profile: %v", err)
+	}
+	avatar := make([]byte, 1000)
+	rand.Read(avatar) // Incompressible
+	hash, err := backend.uploadCDNImage(avatar)
+	if err != nil {
+		t.Fatalf("failed to upload avatar: %v", err)
+	}
+	blob, _ := json.Marshal(&contact{Name: "Bob", Avatar: hash})
+	if err := backend.database.Put(append(append([]byte{}, dbContactPrefix...), "bob"...), blob, nil); err != nil {
+		t.Fatalf("failed to store contact: %v", err)
+	}
+	// Insert a joined event with a banner
+	banner := make([]byte, 2000)
+	rand.Read(banner)
+	bhash, err := backend.uploadCDNImage(banner)
+	if err != nil {
+		t.Fatalf("failed to upload banner: %v", err)
+	}
+	blob, _ = json.Marshal(&events.ClientInfos{Name: "Barbecue", Banner: bhash})
+	if err := backend.database.Put(append(append([]byte{}, dbJoinedEventPrefix...), "barbecue"...), blob, nil); err != nil {
+		t.Fatalf("failed to store joined event: %v", err)
+	}
+	// Insert a message and an image not referenced by anyone
+	if err := backend.storeMessage(tornet.IdentityFingerprint("bob"), &Message{Text: "Hello"}, nil); err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+	if _, err := backend.uploadCDNImage(make([]byte, 500)); err != nil {
+		t.Fatalf("failed to upload orphan image: %v", err)
+	}
+	// Ensure the breakdown roughly matches the inserted data
+	breakdown := backend.StorageBreakdown()
+
+	if breakdown.Profile < 100 || breakdown.Profile > 200 {
+		t.Errorf("profile size mismatch: have %d, want ~%d", breakdown.Profile, 100)
+	}
+	if breakdown.Contacts == 0 || breakdown.Contacts > 200 {
+		t.Errorf("contacts size mismatch: have %d, want ~%d", breakdown.Contacts, len(blob))
+	}
+	if breakdown.Avatars < 1000 || breakdown.Avatars > 1100 {
+		t.Errorf("avatars size mismatch: have %d, want ~%d", breakdown.Avatars, 1000)
+	}
+	if breakdown.Banners < 2000 || breakdown.Banners > 2100 {
+		t.Errorf("banners size mismatch: have %d, want ~%d", breakdown.Banners, 2000)
+	}
+	if breakdown.Joined == 0 || breakdown.Hosted != 0 {
+		t.Errorf("event sizes mismatch: have hosted %d, joined %d", breakdown.Hosted, breakdown.Joined)
+	}
+	if breakdown.Messages == 0 {
+		t.Errorf("messages size missing")
+	}
+	if breakdown.CDN <= breakdown.Avatars+breakdown.Banners {
+		t.Errorf("cdn size doesn't include orphan: have %d, attributed %d", breakdown.CDN, breakdown.Avatars+breakdown.Banners)
+	}
+	sum := breakdown.Profile + breakdown.Contacts + breakdown.Messages + breakdown.Hosted + breakdown.Joined + breakdown.CDN
+	if breakdown.Total != sum {
+		t.Errorf("total size mismatch: have %d, want %d", breakdown.Total, sum)
+	}
+}
@@ -0,0 +1,172 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// supervisor is a background health monitor that periodically probes a service
+// and restarts it if it's persistently failing. Consecutive restarts are backed
+// off exponentially to avoid restart loops if the failure is external (e.g. no
+// internet connectivity at all).
+type supervisor struct {
+	check   func() error // Health probe, returning an error if the service is broken
+	restart func() error // Recovery procedure to rebuild the service from scratch
+
+	interval   time.Duration // Time between two consecutive health probes
+	threshold  int           // Number of consecutive failed probes to trigger a restart
+	backoff    time.Duration // Minimum time to wait between two restarts
+	maxBackoff time.Duration // Maximum time to wait between two restarts
+
+	quit   chan chan struct{} // Quit channel to tear down the supervisor
+	logger log.Logger         // Contextual logger to embed outside tags
+}
+
+// newSupervisor creates a health monitor with the given probe and recovery
+// methods, and starts it.
+func newSupervisor(check func() error, restart func() error, interval time.Duration, threshold int, backoff time.Duration, maxBackoff time.Duration, logger log.Logger) *supervisor {
+	s := &supervisor{
+		check:      check,
+		restart:    restart,
+		interval:   interval,
+		threshold:  threshold,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		quit:       make(chan chan struct{}),
+		logger:     logger,
+	}
+	go s.loop()
+	return s
+}
+
+// close terminates the health monitor, waiting for any restart in progress.
+func (s *supervisor) close() {
+	quit := make(chan struct{})
+	s.quit <- quit
+	<-quit
+}
+
+// loop periodically probes the supervised service and restarts it if enough
+// consecutive probes fail and the restart backoff permits.
+func (s *supervisor) loop() {
+	timer := time.NewTimer(s.interval)
+	defer timer.Stop()
+
+	var (
+		failures int         // Number of consecutive failed probes
+		delay    = s.backoff // Backoff to enforce after the next restart
+		blocked  time.Time   // Time until which restarts are suppressed
+	)
+	for {
+		select {
+		case quit := <-s.quit:
+			close(quit)
+			return
+		case <-timer.C:
+		}
+		// Probe the service and reset the backoff if it's been fine long enough
+		if err := s.check(); err == nil {
+			if failures > 0 {
+				s.logger.Info("Supervised service recovered", "failures", failures)
+			}
+			failures = 0
+			if time.Now().After(blocked) {
+				delay = s.backoff
+			}
+			timer.Reset(s.interval)
+			continue
+		} else {
+			failures++
+			s.logger.Warn("Supervised service unhealthy", "failures", failures, "err", err)
+		}
+		// Service failing, restart it if it's been broken for long enough
+		if failures >= s.threshold && !time.Now().Before(blocked) {
+			s.logger.Warn("Restarting supervised service", "failures", failures)
+			if err := s.restart(); err != nil {
+				s.logger.Error("Failed to restart supervised service", "backoff", delay, "err", err)
+			} else {
+				failures = 0
+			}
+			blocked = time.Now().Add(delay)
+			if delay *= 2; delay > s.maxBackoff {
+				delay = s.maxBackoff
+			}
+		}
+		timer.Reset(s.interval)
+	}
+}
+
+// errNoCircuits is returned by the gateway health probe if Tor is running, but
+// it could not build any circuits.
+var errNoCircuits = errors.New("no circuits established")
+
+// checkGateway probes the Tor process through its control port, reporting an
+// error if it's dead or can't build circuits. If networking is disabled by the
+// user, the gateway is reported healthy, since no circuits are expected.
+func (b *Backend) checkGateway() error {
+	b.lock.RLock()
+	network, enabled := b.network, b.enabled
+	b.lock.RUnlock()
+
+	if network == nil || !enabled {
+		return nil
+	}
+	res, err := network.Control.GetInfo("status/circuit-established")
+	if err != nil {
+		return err
+	}
+	if len(res) == 0 || res[0].Val != "1" {
+		return errNoCircuits
+	}
+	return nil
+}
+
+// restartGateway tears down the Tor process along with all the networking built
+// on top, and recreates everything from scratch.
+func (b *Backend) restartGateway() error {
+	b.logger.Warn("Restarting Tor gateway")
+
+	b.lock.Lock()
+	// Tear down the overlay and the dead Tor process
+	b.nukeOverlay()
+	b.network.Close()
+
+	// Start a fresh Tor process, reenabling networking if it was on before. If
+	// anything fails, keep the dead process around, the next attempt will nuke
+	// it again.
+	network, err := startTor(b.datadir, b.config)
+	if err != nil {
+		b.lock.Unlock()
+		return err
+	}
+	b.network = network
+
+	if b.enabled {
+		if err := network.EnableNetwork(nil, false); err != nil {
+			b.lock.Unlock()
+			return err
+		}
+	}
+	// Gateway restarted, rebuild the overlay if there's a user profile
+	prof, err := b.Profile()
+	if err == nil {
+		if err := b.initOverlay(*prof.KeyRing); err != nil {
+			b.lock.Unlock()
+			return err
+		}
+	}
+	enabled := b.enabled
+	b.lock.Unlock()
+
+	// Networking rebuilt, resume dialing contacts if enabled
+	if prof != nil && enabled {
+		b.dialer.reinit(*prof.KeyRing)
+	}
+	b.feed.publish(Event{Kind: EventGatewayRestarted, Message: "Tor gateway restarted after persistent failures"})
+	return nil
+}
@@ -0,0 +1,110 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// testGateway is a fake supervised service that can be killed and revived.
+type testGateway struct {
+	dead     bool // Whether the gateway is currently dead
+	broken   bool // Whether restarts should fail to revive the gateway
+	restarts int  // Number of restarts requested by the supervisor
+	lock     sync.Mutex
+}
+
+func (g *testGateway) check() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.dead {
+		return errors.New("gateway dead")
+	}
+	return nil
+}
+
+func (g *testGateway) restart() error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.restarts++
+	if g.broken {
+		return errors.New("gateway broken")
+	}
+	g.dead = false
+	return nil
+}
+
+func (g *testGateway) kill(broken bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.dead, g.broken = true, broken
+}
+
+func (g *testGateway) status() (bool, int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.dead, g.restarts
+}
+
+// Tests that the supervisor restarts a killed gateway after enough consecutive
+// failed health checks, restoring connectivity.
+func TestSupervisorRecovery(t *testing.T) {
+	gateway := new(testGateway)
+
+	sup := newSupervisor(gateway.check, gateway.restart, 10*time.Millisecond, 3, time.Millisecond, time.Millisecond, log.Root())
+	defer sup.close()
+
+	// Ensure a healthy gateway is left alone
+	time.Sleep(100 * time.Millisecond)
+	if _, restarts := gateway.status(); restarts != 0 {
+		t.Fatalf("healthy gateway restarts mismatch: have %d, want %d", restarts, 0)
+	}
+	// Kill the gateway and ensure it gets restarted
+	gateway.kill(false)
+	for i := 0; i < 100; i++ {
+		if dead, _ := gateway.status(); !dead {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dead, restarts := gateway.status()
+	if dead {
+		t.Fatalf("gateway not recovered")
+	}
+	if restarts != 1 {
+		t.Fatalf("recovery restarts mismatch: have %d, want %d", restarts, 1)
+	}
+	// Ensure a recovered gateway is left alone
+	time.Sleep(100 * time.Millisecond)
+	if _, restarts := gateway.status(); restarts != 1 {
+		t.Fatalf("recovered gateway restarts mismatch: have %d, want %d", restarts, 1)
+	}
+}
+
+// Tests that the supervisor backs off restarting a gateway that cannot recover,
+// instead of getting stuck in a restart loop.
+func TestSupervisorBackoff(t *testing.T) {
+	gateway := new(testGateway)
+	gateway.kill(true)
+
+	sup := newSupervisor(gateway.check, gateway.restart, 10*time.Millisecond, 1, 200*time.Millisecond, time.Hour, log.Root())
+
+	// Without backoff, the supervisor would restart every 10ms. With the 200ms
+	// initial backoff doubling, it should fit at most 3 attempts into 500ms.
+	time.Sleep(500 * time.Millisecond)
+	sup.close()
+
+	if _, restarts := gateway.status(); restarts < 1 || restarts > 3 {
+		t.Fatalf("restart count mismatch: have %d, want [1, 3]", restarts)
+	}
+}
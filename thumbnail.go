@@ -0,0 +1,140 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png" // Register the PNG decoder for thumbnailing
+)
+
+// errThumbnailTooLarge is returned if a thumbnail is attempted to be generated
+// from an image with too many pixels.
+var errThumbnailTooLarge = errors.New("image too large to thumbnail")
+
+// uploadCDNPicture inserts a binary image blob by hash into the CDN, increments
+// its reference count and generates a thumbnail for it if it doesn't yet have
+// one. If the blob is not a decodable image, it is stored without a thumbnail.
+//
+// Note, this method assumes the write lock is held.
+func (b *Backend) uploadCDNPicture(data []byte) ([32]byte, error) {
+	hash, err := b.uploadCDNImage(data)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	key := append(append(append([]byte{}, dbCDNImagePrefix...), hash[:]...), dbCDNImageThumbSuffix...)
+	if ok, _ := b.database.Has(key, nil); ok {
+		return hash, nil
+	}
+	thumb, err := makeThumbnail(data)
+	if err != nil {
+		b.logger.Debug("Skipping image thumbnail", "hash", hex.EncodeToString(hash[:]), "err", err)
+		return hash, nil
+	}
+	return hash, b.database.Put(key, thumb, nil)
+}
+
+// CDNThumbnail retrieves the thumbnail of an image from the CDN. If the image
+// predates thumbnail generation, one is created on the fly (but not stored).
+func (b *Backend) CDNThumbnail(hash [32]byte) ([]byte, error) {
+	thumb, err := b.database.Get(append(append(append([]byte{}, dbCDNImagePrefix...), hash[:]...), dbCDNImageThumbSuffix...), nil)
+	if err == nil {
+		return thumb, nil
+	}
+	data, err := b.CDNImage(hash)
+	if err != nil {
+		return nil, ErrImageNotFound
+	}
+	if thumb, err = makeThumbnail(data); err != nil {
+		return nil, ErrImageNotFound
+	}
+	return thumb, nil
+}
+
+// makePlaceholder creates a tiny blank JPEG image to stand in for pictures that
+// are referenced, but cannot be loaded any more.
+func makePlaceholder() []byte {
+	img := image.NewGray(image.Rect(0, 0, 1, 1))
+	img.SetGray(0, 0, color.Gray{Y: 0xc0})
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		panic(err) // Encoding an in-memory image cannot fail
+	}
+	return buf.Bytes()
+}
+
+// makeThumbnail decodes a JPEG or PNG image, downscales it to fit within the
+// thumbnail size (box filtering the source pixels) and reencodes it as a JPEG.
+// Any transparency is flattened onto a white background.
+func makeThumbnail(data []byte) ([]byte, error) {
+	// Reject anything that's not an image or would take too much memory
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > cdnThumbnailMaxPixels {
+		return nil, errThumbnailTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	// Calculate the thumbnail dimensions, retaining the aspect ratio
+	var (
+		bounds = img.Bounds()
+		width  = bounds.Dx()
+		height = bounds.Dy()
+	)
+	if width == 0 || height == 0 {
+		return nil, image.ErrFormat
+	}
+	thumbWidth, thumbHeight := width, height
+	switch {
+	case width >= height && width > cdnThumbnailSize:
+		thumbWidth, thumbHeight = cdnThumbnailSize, height*cdnThumbnailSize/width
+	case height > width && height > cdnThumbnailSize:
+		thumbWidth, thumbHeight = width*cdnThumbnailSize/height, cdnThumbnailSize
+	}
+	if thumbWidth == 0 {
+		thumbWidth = 1
+	}
+	if thumbHeight == 0 {
+		thumbHeight = 1
+	}
+	// Average every source pixel block into a thumbnail pixel
+	thumb := image.NewRGBA64(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for y := 0; y < thumbHeight; y++ {
+		y0, y1 := bounds.Min.Y+y*height/thumbHeight, bounds.Min.Y+(y+1)*height/thumbHeight
+		for x := 0; x < thumbWidth; x++ {
+			x0, x1 := bounds.Min.X+x*width/thumbWidth, bounds.Min.X+(x+1)*width/thumbWidth
+
+			var red, green, blue, pixels uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					r, g, b, a := img.At(sx, sy).RGBA()
+					red += uint64(r + 0xffff - a)
+					green += uint64(g + 0xffff - a)
+					blue += uint64(b + 0xffff - a)
+					pixels++
+				}
+			}
+			thumb.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(red / pixels),
+				G: uint16(green / pixels),
+				B: uint16(blue / pixels),
+				A: 0xffff,
+			})
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, thumb, &jpeg.Options{Quality: cdnThumbnailQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,80 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package tornet
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	// defaultBackoffMin is the delay to wait before redialing a peer after the
+	// first failed attempt, if not configured otherwise.
+	defaultBackoffMin = 250 * time.Millisecond
+
+	// defaultBackoffMax is the maximum delay to wait before redialing a peer,
+	// if not configured otherwise.
+	defaultBackoffMax = 5 * time.Minute
+
+	// defaultBackoffFactor is the multiplier to apply to the redial delay after
+	// each consecutive failure, if not configured otherwise.
+	defaultBackoffFactor = 2.0
+)
+
+// BackoffConfig can be used to fine tune how aggressively a node redials peers
+// that failed to connect. Any zero fields fall back to the defaults.
+type BackoffConfig struct {
+	Min    time.Duration // Delay to wait after the first failure
+	Max    time.Duration // Maximum delay to wait between attempts
+	Factor float64       // Multiplier to apply after each consecutive failure
+	Jitter float64       // Fraction (0-1) to randomly spread the delay with
+}
+
+// withDefaults returns a copy of the config with the unset fields defaulted.
+func (c BackoffConfig) withDefaults() BackoffConfig {
+	if c.Min == 0 {
+		c.Min = defaultBackoffMin
+	}
+	if c.Max == 0 {
+		c.Max = defaultBackoffMax
+	}
+	if c.Max < c.Min {
+		c.Max = c.Min
+	}
+	if c.Factor < 1 {
+		c.Factor = defaultBackoffFactor
+	}
+	if c.Jitter < 0 {
+		c.Jitter = 0
+	}
+	if c.Jitter > 1 {
+		c.Jitter = 1
+	}
+	return c
+}
+
+// Delay calculates the time to wait before redialing after the given number of
+// consecutive failures. The jitter is applied on top of the capped delay, so
+// that peers dropped at the same time don't all redial in lockstep.
+func (c BackoffConfig) Delay(failures int) time.Duration {
+	c = c.withDefaults()
+	if failures <= 0 {
+		return 0
+	}
+	delay := float64(c.Min) * math.Pow(c.Factor, float64(failures-1))
+	if delay > float64(c.Max) {
+		delay = float64(c.Max)
+	}
+	if c.Jitter > 0 {
+		delay *= 1 + c.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay)
+}
+
+// dialBackoff tracks the consecutive dial failures towards a single peer.
+type dialBackoff struct {
+	failures int       // Number of consecutive failed dials
+	next     time.Time // Earliest time the peer may be redialed
+}
@@ -0,0 +1,115 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package tornet
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Tests that the backoff delays grow exponentially up to the cap, falling back to
+// the defaults for unset fields.
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		config   BackoffConfig
+		failures int
+		delay    time.Duration
+	}{
+		{BackoffConfig{}, 0, 0},
+		{BackoffConfig{}, 1, defaultBackoffMin},
+		{BackoffConfig{}, 2, 2 * defaultBackoffMin},
+		{BackoffConfig{}, 5, 16 * defaultBackoffMin},
+		{BackoffConfig{}, 100, defaultBackoffMax},
+		{BackoffConfig{Min: time.Second, Max: 10 * time.Second, Factor: 3}, 1, time.Second},
+		{BackoffConfig{Min: time.Second, Max: 10 * time.Second, Factor: 3}, 2, 3 * time.Second},
+		{BackoffConfig{Min: time.Second, Max: 10 * time.Second, Factor: 3}, 3, 9 * time.Second},
+		{BackoffConfig{Min: time.Second, Max: 10 * time.Second, Factor: 3}, 4, 10 * time.Second},
+	}
+	for i, tt := range tests {
+		if delay := tt.config.Delay(tt.failures); delay != tt.delay {
+			t.Errorf("test %d: delay mismatch: have %v, want %v", i, delay, tt.delay)
+		}
+	}
+}
+
+// Tests that jittered backoff delays are spread within the requested bounds.
+func TestBackoffJitter(t *testing.T) {
+	config := BackoffConfig{Min: time.Second, Max: time.Minute, Jitter: 0.2}
+
+	var low, high bool
+	for i := 0; i < 1000; i++ {
+		delay := config.Delay(3)
+		if delay < 3200*time.Millisecond || delay > 4800*time.Millisecond {
+			t.Fatalf("jittered delay out of bounds: have %v, want 3.2s-4.8s", delay)
+		}
+		low = low || delay < 4*time.Second
+		high = high || delay > 4*time.Second
+	}
+	if !low || !high {
+		t.Fatalf("jitter not spread: below %v, above %v", low, high)
+	}
+}
+
+// Tests that a node refuses to redial an unreachable peer until the backoff
+// expires, and that trust changes reset it.
+func TestNodeDialBackoff(t *testing.T) {
+	// Create a node trusting a peer that is not online
+	keyring, _ := GenerateKeyRing()
+	remote, _ := GenerateKeyRing()
+
+	keyring.Trusted[remote.Identity.Fingerprint()] = RemoteKeyRing{
+		Identity: remote.Identity.Public(),
+		Address:  remote.Addresses[0].Public(),
+	}
+	keyring.Accesses[keyring.Addresses[0].Fingerprint()][remote.Identity.Fingerprint()] = struct{}{}
+
+	node, err := NewNode(NodeConfig{
+		Gateway:     NewMockGateway(),
+		KeyRing:     keyring,
+		RingHandler: func(keyring SecretKeyRing) {},
+		Backoff:     BackoffConfig{Min: 100 * time.Millisecond, Max: time.Second},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Close()
+
+	// Dial the peer and ensure immediate redials get rejected
+	uid := remote.Identity.Fingerprint()
+	if _, err := node.Dial(context.Background(), uid); err == nil {
+		t.Fatalf("Offline peer dialed successfully")
+	}
+	if node.backoffs[uid] == nil || node.backoffs[uid].failures != 1 {
+		t.Fatalf("Dial failure not tracked")
+	}
+	if _, err := node.Dial(context.Background(), uid); !errors.Is(err, ErrRedialBackoff) {
+		t.Fatalf("Redial error mismatch: have %v, want %v", err, ErrRedialBackoff)
+	}
+	if failures := node.backoffs[uid].failures; failures != 1 {
+		t.Fatalf("Rejected redial counted as failure: have %d, want %d", failures, 1)
+	}
+	// Wait for the backoff to expire and ensure the next failure grows it
+	time.Sleep(150 * time.Millisecond)
+	if _, err := node.Dial(context.Background(), uid); err == nil {
+		t.Fatalf("Offline peer dialed successfully")
+	}
+	if failures := node.backoffs[uid].failures; failures != 2 {
+		t.Fatalf("Backoff failure count mismatch: have %d, want %d", failures, 2)
+	}
+	if left := time.Until(node.backoffs[uid].next); left <= 100*time.Millisecond {
+		t.Fatalf("Backoff not increased: have %v, want > %v", left, 100*time.Millisecond)
+	}
+	// Untrust the peer and ensure the backoff is dropped
+	if err := node.Untrust(uid); err != nil {
+		t.Fatalf("Failed to untrust peer: %v", err)
+	}
+	if _, ok := node.backoffs[uid]; ok {
+		t.Fatalf("Backoff retained after untrust")
+	}
+	if _, err := node.Dial(context.Background(), uid); err != ErrUnknownIdentity {
+		t.Fatalf("Untrusted dial error mismatch: have %v, want %v", err, ErrUnknownIdentity)
+	}
+}
@@ -9,31 +9,68 @@ import (
 )
 
 // breaker is a net.Conn wrapper that automatically disconnect if no data exchange
-// happens for a pre-configured amount of time.
+// happens for a pre-configured amount of time, or optionally if the connection
+// exceeds a maximum lifetime irrespective of activity.
 type breaker struct {
 	net.Conn // Pass everything non-interesting through
 
-	timeout time.Duration // Duration to reset to on traffic
-	breaker *time.Timer   // Timer that will break the connection
+	timeout time.Duration // Duration to reset to on traffic (0 = never idle out)
+	idler   *time.Timer   // Timer that will break the connection if idle
+	expirer *time.Timer   // Timer that will break the connection on expiry
 }
 
-// newBreaker creates a net.Conn wrapper that breaks after a pre-configured time.
-func newBreaker(conn net.Conn, timeout time.Duration) net.Conn {
-	return &breaker{
+// newBreaker creates a net.Conn wrapper that breaks after being idle for the
+// given timeout, or after the given lifetime has passed (0 = disabled).
+func newBreaker(conn net.Conn, timeout time.Duration, lifetime time.Duration) net.Conn {
+	b := &breaker{
 		Conn:    conn,
 		timeout: timeout,
-		breaker: time.AfterFunc(timeout, func() { conn.Close() }),
 	}
+	if timeout > 0 {
+		b.idler = time.AfterFunc(timeout, func() { conn.Close() })
+	}
+	if lifetime > 0 {
+		b.expirer = time.AfterFunc(lifetime, func() { conn.Close() })
+	}
+	return b
 }
 
-// Read implements net.Conn, resetting the idle timer within the connection.
+// Read implements net.Conn, resetting the idle timer within the connection both
+// when starting to wait for data and when data arrives.
 func (b *breaker) Read(buf []byte) (int, error) {
-	b.breaker.Reset(b.timeout)
-	return b.Conn.Read(buf)
+	b.reset()
+	n, err := b.Conn.Read(buf)
+	if n > 0 {
+		b.reset()
+	}
+	return n, err
 }
 
-// Write implements net.Conn, resetting the idle timer within the connection.
+// Write implements net.Conn, resetting the idle timer within the connection both
+// when starting to send data and when data was sent.
 func (b *breaker) Write(buf []byte) (int, error) {
-	b.breaker.Reset(b.timeout)
-	return b.Conn.Write(buf)
+	b.reset()
+	n, err := b.Conn.Write(buf)
+	if n > 0 {
+		b.reset()
+	}
+	return n, err
+}
+
+// Close implements net.Conn, stopping the timers too.
+func (b *breaker) Close() error {
+	if b.idler != nil {
+		b.idler.Stop()
+	}
+	if b.expirer != nil {
+		b.expirer.Stop()
+	}
+	return b.Conn.Close()
+}
+
+// reset pushes the idle timer out, if the breaker has one.
+func (b *breaker) reset() {
+	if b.idler != nil {
+		b.idler.Reset(b.timeout)
+	}
 }
@@ -0,0 +1,72 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package tornet
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Tests that the breaker only disconnects idle connections, keeping active ones
+// alive beyond the idle timeout.
+func TestBreakerIdleReset(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn := newBreaker(local, 100*time.Millisecond, 0)
+	defer conn.Close()
+
+	// Keep exchanging data for multiple timeouts and ensure it stays alive
+	go func() {
+		for {
+			if _, err := remote.Write([]byte{0x00}); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	for time.Since(start) < 300*time.Millisecond {
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			t.Fatalf("active connection broken after %v: %v", time.Since(start), err)
+		}
+	}
+	// Stop reading and ensure the connection is broken for being idle
+	time.Sleep(200 * time.Millisecond)
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("idle connection not broken")
+	}
+}
+
+// Tests that the breaker disconnects connections exceeding their lifetime, even
+// if they are active.
+func TestBreakerLifetime(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	conn := newBreaker(local, time.Hour, 100*time.Millisecond)
+	defer conn.Close()
+
+	go func() {
+		for {
+			if _, err := remote.Write([]byte{0x00}); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	for {
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("expired connection not broken")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("connection broken before expiry: %v", elapsed)
+	}
+}
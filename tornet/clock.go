@@ -0,0 +1,205 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package tornet
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a source of time and timers. Live code should use the system clock,
+// the purpose of the interface is to allow testing scheduling logic without the
+// need to actually wait for time to pass.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer creates a timer that delivers the current time on its channel
+	// after at least the given duration.
+	NewTimer(d time.Duration) Timer
+
+	// After waits for the duration to elapse and then delivers the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Timer is a single event scheduled by a Clock, the same as a time.Timer.
+type Timer interface {
+	// C returns the channel on which the timer delivers its event.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing. It returns false if the timer has
+	// already expired or been stopped.
+	Stop() bool
+
+	// Reset changes the timer to expire after the given duration. It returns
+	// true if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// SystemClock is the clock backed by the real wall time of the system.
+var SystemClock Clock = systemClock{}
+
+// systemClock is a Clock implementation that passes everything to the standard
+// library time package.
+type systemClock struct{}
+
+// Now returns the current local time.
+func (systemClock) Now() time.Time { return time.Now() }
+
+// NewTimer creates a standard library timer.
+func (systemClock) NewTimer(d time.Duration) Timer { return &systemTimer{time.NewTimer(d)} }
+
+// After waits for the duration to elapse and then sends the time on the channel.
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// systemTimer is a Timer implementation wrapping a standard library timer.
+type systemTimer struct {
+	timer *time.Timer
+}
+
+// C returns the channel on which the timer delivers its event.
+func (t *systemTimer) C() <-chan time.Time { return t.timer.C }
+
+// Stop prevents the timer from firing.
+func (t *systemTimer) Stop() bool { return t.timer.Stop() }
+
+// Reset changes the timer to expire after the given duration.
+func (t *systemTimer) Reset(d time.Duration) bool { return t.timer.Reset(d) }
+
+// SimulatedClock is a Clock whose time only advances when explicitly requested,
+// firing any timers passed over in chronological order.
+type SimulatedClock struct {
+	now    time.Time         // Current simulated time
+	timers []*simulatedTimer // Timers created by this clock, pending or not
+	lock   sync.Mutex        // Lock protecting the time and timers
+}
+
+// NewSimulatedClock creates a simulated clock starting at the given time.
+func NewSimulatedClock(start time.Time) *SimulatedClock {
+	return &SimulatedClock{now: start}
+}
+
+// Now returns the current simulated time.
+func (c *SimulatedClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+// NewTimer creates a timer that fires when the simulated time advances by the
+// given duration.
+func (c *SimulatedClock) NewTimer(d time.Duration) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	timer := &simulatedTimer{
+		clock: c,
+		ch:    make(chan time.Time, 1),
+	}
+	c.timers = append(c.timers, timer)
+	timer.schedule(d)
+
+	return timer
+}
+
+// After waits for the simulated time to advance by the given duration and then
+// sends the time on the returned channel.
+func (c *SimulatedClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// Run advances the simulated time by the given duration, firing all the timers
+// expiring in the meantime.
+func (c *SimulatedClock) Run(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	end := c.now.Add(d)
+	for {
+		// Find the earliest pending timer expiring until the end of the run
+		var next *simulatedTimer
+		for _, timer := range c.timers {
+			if timer.pending && !timer.at.After(end) && (next == nil || timer.at.Before(next.at)) {
+				next = timer
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.at
+		next.fire()
+	}
+	c.now = end
+}
+
+// Pending returns the number of timers currently waiting to fire. It is useful
+// for tests to wait until some goroutine arms its timer before advancing time.
+func (c *SimulatedClock) Pending() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var pending int
+	for _, timer := range c.timers {
+		if timer.pending {
+			pending++
+		}
+	}
+	return pending
+}
+
+// simulatedTimer is a Timer implementation driven by a simulated clock.
+type simulatedTimer struct {
+	clock   *SimulatedClock // Clock driving the timer
+	at      time.Time       // Simulated time when the timer expires
+	pending bool            // Whether the timer is waiting to fire
+	ch      chan time.Time  // Channel to deliver the event on
+}
+
+// C returns the channel on which the timer delivers its event.
+func (t *simulatedTimer) C() <-chan time.Time { return t.ch }
+
+// Stop prevents the timer from firing.
+func (t *simulatedTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	active := t.pending
+	t.pending = false
+	return active
+}
+
+// Reset changes the timer to expire after the given duration.
+func (t *simulatedTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	active := t.pending
+	t.schedule(d)
+	return active
+}
+
+// schedule arms the timer to expire after the given duration, firing it right
+// away if the duration is not positive.
+//
+// Note, this method assumes the clock lock is held.
+func (t *simulatedTimer) schedule(d time.Duration) {
+	t.at, t.pending = t.clock.now.Add(d), true
+	if d <= 0 {
+		t.fire()
+	}
+}
+
+// fire delivers the timer's event, dropping it if a previous one is still not
+// consumed, the same as the standard library timers do.
+//
+// Note, this method assumes the clock lock is held.
+func (t *simulatedTimer) fire() {
+	t.pending = false
+	select {
+	case t.ch <- t.at:
+	default:
+	}
+}
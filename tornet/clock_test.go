@@ -0,0 +1,66 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package tornet
+
+import (
+	"testing"
+	"time"
+)
+
+// Tests that the simulated clock only advances when requested, firing timers in
+// chronological order and honoring stops and resets.
+func TestSimulatedClock(t *testing.T) {
+	start := time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewSimulatedClock(start)
+
+	// Ensure zero timers fire immediately, others wait for time to advance
+	select {
+	case <-clock.NewTimer(0).C():
+	default:
+		t.Fatalf("Zero timer didn't fire")
+	}
+	early, late := clock.NewTimer(time.Second), clock.NewTimer(time.Minute)
+	stopped := clock.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Fatalf("Pending timer reported inactive on stop")
+	}
+	if pending := clock.Pending(); pending != 2 {
+		t.Fatalf("Pending timers mismatch: have %d, want %d", pending, 2)
+	}
+	clock.Run(30 * time.Second)
+	if now := clock.Now(); !now.Equal(start.Add(30 * time.Second)) {
+		t.Fatalf("Simulated time mismatch: have %v, want %v", now, start.Add(30*time.Second))
+	}
+	select {
+	case fired := <-early.C():
+		if !fired.Equal(start.Add(time.Second)) {
+			t.Fatalf("Fire time mismatch: have %v, want %v", fired, start.Add(time.Second))
+		}
+	default:
+		t.Fatalf("Expired timer didn't fire")
+	}
+	select {
+	case <-late.C():
+		t.Fatalf("Pending timer fired early")
+	case <-stopped.C():
+		t.Fatalf("Stopped timer fired")
+	default:
+	}
+	// Reset the late timer to a later time and ensure it's respected
+	if !late.Reset(time.Hour) {
+		t.Fatalf("Pending timer reported inactive on reset")
+	}
+	clock.Run(time.Hour - time.Second)
+	select {
+	case <-late.C():
+		t.Fatalf("Reset timer fired early")
+	default:
+	}
+	clock.Run(time.Second)
+	select {
+	case <-late.C():
+	default:
+		t.Fatalf("Reset timer didn't fire")
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/cretz/bine/tor"
 	"github.com/cretz/bine/torutil"
@@ -31,12 +33,20 @@ type Gateway interface {
 // NewTorGateway creates a new live Tor proxy that passes all network communication
 // through the global public Tor network.
 func NewTorGateway(proxy *tor.Tor) Gateway {
-	return &torGateway{proxy}
+	return &torGateway{proxy: proxy}
+}
+
+// NewTorGatewayWithSocks creates a new live Tor proxy that passes all network
+// communication through the global public Tor network, dialing out via the given
+// SOCKS proxy address instead of querying it from the Tor control port.
+func NewTorGatewayWithSocks(proxy *tor.Tor, socks string) Gateway {
+	return &torGateway{proxy: proxy, socks: socks}
 }
 
 // torGateway is a live Tor proxy using the global public network.
 type torGateway struct {
 	proxy *tor.Tor
+	socks string // SOCKS proxy address to dial through (empty = query from Tor)
 }
 
 // Listen creates an onion service and local listener. The context can be nil.
@@ -46,6 +56,14 @@ func (gw *torGateway) Listen(ctx context.Context, conf *tor.ListenConf) (net.Lis
 
 // Dialer creates a new Dialer for the given configuration. Context can be nil.
 func (gw *torGateway) Dialer(ctx context.Context, conf *tor.DialConf) (proxy.Dialer, error) {
+	if gw.socks != "" && (conf == nil || conf.ProxyAddress == "") {
+		override := new(tor.DialConf)
+		if conf != nil {
+			*override = *conf
+		}
+		override.ProxyAddress = gw.socks
+		conf = override
+	}
 	return gw.proxy.Dialer(ctx, conf)
 }
 
@@ -57,11 +75,103 @@ func NewMockGateway() Gateway {
 	}
 }
 
+// MockConditions are the network characteristics a mock gateway should simulate
+// on top of its otherwise instantaneous connections.
+type MockConditions struct {
+	Latency   time.Duration // Delay to inject before every write (0 = none)
+	Bandwidth int           // Maximum bytes per second per connection (0 = unlimited)
+	DropRate  float64       // Probability of a write tearing down the connection (0 = never)
+	Seed      int64         // Seed for the drop randomness to allow reproducible runs
+}
+
+// NewMockGatewayWithConditions creates a new mock Tor gateway that short circuits
+// all network communication through local in-memory channels, but delays, rate
+// limits and drops the connections according to the requested conditions.
+func NewMockGatewayWithConditions(conds MockConditions) Gateway {
+	return &mockGateway{
+		services:   make(map[string]net.Listener),
+		conditions: &conds,
+		rand:       rand.New(rand.NewSource(conds.Seed)),
+	}
+}
+
 // mockGateway simulates a Tor gateway, but short circuits all network channels
 // locally via in-memory channels.
 type mockGateway struct {
 	services map[string]net.Listener // Listeners simulating the global Tor network
 	lock     sync.RWMutex            // Lock to make sure concurrent access works
+
+	conditions *MockConditions // Network conditions to simulate (nil = instantaneous)
+	rand       *rand.Rand      // Source of randomness for connection drops
+	randLock   sync.Mutex      // Lock protecting the non-threadsafe randomness
+}
+
+// wrap injects the simulated network conditions into a freshly established
+// connection, or returns it as is if the gateway is instantaneous.
+func (gw *mockGateway) wrap(conn net.Conn) net.Conn {
+	if gw.conditions == nil {
+		return conn
+	}
+	return &mockConditionConn{
+		Conn:    conn,
+		gateway: gw,
+		tokens:  float64(gw.conditions.Bandwidth),
+		refill:  time.Now(),
+	}
+}
+
+// drop rolls the dice whether the next write should tear down the connection.
+func (gw *mockGateway) drop() bool {
+	if gw.conditions.DropRate <= 0 {
+		return false
+	}
+	gw.randLock.Lock()
+	defer gw.randLock.Unlock()
+
+	return gw.rand.Float64() < gw.conditions.DropRate
+}
+
+// mockConditionConn is a network connection which simulates the latency, limited
+// bandwidth and unreliability of the Tor network.
+type mockConditionConn struct {
+	net.Conn // The real TCP connection for network communication
+
+	gateway *mockGateway // Gateway holding the conditions to simulate
+	tokens  float64      // Bytes permitted to be written without waiting
+	refill  time.Time    // Last time the token bucket was refilled
+	lock    sync.Mutex   // Lock serializing writes for the token bucket
+}
+
+// Write delays the data by the configured latency and bandwidth before passing
+// it to the real connection, or tears the connection down if a drop is rolled.
+func (c *mockConditionConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	conds := c.gateway.conditions
+	if c.gateway.drop() {
+		c.Conn.Close()
+		return 0, errors.New("simulated connection drop")
+	}
+	if conds.Latency > 0 {
+		time.Sleep(conds.Latency)
+	}
+	if conds.Bandwidth > 0 {
+		// Refill the token bucket, capping it at one second worth of data
+		now := time.Now()
+		c.tokens += now.Sub(c.refill).Seconds() * float64(conds.Bandwidth)
+		if c.tokens > float64(conds.Bandwidth) {
+			c.tokens = float64(conds.Bandwidth)
+		}
+		c.refill = now
+
+		// If there's not enough allowance for the write, wait until there is
+		c.tokens -= float64(len(b))
+		if c.tokens < 0 {
+			time.Sleep(time.Duration(-c.tokens / float64(conds.Bandwidth) * float64(time.Second)))
+		}
+	}
+	return c.Conn.Write(b)
 }
 
 // Listen creates an onion service and local listener. The context can be nil.
@@ -95,6 +205,16 @@ type mockGatewayListener struct {
 	service string       // Onion URL to deregister on close
 }
 
+// Accept waits for and returns the next connection to the listener, injecting
+// the simulated network conditions of the gateway.
+func (l *mockGatewayListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.gateway.wrap(conn), nil
+}
+
 // Close terminates the underlying listener and also removes it from the mock
 // gateway service list.
 func (l *mockGatewayListener) Close() error {
@@ -128,5 +248,9 @@ func (d *mockGatewayDialer) Dial(network, addr string) (net.Conn, error) {
 	if listener == nil {
 		return nil, errors.New("unknown destination address")
 	}
-	return net.Dial(listener.Addr().Network(), listener.Addr().String())
+	conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	return d.gateway.wrap(conn), nil
 }
@@ -0,0 +1,112 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package tornet
+
+import (
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/tor"
+	tored25519 "github.com/cretz/bine/torutil/ed25519"
+)
+
+// newTestGatewayConn opens a mock onion service through the given gateway and
+// dials it, returning both ends of the simulated connection.
+func newTestGatewayConn(t *testing.T, gateway Gateway) (net.Conn, net.Conn) {
+	addr, _ := GenerateAddress()
+	listener, err := gateway.Listen(nil, &tor.ListenConf{
+		Key:         tored25519.FromCryptoPrivateKey(ed25519.NewKeyFromSeed(addr)).PrivateKey(),
+		RemotePorts: []int{1},
+	})
+	if err != nil {
+		t.Fatalf("Failed to open mock onion: %v", err)
+	}
+	defer listener.Close()
+
+	var url string
+	for url = range gateway.(*mockGateway).services {
+	}
+	dialer, _ := gateway.Dialer(nil, nil)
+	local, err := dialer.Dial("tcp", url)
+	if err != nil {
+		t.Fatalf("Failed to dial mock onion: %v", err)
+	}
+	remote, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept mock connection: %v", err)
+	}
+	return local, remote
+}
+
+// Tests that the default mock gateway is instantaneous, whereas the conditioned
+// one delays writes by the configured latency and bandwidth.
+func TestMockGatewayConditions(t *testing.T) {
+	// Ensure the default gateway doesn't wrap the connections at all
+	local, remote := newTestGatewayConn(t, NewMockGateway())
+	if _, ok := local.(*mockConditionConn); ok {
+		t.Fatalf("Default gateway conditioned outbound connection")
+	}
+	if _, ok := remote.(*mockConditionConn); ok {
+		t.Fatalf("Default gateway conditioned inbound connection")
+	}
+	local.Close()
+	remote.Close()
+
+	// Create a laggy gateway and ensure writes are delayed in both directions
+	gateway := NewMockGatewayWithConditions(MockConditions{
+		Latency:   50 * time.Millisecond,
+		Bandwidth: 1000,
+	})
+	local, remote = newTestGatewayConn(t, gateway)
+	defer local.Close()
+	defer remote.Close()
+
+	go io.Copy(ioutil.Discard, remote)
+
+	start := time.Now()
+	if _, err := local.Write(make([]byte, 10)); err != nil {
+		t.Fatalf("Failed to write to conditioned connection: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("Latency not simulated: have %v, want >= %v", elapsed, 50*time.Millisecond)
+	}
+	// Exhaust the token bucket and ensure further writes are rate limited
+	start = time.Now()
+	if _, err := local.Write(make([]byte, 990)); err != nil {
+		t.Fatalf("Failed to write to conditioned connection: %v", err)
+	}
+	if _, err := local.Write(make([]byte, 500)); err != nil {
+		t.Fatalf("Failed to write to conditioned connection: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("Bandwidth not simulated: have %v, want >= %v", elapsed, 500*time.Millisecond)
+	}
+	go io.Copy(ioutil.Discard, local)
+
+	start = time.Now()
+	if _, err := remote.Write(make([]byte, 10)); err != nil {
+		t.Fatalf("Failed to write to conditioned connection: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("Inbound latency not simulated: have %v, want >= %v", elapsed, 50*time.Millisecond)
+	}
+}
+
+// Tests that a mock gateway simulating an unreliable network tears connections
+// down on writes.
+func TestMockGatewayDrops(t *testing.T) {
+	local, remote := newTestGatewayConn(t, NewMockGatewayWithConditions(MockConditions{DropRate: 1}))
+	defer remote.Close()
+
+	if _, err := local.Write([]byte{0x01}); err == nil {
+		t.Fatalf("Write succeeded on dropping connection")
+	}
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read error mismatch: have %v, want %v", err, io.EOF)
+	}
+}
@@ -3,6 +3,15 @@
 
 package tornet
 
+import (
+	"crypto/ed25519"
+	"errors"
+)
+
+// ErrMalformedKeyRing is returned if a serialized remote keyring (usually pasted
+// by the user) is of the wrong length or contains invalid keys.
+var ErrMalformedKeyRing = errors.New("malformed keyring")
+
 // SecretKeyRing is the ultimate collection of cryptographic identities and
 // relations for a local user. These are the keys to the castle.
 //
@@ -13,12 +22,19 @@ package tornet
 // The complexity of multiple addresses and mappings are to enable rotating Tor
 // onions gradually, introducing new ones and shifting out old ones after every
 // contact has been moved over.
+//
+// Similarly, the permanent identity can be rotated. Until every contact learns
+// about the new one, the old identity is retained for the old addresses and for
+// dialing the contacts still pending migration.
 type SecretKeyRing struct {
 	Identity  SecretIdentity  `json:"identity"`  // Secret stable identity. This is you.
 	Addresses []SecretAddress `json:"addresses"` // Secret semi-stable addresses. These are where you are.
 
 	Trusted  map[IdentityFingerprint]RemoteKeyRing                   `json:"trusted"`  // Remote identities trusted for communication
 	Accesses map[AddressFingerprint]map[IdentityFingerprint]struct{} `json:"accesses"` // Addresses that specific remote identities can dial
+
+	Retired   SecretIdentity                   `json:"retired,omitempty"`   // Previous identity while a rotation is in progress
+	Migrating map[IdentityFingerprint]struct{} `json:"migrating,omitempty"` // Remote identities not yet aware of the rotation
 }
 
 // RemoteKeyRing is a small collection of cryptographic keys maintained about a
@@ -28,6 +44,37 @@ type RemoteKeyRing struct {
 	Address  PublicAddress  `json:"address"`  // Remote semi-stable address. This is where your contact is.
 }
 
+// ValidateRemoteKeyRing checks that the identity and address of a remote keyring
+// are well formed keys, so that a dial is not even attempted with junk.
+func ValidateRemoteKeyRing(keyring RemoteKeyRing) error {
+	if !validPublicKey(keyring.Identity) || !validPublicKey(keyring.Address) {
+		return ErrMalformedKeyRing
+	}
+	return nil
+}
+
+// ParseRemoteKeyRing splits a serialized remote keyring (identity followed by the
+// address) into its components, validating them in the process.
+func ParseRemoteKeyRing(blob []byte) (RemoteKeyRing, error) {
+	if len(blob) != 2*ed25519.PublicKeySize {
+		return RemoteKeyRing{}, ErrMalformedKeyRing
+	}
+	keyring := RemoteKeyRing{
+		Identity: append(PublicIdentity{}, blob[:ed25519.PublicKeySize]...),
+		Address:  append(PublicAddress{}, blob[ed25519.PublicKeySize:]...),
+	}
+	if err := ValidateRemoteKeyRing(keyring); err != nil {
+		return RemoteKeyRing{}, err
+	}
+	return keyring, nil
+}
+
+// Bytes serializes a remote keyring (identity followed by the address) into the
+// format accepted by ParseRemoteKeyRing.
+func (k RemoteKeyRing) Bytes() []byte {
+	return append(append(make([]byte, 0, len(k.Identity)+len(k.Address)), k.Identity...), k.Address...)
+}
+
 // GenerateKeyRing generates a new cryptographic identity and initial contact
 // address for tornet.
 func GenerateKeyRing() (SecretKeyRing, error) {
@@ -48,3 +95,31 @@ func GenerateKeyRing() (SecretKeyRing, error) {
 		},
 	}, nil
 }
+
+// copy creates a deep copy of the keyring, so that it can be handed out without
+// the internal maps being modified concurrently.
+func (k SecretKeyRing) copy() SecretKeyRing {
+	keyring := SecretKeyRing{
+		Identity:  k.Identity,
+		Addresses: append([]SecretAddress{}, k.Addresses...),
+		Trusted:   make(map[IdentityFingerprint]RemoteKeyRing, len(k.Trusted)),
+		Accesses:  make(map[AddressFingerprint]map[IdentityFingerprint]struct{}, len(k.Accesses)),
+		Retired:   k.Retired,
+	}
+	for uid, trust := range k.Trusted {
+		keyring.Trusted[uid] = trust
+	}
+	for addr, peers := range k.Accesses {
+		keyring.Accesses[addr] = make(map[IdentityFingerprint]struct{}, len(peers))
+		for uid := range peers {
+			keyring.Accesses[addr][uid] = struct{}{}
+		}
+	}
+	if k.Migrating != nil {
+		keyring.Migrating = make(map[IdentityFingerprint]struct{}, len(k.Migrating))
+		for uid := range k.Migrating {
+			keyring.Migrating[uid] = struct{}{}
+		}
+	}
+	return keyring
+}
@@ -48,3 +48,33 @@ func TestSecretKeyRingMarshalling(t *testing.T) {
 		t.Fatalf("Encode-parse-encode mismatch: have\n %s\n want\n %s", parsed, original)
 	}
 }
+
+// Tests that remote key rings can be parsed from their serialized form, and
+// that malformed ones are rejected.
+func TestParseRemoteKeyRing(t *testing.T) {
+	identity, _ := GenerateIdentity()
+	address, _ := GenerateAddress()
+
+	blob := append(append([]byte{}, identity.Public()...), address.Public()...)
+	keyring, err := ParseRemoteKeyRing(blob)
+	if err != nil {
+		t.Fatalf("Failed to parse remote keyring: %v", err)
+	}
+	if !bytes.Equal(keyring.Identity, identity.Public()) || !bytes.Equal(keyring.Address, address.Public()) {
+		t.Fatalf("Remote keyring mismatch: have %x/%x, want %x/%x", keyring.Identity, keyring.Address, identity.Public(), address.Public())
+	}
+	offcurve := make([]byte, 32)
+	offcurve[0] = 2
+
+	for i, blob := range [][]byte{
+		nil,
+		blob[:63],
+		append(append([]byte{}, blob...), 0),
+		append(append([]byte{}, offcurve...), address.Public()...),
+		append(append([]byte{}, identity.Public()...), offcurve...),
+	} {
+		if _, err := ParseRemoteKeyRing(blob); err != ErrMalformedKeyRing {
+			t.Errorf("Keyring %d: error mismatch: have %v, want %v", i, err, ErrMalformedKeyRing)
+		}
+	}
+}
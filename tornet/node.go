@@ -15,13 +15,36 @@ import (
 	"github.com/ethereum/go-ethereum/log"
 )
 
+var (
+	// ErrIdentityMigrating is returned if the permanent identity is attempted to
+	// be rotated while a previous rotation is still being propagated to contacts.
+	ErrIdentityMigrating = errors.New("identity migration in progress")
+
+	// ErrUnknownIdentity is returned if an operation is attempted on a remote
+	// peer that is not in the node's trust ring.
+	ErrUnknownIdentity = errors.New("unknown identity")
+
+	// ErrIdentityTrusted is returned if a migrated away identity is attempted to
+	// be forgotten while it's still in the node's trust ring.
+	ErrIdentityTrusted = errors.New("identity still trusted")
+
+	// ErrRedialBackoff is returned if a remote peer is attempted to be dialed
+	// before its backoff period (due to previous failures) elapses.
+	ErrRedialBackoff = errors.New("redial backoff")
+)
+
 // NodeConfig can be used to fine tune the initial setup of a tornet node.
 type NodeConfig struct {
-	Gateway     Gateway       // Tor gateway to network through
-	KeyRing     SecretKeyRing // Key ring for peer management
-	RingHandler RingHandler   // Handler to run for keyring changes
-	ConnHandler ConnHandler   // Handler to run for each peer
-	ConnTimeout time.Duration // Maximum idle time after which to disconnect
+	Gateway      Gateway       // Tor gateway to network through
+	KeyRing      SecretKeyRing // Key ring for peer management
+	RingHandler  RingHandler   // Handler to run for keyring changes
+	ConnHandler  ConnHandler   // Handler to run for each peer
+	ConnTimeout  time.Duration // Maximum idle time after which to disconnect
+	ConnLifetime time.Duration // Maximum connection lifetime irrespective of activity (0 = unlimited)
+	Backoff      BackoffConfig // Redial delay policy for unreachable peers
+	Clock        Clock         // Source of time for redial backoffs (nil = system clock)
+
+	RotationInterval time.Duration // Interval to rotate the onion address at (0 = only on untrust)
 
 	Logger log.Logger // Logger to allow injecting pre-networking context
 }
@@ -39,6 +62,9 @@ type RingHandler func(keyring SecretKeyRing)
 // removed from the trust ring, a new tornet server is launched with the aim of
 // moving everyone over eventually. At that point the old address can be removed,
 //
+// The same mechanism is used to rotate the permanent identity: a new server is
+// launched with the new identity, whilst the old servers keep presenting the
+// retired one until every contact acknowledged the migration.
 type Node struct {
 	gateway Gateway       // Tor gateway to network through
 	keyring SecretKeyRing // Cryptographic credentials to connect with and manage
@@ -49,6 +75,14 @@ type Node struct {
 
 	servers []*Server // Remote connection listeners in the Tor network
 
+	backoff  BackoffConfig                        // Redial delay policy for unreachable peers
+	backoffs map[IdentityFingerprint]*dialBackoff // Failure trackers for unreachable peers
+	clock    Clock                                // Source of time for redial backoffs
+
+	rotation time.Duration // Interval to rotate the onion address at (0 = disabled)
+	quit     chan struct{} // Quit channel to stop the address rotation loop
+	done     chan struct{} // Termination channel of the address rotation loop
+
 	logger log.Logger   // Contextual logger with optional embedded tags
 	lock   sync.RWMutex // Ensures the internals are not modified concurrently
 }
@@ -62,8 +96,15 @@ func NewNode(config NodeConfig) (*Node, error) {
 		keyring:     config.KeyRing,
 		ringHandler: config.RingHandler,
 		connHandler: config.ConnHandler,
+		backoff:     config.Backoff.withDefaults(),
+		backoffs:    make(map[IdentityFingerprint]*dialBackoff),
+		clock:       config.Clock,
+		rotation:    config.RotationInterval,
 		logger:      config.Logger,
 	}
+	if node.clock == nil {
+		node.clock = SystemClock
+	}
 	if node.logger == nil {
 		node.logger = log.Root()
 	}
@@ -73,17 +114,24 @@ func NewNode(config NodeConfig) (*Node, error) {
 		trusted = append(trusted, trust.Identity)
 	}
 	node.peerset = NewPeerSet(PeerSetConfig{
-		Trusted: trusted,
-		Handler: node.handle,
-		Timeout: config.ConnTimeout,
-		Logger:  node.logger,
+		Trusted:  trusted,
+		Handler:  node.handle,
+		Timeout:  config.ConnTimeout,
+		Lifetime: config.ConnLifetime,
+		Logger:   node.logger,
 	})
 	// For every currently maintained address, launch a listener server
-	for _, address := range node.keyring.Addresses {
+	for i, address := range node.keyring.Addresses {
+		// If an identity rotation is in progress, only the newest address is
+		// bound to the new identity, the old ones are for unmigrated contacts.
+		identity := node.keyring.Identity
+		if node.keyring.Retired != nil && i < len(node.keyring.Addresses)-1 {
+			identity = node.keyring.Retired
+		}
 		server, err := NewServer(ServerConfig{
 			Gateway:  node.gateway,
 			Address:  address,
-			Identity: node.keyring.Identity,
+			Identity: identity,
 			PeerSet:  node.peerset,
 			Logger:   node.logger,
 		})
@@ -96,11 +144,23 @@ func NewNode(config NodeConfig) (*Node, error) {
 		}
 		node.servers = append(node.servers, server)
 	}
+	// If periodic address rotation was requested, start the rotation loop
+	if node.rotation > 0 {
+		node.quit = make(chan struct{})
+		node.done = make(chan struct{})
+		go node.loop(node.quit, node.done)
+	}
 	return node, nil
 }
 
 // Close terminates all the network listeners and tears down all connections.
 func (n *Node) Close() error {
+	// Stop rotating addresses, the servers are being torn down anyway
+	if n.quit != nil {
+		close(n.quit)
+		<-n.done
+		n.quit = nil
+	}
 	// Terminate all servers first to ensure no more peers get in
 	n.lock.RLock()
 	for _, server := range n.servers {
@@ -116,7 +176,85 @@ func (n *Node) Close() error {
 	return nil
 }
 
-// Dial requests the node to connect to an already configured remote peer.
+// loop periodically rotates the onion address of the node until torn down.
+func (n *Node) loop(quit chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	timer := n.clock.NewTimer(n.rotation)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			if err := n.rotate(); err != nil {
+				n.logger.Warn("Failed to rotate address", "err", err)
+			}
+			timer.Reset(n.rotation)
+
+		case <-quit:
+			return
+		}
+	}
+}
+
+// rotate launches a new server on a fresh address, which becomes the preferred
+// one announced to all peers during the address exchange. Old addresses remain
+// online until all their peers acknowledged the new one, except the ones that
+// have no peers at all, which are retired immediately.
+func (n *Node) rotate() error {
+	address, err := GenerateAddress()
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	// The newest address is bound to the new identity during an identity
+	// migration, don't shift it out until that completes
+	if n.keyring.Retired != nil {
+		return ErrIdentityMigrating
+	}
+	server, err := NewServer(ServerConfig{
+		Gateway:  n.gateway,
+		Address:  address,
+		Identity: n.keyring.Identity,
+		PeerSet:  n.peerset,
+		Logger:   n.logger,
+	})
+	if err != nil {
+		return err
+	}
+	n.servers = append(n.servers, server)
+	n.keyring.Addresses = append(n.keyring.Addresses, address)
+	n.keyring.Accesses[address.Fingerprint()] = make(map[IdentityFingerprint]struct{})
+
+	// Retire any old address that nobody needs to be moved away from
+	for _, addr := range append([]SecretAddress{}, n.keyring.Addresses[:len(n.keyring.Addresses)-1]...) {
+		if uid := addr.Fingerprint(); len(n.keyring.Accesses[uid]) == 0 {
+			n.dropServer(uid)
+		}
+	}
+	n.logger.Info("Rotated onion address", "address", address.Fingerprint(), "addresses", len(n.keyring.Addresses))
+	n.ringHandler(n.keyring.copy())
+	return nil
+}
+
+// Drain stops accepting new connections and waits (bounded by the context) for
+// all active connection handlers to reach a quiescent point. The listeners and
+// connections are left running, they should be torn down afterwards via Close.
+func (n *Node) Drain(ctx context.Context) error {
+	return n.peerset.Drain(ctx)
+}
+
+// ConnTimeouts returns the idle timeout and maximum lifetime applied to the
+// connections of the node. Zero means the specific limit is disabled.
+func (n *Node) ConnTimeouts() (idle time.Duration, lifetime time.Duration) {
+	return n.peerset.Timeouts()
+}
+
+// Dial requests the node to connect to an already configured remote peer. If
+// previous dials to the peer failed, new attempts are rejected until the backoff
+// delay expires.
 //
 // Since the handshake is async, a failure cannot be immediately returned. Instead,
 // an error channel is returned which will get sent any failure after dialing.
@@ -126,18 +264,101 @@ func (n *Node) Dial(ctx context.Context, id IdentityFingerprint) (chan error, er
 	keyring, ok := n.keyring.Trusted[id]
 	if !ok {
 		n.lock.RUnlock()
-		return nil, errors.New("unknown identity")
+		return nil, ErrUnknownIdentity
 	}
+	backoff := n.backoffs[id]
+	identity := n.localIdentity(id)
 	n.lock.RUnlock()
 
+	if now := n.clock.Now(); backoff != nil && now.Before(backoff.next) {
+		return nil, fmt.Errorf("%w: %v remaining", ErrRedialBackoff, backoff.next.Sub(now))
+	}
 	// Address located, attempt to dial it
-	return DialServer(ctx, DialConfig{
+	done, err := DialServer(ctx, DialConfig{
 		Gateway:  n.gateway,
 		Address:  keyring.Address,
 		Server:   keyring.Identity,
-		Identity: n.keyring.Identity,
+		Identity: identity,
 		PeerSet:  n.peerset,
 	})
+	// Track the failures to avoid hammering unreachable peers
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if err == nil {
+		delete(n.backoffs, id)
+		return done, nil
+	}
+	if backoff = n.backoffs[id]; backoff == nil {
+		backoff = new(dialBackoff)
+		n.backoffs[id] = backoff
+	}
+	backoff.failures++
+	backoff.next = n.clock.Now().Add(n.backoff.Delay(backoff.failures))
+
+	return nil, err
+}
+
+// Connections returns the number of live connections with remote peers.
+func (n *Node) Connections() int {
+	return n.peerset.Count()
+}
+
+// PeerStatus returns whether there is a live connection with a trusted remote
+// peer, and if so, since when. Connections still running the handshake are not
+// considered live yet.
+func (n *Node) PeerStatus(id IdentityFingerprint) (connected bool, since time.Time, err error) {
+	n.lock.RLock()
+	_, ok := n.keyring.Trusted[id]
+	n.lock.RUnlock()
+
+	if !ok {
+		return false, time.Time{}, ErrUnknownIdentity
+	}
+	connected, since = n.peerset.Status(id)
+	return connected, since, nil
+}
+
+// NegotiatedVersion returns the protocol and version negotiated on the live
+// connection with the given peer, if any was recorded.
+func (n *Node) NegotiatedVersion(id IdentityFingerprint) (string, uint, bool) {
+	return n.peerset.NegotiatedVersion(id)
+}
+
+// Trusted returns a copy of the remote keyrings currently trusted by the node.
+// This may be more recent than the last persisted keyring, as it contains any
+// address updates received from the remote peers.
+func (n *Node) Trusted() map[IdentityFingerprint]RemoteKeyRing {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	trusted := make(map[IdentityFingerprint]RemoteKeyRing, len(n.keyring.Trusted))
+	for uid, keyring := range n.keyring.Trusted {
+		trusted[uid] = RemoteKeyRing{
+			Identity: append(PublicIdentity{}, keyring.Identity...),
+			Address:  append(PublicAddress{}, keyring.Address...),
+		}
+	}
+	return trusted
+}
+
+// KeyRing returns a copy of the entire local keyring currently used by the node.
+func (n *Node) KeyRing() SecretKeyRing {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.keyring.copy()
+}
+
+// localIdentity returns the local identity a remote peer knows us by. This is
+// the retired identity if the peer did not acknowledge a rotation yet.
+//
+// Note, this method assumes the read lock is held.
+func (n *Node) localIdentity(id IdentityFingerprint) SecretIdentity {
+	if _, ok := n.keyring.Migrating[id]; ok {
+		return n.keyring.Retired
+	}
+	return n.keyring.Identity
 }
 
 // handle is responsible for doing a cryptographic address exchange between two
@@ -152,6 +373,11 @@ func (n *Node) handle(id IdentityFingerprint, conn net.Conn, logger log.Logger)
 	// on. Also read the other side's preferences.
 	n.lock.RLock()
 	preferredLocalAddress := n.keyring.Addresses[len(n.keyring.Addresses)-1].Public()
+	if _, ok := n.keyring.Migrating[id]; ok {
+		// The newest address runs with the new identity, which the peer does not
+		// know yet. Keep it on its current address until the migration is done.
+		preferredLocalAddress = n.accessAddress(id).Public()
+	}
 	believedRemoteAddress := n.keyring.Trusted[id].Address
 	n.lock.RUnlock()
 
@@ -204,6 +430,19 @@ func (n *Node) handle(id IdentityFingerprint, conn net.Conn, logger log.Logger)
 	n.connHandler(id, conn, logger)
 }
 
+// accessAddress returns the local address through which a remote peer is allowed
+// to access us, falling back to the newest address if not found.
+//
+// Note, this method assumes the read lock is held.
+func (n *Node) accessAddress(id IdentityFingerprint) SecretAddress {
+	for _, addr := range n.keyring.Addresses {
+		if _, ok := n.keyring.Accesses[addr.Fingerprint()][id]; ok {
+			return addr
+		}
+	}
+	return n.keyring.Addresses[len(n.keyring.Addresses)-1]
+}
+
 // handleNewAddress handles the remote announcement of a new tornet address.
 func (n *Node) handleNewAddress(id IdentityFingerprint, addr PublicAddress) {
 	n.lock.Lock()
@@ -213,7 +452,8 @@ func (n *Node) handleNewAddress(id IdentityFingerprint, addr PublicAddress) {
 		Identity: n.keyring.Trusted[id].Identity,
 		Address:  addr,
 	}
-	n.ringHandler(n.keyring)
+	delete(n.backoffs, id) // New address, give it a fresh chance
+	n.ringHandler(n.keyring.copy())
 }
 
 // handleMaybeNewAccess handles the remote acknowledgement of a new tornet address.
@@ -236,7 +476,7 @@ func (n *Node) handleMaybeNewAccess(peerId IdentityFingerprint, addrId AddressFi
 		}
 	}
 	n.keyring.Accesses[addrId][peerId] = struct{}{}
-	n.ringHandler(n.keyring)
+	n.ringHandler(n.keyring.copy())
 }
 
 // dropServer removes a dud server and it's address from the keyring.
@@ -255,7 +495,7 @@ func (n *Node) dropServer(uid AddressFingerprint) {
 			n.servers = append(n.servers[:i], n.servers[i+1:]...)
 		}
 	}
-	n.ringHandler(n.keyring)
+	n.ringHandler(n.keyring.copy())
 }
 
 // Trust adds a new remote keyring into the node's internal ring.
@@ -281,7 +521,7 @@ func (n *Node) Trust(keyring RemoteKeyRing) error {
 		panic(fmt.Sprintf("peer known in keyring/accesses but not in peerset"))
 	}
 	n.keyring.Accesses[addr][uid] = struct{}{}
-	n.ringHandler(n.keyring)
+	n.ringHandler(n.keyring.copy())
 	return nil
 }
 
@@ -301,6 +541,14 @@ func (n *Node) Untrust(uid IdentityFingerprint) error {
 		panic(fmt.Sprintf("peer known in peerset but not in keyring/trusted"))
 	}
 	delete(n.keyring.Trusted, uid)
+	delete(n.backoffs, uid)
+
+	if _, ok := n.keyring.Migrating[uid]; ok {
+		delete(n.keyring.Migrating, uid)
+		if len(n.keyring.Migrating) == 0 {
+			n.keyring.Retired, n.keyring.Migrating = nil, nil
+		}
+	}
 
 	for addr, peers := range n.keyring.Accesses {
 		if _, ok := peers[uid]; ok {
@@ -311,6 +559,146 @@ func (n *Node) Untrust(uid IdentityFingerprint) error {
 			break
 		}
 	}
-	n.ringHandler(n.keyring)
+	n.ringHandler(n.keyring.copy())
+	return nil
+}
+
+// RotateIdentity replaces the local permanent identity with a new one, launching
+// a new server bound to it on a fresh address. The old identity is retained on
+// the old addresses until all the trusted peers are migrated (Migrated), so that
+// both sides can keep reaching each other throughout.
+func (n *Node) RotateIdentity(identity SecretIdentity, address SecretAddress) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.keyring.Retired != nil {
+		return ErrIdentityMigrating
+	}
+	// Launch a new server with the new identity, on a new address, since the old
+	// ones are known to be bound to the old identity
+	server, err := NewServer(ServerConfig{
+		Gateway:  n.gateway,
+		Address:  address,
+		Identity: identity,
+		PeerSet:  n.peerset,
+		Logger:   n.logger,
+	})
+	if err != nil {
+		return err
+	}
+	n.servers = append(n.servers, server)
+	n.keyring.Addresses = append(n.keyring.Addresses, address)
+	n.keyring.Accesses[address.Fingerprint()] = make(map[IdentityFingerprint]struct{})
+
+	// Every currently trusted peer needs to be told about the new identity
+	retired := n.keyring.Identity
+	n.keyring.Identity = identity
+
+	if len(n.keyring.Trusted) > 0 {
+		n.keyring.Retired = retired
+		n.keyring.Migrating = make(map[IdentityFingerprint]struct{}, len(n.keyring.Trusted))
+		for uid := range n.keyring.Trusted {
+			n.keyring.Migrating[uid] = struct{}{}
+		}
+	} else {
+		// Nobody knows about the old identity, drop its addresses straight away
+		for len(n.keyring.Addresses) > 1 {
+			n.dropServer(n.keyring.Addresses[0].Fingerprint())
+		}
+	}
+	n.ringHandler(n.keyring.copy())
 	return nil
 }
+
+// Migrating returns whether a trusted peer still needs to be told about the new
+// local identity, along with the retired identity it knows us by.
+func (n *Node) Migrating(id IdentityFingerprint) (SecretIdentity, bool) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	if _, ok := n.keyring.Migrating[id]; !ok {
+		return nil, false
+	}
+	return n.keyring.Retired, true
+}
+
+// Migrated marks a trusted peer as having acknowledged the new local identity,
+// moving it over to the new address. If this was the last peer pending, the old
+// identity is discarded.
+func (n *Node) Migrated(id IdentityFingerprint) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.keyring.Migrating[id]; !ok {
+		return
+	}
+	delete(n.keyring.Migrating, id)
+
+	// The peer was told about the new address too, so move it into that pool
+	addr := n.keyring.Addresses[len(n.keyring.Addresses)-1].Fingerprint()
+	for old, peers := range n.keyring.Accesses {
+		if _, ok := peers[id]; ok && old != addr {
+			delete(peers, id)
+			if len(peers) == 0 {
+				n.dropServer(old)
+			}
+			break
+		}
+	}
+	n.keyring.Accesses[addr][id] = struct{}{}
+
+	if len(n.keyring.Migrating) == 0 {
+		n.keyring.Retired, n.keyring.Migrating = nil, nil
+	}
+	n.ringHandler(n.keyring.copy())
+}
+
+// Migrate replaces the identity of a trusted peer after it announced rotating
+// it. The old identity is removed from the keyring, but it is left in the peer
+// set so the live connection can acknowledge the migration. Forget needs to be
+// called afterwards to finalize the switch.
+func (n *Node) Migrate(old IdentityFingerprint, keyring RemoteKeyRing) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.keyring.Trusted[old]; !ok {
+		return ErrUnknownIdentity
+	}
+	uid := keyring.Identity.Fingerprint()
+	if _, ok := n.keyring.Trusted[uid]; ok {
+		return ErrAlreadyTrusted
+	}
+	if err := n.peerset.Trust(keyring.Identity); err != nil {
+		return err
+	}
+	// Swap out the identity in the trust ring, retaining the peer's access pool
+	delete(n.keyring.Trusted, old)
+	delete(n.backoffs, old)
+	n.keyring.Trusted[uid] = keyring
+
+	for _, peers := range n.keyring.Accesses {
+		if _, ok := peers[old]; ok {
+			delete(peers, old)
+			peers[uid] = struct{}{}
+			break
+		}
+	}
+	if _, ok := n.keyring.Migrating[old]; ok {
+		delete(n.keyring.Migrating, old)
+		n.keyring.Migrating[uid] = struct{}{}
+	}
+	n.ringHandler(n.keyring.copy())
+	return nil
+}
+
+// Forget removes a migrated away identity from the peer set, dropping any live
+// connections still authenticated with it.
+func (n *Node) Forget(old IdentityFingerprint) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.keyring.Trusted[old]; ok {
+		return ErrIdentityTrusted
+	}
+	return n.peerset.Untrust(old)
+}
@@ -4,6 +4,7 @@
 package tornet
 
 import (
+	"bytes"
 	"context"
 	"net"
 	"testing"
@@ -86,6 +87,82 @@ func TestNodeConnectivity(t *testing.T) {
 	}
 }
 
+// Tests that the connection status of peers is reported correctly by a node.
+func TestNodePeerStatus(t *testing.T) {
+	// Create the key rings for two mutually trusting users
+	keyring1, _ := GenerateKeyRing()
+	keyring2, _ := GenerateKeyRing()
+
+	keyring1.Trusted[keyring2.Identity.Fingerprint()] = RemoteKeyRing{
+		Identity: keyring2.Identity.Public(),
+		Address:  keyring2.Addresses[0].Public(),
+	}
+	keyring1.Accesses[keyring1.Addresses[0].Fingerprint()][keyring2.Identity.Fingerprint()] = struct{}{}
+
+	keyring2.Trusted[keyring1.Identity.Fingerprint()] = RemoteKeyRing{
+		Identity: keyring1.Identity.Public(),
+		Address:  keyring1.Addresses[0].Public(),
+	}
+	keyring2.Accesses[keyring2.Addresses[0].Fingerprint()][keyring1.Identity.Fingerprint()] = struct{}{}
+
+	// Create and boot the nodes, keeping the connections open until released
+	var (
+		gateway = NewMockGateway()
+		notify  = make(chan struct{}, 2)
+		release = make(chan struct{})
+	)
+	handler := func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {
+		notify <- struct{}{}
+		<-release
+	}
+	node1, _ := NewNode(NodeConfig{Gateway: gateway, KeyRing: keyring1, ConnHandler: handler})
+	defer node1.Close()
+
+	node2, _ := NewNode(NodeConfig{Gateway: gateway, KeyRing: keyring2, ConnHandler: handler})
+	defer node2.Close()
+
+	// Unknown peers should be rejected, trusted ones reported offline
+	stranger, _ := GenerateIdentity()
+	if _, _, err := node1.PeerStatus(stranger.Fingerprint()); err != ErrUnknownIdentity {
+		t.Fatalf("Unknown peer status error mismatch: have %v, want %v", err, ErrUnknownIdentity)
+	}
+	connected, since, err := node1.PeerStatus(keyring2.Identity.Fingerprint())
+	if err != nil {
+		t.Fatalf("Failed to retrieve peer status: %v", err)
+	}
+	if connected || !since.IsZero() {
+		t.Fatalf("Offline status mismatch: have %v/%v, want %v/%v", connected, since, false, time.Time{})
+	}
+	// Connect the two nodes and ensure both report each other online
+	start := time.Now()
+	if _, err := node1.Dial(context.Background(), keyring2.Identity.Fingerprint()); err != nil {
+		t.Fatalf("Failed to dial peer: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-notify:
+		case <-time.After(time.Second):
+			t.Fatalf("Connection timed out")
+		}
+	}
+	for _, check := range []struct {
+		node *Node
+		peer IdentityFingerprint
+	}{
+		{node1, keyring2.Identity.Fingerprint()},
+		{node2, keyring1.Identity.Fingerprint()},
+	} {
+		connected, since, err := check.node.PeerStatus(check.peer)
+		if err != nil {
+			t.Fatalf("Failed to retrieve peer status: %v", err)
+		}
+		if !connected || since.Before(start) {
+			t.Fatalf("Online status mismatch: have %v/%v, want %v/after %v", connected, since, true, start)
+		}
+	}
+	close(release)
+}
+
 // Tests that new remote identities can be injected into a node to accept new
 // connections and they can also be removed to reject them.
 func TestNodeTrustManagement(t *testing.T) {
@@ -162,3 +239,342 @@ func TestNodeTrustManagement(t *testing.T) {
 		// Connection seem to have failed
 	}
 }
+
+// Tests that a remote identity cannot be trusted twice, even if it arrives with
+// a different address, leaving the original trust entry intact.
+func TestNodeTrustConflict(t *testing.T) {
+	keyring1, _ := GenerateKeyRing()
+	keyring2, _ := GenerateKeyRing()
+
+	node, _ := NewNode(NodeConfig{
+		Gateway:     NewMockGateway(),
+		KeyRing:     keyring1,
+		RingHandler: func(keyring SecretKeyRing) {},
+		ConnHandler: func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {},
+	})
+	defer node.Close()
+
+	if err := node.Trust(RemoteKeyRing{
+		Identity: keyring2.Identity.Public(),
+		Address:  keyring2.Addresses[0].Public(),
+	}); err != nil {
+		t.Fatalf("Failed to trust peer: %v", err)
+	}
+	// Trust the same identity with a different address and ensure it's rejected
+	address, _ := GenerateAddress()
+	if err := node.Trust(RemoteKeyRing{
+		Identity: keyring2.Identity.Public(),
+		Address:  address.Public(),
+	}); err != ErrAlreadyTrusted {
+		t.Fatalf("Conflicting trust error mismatch: have %v, want %v", err, ErrAlreadyTrusted)
+	}
+	trusted := node.Trusted()
+	if len(trusted) != 1 {
+		t.Fatalf("Trusted peer count mismatch: have %d, want %d", len(trusted), 1)
+	}
+	if have, want := trusted[keyring2.Identity.Fingerprint()].Address.Fingerprint(), keyring2.Addresses[0].Fingerprint(); have != want {
+		t.Fatalf("Trusted address mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that the trusted peers reported by a node reflect any address updates
+// received from remote peers during connection.
+func TestNodeTrustedAddressUpdate(t *testing.T) {
+	// Create the key rings for two users, with the first believing in a stale
+	// address of the second
+	keyring1, _ := GenerateKeyRing()
+	keyring2, _ := GenerateKeyRing()
+	stale, _ := GenerateAddress()
+
+	keyring1.Trusted[keyring2.Identity.Fingerprint()] = RemoteKeyRing{
+		Identity: keyring2.Identity.Public(),
+		Address:  stale.Public(),
+	}
+	keyring1.Accesses[keyring1.Addresses[0].Fingerprint()][keyring2.Identity.Fingerprint()] = struct{}{}
+
+	keyring2.Trusted[keyring1.Identity.Fingerprint()] = RemoteKeyRing{
+		Identity: keyring1.Identity.Public(),
+		Address:  keyring1.Addresses[0].Public(),
+	}
+	keyring2.Accesses[keyring2.Addresses[0].Fingerprint()][keyring1.Identity.Fingerprint()] = struct{}{}
+
+	// Create and boot the mutually trusting nodes
+	gateway := NewMockGateway()
+
+	notify := make(chan struct{}, 1)
+	node1, _ := NewNode(NodeConfig{
+		Gateway:     gateway,
+		KeyRing:     keyring1,
+		RingHandler: func(keyring SecretKeyRing) {},
+		ConnHandler: func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {
+			notify <- struct{}{}
+		},
+	})
+	defer node1.Close()
+
+	node2, _ := NewNode(NodeConfig{
+		Gateway:     gateway,
+		KeyRing:     keyring2,
+		RingHandler: func(keyring SecretKeyRing) {},
+		ConnHandler: func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {},
+	})
+	defer node2.Close()
+
+	// Ensure the stale address is reported before connecting
+	uid := keyring2.Identity.Fingerprint()
+	if addr := node1.Trusted()[uid].Address; !bytes.Equal(addr, stale.Public()) {
+		t.Fatalf("Initial address mismatch: have %x, want %x", addr, stale.Public())
+	}
+	// Connect the second node to the first, exchanging the live addresses
+	if _, err := node2.Dial(context.Background(), keyring1.Identity.Fingerprint()); err != nil {
+		t.Fatalf("Failed to dial peer: %v", err)
+	}
+	select {
+	case <-notify:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("Connection timed out")
+	}
+	trusted := node1.Trusted()
+	if addr := trusted[uid].Address; !bytes.Equal(addr, keyring2.Addresses[0].Public()) {
+		t.Fatalf("Updated address mismatch: have %x, want %x", addr, keyring2.Addresses[0].Public())
+	}
+	// Ensure the returned trust ring is a copy, not the live one
+	delete(trusted, uid)
+	if _, ok := node1.Trusted()[uid]; !ok {
+		t.Fatalf("Trusted peer removed through returned copy")
+	}
+}
+
+// Tests that rotating the permanent identity keeps unmigrated peers connected
+// through the retired identity, and that the old identity and its address are
+// dropped after the last peer migrated.
+func TestNodeIdentityRotation(t *testing.T) {
+	// Create the key rings for two mutually trusting users
+	keyring1, _ := GenerateKeyRing()
+	keyring2, _ := GenerateKeyRing()
+
+	keyring1.Trusted[keyring2.Identity.Fingerprint()] = RemoteKeyRing{
+		Identity: keyring2.Identity.Public(),
+		Address:  keyring2.Addresses[0].Public(),
+	}
+	keyring1.Accesses[keyring1.Addresses[0].Fingerprint()][keyring2.Identity.Fingerprint()] = struct{}{}
+
+	keyring2.Trusted[keyring1.Identity.Fingerprint()] = RemoteKeyRing{
+		Identity: keyring1.Identity.Public(),
+		Address:  keyring1.Addresses[0].Public(),
+	}
+	keyring2.Accesses[keyring2.Addresses[0].Fingerprint()][keyring1.Identity.Fingerprint()] = struct{}{}
+
+	// Create and boot the mutually trusting nodes
+	var (
+		gateway = NewMockGateway()
+		notify  = make(chan IdentityFingerprint, 2)
+	)
+	handler := func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {
+		notify <- id
+	}
+	node1, _ := NewNode(NodeConfig{Gateway: gateway, KeyRing: keyring1, RingHandler: func(keyring SecretKeyRing) {}, ConnHandler: handler})
+	defer node1.Close()
+
+	node2, _ := NewNode(NodeConfig{Gateway: gateway, KeyRing: keyring2, RingHandler: func(keyring SecretKeyRing) {}, ConnHandler: handler})
+	defer node2.Close()
+
+	// connect dials a peer and waits until both sides ran the handler
+	connect := func(node *Node, id IdentityFingerprint, want IdentityFingerprint) {
+		if _, err := node.Dial(context.Background(), id); err != nil {
+			t.Fatalf("Failed to dial peer: %v", err)
+		}
+		var seen []IdentityFingerprint
+		for i := 0; i < 2; i++ {
+			select {
+			case id := <-notify:
+				seen = append(seen, id)
+			case <-time.After(time.Second):
+				t.Fatalf("Connection timed out")
+			}
+		}
+		if seen[0] != want && seen[1] != want {
+			t.Fatalf("Connected identity mismatch: have %v, want %v", seen, want)
+		}
+	}
+	// Rotate the identity of the first node and ensure a second one is rejected
+	old := keyring1.Identity.Fingerprint()
+
+	identity, _ := GenerateIdentity()
+	address, _ := GenerateAddress()
+	if err := node1.RotateIdentity(identity, address); err != nil {
+		t.Fatalf("Failed to rotate identity: %v", err)
+	}
+	if err := node1.RotateIdentity(identity, address); err != ErrIdentityMigrating {
+		t.Fatalf("Double rotation error mismatch: have %v, want %v", err, ErrIdentityMigrating)
+	}
+	if retired, ok := node1.Migrating(keyring2.Identity.Fingerprint()); !ok || retired.Fingerprint() != old {
+		t.Fatalf("Migration status mismatch: have %v/%v, want %v/%v", retired.Fingerprint(), ok, old, true)
+	}
+	// Ensure the unmigrated peer can still connect both ways via the old identity
+	connect(node2, old, old)
+	connect(node1, keyring2.Identity.Fingerprint(), old)
+
+	// Migrate the second node over to the new identity and ensure it connects
+	if err := node2.Migrate(old, RemoteKeyRing{Identity: identity.Public(), Address: address.Public()}); err != nil {
+		t.Fatalf("Failed to migrate peer: %v", err)
+	}
+	if err := node2.Forget(old); err != nil {
+		t.Fatalf("Failed to forget old identity: %v", err)
+	}
+	node1.Migrated(keyring2.Identity.Fingerprint())
+
+	keyring := node1.KeyRing()
+	if keyring.Retired != nil || len(keyring.Migrating) != 0 {
+		t.Fatalf("Retired identity not dropped")
+	}
+	if len(keyring.Addresses) != 1 || keyring.Addresses[0].Fingerprint() != address.Fingerprint() {
+		t.Fatalf("Old addresses not dropped: have %d addresses", len(keyring.Addresses))
+	}
+	connect(node2, identity.Fingerprint(), identity.Fingerprint())
+	connect(node1, keyring2.Identity.Fingerprint(), identity.Fingerprint())
+}
+
+// Tests that rotating the onion address keeps the old one online until all its
+// peers acknowledged the new one, and that the resulting keyring can be used to
+// restart the node.
+func TestNodeAddressRotation(t *testing.T) {
+	// Create the key rings for two mutually trusting users
+	keyring1, _ := GenerateKeyRing()
+	keyring2, _ := GenerateKeyRing()
+
+	keyring1.Trusted[keyring2.Identity.Fingerprint()] = RemoteKeyRing{
+		Identity: keyring2.Identity.Public(),
+		Address:  keyring2.Addresses[0].Public(),
+	}
+	keyring1.Accesses[keyring1.Addresses[0].Fingerprint()][keyring2.Identity.Fingerprint()] = struct{}{}
+
+	keyring2.Trusted[keyring1.Identity.Fingerprint()] = RemoteKeyRing{
+		Identity: keyring1.Identity.Public(),
+		Address:  keyring1.Addresses[0].Public(),
+	}
+	keyring2.Accesses[keyring2.Addresses[0].Fingerprint()][keyring1.Identity.Fingerprint()] = struct{}{}
+
+	// Create and boot the mutually trusting nodes, tracking the first's keyring
+	var (
+		gateway = NewMockGateway()
+		notify  = make(chan struct{}, 2)
+		persist = make(chan SecretKeyRing, 16)
+	)
+	handler := func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {
+		notify <- struct{}{}
+	}
+	node1, _ := NewNode(NodeConfig{
+		Gateway:     gateway,
+		KeyRing:     keyring1,
+		RingHandler: func(keyring SecretKeyRing) { persist <- keyring },
+		ConnHandler: handler,
+	})
+	node2, _ := NewNode(NodeConfig{Gateway: gateway, KeyRing: keyring2, RingHandler: func(keyring SecretKeyRing) {}, ConnHandler: handler})
+	defer node2.Close()
+
+	// connect dials the first node from the second and waits for the exchange
+	connect := func() {
+		if _, err := node2.Dial(context.Background(), keyring1.Identity.Fingerprint()); err != nil {
+			t.Fatalf("Failed to dial peer: %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case <-notify:
+			case <-time.After(time.Second):
+				t.Fatalf("Connection timed out")
+			}
+		}
+	}
+	// Rotate the address and ensure the old one is retained for the peer
+	old := keyring1.Addresses[0]
+	if err := node1.rotate(); err != nil {
+		t.Fatalf("Failed to rotate address: %v", err)
+	}
+	keyring := node1.KeyRing()
+	if len(keyring.Addresses) != 2 {
+		t.Fatalf("Address count mismatch: have %d, want %d", len(keyring.Addresses), 2)
+	}
+	fresh := keyring.Addresses[1]
+
+	// Connect via the old address, which should announce the new one
+	connect()
+	if addr := node2.Trusted()[keyring1.Identity.Fingerprint()].Address; !bytes.Equal(addr, fresh.Public()) {
+		t.Fatalf("Announced address mismatch: have %x, want %x", addr, fresh.Public())
+	}
+	if keyring := node1.KeyRing(); len(keyring.Addresses) != 2 {
+		t.Fatalf("Old address retired before acknowledgement")
+	}
+	// Connect via the new address, which should retire the old one
+	connect()
+
+	keyring = node1.KeyRing()
+	if len(keyring.Addresses) != 1 || keyring.Addresses[0].Fingerprint() != fresh.Fingerprint() {
+		t.Fatalf("Old address not retired: have %d addresses", len(keyring.Addresses))
+	}
+	if _, ok := keyring.Accesses[old.Fingerprint()]; ok {
+		t.Fatalf("Old address access pool not retired")
+	}
+	if _, ok := keyring.Accesses[fresh.Fingerprint()][keyring2.Identity.Fingerprint()]; !ok || len(keyring.Accesses) != 1 {
+		t.Fatalf("Access pools mismatch: have %v", keyring.Accesses)
+	}
+	// Restart the node from the last persisted keyring and ensure it's reachable
+	node1.Close()
+
+	var persisted SecretKeyRing
+	for len(persist) > 0 {
+		persisted = <-persist
+	}
+	if len(persisted.Addresses) != 1 || persisted.Addresses[0].Fingerprint() != fresh.Fingerprint() {
+		t.Fatalf("Persisted addresses mismatch: have %d addresses", len(persisted.Addresses))
+	}
+	node1, _ = NewNode(NodeConfig{Gateway: gateway, KeyRing: persisted, RingHandler: func(keyring SecretKeyRing) {}, ConnHandler: handler})
+	defer node1.Close()
+
+	connect()
+}
+
+// Tests that the node rotates its address periodically if configured to.
+func TestNodeAddressRotationTimer(t *testing.T) {
+	keyring, _ := GenerateKeyRing()
+	clock := NewSimulatedClock(time.Date(2020, time.April, 1, 12, 0, 0, 0, time.UTC))
+
+	rotated := make(chan SecretKeyRing, 4)
+	node, err := NewNode(NodeConfig{
+		Gateway:          NewMockGateway(),
+		KeyRing:          keyring,
+		RingHandler:      func(keyring SecretKeyRing) { rotated <- keyring },
+		Clock:            clock,
+		RotationInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Close()
+
+	for i := 0; i < 2; i++ {
+		// Wait for the rotation timer to be armed, then trigger it
+		for j := 0; clock.Pending() == 0; j++ {
+			if j == 100 {
+				t.Fatalf("Rotation %d: timer not armed", i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		clock.Run(time.Hour)
+		select {
+		case keyring := <-rotated:
+			// Without any peers, the old address should be retired immediately
+			if len(keyring.Addresses) != 1 {
+				t.Fatalf("Rotation %d: address count mismatch: have %d, want %d", i, len(keyring.Addresses), 1)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Rotation %d: address not rotated", i)
+		}
+		for len(rotated) > 0 {
+			<-rotated
+		}
+	}
+	if addr := node.KeyRing().Addresses[0]; addr.Fingerprint() == keyring.Addresses[0].Fingerprint() {
+		t.Fatalf("Address not rotated")
+	}
+}
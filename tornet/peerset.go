@@ -4,11 +4,14 @@
 package tornet
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/log"
@@ -20,14 +23,82 @@ import (
 // in both directions.
 const protocolMagic = "COVID-19"
 
+var (
+	// ErrDraining is returned if a connection is attempted to be established or
+	// read from while the peer set is shutting down.
+	ErrDraining = errors.New("peer set draining")
+
+	// ErrPeerLimit is returned if a connection is attempted to be established from
+	// a new peer while the peer set is already at its connection cap.
+	ErrPeerLimit = errors.New("peer limit reached")
+
+	// ErrPeerSetClosed is returned if a connection finishes its handshake after
+	// the peer set was already closed.
+	ErrPeerSetClosed = errors.New("peer set closed")
+
+	// ErrUntrustedConn is returned if a connection is established with a peer
+	// that is not (or no longer) authorized in the peer set.
+	ErrUntrustedConn = errors.New("untrusted connection")
+
+	// ErrDuplicateConn is returned if a connection is established with a peer
+	// that already has a live connection in the peer set.
+	ErrDuplicateConn = errors.New("duplicate connection")
+
+	// ErrMagicMismatch is returned if the remote side of a connection did not
+	// send the expected protocol magic after the TLS handshake.
+	ErrMagicMismatch = errors.New("magic mismatch")
+
+	// ErrRejected is returned if the remote side of a connection refused the TLS
+	// handshake, typically because it does not trust the local identity.
+	ErrRejected = errors.New("connection rejected")
+
+	// ErrAlreadyTrusted is returned if a remote identity is attempted to be
+	// trusted, but it's already authorized.
+	ErrAlreadyTrusted = errors.New("already trusted")
+
+	// ErrNotTrusted is returned if a remote identity is attempted to be untrusted,
+	// but it was not authorized in the first place.
+	ErrNotTrusted = errors.New("not trusted")
+)
+
 // ConnHandler is a network callback for authenticated connections.
 type ConnHandler func(id IdentityFingerprint, conn net.Conn, logger log.Logger)
 
+// NegotiationRecorder is implemented by the connections a peer set hands to its
+// handler, allowing the protocol layer to record the protocol and version that
+// was negotiated on top for introspection.
+type NegotiationRecorder interface {
+	RecordNegotiation(protocol string, version uint)
+}
+
+// MessageTracker is implemented by the connections a peer set hands to its
+// handler, allowing the protocol layer to mark where its messages start and end.
+// Draining only interrupts reads waiting for a new message, a message halfway
+// received when draining starts is still read in full.
+type MessageTracker interface {
+	MessageStarted()  // Invoked when the first byte of a new message is read
+	MessageFinished() // Invoked when the last byte of a message is read
+}
+
+// negotiation is the protocol and version agreed upon on a live connection.
+type negotiation struct {
+	protocol string // Name of the negotiated protocol
+	version  uint   // Version of the negotiated protocol
+}
+
 // PeerSetConfig can be used to fine tune the initial setup of a tornet peerset.
 type PeerSetConfig struct {
-	Trusted []PublicIdentity // Initial set of trusted authorizations
-	Handler ConnHandler      // Handler to run for each added connection
-	Timeout time.Duration    // Maximum idle time after which to disconnect
+	Trusted  []PublicIdentity // Initial set of trusted authorizations
+	Handler  ConnHandler      // Handler to run for each added connection
+	Timeout  time.Duration    // Maximum idle time after which to disconnect (0 = never)
+	Lifetime time.Duration    // Maximum connection lifetime irrespective of activity (0 = unlimited)
+
+	MaxConns int // Maximum number of distinct peers connected at once (0 = unlimited)
+
+	MaxConcurrentHandshakes int // Maximum number of inbound handshakes running at once (0 = unlimited)
+
+	OnConnect    func(uid IdentityFingerprint) // Callback when a peer connection is established (nil = none)
+	OnDisconnect func(uid IdentityFingerprint) // Callback when a peer connection is torn down (nil = none)
 
 	Logger log.Logger // Logger to allow injecting pre-networking context
 }
@@ -36,12 +107,25 @@ type PeerSetConfig struct {
 // is to allow de-duplicating connections that might arrive from a variety of
 // onion addresses.
 type PeerSet struct {
-	gateway Gateway       // Tor gateway to open the listener through
-	handler ConnHandler   // Network to run for each added connection
-	timeout time.Duration // Maximum idle time after which to disconnect
+	gateway  Gateway       // Tor gateway to open the listener through
+	handler  ConnHandler   // Network to run for each added connection
+	timeout  time.Duration // Maximum idle time after which to disconnect
+	lifetime time.Duration // Maximum connection lifetime irrespective of activity
+
+	maxConns int // Maximum number of distinct peers connected at once
+
+	handshakes chan struct{} // Semaphore limiting the concurrent inbound handshakes (nil = unlimited)
 
-	auths map[IdentityFingerprint]PublicIdentity // Remote identities for inbound dials
-	conns map[IdentityFingerprint]net.Conn       // Currently live remote connections
+	onConnect    func(uid IdentityFingerprint) // Callback when a peer connection is established
+	onDisconnect func(uid IdentityFingerprint) // Callback when a peer connection is torn down
+
+	auths  map[IdentityFingerprint]PublicIdentity // Remote identities for inbound dials
+	conns  map[IdentityFingerprint]net.Conn       // Currently live remote connections
+	since  map[IdentityFingerprint]time.Time      // Handshake completion times of live connections
+	protos map[IdentityFingerprint]negotiation    // Protocols negotiated on live connections
+
+	pend  sync.WaitGroup // Tracks the active connection handlers for draining
+	drain chan struct{}  // Closed when the set stops accepting connections
 
 	logger log.Logger   // Contextual logger with optional embedded tags
 	lock   sync.RWMutex // Lock protecting the set's internals
@@ -51,15 +135,25 @@ type PeerSet struct {
 // remote identities.
 func NewPeerSet(config PeerSetConfig) *PeerSet {
 	peerset := &PeerSet{
-		handler: config.Handler,
-		timeout: config.Timeout,
-		auths:   make(map[IdentityFingerprint]PublicIdentity),
-		conns:   make(map[IdentityFingerprint]net.Conn),
-		logger:  config.Logger,
+		handler:      config.Handler,
+		timeout:      config.Timeout,
+		lifetime:     config.Lifetime,
+		maxConns:     config.MaxConns,
+		onConnect:    config.OnConnect,
+		onDisconnect: config.OnDisconnect,
+		auths:        make(map[IdentityFingerprint]PublicIdentity),
+		conns:        make(map[IdentityFingerprint]net.Conn),
+		since:        make(map[IdentityFingerprint]time.Time),
+		protos:       make(map[IdentityFingerprint]negotiation),
+		drain:        make(chan struct{}),
+		logger:       config.Logger,
 	}
 	for _, auth := range config.Trusted {
 		peerset.auths[auth.Fingerprint()] = auth
 	}
+	if config.MaxConcurrentHandshakes > 0 {
+		peerset.handshakes = make(chan struct{}, config.MaxConcurrentHandshakes)
+	}
 	if peerset.logger == nil {
 		peerset.logger = log.Root()
 	}
@@ -77,21 +171,97 @@ func (ps *PeerSet) Close() error {
 	for _, conn := range ps.conns {
 		conn.Close()
 	}
-	ps.conns = nil
+	ps.conns, ps.since, ps.protos = nil, nil, nil
 	return nil
 }
 
+// Drain stops accepting new connections and interrupts any reads waiting for a
+// new message, waiting (bounded by the context) for all active connection handlers
+// to finish their in-flight message processing and return. The connections
+// themselves are not closed, that is left to Close.
+//
+// Handlers that report their message boundaries (MessageTracker) get to finish
+// reading a message halfway received when draining starts. Others have all
+// their reads interrupted, even if that leaves a message half read.
+func (ps *PeerSet) Drain(ctx context.Context) error {
+	ps.lock.Lock()
+	select {
+	case <-ps.drain:
+	default:
+		close(ps.drain)
+	}
+	for _, conn := range ps.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	ps.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ps.pend.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// accept gates an inbound connection through the handshake limiter and if a slot
+// is available, handles it on a new goroutine. Excess connections are dropped
+// before the TLS handshake so a flood cannot exhaust our resources.
+func (ps *PeerSet) accept(conn net.Conn) {
+	if ps.handshakes == nil {
+		go ps.handle(conn, make(chan error, 1), nil) // We don't care about the error
+		return
+	}
+	select {
+	case ps.handshakes <- struct{}{}:
+		go ps.handle(conn, make(chan error, 1), func() { <-ps.handshakes })
+	default:
+		ps.logger.Debug("Rejecting connection over handshake limit")
+		conn.Close()
+	}
+}
+
 // handle is responsible for doing the authentication handshake with a remote
 // peer, and if passed, to establish a persistent data stream until it's torn
 // down or breaks.
-func (ps *PeerSet) handle(conn net.Conn, done chan error) {
+//
+// If a release callback is given, it's invoked when the handshake finishes,
+// either successfully or not, to free up the slot taken in the limiter.
+func (ps *PeerSet) handle(conn net.Conn, done chan error, release func()) {
+	// Make sure the handshake slot is freed up, whatever happens
+	finish := func() {
+		if release != nil {
+			release()
+			release = nil
+		}
+	}
+	defer finish()
+
+	// Track the handler for draining, unless we're already shutting down
+	ps.lock.Lock()
+	select {
+	case <-ps.drain:
+		ps.lock.Unlock()
+		conn.Close()
+		done <- ErrDraining
+		return
+	default:
+	}
+	ps.pend.Add(1)
+	ps.lock.Unlock()
+	defer ps.pend.Done()
+
 	// Make sure the connection is torn down, whatever happens
 	defer conn.Close()
 
 	// Before doing anything, run the TLS handshake
 	if err := conn.(*tls.Conn).Handshake(); err != nil {
 		ps.logger.Warn("Remote connection failed authentication", "err", err)
-		done <- err
+		done <- classifyRemoteError(err)
 		return
 	}
 	// Retrieve the peer certificate and deduplicate connections
@@ -101,32 +271,57 @@ func (ps *PeerSet) handle(conn net.Conn, done chan error) {
 	logger := ps.logger.New("peer", uid)
 
 	ps.lock.Lock()
+	if ps.conns == nil {
+		// The peer set was closed while the handshake was running (e.g. a
+		// dial raced with teardown), don't resurrect a connection into it.
+		logger.Debug("Connection established into closed peer set")
+		ps.lock.Unlock()
+		done <- ErrPeerSetClosed
+		return
+	}
 	if _, ok := ps.auths[uid]; !ok {
 		// This path triggers if the server permitted a peer to connect to us,
 		// but that peer was not authorized to do so. It signals a bad usage
 		// of the package.
 		logger.Error("Connection accepted but peer not trusted")
 		ps.lock.Unlock()
-		done <- errors.New("untrusted connection")
+		done <- ErrUntrustedConn
 		return
 	}
 	if _, ok := ps.conns[uid]; ok {
 		logger.Debug("New peer connection deduplicated")
 		ps.lock.Unlock()
-		done <- errors.New("duplicate connection")
+		done <- ErrDuplicateConn
+		return
+	}
+	// Not a duplicate, make sure the peer isn't crowding us out
+	if ps.maxConns > 0 && len(ps.conns) >= ps.maxConns {
+		logger.Warn("Rejecting connection over peer limit", "peers", len(ps.conns))
+		ps.lock.Unlock()
+		done <- ErrPeerLimit
 		return
 	}
 	logger.Debug("New peer connection established")
 	ps.conns[uid] = conn
 	ps.lock.Unlock()
 
+	// Notify any listener of the connection outside of the lock, as it might call
+	// back into the peer set
+	if ps.onConnect != nil {
+		ps.onConnect(uid)
+	}
 	// Ensure the connection is removed from the pool on disconnect
 	defer func() {
 		ps.lock.Lock()
-		defer ps.lock.Unlock()
-
 		logger.Debug("Peer connection torn down")
 		delete(ps.conns, uid)
+		delete(ps.since, uid)
+		delete(ps.protos, uid)
+		ps.lock.Unlock()
+
+		if ps.onDisconnect != nil {
+			ps.onDisconnect(uid)
+		}
 	}()
 	// TLS seems to be ok, at least on this side. To ensure it's ok in both of
 	// the directions, exchange the initial protocol magic.
@@ -147,25 +342,91 @@ func (ps *PeerSet) handle(conn net.Conn, done chan error) {
 	for i := 0; i < 2; i++ {
 		if err := <-errc; err != nil {
 			logger.Warn("Protocol validation failed", "err", err)
-			done <- err
+			done <- classifyRemoteError(err)
 			return
 		}
 	}
 	if string(helo) != protocolMagic {
 		logger.Warn("Protocol magic mismatch", "magic", helo)
-		done <- errors.New("magic mismatch")
+		done <- ErrMagicMismatch
 		return
 	}
 	conn.SetDeadline(time.Time{})
 
-	// Handshake complete, initiate the time breaker and pass to the user
-	if ps.timeout != 0 {
-		conn = newBreaker(conn, ps.timeout)
+	// Handshake complete, mark the peer connected (unless dropped meanwhile)
+	ps.lock.Lock()
+	if ps.conns[uid] == conn {
+		ps.since[uid] = time.Now()
 	}
-	ps.handler(uid, conn, ps.logger)
+	ps.lock.Unlock()
+
+	// Initiate the time breaker and pass to the user
+	finish()
+
+	live := conn
+	if ps.timeout != 0 || ps.lifetime != 0 {
+		conn = newBreaker(conn, ps.timeout, ps.lifetime)
+	}
+	ps.handler(uid, &recordingConn{Conn: conn, peerset: ps, uid: uid, live: live}, ps.logger)
 	done <- nil
 }
 
+// classifyRemoteError converts a TLS alert sent by the remote side into a typed
+// rejection error. With TLS 1.3, the server verifies the client certificate only
+// after the client considers the handshake done, so the alert may also arrive
+// on the first read.
+func classifyRemoteError(err error) error {
+	var op *net.OpError
+	if errors.As(err, &op) && op.Op == "remote error" {
+		return fmt.Errorf("%w: %v", ErrRejected, err)
+	}
+	return err
+}
+
+// Timeouts returns the idle timeout after which connections are dropped if no
+// data is exchanged, and the maximum lifetime after which they are dropped even
+// if active. Zero means the specific limit is disabled.
+func (ps *PeerSet) Timeouts() (idle time.Duration, lifetime time.Duration) {
+	return ps.timeout, ps.lifetime
+}
+
+// Count returns the number of live connections in the peer set.
+func (ps *PeerSet) Count() int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return len(ps.conns)
+}
+
+// Connected returns whether there is a live connection with the given peer.
+func (ps *PeerSet) Connected(uid IdentityFingerprint) bool {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	_, ok := ps.conns[uid]
+	return ok
+}
+
+// Status returns whether there is a live connection with the given peer that
+// completed the protocol handshake, and if so, since when.
+func (ps *PeerSet) Status(uid IdentityFingerprint) (bool, time.Time) {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	since, ok := ps.since[uid]
+	return ok, since
+}
+
+// NegotiatedVersion returns the protocol and version negotiated on the live
+// connection with the given peer, if any was recorded.
+func (ps *PeerSet) NegotiatedVersion(uid IdentityFingerprint) (string, uint, bool) {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	proto, ok := ps.protos[uid]
+	return proto.protocol, proto.version, ok
+}
+
 // Trust adds a new public identity into the set of trusted peers.
 func (ps *PeerSet) Trust(id PublicIdentity) error {
 	ps.lock.Lock()
@@ -173,7 +434,7 @@ func (ps *PeerSet) Trust(id PublicIdentity) error {
 
 	uid := id.Fingerprint()
 	if _, ok := ps.auths[uid]; ok {
-		return errors.New("already trusted")
+		return ErrAlreadyTrusted
 	}
 	ps.auths[uid] = id
 	return nil
@@ -186,13 +447,85 @@ func (ps *PeerSet) Untrust(uid IdentityFingerprint) error {
 	defer ps.lock.Unlock()
 
 	if _, ok := ps.auths[uid]; !ok {
-		return errors.New("not trusted")
+		return ErrNotTrusted
 	}
 	if conn, ok := ps.conns[uid]; ok {
 		conn.Close()
 	}
 	delete(ps.auths, uid)
 	delete(ps.conns, uid)
+	delete(ps.since, uid)
+	delete(ps.protos, uid)
 
 	return nil
 }
+
+// recordingConn is a net.Conn wrapper handed to the peer set's handler, through
+// which the negotiated protocol can be recorded into the connection's entry.
+type recordingConn struct {
+	net.Conn // Pass everything non-interesting through
+
+	peerset *PeerSet            // Peer set tracking the connection
+	uid     IdentityFingerprint // Remote peer of the connection
+	live    net.Conn            // Original connection tracked by the peer set
+	partial int32               // Whether a message is halfway read (atomic)
+}
+
+// Read implements net.Conn, refusing to wait for new data once the peer set is
+// draining, so handlers return at their next message boundary. If a message is
+// halfway read, the drain's read deadline is lifted to finish reading it.
+func (c *recordingConn) Read(buf []byte) (int, error) {
+	for {
+		if c.draining() && atomic.LoadInt32(&c.partial) == 0 {
+			return 0, ErrDraining
+		}
+		n, err := c.Conn.Read(buf)
+		if err == nil || !c.draining() {
+			return n, err
+		}
+		// The read was interrupted by draining, finish any message in flight
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			if n > 0 {
+				return n, nil
+			}
+			if atomic.LoadInt32(&c.partial) == 1 {
+				c.Conn.SetReadDeadline(time.Time{})
+				continue
+			}
+		}
+		return n, ErrDraining
+	}
+}
+
+// draining returns whether the peer set tracking the connection is draining.
+func (c *recordingConn) draining() bool {
+	select {
+	case <-c.peerset.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// MessageStarted implements MessageTracker, marking a message halfway read so
+// that draining does not interrupt it.
+func (c *recordingConn) MessageStarted() {
+	atomic.StoreInt32(&c.partial, 1)
+}
+
+// MessageFinished implements MessageTracker, marking the connection idle between
+// two messages, where draining may interrupt it.
+func (c *recordingConn) MessageFinished() {
+	atomic.StoreInt32(&c.partial, 0)
+}
+
+// RecordNegotiation implements NegotiationRecorder, storing the negotiated
+// protocol version into the peer set (unless the connection was dropped).
+func (c *recordingConn) RecordNegotiation(protocol string, version uint) {
+	c.peerset.lock.Lock()
+	defer c.peerset.lock.Unlock()
+
+	if c.peerset.conns[c.uid] == c.live {
+		c.peerset.protos[c.uid] = negotiation{protocol: protocol, version: version}
+	}
+}
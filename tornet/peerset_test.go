@@ -5,6 +5,9 @@ package tornet
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
 	"net"
 	"testing"
 	"time"
@@ -22,9 +25,18 @@ func TestPeerSetTrustManagement(t *testing.T) {
 		serverAddr, _ = GenerateAddress()
 		clientId, _   = GenerateIdentity()
 	)
-	// Create a server that does not trust the client
+	// Create a server that does not trust the client, tracking connection events
+	serverEvents := make(chan string, 4)
 	serverPeers := NewPeerSet(PeerSetConfig{
-		Handler: func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {},
+		Handler: func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {
+			io.Copy(ioutil.Discard, conn)
+		},
+		OnConnect: func(uid IdentityFingerprint) {
+			serverEvents <- "connect " + string(uid)
+		},
+		OnDisconnect: func(uid IdentityFingerprint) {
+			serverEvents <- "disconnect " + string(uid)
+		},
 	})
 	server, err := NewServer(ServerConfig{
 		Gateway:  gateway,
@@ -43,6 +55,7 @@ func TestPeerSetTrustManagement(t *testing.T) {
 		Trusted: []PublicIdentity{serverId.Public()},
 		Handler: func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {
 			clientNotify <- struct{}{}
+			io.Copy(ioutil.Discard, conn)
 		},
 	})
 	if _, err := DialServer(context.Background(), DialConfig{
@@ -78,9 +91,31 @@ func TestPeerSetTrustManagement(t *testing.T) {
 	case <-time.After(100 * time.Millisecond):
 		t.Fatalf("Connection timed out")
 	}
+	select {
+	case event := <-serverEvents:
+		if want := "connect " + string(clientId.Fingerprint()); event != want {
+			t.Fatalf("Connection event mismatch: have %s, want %s", event, want)
+		}
+	default:
+		t.Fatalf("Connection event missing")
+	}
+	select {
+	case event := <-serverEvents:
+		t.Fatalf("Unexpected event before untrust: %s", event)
+	default:
+	}
 	// Remove the client from the server's trust ring and retry
 	serverPeers.Untrust(clientId.Fingerprint())
 
+	select {
+	case event := <-serverEvents:
+		if want := "disconnect " + string(clientId.Fingerprint()); event != want {
+			t.Fatalf("Disconnection event mismatch: have %s, want %s", event, want)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("Disconnection event timed out")
+	}
+
 	if _, err := DialServer(context.Background(), DialConfig{
 		Gateway:  gateway,
 		Address:  serverAddr.Public(),
@@ -97,3 +132,348 @@ func TestPeerSetTrustManagement(t *testing.T) {
 		// Connection seem to have failed
 	}
 }
+
+// Tests that a peer is only reported connected after the protocol handshake is
+// done, and reported disconnected after teardown.
+func TestPeerSetStatus(t *testing.T) {
+	// Set up the crypto identities and a peer set trusting the remote side
+	localId, _ := GenerateIdentity()
+	remoteId, _ := GenerateIdentity()
+
+	release := make(chan struct{})
+	peers := NewPeerSet(PeerSetConfig{
+		Trusted: []PublicIdentity{remoteId.Public()},
+		Handler: func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {
+			<-release
+		},
+	})
+	defer peers.Close()
+
+	uid := remoteId.Fingerprint()
+	if connected, since := peers.Status(uid); connected || !since.IsZero() {
+		t.Fatalf("Offline status mismatch: have %v/%v, want %v/%v", connected, since, false, time.Time{})
+	}
+	// Run the TLS handshake, but stall the protocol magic on the remote side
+	local, remote := net.Pipe()
+
+	done := make(chan error, 1)
+	go peers.handle(tls.Client(local, &tls.Config{
+		Certificates:       []tls.Certificate{localId.certificate()},
+		InsecureSkipVerify: true,
+	}), done, nil)
+
+	conn := tls.Server(remote, &tls.Config{
+		Certificates: []tls.Certificate{remoteId.certificate()},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	defer conn.Close()
+
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("Failed to run TLS handshake: %v", err)
+	}
+	for i := 0; i < 100 && !peers.Connected(uid); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if !peers.Connected(uid) {
+		t.Fatalf("Connection not tracked")
+	}
+	if connected, _ := peers.Status(uid); connected {
+		t.Fatalf("Peer reported connected mid-handshake")
+	}
+	// Finish the protocol handshake and ensure the peer is reported live
+	helo := make([]byte, len(protocolMagic))
+	go conn.Write([]byte(protocolMagic))
+	if _, err := conn.Read(helo); err != nil {
+		t.Fatalf("Failed to read protocol magic: %v", err)
+	}
+	var (
+		connected bool
+		since     time.Time
+	)
+	for i := 0; i < 100 && !connected; i++ {
+		time.Sleep(time.Millisecond)
+		connected, since = peers.Status(uid)
+	}
+	if !connected || since.IsZero() {
+		t.Fatalf("Online status mismatch: have %v/%v, want %v/non-zero", connected, since, true)
+	}
+	// Tear down the connection and ensure the peer is reported offline
+	remote.Close()
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Connection failed: %v", err)
+	}
+	if connected, since := peers.Status(uid); connected || !since.IsZero() {
+		t.Fatalf("Disconnected status mismatch: have %v/%v, want %v/%v", connected, since, false, time.Time{})
+	}
+}
+
+// Tests that draining a peer set waits for the active handlers to finish their
+// in-flight processing, interrupts their idle reads and rejects new connections.
+func TestPeerSetDrain(t *testing.T) {
+	// Set up the crypto identities and a peer set trusting the remote side
+	localId, _ := GenerateIdentity()
+	remoteId, _ := GenerateIdentity()
+
+	var (
+		started   = make(chan struct{})
+		release   = make(chan struct{})
+		processed = make(chan error, 1)
+	)
+	peers := NewPeerSet(PeerSetConfig{
+		Trusted: []PublicIdentity{remoteId.Public()},
+		Handler: func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {
+			// Read a message and stall processing it until released
+			if _, err := conn.Read(make([]byte, 1)); err != nil {
+				processed <- err
+				return
+			}
+			close(started)
+			<-release
+
+			// Wait for the next message, which should be interrupted
+			_, err := conn.Read(make([]byte, 1))
+			processed <- err
+		},
+	})
+	defer peers.Close()
+
+	// Establish a connection and send over a message to process
+	local, remote := net.Pipe()
+
+	done := make(chan error, 1)
+	go peers.handle(tls.Client(local, &tls.Config{
+		Certificates:       []tls.Certificate{localId.certificate()},
+		InsecureSkipVerify: true,
+	}), done, nil)
+
+	conn := tls.Server(remote, &tls.Config{
+		Certificates: []tls.Certificate{remoteId.certificate()},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	defer conn.Close()
+
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("Failed to run TLS handshake: %v", err)
+	}
+	helo := make([]byte, len(protocolMagic))
+	sent := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte(protocolMagic))
+		sent <- err
+	}()
+	if _, err := conn.Read(helo); err != nil {
+		t.Fatalf("Failed to read protocol magic: %v", err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("Failed to send protocol magic: %v", err)
+	}
+	if _, err := conn.Write([]byte{0x01}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	go ioutil.ReadAll(conn) // Consume the close notification on teardown
+	select {
+	case <-started:
+	case err := <-processed:
+		t.Fatalf("Handler failed: %v", err)
+	case <-time.After(time.Second):
+		t.Fatalf("Handler didn't start processing")
+	}
+	// Start draining and ensure it waits for the in-flight processing
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	drained := make(chan error, 1)
+	go func() { drained <- peers.Drain(ctx) }()
+
+	select {
+	case err := <-drained:
+		t.Fatalf("Drain returned mid-processing: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-drained; err != nil {
+		t.Fatalf("Failed to drain peer set: %v", err)
+	}
+	if err := <-processed; err != ErrDraining {
+		t.Fatalf("Idle read error mismatch: have %v, want %v", err, ErrDraining)
+	}
+	// Ensure new connections are rejected
+	extra, _ := net.Pipe()
+	reject := make(chan error, 1)
+	peers.handle(extra, reject, nil)
+	if err := <-reject; err != ErrDraining {
+		t.Fatalf("Connection error mismatch: have %v, want %v", err, ErrDraining)
+	}
+}
+
+// Tests that draining a peer set lets handlers finish reading a message they are
+// halfway through, only interrupting them at the next message boundary.
+func TestPeerSetDrainPartialMessage(t *testing.T) {
+	// Set up the crypto identities and a peer set trusting the remote side
+	localId, _ := GenerateIdentity()
+	remoteId, _ := GenerateIdentity()
+
+	var (
+		started   = make(chan struct{})
+		processed = make(chan error, 2)
+	)
+	peers := NewPeerSet(PeerSetConfig{
+		Trusted: []PublicIdentity{remoteId.Public()},
+		Handler: func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {
+			// Read the first half of a message and signal that we're in the middle
+			if _, err := conn.Read(make([]byte, 1)); err != nil {
+				processed <- err
+				return
+			}
+			conn.(MessageTracker).MessageStarted()
+			close(started)
+
+			// Read the second half, which should survive draining
+			_, err := conn.Read(make([]byte, 1))
+			conn.(MessageTracker).MessageFinished()
+			processed <- err
+
+			// Wait for the next message, which should be interrupted
+			_, err = conn.Read(make([]byte, 1))
+			processed <- err
+		},
+	})
+	defer peers.Close()
+
+	// Establish a connection and send over the first half of a message
+	local, remote := net.Pipe()
+
+	done := make(chan error, 1)
+	go peers.handle(tls.Client(local, &tls.Config{
+		Certificates:       []tls.Certificate{localId.certificate()},
+		InsecureSkipVerify: true,
+	}), done, nil)
+
+	conn := tls.Server(remote, &tls.Config{
+		Certificates: []tls.Certificate{remoteId.certificate()},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	defer conn.Close()
+
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("Failed to run TLS handshake: %v", err)
+	}
+	helo := make([]byte, len(protocolMagic))
+	sent := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte(protocolMagic))
+		sent <- err
+	}()
+	if _, err := conn.Read(helo); err != nil {
+		t.Fatalf("Failed to read protocol magic: %v", err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("Failed to send protocol magic: %v", err)
+	}
+	if _, err := conn.Write([]byte{0x01}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	go ioutil.ReadAll(conn) // Consume the close notification on teardown
+	select {
+	case <-started:
+	case err := <-processed:
+		t.Fatalf("Handler failed: %v", err)
+	case <-time.After(time.Second):
+		t.Fatalf("Handler didn't start reading")
+	}
+	// Start draining and only afterwards send the second half of the message
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	drained := make(chan error, 1)
+	go func() { drained <- peers.Drain(ctx) }()
+
+	time.Sleep(50 * time.Millisecond)
+	if _, err := conn.Write([]byte{0x02}); err != nil {
+		t.Fatalf("Failed to send message remainder: %v", err)
+	}
+	if err := <-processed; err != nil {
+		t.Fatalf("Partial message interrupted: %v", err)
+	}
+	if err := <-processed; err != ErrDraining {
+		t.Fatalf("Idle read error mismatch: have %v, want %v", err, ErrDraining)
+	}
+	if err := <-drained; err != nil {
+		t.Fatalf("Failed to drain peer set: %v", err)
+	}
+}
+
+// Tests that the peer set reports the connection limits it was configured with.
+func TestPeerSetTimeouts(t *testing.T) {
+	peers := NewPeerSet(PeerSetConfig{Timeout: time.Minute, Lifetime: time.Hour})
+	if idle, lifetime := peers.Timeouts(); idle != time.Minute || lifetime != time.Hour {
+		t.Fatalf("timeouts mismatch: have %v/%v, want %v/%v", idle, lifetime, time.Minute, time.Hour)
+	}
+}
+
+// Tests that the peer set rejects new peers over its connection cap, admitting
+// them again once a slot frees up.
+func TestPeerSetLimits(t *testing.T) {
+	// Set up the crypto identities and a peer set trusting the remote sides
+	localId, _ := GenerateIdentity()
+	aliceId, _ := GenerateIdentity()
+	bobId, _ := GenerateIdentity()
+
+	release := make(chan struct{})
+	peers := NewPeerSet(PeerSetConfig{
+		Trusted:  []PublicIdentity{aliceId.Public(), bobId.Public()},
+		Handler:  func(id IdentityFingerprint, conn net.Conn, logger log.Logger) { <-release },
+		MaxConns: 1,
+	})
+	defer peers.Close()
+
+	// Create a connector running the TLS handshake from a remote identity
+	connect := func(id SecretIdentity) (*tls.Conn, chan error) {
+		local, remote := net.Pipe()
+
+		done := make(chan error, 1)
+		go peers.handle(tls.Client(local, &tls.Config{
+			Certificates:       []tls.Certificate{localId.certificate()},
+			InsecureSkipVerify: true,
+		}), done, nil)
+
+		conn := tls.Server(remote, &tls.Config{
+			Certificates: []tls.Certificate{id.certificate()},
+			ClientAuth:   tls.RequireAnyClientCert,
+		})
+		if err := conn.Handshake(); err != nil {
+			t.Fatalf("Failed to run TLS handshake: %v", err)
+		}
+		return conn, done
+	}
+	// Connect the first peer, filling up the peer set
+	alice, aliceDone := connect(aliceId)
+	for i := 0; i < 100 && !peers.Connected(aliceId.Fingerprint()); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if !peers.Connected(aliceId.Fingerprint()) {
+		t.Fatalf("Connection not tracked")
+	}
+	// Ensure a second distinct peer is rejected
+	bob, bobDone := connect(bobId)
+	defer bob.Close()
+
+	if err := <-bobDone; err != ErrPeerLimit {
+		t.Fatalf("Over-limit error mismatch: have %v, want %v", err, ErrPeerLimit)
+	}
+	// Tear down the first peer and ensure its slot is freed up for the second
+	alice.Close()
+	close(release)
+	<-aliceDone
+
+	bob, _ = connect(bobId)
+	defer bob.Close()
+
+	for i := 0; i < 100 && !peers.Connected(bobId.Fingerprint()); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if !peers.Connected(bobId.Fingerprint()) {
+		t.Fatalf("Connection not tracked after slot freed")
+	}
+}
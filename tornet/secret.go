@@ -0,0 +1,84 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package tornet
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+
+	"filippo.io/edwards25519"
+)
+
+// ErrMalformedSecret is returned if a pairing or checkin secret (usually scanned
+// from a QR code) is of the wrong length or contains invalid keys.
+var ErrMalformedSecret = errors.New("malformed secret")
+
+// validPublicKey checks whether a blob is a well formed Ed25519 public key, i.e.
+// it's of the correct length, is the canonical encoding of a point on the curve
+// and that point is not of small order (which would make any signature trivially
+// forgeable against it).
+func validPublicKey(key []byte) bool {
+	if len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	point, err := new(edwards25519.Point).SetBytes(key)
+	if err != nil {
+		return false
+	}
+	// The decoder accepts non-canonical encodings, reject them explicitly
+	if !bytes.Equal(point.Bytes(), key) {
+		return false
+	}
+	return new(edwards25519.Point).MultByCofactor(point).Equal(edwards25519.NewIdentityPoint()) == 0
+}
+
+// ValidatePairingSecret checks that the components of a pairing secret are well
+// formed, so that a dial is not even attempted with junk.
+func ValidatePairingSecret(secret SecretIdentity, address PublicAddress) error {
+	if len(secret) != ed25519.SeedSize || !validPublicKey(address) {
+		return ErrMalformedSecret
+	}
+	return nil
+}
+
+// ParsePairingSecret splits a serialized pairing secret into its temporary
+// identity and onion address, validating them in the process.
+func ParsePairingSecret(blob []byte) (SecretIdentity, PublicAddress, error) {
+	if len(blob) != ed25519.SeedSize+ed25519.PublicKeySize {
+		return nil, nil, ErrMalformedSecret
+	}
+	secret := SecretIdentity(blob[:ed25519.SeedSize])
+	address := PublicAddress(blob[ed25519.SeedSize:])
+
+	if err := ValidatePairingSecret(secret, address); err != nil {
+		return nil, nil, err
+	}
+	return secret, address, nil
+}
+
+// ValidateCheckinSecret checks that the components of a checkin secret are well
+// formed, so that a dial is not even attempted with junk.
+func ValidateCheckinSecret(id PublicIdentity, address PublicAddress, auth SecretIdentity) error {
+	if !validPublicKey(id) || !validPublicKey(address) || len(auth) != ed25519.SeedSize {
+		return ErrMalformedSecret
+	}
+	return nil
+}
+
+// ParseCheckinSecret splits a serialized checkin secret into the event identity,
+// its onion address and the checkin authorization, validating them in the process.
+func ParseCheckinSecret(blob []byte) (PublicIdentity, PublicAddress, SecretIdentity, error) {
+	if len(blob) != 2*ed25519.PublicKeySize+ed25519.SeedSize {
+		return nil, nil, nil, ErrMalformedSecret
+	}
+	id := PublicIdentity(blob[:ed25519.PublicKeySize])
+	address := PublicAddress(blob[ed25519.PublicKeySize : 2*ed25519.PublicKeySize])
+	auth := SecretIdentity(blob[2*ed25519.PublicKeySize:])
+
+	if err := ValidateCheckinSecret(id, address, auth); err != nil {
+		return nil, nil, nil, err
+	}
+	return id, address, auth, nil
+}
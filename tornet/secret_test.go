@@ -0,0 +1,114 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package tornet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Tests that pairing and checkin secrets are parsed back into their components
+// if well formed, and rejected if their lengths or keys are invalid.
+func TestParseSecrets(t *testing.T) {
+	identity, _ := GenerateIdentity()
+	address, _ := GenerateAddress()
+	auth, _ := GenerateIdentity()
+
+	// Invalid keys: y = 2 is not on the curve, y = 2^255 - 1 is out of the field
+	offcurve := make([]byte, 32)
+	offcurve[0] = 2
+
+	overflow := bytes.Repeat([]byte{0xff}, 32)
+	overflow[31] = 0x7f
+
+	// Pairing secrets
+	pairing := append(append([]byte{}, auth...), address.Public()...)
+	if secret, addr, err := ParsePairingSecret(pairing); err != nil {
+		t.Fatalf("Failed to parse pairing secret: %v", err)
+	} else if !bytes.Equal(secret, auth) || !bytes.Equal(addr, address.Public()) {
+		t.Fatalf("Pairing secret mismatch: have %x/%x, want %x/%x", secret, addr, auth, address.Public())
+	}
+	for i, blob := range [][]byte{
+		nil,
+		pairing[:63],
+		append(append([]byte{}, pairing...), 0),
+		append(append([]byte{}, auth...), offcurve...),
+		append(append([]byte{}, auth...), overflow...),
+	} {
+		if _, _, err := ParsePairingSecret(blob); err != ErrMalformedSecret {
+			t.Errorf("Pairing secret %d: error mismatch: have %v, want %v", i, err, ErrMalformedSecret)
+		}
+	}
+	// Checkin secrets
+	checkin := append(append(append([]byte{}, identity.Public()...), address.Public()...), auth...)
+	if id, addr, secret, err := ParseCheckinSecret(checkin); err != nil {
+		t.Fatalf("Failed to parse checkin secret: %v", err)
+	} else if !bytes.Equal(id, identity.Public()) || !bytes.Equal(addr, address.Public()) || !bytes.Equal(secret, auth) {
+		t.Fatalf("Checkin secret mismatch: have %x/%x/%x, want %x/%x/%x", id, addr, secret, identity.Public(), address.Public(), auth)
+	}
+	for i, blob := range [][]byte{
+		nil,
+		checkin[:95],
+		append(append([]byte{}, checkin...), 0),
+		append(append(append([]byte{}, offcurve...), address.Public()...), auth...),
+		append(append(append([]byte{}, identity.Public()...), overflow...), auth...),
+	} {
+		if _, _, _, err := ParseCheckinSecret(blob); err != ErrMalformedSecret {
+			t.Errorf("Checkin secret %d: error mismatch: have %v, want %v", i, err, ErrMalformedSecret)
+		}
+	}
+	// Random keys should always be accepted
+	for i := 0; i < 100; i++ {
+		key, _ := GenerateIdentity()
+		if !validPublicKey(key.Public()) {
+			t.Fatalf("Random key %d rejected: %x", i, key.Public())
+		}
+	}
+}
+
+// Tests that public key validation accepts canonical encodings of proper curve
+// points and rejects anything off-curve, non-canonical or of small order.
+func TestValidPublicKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		// Base point and a RFC 8032 test vector key
+		{"5866666666666666666666666666666666666666666666666666666666666666", true},
+		{"d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a", true},
+
+		// Wrong lengths
+		{"", false},
+		{"58666666666666666666666666666666666666666666666666666666666666", false},
+		{"586666666666666666666666666666666666666666666666666666666666666666", false},
+
+		// Not on the curve (y = 2)
+		{"0200000000000000000000000000000000000000000000000000000000000000", false},
+
+		// Non-canonical: y = p + 1, y = 2^255 - 1 and x = -0 for y = 1
+		{"eeffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f", false},
+		{"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f", false},
+		{"0100000000000000000000000000000000000000000000000000000000000080", false},
+
+		// Small order: identity, order 2, order 4 and order 8 points
+		{"0100000000000000000000000000000000000000000000000000000000000000", false},
+		{"ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f", false},
+		{"0000000000000000000000000000000000000000000000000000000000000000", false},
+		{"0000000000000000000000000000000000000000000000000000000000000080", false},
+		{"c7176a703d4dd84fba3c0b760d10670f2a2053fa2c39ccc64ec7fd7792ac037a", false},
+		{"c7176a703d4dd84fba3c0b760d10670f2a2053fa2c39ccc64ec7fd7792ac03fa", false},
+		{"26e8958fc2b227b045c3f489f2ef98f0d5dfac05d3c63339b13802886d53fc05", false},
+		{"26e8958fc2b227b045c3f489f2ef98f0d5dfac05d3c63339b13802886d53fc85", false},
+	}
+	for i, tt := range tests {
+		key, err := hex.DecodeString(tt.key)
+		if err != nil {
+			t.Fatalf("Test %d: failed to decode key: %v", i, err)
+		}
+		if valid := validPublicKey(key); valid != tt.valid {
+			t.Errorf("Test %d: validity mismatch: have %v, want %v", i, valid, tt.valid)
+		}
+	}
+}
@@ -19,6 +19,24 @@ import (
 	"github.com/ethereum/go-ethereum/log"
 )
 
+var (
+	// ErrUnreachable is returned if a remote onion service cannot be connected
+	// to, either because it does not exist or because it's offline.
+	ErrUnreachable = errors.New("onion unreachable")
+
+	// ErrInvalidKeyType is returned if the remote side of a connection presents
+	// a certificate with a public key other than Ed25519.
+	ErrInvalidKeyType = errors.New("invalid public key type")
+
+	// ErrUnexpectedServer is returned if a dialed server authenticates with a
+	// different identity than the one expected.
+	ErrUnexpectedServer = errors.New("unexpected server key")
+
+	// ErrUnauthorizedKey is returned if the remote side of a connection presents
+	// a certificate with a public key not authorized in the peer set.
+	ErrUnauthorizedKey = errors.New("unauthorized public key")
+)
+
 // ServerConfig can be used to fine tune the initial setup of a tornet server.
 type ServerConfig struct {
 	Gateway  Gateway        // Tor gateway to open the listener through
@@ -85,7 +103,7 @@ func NewServer(config ServerConfig) (*Server, error) {
 			// We only use Ed25519 curves, discard any connections not speaking it
 			pub, ok := cert.PublicKey.(ed25519.PublicKey)
 			if !ok {
-				return errors.New("invalid public key type")
+				return ErrInvalidKeyType
 			}
 			// The certificate has the right crypto, authenticate the public key
 			// against the local key ring.
@@ -96,7 +114,7 @@ func NewServer(config ServerConfig) (*Server, error) {
 			config.PeerSet.lock.RUnlock()
 
 			if !authorized {
-				return fmt.Errorf("unauthorized public key: %s", uid)
+				return fmt.Errorf("%w: %s", ErrUnauthorizedKey, uid)
 			}
 			// Public key authorized, validate the self-signed certificate
 			return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
@@ -116,7 +134,7 @@ func (s *Server) loop(peerset *PeerSet) {
 	for err == nil {
 		var conn net.Conn
 		if conn, err = s.listener.Accept(); err == nil {
-			go peerset.handle(conn, make(chan error, 1)) // We don't care about the error
+			peerset.accept(conn)
 		}
 	}
 	// Something went wrong, terminate
@@ -170,7 +188,7 @@ func DialServer(ctx context.Context, config DialConfig) (chan error, error) {
 	onion := torutil.OnionServiceIDFromPublicKey(tored25519.FromCryptoPublicKey(ed25519.PublicKey(config.Address)))
 	conn, err := dialer.Dial("tcp", fmt.Sprintf("%s.onion:1", onion))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrUnreachable, err)
 	}
 	// Wrap the connection into a TLS client to ensure mutual authentication
 	done := make(chan error, 1) // TODO(karalabe): Bleah, this is one ugly hack
@@ -195,11 +213,11 @@ func DialServer(ctx context.Context, config DialConfig) (chan error, error) {
 			// We only use Ed25519 curves, discard any connections not speaking it
 			pub, ok := cert.PublicKey.(ed25519.PublicKey)
 			if !ok {
-				return errors.New("invalid public key type")
+				return ErrInvalidKeyType
 			}
 			// The certificate has the right crypto, authenticate it
 			if !bytes.Equal(pub, config.Server) {
-				return errors.New("unexpected server key")
+				return ErrUnexpectedServer
 			}
 			// Double check against the local keyring, don't permit insecure connections
 			uid := PublicIdentity(pub).Fingerprint()
@@ -209,11 +227,11 @@ func DialServer(ctx context.Context, config DialConfig) (chan error, error) {
 			config.PeerSet.lock.RUnlock()
 
 			if !authorized {
-				return errors.New("unauthorized public key")
+				return ErrUnauthorizedKey
 			}
 			// Public key authorized, validate the self-signed certificate
 			return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
 		},
-	}), done)
+	}), done, nil)
 	return done, nil
 }
@@ -5,10 +5,15 @@ package tornet
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
 	"net"
 	"testing"
 	"time"
 
+	"github.com/cretz/bine/torutil"
+	tored25519 "github.com/cretz/bine/torutil/ed25519"
 	"github.com/ethereum/go-ethereum/log"
 )
 
@@ -70,3 +75,186 @@ func TestServerConnectivity(t *testing.T) {
 		}
 	}
 }
+
+// Tests that a flood of inbound connections is capped by the number of handshakes
+// permitted to run concurrently, with excess connections dropped right away.
+func TestServerHandshakeLimit(t *testing.T) {
+	// Set up the crypto identities and trusts
+	var (
+		gateway       = NewMockGateway()
+		serverId, _   = GenerateIdentity()
+		serverAddr, _ = GenerateAddress()
+		clientId, _   = GenerateIdentity()
+	)
+	// Create a server that permits only a few concurrent handshakes
+	serverNotify := make(chan struct{}, 1)
+	serverPeers := NewPeerSet(PeerSetConfig{
+		Trusted: []PublicIdentity{clientId.Public()},
+		Handler: func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {
+			serverNotify <- struct{}{}
+		},
+		MaxConcurrentHandshakes: 4,
+	})
+	server, err := NewServer(ServerConfig{
+		Gateway:  gateway,
+		Address:  serverAddr,
+		Identity: serverId,
+		PeerSet:  serverPeers,
+	})
+	if err != nil {
+		t.Fatalf("Failed to launch server: %v", err)
+	}
+	defer server.Close()
+
+	// Flood the server with connections that never start a handshake, tracking
+	// the number of handshakes running concurrently meanwhile
+	var (
+		peak    = make(chan int)
+		stopped = make(chan struct{})
+	)
+	go func() {
+		var max int
+		for {
+			if n := len(serverPeers.handshakes); n > max {
+				max = n
+			}
+			select {
+			case <-stopped:
+				peak <- max
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	dialer, _ := gateway.Dialer(context.Background(), nil)
+	onion := torutil.OnionServiceIDFromPublicKey(tored25519.FromCryptoPublicKey(ed25519.PublicKey(serverAddr.Public())))
+
+	conns := make([]net.Conn, 32)
+	for i := range conns {
+		if conns[i], err = dialer.Dial("tcp", fmt.Sprintf("%s.onion:1", onion)); err != nil {
+			t.Fatalf("Failed to dial server: %v", err)
+		}
+		defer conns[i].Close()
+	}
+	// Ensure only the permitted number of connections were kept alive
+	var alive []net.Conn
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				alive = append(alive, conn)
+			}
+		}
+	}
+	close(stopped)
+	if max := <-peak; max > 4 {
+		t.Fatalf("Concurrent handshakes exceeded cap: have %d, want <= %d", max, 4)
+	}
+	if len(alive) != 4 {
+		t.Fatalf("Alive connection count mismatch: have %d, want %d", len(alive), 4)
+	}
+	// Drop the flood and ensure legitimate clients can connect again
+	for _, conn := range alive {
+		conn.Close()
+	}
+	for i := 0; i < 100 && len(serverPeers.handshakes) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	clientPeers := NewPeerSet(PeerSetConfig{
+		Trusted: []PublicIdentity{serverId.Public()},
+		Handler: func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {},
+	})
+	if _, err := DialServer(context.Background(), DialConfig{
+		Gateway:  gateway,
+		Address:  serverAddr.Public(),
+		Server:   serverId.Public(),
+		Identity: clientId,
+		PeerSet:  clientPeers,
+	}); err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	select {
+	case <-serverNotify:
+	case <-time.After(time.Second):
+		t.Fatalf("Connection timed out")
+	}
+}
+
+// Tests that dial failures are classified, differentiating between unreachable
+// servers and authentication failures after connecting.
+func TestServerDialErrors(t *testing.T) {
+	// Set up the crypto identities and trusts
+	var (
+		gateway       = NewMockGateway()
+		serverId, _   = GenerateIdentity()
+		serverAddr, _ = GenerateAddress()
+		clientId, _   = GenerateIdentity()
+		strangerId, _ = GenerateIdentity()
+	)
+	clientPeers := NewPeerSet(PeerSetConfig{
+		Trusted: []PublicIdentity{serverId.Public(), strangerId.Public()},
+		Handler: func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {},
+	})
+	// Ensure dialing an offline server is reported as unreachable
+	if _, err := DialServer(context.Background(), DialConfig{
+		Gateway:  gateway,
+		Address:  serverAddr.Public(),
+		Server:   serverId.Public(),
+		Identity: clientId,
+		PeerSet:  clientPeers,
+	}); !errors.Is(err, ErrUnreachable) {
+		t.Fatalf("Offline dial error mismatch: have %v, want %v", err, ErrUnreachable)
+	}
+	// Start a server not trusting the client and ensure it's reported as rejected
+	serverPeers := NewPeerSet(PeerSetConfig{
+		Handler: func(id IdentityFingerprint, conn net.Conn, logger log.Logger) {},
+	})
+	server, err := NewServer(ServerConfig{
+		Gateway:  gateway,
+		Address:  serverAddr,
+		Identity: serverId,
+		PeerSet:  serverPeers,
+	})
+	if err != nil {
+		t.Fatalf("Failed to launch server: %v", err)
+	}
+	defer server.Close()
+
+	done, err := DialServer(context.Background(), DialConfig{
+		Gateway:  gateway,
+		Address:  serverAddr.Public(),
+		Server:   serverId.Public(),
+		Identity: clientId,
+		PeerSet:  clientPeers,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrRejected) {
+			t.Fatalf("Untrusted dial error mismatch: have %v, want %v", err, ErrRejected)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Untrusted dial timed out")
+	}
+	// Ensure a server authenticating with an unexpected identity is rejected
+	done, err = DialServer(context.Background(), DialConfig{
+		Gateway:  gateway,
+		Address:  serverAddr.Public(),
+		Server:   strangerId.Public(),
+		Identity: clientId,
+		PeerSet:  clientPeers,
+	})
+	if err != nil {
+		t.Fatalf("Failed to dial server: %v", err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrUnexpectedServer) {
+			t.Fatalf("Impersonated dial error mismatch: have %v, want %v", err, ErrUnexpectedServer)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Impersonated dial timed out")
+	}
+}
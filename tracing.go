@@ -0,0 +1,32 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import "github.com/coronanet/go-coronanet/protocols"
+
+// SetTracer sets (or with nil, removes) a debug tracer to observe the messages
+// of the contact and event protocols. It takes effect for all connections that
+// are established after the call.
+func (b *Backend) SetTracer(tracer protocols.Tracer) {
+	b.tracer.Store(tracer)
+}
+
+// Tracer returns the currently configured protocol message tracer, if any.
+//
+// Note, the method is called on every new connection, so it deliberately does
+// not touch the backend lock to avoid blocking the networking on it.
+func (b *Backend) Tracer() protocols.Tracer {
+	tracer, _ := b.tracer.Load().(protocols.Tracer)
+	return tracer
+}
+
+// Tracer returns the protocol message tracer to observe event connections with.
+func (h *eventHost) Tracer() protocols.Tracer {
+	return (*Backend)(h).Tracer()
+}
+
+// Tracer returns the protocol message tracer to observe event connections with.
+func (g *eventGuest) Tracer() protocols.Tracer {
+	return (*Backend)(g).Tracer()
+}
@@ -0,0 +1,49 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/protocols"
+	"github.com/coronanet/go-coronanet/protocols/corona"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that a tracer set on the backend observes the contact protocol messages
+// of new connections, with the message texts redacted.
+func TestBackendTracer(t *testing.T) {
+	alice, bob, teardown := newTestContacts(t)
+	defer teardown()
+
+	// Trace all the messages alice receives over the corona protocol
+	texts := make(chan string, 16)
+	alice.SetTracer(func(dir protocols.Direction, proto string, uid tornet.IdentityFingerprint, msg interface{}) {
+		if envelope, ok := msg.(*corona.Envelope); ok && dir == protocols.Inbound && envelope.Message != nil {
+			texts <- envelope.Message.Text
+		}
+	})
+	// Connect the two users and send a message to alice
+	aliceId, bobId := newTestRemote(t, alice), newTestRemote(t, bob)
+	if _, err := alice.AddContact(bobId); err != nil {
+		t.Fatalf("failed to add bob to alice: %v", err)
+	}
+	if _, err := bob.AddContact(aliceId); err != nil {
+		t.Fatalf("failed to add alice to bob: %v", err)
+	}
+	waitTestConnection(t, bob, aliceId.Identity.Fingerprint())
+
+	if err := bob.SendMessage(aliceId.Identity.Fingerprint(), "Hello Alice"); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	select {
+	case text := <-texts:
+		if text != "<redacted 11 bytes>" {
+			t.Fatalf("traced text mismatch: have %s, want %s", text, "<redacted 11 bytes>")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not traced")
+	}
+}
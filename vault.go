@@ -0,0 +1,348 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	// dbVaultKey is the database key for storing the key derivation parameters
+	// of the at-rest encryption. If missing, secret records are in plaintext.
+	dbVaultKey = []byte("vault")
+
+	// ErrBadPassphrase is returned if the database is attempted to be opened or
+	// re-encrypted with a passphrase that does not match the one it's sealed with.
+	ErrBadPassphrase = errors.New("bad passphrase")
+)
+
+const (
+	// vaultSealedMarker is the leading byte of sealed database records. Since all
+	// plaintext records are JSON objects, it can never clash with one.
+	vaultSealedMarker = 0x00
+
+	// vaultSaltLength is the number of random bytes to salt the passphrase based
+	// key derivation with.
+	vaultSaltLength = 16
+
+	// vaultCheckPlaintext is the content of the sealed record used to verify that
+	// a passphrase is correct, even if there are no secret records stored yet.
+	vaultCheckPlaintext = "coronanet"
+
+	// vaultScryptN, vaultScryptR and vaultScryptP are the scrypt parameters for
+	// deriving the encryption key from the user's passphrase.
+	vaultScryptN = 1 << 15
+	vaultScryptR = 8
+	vaultScryptP = 1
+)
+
+// vaultSecretKeys are the exact database keys holding secret-bearing records.
+var vaultSecretKeys = [][]byte{dbProfileKey, dbInfectionKey}
+
+// vaultSecretPrefixes are the database key prefixes of the secret-bearing records.
+var vaultSecretPrefixes = [][]byte{
+	dbHostedEventPrefix, dbHostedHistoryPrefix, dbJoinedEventPrefix,
+	dbMessagePrefix, dbOutboxPrefix, dbEventReportPrefix,
+}
+
+// vaultRecord is the persisted configuration of the at-rest encryption.
+type vaultRecord struct {
+	Salt  []byte `json:"salt"`  // Salt to derive the encryption key with
+	Check []byte `json:"check"` // Sealed known plaintext to verify the passphrase
+}
+
+// vault is an authenticated cipher derived from the user's passphrase to seal
+// and open secret database records with.
+type vault struct {
+	salt []byte      // Salt the key was derived with
+	key  []byte      // Derived symmetric key, for verifying passphrases
+	aead cipher.AEAD // Authenticated cipher to seal and open records with
+}
+
+// newVault derives the encryption key from a passphrase and salt, and creates
+// an authenticated cipher from it.
+func newVault(passphrase string, salt []byte) (*vault, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, vaultScryptN, vaultScryptR, vaultScryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &vault{salt: salt, key: key, aead: aead}, nil
+}
+
+// seal encrypts a database record. The output is the sealed marker, followed
+// by the nonce and the sealed data. A nil vault leaves the record in plaintext.
+func (v *vault) seal(blob []byte) ([]byte, error) {
+	if v == nil {
+		return blob, nil
+	}
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append([]byte{vaultSealedMarker}, nonce...)
+	return v.aead.Seal(sealed, nonce, blob, nil), nil
+}
+
+// open decrypts a database record sealed by seal. Plaintext records are passed
+// through as is, since they might predate the encryption being enabled.
+func (v *vault) open(blob []byte) ([]byte, error) {
+	if len(blob) == 0 || blob[0] != vaultSealedMarker {
+		return blob, nil
+	}
+	if v == nil {
+		return nil, ErrBadPassphrase
+	}
+	blob = blob[1:]
+	if len(blob) < v.aead.NonceSize() {
+		return nil, ErrBadPassphrase
+	}
+	plain, err := v.aead.Open(nil, blob[:v.aead.NonceSize()], blob[v.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+	return plain, nil
+}
+
+// openVault derives the at-rest encryption key from the user's passphrase and
+// verifies it against the database. If the database was not yet encrypted but
+// a passphrase is given, all the secret records are sealed. An empty passphrase
+// keeps everything in plaintext.
+//
+// Note, this method is meant to be called on startup, before anything else is
+// accessing the database.
+func (b *Backend) openVault(passphrase string) error {
+	blob, err := b.database.Get(dbVaultKey, nil)
+	if err == leveldb.ErrNotFound {
+		if passphrase == "" {
+			return nil
+		}
+		b.logger.Info("Enabling database encryption")
+		return b.changeVault(nil, passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	if passphrase == "" {
+		return ErrBadPassphrase
+	}
+	record := new(vaultRecord)
+	if err := json.Unmarshal(blob, record); err != nil {
+		return err
+	}
+	v, err := newVault(passphrase, record.Salt)
+	if err != nil {
+		return err
+	}
+	if check, err := v.open(record.Check); err != nil || string(check) != vaultCheckPlaintext {
+		return ErrBadPassphrase
+	}
+	b.vault = v
+	return nil
+}
+
+// ChangePassphrase re-encrypts all the secret records in the database with a new
+// passphrase. An empty new passphrase disables the encryption, storing everything
+// in plaintext; an empty old one is expected if encryption was not yet enabled.
+//
+// In multi-profile mode all the profiles share the same passphrase, so the ones
+// not currently active are re-encrypted too.
+func (b *Backend) ChangePassphrase(oldPass, newPass string) error {
+	b.logger.Info("Changing database passphrase")
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.vaultLock.Lock()
+	defer b.vaultLock.Unlock()
+
+	// Make sure the old passphrase matches the current one
+	switch {
+	case b.vault == nil && oldPass != "":
+		return ErrBadPassphrase
+	case b.vault != nil:
+		if oldPass == "" {
+			return ErrBadPassphrase
+		}
+		v, err := newVault(oldPass, b.vault.salt)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare(v.key, b.vault.key) != 1 {
+			return ErrBadPassphrase
+		}
+	}
+	// Unlock all the inactive profiles before touching anything, so a profile
+	// with a mismatching passphrase can't leave the others half re-encrypted
+	var inactive []*Backend
+	defer func() {
+		for _, scratch := range inactive {
+			scratch.database.Close()
+		}
+	}()
+	for _, id := range b.Profiles() {
+		if id == b.profileID {
+			continue
+		}
+		db, err := leveldb.OpenFile(profileDatabase(b.datadir, id), &opt.Options{})
+		if err != nil {
+			return err
+		}
+		vault, err := prepareDatabase(db, BackendConfig{Passphrase: oldPass}, b.logger)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		inactive = append(inactive, &Backend{database: db, vault: vault, logger: b.logger})
+	}
+	for _, scratch := range inactive {
+		if err := scratch.changeVault(scratch.vault, newPass); err != nil {
+			return err
+		}
+	}
+	if err := b.changeVault(b.vault, newPass); err != nil {
+		return err
+	}
+	// Subsequent profile switches need to unlock with the new passphrase
+	b.config.Passphrase = newPass
+	return nil
+}
+
+// changeVault re-encrypts all the secret records from an old vault to a new one
+// derived from the given passphrase, atomically swapping the two.
+//
+// Note, this method assumes the vault write lock is held.
+func (b *Backend) changeVault(old *vault, passphrase string) error {
+	// Derive the new vault and its verification record (unless disabling)
+	var (
+		batch = new(leveldb.Batch)
+		fresh *vault
+	)
+	if passphrase == "" {
+		batch.Delete(dbVaultKey)
+	} else {
+		salt := make([]byte, vaultSaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		v, err := newVault(passphrase, salt)
+		if err != nil {
+			return err
+		}
+		check, err := v.seal([]byte(vaultCheckPlaintext))
+		if err != nil {
+			return err
+		}
+		blob, err := json.Marshal(&vaultRecord{Salt: salt, Check: check})
+		if err != nil {
+			return err
+		}
+		batch.Put(dbVaultKey, blob)
+		fresh = v
+	}
+	// Re-encrypt all the secret records with the new vault
+	reseal := func(key, value []byte) error {
+		plain, err := old.open(value)
+		if err != nil {
+			return err
+		}
+		sealed, err := fresh.seal(plain)
+		if err != nil {
+			return err
+		}
+		batch.Put(key, sealed)
+		return nil
+	}
+	for _, key := range vaultSecretKeys {
+		value, err := b.database.Get(key, nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := reseal(key, value); err != nil {
+			return err
+		}
+	}
+	for _, prefix := range vaultSecretPrefixes {
+		it := b.database.NewIterator(util.BytesPrefix(prefix), nil)
+		for it.Next() {
+			if err := reseal(it.Key(), it.Value()); err != nil {
+				it.Release()
+				return err
+			}
+		}
+		it.Release()
+		if err := it.Error(); err != nil {
+			return err
+		}
+	}
+	if err := b.database.Write(batch, &opt.WriteOptions{Sync: true}); err != nil {
+		return err
+	}
+	b.vault = fresh
+	return nil
+}
+
+// getSecret retrieves a secret-bearing record from the database, decrypting it
+// if the database is encrypted at rest.
+func (b *Backend) getSecret(key []byte) ([]byte, error) {
+	b.vaultLock.RLock()
+	defer b.vaultLock.RUnlock()
+
+	blob, err := b.database.Get(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return b.vault.open(blob)
+}
+
+// putSecret stores a secret-bearing record into the database, encrypting it if
+// the database is encrypted at rest.
+func (b *Backend) putSecret(key []byte, blob []byte) error {
+	b.vaultLock.RLock()
+	defer b.vaultLock.RUnlock()
+
+	sealed, err := b.vault.seal(blob)
+	if err != nil {
+		return err
+	}
+	return b.database.Put(key, sealed, nil)
+}
+
+// sealSecret encrypts a secret-bearing record to be written into the database
+// directly (e.g. via a batch or with custom write options).
+func (b *Backend) sealSecret(blob []byte) ([]byte, error) {
+	b.vaultLock.RLock()
+	defer b.vaultLock.RUnlock()
+
+	return b.vault.seal(blob)
+}
+
+// openSecret decrypts a secret-bearing record already retrieved from the database
+// (e.g. via an iterator).
+func (b *Backend) openSecret(blob []byte) ([]byte, error) {
+	b.vaultLock.RLock()
+	defer b.vaultLock.RUnlock()
+
+	return b.vault.open(blob)
+}
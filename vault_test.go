@@ -0,0 +1,146 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/coronanet/go-coronanet/params"
+	"github.com/coronanet/go-coronanet/protocols/corona"
+	"github.com/coronanet/go-coronanet/tornet"
+)
+
+// Tests that enabling the at-rest encryption seals the profile, that it can only
+// be reopened with the correct passphrase and that the passphrase can be changed
+// or removed altogether.
+func TestVaultEncryption(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	keyring := newTestReporter(t, backend)
+
+	// Enable the encryption and ensure the profile is not stored in plaintext
+	if err := backend.openVault("secret"); err != nil {
+		t.Fatalf("failed to enable encryption: %v", err)
+	}
+	blob, err := backend.database.Get(dbProfileKey, nil)
+	if err != nil {
+		t.Fatalf("failed to retrieve raw profile: %v", err)
+	}
+	if json.Valid(blob) || bytes.Contains(blob, []byte("Bob")) {
+		t.Fatalf("profile stored in plaintext: %s", blob)
+	}
+	prof, err := backend.Profile()
+	if err != nil {
+		t.Fatalf("failed to retrieve profile: %v", err)
+	}
+	if prof.Name != "Bob" || !bytes.Equal(prof.KeyRing.Identity, keyring.Identity) {
+		t.Fatalf("profile mismatch: have %s/%x, want %s/%x", prof.Name, prof.KeyRing.Identity, "Bob", keyring.Identity)
+	}
+	// Simulate restarts and ensure only the correct passphrase is accepted
+	for _, passphrase := range []string{"", "wrong"} {
+		backend.vault = nil
+		if err := backend.openVault(passphrase); err != ErrBadPassphrase {
+			t.Fatalf("passphrase %q error mismatch: have %v, want %v", passphrase, err, ErrBadPassphrase)
+		}
+	}
+	if err := backend.openVault("secret"); err != nil {
+		t.Fatalf("failed to reopen encryption: %v", err)
+	}
+	// Change the passphrase and ensure the old one is rejected afterwards
+	if err := backend.ChangePassphrase("wrong", "changed"); err != ErrBadPassphrase {
+		t.Fatalf("change error mismatch: have %v, want %v", err, ErrBadPassphrase)
+	}
+	if err := backend.ChangePassphrase("secret", "changed"); err != nil {
+		t.Fatalf("failed to change passphrase: %v", err)
+	}
+	backend.vault = nil
+	if err := backend.openVault("secret"); err != ErrBadPassphrase {
+		t.Fatalf("old passphrase error mismatch: have %v, want %v", err, ErrBadPassphrase)
+	}
+	if err := backend.openVault("changed"); err != nil {
+		t.Fatalf("failed to reopen with changed passphrase: %v", err)
+	}
+	if prof, err := backend.Profile(); err != nil || prof.Name != "Bob" {
+		t.Fatalf("profile mismatch after change: have %v/%v", prof, err)
+	}
+	// Remove the passphrase and ensure the profile is back in plaintext
+	if err := backend.ChangePassphrase("changed", ""); err != nil {
+		t.Fatalf("failed to remove passphrase: %v", err)
+	}
+	backend.vault = nil
+	if err := backend.openVault(""); err != nil {
+		t.Fatalf("failed to reopen without passphrase: %v", err)
+	}
+	if blob, err = backend.database.Get(dbProfileKey, nil); err != nil {
+		t.Fatalf("failed to retrieve raw profile: %v", err)
+	}
+	if !json.Valid(blob) {
+		t.Fatalf("profile not stored in plaintext: %x", blob)
+	}
+}
+
+// Tests that messages, queued deliveries and the infection history are sealed by
+// the at-rest encryption too, and that they survive a passphrase change.
+func TestVaultEncryptionPrivateRecords(t *testing.T) {
+	backend := newTestBackend(t)
+	defer backend.database.Close()
+
+	newTestReporter(t, backend)
+
+	if err := backend.openVault("secret"); err != nil {
+		t.Fatalf("failed to enable encryption: %v", err)
+	}
+	uid := tornet.IdentityFingerprint("contact")
+	msg := &corona.Message{Text: "Hello Alice", Timestamp: time.Now(), Sequence: 1}
+
+	if _, err := backend.setInfectionStatus(params.InfectionStatusPositive); err != nil {
+		t.Fatalf("failed to declare infection status: %v", err)
+	}
+	if err := backend.storeMessage(uid, &Message{Nonce: msg.Nonce, Text: msg.Text, Time: msg.Timestamp, Outgoing: true}, nil); err != nil {
+		t.Fatalf("failed to store message: %v", err)
+	}
+	if err := backend.queueMessage(uid, msg); err != nil {
+		t.Fatalf("failed to queue message: %v", err)
+	}
+	for _, key := range [][]byte{dbInfectionKey, messageKey(uid, msg.Nonce), outboxKey(uid, msg.Nonce)} {
+		blob, err := backend.database.Get(key, nil)
+		if err != nil {
+			t.Fatalf("failed to retrieve raw record %q: %v", key, err)
+		}
+		if json.Valid(blob) || bytes.Contains(blob, []byte("Hello")) || bytes.Contains(blob, []byte("positive")) {
+			t.Fatalf("record %q stored in plaintext: %s", key, blob)
+		}
+	}
+	// Change the passphrase and ensure everything is still readable
+	if err := backend.ChangePassphrase("secret", "changed"); err != nil {
+		t.Fatalf("failed to change passphrase: %v", err)
+	}
+	backend.vault = nil
+	if err := backend.openVault("changed"); err != nil {
+		t.Fatalf("failed to reopen with changed passphrase: %v", err)
+	}
+	history, err := backend.infectionHistory()
+	if err != nil || len(history) != 1 || history[0].Status != params.InfectionStatusPositive {
+		t.Fatalf("infection history mismatch: have %v/%v", history, err)
+	}
+	queued, err := backend.queuedMessages(uid)
+	if err != nil || len(queued) != 1 || queued[0].Text != msg.Text {
+		t.Fatalf("queued messages mismatch: have %v/%v", queued, err)
+	}
+	if err := backend.acknowledgeMessage(uid, msg.Sequence); err != nil {
+		t.Fatalf("failed to acknowledge message: %v", err)
+	}
+	blob, err := backend.getSecret(messageKey(uid, msg.Nonce))
+	if err != nil {
+		t.Fatalf("failed to retrieve message: %v", err)
+	}
+	stored := new(Message)
+	if err := json.Unmarshal(blob, stored); err != nil || stored.Text != msg.Text || !stored.Delivered {
+		t.Fatalf("stored message mismatch: have %+v/%v", stored, err)
+	}
+}
@@ -0,0 +1,82 @@
+// go-coronanet - Coronavirus social distancing network
+// Copyright (c) 2020 Péter Szilágyi. All rights reserved.
+
+package coronanet
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/coronanet/go-coronanet/tornet"
+	"golang.org/x/crypto/sha3"
+)
+
+// ErrNoteTooLong is returned if a contact verification note is attempted to be
+// set that exceeds the permitted length.
+var ErrNoteTooLong = errors.New("note too long")
+
+// SetContactVerification records whether the identity of a remote contact was
+// verified out-of-band (e.g. by comparing fingerprints in person), along with an
+// optional free form note. The metadata is local only, never sent over the wire.
+func (b *Backend) SetContactVerification(uid tornet.IdentityFingerprint, verified bool, note string) error {
+	b.logger.Info("Updating contact verification", "contact", uid, "verified", verified)
+
+	if len(note) > contactNoteMaxLength {
+		return ErrNoteTooLong
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Retrieve the current profile and abort if the update is a noop
+	info, err := b.Contact(uid)
+	if err != nil {
+		return err
+	}
+	if info.Verified == verified && info.Note == note {
+		return nil
+	}
+	info.Verified, info.Note = verified, note
+
+	blob, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := b.database.Put(append(dbContactPrefix, uid...), blob, nil); err != nil {
+		return err
+	}
+	b.feed.publish(Event{Kind: EventContactUpdated, Contact: uid})
+	return nil
+}
+
+// ContactFingerprint retrieves the human-comparable fingerprint of a remote
+// contact's permanent identity, which both sides can display and compare when
+// verifying each other out-of-band. See formatFingerprint for the format.
+func (b *Backend) ContactFingerprint(uid tornet.IdentityFingerprint) (string, error) {
+	keyring, err := b.ExportContact(uid)
+	if err != nil {
+		return "", err
+	}
+	return formatFingerprint(keyring.Identity), nil
+}
+
+// formatFingerprint converts a public identity into a human-comparable string.
+// The format is stable and must not be changed, since users compare the values
+// shown on different devices (and versions):
+//
+//   - The SHA3-256 hash of the raw public identity is calculated
+//   - The first 20 bytes (160 bits) of the hash are hex encoded in upper case
+//   - The 40 characters are split into 10 groups of 4, separated by spaces
+//
+// E.g. "3F2A 9C01 77B4 E0D2 5A16 C8F9 0B3E 4D71 A2C5 981F".
+func formatFingerprint(id tornet.PublicIdentity) string {
+	hash := sha3.Sum256(id)
+	digits := strings.ToUpper(hex.EncodeToString(hash[:20]))
+
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}